@@ -130,6 +130,14 @@ func (priv *PrivateKey) Unmarshal(g *Group, b []byte) (*PrivateKey, bool) {
 	return priv, true
 }
 
+// Wipe sets the private values in priv to zero. priv cannot be used
+// afterwards.
+func (priv *PrivateKey) Wipe() {
+	wipeInt(priv.xi1)
+	wipeInt(priv.xi2)
+	wipeInt(priv.gamma)
+}
+
 // MemberKey represents a member private key. It is capable of signing messages
 // such that nobody, save the holder of the group private key, can determine
 // which member of the group made the signature.
@@ -139,6 +147,11 @@ type MemberKey struct {
 	a *bn256.G1
 }
 
+// Wipe sets the private value in mem to zero. mem cannot be used afterwards.
+func (mem *MemberKey) Wipe() {
+	wipeInt(mem.x)
+}
+
 // Tag returns an opaque byte slice that identifies the member private key for
 // the purposes of comparing against the result of Open.
 func (mem *MemberKey) Tag() []byte {
@@ -558,3 +571,15 @@ func appendN(b []byte, n *big.Int) []byte {
 	}
 	return append(b, bytes...)
 }
+
+// wipeInt overwrites the memory backing x and sets it to zero.
+func wipeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
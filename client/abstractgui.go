@@ -2,6 +2,11 @@
 
 package main
 
+import (
+	"net/url"
+	"strings"
+)
+
 const uiActionsQueueLen = 256
 
 // GUI contains an abstraction layer that models GTK pretty closely.  This is
@@ -23,6 +28,53 @@ type GUI interface {
 	Run()
 }
 
+// batchGUI wraps a GUI so that a sequence of actions can be flushed with a
+// single Signal, rather than one per action. Outside of a call to Batch it
+// behaves exactly like the wrapped GUI. Like the rest of the GUI client, it
+// must only be used from a single goroutine.
+type batchGUI struct {
+	GUI
+	// depth is the number of calls to Batch that are in progress.
+	depth int
+	// pending is true if a call to Signal has been deferred until the
+	// end of the outermost batch.
+	pending bool
+	// signals counts the calls to Signal that were passed to the wrapped
+	// GUI and coalesced counts those that were absorbed by a batch.
+	signals, coalesced int
+}
+
+func (b *batchGUI) Signal() {
+	if b.depth > 0 {
+		// The GUI only drains the actions queue when signaled, so the
+		// signal can't be deferred once the queue is filling up or
+		// writing further actions would block forever.
+		actions := b.GUI.Actions()
+		if len(actions) < cap(actions)/2 {
+			b.pending = true
+			b.coalesced++
+			return
+		}
+	}
+	b.pending = false
+	b.signals++
+	b.GUI.Signal()
+}
+
+// Batch calls f and then, if f signaled the GUI, signals it once. Batches may
+// be nested, in which case the signal is sent at the end of the outermost
+// one.
+func (b *batchGUI) Batch(f func()) {
+	b.depth++
+	defer func() {
+		b.depth--
+		if b.depth == 0 && b.pending {
+			b.Signal()
+		}
+	}()
+	f()
+}
+
 const (
 	AlignNone = iota
 	AlignStart
@@ -118,6 +170,9 @@ type HBox struct {
 type EventBox struct {
 	widgetBase
 	child Widget
+	// dropFiles causes files that are dragged onto the box to result in
+	// a FilesDropped event.
+	dropFiles bool
 }
 
 type Label struct {
@@ -153,6 +208,8 @@ type Paned struct {
 	widgetBase
 	left  Widget
 	right Widget
+	// position, if non-zero, is the initial position of the divider.
+	position int
 }
 
 type Scrolled struct {
@@ -164,11 +221,15 @@ type Scrolled struct {
 
 type TextView struct {
 	widgetBase
+	// editable, if false, prevents the text from being changed. It can
+	// still be selected and copied.
 	editable       bool
 	text           string
 	wrap           bool
 	updateOnChange bool
-	spellCheck     bool
+	// spellCheck, if true, causes misspelt words to be marked. Only
+	// locally installed dictionaries are consulted.
+	spellCheck bool
 }
 
 type Combo struct {
@@ -214,7 +275,13 @@ type CheckButton struct {
 
 type Image struct {
 	widgetBase
-	image          Indicator
+	image Indicator
+	// png, if not empty, contains a PNG image that is displayed in place
+	// of image.
+	png []byte
+	// icon, if not empty, names an icon from the desktop's icon theme
+	// that is displayed in place of image.
+	icon           string
 	xAlign, yAlign float32
 }
 
@@ -249,6 +316,10 @@ type GridSet struct {
 // Reset replaces the top-level widget with root.
 type Reset struct {
 	root Widget
+	// foreground and background, if non-zero, are the default colors of
+	// text and of the widgets into which text is entered. Widgets that
+	// set their own colors aren't affected.
+	foreground, background uint32
 }
 
 // Append adds widgets to a named, container widget.
@@ -279,6 +350,13 @@ type Sensitive struct {
 	sensitive bool
 }
 
+// SetVisible shows or hides a widget. A hidden widget remains hidden when the
+// rest of the window is shown.
+type SetVisible struct {
+	name    string
+	visible bool
+}
+
 type SetBackground struct {
 	name  string
 	color uint32
@@ -310,11 +388,23 @@ type SetEntry struct {
 type SetTextView struct {
 	name string
 	text string
+	// spans, if not nil, is used instead of text and allows parts of the
+	// text to be colored.
+	spans []TextSpan
+}
+
+// TextSpan is part of the text set by SetTextView. If foreground is non-zero
+// then the text is shown in that color.
+type TextSpan struct {
+	text       string
+	foreground uint32
 }
 
 type SetImage struct {
 	name  string
 	image Indicator
+	// png, if not empty, is shown instead of image.
+	png []byte
 }
 
 type SetFocus struct {
@@ -356,6 +446,20 @@ type SetTitle struct {
 	title string
 }
 
+// SetClipboard replaces the contents of the clipboard with text. The copy is
+// made by the GUI thread so that a large text doesn't block the client.
+type SetClipboard struct {
+	text string
+}
+
+// InterceptClose causes attempts by the user to close the window to result in
+// a CloseRequested event rather than closing it.
+type InterceptClose struct{}
+
+// CloseWindow closes the window, after which the GUI's events channel is
+// closed.
+type CloseWindow struct{}
+
 // UIState is a message that is ignored by a real GUI, but is used for
 // synchronisation with unittests.
 type UIState struct {
@@ -392,6 +496,9 @@ type Click struct {
 	radios      map[string]int
 	calendars   map[string]CalendarDate
 	spinButtons map[string]int
+	// shift and control are true if those keys were held when an EventBox
+	// was clicked.
+	shift, control bool
 }
 
 type CalendarDate struct {
@@ -404,9 +511,59 @@ type Update struct {
 	text string
 }
 
+// LinkClicked results when the user clicks on a link in the markup of a named
+// Label. The GUI never opens the link itself.
+type LinkClicked struct {
+	name string
+	uri  string
+}
+
+// KeyPress results when the user presses a key, with control or alt held,
+// anywhere in the window. key is named as in hotkey.
+type KeyPress struct {
+	key                 string
+	control, alt, shift bool
+}
+
+// CloseRequested results when the user tries to close the window, once
+// InterceptClose has been sent. The window stays open.
+type CloseRequested struct{}
+
+// PanedMoved results when the divider of a named Paned is moved.
+type PanedMoved struct {
+	name     string
+	position int
+}
+
 // OpenResult results from the completion of a file dialog.
 type OpenResult struct {
 	ok   bool
 	path string
 	arg  interface{}
 }
+
+// FilesDropped results when files are dragged onto an EventBox that has
+// dropFiles set.
+type FilesDropped struct {
+	paths []string
+}
+
+// parseURIList returns the paths of the local files in data, which is a
+// text/uri-list as produced by dragging files. Other URIs are ignored.
+func parseURIList(data string) (paths []string) {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme != "file" || len(u.Path) == 0 {
+			continue
+		}
+		if len(u.Host) > 0 && u.Host != "localhost" {
+			continue
+		}
+		paths = append(paths, u.Path)
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/pond/client/disk"
+	pond "github.com/agl/pond/protos"
+)
+
+// archivedMessage returns a copy of msg that is suitable for exporting. The
+// values that only matter to the protocol, such as the sender's next
+// Diffie-Hellman value and the acknowledgements of other messages, are
+// removed since they could link the archive to the sender's keys or to other
+// messages.
+func archivedMessage(msg *pond.Message) *pond.Message {
+	archived := proto.Clone(msg).(*pond.Message)
+	archived.MyNextDh = nil
+	archived.AlsoAck = nil
+	archived.SupportedVersion = nil
+	return archived
+}
+
+// exportMessage writes msg, including any attachments, to path, encrypted with
+// a key derived from passphrase. The archive can be read with importMessage
+// long after msg itself has been erased.
+func (c *client) exportMessage(path, passphrase string, msg *pond.Message) error {
+	serialized, err := proto.Marshal(archivedMessage(msg))
+	if err != nil {
+		return err
+	}
+	archive, err := disk.SealArchive(c.rand, passphrase, serialized)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, archive, 0600)
+}
+
+// importMessage reads a message that was written by exportMessage. It returns
+// disk.BadPasswordError if the passphrase is incorrect and
+// disk.UnsupportedArchiveError if the archive was written by a newer version
+// of Pond.
+func importMessage(path, passphrase string) (*pond.Message, error) {
+	archive, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := disk.OpenArchive(passphrase, archive)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(pond.Message)
+	if err := proto.Unmarshal(serialized, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// addImportedMessage adds a message, read by importMessage, to the inbox as if
+// it had been received from the given contact. The message is marked as
+// retained, since the user has explicitly chosen to keep it, and as acked so
+// that no acknowledgement is sent for it.
+func (c *client) addImportedMessage(msg *pond.Message, from *Contact) (*InboxMessage, error) {
+	for _, candidate := range c.inbox {
+		if candidate.from == from.id && candidate.message != nil && candidate.message.GetId() == msg.GetId() {
+			return nil, errors.New("this message is already in the inbox")
+		}
+	}
+
+	inboxMsg := &InboxMessage{
+		id:           c.randId(),
+		from:         from.id,
+		receivedTime: c.Now(),
+		message:      msg,
+		read:         true,
+		acked:        true,
+		retained:     true,
+	}
+	c.inbox = append(c.inbox, inboxMsg)
+	c.threadInbox(inboxMsg)
+	c.save()
+	return inboxMsg, nil
+}
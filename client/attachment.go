@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"code.google.com/p/goprotobuf/proto"
+	pond "github.com/agl/pond/protos"
+)
+
+// newAttachment returns an attachment containing the given file. It includes
+// a hash of the contents so that the recipient can check that the file is
+// intact with attachmentIntact.
+func newAttachment(filename string, contents []byte) *pond.Message_Attachment {
+	h := sha256.Sum256(contents)
+	return &pond.Message_Attachment{
+		Filename: proto.String(filename),
+		Contents: contents,
+		Sha256:   h[:],
+	}
+}
+
+// attachmentIntact returns false if the contents of a don't match the hash
+// that the sender included. Attachments from older clients don't have a hash
+// and are assumed to be intact.
+func attachmentIntact(a *pond.Message_Attachment) bool {
+	if a.Sha256 == nil {
+		return true
+	}
+	h := sha256.Sum256(a.Contents)
+	return bytes.Equal(h[:], a.Sha256)
+}
@@ -64,7 +64,7 @@ func (c *client) startDecryption(id uint64, outPath, inPath string, detachment *
 }
 
 func (c *client) buildDetachmentURL(id uint64) string {
-	u, err := url.Parse(c.server)
+	u, err := url.Parse(c.homeServer())
 	if err != nil {
 		panic("own server failed to parse as URL")
 	}
@@ -131,6 +131,80 @@ func (c *client) startDownload(id uint64, outPath string, detachment *pond.Messa
 	}
 }
 
+// startAttachmentSave writes contents, the contents of an attachment, to
+// outPath in the background. Progress is reported with the same messages as
+// for detachments. If the save fails or is canceled, the partial file is
+// removed.
+func (c *client) startAttachmentSave(id uint64, outPath string, contents []byte) (cancel func()) {
+	killChan := make(chan bool, 1)
+	go func() {
+		err := saveAttachment(c.backgroundChan, outPath, id, contents, killChan)
+		if err == nil {
+			c.backgroundChan <- DetachmentComplete{id, nil}
+		} else {
+			c.backgroundChan <- DetachmentError{id, err}
+		}
+	}()
+	return func() {
+		killChan <- true
+	}
+}
+
+// attachmentSaveBlockSize is the number of bytes of an attachment that are
+// written between checks for cancelation.
+const attachmentSaveBlockSize = 64 * 1024
+
+func saveAttachment(c chan interface{}, outPath string, id uint64, contents []byte, killChan chan bool) error {
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.New("failed to open output: " + err.Error())
+	}
+
+	var lastUpdate time.Time
+	for done := 0; done < len(contents); {
+		select {
+		case <-killChan:
+			out.Close()
+			os.Remove(outPath)
+			return backgroundCanceledError
+		default:
+			break
+		}
+
+		n := len(contents) - done
+		if n > attachmentSaveBlockSize {
+			n = attachmentSaveBlockSize
+		}
+		if _, err := out.Write(contents[done : done+n]); err != nil {
+			out.Close()
+			os.Remove(outPath)
+			return errors.New("failed to write to destination: " + err.Error())
+		}
+		done += n
+
+		now := time.Now()
+		if lastUpdate.IsZero() || now.Sub(lastUpdate) > 500*time.Millisecond {
+			lastUpdate = now
+			select {
+			case c <- DetachmentProgress{
+				id:     id,
+				done:   uint64(done),
+				total:  uint64(len(contents)),
+				status: "saving",
+			}:
+				break
+			default:
+			}
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(outPath)
+		return errors.New("failed to write to destination: " + err.Error())
+	}
+	return nil
+}
+
 type DetachmentProgress struct {
 	id          uint64
 	done, total uint64
@@ -34,7 +34,10 @@ const (
 var cliCommands = []cliCommand{
 	{"abort", abortCommand{}, "Abort sending the current outbox message", contextOutbox},
 	{"acknowledge", ackCommand{}, "Acknowledge the inbox message", contextInbox},
+	{"add-fallback-server", addFallbackServerCommand{}, "Create an account on a fallback server and list it in new handshakes", 0},
 	{"attach", attachCommand{}, "Attach a file to the current draft", contextDraft},
+	{"backup", backupCommand{}, "Write a backup of the encrypted state file", 0},
+	{"change-server", changeServerCommand{}, "Move your account to a new home server", 0},
 	{"clear", clearCommand{}, "Clear terminal", 0},
 	{"close", closeCommand{}, "Close currently opened object", contextDraft | contextInbox | contextOutbox | contextContact},
 	{"compose", composeCommand{}, "Compose a new message", contextContact},
@@ -47,17 +50,27 @@ var cliCommands = []cliCommand{
 	{"identity", showIdentityCommand{}, "Show identity", 0},
 	{"inbox", showInboxSummaryCommand{}, "Show the Inbox", 0},
 	{"log", logCommand{}, "Show recent log entries", 0},
+	{"mode", modeCommand{}, "Restrict network transactions ('normal', 'fetch-only' or 'send-only')", 0},
 	{"new-contact", newContactCommand{}, "Start a key exchange with a new contact", 0},
 	{"outbox", showOutboxSummaryCommand{}, "Show the Outbox", 0},
+	{"proxy", proxyCommand{}, "Set the SOCKS5 proxy address (host:port, or 'default' to use Tor)", 0},
 	{"queue", showQueueStateCommand{}, "Show the queue", 0},
 	{"quit", quitCommand{}, "Exit Pond", 0},
+	{"quote-replies", quoteRepliesCommand{}, "Include a quoted copy of the original message in replies", 0},
+	{"dont-quote-replies", dontQuoteRepliesCommand{}, "Start replies with an empty body", 0},
+	{"compress-bodies", compressBodiesCommand{}, "Compress message bodies when that makes them smaller", 0},
+	{"dont-compress-bodies", dontCompressBodiesCommand{}, "Always send message bodies uncompressed", 0},
 	{"remove", removeCommand{}, "Remove an attachment or detachment from a draft message", contextDraft},
 	{"rename", renameCommand{}, "Rename an existing contact", contextContact},
+	{"replace", replaceCommand{}, "Upload a numbered detachment again under a new key and revoke the old copy", contextOutbox},
 	{"reply", replyCommand{}, "Reply to the current message", contextInbox},
-	{"retain", retainCommand{}, "Retain the current message", contextInbox},
-	{"dont-retain", dontRetainCommand{}, "Do not retain the current message", contextInbox},
+	{"resend", resendCommand{}, "Send the current outbox message again", contextOutbox},
+	{"retain", retainCommand{}, "Retain the current message", contextInbox | contextOutbox},
+	{"dont-retain", dontRetainCommand{}, "Do not retain the current message", contextInbox | contextOutbox},
+	{"revoke", revokeCommand{}, "Delete a numbered detachment from the server so that it can't be downloaded", contextOutbox},
 	{"save", saveCommand{}, "Save a numbered attachment to disk", contextInbox},
 	{"save-key", saveKeyCommand{}, "Save the key to a detachment to disk", contextInbox},
+	{"save-raw-body", saveRawBodyCommand{}, "Save the undecoded body of a message to disk", contextInbox},
 	{"send", sendCommand{}, "Send the current draft", contextDraft},
 	{"show", showCommand{}, "Show the current object", contextDraft | contextInbox | contextOutbox | contextContact},
 	{"status", statusCommand{}, "Show overall Pond status", 0},
@@ -74,7 +87,12 @@ type deleteCommand struct{}
 type editCommand struct{}
 type logCommand struct{}
 type quitCommand struct{}
+type quoteRepliesCommand struct{}
+type dontQuoteRepliesCommand struct{}
+type compressBodiesCommand struct{}
+type dontCompressBodiesCommand struct{}
 type replyCommand struct{}
+type resendCommand struct{}
 type retainCommand struct{}
 type dontRetainCommand struct{}
 type sendCommand struct{}
@@ -109,6 +127,10 @@ type saveCommand struct {
 	Filename string `cli:"filename"`
 }
 
+type saveRawBodyCommand struct {
+	Filename string `cli:"filename"`
+}
+
 type saveKeyCommand struct {
 	Number   string
 	Filename string `cli:"filename"`
@@ -123,6 +145,34 @@ type removeCommand struct {
 	Number string
 }
 
+type revokeCommand struct {
+	Number string
+}
+
+type replaceCommand struct {
+	Number string
+}
+
+type backupCommand struct {
+	Filename string `cli:"filename"`
+}
+
+type changeServerCommand struct {
+	Server string
+}
+
+type addFallbackServerCommand struct {
+	Server string
+}
+
+type proxyCommand struct {
+	Address string
+}
+
+type modeCommand struct {
+	Mode string
+}
+
 type tagCommand struct {
 	tag string
 }
@@ -3,15 +3,17 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -48,6 +50,10 @@ type cliClient struct {
 	// contact. This flag is cleared after any command that is not a delete
 	// command.
 	deleteArmed bool
+	// changeServerArmed contains the server URL from a change-server
+	// command. A second change-server command for the same URL performs
+	// the change. It is cleared by any other command.
+	changeServerArmed string
 
 	// currentObj is either a *Draft or *InboxMessage and is the object
 	// that the user is currently interacting with.
@@ -142,16 +148,16 @@ func (c *cliClient) Start() {
 	if c.writerChan != nil {
 		c.save()
 	}
+	c.stopNetwork(false)
 	if c.writerChan != nil {
 		close(c.writerChan)
 		<-c.writerDone
 	}
-	if c.fetchNowChan != nil {
-		close(c.fetchNowChan)
-	}
 	if c.stateLock != nil {
 		c.stateLock.Close()
 	}
+	c.releaseInstanceLock()
+	c.wipeKeys()
 }
 
 type terminalWrapper struct {
@@ -409,20 +415,18 @@ func (c *cliClient) createPassphraseUI() (string, error) {
 }
 
 func (c *cliClient) createAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
-	defaultServer := msgDefaultServer
-	if c.dev {
-		defaultServer = msgDefaultDevServer
-	}
+	defaultServer := c.defaultServer()
 
 	c.Printf("%s %s\n", termInfoPrefix, msgCreateAccount)
 	c.Printf("%s\n", termInfoPrefix)
 	c.Printf("%s Either leave this blank to use the default server, enter a pondserver:// address, or type one of the following server nicknames:\n", termInfoPrefix)
-	for _, server := range knownServers {
+	for _, server := range c.serverPresets() {
 		if len(server.nickname) == 0 {
 			continue
 		}
 		c.Printf("%s   %s: %s\n", termInfoPrefix, server.nickname, server.description)
 	}
+	c.Printf("%s Alternatively, enter 'restore <filename>' to restore a backup.\n", termInfoPrefix)
 	c.term.SetPrompt("server> ")
 
 	for {
@@ -430,7 +434,22 @@ func (c *cliClient) createAccountUI(stateFile *disk.StateFile, pw string) (bool,
 		if err != nil {
 			return false, err
 		}
-		for _, server := range knownServers {
+		if strings.HasPrefix(line, "restore ") {
+			if err := c.importBackup(stateFile, strings.TrimSpace(line[8:])); err != nil {
+				c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+				continue
+			}
+			err := c.loadState(stateFile, "")
+			for err == disk.BadPasswordError {
+				err = c.keyPromptUI(stateFile)
+			}
+			if err != nil {
+				return false, err
+			}
+			c.lastErasureStorageTime = time.Now()
+			return true, nil
+		}
+		for _, server := range c.serverPresets() {
 			if line == server.nickname {
 				line = server.uri
 				break
@@ -475,6 +494,87 @@ func (c *cliClient) keyPromptUI(stateFile *disk.StateFile) error {
 	return nil
 }
 
+func (c *cliClient) stateRecoveryUI(loadErr error) (string, error) {
+	c.Printf("%s %s\n", termErrPrefix, terminalEscape(loadErr.Error(), false))
+	c.Printf("%s %s\n", termInfoPrefix, msgCorruptState)
+	c.Printf("%s Enter 'restore <filename>' to restore a backup or 'new' to start afresh.\n", termInfoPrefix)
+	c.term.SetPrompt("recover> ")
+
+	for {
+		line, err := c.term.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "new":
+			return "", nil
+		case strings.HasPrefix(line, "restore "):
+			if path := strings.TrimSpace(line[8:]); len(path) > 0 {
+				return path, nil
+			}
+		}
+		c.Printf("%s Enter 'restore <filename>' or 'new'\n", termWarnPrefix)
+	}
+
+	return "", nil
+}
+
+func (c *cliClient) profileUI(profiles []string) (string, error) {
+	if len(profiles) > 0 {
+		c.Printf("%s Profiles: %s\n", termInfoPrefix, terminalEscape(strings.Join(profiles, ", "), false))
+	}
+	c.Printf("%s Enter the name of a profile to open it or 'new <name>' to create one.\n", termInfoPrefix)
+	c.term.SetPrompt("profile> ")
+
+	for {
+		line, err := c.term.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "new ") {
+			name, err := newProfileName(line[4:], profiles)
+			if err == nil {
+				return name, nil
+			}
+			c.Printf("%s %s\n", termWarnPrefix, err)
+			continue
+		}
+		for _, name := range profiles {
+			if name == line {
+				return name, nil
+			}
+		}
+		c.Printf("%s Unknown profile. Enter the name of a profile or 'new <name>'\n", termWarnPrefix)
+	}
+
+	return "", nil
+}
+
+func (c *cliClient) staleLockUI(owner *disk.InstanceOwner) error {
+	c.Printf("%s %s\n", termWarnPrefix, msgStaleLock)
+	c.Printf("%s It was last used by %s.\n", termInfoPrefix, terminalEscape(owner.String(), false))
+	c.Printf("%s Enter 'continue' to use it anyway or 'quit'.\n", termInfoPrefix)
+	c.term.SetPrompt("locked> ")
+
+	for {
+		line, err := c.term.ReadLine()
+		if err != nil {
+			return err
+		}
+		switch strings.TrimSpace(line) {
+		case "continue":
+			return nil
+		case "quit":
+			return errInterrupted
+		}
+		c.Printf("%s Enter 'continue' or 'quit'\n", termWarnPrefix)
+	}
+
+	return nil
+}
+
 func (c *cliClient) processFetch(inboxMsg *InboxMessage) {
 	if inboxMsg.message != nil && len(inboxMsg.message.Body) == 0 {
 		// Skip acks.
@@ -485,7 +585,12 @@ func (c *cliClient) processFetch(inboxMsg *InboxMessage) {
 		inboxMsg.cliId = c.newCliId()
 	}
 
-	c.Printf("\x07%s (%s) New message (%s%s%s) received from %s\n", termPrefix, time.Now().Format(shortTimeFormat), termCliIdStart, inboxMsg.cliId.String(), termReset, terminalEscape(c.ContactName(inboxMsg.from), false))
+	// Muted contacts don't ring the terminal bell.
+	bell := "\x07"
+	if from, ok := c.contacts[inboxMsg.from]; ok && from.muted {
+		bell = ""
+	}
+	c.Printf("%s%s (%s) New message (%s%s%s) received from %s\n", bell, termPrefix, time.Now().Format(shortTimeFormat), termCliIdStart, inboxMsg.cliId.String(), termReset, terminalEscape(c.ContactName(inboxMsg.from), false))
 }
 
 func (c *cliClient) processServerAnnounce(inboxMsg *InboxMessage) {
@@ -594,6 +699,15 @@ func (c *cliClient) setCurrentObject(o interface{}) {
 }
 
 func (c *cliClient) mainUI() {
+	// Finish any unsealing that was interrupted when the GUI was last
+	// running.
+	if contacts := c.contactsWithSealedMessages(); len(contacts) > 0 {
+		for _, contact := range contacts {
+			c.unsealPendingMessages(contact)
+		}
+		c.save()
+	}
+
 	c.term.SetPrompt(fmt.Sprintf("%s>%s ", termCol1, termReset))
 	c.showState()
 
@@ -630,6 +744,9 @@ func (c *cliClient) mainUI() {
 			if _, ok := line.command.(deleteCommand); !ok {
 				c.deleteArmed = false
 			}
+			if _, ok := line.command.(changeServerCommand); !ok {
+				c.changeServerArmed = ""
+			}
 			if shouldQuit {
 				return
 			}
@@ -642,7 +759,13 @@ func (c *cliClient) mainUI() {
 			}
 		case update := <-c.pandaChan:
 			c.processPANDAUpdate(update)
-		case <-c.backgroundChan:
+		case event := <-c.backgroundChan:
+			if result, ok := event.(serverProbeResult); ok {
+				c.processServerProbe(result)
+			}
+			if result, ok := event.(clockSkewResult); ok {
+				c.processClockSkew(result)
+			}
 		case <-c.log.updateChan:
 		}
 	}
@@ -809,10 +932,14 @@ func (c *cliClient) showIdentity() {
 		heading:      "Identity",
 		rows: []cliRow{
 			cliRow{cols: []string{"Server", terminalEscape(c.server, false)}},
+			cliRow{cols: []string{"Fallback servers", terminalEscape(strings.Join(c.fallbackServers, ", "), false)}},
 			cliRow{cols: []string{"Public identity", fmt.Sprintf("%x", c.identityPublic[:])}},
 			cliRow{cols: []string{"Public key", fmt.Sprintf("%x", c.pub[:])}},
 			cliRow{cols: []string{"State file", terminalEscape(c.stateFilename, false)}},
 			cliRow{cols: []string{"Group generation", fmt.Sprintf("%d", c.generation)}},
+			cliRow{cols: []string{"Proxy", terminalEscape(c.proxyAddr(), false)}},
+			cliRow{cols: []string{"Quote replies", fmt.Sprintf("%t", !c.disableReplyQuoting)}},
+			cliRow{cols: []string{"Compress bodies", fmt.Sprintf("%t", !c.disableBodyCompression)}},
 		},
 	}
 	table.WriteTo(c.term)
@@ -855,7 +982,7 @@ func (c *cliClient) inboxSummary() (table cliTable) {
 			} else if !msg.acked && msg.from != 0 {
 				i = indicatorYellow
 			}
-			subline = time.Unix(*msg.message.Time, 0).Format(shortTimeFormat)
+			subline = messageTimeText(msg.message, shortTimeFormat)
 		}
 		if msg.cliId == invalidCliId {
 			msg.cliId = c.newCliId()
@@ -901,7 +1028,7 @@ func (c *cliClient) outboxSummary() (table cliTable) {
 
 		if msg.revocation {
 			table.rows = append(table.rows, cliRow{
-				msg.indicator(nil),
+				c.outboxIndicator(msg),
 				[]string{
 					"(Revocation)",
 					subline,
@@ -921,7 +1048,7 @@ func (c *cliClient) outboxSummary() (table cliTable) {
 
 		to := c.contacts[msg.to]
 		table.rows = append(table.rows, cliRow{
-			msg.indicator(to),
+			c.outboxIndicator(msg),
 			[]string{
 				terminalEscape(to.name, false),
 				subline,
@@ -979,20 +1106,6 @@ func (c *cliClient) draftsSummary() (table cliTable) {
 	return
 }
 
-type contactList []*Contact
-
-func (cl contactList) Len() int {
-	return len(cl)
-}
-
-func (cl contactList) Less(i, j int) bool {
-	return cl[i].name < cl[j].name
-}
-
-func (cl contactList) Swap(i, j int) {
-	cl[i], cl[j] = cl[j], cl[i]
-}
-
 func (c *cliClient) contactsSummary() (table cliTable) {
 	if len(c.contacts) == 0 {
 		return
@@ -1003,14 +1116,7 @@ func (c *cliClient) contactsSummary() (table cliTable) {
 		rows:    make([]cliRow, 0, len(c.contacts)),
 	}
 
-	contacts := contactList(make([]*Contact, 0, len(c.contacts)))
-	for i := range c.contacts {
-		contacts = append(contacts, c.contacts[i])
-	}
-
-	sort.Sort(contacts)
-
-	for _, contact := range contacts {
+	for _, contact := range c.sortedContacts() {
 		if contact.cliId == invalidCliId {
 			contact.cliId = c.newCliId()
 		}
@@ -1023,7 +1129,7 @@ func (c *cliClient) contactsSummary() (table cliTable) {
 			indicator,
 			[]string{
 				terminalEscape(contact.name, false),
-				contact.subline(),
+				c.contactSubline(contact),
 			},
 			contact.cliId,
 		})
@@ -1048,12 +1154,15 @@ func (c *cliClient) showQueueState() {
 }
 
 func (c *cliClient) printDraftSize(draft *Draft) {
-	usageString, oversize := draft.usageString()
+	usageString, oversize := c.usageString(draft)
 	prefix := termPrefix
 	if oversize {
 		prefix = termErrPrefix
 	}
 	c.Printf("%s Message using %s\n", prefix, usageString)
+	for _, i := range c.oversizeAttachments(draft) {
+		c.Printf("%s Attachment %d, %s, exceeds the size limit. Remove it to send this message.\n", termErrPrefix, i+1, terminalEscape(draft.attachments[i].GetFilename(), false))
+	}
 }
 
 // prepareSubobjectCommand performs the initial processing for a command that
@@ -1079,6 +1188,61 @@ func (c *cliClient) prepareSubobjectCommand(userIndex string, n int, objName str
 	return
 }
 
+// revokeDetachment revokes, and possibly replaces, the numbered detachment in
+// the current outbox message.
+func (c *cliClient) revokeDetachment(number string, replace bool) {
+	msg, ok := c.currentObj.(*queuedMessage)
+	if !ok {
+		c.Printf("%s Select outbox message\n", termWarnPrefix)
+		return
+	}
+	if msg.message == nil {
+		c.Printf("%s That message has no detachments\n", termErrPrefix)
+		return
+	}
+	i, ok := c.prepareSubobjectCommand(number, len(msg.message.DetachedFiles), "detachment")
+	if !ok {
+		return
+	}
+	var ref *detachmentReference
+	for _, candidate := range c.detachmentReferences(msg) {
+		if candidate.index == i {
+			ref = &candidate
+			break
+		}
+	}
+	switch {
+	case ref == nil:
+		c.Printf("%s That detachment wasn't uploaded by you\n", termErrPrefix)
+		return
+	case ref.revoked:
+		c.Printf("%s That detachment has already been revoked\n", termErrPrefix)
+		return
+	case msg.sent.IsZero():
+		c.Printf("%s The message hasn't been sent yet: use 'abort' instead\n", termErrPrefix)
+		return
+	}
+
+	id := c.randId()
+	var newID uint64
+	if replace {
+		newID = c.randId()
+		c.Printf("%s Replacing detachment (Ctrl-C to abort):\n", termPrefix)
+	} else {
+		c.Printf("%s Revoking detachment (Ctrl-C to abort):\n", termPrefix)
+	}
+	cancelThunk := c.startRevocation(id, *ref, msg.message.DetachedFiles[i], newID)
+	replacement, ok := c.runBackgroundProcess(id, cancelThunk)
+	if !ok {
+		return
+	}
+
+	if draft := c.finishRevocation(msg, *ref, replacement); draft != nil {
+		draft.cliId = c.newCliId()
+		c.Printf("%s Created new draft with the replacement: %s%s%s\n", termInfoPrefix, termCliIdStart, draft.cliId.String(), termReset)
+	}
+}
+
 // runBackgroundProcess processes update messages from a background process and
 // displays them.
 func (c *cliClient) runBackgroundProcess(id uint64, cancelThunk func()) (*pond.Message_Detachment, bool) {
@@ -1111,6 +1275,8 @@ func (c *cliClient) runBackgroundProcess(id uint64, cancelThunk func()) (*pond.M
 				c.clearTerminalMessage(lastProgressStringLength)
 				c.Printf("%s Complete\n", termPrefix)
 				return e.detachment, true
+			case clockSkewResult:
+				c.processClockSkew(e)
 			}
 		case <-c.interrupt:
 			cancelThunk()
@@ -1122,12 +1288,21 @@ func (c *cliClient) runBackgroundProcess(id uint64, cancelThunk func()) (*pond.M
 	return nil, false
 }
 
+// cliModeNames are the names of each operatingMode in the CLI.
+var cliModeNames = []string{
+	modeNormal:    "normal",
+	modeFetchOnly: "fetch-only",
+	modeSendOnly:  "send-only",
+}
+
 func (c *cliClient) processCommand(cmd interface{}) (shouldQuit bool) {
 	// First commands that might start a subprocess that needs terminal
 	// control.
 	switch cmd.(type) {
 	case composeCommand:
-		if contact, ok := c.currentObj.(*Contact); ok {
+		if c.operatingMode() == modeFetchOnly {
+			c.Printf("%s Messages can't be sent in fetch-only mode\n", termWarnPrefix)
+		} else if contact, ok := c.currentObj.(*Contact); ok {
 			c.compose(contact, nil, nil)
 		} else {
 			c.Printf("%s Select contact first\n", termWarnPrefix)
@@ -1150,6 +1325,10 @@ func (c *cliClient) processCommand(cmd interface{}) (shouldQuit bool) {
 			c.Printf("%s Cannot reply to server announcement\n", termWarnPrefix)
 			return
 		}
+		if c.operatingMode() == modeFetchOnly {
+			c.Printf("%s Messages can't be sent in fetch-only mode\n", termWarnPrefix)
+			return
+		}
 		c.compose(c.contacts[msg.from], nil, msg)
 
 	default:
@@ -1232,10 +1411,14 @@ Handle:
 		}
 
 		for _, entry := range c.log.entries[len(c.log.entries)-n:] {
+			s := entry.s
+			if contact, ok := c.contacts[entry.contact]; ok {
+				s = "[" + contact.name + "] " + s
+			}
 			table.rows = append(table.rows, cliRow{
 				cols: []string{
 					entry.Format(logTimeFormat),
-					terminalEscape(entry.s, false),
+					terminalEscape(s, false),
 				},
 			})
 		}
@@ -1319,7 +1502,11 @@ Handle:
 			c.Printf("%s Draft was created in the GUI and doesn't have a destination specified. Please use the GUI to manipulate this draft.\n", termErrPrefix)
 			return
 		}
-		id, _, err := c.sendDraft(draft)
+		var inReplyTo *uint64
+		if draft.inReplyTo != 0 {
+			inReplyTo = &draft.inReplyTo
+		}
+		id, err := c.SendMessage(draft.to, draft.body, draft.attachments, draft.detachments, inReplyTo)
 		if err != nil {
 			c.Printf("%s Error sending: %s\n", termErrPrefix, err)
 			return
@@ -1376,6 +1563,23 @@ Handle:
 		c.save()
 		c.setCurrentObject(draft)
 
+	case resendCommand:
+		msg, ok := c.currentObj.(*queuedMessage)
+		if !ok {
+			c.Printf("%s Select outbox message first\n", termErrPrefix)
+			return
+		}
+		if !c.canResend(msg) {
+			c.Printf("%s Only messages that haven't been acknowledged within %d hours of being sent can be resent\n", termErrPrefix, resendAfter/time.Hour)
+			return
+		}
+
+		newMsg := c.resend(msg)
+		newMsg.cliId = msg.cliId
+		c.Printf("%s Queued %s%s%s to be sent again\n", termInfoPrefix, termCliIdStart, newMsg.cliId.String(), termReset)
+		c.save()
+		c.setCurrentObject(newMsg)
+
 	case ackCommand:
 		msg, ok := c.currentObj.(*InboxMessage)
 		if !ok {
@@ -1449,10 +1653,7 @@ Handle:
 		}
 
 		base := filepath.Base(cmd.Filename)
-		a := &pond.Message_Attachment{
-			Filename: proto.String(base),
-			Contents: contents,
-		}
+		a := newAttachment(base, contents)
 		draft.attachments = append(draft.attachments, a)
 		c.Printf("%s Attached '%s' (%d bytes)\n", termPrefix, terminalEscape(base, false), len(contents))
 		c.printDraftSize(draft)
@@ -1495,6 +1696,12 @@ Handle:
 
 		c.runBackgroundProcess(id, cancelThunk)
 
+	case revokeCommand:
+		c.revokeDetachment(cmd.Number, false)
+
+	case replaceCommand:
+		c.revokeDetachment(cmd.Number, true)
+
 	case saveKeyCommand:
 		msg, ok := c.currentObj.(*InboxMessage)
 		if !ok {
@@ -1532,12 +1739,32 @@ Handle:
 			return
 		}
 
+		if !attachmentIntact(msg.message.Files[i]) {
+			c.Printf("%s Attachment was damaged in transit: its contents don't match the hash that the sender included\n", termWarnPrefix)
+		}
 		if err := ioutil.WriteFile(cmd.Filename, msg.message.Files[i].GetContents(), 0600); err != nil {
 			c.Printf("%s Failed to write file: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
 		} else {
 			c.Printf("%s Wrote file\n", termPrefix)
 		}
 
+	case saveRawBodyCommand:
+		msg, ok := c.currentObj.(*InboxMessage)
+		if !ok {
+			c.Printf("%s Select inbox message\n", termWarnPrefix)
+			return
+		}
+		if msg.message == nil {
+			c.Printf("%s Message hasn't been decrypted yet\n", termErrPrefix)
+			return
+		}
+
+		if err := ioutil.WriteFile(cmd.Filename, msg.message.Body, 0600); err != nil {
+			c.Printf("%s Failed to write file: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+		} else {
+			c.Printf("%s Wrote file\n", termPrefix)
+		}
+
 	case removeCommand:
 		draft, ok := c.currentObj.(*Draft)
 		if !ok {
@@ -1556,11 +1783,9 @@ Handle:
 		draft.detachments = append(draft.detachments[:i], draft.detachments[i+1:]...)
 
 	case newContactCommand:
-		for _, contact := range c.contacts {
-			if contact.name == cmd.Name {
-				c.Printf("%s A contact with that name already exists.\n", termErrPrefix)
-				return
-			}
+		if c.contactNameInUse(cmd.Name) {
+			c.Printf("%s A contact with that name already exists.\n", termErrPrefix)
+			return
 		}
 
 		var sharedSecret string
@@ -1612,6 +1837,7 @@ Handle:
 		contact.kxsBytes = nil
 
 		c.save()
+		c.flush()
 		c.pandaWaitGroup.Add(1)
 		contact.pandaShutdownChan = make(chan struct{})
 		go c.runPANDA(contact.pandaKeyExchange, contact.id, contact.name, contact.pandaShutdownChan)
@@ -1625,26 +1851,111 @@ Handle:
 		}
 
 	case retainCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
-		if !ok {
-			c.Printf("%s Select inbox message first\n", termWarnPrefix)
+		switch msg := c.currentObj.(type) {
+		case *InboxMessage:
+			msg.retained = true
+		case *queuedMessage:
+			msg.retained = true
+		default:
+			c.Printf("%s Select inbox or outbox message first\n", termWarnPrefix)
 			return
 		}
-		msg.retained = true
 		c.save()
 
 	case dontRetainCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
-		if !ok {
-			c.Printf("%s Select inbox message first\n", termWarnPrefix)
+		switch msg := c.currentObj.(type) {
+		case *InboxMessage:
+			msg.retained = false
+			msg.exposureTime = c.Now()
+		case *queuedMessage:
+			msg.retained = false
+		default:
+			c.Printf("%s Select inbox or outbox message first\n", termWarnPrefix)
 			return
 		}
-		msg.retained = false
-		msg.exposureTime = c.Now()
 		// TODO: the CLI needs to expire messages when open as the GUI
 		// does. See guiClient.processTimer.
 		c.save()
 
+	case backupCommand:
+		if err := c.exportBackup(cmd.Filename); err != nil {
+			c.Printf("%s Failed to write backup: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+		} else {
+			c.Printf("%s Wrote backup\n", termPrefix)
+		}
+
+	case changeServerCommand:
+		if c.changeServerArmed != cmd.Server {
+			c.Printf("%s %s\n", termWarnPrefix, msgChangeServerWarning)
+			c.Printf("%s To confirm, enter the change-server command again.\n", termWarnPrefix)
+			c.changeServerArmed = cmd.Server
+			return
+		}
+		c.changeServerArmed = ""
+
+		updateMsg := func(msg string) {
+			c.Printf("%s %s\n", termInfoPrefix, msg)
+		}
+		if _, err := c.changeHomeServer(cmd.Server, updateMsg); err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		c.Printf("%s Home server changed. Use 'show' on each contact to get their new handshake. Their handshakes must currently be entered using the GUI.\n", termInfoPrefix)
+
+	case addFallbackServerCommand:
+		updateMsg := func(msg string) {
+			c.Printf("%s %s\n", termInfoPrefix, msg)
+		}
+		if err := c.addFallbackServer(cmd.Server, updateMsg); err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		c.Printf("%s Fallback server added. Only handshakes that are created from now on will include it.\n", termInfoPrefix)
+
+	case proxyCommand:
+		if cmd.Address == "default" {
+			c.setProxyAddress("")
+		} else {
+			host, port, err := net.SplitHostPort(cmd.Address)
+			if err == nil {
+				cmd.Address, err = parseProxyAddress(host, port)
+			}
+			if err != nil {
+				c.Printf("%s Invalid proxy address: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+				return
+			}
+			c.setProxyAddress(cmd.Address)
+		}
+		c.save()
+		c.Printf("%s Using SOCKS5 proxy at %s\n", termPrefix, terminalEscape(c.proxyAddr(), false))
+
+	case modeCommand:
+		for mode, name := range cliModeNames {
+			if name == cmd.Mode {
+				c.setOperatingMode(operatingMode(mode))
+				c.save()
+				c.Printf("%s Network mode: %s\n", termPrefix, operatingModeLabels[mode])
+				return
+			}
+		}
+		c.Printf("%s Unknown mode. Use 'normal', 'fetch-only' or 'send-only'\n", termErrPrefix)
+
+	case quoteRepliesCommand:
+		c.disableReplyQuoting = false
+		c.save()
+
+	case dontQuoteRepliesCommand:
+		c.disableReplyQuoting = true
+		c.save()
+
+	case compressBodiesCommand:
+		c.disableBodyCompression = false
+		c.save()
+
+	case dontCompressBodiesCommand:
+		c.disableBodyCompression = true
+		c.save()
+
 	default:
 		panic(fmt.Sprintf("Unhandled command: %#v", cmd))
 	}
@@ -1662,7 +1973,7 @@ func (c *cliClient) compose(to *Contact, draft *Draft, inReplyTo *InboxMessage)
 		}
 		if inReplyTo != nil && inReplyTo.message != nil {
 			draft.inReplyTo = inReplyTo.message.GetId()
-			draft.body = indentForReply(inReplyTo.message.GetBody())
+			draft.body = c.replyBody(inReplyTo)
 		}
 		c.Printf("%s Created new draft: %s%s%s\n", termInfoPrefix, termCliIdStart, draft.cliId.String(), termReset)
 		c.drafts[draft.id] = draft
@@ -1774,20 +2085,21 @@ func (c *cliClient) showInbox(msg *InboxMessage) {
 func (c *cliClient) showOutbox(msg *queuedMessage) {
 	contact := c.contacts[msg.to]
 	var sentTime string
-	if contact.revokedUs {
+	if contact.revokedUs && msg.sent.IsZero() {
 		sentTime = "(never - contact has revoked us)"
 	} else {
-		sentTime = formatTime(msg.sent)
+		sentTime = formatStepTime(msg.sent, msg.enqueued)
 	}
-	eraseTime := formatTime(msg.created.Add(messageLifetime))
+	eraseTime := formatEraseTime(c.outboxEraseTime(msg))
 
 	table := cliTable{
 		noIndicators: true,
 		rows: []cliRow{
 			cliRow{cols: []string{"To", terminalEscape(contact.name, false)}},
-			cliRow{cols: []string{"Created", formatTime(time.Unix(*msg.message.Time, 0))}},
+			cliRow{cols: []string{"Created", formatTime(msg.created)}},
+			cliRow{cols: []string{"Queued", formatStepTime(msg.enqueued, msg.created)}},
 			cliRow{cols: []string{"Sent", sentTime}},
-			cliRow{cols: []string{"Acknowledged", formatTime(msg.acked)}},
+			cliRow{cols: []string{"Acknowledged", formatStepTime(msg.acked, msg.sent)}},
 			cliRow{cols: []string{"Erase", eraseTime}},
 		},
 	}
@@ -1799,17 +2111,32 @@ func (c *cliClient) showOutbox(msg *queuedMessage) {
 	for _, attachment := range msg.message.Files {
 		c.Printf("%s     %s (%d bytes):\n", termHeaderPrefix, terminalEscape(attachment.GetFilename(), false), len(attachment.Contents))
 	}
-	if len(msg.message.DetachedFiles) > 0 {
+	refs := c.detachmentReferences(msg)
+	if len(refs) > 0 {
+		c.Printf("%s Detachments (use '[revoke|replace] <#>' to stop them being downloaded):\n", termHeaderPrefix)
+	} else if len(msg.message.DetachedFiles) > 0 {
 		c.Printf("%s Detachments:\n", termHeaderPrefix)
 	}
-	for _, detachment := range msg.message.DetachedFiles {
-		c.Printf("%s     %s (%d bytes):\n", termHeaderPrefix, terminalEscape(detachment.GetFilename(), false), detachment.GetSize())
+	for i, detachment := range msg.message.DetachedFiles {
+		disposition := ""
+		for _, ref := range refs {
+			if ref.index != i {
+				continue
+			}
+			if ref.revoked {
+				disposition = ", revoked"
+			} else {
+				disposition = ", uploaded"
+			}
+		}
+		c.Printf("%s     %d: %s (%d bytes%s):\n", termHeaderPrefix, i+1, terminalEscape(detachment.GetFilename(), false), detachment.GetSize(), disposition)
 	}
 	if len(msg.message.Files) > 0 || len(msg.message.DetachedFiles) > 0 {
 		c.Printf("\n")
 	}
 
-	c.term.Write([]byte(terminalEscape(string(msg.message.Body), true /* line breaks ok */)))
+	body, _ := decodeBody(msg.message)
+	c.term.Write([]byte(terminalEscape(body, true /* line breaks ok */)))
 	c.Printf("\n")
 }
 
@@ -1876,10 +2203,26 @@ func (c *cliClient) showContact(contact *Contact) {
 			cliRow{cols: []string{"Public key", fmt.Sprintf("%x", contact.theirPub[:])}},
 			cliRow{cols: []string{"Identity key", fmt.Sprintf("%x", contact.theirIdentityPublic[:])}},
 			cliRow{cols: []string{"Client version", fmt.Sprintf("%d", contact.supportedVersion)}},
+			cliRow{cols: []string{"Last heard from", contact.lastHeardFrom(c.Now())}},
 		},
 	}
+	for _, server := range contact.theirFallbackServers {
+		table.rows = append(table.rows, cliRow{cols: []string{"Fallback server", terminalEscape(server, false)}})
+	}
+	if len(contact.serverStatus) > 0 {
+		table.rows = append(table.rows, cliRow{cols: []string{"Server status", terminalEscape(contact.serverStatus, false)}})
+	}
 	table.WriteTo(c.term)
 
+	if c.handshakeStale(contact) {
+		c.Printf("%s This handshake was created %s and hasn't been completed. Consider deleting this contact and creating it again so that a new handshake is generated.\n", termWarnPrefix, formatAgo(c.Now().Sub(contact.kxCreated)))
+	}
+	if contact.isPending && len(contact.pandaKeyExchange) == 0 && len(contact.kxsBytes) > 0 {
+		c.Printf("%s Handshake for this contact:\n", termHeaderPrefix)
+		pem.Encode(c.term, &pem.Block{Bytes: contact.kxsBytes, Type: keyExchangePEM})
+		c.Printf("\n")
+	}
+
 	if len(contact.events) > 0 {
 		table = cliTable{
 			noIndicators: true,
@@ -1895,7 +2238,9 @@ func (c *cliClient) showContact(contact *Contact) {
 	}
 }
 
-func NewCLIClient(stateFilename string, rand io.Reader, testing, autoFetch bool) *cliClient {
+// NewCLIClient returns a client that uses the terminal. If servers is not nil
+// then it overrides the default choice of servers when creating an account.
+func NewCLIClient(stateFilename string, rand io.Reader, testing, autoFetch bool, servers *serverDefaults) *cliClient {
 	c := &cliClient{
 		client: client{
 			testing:            testing,
@@ -1916,10 +2261,13 @@ func NewCLIClient(stateFilename string, rand io.Reader, testing, autoFetch bool)
 		cliIdsAssigned: make(map[cliId]bool),
 	}
 	c.ui = c
+	if servers != nil {
+		c.servers = *servers
+	}
 
 	c.newMeetingPlace = func() panda.MeetingPlace {
 		return &panda.HTTPMeetingPlace{
-			TorAddress: c.torAddress,
+			TorAddress: c.proxyAddr(),
 			URL:        "https://panda-key-exchange.appspot.com/exchange",
 		}
 	}
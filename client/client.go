@@ -27,7 +27,8 @@ package main
 //
 // The state writing goroutine is passed the serialised state for writing to
 // the disk every time c.save() is called. It avoids having disk or TPM latency
-// hang the main goroutine.
+// hang the main goroutine. The few places that need the state to be on disk
+// before continuing call c.flush() to wait for it.
 //
 // The network goroutine handles sending and receiving messages. It shares a
 // locked queue with the main goroutine in the form of client.queue. Once
@@ -61,16 +62,20 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -99,7 +104,38 @@ const (
 	// startup.
 	messageGraceTime = 5 * time.Minute
 	// The current protocol version implemented by this code.
-	protoVersion = 1
+	protoVersion = 2
+	// gzipVersion is the first protocol version that supports GZIP
+	// encoded message bodies.
+	gzipVersion = 2
+	// maxDecodedBodyLen is the maximum size of a message body after
+	// decompression. It protects against bodies that expand to an
+	// enormous size.
+	maxDecodedBodyLen = 1 << 20
+	// defaultAckOverdue is the default amount of time after a message has
+	// been sent that it is considered to be overdue for an
+	// acknowledgement.
+	defaultAckOverdue = 24 * time.Hour
+	// defaultHandshakeExpiry is the default amount of time after which a
+	// handshake that hasn't been completed is considered to be stale.
+	defaultHandshakeExpiry = 7 * 24 * time.Hour
+	// replyErasureWarning is the amount of time before a message is erased
+	// within which replying to it will show a warning.
+	replyErasureWarning = 24 * time.Hour
+	// passphraseKDFTime is roughly how long deriving the state file key
+	// from a new passphrase should take. The cost is chosen when the
+	// passphrase is set so that it keeps pace with faster machines.
+	passphraseKDFTime = time.Second
+)
+
+// These values identify the list in the GUI that contains the selected item.
+// Only messages and contacts are remembered because the other views either
+// have side effects or are cheap to get back to.
+const (
+	selectionNone = iota
+	selectionInbox
+	selectionOutbox
+	selectionContact
 )
 
 const (
@@ -115,6 +151,13 @@ type client struct {
 	testing bool
 	// dev is true if POND=dev is in the environment. Unittests also set this.
 	dev bool
+	// servers contains any overrides of the servers that are offered when
+	// creating an account.
+	servers serverDefaults
+	// appName, if not empty, replaces "Pond" as the name of the application
+	// in the window title and the main window. It doesn't affect anything
+	// that's sent to contacts or servers.
+	appName string
 	// autoFetch controls whether the network goroutine performs periodic
 	// transactions or waits for outside prompting.
 	autoFetch bool
@@ -126,15 +169,36 @@ type client struct {
 	// stateFilename is the filename of the file on disk in which we
 	// load/save our state.
 	stateFilename string
+	// profilesDir, if not empty, is a directory that contains a state file
+	// for each of the user's profiles. One is chosen at startup and
+	// replaces stateFilename. See chooseProfile.
+	profilesDir string
+	// profileName is the name of the chosen profile, if any.
+	profileName string
 	// stateLock protects the state against concurrent access by another
 	// program.
 	stateLock *disk.Lock
+	// instanceLock prevents another copy of Pond from running with the
+	// same state file. See lockInstance.
+	instanceLock *disk.InstanceLock
 	// torAddress contains a string like "127.0.0.1:9050", which specifies
 	// the address of the local Tor SOCKS proxy.
 	torAddress string
+	// proxyAddress, if not empty, contains a user-configured SOCKS5 proxy
+	// address that is used in preference to torAddress. It's only changed
+	// by the main goroutine, with proxyMutex held, and is read by the
+	// network goroutine via proxyAddr.
+	proxyAddress string
+	proxyMutex   sync.Mutex
 
 	// server is the URL of the user's home server.
 	server string
+	// fallbackServers contains the URLs of other servers on which we have
+	// an account with the same group. Contacts learn of them from our key
+	// exchanges and use them if server can't be reached, so they're
+	// fetched from as well. Like server, they're changed by the main
+	// goroutine with queueMutex held.
+	fallbackServers []string
 	// identity is a curve25519 private value that's used to authenticate
 	// the client to its home server.
 	identity, identityPublic [32]byte
@@ -155,16 +219,113 @@ type client struct {
 	// lastErasureStorageTime is the time at which we last rotated the
 	// erasure storage value.
 	lastErasureStorageTime time.Time
+	// disableReplyQuoting, if true, causes replies to start with an empty
+	// body rather than a quoted copy of the original message.
+	disableReplyQuoting bool
+	// disableBodyCompression, if true, causes message bodies to always be
+	// sent uncompressed.
+	disableBodyCompression bool
+	// spellCheck, if true, causes the GUI to check the spelling of
+	// messages as they are composed.
+	spellCheck bool
+	// noQuitPrompt, if true, stops the GUI from asking for confirmation
+	// when it's closed while messages are waiting to be sent.
+	noQuitPrompt bool
+	// idleLockTimeout, if non-zero, is the period without any user
+	// activity after which the GUI saves the state and suspends itself so
+	// that an unattended session can't be used.
+	idleLockTimeout time.Duration
+	// ackOverdue, if non-zero, overrides defaultAckOverdue as the period
+	// after which a sent, but unacknowledged, message is highlighted in
+	// the outbox.
+	ackOverdue time.Duration
+	// handshakeExpiry, if non-zero, overrides defaultHandshakeExpiry.
+	handshakeExpiry time.Duration
+	// sentLifetime, if non-zero, overrides messageLifetime as the period
+	// after which sent messages are erased from the outbox. keepSent, if
+	// true, stops them from being erased at all.
+	sentLifetime time.Duration
+	keepSent     bool
+	// published contains the secrets behind the user's published
+	// handshake, or is nil if there isn't one. See myKeyExchangeBlock.
+	published *publishedKeyExchange
+	// transactionInterval, if non-zero, overrides transactionRateSeconds
+	// as the mean time between network transactions. coverTraffic, if
+	// true, causes anonymous transactions to be made in place of sends
+	// when there's nothing to send. Both are read by the network
+	// goroutine and so are protected by queueMutex. See
+	// transactionSchedule.
+	transactionInterval time.Duration
+	coverTraffic        bool
+	// mode restricts the network transactions to only sending or only
+	// fetching. It's read by the network goroutine and so is protected
+	// by queueMutex.
+	mode operatingMode
+	// selectedList is one of the selection* values and, along with
+	// selectedId, identifies the item that was last selected in the GUI.
+	selectedList int
+	selectedId   uint64
+	// panedPosition, if non-zero, is the position of the divider between
+	// the two halves of the main GUI window.
+	panedPosition int
+	// bodyFont and monoFont, if not empty, override the font families
+	// used for message bodies and for fixed-width text. fontScale, if
+	// non-zero, is the percentage by which the size of both is scaled.
+	bodyFont, monoFont string
+	fontScale          int
+	// themeName, if not empty, names the color theme used by the GUI.
+	themeName string
+	// shapedIndicators is true if each indicator in the GUI's lists has a
+	// distinct shape, for users who can't tell them apart by color.
+	shapedIndicators bool
+	// messageDetails is true if the entries in the GUI's inbox and outbox
+	// show the size of each message and how many attachments it has.
+	messageDetails bool
+	// formatBodies is true if the GUI shows received messages with
+	// lightweight formatting, such as bold text and links. It's off by
+	// default so that messages are shown exactly as they were sent.
+	formatBodies bool
+	// maskKeys is true if the GUI shows public keys as short fingerprints
+	// until the user reveals them, so that they aren't exposed when the
+	// screen is shared.
+	maskKeys bool
+	// defaultRecipient, if not zero, is the id of the contact that new
+	// messages, other than replies, are addressed to by default. If
+	// defaultRecipientRecent is true then they're addressed to the most
+	// recent recipient instead. See composeRecipient.
+	defaultRecipient       uint64
+	defaultRecipientRecent bool
+	// browserCommand, if not empty, is the command that the GUI uses to
+	// open links once the user has confirmed. It should start a browser
+	// that uses Tor.
+	browserCommand string
+	// wipeHotkey, if not nil, is the key combination that destroys the
+	// state file and exits without confirmation. See panicWipe.
+	wipeHotkey *hotkey
+	// stateMigrated is true if the state file was upgraded from an older
+	// version when loaded and thus needs to be rewritten.
+	stateMigrated bool
 	// writerChan is a channel that the disk goroutine reads from to
-	// receive updated, serialised states.
+	// receive updated, serialised states. (Via coalesceStates, which
+	// combines saves that are close together.)
 	writerChan chan disk.NewState
 	// writerDone is a channel that is closed by the disk goroutine when it
 	// has finished all pending updates.
 	writerDone chan struct{}
+	// flushChan is read by coalesceStates and carries requests from
+	// flush to write any pending state immediately.
+	flushChan chan flushRequest
+	// statesSaved and statesWritten count the states that have been
+	// saved and the number of those that were actually written to disk.
+	// They're accessed atomically.
+	statesSaved, statesWritten uint32
 	// fetchNowChan is the channel that the network goroutine reads from
 	// that triggers an immediate network transaction. Mostly intended for
 	// testing.
 	fetchNowChan chan chan bool
+	// networkDone is closed when the network goroutine exits, which it
+	// does once fetchNowChan has been closed.
+	networkDone chan struct{}
 
 	log *Log
 
@@ -173,6 +334,10 @@ type client struct {
 	drafts   map[uint64]*Draft
 	contacts map[uint64]*Contact
 	inbox    []*InboxMessage
+	// threads indexes inbox and outbox messages by the id in their
+	// pond.Message so that chains of replies can be followed. See
+	// thread.go.
+	threads map[uint64]*thread
 
 	// queue is a queue of messages for transmission that's shared with the
 	// network goroutine and protected by queueMutex.
@@ -200,11 +365,21 @@ type client struct {
 	// state file.
 	usedIds map[uint64]bool
 
+	// compressedBody is the draft body that compressedBodyLens holds the
+	// compressed lengths, by gzip level, of. See compressedBodyLen.
+	compressedBody     string
+	compressedBodyLens map[int]int
+
 	// timerChan fires every two minutes so that messages can be erased.
 	timerChan <-chan time.Time
 	// nowFunc is a function that, if not nil, will be used by the GUI to
 	// get the current time. This is used in testing.
 	nowFunc func() time.Time
+	// clockSkew is the amount by which the local clock was found to be
+	// ahead of the home server's during the last fetch. It's only valid
+	// if clockSkewKnown is true.
+	clockSkew      time.Duration
+	clockSkewKnown bool
 
 	// simulateOldClient causes the client to act like a pre-ratchet client
 	// for testing purposes.
@@ -213,6 +388,11 @@ type client struct {
 	// disableV2Ratchet causes the client to advertise and process V1
 	// axolotl ratchet support.
 	disableV2Ratchet bool
+
+	// unsealStepChan, if not nil, must be written to before each step of
+	// unsealing can proceed. It allows tests to act while a contact's
+	// messages are being unsealed.
+	unsealStepChan chan bool
 }
 
 // UI abstracts behaviour that is specific to a given interface (GUI or CLI).
@@ -240,6 +420,20 @@ type UI interface {
 	// occured and an error.
 	createAccountUI(stateFile *disk.StateFile, pw string) (bool, error)
 	keyPromptUI(stateFile *disk.StateFile) error
+	// stateRecoveryUI is called when the state file exists but can't be
+	// loaded for a reason other than an incorrect passphrase. It shows
+	// loadErr and returns the path of a backup to restore, or the empty
+	// string if the user wishes to start afresh.
+	stateRecoveryUI(loadErr error) (backupPath string, err error)
+	// staleLockUI is called when the previous copy of Pond to use the
+	// state file, described by owner, didn't exit cleanly. It returns nil
+	// if the user wishes to take over the state file and doesn't return
+	// otherwise, unless it's interrupted.
+	staleLockUI(owner *disk.InstanceOwner) error
+	// profileUI is called at startup when profiles are in use. It shows
+	// the names of the existing profiles and returns the one chosen by
+	// the user, or the name of a new one.
+	profileUI(profiles []string) (name string, err error)
 	processFetch(msg *InboxMessage)
 	processServerAnnounce(announce *InboxMessage)
 	processAcknowledgement(ackedMsg *queuedMessage)
@@ -284,6 +478,10 @@ type messageSendResult struct {
 	// extraRevocations optionally contains revocations further to
 	// |revocation|. This is only non-empty if |revocation| is non-nil.
 	extraRevocations []*pond.SignedRevocation
+	// rejected is true if the recipient's server rejected the message's
+	// group signature, which suggests that the recipient has removed us
+	// from their group without the server having a revocation to give us.
+	rejected bool
 }
 
 // signingRequest is a structure that is sent from the network thread to the
@@ -294,11 +492,12 @@ type signingRequest struct {
 	resultChan chan *pond.Request
 }
 
-// pendingDecryption represents a detachment decryption/download operation
-// that's in progress. These are not saved to disk.
+// pendingDecryption represents a detachment decryption/download operation, or
+// the saving of an attachment, that's in progress. These are not saved to
+// disk.
 type pendingDecryption struct {
-	// index is used by the UI code and indexes the list of detachments in
-	// a message.
+	// index is used by the UI code and indexes the list of detachments, or
+	// attachments, in a message.
 	index int
 	// cancel is a thunk that causes the task to be canceled at some point
 	// in the future.
@@ -382,6 +581,8 @@ type InboxMessage struct {
 	exposureTime time.Time
 
 	decryptions map[uint64]*pendingDecryption
+	// saves contains the attachments that are being written to disk.
+	saves map[uint64]*pendingDecryption
 }
 
 func (msg *InboxMessage) Strings() (sentTime, eraseTime, body string) {
@@ -390,19 +591,292 @@ func (msg *InboxMessage) Strings() (sentTime, eraseTime, body string) {
 		body = "(cannot display message as key exchange is still pending)"
 		sentTime = "(unknown)"
 	} else {
-		sentTime = time.Unix(*msg.message.Time, 0).Format(time.RFC1123)
-		body = "(cannot display message as encoding is not supported)"
-		if msg.message.BodyEncoding != nil {
-			switch *msg.message.BodyEncoding {
-			case pond.Message_RAW:
-				body = string(msg.message.Body)
-			}
+		sentTime = messageTimeText(msg.message, time.RFC1123)
+		var err error
+		if body, err = decodeBody(msg.message); err == errUnsupportedEncoding {
+			body = "(cannot display message as encoding is not supported)"
+		} else if err != nil {
+			body = "(cannot display message: " + err.Error() + ")"
 		}
 	}
-	eraseTime = msg.receivedTime.Add(messageLifetime).Format(time.RFC1123)
+	eraseTime = msg.eraseTime().Format(time.RFC1123)
 	return
 }
 
+// Placeholders that are shown in place of a contact that has been deleted and
+// of the time of a message that doesn't include one.
+const (
+	unknownContactName = "(unknown contact)"
+	unknownTimeText    = "(unknown time)"
+)
+
+// messageTimeText formats the time that msg was written using layout, or
+// returns unknownTimeText if the message lacks a time.
+func messageTimeText(msg *pond.Message, layout string) string {
+	if msg.Time == nil {
+		return unknownTimeText
+	}
+	return time.Unix(*msg.Time, 0).Format(layout)
+}
+
+// eraseTime returns the time at which msg will be erased, unless it's
+// retained.
+func (msg *InboxMessage) eraseTime() time.Time {
+	return msg.receivedTime.Add(messageLifetime)
+}
+
+// erasesSoon returns true if msg isn't retained and will be erased within
+// replyErasureWarning of now.
+func (msg *InboxMessage) erasesSoon(now time.Time) bool {
+	return !msg.retained && msg.eraseTime().Sub(now) < replyErasureWarning
+}
+
+var errUnsupportedEncoding = errors.New("encoding is not supported")
+
+// decodeBody returns the body of msg after reversing any encoding.
+func decodeBody(msg *pond.Message) (string, error) {
+	switch msg.GetBodyEncoding() {
+	case pond.Message_RAW:
+		return string(msg.Body), nil
+	case pond.Message_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(msg.Body))
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedBodyLen+1))
+		if err != nil {
+			return "", err
+		}
+		if len(body) > maxDecodedBodyLen {
+			return "", errors.New("body is too large once decompressed")
+		}
+		return string(body), nil
+	}
+
+	return "", errUnsupportedEncoding
+}
+
+// encodeBody returns body, encoded for sending to the given contact, and the
+// encoding used. The body is compressed if compression is enabled, the
+// contact supports it and doing so makes the body smaller.
+func (c *client) encodeBody(body []byte, to *Contact) ([]byte, pond.Message_Encoding) {
+	return c.encodeBodyLevel(body, to, gzip.BestCompression)
+}
+
+// encodeBodyLevel is like encodeBody but compresses at the given gzip level.
+func (c *client) encodeBodyLevel(body []byte, to *Contact, level int) ([]byte, pond.Message_Encoding) {
+	if !c.canCompressBody(len(body), to) {
+		return body, pond.Message_RAW
+	}
+
+	compressed := gzipBody(body, level)
+	if len(compressed) >= len(body) {
+		return body, pond.Message_RAW
+	}
+	return compressed, pond.Message_GZIP
+}
+
+// canCompressBody returns true if a body of the given length, sent to to, may
+// be compressed.
+func (c *client) canCompressBody(bodyLen int, to *Contact) bool {
+	return !c.disableBodyCompression && to.supportedVersion >= gzipVersion && bodyLen <= maxDecodedBodyLen
+}
+
+func gzipBody(body []byte, level int) []byte {
+	var compressed bytes.Buffer
+	w, err := gzip.NewWriterLevel(&compressed, level)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(body)
+	w.Close()
+	return compressed.Bytes()
+}
+
+// compressedBodyLen returns the length of body once compressed at the given
+// gzip level. The lengths for the most recent body are cached since the
+// usage of a draft is recalculated several times for each edit.
+func (c *client) compressedBodyLen(body string, level int) int {
+	if c.compressedBodyLens == nil || body != c.compressedBody {
+		c.compressedBody = body
+		c.compressedBodyLens = make(map[int]int)
+	}
+	n, ok := c.compressedBodyLens[level]
+	if !ok {
+		n = len(gzipBody([]byte(body), level))
+		c.compressedBodyLens[level] = n
+	}
+	return n
+}
+
+// conversationEntry is a single message in the conversation with a contact.
+type conversationEntry struct {
+	id uint64
+	// sent is true if we sent this message and false if we received it.
+	sent bool
+	// missing is true if the message is no longer available, for example
+	// because it has been erased. In this case, only id is set and it
+	// holds the id from the pond.Message.
+	missing bool
+	// time is the time that the message was queued, for sent messages, or
+	// received, otherwise. Both are from the local clock so that the two
+	// directions interleave correctly.
+	time time.Time
+	body string
+	// acked is the time at which an ack for a sent message was received,
+	// or zero if none has been.
+	acked time.Time
+}
+
+func inboxConversationEntry(msg *InboxMessage) conversationEntry {
+	_, _, body := msg.Strings()
+	return conversationEntry{
+		id:   msg.id,
+		time: msg.receivedTime,
+		body: body,
+	}
+}
+
+func outboxConversationEntry(msg *queuedMessage) conversationEntry {
+	body, err := decodeBody(msg.message)
+	if err != nil {
+		body = "(cannot display message: " + err.Error() + ")"
+	}
+	return conversationEntry{
+		id:    msg.id,
+		sent:  true,
+		time:  msg.created,
+		body:  body,
+		acked: msg.acked,
+	}
+}
+
+type conversationEntries []conversationEntry
+
+func (ce conversationEntries) Len() int           { return len(ce) }
+func (ce conversationEntries) Less(i, j int) bool { return ce[i].time.Before(ce[j].time) }
+func (ce conversationEntries) Swap(i, j int)      { ce[i], ce[j] = ce[j], ce[i] }
+
+// conversation returns the messages exchanged with the given contact, in both
+// directions, in chronological order. Acks are folded into the messages that
+// they acknowledge rather than being listed separately.
+func (c *client) conversation(contact *Contact) []conversationEntry {
+	var entries conversationEntries
+
+	for _, msg := range c.inbox {
+		if msg.from != contact.id || msg.message == nil || len(msg.message.Body) == 0 {
+			continue
+		}
+		entries = append(entries, inboxConversationEntry(msg))
+	}
+
+	for _, msg := range c.outbox {
+		if msg.to != contact.id || msg.revocation || msg.message == nil || len(msg.message.Body) == 0 {
+			continue
+		}
+		entries = append(entries, outboxConversationEntry(msg))
+	}
+
+	sort.Stable(entries)
+	return entries
+}
+
+// contactList sorts contacts by name, without regard to case, so that they're
+// listed in the same order every time. Contacts whose names differ only in
+// case are ordered by id.
+type contactList []*Contact
+
+func (cl contactList) Len() int {
+	return len(cl)
+}
+
+func (cl contactList) Less(i, j int) bool {
+	a, b := strings.ToLower(cl[i].name), strings.ToLower(cl[j].name)
+	if a != b {
+		return a < b
+	}
+	return cl[i].id < cl[j].id
+}
+
+func (cl contactList) Swap(i, j int) {
+	cl[i], cl[j] = cl[j], cl[i]
+}
+
+// sortedContacts returns the contacts in the order in which they should be
+// listed. c.contacts is a map, so iterating over it directly would list them
+// in a different order each time.
+func (c *client) sortedContacts() []*Contact {
+	contacts := make(contactList, 0, len(c.contacts))
+	for _, contact := range c.contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Sort(contacts)
+	return contacts
+}
+
+// messageStats summarises the messages in the inbox and outbox so that the
+// user can judge whether their home server, or the path to it, is slow.
+type messageStats struct {
+	inbox, outbox, pending int
+	// sendSamples and ackSamples are the number of messages from which
+	// medianSend and medianAck were calculated.
+	sendSamples, ackSamples int
+	// medianSend is the median time between a message being queued and
+	// it being delivered to the recipient's server.
+	medianSend time.Duration
+	// medianAck is the median time between a message being sent and the
+	// recipient acknowledging it.
+	medianAck time.Duration
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// median returns the median of d, which it sorts in place, or zero if d is
+// empty.
+func (d durations) median() time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	sort.Sort(d)
+	mid := len(d) / 2
+	if len(d)%2 == 0 {
+		return (d[mid-1] + d[mid]) / 2
+	}
+	return d[mid]
+}
+
+// messageStats calculates statistics about the current inbox and outbox. It's
+// computed on demand, rather than maintained as messages come and go, since
+// it's only needed when the user asks for it.
+func (c *client) messageStats() messageStats {
+	stats := messageStats{
+		inbox:  len(c.inbox),
+		outbox: len(c.outbox),
+	}
+
+	var toSend, toAck durations
+	for _, msg := range c.outbox {
+		if msg.sent.IsZero() {
+			stats.pending++
+			continue
+		}
+		if !msg.created.IsZero() && !msg.sent.Before(msg.created) {
+			toSend = append(toSend, msg.sent.Sub(msg.created))
+		}
+		if !msg.acked.IsZero() && !msg.acked.Before(msg.sent) {
+			toAck = append(toAck, msg.acked.Sub(msg.sent))
+		}
+	}
+
+	stats.sendSamples, stats.ackSamples = len(toSend), len(toAck)
+	stats.medianSend, stats.medianAck = toSend.median(), toAck.median()
+	return stats
+}
+
 // NewMessage is sent from the network goroutine to the client goroutine and
 // contains messages fetched from the home server.
 type NewMessage struct {
@@ -421,9 +895,24 @@ type Contact struct {
 	// isPending is true if we haven't received a key exchange message from
 	// this contact.
 	isPending bool
+	// unsealing is true while the messages that were received before the
+	// key exchange completed are being unsealed by startUnsealing. New
+	// messages from the contact are kept sealed until it has finished so
+	// that they are unsealed in order.
+	unsealing bool
+	// unsealQueue contains, in order, the sealed messages that
+	// startUnsealing has yet to unseal.
+	unsealQueue []*InboxMessage
 	// kxsBytes is the serialised key exchange message that we generated
 	// for this contact. (Only valid if |isPending| is true.)
 	kxsBytes []byte
+	// kxCreated is the time at which kxsBytes was generated. Handshakes
+	// that remain unanswered for longer than handshakeExpiryPeriod are
+	// stale.
+	kxCreated time.Time
+	// viaPublished is true if this contact replied to our published
+	// handshake. Their groupKey is shared with every such contact.
+	viaPublished bool
 	// groupKey is the group member key that we gave to this contact.
 	// myGroupKey is the one that they gave to us.
 	groupKey, myGroupKey *bbssig.MemberKey
@@ -436,6 +925,15 @@ type Contact struct {
 	generation uint32
 	// theirServer is the URL of the contact's home server.
 	theirServer string
+	// invalidServer, if not nil, is the reason that theirServer couldn't
+	// be parsed when the state was loaded. Messages can't be sent to the
+	// contact until the server is corrected, with setContactServer, or a
+	// new key exchange is completed. It isn't saved.
+	invalidServer error
+	// theirFallbackServers contains the URLs of other servers, in order of
+	// preference, that messages can be sent to if theirServer can't be
+	// reached. It's empty for most contacts.
+	theirFallbackServers []string
 	// theirPub is their Ed25519 public key.
 	theirPub [32]byte
 	// theirIdentityPublic is the public identity that their home server
@@ -448,6 +946,14 @@ type Contact struct {
 	revoked bool
 	// revokedUs is true if this contact has recoved us.
 	revokedUs bool
+	// signatureRejectedIds contains the ids of the distinct messages to
+	// this contact that their server has rejected, because of our group
+	// signature, since a message to them was last delivered. See
+	// maxSignatureRejections.
+	signatureRejectedIds []uint64
+	// firstSignatureRejection is the time of the first of those
+	// rejections.
+	firstSignatureRejection time.Time
 	// pandaKeyExchange contains the serialised PANDA state if a key
 	// exchange is ongoing.
 	pandaKeyExchange []byte
@@ -457,6 +963,10 @@ type Contact struct {
 	// pandaResult contains an error message in the event that a PANDA key
 	// exchange failed.
 	pandaResult string
+	// serverStatus describes the result of the most recent check of
+	// whether the contact's home server is reachable. It's empty if no
+	// check has been made.
+	serverStatus string
 	// events contains a log of important events relating to this contact.
 	events []Event
 
@@ -465,10 +975,53 @@ type Contact struct {
 	currentDHPrivate     [32]byte
 	theirLastDHPublic    [32]byte
 	theirCurrentDHPublic [32]byte
+	// retiredDHPrivates contains our DH values that were replaced by
+	// rotateDH, rather than because the contact proved that it had their
+	// replacements. Messages that the contact sealed to them may still
+	// be in flight so they're kept for decryption until it does.
+	retiredDHPrivates [][32]byte
+	// dhRotationPending is true if currentDHPrivate was rotated by
+	// rotateDH but no message advertising it has been delivered yet.
+	dhRotationPending bool
 
 	// New ratchet support.
 	ratchet *ratchet.Ratchet
 
+	// theirDHAdvanced and ourDHAdvanced contain the times at which the
+	// contact, and we, last advanced the DH ratchet. They are zero if
+	// that hasn't been observed.
+	theirDHAdvanced time.Time
+	ourDHAdvanced   time.Time
+
+	// lastActivity contains the time at which a message, or an ack, was
+	// last received from the contact. It's zero if nothing has been
+	// received. Pond has no notion of presence so this is the only hint
+	// as to whether a contact is still using Pond.
+	lastActivity time.Time
+
+	// color is the name of the color that the user chose for this
+	// contact, or empty if it should be derived from their identity. See
+	// contactAvatarColor.
+	color string
+	// tags are labels, such as "work", that the user has given to this
+	// contact in order to organise their contacts. They're unrelated to
+	// the group signature tags in previousTags. See parseTags.
+	tags []string
+
+	// blocked is true if messages from this contact are to be dropped
+	// when they are received.
+	blocked bool
+
+	// muted is true if messages from this contact shouldn't draw the
+	// user's attention. They are still counted as unread.
+	muted bool
+
+	// verified is true if the user has compared the contact's key with
+	// them out of band. noUnverifiedWarning is true if the user has asked
+	// not to be warned when writing to the contact while they're
+	// unverified.
+	verified, noUnverifiedWarning bool
+
 	cliId cliId
 }
 
@@ -550,9 +1103,68 @@ func prettyNumber(n uint64) string {
 	return string(ret)
 }
 
-// usageString returns a description of the amount of space taken up by a body
-// with the given contents and a bool indicating overflow.
-func (draft *Draft) usageString() (string, bool) {
+// draftUsage describes how much of the space in a message is taken up by a
+// draft.
+type draftUsage struct {
+	// total is the size of the serialised message.
+	total int
+	// body and attachments are the number of bytes of total that are
+	// consumed by the body and by the attachments and detachments. The
+	// remainder is fixed overhead.
+	body, attachments int
+	// compressed is true if the body will be compressed.
+	compressed bool
+}
+
+func (u draftUsage) over() bool {
+	return u.total > pond.MaxSerializedMessage
+}
+
+func (u draftUsage) remaining() int {
+	return pond.MaxSerializedMessage - u.total
+}
+
+func (u draftUsage) String() string {
+	return fmt.Sprintf("%s of %s bytes", prettyNumber(uint64(u.total)), prettyNumber(pond.MaxSerializedMessage))
+}
+
+// breakdown returns a description of where the space in the message is going.
+func (u draftUsage) breakdown() string {
+	var remaining string
+	if u.over() {
+		remaining = fmt.Sprintf("%s bytes too large", prettyNumber(uint64(-u.remaining())))
+	} else {
+		remaining = fmt.Sprintf("%s bytes remaining", prettyNumber(uint64(u.remaining())))
+	}
+	var compressed string
+	if u.compressed {
+		compressed = " compressed"
+	}
+	return fmt.Sprintf("%s (body %s%s, attachments %s)", remaining, prettyNumber(uint64(u.body)), compressed, prettyNumber(uint64(u.attachments)))
+}
+
+// varintLength returns the number of bytes needed to encode n as a protobuf
+// varint.
+func varintLength(n uint64) int {
+	l := 1
+	for n >= 0x80 {
+		n >>= 7
+		l++
+	}
+	return l
+}
+
+// bytesFieldLength returns the number of bytes taken by a length-delimited
+// protobuf field, with a field number less than 16, containing n bytes.
+func bytesFieldLength(n int) int {
+	return 1 + varintLength(uint64(n)) + n
+}
+
+// usage calculates the space taken up by the draft, given the length of the
+// body once encoded. The body can be very large and this is called as it's
+// edited so, rather than serialising it, its contribution is calculated from
+// its length.
+func (draft *Draft) usage(bodyLen int) draftUsage {
 	var replyToId *uint64
 	if draft.inReplyTo != 0 {
 		replyToId = proto.Uint64(1)
@@ -562,7 +1174,7 @@ func (draft *Draft) usageString() (string, bool) {
 	msg := &pond.Message{
 		Id:               proto.Uint64(0),
 		Time:             proto.Int64(1 << 62),
-		Body:             []byte(draft.body),
+		Body:             []byte{},
 		BodyEncoding:     pond.Message_RAW.Enum(),
 		InReplyTo:        replyToId,
 		MyNextDh:         dhPub[:],
@@ -576,8 +1188,98 @@ func (draft *Draft) usageString() (string, bool) {
 		panic("error while serialising candidate Message: " + err.Error())
 	}
 
-	s := fmt.Sprintf("%s of %s bytes", prettyNumber(uint64(len(serialized))), prettyNumber(pond.MaxSerializedMessage))
-	return s, len(serialized) > pond.MaxSerializedMessage
+	var u draftUsage
+	u.body = bytesFieldLength(bodyLen)
+	u.total = len(serialized) - bytesFieldLength(0) + u.body
+	for _, attachment := range draft.attachments {
+		u.attachments += bytesFieldLength(proto.Size(attachment))
+	}
+	for _, detachment := range draft.detachments {
+		u.attachments += bytesFieldLength(proto.Size(detachment))
+	}
+	return u
+}
+
+// draftUsage calculates the space that the draft will take up when sent. If
+// the recipient is known, this accounts for any compression of the body.
+// Since it's called as the draft is edited, the body is compressed at the
+// fastest level, which overestimates its size. The slower, best compression
+// that's used when sending is only tried if the estimate doesn't fit. Both
+// results are cached, by compressedBodyLen, until the body changes.
+func (c *client) draftUsage(draft *Draft) draftUsage {
+	bodyLen := len(draft.body)
+	var compressed bool
+	if to, ok := c.contacts[draft.to]; ok && c.canCompressBody(len(draft.body), to) {
+		n := c.compressedBodyLen(draft.body, gzip.BestSpeed)
+		if draft.usage(n).over() {
+			n = c.compressedBodyLen(draft.body, gzip.BestCompression)
+		}
+		if n < bodyLen {
+			bodyLen = n
+			compressed = true
+		}
+	}
+
+	u := draft.usage(bodyLen)
+	u.compressed = compressed
+	return u
+}
+
+// usageString returns a description of the amount of space taken up by a
+// draft and a bool indicating overflow.
+func (c *client) usageString(draft *Draft) (string, bool) {
+	u := c.draftUsage(draft)
+	return u.String() + ", " + u.breakdown(), u.over()
+}
+
+// composeRecipient returns the contact that a new message, other than a reply,
+// is addressed to by default, or nil if the user should choose.
+func (c *client) composeRecipient() *Contact {
+	id := c.defaultRecipient
+	if c.defaultRecipientRecent {
+		id = c.mostRecentRecipient()
+	}
+	contact, ok := c.contacts[id]
+	if !ok || contact.isPending || contact.revokedUs {
+		return nil
+	}
+	return contact
+}
+
+// mostRecentRecipient returns the id of the contact that the newest message in
+// the outbox was sent to, or zero if there isn't one. Acks, which have no body,
+// aren't counted.
+func (c *client) mostRecentRecipient() (id uint64) {
+	var newest time.Time
+	for _, msg := range c.outbox {
+		if msg.revocation || msg.message == nil || len(msg.message.Body) == 0 || msg.created.Before(newest) {
+			continue
+		}
+		newest, id = msg.created, msg.to
+	}
+	return
+}
+
+// oversizeAttachments returns the indexes, in draft.attachments, of the
+// attachments that don't fit in the message. The attachments are considered in
+// order and each one that would push the message over the limit, given the
+// body and the earlier attachments that fit, is included. Removing them all
+// makes the message fit unless the body alone is too large.
+func (c *client) oversizeAttachments(draft *Draft) (indexes []int) {
+	if !c.draftUsage(draft).over() {
+		return nil
+	}
+
+	trial := *draft
+	trial.attachments = nil
+	for i, attachment := range draft.attachments {
+		trial.attachments = append(trial.attachments, attachment)
+		if c.draftUsage(&trial).over() {
+			trial.attachments = trial.attachments[:len(trial.attachments)-1]
+			indexes = append(indexes, i)
+		}
+	}
+	return
 }
 
 type queuedMessage struct {
@@ -586,22 +1288,69 @@ type queuedMessage struct {
 	to         uint64
 	server     string
 	created    time.Time
+	enqueued   time.Time // later than created if the message was resent.
 	sent       time.Time
 	acked      time.Time
 	revocation bool
 	message    *pond.Message
+	// retained is true if the user has asked for the message to be kept
+	// after it would otherwise have been erased.
+	retained bool
+	// revokedDetachments contains the ids of the files, uploaded to our
+	// server for detachments in message, that have since been deleted.
+	// See detachmentReferences.
+	revokedDetachments []uint64
 
 	// sending is true if the transact goroutine is currently sending this
 	// message. This is protected by the queueMutex.
 	sending bool
 
+	// held is true if the message is waiting for a new key exchange with
+	// its recipient, whose keys were replaced when our home server
+	// changed, before it can be signed. It's protected by the queueMutex
+	// and isn't saved to disk. See releaseHeldMessages.
+	held bool
+
+	// servers contains the servers, in order of preference, that this
+	// message can be sent to. It's copied from the contact, isn't saved
+	// to disk and is empty if there's no alternative to server. See
+	// nextServer.
+	servers []string
+
+	// overdueLogged is true if a warning has been logged because this
+	// message is overdue for an acknowledgement. It's not saved to disk so
+	// the warning is repeated, once, after a restart.
+	overdueLogged bool
+
 	// cliId is a number, assigned by the command-line interface, to
 	// identity this message for the duration of the session. It's not
 	// saved to disk.
 	cliId cliId
 }
 
-func (qm *queuedMessage) indicator(contact *Contact) Indicator {
+// nextServer switches the message to the server that follows server in
+// servers, wrapping around at the end. It returns false if there's no other
+// server to try. It's called by the network goroutine with queueMutex held.
+func (qm *queuedMessage) nextServer() bool {
+	if len(qm.servers) < 2 {
+		return false
+	}
+	next := qm.servers[0]
+	for i, server := range qm.servers {
+		if server == qm.server && i+1 < len(qm.servers) {
+			next = qm.servers[i+1]
+			break
+		}
+	}
+	qm.server = next
+	return true
+}
+
+// indicator returns the color that the message should be shown with in the
+// outbox. Messages that were sent at least overdue before now, but which
+// haven't been acknowledged, are distinguished from those that were sent
+// recently.
+func (qm *queuedMessage) indicator(contact *Contact, now time.Time, overdue time.Duration) Indicator {
 	switch {
 	case !qm.acked.IsZero():
 		return indicatorGreen
@@ -611,6 +1360,9 @@ func (qm *queuedMessage) indicator(contact *Contact) Indicator {
 			// soon as they are sent.
 			return indicatorGreen
 		}
+		if now.Sub(qm.sent) >= overdue {
+			return indicatorOrange
+		}
 		return indicatorYellow
 	case contact != nil && contact.revokedUs:
 		return indicatorBlack
@@ -618,6 +1370,135 @@ func (qm *queuedMessage) indicator(contact *Contact) Indicator {
 	return indicatorRed
 }
 
+// ackOverdueThreshold returns the period after which an unacknowledged
+// message is considered to be overdue.
+func (c *client) ackOverdueThreshold() time.Duration {
+	if c.ackOverdue > 0 {
+		return c.ackOverdue
+	}
+	return defaultAckOverdue
+}
+
+// sentMessageLifetime returns the period after which a sent message is erased
+// from the outbox, unless keepSent is set.
+func (c *client) sentMessageLifetime() time.Duration {
+	if c.sentLifetime > 0 {
+		return c.sentLifetime
+	}
+	return messageLifetime
+}
+
+// outboxEraseTime returns the time at which msg will be erased from the
+// outbox, or the zero time if it will be kept until the user deletes it.
+// Messages that are still waiting to be sent are kept regardless.
+func (c *client) outboxEraseTime(msg *queuedMessage) time.Time {
+	if c.keepSent || msg.retained {
+		return time.Time{}
+	}
+	return msg.created.Add(c.sentMessageLifetime())
+}
+
+// outboxExpired returns true if msg should be erased from the outbox.
+func (c *client) outboxExpired(msg *queuedMessage, now time.Time) bool {
+	erase := c.outboxEraseTime(msg)
+	return !erase.IsZero() && now.After(erase) && !c.isUnsent(msg)
+}
+
+// handshakeExpiryPeriod returns the period after which an unanswered
+// handshake is considered to be stale.
+func (c *client) handshakeExpiryPeriod() time.Duration {
+	if c.handshakeExpiry > 0 {
+		return c.handshakeExpiry
+	}
+	return defaultHandshakeExpiry
+}
+
+// handshakeStale returns true if contact is waiting for the reply to a
+// handshake that we generated more than handshakeExpiryPeriod ago. The
+// handshake contains fresh Diffie-Hellman values and a group member key so
+// it's better to generate a new one, with newKeyExchange, than to leave it
+// around indefinitely. Contacts using PANDA aren't considered because their
+// handshake is exchanged automatically.
+func (c *client) handshakeStale(contact *Contact) bool {
+	if !contact.isPending || len(contact.kxsBytes) == 0 || len(contact.pandaKeyExchange) > 0 || contact.kxCreated.IsZero() {
+		return false
+	}
+	return c.Now().Sub(contact.kxCreated) > c.handshakeExpiryPeriod()
+}
+
+// contactSubline returns the text shown below the name of contact in the
+// lists. It's contact.subline except that stale handshakes are pointed out.
+func (c *client) contactSubline(contact *Contact) string {
+	if c.handshakeStale(contact) && !contact.blocked {
+		return "handshake expired"
+	}
+	return contact.subline(c.Now())
+}
+
+// logOverdueAcks logs a warning for each message in the outbox that has
+// become overdue for an acknowledgement and returns those messages. A warning
+// is only logged once for each message.
+func (c *client) logOverdueAcks() (overdue []*queuedMessage) {
+	now := c.Now()
+	threshold := c.ackOverdueThreshold()
+
+	for _, msg := range c.outbox {
+		if msg.overdueLogged || msg.revocation || msg.sent.IsZero() || !msg.acked.IsZero() {
+			continue
+		}
+		if now.Sub(msg.sent) < threshold {
+			continue
+		}
+		if msg.message != nil && len(msg.message.Body) == 0 {
+			// Acks aren't themselves acknowledged.
+			continue
+		}
+		msg.overdueLogged = true
+		c.log.ContactErrorf(msg.to, "Message to %s, sent %s, hasn't been acknowledged", c.ContactName(msg.to), formatTime(msg.sent))
+		overdue = append(overdue, msg)
+	}
+
+	return
+}
+
+// outboxIndicator returns the color that msg should be shown with in the
+// outbox.
+func (c *client) outboxIndicator(msg *queuedMessage) Indicator {
+	var contact *Contact
+	if !msg.revocation {
+		contact = c.contacts[msg.to]
+	}
+	indicator := msg.indicator(contact, c.Now(), c.ackOverdueThreshold())
+	// Once a message has been acknowledged, a reminder of an unsent
+	// draft to the same contact is more useful than its status.
+	if indicator == indicatorGreen && contact != nil && c.hasDraft(contact.id) {
+		return indicatorDraft
+	}
+	return indicator
+}
+
+// hasDraft returns true if there's an unsent draft addressed to the given
+// contact.
+func (c *client) hasDraft(contactID uint64) bool {
+	for _, draft := range c.drafts {
+		if draft.to == contactID {
+			return true
+		}
+	}
+	return false
+}
+
+// contactIndicator returns the color that contact should be shown with in the
+// contacts list: that from Contact.indicator or, if there's nothing more
+// pressing, whether there's an unsent draft to them.
+func (c *client) contactIndicator(contact *Contact) Indicator {
+	indicator := contact.indicator()
+	if indicator == indicatorNone && c.hasDraft(contact.id) {
+		return indicatorDraft
+	}
+	return indicator
+}
+
 // outboxToDraft converts an outbox message back to a Draft. This is used when
 // the user aborts the sending of a message.
 func (c *client) outboxToDraft(msg *queuedMessage) *Draft {
@@ -625,11 +1506,13 @@ func (c *client) outboxToDraft(msg *queuedMessage) *Draft {
 		id:          msg.id,
 		created:     msg.created,
 		to:          msg.to,
-		body:        string(msg.message.Body),
 		attachments: msg.message.Files,
 		detachments: msg.message.DetachedFiles,
 	}
 
+	// Our own messages are always decodable.
+	draft.body, _ = decodeBody(msg.message)
+
 	if irt := msg.message.GetInReplyTo(); irt != 0 {
 		// The inReplyTo value of a draft references *our* id for the
 		// inbox message. But the InReplyTo field of a pond.Message
@@ -651,7 +1534,11 @@ func (c *client) ContactName(id uint64) string {
 	if id == 0 {
 		return "Home Server"
 	}
-	return c.contacts[id].name
+	contact, ok := c.contacts[id]
+	if !ok {
+		return unknownContactName
+	}
+	return contact.name
 }
 
 // detectTor sets c.torAddress, either from the POND_TOR_ADDRESS environment
@@ -684,15 +1571,124 @@ func (c *client) detectTor() bool {
 	return false
 }
 
-var knownServers = []struct {
+// proxyAddr returns the address of the SOCKS5 proxy that network connections
+// should be made through.
+func (c *client) proxyAddr() string {
+	c.proxyMutex.Lock()
+	defer c.proxyMutex.Unlock()
+
+	if len(c.proxyAddress) > 0 {
+		return c.proxyAddress
+	}
+	return c.torAddress
+}
+
+// setProxyAddress sets the user-configured SOCKS5 proxy address. An empty
+// address means that the local Tor instance is used.
+func (c *client) setProxyAddress(addr string) {
+	c.proxyMutex.Lock()
+	c.proxyAddress = addr
+	c.proxyMutex.Unlock()
+}
+
+// parseProxyAddress validates a SOCKS5 proxy host and port, as entered by the
+// user, and returns the combined address.
+func parseProxyAddress(host, port string) (string, error) {
+	host = strings.TrimSpace(host)
+	if len(host) == 0 {
+		return "", errors.New("proxy host is empty")
+	}
+	portNum, err := strconv.ParseUint(strings.TrimSpace(port), 10, 16)
+	if err != nil || portNum == 0 {
+		return "", errors.New("proxy port must be a number between 1 and 65535")
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(portNum, 10)), nil
+}
+
+// serverPreset is a server that is offered as a choice when creating an
+// account.
+type serverPreset struct {
 	nickname    string
 	description string
 	uri         string
-}{
+}
+
+var knownServers = []serverPreset{
 	{"wau", "Wau Holland Foundation", "pondserver://25WHHEVD3565FGIOXJZWV7LGQFR4BTO3HF3FWHEW7PCYPFMFPVOQ@vx652n4utsodj5c6.onion"},
 	{"hoi", "Hoi Polloi (https://hoi-polloi.org)", "pondserver://4V6Q5M2AFLBW6UIYL2B5LMKDHEBA6HRHR6UIUU3VDQFNI3BHZAEQ@oum7argqrnlzpcro.onion"},
 }
 
+// serverDefaults allows whoever constructs a client to change the servers
+// that are offered when creating an account, without editing the source.
+type serverDefaults struct {
+	// defaultServer, if not empty, is used in place of msgDefaultServer.
+	defaultServer string
+	// knownServers, if not nil, replaces the built-in list of servers.
+	knownServers []serverPreset
+}
+
+// appTitle returns the name of the application as it's shown to the user.
+func (c *client) appTitle() string {
+	title := "Pond"
+	if len(c.appName) > 0 {
+		title = c.appName
+	}
+	if len(c.profileName) > 0 {
+		title += " - " + c.profileName
+	}
+	return title
+}
+
+// defaultServer returns the server that new accounts are created on unless
+// the user picks another.
+func (c *client) defaultServer() string {
+	switch {
+	case c.dev:
+		return msgDefaultDevServer
+	case len(c.servers.defaultServer) > 0:
+		return c.servers.defaultServer
+	}
+	return msgDefaultServer
+}
+
+// serverPresets returns the servers that the user can choose from when
+// creating an account, in addition to the default.
+func (c *client) serverPresets() []serverPreset {
+	if c.servers.knownServers != nil {
+		return c.servers.knownServers
+	}
+	return knownServers
+}
+
+// isUnsent returns true if msg is waiting to be transmitted: it hasn't been
+// sent and its recipient hasn't revoked us. Such messages are kept, whatever
+// their age, until they have been sent so that they are queued again if Pond
+// is restarted.
+func (c *client) isUnsent(msg *queuedMessage) bool {
+	if !msg.sent.IsZero() {
+		return false
+	}
+	if msg.to == 0 {
+		return true
+	}
+	to, ok := c.contacts[msg.to]
+	return ok && !to.revokedUs
+}
+
+// unsentMessageCount returns the number of messages, not including
+// acknowledgements, that are queued for transmission.
+func (c *client) unsentMessageCount() (n int) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	for _, msg := range c.queue {
+		if msg.revocation || (msg.message != nil && len(msg.message.Body) > 0) {
+			n++
+		}
+	}
+	return
+}
+
 func (c *client) enqueue(m *queuedMessage) {
 	c.queueMutex.Lock()
 	defer c.queueMutex.Unlock()
@@ -716,20 +1712,87 @@ func formatTime(t time.Time) string {
 	return t.Format(time.RFC1123)
 }
 
-var errInterrupted = errors.New("cli: interrupt signal")
-
-func (c *client) loadUI() error {
-	c.ui.initUI()
-
-	c.torAddress = "127.0.0.1:9050" // default for dev mode.
-	if !c.dev && !c.detectTor() {
-		if err := c.ui.torPromptUI(); err != nil {
-			return err
-		}
+// formatStepTime is like formatTime but for a step in the delivery of a
+// message. If the previous step happened at prev then the time between the
+// two is included.
+func formatStepTime(t, prev time.Time) string {
+	if t.IsZero() || prev.IsZero() {
+		return formatTime(t)
 	}
+	d := t.Sub(prev)
+	if d < 0 {
+		d = 0
+	}
+	return fmt.Sprintf("%s (%s later)", formatTime(t), (d / time.Second * time.Second).String())
+}
+
+// formatEraseTime is like formatTime but for the time at which something will
+// be erased, for which zero means never.
+func formatEraseTime(t time.Time) string {
+	if t.IsZero() {
+		return "(never)"
+	}
+	return formatTime(t)
+}
+
+var errInterrupted = errors.New("cli: interrupt signal")
+
+// instanceLockSuffix is appended to the state file's path to give the path
+// of the instance lock.
+const instanceLockSuffix = ".lock"
+
+// lockInstance takes the instance lock for the state file so that a second
+// copy of Pond can't load it while this one is running. If Pond is already
+// running then a fatal error is shown.
+func (c *client) lockInstance() error {
+	path := c.stateFilename + instanceLockSuffix
+	lock, owner, err := disk.LockInstance(path, false /* don't take over */)
+	if err == disk.StaleInstanceLockError {
+		c.log.Errorf("Instance lock was not released by %s", owner)
+		if err := c.ui.staleLockUI(owner); err != nil {
+			return err
+		}
+		lock, owner, err = disk.LockInstance(path, true /* take over */)
+	}
+	if err == disk.InstanceRunningError {
+		c.log.Errorf("Instance lock is held by %s", owner)
+		c.ui.errorUI(fmt.Sprintf("%s (%s). Running two copies of the same account would corrupt it, so please use the copy that's already running.", err, owner), true)
+		return c.ui.ShutdownAndSuspend()
+	}
+	if err != nil {
+		c.ui.errorUI("Failed to lock the state file: "+err.Error(), true)
+		return c.ui.ShutdownAndSuspend()
+	}
+	c.instanceLock = lock
+	return nil
+}
+
+// releaseInstanceLock releases the instance lock, if held, when Pond exits.
+func (c *client) releaseInstanceLock() {
+	c.instanceLock.Release()
+	c.instanceLock = nil
+}
+
+func (c *client) loadUI() error {
+	c.ui.initUI()
+
+	if err := c.chooseProfile(); err == errInterrupted {
+		return err
+	} else if err != nil {
+		c.ui.errorUI("Failed to open profile: "+err.Error(), true)
+		if err := c.ui.ShutdownAndSuspend(); err != nil {
+			return err
+		}
+	}
+
+	c.torAddress = "127.0.0.1:9050" // default for dev mode.
 
 	c.ui.loadingUI()
 
+	if err := c.lockInstance(); err != nil {
+		return err
+	}
+
 	stateFile := &disk.StateFile{
 		Path: c.stateFilename,
 		Rand: c.rand,
@@ -737,6 +1800,9 @@ func (c *client) loadUI() error {
 			c.log.Printf(format, args...)
 		},
 	}
+	if !c.testing {
+		stateFile.KDFTime = passphraseKDFTime
+	}
 
 	var newAccount, imported bool
 	var err error
@@ -762,6 +1828,38 @@ func (c *client) loadUI() error {
 		}
 	}
 
+	if !newAccount {
+		// First try with zero key.
+		err := c.loadState(stateFile, "")
+		for err == disk.BadPasswordError {
+			// That didn't work, try prompting for a key.
+			err = c.ui.keyPromptUI(stateFile)
+		}
+		if err == errInterrupted {
+			return err
+		}
+		if _, ok := err.(*newerStateError); ok {
+			c.log.Errorf("Failed to load state file: %s", err)
+			c.ui.errorUI(err.Error(), true)
+			if err := c.ui.ShutdownAndSuspend(); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if newAccount, err = c.recoverState(stateFile, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Tor is only looked for once the state has been loaded because a
+	// proxy that the user configured is used instead.
+	if !c.dev && len(c.proxyAddress) == 0 && !c.detectTor() {
+		if err := c.ui.torPromptUI(); err != nil {
+			return err
+		}
+	}
+
 	if newAccount {
 		pub, priv, err := ed25519.GenerateKey(rand.Reader)
 		if err != nil {
@@ -790,23 +1888,6 @@ func (c *client) loadUI() error {
 		if err != nil {
 			return err
 		}
-	} else {
-		// First try with zero key.
-		err := c.loadState(stateFile, "")
-		for err == disk.BadPasswordError {
-			// That didn't work, try prompting for a key.
-			err = c.ui.keyPromptUI(stateFile)
-		}
-		if err == errInterrupted {
-			return err
-		}
-		if err != nil {
-			// Fatal error loading state. Abort.
-			c.ui.errorUI(err.Error(), true)
-			if err := c.ui.ShutdownAndSuspend(); err != nil {
-				return err
-			}
-		}
 	}
 
 	if newAccount && !imported {
@@ -827,12 +1908,16 @@ func (c *client) loadUI() error {
 
 	c.writerChan = make(chan disk.NewState)
 	c.writerDone = make(chan struct{})
+	c.flushChan = make(chan flushRequest)
 	c.fetchNowChan = make(chan chan bool, 1)
+	c.networkDone = make(chan struct{})
+	diskChan := make(chan disk.NewState)
 
 	// Start disk and network workers.
-	go stateFile.StartWriter(c.writerChan, c.writerDone)
+	go c.coalesceStates(c.writerChan, c.flushChan, diskChan)
+	go stateFile.StartWriter(diskChan, c.writerDone)
 	go c.transact()
-	if newAccount {
+	if newAccount || c.stateMigrated {
 		c.save()
 	}
 
@@ -851,71 +1936,251 @@ func (c *client) loadUI() error {
 	return nil
 }
 
-func (contact *Contact) subline() string {
+// recoverState is called when the state file exists but loadErr occured while
+// loading it. The user can either restore a backup or start afresh, and in
+// both cases the existing state file is set aside rather than deleted. It
+// returns true if a new account needs to be created.
+func (c *client) recoverState(stateFile *disk.StateFile, loadErr error) (bool, error) {
+	c.log.Errorf("Failed to load state file: %s", loadErr)
+
+	for {
+		backupPath, err := c.ui.stateRecoveryUI(loadErr)
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := os.Stat(c.stateFilename); err == nil {
+			corruptPath := unusedPath(c.stateFilename + ".corrupt")
+			if err := stateFile.SetAside(corruptPath); err != nil {
+				loadErr = err
+				continue
+			}
+			c.log.Printf("Moved state file to %s", corruptPath)
+		}
+
+		if len(backupPath) == 0 {
+			return true, nil
+		}
+
+		if loadErr = c.importBackup(stateFile, backupPath); loadErr != nil {
+			continue
+		}
+		loadErr = c.loadState(stateFile, "")
+		for loadErr == disk.BadPasswordError {
+			loadErr = c.ui.keyPromptUI(stateFile)
+		}
+		if loadErr == errInterrupted {
+			return false, loadErr
+		}
+		if loadErr == nil {
+			c.lastErasureStorageTime = time.Now()
+			return false, nil
+		}
+	}
+}
+
+// unusedPath returns path if nothing exists there. Otherwise it returns path
+// with the smallest numeric suffix that doesn't exist.
+func unusedPath(path string) string {
+	candidate := path
+	for i := 2; ; i++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.%d", path, i)
+	}
+}
+
+func (contact *Contact) subline(now time.Time) string {
 	switch {
 	case contact.revokedUs:
 		return "has revoked"
+	case contact.blocked:
+		return "blocked"
+	case contact.invalidServer != nil:
+		return "invalid server"
 	case contact.isPending:
 		return "pending"
 	case len(contact.pandaResult) > 0:
 		return "failed"
 	case !contact.isPending && contact.ratchet == nil:
 		return "old ratchet"
+	case !contact.lastActivity.IsZero():
+		return "heard from " + formatAgo(now.Sub(contact.lastActivity))
 	}
 	return ""
 }
 
+// lastHeardFrom describes when a message or ack was last received from the
+// contact. Since Pond has no notion of presence, this only indicates that the
+// contact was using Pond at some point and says nothing about whether they
+// are now.
+func (contact *Contact) lastHeardFrom(now time.Time) string {
+	if contact.lastActivity.IsZero() {
+		return "Never"
+	}
+	return formatAgo(now.Sub(contact.lastActivity)) + " (the last message or acknowledgement received; this isn't an indication that they are online)"
+}
+
+// formatAgo returns a coarse description of how long ago an event, that
+// happened d ago, occurred.
+func formatAgo(d time.Duration) string {
+	var n int
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = int(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int(d/time.Hour), "hour"
+	default:
+		n, unit = int(d/(24*time.Hour)), "day"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
+
+// servers returns the servers that messages to contact may be sent to, in
+// order of preference, or nil if there's only theirServer.
+func (contact *Contact) servers() []string {
+	if len(contact.theirFallbackServers) == 0 {
+		return nil
+	}
+	return append([]string{contact.theirServer}, contact.theirFallbackServers...)
+}
+
 func (contact *Contact) indicator() Indicator {
 	switch {
 	case contact.revokedUs:
 		return indicatorBlack
-	case contact.isPending:
+	case contact.blocked:
+		return indicatorRed
+	case contact.isPending, contact.invalidServer != nil:
 		return indicatorYellow
 	}
 	return indicatorNone
 }
 
+// setContactServer replaces the home server of contact, which must be valid,
+// and reroutes any messages that are waiting to be sent to them.
+func (c *client) setContactServer(contact *Contact, server string) {
+	c.log.ContactPrintf(contact.id, "Changed the server of %s from %q to %s", contact.name, contact.theirServer, server)
+	contact.theirServer = server
+	contact.invalidServer = nil
+
+	c.queueMutex.Lock()
+	for _, msg := range c.queue {
+		if msg.to == contact.id && !msg.revocation && !msg.sending {
+			msg.server = server
+			msg.servers = contact.servers()
+		}
+	}
+	c.queueMutex.Unlock()
+}
+
+// kxErrorCode identifies the reason that a key exchange message was rejected.
+type kxErrorCode int
+
+const (
+	kxErrUnparsable kxErrorCode = iota + 1
+	kxErrSignatureLength
+	kxErrPublicKey
+	kxErrSignature
+	kxErrServer
+	kxErrGroup
+	kxErrGroupKey
+	kxErrIdentity
+	kxErrDH
+	kxErrRatchet
+)
+
+// kxError is the type of errors returned by processKeyExchange. Its message is
+// that of the underlying error.
+type kxError struct {
+	code kxErrorCode
+	err  error
+}
+
+func (e *kxError) Error() string {
+	return e.err.Error()
+}
+
+// guidance returns advice for the user about how to resolve the error.
+func (e *kxError) guidance() string {
+	switch e.code {
+	case kxErrUnparsable:
+		return "The handshake is corrupt. Check that the whole message was copied, including the BEGIN and END lines."
+	case kxErrSignatureLength, kxErrSignature:
+		return "The handshake's signature doesn't match its contents, so it may have been altered. Ask them to send it again over a channel that you trust."
+	case kxErrServer:
+		return "The handshake names a home server that isn't valid. They may be using an incompatible version of Pond."
+	case kxErrRatchet:
+		return "The handshake couldn't be completed. Abort and start a new key exchange with them."
+	}
+	return "The handshake contains an invalid key. Ask them to send a new handshake."
+}
+
 func (contact *Contact) processKeyExchange(kxsBytes []byte, testing, simulateOldClient, disableV2Ratchet bool) error {
 	var kxs pond.SignedKeyExchange
 	if err := proto.Unmarshal(kxsBytes, &kxs); err != nil {
-		return err
+		return &kxError{kxErrUnparsable, err}
 	}
 
 	var sig [64]byte
 	if len(kxs.Signature) != len(sig) {
-		return errors.New("invalid signature length")
+		return &kxError{kxErrSignatureLength, errors.New("invalid signature length")}
 	}
 	copy(sig[:], kxs.Signature)
 
+	// Fields that were added by newer versions of Pond are skipped by
+	// proto.Unmarshal so only the fields that we use are checked below.
 	var kx pond.KeyExchange
 	if err := proto.Unmarshal(kxs.Signed, &kx); err != nil {
-		return err
+		return &kxError{kxErrUnparsable, err}
+	}
+	if kx.Generation == nil {
+		return &kxError{kxErrUnparsable, errors.New("handshake is missing the generation number")}
+	}
+	if kx.Server == nil {
+		return &kxError{kxErrServer, errors.New("handshake doesn't name a server")}
 	}
 
 	if len(kx.PublicKey) != len(contact.theirPub) {
-		return errors.New("invalid public key")
+		return &kxError{kxErrPublicKey, errors.New("invalid public key")}
 	}
 	copy(contact.theirPub[:], kx.PublicKey)
 
 	if !ed25519.Verify(&contact.theirPub, kxs.Signed, &sig) {
-		return errors.New("invalid signature")
+		return &kxError{kxErrSignature, errors.New("invalid signature")}
 	}
 
 	contact.theirServer = *kx.Server
 	if _, _, err := parseServer(contact.theirServer, testing); err != nil {
-		return err
+		return &kxError{kxErrServer, err}
+	}
+	contact.theirFallbackServers = nil
+	for _, server := range kx.GetFallbackServers() {
+		if _, _, err := parseServer(server, testing); err != nil {
+			return &kxError{kxErrServer, err}
+		}
+		if server != contact.theirServer {
+			contact.theirFallbackServers = append(contact.theirFallbackServers, server)
+		}
 	}
 
 	group, ok := new(bbssig.Group).Unmarshal(kx.Group)
 	if !ok {
-		return errors.New("invalid group")
+		return &kxError{kxErrGroup, errors.New("invalid group")}
 	}
 	if contact.myGroupKey, ok = new(bbssig.MemberKey).Unmarshal(group, kx.GroupKey); !ok {
-		return errors.New("invalid group key")
+		return &kxError{kxErrGroupKey, errors.New("invalid group key")}
 	}
 
 	if len(kx.IdentityPublic) != len(contact.theirIdentityPublic) {
-		return errors.New("invalid public identity")
+		return &kxError{kxErrIdentity, errors.New("invalid public identity")}
 	}
 	copy(contact.theirIdentityPublic[:], kx.IdentityPublic)
 
@@ -929,7 +2194,7 @@ func (contact *Contact) processKeyExchange(kxsBytes []byte, testing, simulateOld
 		// old code.
 		contact.lastDHPrivate = contact.ratchet.GetKXPrivateForTransition()
 		if len(kx.Dh) != len(contact.theirCurrentDHPublic) {
-			return errors.New("invalid public DH value")
+			return &kxError{kxErrDH, errors.New("invalid public DH value")}
 		}
 		copy(contact.theirCurrentDHPublic[:], kx.Dh)
 		contact.ratchet = nil
@@ -941,7 +2206,7 @@ func (contact *Contact) processKeyExchange(kxsBytes []byte, testing, simulateOld
 		extra25519.PublicKeyToCurve25519(&curve25519Public, &ed25519Public)
 		v2 := !disableV2Ratchet && bytes.Equal(curve25519Public[:], kx.IdentityPublic[:])
 		if err := contact.ratchet.CompleteKeyExchange(&kx, v2); err != nil {
-			return err
+			return &kxError{kxErrRatchet, err}
 		}
 	}
 
@@ -950,6 +2215,134 @@ func (contact *Contact) processKeyExchange(kxsBytes []byte, testing, simulateOld
 	return nil
 }
 
+// ratchetStallThreshold is the number of messages that can be sent to a
+// contact, without them advancing the DH ratchet, before the ratchet is
+// considered to be stalled.
+const ratchetStallThreshold = 10
+
+// ratchetAudit summarises the recent history of the DH ratchet with a contact.
+// It's intended to help debug conversations that have become stuck.
+type ratchetAudit struct {
+	// theirAdvanced and ourAdvanced contain the times at which the
+	// contact, and we, last advanced the ratchet. They are zero if
+	// unknown.
+	theirAdvanced, ourAdvanced time.Time
+	// sentSinceTheirAdvance is the number of messages in the outbox that
+	// were sent to the contact after they last advanced the ratchet.
+	sentSinceTheirAdvance int
+	// firstSentSinceTheirAdvance is the time at which the earliest of
+	// those messages was sent.
+	firstSentSinceTheirAdvance time.Time
+	// stalled is true if enough messages have been sent, without the
+	// contact advancing the ratchet, to suggest that they aren't receiving
+	// them.
+	stalled bool
+}
+
+func (c *client) auditRatchet(contact *Contact) ratchetAudit {
+	audit := ratchetAudit{
+		theirAdvanced: contact.theirDHAdvanced,
+		ourAdvanced:   contact.ourDHAdvanced,
+	}
+
+	for _, msg := range c.outbox {
+		if msg.to != contact.id || msg.revocation || msg.sent.IsZero() || !msg.sent.After(contact.theirDHAdvanced) {
+			continue
+		}
+		audit.sentSinceTheirAdvance++
+		if audit.firstSentSinceTheirAdvance.IsZero() || msg.sent.Before(audit.firstSentSinceTheirAdvance) {
+			audit.firstSentSinceTheirAdvance = msg.sent
+		}
+	}
+	audit.stalled = audit.sentSinceTheirAdvance >= ratchetStallThreshold
+
+	return audit
+}
+
+// With the old ratchet, our current DH value is only replaced once the
+// contact proves that they have it, by sealing a message to it. If the
+// contact is offline then that never happens, so rotateDH can replace it from
+// our side. The contact only accepts the last two DH values that we
+// advertised, and we don't know whether they've seen the current one, so the
+// replacement is advertised with the value that they're certain to have
+// until a message advertising it has been delivered. Since messages to a
+// contact are delivered in order, they'll have the replacement by the time
+// that they read any later message, so completeDHRotation then starts sealing
+// with it.
+
+// dhRotationInterval is the amount of time after which our DH value with a
+// contact that uses the old ratchet is rotated, if it hasn't otherwise
+// advanced.
+const dhRotationInterval = 7 * 24 * time.Hour
+
+// maxRetiredDHPrivates is the number of DH values, replaced by rotation, that
+// are kept in order to decrypt messages that were in flight at the time.
+const maxRetiredDHPrivates = 4
+
+// canRotateDH returns true if rotateDH can be used with contact.
+func canRotateDH(contact *Contact) bool {
+	return !contact.isPending && contact.ratchet == nil && !contact.revokedUs && !contact.dhRotationPending
+}
+
+// retireDHPrivate keeps private, which is being replaced, so that messages
+// that were sealed to it can still be decrypted.
+func (contact *Contact) retireDHPrivate(private [32]byte) {
+	contact.retiredDHPrivates = append(contact.retiredDHPrivates, private)
+	if n := len(contact.retiredDHPrivates); n > maxRetiredDHPrivates {
+		contact.retiredDHPrivates = contact.retiredDHPrivates[n-maxRetiredDHPrivates:]
+	}
+}
+
+// advanceDH is called once the contact has proved that it has our current DH
+// value. That becomes the value that we seal messages with and a new one is
+// generated to be advertised. Retired values aren't needed any longer.
+func (contact *Contact) advanceDH() {
+	copy(contact.lastDHPrivate[:], contact.currentDHPrivate[:])
+	if _, err := io.ReadFull(rand.Reader, contact.currentDHPrivate[:]); err != nil {
+		panic(err)
+	}
+	contact.retiredDHPrivates = nil
+	contact.dhRotationPending = false
+}
+
+// rotateDH replaces our current DH value with a contact that uses the old
+// ratchet, without waiting for them to advance it. See canRotateDH.
+func (c *client) rotateDH(contact *Contact) {
+	contact.retireDHPrivate(contact.currentDHPrivate)
+	c.randBytes(contact.currentDHPrivate[:])
+	contact.dhRotationPending = true
+	c.log.ContactPrintf(contact.id, "Rotated the Diffie-Hellman value for %s", contact.name)
+}
+
+// nextDHPublic returns the DH value to advertise in a message to a contact that
+// uses the old ratchet. If our current value hasn't advanced for
+// dhRotationInterval then it's rotated first.
+func (c *client) nextDHPublic(to *Contact) []byte {
+	if canRotateDH(to) && !to.ourDHAdvanced.IsZero() && c.Now().Sub(to.ourDHAdvanced) > dhRotationInterval {
+		c.rotateDH(to)
+	}
+	var nextDHPub [32]byte
+	curve25519.ScalarBaseMult(&nextDHPub, &to.currentDHPrivate)
+	return nextDHPub[:]
+}
+
+// completeDHRotation is called when a message to contact, which advertised
+// the DH value in advertised, has been delivered. If that completes a
+// rotation then our current value is used to seal future messages and a new
+// one is generated to be advertised.
+func (c *client) completeDHRotation(contact *Contact, advertised []byte) {
+	var currentPublic [32]byte
+	curve25519.ScalarBaseMult(&currentPublic, &contact.currentDHPrivate)
+	if !contact.dhRotationPending || !bytes.Equal(advertised, currentPublic[:]) {
+		return
+	}
+	contact.retireDHPrivate(contact.lastDHPrivate)
+	copy(contact.lastDHPrivate[:], contact.currentDHPrivate[:])
+	c.randBytes(contact.currentDHPrivate[:])
+	contact.dhRotationPending = false
+	contact.ourDHAdvanced = c.Now()
+}
+
 // logEvent records an exceptional event relating to the given contact.
 func (c *client) logEvent(contact *Contact, msg string) {
 	event := Event{
@@ -957,7 +2350,7 @@ func (c *client) logEvent(contact *Contact, msg string) {
 		msg: msg,
 	}
 	contact.events = append(contact.events, event)
-	c.log.Errorf("While processing message from %s: %s", contact.name, msg)
+	c.log.ContactErrorf(contact.id, "While processing message from %s: %s", contact.name, msg)
 	c.ui.logEventUI(contact, event)
 }
 
@@ -1017,41 +2410,228 @@ func (c *client) newKeyExchange(contact *Contact) {
 		panic(err)
 	}
 	contact.ratchet = c.newRatchet(contact)
+	contact.kxsBytes = c.signedKeyExchange(contact.groupKey, contact.ratchet)
+	contact.kxCreated = c.Now()
+}
+
+// regenerateKeyExchange replaces the handshake of a pending contact, for
+// example because the original was lost or may have been seen by someone
+// else. The group member key in the old handshake is revoked, so that it
+// can't be used to deliver messages to us, and new Diffie-Hellman values are
+// generated. The returned revocation has been queued for transmission.
+func (c *client) regenerateKeyExchange(contact *Contact) *queuedMessage {
+	revocation := c.revoke(contact)
+	// The revocation only applies to the old member key.
+	contact.revoked = false
+	contact.groupKey.Wipe()
+	contact.lastDHPrivate = [32]byte{}
+	contact.currentDHPrivate = [32]byte{}
+	contact.retiredDHPrivates = nil
+	contact.dhRotationPending = false
+	if contact.ratchet != nil {
+		contact.ratchet.Wipe()
+	}
+	c.newKeyExchange(contact)
+	return revocation
+}
 
-	kx := &pond.KeyExchange{
-		PublicKey:      c.pub[:],
-		IdentityPublic: c.identityPublic[:],
-		Server:         proto.String(c.server),
-		Group:          contact.groupKey.Group.Marshal(),
-		GroupKey:       contact.groupKey.Marshal(),
-		Generation:     proto.Uint32(c.generation),
+// duplicateContact returns another, established, contact that has the same
+// identity or public key as contact, or nil if there's none. Two contacts with
+// the same keys are the same person, so a duplicate suggests either a mistake
+// or that someone is pretending to be two different people.
+func (c *client) duplicateContact(contact *Contact) *Contact {
+	for _, other := range c.contacts {
+		if other == contact || other.isPending {
+			continue
+		}
+		if other.theirIdentityPublic == contact.theirIdentityPublic || other.theirPub == contact.theirPub {
+			return other
+		}
 	}
-	contact.ratchet.FillKeyExchange(kx)
-	if c.simulateOldClient {
-		kx.Dh1 = nil
+	return nil
+}
+
+// isSelf returns true if contact has our own identity or public key. Such a
+// contact can't normally be created, since the ratchet rejects a handshake
+// that echoes our own, but messages that appear to come from ourselves are
+// never accepted.
+func (c *client) isSelf(contact *Contact) bool {
+	return contact.theirIdentityPublic == c.identityPublic || contact.theirPub == c.pub
+}
+
+// contactNameInUse returns true if an existing contact has the given name.
+func (c *client) contactNameInUse(name string) bool {
+	for _, contact := range c.contacts {
+		if contact.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptKeyExchange processes kxsBytes, a key exchange message that contact
+// generated, once our key exchange for them exists. It returns the existing
+// contact, if any, with the same identity so that the caller can decide
+// whether a duplicate is acceptable.
+func (c *client) acceptKeyExchange(contact *Contact, kxsBytes []byte) (dup *Contact, err error) {
+	if err := contact.processKeyExchange(kxsBytes, c.dev, c.simulateOldClient, c.disableV2Ratchet); err != nil {
+		return nil, err
 	}
+	if c.isSelf(contact) {
+		return nil, errors.New("this is your own handshake")
+	}
+	return c.duplicateContact(contact), nil
+}
 
-	kxBytes, err := proto.Marshal(kx)
+// newContactFromKeyExchange creates a contact from a key exchange message that
+// they generated. A key exchange for us is also generated and must be given to
+// them before they can message us. Duplicates of existing contacts are
+// rejected. The contact isn't added to c.contacts.
+func (c *client) newContactFromKeyExchange(name string, kxsBytes []byte) (*Contact, error) {
+	contact := &Contact{
+		name:      name,
+		isPending: true,
+		id:        c.randId(),
+	}
+	c.newKeyExchange(contact)
+	dup, err := c.acceptKeyExchange(contact, kxsBytes)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if dup != nil {
+		return nil, fmt.Errorf("this handshake has the same identity as the existing contact %s", dup.name)
+	}
+	contact.isPending = false
+	return contact, nil
+}
+
+// addIntroducedContact creates a contact called name from a handshake that
+// was sent to us, in a message, by the contact called introducer. The new
+// contact can be sent messages but, until they receive our handshake, they
+// can't reply.
+func (c *client) addIntroducedContact(name string, kxsBytes []byte, introducer string) (*Contact, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return nil, errors.New("the new contact needs a name")
+	}
+	if c.contactNameInUse(name) {
+		return nil, errors.New("another contact already has that name")
 	}
+	contact, err := c.newContactFromKeyExchange(name, kxsBytes)
+	if err != nil {
+		return nil, err
+	}
+	contact.events = append(contact.events, Event{
+		t:   c.Now(),
+		msg: fmt.Sprintf("Introduced by %s, who sent their handshake in a message.", introducer),
+	})
+	c.contacts[contact.id] = contact
+	c.save()
+	c.flush()
+	return contact, nil
+}
 
-	sig := ed25519.Sign(&c.priv, kxBytes)
+// bulkImportResult describes the outcome of importing one key exchange from a
+// bundle.
+type bulkImportResult struct {
+	// name is the name given to the contact.
+	name string
+	// contact is the new contact, or nil if err is set.
+	contact *Contact
+	err     error
+}
 
-	kxs := &pond.SignedKeyExchange{
-		Signed:    kxBytes,
-		Signature: sig[:],
+// importKeyExchangeBundle creates a contact for each key exchange PEM block in
+// bundle. A block's "Name" header, if any, is used as the name of the contact
+// and otherwise a name is generated. Names are made unique by adding a suffix.
+// The new contacts are added, and the state saved, only once every block has
+// been processed so that a bundle is imported atomically. There's nothing to
+// roll back if saving fails because the disk goroutine panics, rather than
+// continuing, when a state can't be written.
+func (c *client) importKeyExchangeBundle(bundle []byte) []bulkImportResult {
+	var results []bulkImportResult
+	taken := make(map[string]bool)
+	for _, contact := range c.contacts {
+		taken[contact.name] = true
 	}
 
-	if contact.kxsBytes, err = proto.Marshal(kxs); err != nil {
-		panic(err)
+	for rest := bundle; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+
+		name := strings.TrimSpace(block.Headers["Name"])
+		if len(name) == 0 {
+			name = fmt.Sprintf("Imported contact %d", len(results)+1)
+		}
+		for i, base := 2, name; taken[name]; i++ {
+			name = fmt.Sprintf("%s (%d)", base, i)
+		}
+
+		result := bulkImportResult{name: name}
+		if block.Type != keyExchangePEM {
+			result.err = errors.New("not a key exchange message")
+		} else {
+			result.contact, result.err = c.newContactFromKeyExchange(name, block.Bytes)
+		}
+		if result.err == nil {
+			taken[name] = true
+		}
+		results = append(results, result)
 	}
+
+	added := false
+	for _, result := range results {
+		if result.contact != nil {
+			c.contacts[result.contact.id] = result.contact
+			added = true
+		}
+	}
+	if added {
+		c.save()
+		c.flush()
+	}
+	return results
+}
+
+// markAllRead marks every displayable message in the inbox as read and
+// returns the messages that were changed. Pending messages, which can't be
+// decrypted yet, are left alone. The state is saved once, if anything
+// changed.
+func (c *client) markAllRead() (marked []*InboxMessage) {
+	for _, msg := range c.inbox {
+		if msg.message == nil || msg.read || len(msg.message.Body) == 0 {
+			continue
+		}
+		msg.read = true
+		marked = append(marked, msg)
+	}
+	if len(marked) > 0 {
+		c.save()
+	}
+	return
+}
+
+// inboxEmpty returns true if there's nothing in the inbox for the user to
+// see. Pure acks, which have no body, aren't listed so they don't count.
+func (c *client) inboxEmpty() bool {
+	for _, msg := range c.inbox {
+		if msg.message == nil || len(msg.message.Body) > 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func (c *client) deleteInboxMsg(id uint64) {
 	newInbox := make([]*InboxMessage, 0, len(c.inbox))
 	for _, inboxMsg := range c.inbox {
 		if inboxMsg.id == id {
+			c.unthreadInbox(inboxMsg)
+			if from, ok := c.contacts[inboxMsg.from]; ok && from.unsealing {
+				from.removeFromUnsealQueue(inboxMsg)
+			}
 			continue
 		}
 		newInbox = append(newInbox, inboxMsg)
@@ -1074,10 +2654,88 @@ func (c *client) dropSealedAndAckMessagesFrom(contact *Contact) {
 	c.inbox = newInbox
 }
 
+// unsealStep is sent on backgroundChan by the goroutine that startUnsealing
+// creates, in order to prompt the main goroutine to unseal the next message
+// from the contact with the given id. The main goroutine replies on more with
+// false once there's nothing left to unseal.
+type unsealStep struct {
+	id   uint64
+	more chan bool
+}
+
+// startUnsealing starts unsealing, in the background, the messages that were
+// received from contact while the key exchange was pending. Unsealing advances
+// the contact's ratchet and changes the inbox so the work itself is done on
+// the main goroutine, one message for each unsealStep, and the UI remains
+// responsive in between.
+func (c *client) startUnsealing(contact *Contact) {
+	contact.unsealing = true
+	// The messages are found once, here, rather than by searching the
+	// inbox for each step.
+	contact.unsealQueue = nil
+	for _, msg := range c.inbox {
+		if msg.from == contact.id && msg.message == nil {
+			contact.unsealQueue = append(contact.unsealQueue, msg)
+		}
+	}
+	id := contact.id
+	stepChan := c.unsealStepChan
+	go func() {
+		more := make(chan bool, 1)
+		for {
+			if stepChan != nil {
+				<-stepChan
+			}
+			c.backgroundChan <- unsealStep{id, more}
+			if !<-more {
+				return
+			}
+		}
+	}()
+}
+
+// removeFromUnsealQueue removes msg, which has been deleted, from the messages
+// that are waiting to be unsealed.
+func (contact *Contact) removeFromUnsealQueue(msg *InboxMessage) {
+	for i, queued := range contact.unsealQueue {
+		if queued == msg {
+			contact.unsealQueue = append(contact.unsealQueue[:i], contact.unsealQueue[i+1:]...)
+			return
+		}
+	}
+}
+
+// hasSealedMessages returns true if the inbox contains a message from contact
+// that is still sealed.
+func (c *client) hasSealedMessages(contact *Contact) bool {
+	for _, msg := range c.inbox {
+		if msg.from == contact.id && msg.message == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// contactsWithSealedMessages returns the contacts whose key exchange has
+// completed but who still have sealed messages in the inbox. That happens if
+// the client was stopped while startUnsealing was running.
+func (c *client) contactsWithSealedMessages() (contacts []*Contact) {
+	for _, contact := range c.contacts {
+		if contact.isPending || contact.unsealing {
+			continue
+		}
+		if c.hasSealedMessages(contact) {
+			contacts = append(contacts, contact)
+		}
+	}
+	return
+}
+
 func (c *client) deleteOutboxMsg(id uint64) {
 	newOutbox := make([]*queuedMessage, 0, len(c.outbox))
 	for _, outboxMsg := range c.outbox {
 		if outboxMsg.id == id {
+			c.unthreadOutbox(outboxMsg)
 			continue
 		}
 		newOutbox = append(newOutbox, outboxMsg)
@@ -1131,11 +2789,54 @@ func (c *client) moveContactsMessagesToEndOfQueue(id uint64) {
 	c.queue = newQueue
 }
 
+// nextQueuedMessage returns the first message in the queue that isn't held,
+// or nil if there are none.
+func (c *client) nextQueuedMessage() *queuedMessage {
+	// c.queueMutex must be held before calling this function.
+
+	for _, msg := range c.queue {
+		if !msg.held {
+			return msg
+		}
+	}
+	return nil
+}
+
+// releaseHeldMessages allows the queued messages to contact, which were held
+// when our home server changed, to be sent now that a new key exchange has
+// completed. They are routed to the contact's current servers.
+func (c *client) releaseHeldMessages(contact *Contact) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	for _, msg := range c.queue {
+		if msg.to == contact.id && msg.held {
+			msg.held = false
+			msg.server = contact.theirServer
+			msg.servers = contact.servers()
+		}
+	}
+}
+
+// moveQueuedMessageToEnd moves msg to the end of the queue, behind any other
+// messages to the same contact.
+func (c *client) moveQueuedMessageToEnd(msg *queuedMessage) {
+	// c.queueMutex must be held before calling this function.
+
+	i := c.indexOfQueuedMessage(msg)
+	if i == -1 {
+		return
+	}
+	copy(c.queue[i:], c.queue[i+1:])
+	c.queue[len(c.queue)-1] = msg
+}
+
 func (c *client) deleteContact(contact *Contact) {
 	var newInbox []*InboxMessage
 	for _, msg := range c.inbox {
 		if msg.from == contact.id {
 			c.ui.removeInboxMessageUI(msg)
+			c.unthreadInbox(msg)
 			continue
 		}
 		newInbox = append(newInbox, msg)
@@ -1163,14 +2864,20 @@ func (c *client) deleteContact(contact *Contact) {
 	for _, msg := range c.outbox {
 		if msg.to == contact.id && !msg.revocation {
 			c.ui.removeOutboxMessageUI(msg)
+			c.unthreadOutbox(msg)
 			continue
 		}
 		newOutbox = append(newOutbox, msg)
 	}
 	c.outbox = newOutbox
 
-	revocationMessage := c.revoke(contact)
-	c.ui.addRevocationMessageUI(revocationMessage)
+	if !contact.viaPublished {
+		revocationMessage := c.revoke(contact)
+		c.ui.addRevocationMessageUI(revocationMessage)
+	}
+	// Otherwise the group member key is shared with everyone who has the
+	// published handshake. Revoking it would cut off all of them while
+	// this contact could still use the published handshake again.
 
 	if contact.pandaShutdownChan != nil {
 		close(contact.pandaShutdownChan)
@@ -1210,12 +2917,28 @@ func indentForReply(i []byte) string {
 	return string(out.Bytes())
 }
 
+// replyBody returns the initial body for a reply to msg. Unless quoting has
+// been disabled, this is an attribution line followed by the indented text of
+// the original message.
+func (c *client) replyBody(msg *InboxMessage) string {
+	if c.disableReplyQuoting || msg.message == nil {
+		return ""
+	}
+
+	body, err := decodeBody(msg.message)
+	if err != nil {
+		return ""
+	}
+	sent := time.Unix(msg.message.GetTime(), 0).Format(shortTimeFormat)
+	return fmt.Sprintf("On %s, %s wrote:\n", sent, c.ContactName(msg.from)) + indentForReply([]byte(body))
+}
+
 // RunPANDA runs in its own goroutine and runs a PANDA key exchange.
 func (c *client) runPANDA(serialisedKeyExchange []byte, id uint64, name string, shutdown chan struct{}) {
 	var result []byte
 	defer c.pandaWaitGroup.Done()
 
-	c.log.Printf("Starting PANDA key exchange with %s", name)
+	c.log.ContactPrintf(id, "Starting PANDA key exchange with %s", name)
 
 	kx, err := panda.UnmarshalKeyExchange(c.rand, c.newMeetingPlace(), serialisedKeyExchange)
 	kx.Testing = c.testing
@@ -1225,7 +2948,7 @@ func (c *client) runPANDA(serialisedKeyExchange []byte, id uint64, name string,
 			id:         id,
 			serialised: serialised,
 		}
-		c.log.Printf("Key exchange with %s: %s", name, fmt.Sprintf(format, args...))
+		c.log.ContactPrintf(id, "Key exchange with %s: %s", name, fmt.Sprintf(format, args...))
 	}
 	kx.ShutdownChan = shutdown
 
@@ -1244,6 +2967,49 @@ func (c *client) runPANDA(serialisedKeyExchange []byte, id uint64, name string,
 	}
 }
 
+// serverProbeResult is sent on backgroundChan by probeServer.
+type serverProbeResult struct {
+	id  uint64
+	err error
+}
+
+// probeServer checks, in the background, whether the home server of a new
+// contact can be reached and records the result in contact.serverStatus. The
+// check is purely advisory and is skipped when testing so that tests remain
+// offline.
+func (c *client) probeServer(contact *Contact) {
+	if c.testing {
+		return
+	}
+
+	contact.serverStatus = "checking"
+	id, server := contact.id, contact.theirServer
+	go func() {
+		conn, err := c.dialServer(server, true /* random identity */)
+		if err == nil {
+			conn.Close()
+		}
+		c.backgroundChan <- serverProbeResult{id, err}
+	}()
+}
+
+// processServerProbe runs on the main client goroutine and handles the result
+// of probeServer.
+func (c *client) processServerProbe(result serverProbeResult) {
+	contact, ok := c.contacts[result.id]
+	if !ok {
+		return
+	}
+
+	now := c.Now().Format(logTimeFormat)
+	if result.err != nil {
+		contact.serverStatus = fmt.Sprintf("unreachable at %s: %s", now, result.err)
+		c.log.ContactPrintf(contact.id, "Home server of %s is unreachable: %s. Messages to them will be delayed until it can be reached", contact.name, result.err)
+	} else {
+		contact.serverStatus = "reachable at " + now
+	}
+}
+
 // processPANDAUpdate runs on the main client goroutine and handles messages
 // from a runPANDA goroutine.
 func (c *client) processPANDAUpdate(update pandaUpdate) {
@@ -1257,7 +3023,7 @@ func (c *client) processPANDAUpdate(update pandaUpdate) {
 		contact.pandaResult = update.err.Error()
 		contact.pandaKeyExchange = nil
 		contact.pandaShutdownChan = nil
-		c.log.Printf("Key exchange with %s failed: %s", contact.name, update.err)
+		c.log.ContactPrintf(contact.id, "Key exchange with %s failed: %s", contact.name, update.err)
 	case update.serialised != nil:
 		if bytes.Equal(contact.pandaKeyExchange, update.serialised) {
 			return
@@ -1270,15 +3036,27 @@ func (c *client) processPANDAUpdate(update pandaUpdate) {
 		if err := contact.processKeyExchange(update.result, c.dev, c.simulateOldClient, c.disableV2Ratchet); err != nil {
 			contact.pandaResult = err.Error()
 			update.err = err
-			c.log.Printf("Key exchange with %s failed: %s", contact.name, err)
+			c.log.ContactPrintf(contact.id, "Key exchange with %s failed: %s", contact.name, err)
 		} else {
-			c.log.Printf("Key exchange with %s complete", contact.name)
+			c.log.ContactPrintf(contact.id, "Key exchange with %s complete", contact.name)
 			contact.isPending = false
+			c.releaseHeldMessages(contact)
+			if dup := c.duplicateContact(contact); dup != nil {
+				c.log.ContactErrorf(contact.id, "Contact %s has the same identity as contact %s", contact.name, dup.name)
+				contact.events = append(contact.events, Event{
+					t:   c.Now(),
+					msg: fmt.Sprintf("This contact has the same identity as %s. They are the same person, which may indicate that someone is impersonating two people.", dup.name),
+				})
+			}
+			c.probeServer(contact)
 		}
 	}
 
 	c.ui.processPANDAUpdateUI(update)
 	c.save()
+	if update.result != nil {
+		c.flush()
+	}
 }
 
 type pandaUpdate struct {
@@ -1363,7 +3141,7 @@ func (c *client) entomb(tombPath string, tombFile *os.File, log func(string, ...
 	log("You must write the ephemeral key down now! Store it somewhat erasable!\n")
 
 	log("Erasing statefile... ")
-	c.writerChan <- disk.NewState{stateBytes, false, true /* destruct */}
+	c.writerChan <- disk.NewState{State: stateBytes, Destruct: true}
 	<-c.writerDone
 	log("done\n")
 
@@ -1395,6 +3173,14 @@ func (c *client) importTombFile(stateFile *disk.StateFile, keyHex, path string)
 		return errors.New("Incorrect key")
 	}
 
+	return c.writeImportedState(stateFile, plaintext)
+}
+
+// writeImportedState replaces the newly created stateFile with plaintext, a
+// serialised State that was moved from another computer. The caller must then
+// load the state.
+func (c *client) writeImportedState(stateFile *disk.StateFile, plaintext []byte) error {
+	var err error
 	c.stateLock, err = stateFile.Lock(true /* create */)
 	if c.stateLock == nil && err == nil {
 		return errors.New("Output statefile is locked.")
@@ -1413,3 +3199,41 @@ func (c *client) importTombFile(stateFile *disk.StateFile, keyHex, path string)
 
 	return nil
 }
+
+// exportBackup writes a backup of the, still encrypted, state file to path.
+func (c *client) exportBackup(path string) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := disk.WriteBackup(out, c.stateFilename); err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+	return out.Close()
+}
+
+// importBackup replaces the newly created stateFile with the state file
+// contained in the backup at path. The caller must then load the state, which
+// prompts for the backup's passphrase.
+func (c *client) importBackup(stateFile *disk.StateFile, path string) error {
+	backupBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	contents, err := disk.ReadBackup(backupBytes)
+	if err != nil {
+		return err
+	}
+
+	c.stateLock, err = stateFile.Lock(true /* create */)
+	if c.stateLock == nil && err == nil {
+		return errors.New("Output statefile is locked.")
+	}
+	if err != nil {
+		return err
+	}
+
+	return stateFile.Restore(contents)
+}
@@ -3,22 +3,34 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/ed25519"
+	"github.com/agl/pond/client/disk"
 	panda "github.com/agl/pond/panda"
 	pond "github.com/agl/pond/protos"
 )
@@ -142,17 +154,24 @@ type TestGUI struct {
 	fileOpen       FileOpen
 	haveFileOpen   bool
 	panicOnSignal  bool
+	clipboard      string
+	windowClosed   bool
+	title          string
+	hidden         map[string]bool
+	images         map[string]Indicator
 }
 
 func NewTestGUI(t *testing.T) *TestGUI {
 	return &TestGUI{
-		actions:        make(chan interface{}, 16),
+		actions:        make(chan interface{}, uiActionsQueueLen),
 		events:         make(chan interface{}, 16),
 		signal:         make(chan chan bool),
 		currentStateID: uiStateInvalid,
 		t:              t,
 		text:           make(map[string]string),
 		combos:         make(map[string][]string),
+		hidden:         make(map[string]bool),
+		images:         make(map[string]Indicator),
 	}
 }
 
@@ -196,12 +215,20 @@ func (ui *TestGUI) processWidget(widget interface{}) {
 		ui.processWidget(v.child)
 	case Frame:
 		ui.processWidget(v.child)
+	case Paned:
+		ui.processWidget(v.left)
+		ui.processWidget(v.right)
 	case TextView:
 		ui.text[v.name] = v.text
 	case Label:
 		ui.text[v.name] = v.text
+		if len(v.markup) > 0 {
+			ui.text[v.name] = v.markup
+		}
 	case Combo:
 		ui.combos[v.name] = v.labels
+	case Image:
+		ui.images[v.name] = v.image
 	}
 }
 
@@ -232,13 +259,27 @@ ReadActions:
 			case SetText:
 				ui.text[action.name] = action.text
 			case SetTextView:
-				ui.text[action.name] = action.text
+				if action.spans == nil {
+					ui.text[action.name] = action.text
+				} else {
+					var text string
+					for _, span := range action.spans {
+						text += span.text
+					}
+					ui.text[action.name] = text
+				}
+			case Reset:
+				ui.processWidget(action.root)
 			case SetChild:
 				ui.processWidget(action.child)
 			case Append:
 				for _, child := range action.children {
 					ui.processWidget(child)
 				}
+			case AddToBox:
+				ui.processWidget(action.child)
+			case SetBoxContents:
+				ui.processWidget(action.child)
 			case InsertRow:
 				for _, gride := range action.row {
 					ui.processWidget(gride.widget)
@@ -246,6 +287,16 @@ ReadActions:
 			case FileOpen:
 				ui.fileOpen = action
 				ui.haveFileOpen = true
+			case SetClipboard:
+				ui.clipboard = action.text
+			case CloseWindow:
+				ui.windowClosed = true
+			case SetTitle:
+				ui.title = action.title
+			case SetVisible:
+				ui.hidden[action.name] = !action.visible
+			case SetImage:
+				ui.images[action.name] = action.image
 			}
 		default:
 			break ReadActions
@@ -277,6 +328,10 @@ type TestClient struct {
 
 type TestClientOptions struct {
 	initialStateFile string
+	appName          string
+	// profiles causes the client to keep its state files in a profiles
+	// directory and to prompt for a profile at startup.
+	profiles bool
 }
 
 func NewTestClient(t *testing.T, name string, options *TestClientOptions) (*TestClient, error) {
@@ -299,7 +354,14 @@ func NewTestClient(t *testing.T, name string, options *TestClientOptions) (*Test
 			panic(err)
 		}
 	}
-	tc.guiClient = NewGUIClient(stateFilePath, tc.gui, rand.Reader, true, false)
+	var appName string
+	if options != nil {
+		appName = options.appName
+	}
+	tc.guiClient = NewGUIClient(stateFilePath, tc.gui, rand.Reader, true, false, nil, appName)
+	if options != nil && options.profiles {
+		tc.guiClient.profilesDir = filepath.Join(tc.stateDir, "profiles")
+	}
 	tc.guiClient.log.name = name
 	tc.guiClient.log.toStderr = clientLogToStderr
 	tc.guiClient.timerChan = tc.testTimerChan
@@ -344,9 +406,17 @@ func (tc *TestClient) Reload() {
 
 func (tc *TestClient) ReloadWithMeetingPlace(mp panda.MeetingPlace) {
 	tc.Shutdown()
+	tc.restart(mp)
+}
+
+// restart starts a new client from the state file of a client that has been
+// shutdown.
+func (tc *TestClient) restart(mp panda.MeetingPlace) {
 	oldNowFunc := tc.nowFunc
+	profilesDir := tc.profilesDir
 	tc.gui = NewTestGUI(tc.gui.t)
-	tc.guiClient = NewGUIClient(filepath.Join(tc.stateDir, "state"), tc.gui, rand.Reader, true /* testing */, false /* autoFetch */)
+	tc.guiClient = NewGUIClient(filepath.Join(tc.stateDir, "state"), tc.gui, rand.Reader, true /* testing */, false /* autoFetch */, nil /* default servers */, "" /* default name */)
+	tc.guiClient.profilesDir = profilesDir
 	tc.guiClient.log.name = tc.name
 	tc.guiClient.log.toStderr = clientLogToStderr
 	tc.guiClient.timerChan = tc.testTimerChan
@@ -728,6 +798,15 @@ WaitForAck:
 	return
 }
 
+// waitForUnsealing processes UI updates until client has unsealed the messages
+// that were received from the named contact before the key exchange completed.
+func waitForUnsealing(client *TestClient, name string) {
+	_, contact := contactByName(client, name)
+	for contact.unsealing {
+		client.gui.WaitForSignal()
+	}
+}
+
 func TestMessageExchange(t *testing.T) {
 	testMessageExchange(t, false)
 }
@@ -804,6 +883,76 @@ func testMessageExchange(t *testing.T, crossVersion bool) {
 	}
 }
 
+func TestRotateDH(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+	// Only the old ratchet can be rotated from our side.
+	client1.simulateOldClient = true
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	expectMessage := func(client *TestClient, fromName, body string) {
+		from, msg := fetchMessage(client)
+		if from != fromName {
+			t.Fatalf("message from %s, expected %s", from, fromName)
+		}
+		if string(msg.message.Body) != body {
+			t.Fatalf("Incorrect message contents: %#v", msg)
+		}
+	}
+
+	// client2 has seen client1's current DH value and seals a message to
+	// it, which is still in flight when client1 rotates.
+	sendMessage(client1, "client2", "before rotation")
+	expectMessage(client2, "client1", "before rotation")
+	sendMessage(client2, "client1", "in flight")
+
+	_, contact := contactByName(client1, "client2")
+	retired := contact.currentDHPrivate
+	clickOnContact(client1, "client2")
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{name: "rotatedh"}
+	client1.AdvanceTo(uiStateShowContact)
+	if contact.currentDHPrivate == retired || !contact.dhRotationPending {
+		t.Fatal("DH value wasn't rotated")
+	}
+
+	for i := 0; i < 3; i++ {
+		testMsg := fmt.Sprintf("after rotation %d", i)
+		sendMessage(client1, "client2", testMsg)
+		expectMessage(client2, "client1", testMsg)
+	}
+	if contact.dhRotationPending {
+		t.Error("Delivering the new DH value didn't complete the rotation")
+	}
+
+	expectMessage(client1, "client2", "in flight")
+	sendMessage(client2, "client1", "reply")
+	expectMessage(client1, "client2", "reply")
+	if len(contact.retiredDHPrivates) != 0 {
+		t.Error("Retired DH values were kept after the contact advanced the ratchet")
+	}
+}
+
 func TestACKs(t *testing.T) {
 	if parallel {
 		t.Parallel()
@@ -955,6 +1104,7 @@ func TestHalfPairedMessageExchange(t *testing.T) {
 		textViews: map[string]string{"kxin": client1KX},
 	}
 	client2.AdvanceTo(uiStateShowContact)
+	waitForUnsealing(client2, "client1")
 	client2.gui.events <- Click{
 		name: client2.inboxUI.entries[0].boxName,
 	}
@@ -965,6 +1115,209 @@ func TestHalfPairedMessageExchange(t *testing.T) {
 	}
 }
 
+func TestFetchWhileUnsealing(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	client1KX := client1.gui.text["kxout"]
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+
+	sendMessage(client1, "client2", "first")
+	if _, msg := fetchMessage(client2); msg == nil || len(msg.sealed) == 0 {
+		t.Fatalf("no sealed message in client2")
+	}
+
+	// Hold unsealing after the key exchange completes so that the next
+	// message is fetched while the first is still sealed.
+	client2.unsealStepChan = make(chan bool)
+	client2.gui.events <- Click{
+		name: client2.contactsUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateNewContact)
+	client2.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client1KX},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+	if _, contact := contactByName(client2, "client1"); !contact.unsealing {
+		t.Fatalf("client2 isn't unsealing")
+	}
+
+	sendMessage(client1, "client2", "second")
+	if _, msg := fetchMessage(client2); msg == nil {
+		t.Fatalf("client2 didn't fetch the second message")
+	}
+
+	close(client2.unsealStepChan)
+	waitForUnsealing(client2, "client1")
+
+	var bodies []string
+	for _, msg := range client2.inbox {
+		if msg.message == nil {
+			t.Fatalf("message still sealed after unsealing")
+		}
+		bodies = append(bodies, string(msg.message.Body))
+	}
+	if len(bodies) != 2 || bodies[0] != "first" || bodies[1] != "second" {
+		t.Fatalf("unexpected messages after unsealing: %q", bodies)
+	}
+}
+
+func TestPendingMessageDetails(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+
+	sendMessage(client1, "client2", "waiting")
+	_, msg := fetchMessage(client2)
+	if msg == nil || msg.message != nil {
+		t.Fatalf("Expected a pending message")
+	}
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	if s, expected := client2.gui.text["sealedsize"], prettyNumber(uint64(len(msg.sealed)))+" bytes (encrypted)"; s != expected {
+		t.Errorf("Got size %q, expected %q", s, expected)
+	}
+	if s := client2.gui.text["receivedtime"]; s != formatTime(msg.receivedTime) {
+		t.Errorf("Bad received time: %q", s)
+	}
+
+	client2.gui.events <- Click{name: "showcontact"}
+	client2.AdvanceTo(uiStateNewContact)
+	if client2.selectedList != selectionContact || client2.selectedId != msg.from {
+		t.Errorf("Pending contact wasn't selected")
+	}
+}
+
+func TestUnsealInBackground(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	client1KX := client1.gui.text["kxout"]
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+
+	const numPending = 3
+	for i := 0; i < numPending; i++ {
+		sendMessage(client1, "client2", fmt.Sprintf("message %d", i))
+		if _, msg := fetchMessage(client2); msg == nil || len(msg.sealed) == 0 {
+			t.Fatalf("Message %d wasn't kept sealed", i)
+		}
+	}
+
+	client2.gui.events <- Click{
+		name: client2.contactsUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateNewContact)
+	client2.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client1KX},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+	waitForUnsealing(client2, "client1")
+
+	checkInbox := func() {
+		if len(client2.inbox) != numPending {
+			t.Fatalf("Inbox has %d messages, rather than %d", len(client2.inbox), numPending)
+		}
+		for i, msg := range client2.inbox {
+			if msg.message == nil {
+				t.Fatalf("Message %d is still sealed", i)
+			}
+			if body, expected := string(msg.message.Body), fmt.Sprintf("message %d", i); body != expected {
+				t.Errorf("Message %d is %q rather than %q", i, body, expected)
+			}
+		}
+	}
+	checkInbox()
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	checkInbox()
+}
+
 func TestDraft(t *testing.T) {
 	if parallel {
 		t.Parallel()
@@ -1096,7 +1449,7 @@ func TestDraft(t *testing.T) {
 	client.gui.WaitForSignal()
 }
 
-func TestDraftDiscard(t *testing.T) {
+func TestAttachmentOrder(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1117,19 +1470,70 @@ func TestDraftDiscard(t *testing.T) {
 	client.gui.events <- Click{name: "compose"}
 	client.AdvanceTo(uiStateCompose)
 
-	if l := len(client.drafts); l != 1 {
-		t.Fatalf("Bad number of drafts: %d", l)
+	var draft *Draft
+	for _, d := range client.drafts {
+		draft = d
 	}
 
-	client.gui.events <- Click{name: "discard"}
-	client.AdvanceTo(uiStateMain)
+	ids := make(map[string]uint64)
+	for _, name := range []string{"first", "second", "third"} {
+		path := filepath.Join(client.stateDir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write attachment file: %s", err)
+		}
+		client.gui.events <- Click{name: "attach"}
+		client.gui.WaitForFileOpen()
+		client.gui.events <- OpenResult{path: path, ok: true}
+		client.gui.WaitForSignal()
 
-	if l := len(client.drafts); l != 0 {
-		t.Fatalf("Bad number of drafts after discard: %d", l)
+		const labelPrefix = "attachment-label-"
+		for label, text := range client.gui.text {
+			if strings.HasPrefix(label, labelPrefix) && strings.HasPrefix(text, name+" ") {
+				if ids[name], err = strconv.ParseUint(label[len(labelPrefix):], 16, 64); err != nil {
+					t.Fatalf("Failed to parse attachment label: %s", label)
+				}
+			}
+		}
+		if ids[name] == 0 {
+			t.Fatalf("Failed to find attachment %s", name)
+		}
+	}
+
+	filenames := func() (names []string) {
+		for _, attachment := range draft.attachments {
+			names = append(names, attachment.GetFilename())
+		}
+		return
+	}
+	checkOrder := func(expected ...string) {
+		if names := filenames(); strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Bad attachment order: got %v, want %v", names, expected)
+		}
+	}
+
+	client.gui.events <- Click{name: fmt.Sprintf("attachment-down-%x", ids["first"])}
+	client.gui.WaitForSignal()
+	checkOrder("second", "first", "third")
+
+	client.gui.events <- Click{name: fmt.Sprintf("attachment-up-%x", ids["third"])}
+	client.gui.WaitForSignal()
+	checkOrder("second", "third", "first")
+
+	client.gui.events <- Update{name: fmt.Sprintf("attachment-name-%x", ids["third"]), text: "renamed.txt"}
+	client.gui.WaitForSignal()
+	checkOrder("second", "renamed.txt", "first")
+
+	// Removing an attachment must remove the correct one even after the
+	// list has been reordered.
+	client.gui.events <- Click{name: fmt.Sprintf("remove-%x", ids["second"])}
+	client.gui.WaitForSignal()
+	checkOrder("renamed.txt", "first")
+	if s := string(draft.attachments[0].Contents); s != "third" {
+		t.Fatalf("Renamed attachment has wrong contents: %s", s)
 	}
 }
 
-func testDetached(t *testing.T, upload bool) {
+func TestDropAttachments(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1140,19 +1544,202 @@ func testDetached(t *testing.T, upload bool) {
 	}
 	defer server.Close()
 
-	client1, err := NewTestClient(t, "client1", nil)
+	client, err := NewTestClient(t, "client", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client1.Close()
+	defer client.Close()
 
-	client2, err := NewTestClient(t, "client2", nil)
-	if err != nil {
-		t.Fatal(err)
+	proceedToMainUI(t, client, server)
+	client.gui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+
+	var draft *Draft
+	for _, d := range client.drafts {
+		draft = d
 	}
-	defer client2.Close()
 
-	proceedToPaired(t, client1, client2, server)
+	var paths []string
+	for _, name := range []string{"first", "second"} {
+		path := filepath.Join(client.stateDir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write attachment file: %s", err)
+		}
+		paths = append(paths, path)
+	}
+	// A directory can't be attached, but that mustn't stop the files
+	// dropped with it from being attached.
+	paths = append(paths, client.stateDir)
+
+	client.gui.events <- FilesDropped{paths: paths}
+	client.gui.WaitForSignal()
+
+	if n := len(draft.attachments); n != 2 {
+		t.Fatalf("Got %d attachments, want 2", n)
+	}
+	for i, name := range []string{"first", "second"} {
+		if filename := draft.attachments[i].GetFilename(); filename != name {
+			t.Errorf("Attachment #%d is %q, want %q", i, filename, name)
+		}
+	}
+
+	found := false
+	for name := range client.gui.text {
+		if strings.HasPrefix(name, "attachment-error-") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("No error was shown for the directory")
+	}
+}
+
+func TestOversizeAttachments(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	client.gui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+
+	var draft *Draft
+	for _, d := range client.drafts {
+		draft = d
+	}
+
+	// The second attachment doesn't fit after the first but the third,
+	// which is small, does.
+	sizes := map[string]int{
+		"first":  pond.MaxSerializedMessage / 2,
+		"second": pond.MaxSerializedMessage / 2,
+		"third":  1000,
+	}
+	ids := make(map[string]uint64)
+	for _, name := range []string{"first", "second", "third"} {
+		path := filepath.Join(client.stateDir, name)
+		if err := ioutil.WriteFile(path, make([]byte, sizes[name]), 0644); err != nil {
+			t.Fatalf("Failed to write attachment file: %s", err)
+		}
+		client.gui.events <- OpenResult{path: path, ok: true}
+		client.gui.WaitForSignal()
+
+		const labelPrefix = "attachment-label-"
+		for label, text := range client.gui.text {
+			if strings.HasPrefix(label, labelPrefix) && strings.HasPrefix(text, name+" ") {
+				if ids[name], err = strconv.ParseUint(label[len(labelPrefix):], 16, 64); err != nil {
+					t.Fatalf("Failed to parse attachment label: %s", label)
+				}
+			}
+		}
+	}
+
+	if indexes := client.oversizeAttachments(draft); len(indexes) != 1 || indexes[0] != 1 {
+		t.Fatalf("Got oversize attachments %v, want [1]", indexes)
+	}
+	for name, id := range ids {
+		text := client.gui.text[fmt.Sprintf("attachment-label-%x", id)]
+		if marked := strings.Contains(text, "exceeds size limit"); marked != (name == "second") {
+			t.Errorf("Attachment %s has label %q", name, text)
+		}
+	}
+	if text := client.gui.text["usagebreakdown"]; !strings.Contains(text, "Remove second ") {
+		t.Errorf("Usage doesn't suggest removing the attachment: %q", text)
+	}
+
+	client.gui.events <- Click{name: fmt.Sprintf("remove-%x", ids["second"])}
+	client.gui.WaitForSignal()
+
+	if indexes := client.oversizeAttachments(draft); len(indexes) != 0 {
+		t.Fatalf("Got oversize attachments %v after removal", indexes)
+	}
+	for name, id := range ids {
+		if text := client.gui.text[fmt.Sprintf("attachment-label-%x", id)]; name != "second" && strings.Contains(text, "exceeds size limit") {
+			t.Errorf("Attachment %s is still marked: %q", name, text)
+		}
+	}
+	if text := client.gui.text["usagebreakdown"]; strings.Contains(text, "Remove") {
+		t.Errorf("Usage still suggests removing an attachment: %q", text)
+	}
+}
+
+func TestParseURIList(t *testing.T) {
+	list := "# comment\r\nfile:///tmp/a%20b.txt\r\nhttp://example.com/c\r\nfile://localhost/tmp/d\r\nfile://remote/tmp/e\r\n"
+	paths := parseURIList(list)
+	if expected := []string{"/tmp/a b.txt", "/tmp/d"}; strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("Got %v, want %v", paths, expected)
+	}
+}
+
+func TestDraftDiscard(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	client.gui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+
+	if l := len(client.drafts); l != 1 {
+		t.Fatalf("Bad number of drafts: %d", l)
+	}
+
+	client.gui.events <- Click{name: "discard"}
+	client.AdvanceTo(uiStateMain)
+
+	if l := len(client.drafts); l != 0 {
+		t.Fatalf("Bad number of drafts after discard: %d", l)
+	}
+}
+
+func testDetached(t *testing.T, upload bool) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
 	client1.gui.events <- Click{name: "compose"}
 	client1.AdvanceTo(uiStateCompose)
 
@@ -1280,7 +1867,7 @@ func TestUploadDownload(t *testing.T) {
 	testDetached(t, true)
 }
 
-func TestLogOverflow(t *testing.T) {
+func TestReplaceDetachment(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1296,65 +1883,135 @@ func TestLogOverflow(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer client1.Close()
-	proceedToMainUI(t, client1, server)
-
-	client1.gui.events <- Click{name: client1.clientUI.entries[1].boxName}
-	client1.AdvanceTo(uiStateLog)
-
-	for i := 0; i < 2*(logLimit+logSlack); i++ {
-		client1.log.Printf("%d", i)
-	}
-}
 
-func TestServerAnnounce(t *testing.T) {
-	server, err := NewTestServer(t)
+	client2, err := NewTestClient(t, "client2", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer server.Close()
+	defer client2.Close()
 
-	client, err := NewTestClient(t, "client", nil)
-	if err != nil {
+	proceedToPaired(t, client1, client2, server)
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+
+	plaintextPath := filepath.Join(client1.stateDir, "file")
+	plaintext := make([]byte, 40*1024)
+	io.ReadFull(rand.Reader, plaintext)
+	if err := ioutil.WriteFile(plaintextPath, plaintext, 0644); err != nil {
 		t.Fatal(err)
 	}
-	defer client.Close()
 
-	proceedToMainUI(t, client, server)
+	client1.gui.events <- Click{name: "attach"}
+	client1.gui.WaitForFileOpen()
+	client1.gui.events <- OpenResult{path: plaintextPath, ok: true}
+	client1.gui.WaitForSignal()
+	for name := range client1.gui.text {
+		const labelPrefix = "attachment-label-"
+		if strings.HasPrefix(name, labelPrefix) {
+			attachmentID, err := strconv.ParseUint(name[len(labelPrefix):], 16, 64)
+			if err != nil {
+				t.Fatalf("Failed to parse attachment label: %s", name)
+			}
+			client1.gui.events <- Click{name: fmt.Sprintf("attachment-upload-%x", attachmentID)}
+			break
+		}
+	}
 
-	const testMessage = "Hello world"
-	announce := &pond.Message{
-		Id:           proto.Uint64(0),
-		Time:         proto.Int64(time.Now().Unix()),
-		Body:         []byte(testMessage),
-		MyNextDh:     []byte{},
-		BodyEncoding: pond.Message_RAW.Enum(),
+	var draft *Draft
+	for _, d := range client1.drafts {
+		draft = d
+		break
 	}
-	announceBytes, err := proto.Marshal(announce)
-	if err != nil {
-		t.Fatalf("Failed to marshal announce message: %s", err)
+	for len(draft.detachments) == 0 {
+		client1.gui.WaitForSignal()
 	}
-	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.identityPublic[:]), announceBytes, 0666); err != nil {
-		t.Fatalf("Failed to write announce message: %s", err)
+
+	client1.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "foo"},
 	}
+	client1.AdvanceTo(uiStateOutbox)
+	transmitMessage(client1, false)
 
-	fetchMessage(client)
+	_, msg := fetchMessage(client2)
+	if len(msg.message.DetachedFiles) != 1 {
+		t.Fatalf("message received with no detachments")
+	}
+	original := msg.message.DetachedFiles[0]
 
-	if len(client.inbox) != 1 {
-		t.Fatalf("Inbox doesn't have a message")
+	// download fetches and decrypts a detachment as client2.
+	download := func(detachment *pond.Message_Detachment) ([]byte, error) {
+		tmp, err := ioutil.TempFile("", "pond-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(tmp.Name())
+		defer tmp.Close()
+		if err := client2.downloadDetachment(make(chan interface{}, 1), tmp, 1, detachment.GetUrl(), make(chan bool)); err != nil {
+			return nil, err
+		}
+		tmp.Seek(0, 0)
+		outputPath := filepath.Join(client2.stateDir, "output")
+		if err := saveDecrypted(make(chan interface{}, 1), outputPath, 1, tmp, detachment, make(chan bool)); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(outputPath)
 	}
-	client.gui.events <- Click{
-		name: client.inboxUI.entries[0].boxName,
+	if result, err := download(original); err != nil || !bytes.Equal(result, plaintext) {
+		t.Fatalf("Failed to download detachment before it was replaced: %v", err)
 	}
-	client.AdvanceTo(uiStateInbox)
-	if s := client.gui.text["body"]; s != testMessage {
-		t.Fatalf("resolved message is incorrect: %s", s)
+
+	// The outbox message is shown again so that it reflects having been
+	// sent.
+	sent := client1.outbox[0]
+	if refs := client1.detachmentReferences(sent); len(refs) != 1 || refs[0].revoked {
+		t.Fatalf("Bad references to uploaded detachments: %#v", refs)
 	}
+	client1.gui.events <- Click{name: client1.outboxUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateOutbox)
 
-	client.Reload()
-	client.AdvanceTo(uiStateMain)
+	// Replacing, like revoking, needs to be confirmed.
+	client1.gui.events <- Click{name: "detachment-replace-0"}
+	client1.gui.WaitForSignal()
+	if len(sent.revokedDetachments) != 0 || len(client1.revocations) != 0 {
+		t.Fatalf("Detachment was replaced without confirmation")
+	}
+	client1.gui.events <- Click{name: "detachment-replace-0"}
+	for client1.gui.text["detachment-status-0"] != "Revoked" {
+		client1.gui.WaitForSignal()
+	}
+
+	var replacement *pond.Message_Detachment
+	for _, d := range client1.drafts {
+		if d.to == sent.to && len(d.detachments) == 1 {
+			replacement = d.detachments[0]
+		}
+	}
+	if replacement == nil {
+		t.Fatalf("No draft was created for the replacement detachment")
+	}
+	if replacement.GetUrl() == original.GetUrl() || bytes.Equal(replacement.Key, original.Key) {
+		t.Errorf("Replacement detachment has the same URL or key as the original")
+	}
+
+	if _, err := download(original); err == nil {
+		t.Errorf("Revoked detachment could still be downloaded")
+	}
+	if result, err := download(replacement); err != nil {
+		t.Errorf("Failed to download replacement detachment: %s", err)
+	} else if !bytes.Equal(result, plaintext) {
+		t.Errorf("Replacement detachment has the wrong contents")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if refs := client1.detachmentReferences(client1.outbox[0]); len(refs) != 1 || !refs[0].revoked {
+		t.Errorf("Revocation wasn't saved: %#v", refs)
+	}
 }
 
-func TestRevoke(t *testing.T) {
+func TestLogOverflow(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1370,33 +2027,160 @@ func TestRevoke(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer client1.Close()
+	proceedToMainUI(t, client1, server)
 
-	client2, err := NewTestClient(t, "client2", nil)
+	client1.gui.events <- Click{name: client1.clientUI.entries[1].boxName}
+	client1.AdvanceTo(uiStateLog)
+
+	for i := 0; i < 2*(logLimit+logSlack); i++ {
+		client1.log.Printf("%d", i)
+	}
+}
+
+func TestLogContactFilter(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client2.Close()
+	defer server.Close()
 
-	client3, err := NewTestClient(t, "client3", nil)
+	client1, err := NewTestClient(t, "client1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client3.Close()
+	defer client1.Close()
 
-	client4, err := NewTestClient(t, "client4", nil)
+	client2, err := NewTestClient(t, "client2", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client4.Close()
+	defer client2.Close()
 
 	proceedToPaired(t, client1, client2, server)
-	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
-	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
+	id, _ := contactByName(client1, "client2")
 
-	initialGeneration := client1.generation
+	client1.gui.events <- Click{name: client1.clientUI.entries[1].boxName}
+	client1.AdvanceTo(uiStateLog)
 
-	// Have client4 send a message before the revocation.
-	const beforeRevocationMsg = "from before revocation"
+	client1.log.ContactPrintf(id, "about the conversation")
+	client1.log.Printf("about something else")
+
+	shows := func(s string) bool {
+		return strings.Contains(client1.gui.text["log"], s)
+	}
+
+	client1.gui.events <- Click{name: "logcontact", combos: map[string]string{"logcontact": "client2"}}
+	for !shows("about the conversation") || shows("about something else") {
+		client1.gui.WaitForSignal()
+	}
+	if !shows("[client2] about the conversation") {
+		t.Errorf("Entry isn't tagged with the contact: %q", client1.gui.text["log"])
+	}
+
+	client1.gui.events <- Click{name: "logcontact", combos: map[string]string{"logcontact": logAllContacts}}
+	for !shows("about something else") {
+		client1.gui.WaitForSignal()
+	}
+	if !shows("about the conversation") {
+		t.Errorf("Contact's entry is missing from the unfiltered log")
+	}
+}
+
+func TestServerAnnounce(t *testing.T) {
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	const testMessage = "Hello world"
+	announce := &pond.Message{
+		Id:           proto.Uint64(0),
+		Time:         proto.Int64(time.Now().Unix()),
+		Body:         []byte(testMessage),
+		MyNextDh:     []byte{},
+		BodyEncoding: pond.Message_RAW.Enum(),
+	}
+	announceBytes, err := proto.Marshal(announce)
+	if err != nil {
+		t.Fatalf("Failed to marshal announce message: %s", err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.identityPublic[:]), announceBytes, 0666); err != nil {
+		t.Fatalf("Failed to write announce message: %s", err)
+	}
+
+	fetchMessage(client)
+
+	if len(client.inbox) != 1 {
+		t.Fatalf("Inbox doesn't have a message")
+	}
+	client.gui.events <- Click{
+		name: client.inboxUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateInbox)
+	if s := client.gui.text["body"]; s != testMessage {
+		t.Fatalf("resolved message is incorrect: %s", s)
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+}
+
+func TestRevoke(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	client4, err := NewTestClient(t, "client4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client4.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
+	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
+
+	initialGeneration := client1.generation
+
+	// Have client4 send a message before the revocation.
+	const beforeRevocationMsg = "from before revocation"
 	sendMessage(client4, "client1", beforeRevocationMsg)
 
 	var client1FromClient2 *Contact
@@ -1590,6 +2374,195 @@ func startPANDAKeyExchange(t *testing.T, client *TestClient, server *TestServer,
 	}
 }
 
+func TestRejectedByRevokedContact(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	client1.gui.events <- Click{name: client1.contactsUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{name: "delete"}
+	client1.gui.WaitForSignal()
+	client1.gui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateRevocationComplete)
+	transmitMessage(client1, true)
+
+	// Without the revocation, the server can only reject client2's
+	// messages.
+	revocations := filepath.Join(server.stateDir, "accounts", fmt.Sprintf("%x", client1.identityPublic[:]), "revocations")
+	if err := os.RemoveAll(revocations); err != nil {
+		t.Fatal(err)
+	}
+
+	_, contact := contactByName(client2, "client1")
+	// Retries of the same message don't count as further rejections.
+	sendMessage(client2, "client1", "rejected")
+	transmitMessage(client2, false)
+	transmitMessage(client2, false)
+	if n := len(contact.signatureRejectedIds); n != 1 {
+		t.Fatalf("Retries of one message counted as %d rejections", n)
+	}
+
+	// Rejections of distinct messages aren't enough until they've been
+	// happening for long enough. Each transmission waits for the result
+	// of the previous one to be processed.
+	for i := 1; i < maxSignatureRejections; i++ {
+		sendMessage(client2, "client1", fmt.Sprintf("rejected %d", i))
+	}
+	for i := 0; i < 2*maxSignatureRejections && len(contact.signatureRejectedIds) < maxSignatureRejections; i++ {
+		transmitMessage(client2, false)
+	}
+	if n := len(contact.signatureRejectedIds); n != maxSignatureRejections {
+		t.Fatalf("%d distinct messages were rejected, but %d were counted", maxSignatureRejections, n)
+	}
+	if contact.revokedUs {
+		t.Fatalf("Contact marked as having removed us before %s had passed", minSignatureRejectionPeriod)
+	}
+
+	// The rejections are remembered across restarts.
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	_, contact = contactByName(client2, "client1")
+	if n := len(contact.signatureRejectedIds); n != maxSignatureRejections {
+		t.Fatalf("%d rejections remembered after reload", n)
+	}
+
+	later := time.Now().Add(minSignatureRejectionPeriod + time.Hour)
+	client2.nowFunc = func() time.Time {
+		return later
+	}
+	transmitMessage(client2, false)
+	for !contact.revokedUs {
+		client2.gui.WaitForSignal()
+	}
+
+	clickOnContact(client2, "client1")
+	client2.AdvanceTo(uiStateShowContact)
+
+	client2.queueMutex.Lock()
+	queued := len(client2.queue)
+	client2.queueMutex.Unlock()
+	if queued != 0 {
+		t.Errorf("%d messages are still queued for retrying", queued)
+	}
+	if len(contact.events) == 0 {
+		t.Errorf("No event was recorded for the contact")
+	}
+	if len(client2.gui.text["revokedus"]) == 0 {
+		t.Errorf("Contact isn't shown as having removed us")
+	}
+	client2.gui.events <- Click{name: "archive"}
+	client2.AdvanceTo(uiStateShowContact)
+	if !contactHasTag(contact, archivedTag) {
+		t.Errorf("Contact wasn't archived")
+	}
+	if contact.muted {
+		t.Errorf("Archiving the contact muted it")
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	_, contact = contactByName(client2, "client1")
+	if !contact.revokedUs {
+		t.Errorf("Contact isn't marked as having removed us after reload")
+	}
+}
+
+func TestIntroduction(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToKeyExchange(t, client3, server, "client2")
+
+	// client1 introduces client3 to client2.
+	sendMessage(client1, "client2", "Meet client3:\n\n"+client3.gui.text["kxout"])
+	fetchMessage(client2)
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.gui.events <- Click{name: "introduction-0"}
+	client2.AdvanceTo(uiStateIntroduction)
+	if s := client2.gui.text["introducer"]; !strings.HasPrefix(s, "client1 ") {
+		t.Errorf("Introducer isn't shown: %q", s)
+	}
+
+	client2.gui.events <- Click{name: "add", entries: map[string]string{"name": "client1"}}
+	client2.AdvanceTo(uiStateIntroduction)
+	if len(client2.gui.text["error"]) == 0 {
+		t.Errorf("A contact was added with a name that's in use")
+	}
+
+	client2.gui.events <- Click{name: "add", entries: map[string]string{"name": "client3"}}
+	client2.AdvanceTo(uiStateShowContact)
+	_, contact := contactByName(client2, "client3")
+	if contact.isPending || len(contact.events) == 0 {
+		t.Fatalf("Introduced contact wasn't created correctly")
+	}
+
+	// client3 completes the key exchange with client2's handshake and
+	// then each can message the other.
+	client3.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": string(pem.EncodeToMemory(&pem.Block{Type: keyExchangePEM, Bytes: contact.kxsBytes}))},
+	}
+	client3.AdvanceTo(uiStateShowContact)
+
+	sendMessage(client2, "client3", "hello")
+	if from, msg := fetchMessage(client3); from != "client2" || string(msg.message.Body) != "hello" {
+		t.Errorf("Message to the introduced contact wasn't received")
+	}
+	sendMessage(client3, "client2", "hello back")
+	if from, _ := fetchMessage(client2); from != "client3" {
+		t.Errorf("Message from the introduced contact wasn't received")
+	}
+}
+
 func TestPANDA(t *testing.T) {
 	if parallel {
 		t.Parallel()
@@ -1683,6 +2656,90 @@ func TestReadingOldStateFiles(t *testing.T) {
 	client1.AdvanceTo(uiStateMain)
 }
 
+func TestStateMigration(t *testing.T) {
+	state := new(disk.State)
+	migrated, err := migrateState(state)
+	if err != nil {
+		t.Fatalf("failed to migrate unversioned state: %s", err)
+	}
+	if !migrated || state.GetVersion() != stateVersion {
+		t.Fatalf("unversioned state wasn't migrated to version %d", stateVersion)
+	}
+
+	if migrated, err = migrateState(state); err != nil || migrated {
+		t.Fatalf("current state was migrated again (migrated: %t, err: %v)", migrated, err)
+	}
+
+	state.Version = proto.Uint32(stateVersion + 1)
+	if _, err := migrateState(state); err == nil {
+		t.Fatalf("state from a newer version was accepted")
+	} else if _, ok := err.(*newerStateError); !ok {
+		t.Fatalf("state from a newer version gave an unexpected error: %s", err)
+	}
+}
+
+func TestNewerStateFile(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	dir, err := ioutil.TempDir("", "pond-newer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := &disk.StateFile{
+		Path: filepath.Join(dir, "state"),
+		Rand: rand.Reader,
+		Log:  t.Logf,
+	}
+	if err := stateFile.Create(""); err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, 32)
+	stateBytes, err := proto.Marshal(&disk.State{
+		Version:      proto.Uint32(stateVersion + 1),
+		Identity:     key,
+		Public:       key,
+		Private:      key,
+		Server:       proto.String("pondserver://test"),
+		Group:        key,
+		GroupPrivate: key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(chan disk.NewState)
+	done := make(chan struct{})
+	go stateFile.StartWriter(states, done)
+	states <- disk.NewState{State: stateBytes}
+	close(states)
+	<-done
+
+	client, err := NewTestClient(t, "client", &TestClientOptions{
+		initialStateFile: stateFile.Path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A newer state file isn't damaged so the user mustn't be offered the
+	// chance to set it aside.
+	client.AdvanceTo(uiStateError)
+	if errorText := client.gui.text["errortext"]; !strings.Contains(errorText, "newer version of Pond") {
+		t.Errorf("Unexpected error for a newer state file: %s", errorText)
+	}
+	statePath := filepath.Join(client.stateDir, "state")
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("Newer state file is missing: %s", err)
+	}
+	if _, err := os.Stat(statePath + ".corrupt"); !os.IsNotExist(err) {
+		t.Errorf("Newer state file was set aside: %v", err)
+	}
+}
+
 func testReplyACKs(t *testing.T, reloadDraft bool, abortSend bool) {
 	// Test that a message is acked by sending a reply. If reloadDraft is
 	// true then the message is reloaded as draft before sending.
@@ -1792,8 +2849,295 @@ func TestReplyACKsWithDraftAndAbort(t *testing.T) {
 	testReplyACKs(t, true, true)
 }
 
-func TestCliId(t *testing.T) {
-	id := cliId(0x7ab8)
+func TestReplyQuoting(t *testing.T) {
+	c := &client{
+		contacts: map[uint64]*Contact{
+			1: &Contact{name: "alice"},
+		},
+	}
+	sent := time.Date(2014, 3, 7, 12, 30, 0, 0, time.Local)
+	msg := &InboxMessage{
+		from: 1,
+		message: &pond.Message{
+			Time: proto.Int64(sent.Unix()),
+			Body: []byte("hello\n\nworld\n"),
+		},
+	}
+
+	const expected = "On Mar  7 12:30, alice wrote:\n> hello\n>\n> world\n"
+	if body := c.replyBody(msg); body != expected {
+		t.Errorf("got reply body %q, want %q", body, expected)
+	}
+
+	c.disableReplyQuoting = true
+	if body := c.replyBody(msg); len(body) != 0 {
+		t.Errorf("got reply body %q with quoting disabled", body)
+	}
+}
+
+func TestChangeHomeServer(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	newServer, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newServer.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// This message is still queued when the home server changes.
+	composeMessage(client1, "client2", "queued before the move")
+	queued := client1.outbox[len(client1.outbox)-1]
+
+	client1.gui.events <- Click{
+		name: client1.clientUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	// The first click only arms the button.
+	client1.gui.events <- Click{
+		name:    "changeserver",
+		entries: map[string]string{"newserver": newServer.URL()},
+	}
+	client1.gui.WaitForSignal()
+	if client1.server != server.URL() {
+		t.Fatalf("home server changed without confirmation")
+	}
+
+	client1.gui.events <- Click{
+		name:    "changeserver",
+		entries: map[string]string{"newserver": newServer.URL()},
+	}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	if client1.server != newServer.URL() {
+		t.Fatalf("home server is %s, wanted %s", client1.server, newServer.URL())
+	}
+	contact := client1.contacts[client1.contactsUI.entries[0].id]
+	if !contact.isPending {
+		t.Fatalf("contact isn't pending after changing home server")
+	}
+
+	// client1's revocation of the old member key is sent to the new
+	// server while the queued message is held for the key exchange.
+	if len(client1.queue) != 2 || client1.queue[0] != queued || !queued.held {
+		t.Fatalf("queued message isn't held after changing home server")
+	}
+	if !client1.queue[1].revocation || client1.queue[1].server != newServer.URL() {
+		t.Fatalf("revocation isn't queued for the new server")
+	}
+	transmitMessage(client1, false)
+	if len(client1.queue) != 1 || client1.queue[0] != queued || !queued.sent.IsZero() {
+		t.Fatalf("held message was sent, or revocation wasn't")
+	}
+
+	// Repeat the key exchange so that client2 learns of the new server.
+	client1.gui.events <- Click{
+		name: client1.contactsUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateNewContact2)
+
+	client2.gui.events <- Click{name: "newcontact"}
+	client2.AdvanceTo(uiStateNewContact)
+	client2.gui.events <- Click{
+		name:    "name",
+		entries: map[string]string{"name": "client1-moved"},
+	}
+	client2.gui.events <- Click{name: "manual"}
+	client2.AdvanceTo(uiStateNewContact2)
+
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+
+	// client2 is warned that client1-moved has the same identity as
+	// client1 and has to confirm.
+	process := Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client1.gui.text["kxout"]},
+	}
+	client2.gui.events <- process
+	if err := client2.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+	client2.gui.events <- process
+	client2.AdvanceTo(uiStateShowContact)
+
+	// The held message is released by the key exchange and signed with
+	// the new keys.
+	if queued.held || queued.server != contact.theirServer {
+		t.Fatalf("queued message wasn't released by the key exchange")
+	}
+	transmitMessage(client1, false)
+	from, msg := fetchMessage(client2)
+	if from != "client1-moved" {
+		t.Fatalf("message from %s, expected client1-moved", from)
+	}
+	if string(msg.message.Body) != "queued before the move" {
+		t.Fatalf("unexpected message body: %s", msg.message.Body)
+	}
+
+	sendMessage(client2, "client1-moved", "hello at the new server")
+	from, msg = fetchMessage(client1)
+	if from != "client2" {
+		t.Fatalf("message from %s, expected client2", from)
+	}
+	if string(msg.message.Body) != "hello at the new server" {
+		t.Fatalf("unexpected message body: %s", msg.message.Body)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	sendMessage(client2, "client1", "foo")
+	fetchMessage(client1)
+
+	client1.gui.events <- Click{
+		name: client1.clientUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	backupPath := filepath.Join(client1.stateDir, "pond.backup")
+	client1.gui.events <- Click{name: "exportbackup"}
+	fo := client1.gui.WaitForFileOpen()
+	client1.gui.events <- OpenResult{ok: true, path: backupPath, arg: fo.arg}
+	if err := client1.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	client3.AdvanceTo(uiStateCreatePassphrase)
+	client3.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": ""},
+	}
+	client3.AdvanceTo(uiStateErasureStorage)
+	client3.gui.events <- Click{
+		name: "continue",
+	}
+	client3.AdvanceTo(uiStateCreateAccount)
+
+	client3.gui.events <- Click{name: "backupfile"}
+	fo = client3.gui.WaitForFileOpen()
+	client3.gui.events <- OpenResult{ok: true, path: backupPath, arg: fo.arg}
+	client3.gui.events <- Click{name: "restore"}
+	client3.AdvanceTo(uiStateMain)
+
+	if client3.identityPublic != client1.identityPublic {
+		t.Fatalf("restored identity doesn't match")
+	}
+	if len(client3.contacts) != 1 {
+		t.Fatalf("restored state has %d contacts, expected one", len(client3.contacts))
+	}
+}
+
+func TestBackupRejectsNewerVersion(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "pond-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	statePath := filepath.Join(stateDir, "state")
+	if err := ioutil.WriteFile(statePath, make([]byte, 64), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := disk.WriteBackup(&buf, statePath); err != nil {
+		t.Fatal(err)
+	}
+	backup := buf.Bytes()
+	if _, err := disk.ReadBackup(backup); err != nil {
+		t.Fatalf("failed to read backup: %s", err)
+	}
+
+	// Increment the version number, which follows the magic value.
+	backup[8]++
+	if _, err := disk.ReadBackup(backup); err == nil {
+		t.Fatalf("backup from a newer version was accepted")
+	}
+}
+
+func TestParseProxyAddress(t *testing.T) {
+	tests := []struct {
+		host, port, addr string
+		ok               bool
+	}{
+		{"127.0.0.1", "9050", "127.0.0.1:9050", true},
+		{" localhost ", "9150 ", "localhost:9150", true},
+		{"::1", "1080", "[::1]:1080", true},
+		{"", "9050", "", false},
+		{"127.0.0.1", "", "", false},
+		{"127.0.0.1", "0", "", false},
+		{"127.0.0.1", "65536", "", false},
+		{"127.0.0.1", "port", "", false},
+	}
+
+	for _, test := range tests {
+		addr, err := parseProxyAddress(test.host, test.port)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("parseProxyAddress(%q, %q) returned error %v", test.host, test.port, err)
+			continue
+		}
+		if addr != test.addr {
+			t.Errorf("parseProxyAddress(%q, %q) = %q, want %q", test.host, test.port, addr, test.addr)
+		}
+	}
+}
+
+func TestCliId(t *testing.T) {
+	id := cliId(0x7ab8)
 	s := id.String()
 	t.Log(s)
 	if result, ok := cliIdFromString(s); !ok || result != id {
@@ -2218,7 +3562,7 @@ func TestOutboxDeletion(t *testing.T) {
 	}
 }
 
-func TestStateFileLocking(t *testing.T) {
+func TestSentLifetime(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2241,20 +3585,67 @@ func TestStateFileLocking(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	stateFile, err := os.Open(filepath.Join(client1.stateDir, "state"))
-	if err != nil {
-		t.Fatalf("Failed to open state file")
+	// The first message is retained while it's being shown.
+	sendMessage(client1, "client2", "retained")
+	retained := client1.outbox[0]
+	client1.gui.events <- Click{
+		name:   "retain",
+		checks: map[string]bool{"retain": true},
 	}
-	defer stateFile.Close()
-	if syscall.Flock(int(stateFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
-		t.Fatalf("Was able to lock state file")
+	client1.AdvanceTo(uiStateOutbox)
+	sendMessage(client1, "client2", "not retained")
+
+	setSentLifetime := func(label string) {
+		client1.gui.events <- Click{
+			name: client1.clientUI.entries[0].boxName,
+		}
+		client1.AdvanceTo(uiStateShowIdentity)
+		client1.gui.events <- Click{
+			name:   "sentlifetime",
+			combos: map[string]string{"sentlifetime": label},
+		}
+		// Reselecting the identity view ensures that the previous
+		// click has been processed.
+		client1.gui.events <- Click{
+			name: client1.clientUI.entries[0].boxName,
+		}
+		client1.AdvanceTo(uiStateShowIdentity)
+	}
+
+	baseTime := time.Now()
+	setSentLifetime("Never")
+	client1.nowFunc = func() time.Time {
+		return baseTime.Add(messageLifetime + 10*time.Second)
+	}
+	client1.testTimerChan <- baseTime
+	client1.AdvanceTo(uiStateTimerComplete)
+	if n := len(client1.outbox); n != 2 {
+		t.Fatalf("%d messages left in the outbox when sent messages are kept", n)
+	}
+
+	setSentLifetime("After 1 day")
+	client1.nowFunc = func() time.Time {
+		return baseTime.Add(2 * 24 * time.Hour)
+	}
+	client1.testTimerChan <- baseTime
+	client1.AdvanceTo(uiStateTimerComplete)
+	if n := len(client1.outbox); n != 1 || client1.outbox[0] != retained {
+		t.Fatalf("Expected only the retained message to be left in the outbox, but found %d messages", n)
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if n := len(client1.outbox); n != 1 || !client1.outbox[0].retained {
+		t.Errorf("Retained message wasn't kept after reload")
+	}
+	if client1.sentLifetime != 24*time.Hour || client1.keepSent {
+		t.Errorf("Sent message lifetime wasn't kept after reload: %s, %t", client1.sentLifetime, client1.keepSent)
 	}
 }
 
-func TestMergedACKs(t *testing.T) {
+func TestMessageDetails(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2277,49 +3668,62 @@ func TestMergedACKs(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	// Send two messages to client2.
-	sendMessage(client1, "client2", "foo1")
-	fetchMessage(client2)
-	sendMessage(client1, "client2", "foo2")
-	fetchMessage(client2)
-
-	// Ack the two messages in client2. The second ack should merge with
-	// the first.
-	client2.gui.events <- Click{
-		name: client2.inboxUI.entries[0].boxName,
+	client1.gui.events <- Click{
+		name: client1.clientUI.entries[0].boxName,
 	}
-	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name: "ack",
+	client1.AdvanceTo(uiStateShowIdentity)
+	client1.gui.events <- Click{
+		name:   "messagedetails",
+		checks: map[string]bool{"messagedetails": true},
 	}
-	client2.AdvanceTo(uiStateInbox)
+	client1.AdvanceTo(uiStateShowIdentity)
 
-	client2.gui.events <- Click{
-		name: client2.inboxUI.entries[1].boxName,
+	attachmentPath := filepath.Join(client1.stateDir, "attachment")
+	if err := ioutil.WriteFile(attachmentPath, make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
 	}
-	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name: "ack",
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	client1.gui.events <- Click{name: "attach"}
+	client1.gui.WaitForFileOpen()
+	client1.gui.events <- OpenResult{path: attachmentPath, ok: true}
+	client1.gui.WaitForSignal()
+	client1.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "attached"},
 	}
-	client2.AdvanceTo(uiStateInbox)
+	client1.AdvanceTo(uiStateOutbox)
 
-	// Send only one message from client2.
-	transmitMessage(client2, false)
+	entry := client1.outboxUI.entries[0]
+	if !entry.hasDetail {
+		t.Fatalf("Outbox entry has no detail")
+	}
+	detail := client1.gui.text[entry.detailName]
+	if want := messageDetail(client1.outbox[0].message); detail != want {
+		t.Errorf("Outbox entry detail is %q, but wanted %q", detail, want)
+	}
+	if !strings.HasPrefix(detail, "\U0001F4CE1") || !strings.HasSuffix(detail, "KB") {
+		t.Errorf("Outbox entry detail %q doesn't describe the attachment and size", detail)
+	}
 
-	// Both messages should be ACKed in client1 on receipt.
-	fetchMessage(client1)
+	// Details aren't shown by default.
+	transmitMessage(client1, false)
+	fetchMessage(client2)
+	if entry := client2.inboxUI.entries[0]; entry.hasDetail {
+		t.Errorf("Inbox entry has a detail although it wasn't asked for")
+	}
 
-	for _, msg := range client1.outbox {
-		if msg.acked.IsZero() {
-			t.Errorf("Unacked message in client1's outbox.")
-		}
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if !client1.messageDetails || !client1.outboxUI.entries[0].hasDetail {
+		t.Errorf("Message details weren't shown after reload")
 	}
 }
 
-func TestEntombing(t *testing.T) {
+func TestStateFileLocking(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2345,9 +3749,110 @@ func TestEntombing(t *testing.T) {
 	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	// Send a message so that we can be sure that the state file was
-	// correctly recovered.
-	sendMessage(client1, "client2", "foo1")
+	stateFile, err := os.Open(filepath.Join(client1.stateDir, "state"))
+	if err != nil {
+		t.Fatalf("Failed to open state file")
+	}
+	defer stateFile.Close()
+	if syscall.Flock(int(stateFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+		t.Fatalf("Was able to lock state file")
+	}
+}
+
+func TestMergedACKs(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	// Send two messages to client2.
+	sendMessage(client1, "client2", "foo1")
+	fetchMessage(client2)
+	sendMessage(client1, "client2", "foo2")
+	fetchMessage(client2)
+
+	// Ack the two messages in client2. The second ack should merge with
+	// the first.
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[1].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	// Send only one message from client2.
+	transmitMessage(client2, false)
+
+	// Both messages should be ACKed in client1 on receipt.
+	fetchMessage(client1)
+
+	for _, msg := range client1.outbox {
+		if msg.acked.IsZero() {
+			t.Errorf("Unacked message in client1's outbox.")
+		}
+	}
+}
+
+func TestEntombing(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	// Send a message so that we can be sure that the state file was
+	// correctly recovered.
+	sendMessage(client1, "client2", "foo1")
 	fetchMessage(client2)
 
 	// Emtomb client1.
@@ -2386,3 +3891,5661 @@ func TestEntombing(t *testing.T) {
 		t.Fatalf("No messages in outbox")
 	}
 }
+
+func TestAccountTransfer(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	sendMessage(client1, "client2", "foo1")
+	fetchMessage(client2)
+
+	transferPath := filepath.Join(client1.stateDir, "pond.transfer")
+	client1.gui.events <- Click{
+		name: client1.clientUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	client1.gui.events <- OpenResult{ok: true, path: transferPath, arg: transferFileArg{}}
+	client1.gui.events <- Click{
+		name:    "transfer",
+		entries: map[string]string{"transferpassphrase": ""},
+	}
+	client1.AdvanceTo(uiStateShowIdentity)
+	if len(client1.gui.text["transfererror"]) == 0 {
+		t.Fatalf("Transfer started without a passphrase")
+	}
+
+	client1.gui.events <- Click{
+		name:    "transfer",
+		entries: map[string]string{"transferpassphrase": "passphrase"},
+	}
+	client1.AdvanceTo(uiStateTransfer)
+	client1.AdvanceTo(uiStateTransfer)
+	code := client1.gui.text["transfercode"]
+	if len(code) == 0 {
+		t.Fatalf("No transfer code was displayed")
+	}
+
+	client1.gui.events <- Click{name: "transferdone"}
+	client1.gui.events <- Click{name: "transferdone"}
+	client1.AdvanceTo(uiStateTransferComplete)
+	if _, err := os.Stat(filepath.Join(client1.stateDir, "state")); !os.IsNotExist(err) {
+		t.Fatalf("State file still exists after the transfer was completed: %v", err)
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateLoading)
+	client1.AdvanceTo(uiStateCreatePassphrase)
+	client1.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": ""},
+	}
+	client1.AdvanceTo(uiStateErasureStorage)
+	client1.gui.events <- Click{
+		name: "continue",
+	}
+
+	bundle, err := ioutil.ReadFile(transferPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.ReadTransfer(bundle, "passphrase", "AAAA-AAAA-AAAA-AAAA"); err != disk.BadTransferKeyError {
+		t.Fatalf("Bad error from opening the transfer file with the wrong code: %v", err)
+	}
+
+	// A bundle with an excessive scrypt cost must be rejected before the
+	// key is derived.
+	headerLen := binary.LittleEndian.Uint32(bundle[12:])
+	var header disk.Header
+	if err := proto.Unmarshal(bundle[16:16+headerLen], &header); err != nil {
+		t.Fatal(err)
+	}
+	header.Scrypt = &disk.Header_SCrypt{N: proto.Int32(1 << 30)}
+	headerBytes, err := proto.Marshal(&header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte(nil), bundle[:12]...)
+	var lenBytes [4]byte
+	binary.LittleEndian.PutUint32(lenBytes[:], uint32(len(headerBytes)))
+	tampered = append(tampered, lenBytes[:]...)
+	tampered = append(tampered, headerBytes...)
+	tampered = append(tampered, bundle[16+headerLen:]...)
+	if _, err := disk.ReadTransfer(tampered, "passphrase", code); err == nil || err == disk.BadTransferKeyError {
+		t.Fatalf("Bad error from opening a transfer file with an excessive scrypt cost: %v", err)
+	}
+
+	client1.AdvanceTo(uiStateCreateAccount)
+	client1.gui.events <- OpenResult{ok: true, path: transferPath, arg: transferFileArg{}}
+	client1.gui.events <- Click{
+		name: "importtransfer",
+		entries: map[string]string{
+			"transferimportpassphrase": "passphrase",
+			// The code may be entered without separators and in
+			// lower case.
+			"transfercode": strings.ToLower(strings.Replace(code, "-", "", -1)),
+		},
+	}
+	client1.AdvanceTo(uiStateMain)
+
+	if len(client1.outbox) != 1 {
+		t.Fatalf("No messages in outbox")
+	}
+	if _, err := os.Stat(transferPath); !os.IsNotExist(err) {
+		t.Errorf("Transfer file still exists after it was imported: %v", err)
+	}
+
+	// The imported account must still work with its contact.
+	sendMessage(client1, "client2", "foo2")
+	if from, msg := fetchMessage(client2); from != "client1" || string(msg.message.Body) != "foo2" {
+		t.Errorf("Bad message after transfer: from %s: %s", from, msg.message.Body)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", &TestClientOptions{profiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	createProfile := func(name, passphrase string) {
+		client.gui.events <- Click{
+			name:    "createprofile",
+			entries: map[string]string{"newprofile": name},
+		}
+		client.AdvanceTo(uiStateCreatePassphrase)
+		client.gui.events <- Click{
+			name:    "next",
+			entries: map[string]string{"pw": passphrase},
+		}
+		client.AdvanceTo(uiStateErasureStorage)
+		client.gui.events <- Click{
+			name: "continue",
+		}
+		client.AdvanceTo(uiStateCreateAccount)
+		client.gui.events <- Click{
+			name:    "create",
+			entries: map[string]string{"server": server.URL()},
+		}
+		client.AdvanceTo(uiStateMain)
+	}
+
+	client.AdvanceTo(uiStateProfiles)
+	if profiles := client.gui.combos["profiles"]; len(profiles) != 0 {
+		t.Fatalf("Unexpected profiles: %v", profiles)
+	}
+	client.gui.events <- Click{
+		name:    "createprofile",
+		entries: map[string]string{"newprofile": "../work"},
+	}
+	client.AdvanceTo(uiStateProfiles)
+	if len(client.gui.text["profileerror"]) == 0 {
+		t.Fatalf("Invalid profile name accepted")
+	}
+	createProfile("work", "passphrase")
+	workIdentity := client.identityPublic
+
+	client.Reload()
+	client.AdvanceTo(uiStateProfiles)
+	createProfile("home", "")
+	if client.identityPublic == workIdentity {
+		t.Fatalf("New profile has the same identity as the first")
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateProfiles)
+	client.gui.events <- Click{
+		name:    "createprofile",
+		entries: map[string]string{"newprofile": "Work"},
+	}
+	client.AdvanceTo(uiStateProfiles)
+	if len(client.gui.text["profileerror"]) == 0 {
+		t.Fatalf("Profile name differing only in case accepted")
+	}
+	if profiles := client.gui.combos["profiles"]; len(profiles) != 2 || profiles[0] != "home" || profiles[1] != "work" {
+		t.Fatalf("Unexpected profiles: %v", profiles)
+	}
+	client.gui.events <- Click{
+		name:   "openprofile",
+		combos: map[string]string{"profiles": "work"},
+	}
+	client.AdvanceTo(uiStatePassphrase)
+	client.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": "passphrase"},
+	}
+	client.AdvanceTo(uiStateMain)
+	if client.identityPublic != workIdentity {
+		t.Errorf("Opening a profile loaded the wrong identity")
+	}
+	if _, err := os.Stat(filepath.Join(client.profilesDir, "work"+profileSuffix+instanceLockSuffix)); err != nil {
+		t.Errorf("Profile isn't locked: %s", err)
+	}
+}
+
+func TestAttachmentThumbnail(t *testing.T) {
+	encode := func(img image.Image) []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	thumbnail := attachmentThumbnail(encode(image.NewGray(image.Rect(0, 0, 600, 300))))
+	if thumbnail == nil {
+		t.Fatalf("No thumbnail generated for a valid image")
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		t.Fatalf("Failed to decode thumbnail: %s", err)
+	}
+	if config.Width != maxThumbnailDimension || config.Height != maxThumbnailDimension/2 {
+		t.Errorf("Bad thumbnail dimensions: %dx%d", config.Width, config.Height)
+	}
+
+	if attachmentThumbnail(encode(image.NewGray(image.Rect(0, 0, 4096, 4096)))) != nil {
+		t.Errorf("Thumbnail generated for an oversized image")
+	}
+	if attachmentThumbnail([]byte("not an image")) != nil {
+		t.Errorf("Thumbnail generated for a non-image")
+	}
+}
+
+func TestDetectAttachmentType(t *testing.T) {
+	var pngBytes bytes.Buffer
+	if err := png.Encode(&pngBytes, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		contents []byte
+		mimeType string
+		isImage  bool
+	}{
+		{pngBytes.Bytes(), "image/png", true},
+		{[]byte("GIF89a......"), "image/gif", true},
+		{[]byte("%PDF-1.4\n"), "application/pdf", false},
+		{[]byte("PK\x03\x04 archive"), "application/zip", false},
+		{[]byte("just some text"), "text/plain", false},
+		{[]byte{0, 1, 2, 3, 0xff}, "application/octet-stream", false},
+		// Only the start of the contents is considered.
+		{append(bytes.Repeat([]byte("a"), sniffLen), pngBytes.Bytes()...), "text/plain", false},
+	} {
+		got := detectAttachmentType(test.contents)
+		if got.mimeType != test.mimeType || got.isImage != test.isImage {
+			t.Errorf("#%d: got %s (image: %t), want %s (image: %t)", i, got.mimeType, got.isImage, test.mimeType, test.isImage)
+		}
+		if len(got.label) == 0 || len(got.icon) == 0 {
+			t.Errorf("#%d: missing label or icon for %s", i, got.mimeType)
+		}
+	}
+}
+
+func TestDraftUsage(t *testing.T) {
+	draft := &Draft{
+		inReplyTo: 1,
+		attachments: []*pond.Message_Attachment{
+			{Filename: proto.String("a.txt"), Contents: make([]byte, 300)},
+		},
+	}
+
+	for _, bodyLen := range []int{0, 1, 127, 128, 16383, 16384, pond.MaxSerializedMessage} {
+		draft.body = strings.Repeat("x", bodyLen)
+		u := draft.usage(len(draft.body))
+
+		var dhPub [32]byte
+		serialized, err := proto.Marshal(&pond.Message{
+			Id:               proto.Uint64(0),
+			Time:             proto.Int64(1 << 62),
+			Body:             []byte(draft.body),
+			BodyEncoding:     pond.Message_RAW.Enum(),
+			InReplyTo:        proto.Uint64(1),
+			MyNextDh:         dhPub[:],
+			Files:            draft.attachments,
+			SupportedVersion: proto.Int32(protoVersion),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.total != len(serialized) {
+			t.Errorf("Bad total for %d byte body: got %d, want %d", bodyLen, u.total, len(serialized))
+		}
+		if u.body < bodyLen || u.attachments < 300 || u.body+u.attachments > u.total {
+			t.Errorf("Bad breakdown for %d byte body: %#v", bodyLen, u)
+		}
+		if over := u.total > pond.MaxSerializedMessage; u.over() != over || (usageColor(u) == colorRed) != over {
+			t.Errorf("Bad over-size result for %d byte body", bodyLen)
+		}
+	}
+}
+
+func TestCompressedDraftUsage(t *testing.T) {
+	contact := &Contact{id: 1, supportedVersion: protoVersion}
+	c := &client{contacts: map[uint64]*Contact{contact.id: contact}}
+	draft := &Draft{
+		to:   contact.id,
+		body: strings.Repeat("All work and no play makes Jack a dull boy. ", pond.MaxSerializedMessage/40),
+	}
+
+	if !draft.usage(len(draft.body)).over() {
+		t.Fatalf("Uncompressed body should be over-size")
+	}
+	if u := c.draftUsage(draft); u.over() || !u.compressed {
+		t.Errorf("Compressed body should fit: %#v", u)
+	}
+	if c.compressedBody != draft.body || len(c.compressedBodyLens) == 0 {
+		t.Errorf("Compressed length of the body wasn't cached")
+	}
+	draft.body += "!"
+	if u := c.draftUsage(draft); u.over() || !u.compressed || c.compressedBody != draft.body {
+		t.Errorf("Compressed length wasn't recalculated after the body changed: %#v", u)
+	}
+
+	c.disableBodyCompression = true
+	if u := c.draftUsage(draft); !u.over() || u.compressed {
+		t.Errorf("Body was compressed when compression was disabled: %#v", u)
+	}
+
+	c.disableBodyCompression = false
+	contact.supportedVersion = 1
+	if u := c.draftUsage(draft); !u.over() || u.compressed {
+		t.Errorf("Body was compressed for a contact that doesn't support it: %#v", u)
+	}
+}
+
+func TestRatchetAudit(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "ping")
+	fetchMessage(client2)
+	sendMessage(client2, "client1", "pong")
+	fetchMessage(client1)
+
+	_, contact := contactByName(client1, "client2")
+	if contact.theirDHAdvanced.IsZero() {
+		t.Errorf("client1 didn't observe client2 advancing the ratchet")
+	}
+	if _, contact := contactByName(client2, "client1"); contact.ourDHAdvanced.IsZero() {
+		t.Errorf("client2 didn't record advancing the ratchet")
+	}
+	if audit := client1.auditRatchet(contact); audit.stalled || audit.sentSinceTheirAdvance != 0 {
+		t.Errorf("Bad audit after a reply: %#v", audit)
+	}
+
+	selectContact(t, client1, "client2")
+	client1.gui.events <- Click{name: "ratchet"}
+	client1.gui.WaitForSignal()
+	if status := client1.gui.text["ratchetstatus"]; status != "OK" {
+		t.Errorf("Bad ratchet status: %s", status)
+	}
+
+	// Messages that are sent without the contact ever replying should
+	// cause the ratchet to be reported as stalled.
+	c := &client{}
+	stuck := &Contact{id: 1, theirDHAdvanced: time.Now().Add(-time.Hour)}
+	for i := 0; i < ratchetStallThreshold; i++ {
+		c.outbox = append(c.outbox, &queuedMessage{to: stuck.id, sent: time.Now()})
+		if audit := c.auditRatchet(stuck); audit.stalled != (i == ratchetStallThreshold-1) {
+			t.Fatalf("Bad stalled value after %d messages", i+1)
+		}
+	}
+	c.outbox = append(c.outbox, &queuedMessage{to: 2, sent: time.Now()})
+	if audit := c.auditRatchet(stuck); audit.sentSinceTheirAdvance != ratchetStallThreshold {
+		t.Errorf("Messages to other contacts were counted: %d", audit.sentSinceTheirAdvance)
+	}
+}
+
+func TestResend(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "test message")
+	client1.gui.events <- Click{name: client1.outboxUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateOutbox)
+
+	original := client1.outbox[0]
+	if client1.canResend(original) {
+		t.Fatalf("A message that was just sent can be resent")
+	}
+	original.sent = original.sent.Add(-2 * resendAfter)
+	original.created = original.created.Add(-time.Hour)
+	if !client1.canResend(original) {
+		t.Fatalf("An old, unacknowledged message cannot be resent")
+	}
+
+	client1.gui.events <- Click{name: "resend"}
+	client1.AdvanceTo(uiStateOutbox)
+
+	if l := len(client1.outbox); l != 1 {
+		t.Fatalf("Bad number of outbox entries after resend: %d", l)
+	}
+	resent := client1.outbox[0]
+	if resent.id == original.id || resent.message.GetId() != original.message.GetId() || !resent.created.Equal(original.created) {
+		t.Fatalf("Resent message has unexpected identifiers")
+	}
+	if !resent.enqueued.After(resent.created) {
+		t.Errorf("Resent message wasn't queued after it was created")
+	}
+	if s := client1.gui.text["queued"]; !strings.HasSuffix(s, " later)") {
+		t.Errorf("Queued time of resent message is shown as %q", s)
+	}
+	transmitMessage(client1, false)
+
+	// The recipient should discard the second copy.
+	if from, _ := fetchMessage(client2); from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+	if _, msg := fetchMessage(client2); msg != nil {
+		t.Fatalf("Duplicate message was delivered")
+	}
+
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{name: "ack"}
+	client2.AdvanceTo(uiStateInbox)
+	transmitMessage(client2, false)
+	fetchMessage(client1)
+
+	if resent.acked.IsZero() {
+		t.Fatalf("Acknowledgement of the original message wasn't applied to the resent message")
+	}
+}
+
+// copyQueuedMessages returns the contents of the messages that are waiting
+// on the server for the given client.
+func copyQueuedMessages(t *testing.T, server *TestServer, client *TestClient) map[string][]byte {
+	dir := filepath.Join(server.stateDir, "accounts", fmt.Sprintf("%x", client.identityPublic[:]))
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make(map[string][]byte)
+	for _, ent := range ents {
+		// Message files are named with a timestamp and digest, in hex.
+		if ent.IsDir() || len(ent.Name()) != (8+32)*2 {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, ent.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs[ent.Name()] = contents
+	}
+	return msgs
+}
+
+// redeliver puts messages, from copyQueuedMessages, back on the server.
+func redeliver(t *testing.T, server *TestServer, client *TestClient, msgs map[string][]byte) {
+	dir := filepath.Join(server.stateDir, "accounts", fmt.Sprintf("%x", client.identityPublic[:]))
+	for name, contents := range msgs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDuplicateDelivery(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "test message")
+	queued := copyQueuedMessages(t, server, client2)
+	if len(queued) != 1 {
+		t.Fatalf("Expected one message on the server, found %d", len(queued))
+	}
+	if from, _ := fetchMessage(client2); from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+	redeliver(t, server, client2, queued)
+	fetchMessage(client2)
+
+	if l := len(client2.inbox); l != 1 {
+		t.Fatalf("Redelivered message resulted in %d inbox entries", l)
+	}
+
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{name: "ack"}
+	client2.AdvanceTo(uiStateInbox)
+	transmitMessage(client2, false)
+
+	queued = copyQueuedMessages(t, server, client1)
+	fetchMessage(client1)
+	acked := client1.outbox[0].acked
+	if acked.IsZero() {
+		t.Fatalf("Message wasn't acknowledged")
+	}
+	redeliver(t, server, client1, queued)
+	fetchMessage(client1)
+	if !client1.outbox[0].acked.Equal(acked) {
+		t.Fatalf("Redelivered acknowledgement changed the acknowledgement time")
+	}
+}
+
+func TestBodyEncoding(t *testing.T) {
+	longBody := []byte(strings.Repeat("All work and no play makes Jack a dull boy. ", 200))
+	oldContact := &Contact{supportedVersion: 1}
+	newContact := &Contact{supportedVersion: protoVersion}
+	c := &client{}
+
+	if _, encoding := c.encodeBody(longBody, oldContact); encoding != pond.Message_RAW {
+		t.Errorf("Body was compressed for a contact that doesn't support it")
+	}
+
+	encoded, encoding := c.encodeBody(longBody, newContact)
+	if encoding != pond.Message_GZIP || len(encoded) >= len(longBody) {
+		t.Fatalf("Compressible body wasn't compressed")
+	}
+	body, err := decodeBody(&pond.Message{Body: encoded, BodyEncoding: encoding.Enum()})
+	if err != nil {
+		t.Fatalf("Failed to decode body: %s", err)
+	}
+	if body != string(longBody) {
+		t.Errorf("Body changed after encoding and decoding")
+	}
+
+	random := make([]byte, 1000)
+	io.ReadFull(rand.Reader, random)
+	if _, encoding := c.encodeBody(random, newContact); encoding != pond.Message_RAW {
+		t.Errorf("Incompressible body was compressed")
+	}
+
+	c.disableBodyCompression = true
+	if _, encoding := c.encodeBody(longBody, newContact); encoding != pond.Message_RAW {
+		t.Errorf("Body was compressed when compression was disabled")
+	}
+
+	unknown := pond.Message_Encoding(99)
+	if _, err := decodeBody(&pond.Message{Body: longBody, BodyEncoding: &unknown}); err != errUnsupportedEncoding {
+		t.Errorf("Unknown encoding gave unexpected result: %v", err)
+	}
+
+	if _, encoding := c.encodeBody(make([]byte, maxDecodedBodyLen+1), newContact); encoding != pond.Message_RAW {
+		t.Errorf("Body that couldn't be decoded was compressed")
+	}
+
+	var bomb bytes.Buffer
+	w := gzip.NewWriter(&bomb)
+	w.Write(make([]byte, maxDecodedBodyLen+1))
+	w.Close()
+	if _, err := decodeBody(&pond.Message{Body: bomb.Bytes(), BodyEncoding: pond.Message_GZIP.Enum()}); err == nil {
+		t.Errorf("Body that decompresses to an excessive size was accepted")
+	}
+}
+
+func TestCompressedMessage(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// client1 learns that client2 supports compression from this message.
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+
+	longBody := strings.Repeat("All work and no play makes Jack a dull boy. ", 200)
+	sendMessage(client1, "client2", longBody)
+	_, msg := fetchMessage(client2)
+	if msg == nil {
+		t.Fatalf("Failed to receive message")
+	}
+	if encoding := msg.message.GetBodyEncoding(); encoding != pond.Message_GZIP {
+		t.Errorf("Message was sent with encoding %s", encoding)
+	}
+
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+	if s := client2.gui.text["body"]; s != longBody {
+		t.Fatalf("Compressed message was displayed incorrectly")
+	}
+}
+
+func TestIdleLock(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "idlelock",
+		combos: map[string]string{"idlelock": "After 5 minutes"},
+	}
+	// Reselecting the identity view ensures that the previous click has
+	// been processed.
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	// A timer tick shortly after the last event shouldn't lock.
+	baseTime := time.Now()
+	client.nowFunc = func() time.Time {
+		return baseTime.Add(time.Minute)
+	}
+	client.testTimerChan <- baseTime
+	client.AdvanceTo(uiStateTimerComplete)
+
+	if client.idleLockTimeout != 5*time.Minute {
+		t.Fatalf("Idle lock timeout wasn't set: %s", client.idleLockTimeout)
+	}
+
+	client.nowFunc = func() time.Time {
+		return baseTime.Add(10 * time.Minute)
+	}
+	client.testTimerChan <- baseTime
+
+WaitForLock:
+	for {
+		select {
+		case _, ok := <-client.gui.actions:
+			if !ok {
+				break WaitForLock
+			}
+		case ack := <-client.gui.signal:
+			ack <- true
+		}
+	}
+
+	client.nowFunc = nil
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	if client.idleLockTimeout != 5*time.Minute {
+		t.Errorf("Idle lock timeout wasn't persisted: %s", client.idleLockTimeout)
+	}
+
+	for _, test := range []struct {
+		d     time.Duration
+		label string
+	}{
+		{0, "Never"},
+		{time.Minute, "After 1 minute"},
+		{90 * time.Minute, "After 90 minutes"},
+		{4 * time.Hour, "After 4 hours"},
+	} {
+		if label := idleLockLabel(test.d); label != test.label {
+			t.Errorf("Bad label for %s: got %q, want %q", test.d, label, test.label)
+		}
+	}
+}
+
+func TestShutdownWipesKeys(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(client1.stateDir)
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	sendMessage(client2, "client1", "foo")
+	fetchMessage(client1)
+
+	client1.Shutdown()
+
+	isZero := func(b []byte) bool {
+		for _, v := range b {
+			if v != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !isZero(client1.priv[:]) {
+		t.Errorf("Signing key wasn't wiped")
+	}
+	if !isZero(client1.identity[:]) {
+		t.Errorf("Identity key wasn't wiped")
+	}
+	if !isZero(client1.groupPriv.Marshal()) {
+		t.Errorf("Group private key wasn't wiped")
+	}
+	_, contact := contactByName(client1, "client2")
+	if !isZero(contact.lastDHPrivate[:]) || !isZero(contact.currentDHPrivate[:]) {
+		t.Errorf("Contact DH private values weren't wiped")
+	}
+	if !isZero(contact.myGroupKey.Marshal()[:32]) {
+		t.Errorf("Member key wasn't wiped")
+	}
+	if !isZero(contact.ratchet.Marshal(time.Now(), messageLifetime).RootKey) {
+		t.Errorf("Ratchet wasn't wiped")
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	// This example, of version 1-M, is from the Thonky QR code tutorial.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	wantECC := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ecc := qrReedSolomonRemainder(data, qrReedSolomonDivisor(10)); !bytes.Equal(ecc, wantECC) {
+		t.Errorf("Bad error correction codewords: got %v, want %v", ecc, wantECC)
+	}
+
+	if bits := qrFormatBits(1); bits != 0x5125 {
+		t.Errorf("Bad format bits: %x", bits)
+	}
+	if bits := qrFormatBits(7); bits != 0x4aa0 {
+		t.Errorf("Bad format bits: %x", bits)
+	}
+	if bits := qrVersionBits(7); bits != 0x07c94 {
+		t.Errorf("Bad version bits: %x", bits)
+	}
+
+	lengths := []int{0, 1}
+	for version := 1; version <= qrMaxVersion; version++ {
+		lengths = append(lengths, qrCapacity(version))
+	}
+	for _, n := range lengths {
+		in := make([]byte, n)
+		io.ReadFull(rand.Reader, in)
+		code, err := encodeQR(in)
+		if err != nil {
+			t.Fatalf("Failed to encode %d bytes: %s", n, err)
+		}
+		if n > 0 && n > qrCapacity(code.version) || code.version > 1 && n <= qrCapacity(code.version-1) {
+			t.Errorf("Bad version %d for %d bytes", code.version, n)
+		}
+		out, err := decodeQRImage(code.image())
+		if err != nil {
+			t.Fatalf("Failed to decode %d bytes: %s", n, err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Errorf("Contents changed after encoding and decoding %d bytes", n)
+		}
+	}
+
+	if _, err := encodeQR(make([]byte, qrCapacity(qrMaxVersion)+1)); err == nil {
+		t.Errorf("Oversized contents were encoded")
+	}
+
+	code, _ := encodeQR([]byte("damaged"))
+	code.dataPositions(func(x, y int) {
+		code.modules[y][x] = !code.modules[y][x]
+	})
+	if _, err := decodeQRImage(code.image()); err == nil {
+		t.Errorf("Damaged code was decoded")
+	}
+}
+
+func TestHandshakeQR(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	block, _ := pem.Decode([]byte(client1.gui.text["kxout"]))
+	pngs, err := handshakeQRCodes(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pngs) < 2 {
+		t.Fatalf("Expected the handshake to be split across several codes, but got %d", len(pngs))
+	}
+
+	// Read the codes in reverse order to check that order doesn't matter.
+	for i := len(pngs) - 1; i >= 0; i-- {
+		path := filepath.Join(client2.stateDir, fmt.Sprintf("qr%d.png", i))
+		if err := ioutil.WriteFile(path, pngs[i], 0600); err != nil {
+			t.Fatal(err)
+		}
+		client2.gui.events <- Click{name: "loadqr"}
+		fo := client2.gui.WaitForFileOpen()
+		client2.gui.events <- OpenResult{ok: true, path: path, arg: fo.arg}
+		if err := client2.gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && len(client2.gui.text["kxin"]) > 0 {
+			t.Fatalf("Handshake was complete after reading %d codes", len(pngs)-i)
+		}
+	}
+
+	if kxin := client2.gui.text["kxin"]; kxin != client1.gui.text["kxout"] {
+		t.Fatalf("Handshake from QR codes doesn't match: got %q", kxin)
+	}
+
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxin"]},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+
+	sendMessage(client1, "client2", "hello")
+	if from, _ := fetchMessage(client2); from != "client1" {
+		t.Fatalf("Message from %s, expected client1", from)
+	}
+}
+
+func TestKeyExchangeErrors(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	block, _ := pem.Decode([]byte(client2.gui.text["kxout"]))
+	var kxs pond.SignedKeyExchange
+	if err := proto.Unmarshal(block.Bytes, &kxs); err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(f func(kxs *pond.SignedKeyExchange)) string {
+		tampered := kxs
+		tampered.Signature = append([]byte{}, kxs.Signature...)
+		f(&tampered)
+		kxsBytes, err := proto.Marshal(&tampered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Bytes: kxsBytes, Type: keyExchangePEM}))
+	}
+
+	tests := []struct {
+		handshake string
+		code      kxErrorCode
+		errText   string
+	}{
+		{
+			tamper(func(kxs *pond.SignedKeyExchange) { kxs.Signature[0] ^= 1 }),
+			kxErrSignature,
+			"invalid signature",
+		},
+		{
+			tamper(func(kxs *pond.SignedKeyExchange) { kxs.Signature = kxs.Signature[1:] }),
+			kxErrSignatureLength,
+			"invalid signature length",
+		},
+		{
+			string(pem.EncodeToMemory(&pem.Block{Bytes: []byte{0xff}, Type: keyExchangePEM})),
+			kxErrUnparsable,
+			"",
+		},
+	}
+
+	for i, test := range tests {
+		client1.gui.text["error2guidance"] = ""
+		client1.gui.events <- Click{
+			name:      "process",
+			textViews: map[string]string{"kxin": test.handshake},
+		}
+		if err := client1.gui.WaitForSignal(); err == nil {
+			t.Fatalf("#%d: no error from invalid handshake", i)
+		} else if kxErr, ok := err.(*kxError); !ok || kxErr.code != test.code {
+			t.Errorf("#%d: unexpected error: %#v", i, err)
+		} else if guidance := client1.gui.text["error2guidance"]; guidance != kxErr.guidance() || len(guidance) == 0 {
+			t.Errorf("#%d: bad guidance: %q", i, guidance)
+		}
+		if len(test.errText) > 0 && client1.gui.text["error2"] != test.errText {
+			t.Errorf("#%d: bad error text: %q", i, client1.gui.text["error2"])
+		}
+	}
+
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+}
+
+func TestKeyExchangeUnknownFields(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	// A newer client may add fields to both the signed key exchange and
+	// the wrapper around it. Field 100 is a varint and field 101 is a
+	// string.
+	unknownFields := []byte{0xa0, 0x06, 0x01, 0xaa, 0x06, 0x03, 'n', 'e', 'w'}
+
+	block, _ := pem.Decode([]byte(client2.gui.text["kxout"]))
+	var kxs pond.SignedKeyExchange
+	if err := proto.Unmarshal(block.Bytes, &kxs); err != nil {
+		t.Fatal(err)
+	}
+	kxs.Signed = append(kxs.Signed, unknownFields...)
+	sig := ed25519.Sign(&client2.priv, kxs.Signed)
+	kxs.Signature = sig[:]
+	kxsBytes, err := proto.Marshal(&kxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kxsBytes = append(kxsBytes, unknownFields...)
+
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": string(pem.EncodeToMemory(&pem.Block{Bytes: kxsBytes, Type: keyExchangePEM}))},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+
+	client2.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client1.gui.text["kxout"]},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+
+	sendMessage(client1, "client2", "hello")
+	if from, _ := fetchMessage(client2); from != "client1" {
+		t.Fatalf("Message from %s, expected client1", from)
+	}
+}
+
+func TestServerProbe(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	id, contact := contactByName(client1, "client2")
+	if len(contact.serverStatus) != 0 {
+		t.Fatalf("Server was probed while testing: %s", contact.serverStatus)
+	}
+
+	// Simulate the result of a probe arriving while the contact is shown.
+	client1.backgroundChan <- serverProbeResult{id, errors.New("connection refused")}
+	client1.AdvanceTo(uiStateShowContact)
+	if status := contact.serverStatus; !strings.HasPrefix(status, "unreachable") || !strings.Contains(status, "connection refused") {
+		t.Errorf("Bad server status after failed probe: %s", status)
+	}
+
+	client1.backgroundChan <- serverProbeResult{id, nil}
+	client1.AdvanceTo(uiStateShowContact)
+	if status := contact.serverStatus; !strings.HasPrefix(status, "reachable") {
+		t.Errorf("Bad server status after successful probe: %s", status)
+	}
+}
+
+func TestBulkImport(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	proceedToKeyExchange(t, client2, server, "client1")
+	proceedToKeyExchange(t, client3, server, "client1")
+	proceedToMainUI(t, client1, server)
+
+	handshake := func(client *TestClient) []byte {
+		block, _ := pem.Decode([]byte(client.gui.text["kxout"]))
+		if block == nil {
+			t.Fatalf("Failed to decode handshake of %s", client.name)
+		}
+		return block.Bytes
+	}
+
+	var bundle bytes.Buffer
+	pem.Encode(&bundle, &pem.Block{Type: keyExchangePEM, Headers: map[string]string{"Name": "client2"}, Bytes: handshake(client2)})
+	pem.Encode(&bundle, &pem.Block{Type: keyExchangePEM, Bytes: []byte("corrupt")})
+	pem.Encode(&bundle, &pem.Block{Type: keyExchangePEM, Headers: map[string]string{"Name": "client2"}, Bytes: handshake(client3)})
+
+	client1.gui.events <- Click{name: "newcontact"}
+	client1.AdvanceTo(uiStateNewContact)
+	client1.gui.events <- Click{name: "bulkimport"}
+	client1.AdvanceTo(uiStateBulkImport)
+	client1.gui.events <- Click{
+		name:      "import",
+		textViews: map[string]string{"bundle": bundle.String()},
+	}
+	client1.AdvanceTo(uiStateBulkImport)
+
+	if n := len(client1.contacts); n != 2 {
+		t.Fatalf("Expected two contacts after import, but found %d", n)
+	}
+	if _, contact := contactByName(client1, "client2"); contact == nil {
+		t.Error("First contact wasn't created")
+	}
+	if _, contact := contactByName(client1, "client2 (2)"); contact == nil {
+		t.Error("Duplicate name wasn't made unique")
+	}
+	results := strings.Split(client1.gui.text["importresults"], "\n")
+	if len(results) != 3 || !strings.Contains(results[1], "Failed") {
+		t.Errorf("Bad import results: %q", results)
+	}
+
+	// The output bundle should contain a handshake for each new contact,
+	// which they must be able to process.
+	forName := make(map[string]string)
+	for rest := []byte(client1.gui.text["bundleout"]); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		forName[block.Headers["For"]] = string(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes}))
+	}
+	for name, client := range map[string]*TestClient{"client2": client2, "client2 (2)": client3} {
+		kx, ok := forName[name]
+		if !ok {
+			t.Fatalf("No handshake for %s in output bundle", name)
+		}
+		client.gui.events <- Click{
+			name:      "process",
+			textViews: map[string]string{"kxin": kx},
+		}
+		client.AdvanceTo(uiStateShowContact)
+	}
+
+	sendMessage(client2, "client1", "hello from client2")
+	fetchMessage(client1)
+	if len(client1.inbox) != 1 {
+		t.Fatalf("Expected one message, but found %d", len(client1.inbox))
+	}
+}
+
+func TestAckOverdueIndicator(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	now := time.Now()
+	for i, test := range []struct {
+		msg  queuedMessage
+		want Indicator
+	}{
+		{queuedMessage{}, indicatorRed},
+		{queuedMessage{sent: now.Add(-time.Hour)}, indicatorYellow},
+		{queuedMessage{sent: now.Add(-13 * time.Hour)}, indicatorOrange},
+		{queuedMessage{sent: now.Add(-13 * time.Hour), acked: now}, indicatorGreen},
+		{queuedMessage{sent: now.Add(-13 * time.Hour), revocation: true}, indicatorGreen},
+	} {
+		if got := test.msg.indicator(nil, now, 12*time.Hour); got != test.want {
+			t.Errorf("#%d: got indicator %d, want %d", i, got, test.want)
+		}
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	if threshold := client.ackOverdueThreshold(); threshold != defaultAckOverdue {
+		t.Errorf("Bad default ack overdue threshold: %s", threshold)
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "ackoverdue",
+		combos: map[string]string{"ackoverdue": "After 2 days"},
+	}
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	if threshold := client.ackOverdueThreshold(); threshold != 48*time.Hour {
+		t.Fatalf("Ack overdue threshold wasn't set: %s", threshold)
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	if threshold := client.ackOverdueThreshold(); threshold != 48*time.Hour {
+		t.Errorf("Ack overdue threshold wasn't persisted: %s", threshold)
+	}
+}
+
+func TestRestoreSelection(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	id, _ := contactByName(client1, "client2")
+	clickOnContact(client1, "client2")
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- PanedMoved{name: "paned", position: 321}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	client1.AdvanceTo(uiStateShowContact)
+
+	if client1.contactsUI.selected != id {
+		t.Errorf("Contact wasn't selected after reload")
+	}
+	if client1.panedPosition != 321 {
+		t.Errorf("Divider position wasn't restored: %d", client1.panedPosition)
+	}
+
+	// Once the selected contact has been deleted, nothing should be
+	// selected after a reload.
+	client1.gui.events <- Click{name: "delete"}
+	client1.gui.WaitForSignal()
+	client1.gui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateRevocationComplete)
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	client1.gui.events <- Click{name: client1.clientUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	if client1.contactsUI.selected != 0 {
+		t.Errorf("Deleted contact was selected after reload")
+	}
+}
+
+func TestServerDefaults(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	const custom = "pondserver://ICYUHSAYGIXTKYKXSAHIBWEAQCTEF26WUWEPOVC764WYELCJMUPA@example.onion"
+	c := &client{
+		servers: serverDefaults{
+			defaultServer: custom,
+			knownServers:  []serverPreset{{"ex", "Example", custom}},
+		},
+	}
+	if server := c.defaultServer(); server != custom {
+		t.Errorf("Configured default server wasn't used: %s", server)
+	}
+	if presets := c.serverPresets(); len(presets) != 1 || presets[0].nickname != "ex" {
+		t.Errorf("Configured server presets weren't used: %v", presets)
+	}
+	c.dev = true
+	if server := c.defaultServer(); server != msgDefaultDevServer {
+		t.Errorf("Development server wasn't used: %s", server)
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.AdvanceTo(uiStateCreatePassphrase)
+	client.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": ""},
+	}
+	client.AdvanceTo(uiStateErasureStorage)
+	client.gui.events <- Click{
+		name: "continue",
+	}
+	client.AdvanceTo(uiStateCreateAccount)
+
+	client.gui.events <- Update{name: "server", text: "https://example.com"}
+	client.gui.WaitForSignal()
+	if errText := client.gui.text["servererror"]; !strings.Contains(errText, "scheme") {
+		t.Errorf("Unexpected error for bad server: %q", errText)
+	}
+
+	client.gui.events <- Update{name: "server", text: server.URL()}
+	client.gui.WaitForSignal()
+	if errText := client.gui.text["servererror"]; len(errText) != 0 {
+		t.Errorf("Unexpected error for good server: %q", errText)
+	}
+}
+
+// scriptTestClient runs a scriptClient and allows a test to exchange JSON
+// with it.
+type scriptTestClient struct {
+	t        *testing.T
+	stateDir string
+	in       *io.PipeWriter
+	out      *json.Decoder
+	done     chan struct{}
+}
+
+func newScriptTestClient(t *testing.T, name string) *scriptTestClient {
+	stateDir, err := ioutil.TempDir("", "pond-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+
+	sc := &scriptTestClient{
+		t:        t,
+		stateDir: stateDir,
+		in:       inWriter,
+		out:      json.NewDecoder(outReader),
+		done:     make(chan struct{}),
+	}
+	client := NewScriptClient(filepath.Join(stateDir, "state"), inReader, outWriter, rand.Reader, true /* testing */, false /* autoFetch */, nil /* default servers */)
+	client.log.name = name
+	client.log.toStderr = clientLogToStderr
+	go func() {
+		client.Start()
+		outWriter.Close()
+		close(sc.done)
+	}()
+	return sc
+}
+
+func (sc *scriptTestClient) Close() {
+	sc.in.Close()
+	// Drain any remaining output so that the client can exit.
+	for {
+		var out scriptOutput
+		if err := sc.out.Decode(&out); err != nil {
+			break
+		}
+	}
+	<-sc.done
+	os.RemoveAll(sc.stateDir)
+}
+
+// Do sends cmd and returns the outputs up to, and including, its reply.
+func (sc *scriptTestClient) Do(cmd scriptCommand) (reply scriptOutput, events []scriptOutput) {
+	if err := json.NewEncoder(sc.in).Encode(cmd); err != nil {
+		sc.t.Fatal(err)
+	}
+	for {
+		var out scriptOutput
+		if err := sc.out.Decode(&out); err != nil {
+			sc.t.Fatalf("Failed to read reply to %s: %s", cmd.Command, err)
+		}
+		if out.Command == cmd.Command {
+			return out, events
+		}
+		events = append(events, out)
+	}
+}
+
+// MustDo sends cmd and fails the test if it doesn't succeed.
+func (sc *scriptTestClient) MustDo(cmd scriptCommand) (reply scriptOutput, events []scriptOutput) {
+	reply, events = sc.Do(cmd)
+	if len(reply.Error) > 0 {
+		sc.t.Fatalf("%s failed: %s", cmd.Command, reply.Error)
+	}
+	return
+}
+
+func findEvent(events []scriptOutput, name string) (scriptOutput, bool) {
+	for _, event := range events {
+		if event.Event == name {
+			return event, true
+		}
+	}
+	return scriptOutput{}, false
+}
+
+func TestScriptClient(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1 := newScriptTestClient(t, "client1")
+	defer client1.Close()
+	client2 := newScriptTestClient(t, "client2")
+	defer client2.Close()
+
+	if reply, _ := client1.Do(scriptCommand{Command: "send", To: "client2"}); len(reply.Error) == 0 {
+		t.Error("Command succeeded before an account was created")
+	}
+
+	for _, client := range []*scriptTestClient{client1, client2} {
+		client.MustDo(scriptCommand{Command: "create-account", Server: server.URL()})
+	}
+
+	reply, _ := client1.MustDo(scriptCommand{Command: "new-contact", Name: "client2"})
+	handshake1 := reply.Handshake
+	reply, _ = client2.MustDo(scriptCommand{Command: "new-contact", Name: "client1", Handshake: handshake1})
+	handshake2 := reply.Handshake
+	client1.MustDo(scriptCommand{Command: "new-contact", Name: "client2", Handshake: handshake2})
+
+	if reply, _ := client1.Do(scriptCommand{Command: "send", To: "client3", Body: "hello"}); len(reply.Error) == 0 {
+		t.Error("Sending to an unknown contact succeeded")
+	}
+
+	const body = "hello from a script"
+	reply, _ = client1.MustDo(scriptCommand{Command: "send", To: "client2", Body: body})
+	id := reply.Id
+	_, events := client1.MustDo(scriptCommand{Command: "fetch"})
+	if event, ok := findEvent(events, "delivered"); !ok || event.Id != id {
+		t.Errorf("Delivery wasn't reported: %#v", events)
+	}
+
+	_, events = client2.MustDo(scriptCommand{Command: "fetch"})
+	event, ok := findEvent(events, "message")
+	if !ok {
+		t.Fatalf("Message wasn't received: %#v", events)
+	}
+	if event.Body != body || event.Contact != "client1" || event.Id != id {
+		t.Errorf("Bad message event: %#v", event)
+	}
+}
+
+func TestSendMessageErrors(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	c := &client{
+		contacts: map[uint64]*Contact{
+			1: {id: 1, name: "pending", isPending: true},
+			2: {id: 2, name: "revoked", revokedUs: true},
+		},
+	}
+	for _, id := range []uint64{1, 2, 3} {
+		if _, err := c.SendMessage(id, "hello", nil, nil, nil); err == nil {
+			t.Errorf("Sending to contact %d succeeded", id)
+		}
+	}
+	if len(c.outbox) != 0 {
+		t.Errorf("Failed sends were added to the outbox")
+	}
+}
+
+func TestConversation(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+	transmitMessage(client2, false)
+	fetchMessage(client1)
+	client1.gui.events <- Click{
+		name: client1.outboxUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateOutbox)
+
+	sendMessage(client2, "client1", "hello yourself")
+	fetchMessage(client1)
+
+	_, contact := contactByName(client1, "client2")
+	entries := client1.conversation(contact)
+	if len(entries) != 2 {
+		t.Fatalf("Got %d conversation entries, want 2", len(entries))
+	}
+	if !entries[0].sent || entries[0].body != "hello" || entries[0].acked.IsZero() {
+		t.Errorf("Bad first entry: %#v", entries[0])
+	}
+	if entries[1].sent || entries[1].body != "hello yourself" {
+		t.Errorf("Bad second entry: %#v", entries[1])
+	}
+
+	clickOnContact(client1, "client2")
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{name: "conversation"}
+	client1.AdvanceTo(uiStateConversation)
+
+	for _, entry := range entries {
+		name := fmt.Sprintf("conversation-%d", entry.id)
+		if text := client1.gui.text[name]; text != entry.body {
+			t.Errorf("Conversation shows %q for message %d, want %q", text, entry.id, entry.body)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "original")
+	fetchMessage(client2)
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "reply",
+	}
+	client2.AdvanceTo(uiStateCompose)
+	client2.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client1"},
+		textViews: map[string]string{"body": "reply"},
+	}
+	client2.AdvanceTo(uiStateOutbox)
+	transmitMessage(client2, false)
+
+	_, reply := fetchMessage(client1)
+	if reply == nil {
+		t.Fatal("client1 didn't receive the reply")
+	}
+	replyId := reply.message.GetId()
+	original := client1.outbox[0]
+
+	if client1.hasThread(original.message.GetId()) {
+		t.Error("Original message has a thread")
+	}
+	if !client1.hasThread(replyId) {
+		t.Fatal("Reply doesn't have a thread")
+	}
+	entries := client1.threadOf(replyId)
+	if len(entries) != 2 {
+		t.Fatalf("Got %d thread entries, want 2", len(entries))
+	}
+	if !entries[0].sent || entries[0].body != "original" {
+		t.Errorf("Bad first entry: %#v", entries[0])
+	}
+	if entries[1].sent || entries[1].body != "reply" {
+		t.Errorf("Bad second entry: %#v", entries[1])
+	}
+
+	client1.gui.events <- Click{
+		name: client1.inboxUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateInbox)
+	client1.gui.events <- Click{name: "thread"}
+	client1.AdvanceTo(uiStateThread)
+	for _, entry := range entries {
+		name := fmt.Sprintf("conversation-%d", entry.id)
+		if text := client1.gui.text[name]; text != entry.body {
+			t.Errorf("Thread shows %q for message %d, want %q", text, entry.id, entry.body)
+		}
+	}
+
+	// Erasing the original should leave a placeholder for it.
+	client1.gui.events <- Click{
+		name: client1.outboxUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateOutbox)
+	client1.gui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateMain)
+
+	checkPlaceholder := func() {
+		entries := client1.threadOf(replyId)
+		if len(entries) != 2 {
+			t.Fatalf("Got %d thread entries after erasure, want 2", len(entries))
+		}
+		if !entries[0].missing || entries[0].id != original.message.GetId() {
+			t.Errorf("Bad placeholder entry: %#v", entries[0])
+		}
+		if entries[1].body != "reply" {
+			t.Errorf("Bad second entry after erasure: %#v", entries[1])
+		}
+	}
+	checkPlaceholder()
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	checkPlaceholder()
+}
+
+func TestReplyErasureWarning(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "test message")
+	_, msg := fetchMessage(client2)
+
+	reply := func() {
+		client2.gui.events <- Click{
+			name: client2.inboxUI.entries[0].boxName,
+		}
+		client2.AdvanceTo(uiStateInbox)
+		client2.gui.events <- Click{name: "reply"}
+		client2.AdvanceTo(uiStateCompose)
+	}
+
+	reply()
+	if _, ok := client2.gui.text["erasurewarningtext"]; ok {
+		t.Fatal("Erasure warning shown for a new message")
+	}
+	client2.gui.events <- Click{name: "discard"}
+	client2.AdvanceTo(uiStateMain)
+
+	msg.receivedTime = client2.Now().Add(-messageLifetime + time.Hour)
+	reply()
+	if _, ok := client2.gui.text["erasurewarningtext"]; !ok {
+		t.Fatal("No erasure warning shown for a message that is about to be erased")
+	}
+
+	client2.gui.events <- Click{name: "retainoriginal"}
+	client2.AdvanceTo(uiStateCompose)
+	if !msg.retained {
+		t.Error("Original message wasn't retained")
+	}
+	if msg.erasesSoon(client2.Now()) {
+		t.Error("Retained message still erases soon")
+	}
+}
+
+func TestStateRecovery(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	const passphrase = "passphrase"
+	client.AdvanceTo(uiStateCreatePassphrase)
+	client.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": passphrase},
+	}
+	client.AdvanceTo(uiStateErasureStorage)
+	client.gui.events <- Click{
+		name: "continue",
+	}
+	client.AdvanceTo(uiStateCreateAccount)
+	client.gui.events <- Click{
+		name:    "create",
+		entries: map[string]string{"server": server.URL()},
+	}
+	client.AdvanceTo(uiStateMain)
+	identityPublic := client.identityPublic
+
+	enterPassphrase := func(pw string) {
+		client.gui.events <- Click{
+			name:    "next",
+			entries: map[string]string{"pw": pw},
+		}
+	}
+
+	// Reloading ensures that the state file has been written before it's
+	// backed up.
+	client.Reload()
+	client.AdvanceTo(uiStatePassphrase)
+	enterPassphrase(passphrase)
+	client.AdvanceTo(uiStateMain)
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	backupPath := filepath.Join(client.stateDir, "pond.backup")
+	client.gui.events <- Click{name: "exportbackup"}
+	fo := client.gui.WaitForFileOpen()
+	client.gui.events <- OpenResult{ok: true, path: backupPath, arg: fo.arg}
+	if err := client.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+
+	statePath := filepath.Join(client.stateDir, "state")
+	corruptAndRestart := func() {
+		client.Shutdown()
+
+		contents, err := ioutil.ReadFile(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[len(contents)-1] ^= 1
+		if err := ioutil.WriteFile(statePath, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		client.restart(nil)
+	}
+	corruptAndRestart()
+	client.AdvanceTo(uiStatePassphrase)
+
+	// An incorrect passphrase must still be reported as such, even though
+	// the state file is corrupt.
+	enterPassphrase("wrong")
+	for i := 0; i < 2; i++ {
+		if err := client.gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := client.gui.text["status"]; status != msgIncorrectPassword {
+		t.Fatalf("Unexpected status after incorrect passphrase: %q", status)
+	}
+
+	enterPassphrase(passphrase)
+	client.AdvanceTo(uiStateRecovery)
+
+	client.gui.events <- Click{name: "backupfile"}
+	fo = client.gui.WaitForFileOpen()
+	client.gui.events <- OpenResult{ok: true, path: backupPath, arg: fo.arg}
+	client.AdvanceTo(uiStatePassphrase)
+	enterPassphrase(passphrase)
+	client.AdvanceTo(uiStateMain)
+
+	if client.identityPublic != identityPublic {
+		t.Error("Restored identity doesn't match")
+	}
+	if _, err := os.Stat(statePath + ".corrupt"); err != nil {
+		t.Errorf("Corrupt state file wasn't kept: %s", err)
+	}
+
+	corruptAndRestart()
+	client.AdvanceTo(uiStatePassphrase)
+	enterPassphrase(passphrase)
+	client.AdvanceTo(uiStateRecovery)
+	client.gui.events <- Click{name: "fresh"}
+	client.AdvanceTo(uiStateCreatePassphrase)
+
+	if _, err := os.Stat(statePath + ".corrupt.2"); err != nil {
+		t.Errorf("Second corrupt state file wasn't kept: %s", err)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("State file still exists when starting afresh: %s", err)
+	}
+}
+
+func TestInstanceLock(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	proceedToMainUI(t, client, server)
+
+	// A second copy using the same state file must refuse to run.
+	second := &TestClient{
+		gui:  NewTestGUI(t),
+		name: "second",
+	}
+	second.guiClient = NewGUIClient(filepath.Join(client.stateDir, "state"), second.gui, rand.Reader, true /* testing */, false /* autoFetch */, nil /* default servers */, "" /* default name */)
+	second.guiClient.log.name = second.name
+	second.guiClient.log.toStderr = clientLogToStderr
+	second.guiClient.Start()
+	second.AdvanceTo(uiStateError)
+	if errorText := second.gui.text["errortext"]; !strings.Contains(errorText, "already running") {
+		t.Errorf("Unexpected error from second copy: %s", errorText)
+	}
+	second.Shutdown()
+
+	// A lock that wasn't released, because Pond crashed, results in a
+	// prompt.
+	client.Shutdown()
+	lockPath := filepath.Join(client.stateDir, "state"+instanceLockSuffix)
+	if contents, err := ioutil.ReadFile(lockPath); err != nil || len(contents) != 0 {
+		t.Fatalf("Instance lock not released on shutdown: %q %v", contents, err)
+	}
+	if err := ioutil.WriteFile(lockPath, []byte("12345\nelsewhere\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client.restart(nil)
+	client.AdvanceTo(uiStateStaleLock)
+	if owner := client.gui.text["lockowner"]; !strings.Contains(owner, "process 12345 on elsewhere") {
+		t.Errorf("Previous owner not shown: %s", owner)
+	}
+	client.gui.events <- Click{name: "takeover"}
+	client.AdvanceTo(uiStateMain)
+
+	contents, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("%d\n", os.Getpid()); !strings.HasPrefix(string(contents), expected) {
+		t.Errorf("Instance lock not taken over: %q", contents)
+	}
+}
+
+func TestSaveCoalescing(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	const burst = 20
+	savedBefore := atomic.LoadUint32(&client.statesSaved)
+	writtenBefore := atomic.LoadUint32(&client.statesWritten)
+	for i := 1; i <= burst; i++ {
+		client.panedPosition = i
+		client.save()
+	}
+
+	client.Shutdown()
+	saved := atomic.LoadUint32(&client.statesSaved) - savedBefore
+	written := atomic.LoadUint32(&client.statesWritten) - writtenBefore
+	t.Logf("%d saves resulted in %d writes", saved, written)
+
+	// Shutdown may save once more and the burst may have been split by
+	// a write that was already pending.
+	if saved < burst {
+		t.Errorf("Got %d saves, want at least %d", saved, burst)
+	}
+	if written > 3 {
+		t.Errorf("%d saves weren't coalesced: %d writes", saved, written)
+	}
+
+	client.restart(nil)
+	client.AdvanceTo(uiStateMain)
+	if client.panedPosition != burst {
+		t.Errorf("Latest state wasn't written: paned position is %d, want %d", client.panedPosition, burst)
+	}
+}
+
+func TestFlushState(t *testing.T) {
+	c := new(client)
+	in := make(chan disk.NewState)
+	flushes := make(chan flushRequest)
+	out := make(chan disk.NewState)
+	go c.coalesceStates(in, flushes, out)
+
+	// Saving doesn't wait for the disk, which isn't reading yet.
+	in <- disk.NewState{State: []byte("one")}
+	in <- disk.NewState{State: []byte("two")}
+
+	reply := make(chan chan struct{})
+	flushes <- reply
+	state := <-out
+	if string(state.State) != "two" {
+		t.Errorf("Flush wrote %q, want the latest state", state.State)
+	}
+	written := <-reply
+	select {
+	case <-written:
+		t.Fatalf("Flush completed before the state was written")
+	default:
+	}
+	close(state.Written)
+	<-written
+
+	// With nothing pending, a flush completes immediately.
+	reply = make(chan chan struct{})
+	flushes <- reply
+	<-<-reply
+
+	close(in)
+	if _, ok := <-out; ok {
+		t.Errorf("Unexpected state written after flush")
+	}
+}
+
+func TestFormatStepTime(t *testing.T) {
+	sent := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	acked := sent.Add(90*time.Minute + 5*time.Second + 300*time.Millisecond)
+
+	if s := formatStepTime(time.Time{}, sent); s != "(not yet)" {
+		t.Errorf("Step that hasn't happened is formatted as %q", s)
+	}
+	if s := formatStepTime(sent, time.Time{}); s != formatTime(sent) {
+		t.Errorf("Step without a previous step is formatted as %q", s)
+	}
+	if s, expected := formatStepTime(acked, sent), formatTime(acked)+" (1h30m5s later)"; s != expected {
+		t.Errorf("Got %q, want %q", s, expected)
+	}
+	// Clocks can be changed, but steps never happen before earlier ones.
+	if s, expected := formatStepTime(sent, acked), formatTime(sent)+" (0s later)"; s != expected {
+		t.Errorf("Got %q, want %q", s, expected)
+	}
+}
+
+func TestSortedContacts(t *testing.T) {
+	c := &client{
+		contacts: map[uint64]*Contact{
+			1: {id: 1, name: "carol"},
+			2: {id: 2, name: "Bob"},
+			3: {id: 3, name: "alice"},
+			4: {id: 4, name: "bob"},
+			5: {id: 5, name: "Alice"},
+		},
+	}
+
+	expected := []uint64{3, 5, 2, 4, 1}
+	for i := 0; i < 10; i++ {
+		contacts := c.sortedContacts()
+		for j, contact := range contacts {
+			if contact.id != expected[j] {
+				t.Fatalf("Contact #%d is %q (%d), want id %d", j, contact.name, contact.id, expected[j])
+			}
+		}
+	}
+}
+
+func TestMessageStats(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	now := time.Now()
+	c := &client{
+		inbox: []*InboxMessage{{}, {}},
+		outbox: []*queuedMessage{
+			{created: now},
+			{created: now.Add(-time.Hour), sent: now.Add(-59 * time.Minute)},
+			{created: now.Add(-time.Hour), sent: now.Add(-57 * time.Minute), acked: now.Add(-50 * time.Minute)},
+			{created: now.Add(-time.Hour), sent: now.Add(-55 * time.Minute), acked: now.Add(-30 * time.Minute)},
+		},
+	}
+
+	stats := c.messageStats()
+	if stats.inbox != 2 || stats.outbox != 4 || stats.pending != 1 {
+		t.Errorf("bad counts: inbox %d, outbox %d, pending %d", stats.inbox, stats.outbox, stats.pending)
+	}
+	if stats.sendSamples != 3 || stats.medianSend != 3*time.Minute {
+		t.Errorf("bad time to send: %s from %d messages", stats.medianSend, stats.sendSamples)
+	}
+	if stats.ackSamples != 2 || stats.medianAck != 16*time.Minute {
+		t.Errorf("bad time to ack: %s from %d messages", stats.medianAck, stats.ackSamples)
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	if text := client.gui.text["statsoutbox"]; text != "0" {
+		t.Errorf("outbox count is %q", text)
+	}
+	if text := client.gui.text["statssend"]; text != "No data" {
+		t.Errorf("time to send with no messages is %q", text)
+	}
+}
+
+func TestLastActivity(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	for i, test := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{30 * time.Second, "just now"},
+		{time.Minute, "1 minute ago"},
+		{90 * time.Minute, "1 hour ago"},
+		{49 * time.Hour, "2 days ago"},
+	} {
+		if got := formatAgo(test.d); got != test.want {
+			t.Errorf("#%d: got %q, want %q", i, got, test.want)
+		}
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	if _, contact := contactByName(client2, "client1"); !contact.lastActivity.IsZero() {
+		t.Fatalf("Contact has activity before any message was received")
+	}
+
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+
+	id, contact := contactByName(client2, "client1")
+	if contact.lastActivity.IsZero() {
+		t.Fatalf("Receiving a message didn't record activity")
+	}
+	if subline := contact.subline(contact.lastActivity.Add(2 * time.Hour)); subline != "heard from 2 hours ago" {
+		t.Errorf("Bad contact subline: %q", subline)
+	}
+	for _, entry := range client2.contactsUI.entries {
+		if entry.id == id && !entry.hasSubline {
+			t.Errorf("Contacts list doesn't show when the contact was last heard from")
+		}
+	}
+	lastActivity := contact.lastActivity
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+
+	if _, contact := contactByName(client2, "client1"); contact.lastActivity.Unix() != lastActivity.Unix() {
+		t.Errorf("Activity time wasn't saved: got %s, want %s", contact.lastActivity, lastActivity)
+	}
+}
+
+func TestFontPreferences(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	if font := client.messageFont(); font != fontMainBody {
+		t.Errorf("Default message font is %q, want %q", font, fontMainBody)
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "bodyfont",
+		combos: map[string]string{"bodyfont": "DejaVu Serif"},
+	}
+	client.gui.events <- Click{
+		name:   "fontscale",
+		combos: map[string]string{"fontscale": "150%"},
+	}
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	if font := client.messageFont(); font != "DejaVu Serif 18" {
+		t.Errorf("Message font is %q after reload", font)
+	}
+	if font := client.messageMonoFont(); font != "Liberation Mono 15" {
+		t.Errorf("Fixed-width font is %q after reload", font)
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{name: "resetfonts"}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	if font := client.messageFont(); font != fontMainBody {
+		t.Errorf("Message font is %q after reset", font)
+	}
+	if font := client.messageMonoFont(); font != fontMainMono {
+		t.Errorf("Fixed-width font is %q after reset", font)
+	}
+}
+
+func TestTheme(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	if client.contactsUI.theme != lightTheme {
+		t.Fatalf("The default theme isn't the light theme")
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	if labels := client.gui.combos["theme"]; len(labels) != len(themes) {
+		t.Errorf("Theme choices are %v", labels)
+	}
+	client.gui.events <- Click{
+		name:   "theme",
+		combos: map[string]string{"theme": darkTheme.name},
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	if client.themeName != darkTheme.name {
+		t.Errorf("Theme wasn't changed: %q", client.themeName)
+	}
+	if client.contactsUI.theme != darkTheme || client.inboxUI.theme != darkTheme {
+		t.Errorf("The main UI wasn't rebuilt with the new theme")
+	}
+	if client.clientUI.selected != clientUIIdentity {
+		t.Errorf("The identity view isn't selected after changing the theme")
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	if client.contactsUI.theme != darkTheme {
+		t.Fatalf("The theme wasn't restored")
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "theme",
+		combos: map[string]string{"theme": lightTheme.name},
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	if len(client.themeName) != 0 || client.contactsUI.theme != lightTheme {
+		t.Errorf("Theme wasn't reset to the default: %q", client.themeName)
+	}
+}
+
+func TestShapedIndicators(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	// Each shape must be distinct, and drawn in the indicator's color.
+	seen := make(map[string]Indicator)
+	for i, shape := range indicatorShapes {
+		img, err := png.Decode(bytes.NewReader(i.shapedPNGBytes()))
+		if err != nil {
+			t.Fatalf("Failed to decode shaped indicator %d: %s", i, err)
+		}
+		standard, err := png.Decode(bytes.NewReader(i.pngBytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, g, b, _ := img.At(4, 4).RGBA()
+		sr, sg, sb, _ := standard.At(4, 4).RGBA()
+		if r>>8 != sr>>8 || g>>8 != sg>>8 || b>>8 != sb>>8 {
+			t.Errorf("Shaped indicator %d has a different color from the standard one", i)
+		}
+		mask := strings.Join(shape.rows[:], "")
+		if other, ok := seen[mask]; ok {
+			t.Errorf("Indicators %d and %d have the same shape", i, other)
+		}
+		seen[mask] = i
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	if client.inboxUI.shapedIndicators {
+		t.Fatalf("Indicators are shaped by default")
+	}
+
+	client.gui.events <- Click{name: client.clientUI.entries[0].boxName}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "shapedindicators",
+		checks: map[string]bool{"shapedindicators": true},
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	if !client.inboxUI.shapedIndicators || !client.contactsUI.shapedIndicators {
+		t.Errorf("The main UI wasn't rebuilt with shaped indicators")
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	if !client.outboxUI.shapedIndicators {
+		t.Errorf("Shaped indicators weren't restored")
+	}
+}
+
+func TestSpellCheckPreference(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	if client.spellCheck {
+		t.Fatalf("Spell checking is enabled by default")
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "spellcheck",
+		checks: map[string]bool{"spellcheck": true},
+	}
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	if !client.spellCheck {
+		t.Errorf("Spell checking preference wasn't saved")
+	}
+}
+
+func TestMessageExport(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.gui.events <- Click{name: "export"}
+	if err := client2.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client2.gui.text["exportstatus"]) == 0 {
+		t.Errorf("No error was shown when exporting without a passphrase")
+	}
+
+	exportPath := filepath.Join(client2.stateDir, "exported")
+	client2.gui.events <- Click{
+		name:    "export",
+		entries: map[string]string{"exportpassphrase": "secret"},
+	}
+	fo := client2.gui.WaitForFileOpen()
+	client2.gui.events <- OpenResult{ok: true, path: exportPath, arg: fo.arg}
+	if err := client2.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := importMessage(exportPath, "secret")
+	if err != nil {
+		t.Fatalf("Failed to import exported message: %s", err)
+	}
+	if body, _ := decodeBody(msg); body != "hello" {
+		t.Errorf("Imported message has body %q", body)
+	}
+	if msg.MyNextDh != nil || msg.SupportedVersion != nil {
+		t.Errorf("Exported message includes protocol values: %s", msg)
+	}
+
+	if _, err := importMessage(exportPath, "wrong"); err != disk.BadPasswordError {
+		t.Errorf("Importing with the wrong passphrase gave %v", err)
+	}
+
+	archive, err := ioutil.ReadFile(exportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive[8]++
+	if err := ioutil.WriteFile(exportPath, archive, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importMessage(exportPath, "secret"); err != disk.UnsupportedArchiveError {
+		t.Errorf("Importing an archive from a newer version gave %v", err)
+	}
+
+	attached := &pond.Message{
+		Id:       proto.Uint64(1),
+		Time:     proto.Int64(2),
+		Body:     []byte("with attachment"),
+		MyNextDh: []byte{1, 2, 3},
+		AlsoAck:  []uint64{3},
+		Files: []*pond.Message_Attachment{
+			{Filename: proto.String("a.txt"), Contents: []byte("contents")},
+		},
+	}
+	if err := client2.exportMessage(exportPath, "secret", attached); err != nil {
+		t.Fatal(err)
+	}
+	if attached.MyNextDh == nil {
+		t.Errorf("Exporting modified the original message")
+	}
+	msg, err = importMessage(exportPath, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Files) != 1 || string(msg.Files[0].Contents) != "contents" || msg.AlsoAck != nil {
+		t.Errorf("Bad round trip of message with an attachment: %s", msg)
+	}
+}
+
+func TestMessageImport(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	msg := &pond.Message{
+		Id:   proto.Uint64(42),
+		Time: proto.Int64(1000),
+		Body: []byte("from an archive"),
+	}
+	exportPath := filepath.Join(client2.stateDir, "exported")
+	if err := client2.exportMessage(exportPath, "secret", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	client2.gui.events <- Click{name: client2.clientUI.entries[3].boxName}
+	client2.AdvanceTo(uiStateImportMessage)
+
+	client2.gui.events <- Click{name: "importfile"}
+	fo := client2.gui.WaitForFileOpen()
+	client2.gui.events <- OpenResult{ok: true, path: exportPath, arg: fo.arg}
+	if err := client2.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+
+	client2.gui.events <- Click{
+		name:    "import",
+		entries: map[string]string{"importpassphrase": "wrong"},
+	}
+	if err := client2.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+	if text := client2.gui.text["importerror"]; text != importErrorText(disk.BadPasswordError) {
+		t.Errorf("Wrong passphrase resulted in error text %q", text)
+	}
+
+	client2.gui.events <- Click{
+		name:    "import",
+		entries: map[string]string{"importpassphrase": "secret"},
+	}
+	client2.AdvanceTo(uiStateImportedMessage)
+	if text := client2.gui.text["body"]; text != "from an archive" {
+		t.Errorf("Imported message shown with body %q", text)
+	}
+	if len(client2.inbox) != 0 {
+		t.Fatalf("Imported message was added to the inbox without being asked")
+	}
+
+	client2.gui.events <- Click{
+		name:   "addtoinbox",
+		combos: map[string]string{"importfrom": "client1"},
+	}
+	client2.AdvanceTo(uiStateInbox)
+	if len(client2.inbox) != 1 {
+		t.Fatalf("Imported message wasn't added to the inbox")
+	}
+	id, contact := contactByName(client2, "client1")
+	if inboxMsg := client2.inbox[0]; !inboxMsg.retained || inboxMsg.from != id {
+		t.Errorf("Imported message added to the inbox incorrectly: %#v", inboxMsg)
+	}
+	if _, err := client2.addImportedMessage(msg, contact); err == nil {
+		t.Errorf("The same message was imported twice")
+	}
+}
+
+func TestAppName(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", &TestClientOptions{appName: "Example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	if client1.gui.title != "Example" {
+		t.Errorf("Window title is %q rather than the configured name", client1.gui.title)
+	}
+
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+	client1.gui.events <- Click{name: client1.clientUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowIdentity)
+	if client1.gui.title != "Example (1)" {
+		t.Errorf("Window title is %q after receiving a message", client1.gui.title)
+	}
+	if client2.gui.title != "Pond" {
+		t.Errorf("Default window title is %q", client2.gui.title)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	if !client.gui.hidden["clockskewbanner"] {
+		t.Fatalf("Clock skew warning is shown before the clock was checked")
+	}
+
+	// The skew is processed by the main goroutine some time after the
+	// fetch so the identity UI is shown repeatedly until the warning
+	// changes.
+	waitForBanner := func(visible bool) {
+		for i := 0; i < 20; i++ {
+			client.gui.events <- Click{name: client.clientUI.entries[0].boxName}
+			client.AdvanceTo(uiStateShowIdentity)
+			if client.gui.hidden["clockskewbanner"] != visible {
+				return
+			}
+		}
+		t.Fatalf("Clock skew warning didn't become visible=%t", visible)
+	}
+
+	client.nowFunc = func() time.Time {
+		return time.Now().Add(2 * time.Hour)
+	}
+	fetchMessage(client)
+	waitForBanner(true)
+	if !client.clockSkewed() || client.clockSkew < 2*time.Hour-maxClockSkew {
+		t.Errorf("Bad clock skew measured: %s", client.clockSkew)
+	}
+	if text := client.gui.text["clockskew"]; !strings.Contains(text, "2h0m0s ahead of") {
+		t.Errorf("Clock skew warning doesn't describe the skew: %q", text)
+	}
+
+	client.nowFunc = nil
+	fetchMessage(client)
+	waitForBanner(false)
+}
+
+func TestContactColor(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+
+	id, contact := contactByName(client2, "client1")
+	derived := contactAvatarColor(contact)
+	renamed := *contact
+	renamed.name = "someone else"
+	if contactAvatarColor(&renamed) != derived {
+		t.Errorf("Default color of a contact depends on their name")
+	}
+	if initial := contactInitial(contact); initial != "C" {
+		t.Errorf("Bad initial for contact: %q", initial)
+	}
+	for _, entry := range client2.contactsUI.entries {
+		if entry.id == id && !entry.hasAvatar {
+			t.Errorf("Contacts list entry doesn't have an avatar")
+		}
+	}
+	if !client2.inboxUI.entries[0].hasAvatar {
+		t.Errorf("Inbox entry doesn't have an avatar")
+	}
+
+	var chosen string
+	for _, ac := range avatarColors {
+		if ac != derived {
+			chosen = ac.name
+			break
+		}
+	}
+
+	client2.gui.events <- Click{name: client2.contactsUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{
+		name:   "color",
+		combos: map[string]string{"color": chosen},
+	}
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+
+	if got := contactAvatarColor(contact).name; got != chosen {
+		t.Errorf("Contact has color %s after choosing %s", got, chosen)
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if _, contact := contactByName(client2, "client1"); contact.color != chosen {
+		t.Errorf("Chosen color wasn't persisted: %q", contact.color)
+	}
+}
+
+func TestFilterMessages(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
+
+	sendMessage(client2, "client1", "from client2")
+	fetchMessage(client1)
+	sendMessage(client3, "client1", "from client3")
+	fetchMessage(client1)
+	sendMessage(client1, "client3", "to client3")
+
+	visible := func(list *listUI) (ids []uint64) {
+		for _, entry := range list.entries {
+			if !entry.hidden {
+				ids = append(ids, entry.id)
+			}
+		}
+		return
+	}
+
+	id2, _ := contactByName(client1, "client2")
+
+	contactEvent, _ := client1.contactsUI.SelectEvent(id2)
+	client1.gui.events <- contactEvent
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{name: "filter"}
+	client1.AdvanceTo(uiStateShowContact)
+
+	if ids := visible(client1.inboxUI); len(ids) != 1 || client1.inbox[0].from != id2 || ids[0] != client1.inbox[0].id {
+		t.Errorf("Inbox shows %d messages after filtering, rather than only the one from client2", len(ids))
+	}
+	if ids := visible(client1.outboxUI); len(ids) != 0 {
+		t.Errorf("Outbox shows %d messages after filtering, but none were sent to client2", len(ids))
+	}
+	if entry := client1.inboxUI.entries[1]; !client1.gui.hidden[entry.boxName] || !client1.gui.hidden[entry.sepName] {
+		t.Errorf("Entry and separator of a filtered message are visible")
+	}
+
+	// A message that arrives while the filter is active is filtered too.
+	sendMessage(client3, "client1", "another from client3")
+	fetchMessage(client1)
+	if ids := visible(client1.inboxUI); len(ids) != 1 {
+		t.Errorf("Inbox shows %d messages after a new message arrived, rather than one", len(ids))
+	}
+
+	client1.gui.events <- Click{name: "filter"}
+	client1.AdvanceTo(uiStateShowContact)
+
+	if ids := visible(client1.inboxUI); len(ids) != 3 {
+		t.Errorf("Inbox shows %d messages after clearing the filter, rather than three", len(ids))
+	}
+	if ids := visible(client1.outboxUI); len(ids) != 1 {
+		t.Errorf("Outbox shows %d messages after clearing the filter, rather than one", len(ids))
+	}
+}
+
+func TestMarkAllRead(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "one")
+	fetchMessage(client2)
+	sendMessage(client1, "client2", "two")
+	fetchMessage(client2)
+
+	// A message that can't yet be decrypted shouldn't be marked as read.
+	_, contact := contactByName(client2, "client1")
+	pending := &InboxMessage{
+		id:     client2.randId(),
+		from:   contact.id,
+		sealed: []byte{1},
+	}
+	client2.inbox = append(client2.inbox, pending)
+
+	var unread int
+	for _, msg := range client2.inbox {
+		if msg.message != nil && !msg.read {
+			unread++
+		}
+	}
+	if unread != 2 {
+		t.Fatalf("Expected two unread messages, but found %d", unread)
+	}
+
+	client2.gui.events <- Click{name: "markallread"}
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+
+	for _, msg := range client2.inbox {
+		if msg == pending {
+			if msg.read {
+				t.Errorf("Pending message was marked as read")
+			}
+			continue
+		}
+		if !msg.read {
+			t.Errorf("Message %d wasn't marked as read", msg.id)
+		}
+	}
+	if marked := client2.markAllRead(); len(marked) != 0 {
+		t.Errorf("Marking all messages read a second time changed %d messages", len(marked))
+	}
+}
+
+func TestUnsentMessageSurvivesRestart(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	composeMessage(client1, "client2", "survivor")
+	if len(client1.queue) != 1 {
+		t.Fatalf("Expected one queued message, but found %d", len(client1.queue))
+	}
+	// Even a message that's older than the usual lifetime must be kept
+	// until it has been sent.
+	client1.outbox[0].created = time.Now().Add(-2 * messageLifetime)
+	client1.save()
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+
+	if len(client1.queue) != 1 {
+		t.Fatalf("Expected one queued message after restart, but found %d", len(client1.queue))
+	}
+	if client1.queue[0].message == nil || string(client1.queue[0].message.Body) != "survivor" {
+		t.Fatalf("Wrong message queued after restart")
+	}
+
+	transmitMessage(client1, false)
+	if len(client1.queue) != 0 {
+		t.Fatalf("Message wasn't sent after restart")
+	}
+
+	from, msg := fetchMessage(client2)
+	if from != "client1" || msg == nil || string(msg.message.Body) != "survivor" {
+		t.Errorf("Message wasn't received after restart")
+	}
+}
+
+func TestOverdueAckWarning(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "hello")
+
+	countWarnings := func() (n int) {
+		client1.log.Lock()
+		defer client1.log.Unlock()
+		for _, entry := range client1.log.entries {
+			if entry.isError && strings.Contains(entry.s, "hasn't been acknowledged") {
+				n++
+			}
+		}
+		return
+	}
+
+	baseTime := time.Now()
+	client1.testTimerChan <- baseTime
+	client1.AdvanceTo(uiStateTimerComplete)
+	if n := countWarnings(); n != 0 {
+		t.Fatalf("%d warnings logged before the message was overdue", n)
+	}
+
+	client1.nowFunc = func() time.Time {
+		return baseTime.Add(defaultAckOverdue + time.Minute)
+	}
+	for i := 0; i < 2; i++ {
+		client1.testTimerChan <- baseTime
+		client1.AdvanceTo(uiStateTimerComplete)
+	}
+	if n := countWarnings(); n != 1 {
+		t.Errorf("Expected one warning for an overdue message, but found %d", n)
+	}
+	for _, msg := range client1.outbox {
+		if len(msg.message.Body) > 0 && client1.outboxIndicator(msg) != indicatorOrange {
+			t.Errorf("Overdue message has indicator %v", client1.outboxIndicator(msg))
+		}
+	}
+}
+
+func TestOutboxViewUpdatesOnlyOnChange(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// composeMessage leaves the new message displayed in the outbox.
+	composeMessage(client1, "client2", "hello")
+	transmitMessage(client1, true)
+
+	// The result of the transmission may still be being processed. An
+	// export without a passphrase is used to wait for that to complete
+	// since it's always answered with an error.
+	client1.gui.events <- Click{name: "export"}
+	for len(client1.gui.text["exportstatus"]) == 0 {
+		if err := client1.gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the message has been sent, events that don't change it
+	// shouldn't cause the view to be updated. Previously every event
+	// resulted in the sent time being set again.
+	client1.gui.text["sent"] = ""
+	for i := 0; i < 8; i++ {
+		client1.gui.events <- Click{name: "nothing"}
+	}
+	client1.gui.events <- Click{name: client1.clientUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	if text := client1.gui.text["sent"]; len(text) != 0 {
+		t.Errorf("Outbox view was updated without a change to the message")
+	}
+}
+
+func TestBlockContact(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	client2.gui.events <- Click{name: client2.contactsUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{name: "block"}
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+
+	_, contact := contactByName(client2, "client1")
+	if !contact.blocked {
+		t.Fatalf("Contact wasn't blocked")
+	}
+	if contact.indicator() != indicatorRed || contact.subline(client2.Now()) != "blocked" {
+		t.Errorf("Blocked contact isn't distinguished in the contacts list")
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if _, contact = contactByName(client2, "client1"); !contact.blocked {
+		t.Fatalf("Blocked status wasn't persisted")
+	}
+
+	sendMessage(client1, "client2", "blocked")
+	fetchMessage(client2)
+	if n := len(client2.inbox); n != 0 {
+		t.Fatalf("Message from blocked contact was added to the inbox (%d messages)", n)
+	}
+
+	client2.gui.events <- Click{name: client2.contactsUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{name: "block"}
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	if contact.blocked {
+		t.Fatalf("Contact wasn't unblocked")
+	}
+
+	sendMessage(client1, "client2", "unblocked")
+	if from, msg := fetchMessage(client2); from != "client1" || msg == nil || string(msg.message.Body) != "unblocked" {
+		t.Errorf("Message wasn't received after unblocking")
+	}
+}
+
+func TestCopyBody(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// composeMessage leaves the sent message displayed.
+	composeMessage(client1, "client2", "copy me")
+	client1.gui.events <- Click{name: "copybody"}
+	if err := client1.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+	if client1.gui.clipboard != "copy me" {
+		t.Errorf("Copying a sent message put %q on the clipboard", client1.gui.clipboard)
+	}
+	transmitMessage(client1, false)
+
+	fetchMessage(client2)
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{name: "copybody"}
+	if err := client2.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+	if client2.gui.clipboard != "copy me" {
+		t.Errorf("Copying a received message put %q on the clipboard", client2.gui.clipboard)
+	}
+}
+
+func TestEmptyInboxGuidance(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToMainUI(t, client1, server)
+	if guidance := client1.gui.text["emptyguidance"]; !strings.Contains(guidance, "don't have any contacts") {
+		t.Errorf("Without contacts, the guidance was %q", guidance)
+	}
+	client1.gui.events <- Click{name: "emptynewcontact"}
+	client1.AdvanceTo(uiStateNewContact)
+
+	proceedToPaired(t, client1, client2, server)
+	delete(client1.gui.text, "emptyguidance")
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if guidance := client1.gui.text["emptyguidance"]; !strings.Contains(guidance, "inbox is empty") {
+		t.Errorf("With an empty inbox, the guidance was %q", guidance)
+	}
+
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+	delete(client1.gui.text, "emptyguidance")
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if guidance, ok := client1.gui.text["emptyguidance"]; ok {
+		t.Errorf("Guidance %q was shown with a message in the inbox", guidance)
+	}
+}
+
+func TestMessageIds(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// composeMessage leaves the sent message displayed.
+	composeMessage(client1, "client2", "details")
+	if !client1.gui.hidden["messageids"] {
+		t.Error("Message details weren't initially hidden")
+	}
+	client1.gui.events <- Click{name: "details"}
+	for client1.gui.hidden["messageids"] {
+		if err := client1.gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := client1.outbox[0]
+	if id := fmt.Sprintf("%016x", sent.message.GetId()); client1.gui.text["messageid"] != id {
+		t.Errorf("Sent message showed id %q, wanted %q", client1.gui.text["messageid"], id)
+	}
+	if id := fmt.Sprintf("%016x", sent.to); client1.gui.text["contactid"] != id {
+		t.Errorf("Sent message showed contact %q, wanted %q", client1.gui.text["contactid"], id)
+	}
+	if client1.gui.text["inreplytoid"] != "(none)" {
+		t.Errorf("Sent message showed in-reply-to %q", client1.gui.text["inreplytoid"])
+	}
+	client1.gui.events <- Click{name: "details"}
+	for !client1.gui.hidden["messageids"] {
+		if err := client1.gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transmitMessage(client1, false)
+
+	fetchMessage(client2)
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+	received := client2.inbox[0]
+	if id := fmt.Sprintf("%016x", sent.message.GetId()); client2.gui.text["messageid"] != id {
+		t.Errorf("Received message showed id %q, wanted %q", client2.gui.text["messageid"], id)
+	}
+	if id := fmt.Sprintf("%016x", received.id); client2.gui.text["localid"] != id {
+		t.Errorf("Received message showed local id %q, wanted %q", client2.gui.text["localid"], id)
+	}
+	if id := fmt.Sprintf("%016x", received.from); client2.gui.text["contactid"] != id {
+		t.Errorf("Received message showed contact %q, wanted %q", client2.gui.text["contactid"], id)
+	}
+}
+
+// countingGUI is a GUI that counts signals and drains the actions queue on
+// each one.
+type countingGUI struct {
+	actions chan interface{}
+	signals int
+}
+
+func (ui *countingGUI) Actions() chan<- interface{} { return ui.actions }
+func (ui *countingGUI) Events() <-chan interface{}  { return nil }
+func (ui *countingGUI) Run()                        {}
+
+func (ui *countingGUI) Signal() {
+	ui.signals++
+	for len(ui.actions) > 0 {
+		<-ui.actions
+	}
+}
+
+func TestBatchSignals(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	counting := &countingGUI{actions: make(chan interface{}, 16)}
+	gui := &batchGUI{GUI: counting}
+
+	gui.Signal()
+	if counting.signals != 1 {
+		t.Fatalf("Signal outside of a batch resulted in %d signals", counting.signals)
+	}
+
+	// Adding 100 entries to a list, one action and signal each, must not
+	// block even though the queue is shorter than that.
+	gui.Batch(func() {
+		for i := 0; i < 100; i++ {
+			gui.Actions() <- SetText{name: "line", text: strconv.Itoa(i)}
+			gui.Signal()
+			gui.Batch(func() {
+				gui.Signal()
+			})
+		}
+	})
+	if n := counting.signals - 1; n > 20 {
+		t.Errorf("100 signals in a batch resulted in %d signals", n)
+	}
+	if len(counting.actions) != 0 {
+		t.Errorf("%d actions were left unsignaled after the batch", len(counting.actions))
+	}
+	t.Logf("Batching reduced 200 signals to %d", counting.signals-1)
+
+	before := counting.signals
+	gui.Batch(func() {})
+	if counting.signals != before {
+		t.Error("An empty batch signaled the GUI")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	// confirm is driven directly, without the rest of the client, so the
+	// lists only need to exist for nextEvent.
+	gui := NewTestGUI(t)
+	c := NewGUIClient("", gui, rand.Reader, true /* testing */, false /* autoFetch */, nil /* default servers */, "" /* default name */)
+	for _, ui := range []**listUI{&c.inboxUI, &c.outboxUI, &c.contactsUI, &c.clientUI, &c.draftsUI} {
+		*ui = &listUI{gui: gui}
+	}
+
+	for _, answer := range []string{"confirmyes", "confirmno"} {
+		result := make(chan bool, 1)
+		go func() {
+			result <- c.confirm("DELETE", "Are you sure?")
+		}()
+		if err := gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+		if gui.currentStateID != uiStateConfirm {
+			t.Fatalf("Confirmation not shown")
+		}
+		if text := gui.text["confirmbody"]; text != "Are you sure?" {
+			t.Errorf("Confirmation shows %q", text)
+		}
+
+		// Other parts of the window are ignored until there's an
+		// answer.
+		gui.events <- Click{name: "compose"}
+		gui.events <- Click{name: answer}
+		if got, want := <-result, answer == "confirmyes"; got != want {
+			t.Errorf("Clicking %s resulted in %t", answer, got)
+		}
+	}
+}
+
+func TestQuitPrompt(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// With nothing waiting to be sent, the window closes immediately.
+	client1.gui.events <- CloseRequested{}
+	client1.testTimerChan <- time.Now()
+	client1.AdvanceTo(uiStateTimerComplete)
+	if !client1.gui.windowClosed {
+		t.Fatalf("Window wasn't closed with an empty queue")
+	}
+	client1.gui.windowClosed = false
+
+	composeMessage(client1, "client2", "not yet sent")
+	client1.gui.events <- CloseRequested{}
+	client1.AdvanceTo(uiStateQuit)
+	if client1.gui.windowClosed {
+		t.Fatalf("Window was closed with a message waiting to be sent")
+	}
+	if msg := client1.gui.text["quitmessage"]; !strings.Contains(msg, "1 message hasn't") {
+		t.Errorf("Unexpected quit message: %q", msg)
+	}
+
+	client1.gui.events <- Click{
+		name:   "quitwait",
+		checks: map[string]bool{"quitdontask": true},
+	}
+	transmitMessage(client1, false)
+	client1.testTimerChan <- time.Now()
+	client1.AdvanceTo(uiStateTimerComplete)
+	if !client1.gui.windowClosed {
+		t.Errorf("Window wasn't closed after the message was sent")
+	}
+	if !client1.noQuitPrompt {
+		t.Errorf("Quit prompt wasn't disabled")
+	}
+}
+
+func TestTransactionSchedule(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	if mean, cover := client.transactionSchedule(); mean != transactionRateSeconds*time.Second || cover {
+		t.Fatalf("Bad default schedule: %s %t", mean, cover)
+	}
+
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	client.gui.events <- Click{
+		name:   "transactioninterval",
+		combos: map[string]string{"transactioninterval": "10 minutes"},
+		checks: map[string]bool{"covertraffic": true},
+	}
+	client.gui.events <- Click{
+		name: client.clientUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	if mean, cover := client.transactionSchedule(); mean != 10*time.Minute || !cover {
+		t.Errorf("Schedule wasn't saved: %s %t", mean, cover)
+	}
+
+	// Values outside of the permitted range, for example from an edited
+	// state file, are clamped.
+	client.setTransactionSchedule(time.Second, false)
+	if mean, _ := client.transactionSchedule(); mean != minTransactionInterval {
+		t.Errorf("Short interval was not clamped: %s", mean)
+	}
+	client.setTransactionSchedule(24*time.Hour, false)
+	if mean, _ := client.transactionSchedule(); mean != maxTransactionInterval {
+		t.Errorf("Long interval was not clamped: %s", mean)
+	}
+}
+
+func TestOperatingModes(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	setMode := func(mode operatingMode) {
+		client1.gui.events <- Click{
+			name: client1.clientUI.entries[0].boxName,
+		}
+		client1.AdvanceTo(uiStateShowIdentity)
+		client1.gui.events <- Click{
+			name:   "operatingmode",
+			combos: map[string]string{"operatingmode": operatingModeLabels[mode]},
+		}
+		client1.AdvanceTo(uiStateShowIdentity)
+		if client1.operatingMode() != mode {
+			t.Fatalf("Mode is %d after selecting %d", client1.operatingMode(), mode)
+		}
+	}
+
+	sendMessage(client2, "client1", "hello")
+	composeMessage(client1, "client2", "first")
+
+	// In send-only mode, queued messages are sent but nothing is
+	// fetched.
+	setMode(modeSendOnly)
+	if from, _ := fetchMessage(client1); len(from) != 0 {
+		t.Fatalf("Message fetched in send-only mode")
+	}
+	if len(client1.queue) != 0 {
+		t.Fatalf("Message not sent in send-only mode")
+	}
+	if from, _ := fetchMessage(client1); len(from) != 0 || len(client1.inbox) != 0 {
+		t.Fatalf("Message fetched in send-only mode")
+	}
+	// With nothing to send, a cover transaction is made instead.
+	client1.log.Lock()
+	sentCover := false
+	for _, entry := range client1.log.entries {
+		if strings.Contains(entry.s, "Starting cover transaction") {
+			sentCover = true
+		}
+	}
+	client1.log.Unlock()
+	if !sentCover {
+		t.Errorf("No cover transaction was made in send-only mode with nothing to send")
+	}
+	if from, msg := fetchMessage(client2); from != "client1" || string(msg.message.Body) != "first" {
+		t.Fatalf("Message sent in send-only mode wasn't received")
+	}
+
+	// In fetch-only mode, messages are fetched even though one is
+	// waiting to be sent and composing is unavailable.
+	composeMessage(client1, "client2", "second")
+	setMode(modeFetchOnly)
+	if !client1.gui.hidden["compose"] {
+		t.Errorf("Compose is shown in fetch-only mode")
+	}
+	if from, msg := fetchMessage(client1); from != "client2" || string(msg.message.Body) != "hello" {
+		t.Fatalf("Message not fetched in fetch-only mode")
+	}
+	if len(client1.queue) == 0 {
+		t.Fatalf("Message sent in fetch-only mode")
+	}
+
+	// The mode is kept when restarting.
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if client1.operatingMode() != modeFetchOnly {
+		t.Fatalf("Mode wasn't persisted")
+	}
+	if !client1.gui.hidden["compose"] {
+		t.Errorf("Compose is shown in fetch-only mode after a restart")
+	}
+
+	setMode(modeNormal)
+	if client1.gui.hidden["compose"] {
+		t.Errorf("Compose is hidden in normal mode")
+	}
+}
+
+func TestInvalidContactServer(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// Damage the server of client2 in client1's state.
+	id, contact := contactByName(client1, "client2")
+	goodServer := contact.theirServer
+	contact.theirServer = "garbage"
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+
+	_, contact = contactByName(client1, "client2")
+	if contact.invalidServer == nil {
+		t.Fatalf("Invalid server wasn't detected at load")
+	}
+	if contact.indicator() != indicatorYellow || contact.subline(client1.Now()) != "invalid server" {
+		t.Errorf("Contact with an invalid server isn't marked")
+	}
+	if _, err := client1.SendMessage(id, "test", nil, nil, nil); err == nil {
+		t.Errorf("Message to a contact with an invalid server was accepted")
+	}
+
+	clickOnContact(client1, "client2")
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{
+		name:    "fixserverset",
+		entries: map[string]string{"fixserver": "still garbage"},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+	if len(client1.gui.text["fixservererror"]) == 0 {
+		t.Errorf("No error shown for an invalid server")
+	}
+	client1.gui.events <- Click{
+		name:    "fixserverset",
+		entries: map[string]string{"fixserver": goodServer},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+	if contact.invalidServer != nil || contact.theirServer != goodServer {
+		t.Fatalf("Server wasn't corrected")
+	}
+
+	const testMsg = "after the fix"
+	sendMessage(client1, "client2", testMsg)
+	if _, msg := fetchMessage(client2); string(msg.message.Body) != testMsg {
+		t.Errorf("Message wasn't received after the server was corrected")
+	}
+}
+
+func TestFallbackServers(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	fallbackServer, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fallbackServer.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// client2 adds a fallback server before the key exchange so that its
+	// handshake lists it.
+	proceedToMainUI(t, client2, server)
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.gui.events <- Click{
+		name:    "addfallback",
+		entries: map[string]string{"fallbackserver": server.URL()},
+	}
+	for len(client2.gui.text["fallbackstatus"]) == 0 {
+		client2.gui.WaitForSignal()
+	}
+	if len(client2.fallbackServers) != 0 {
+		t.Fatalf("Home server was added as a fallback server")
+	}
+	client2.gui.events <- Click{
+		name:    "addfallback",
+		entries: map[string]string{"fallbackserver": fallbackServer.URL()},
+	}
+	client2.AdvanceTo(uiStateShowIdentity)
+	if len(client2.fallbackServers) != 1 || client2.fallbackServers[0] != fallbackServer.URL() {
+		t.Fatalf("Fallback server wasn't added: %v", client2.fallbackServers)
+	}
+
+	proceedToPaired(t, client1, client2, server)
+
+	_, contact := contactByName(client1, "client2")
+	if len(contact.theirFallbackServers) != 1 || contact.theirFallbackServers[0] != fallbackServer.URL() {
+		t.Fatalf("Fallback servers weren't received in the key exchange: %v", contact.theirFallbackServers)
+	}
+
+	// Make client2's home server unreachable so that client1 has to use
+	// the fallback. The unreachable server has a valid address since
+	// invalid servers are rejected when the state is loaded.
+	unreachable, err := url.Parse(contact.theirServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable.Host = "127.0.0.1:1"
+	contact.theirServer = unreachable.String()
+	client1.save()
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	_, contact = contactByName(client1, "client2")
+	if len(contact.theirFallbackServers) != 1 || contact.theirFallbackServers[0] != fallbackServer.URL() {
+		t.Fatalf("Fallback servers weren't saved: %v", contact.theirFallbackServers)
+	}
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if len(client2.fallbackServers) != 1 {
+		t.Fatalf("Our fallback servers weren't saved: %v", client2.fallbackServers)
+	}
+
+	composeMessage(client1, "client2", "via the fallback")
+	transmitMessage(client1, false)
+	if msg := client1.outbox[0]; msg.server != fallbackServer.URL() || !msg.sent.IsZero() {
+		t.Fatalf("Failed send didn't switch to the fallback server: %s", msg.server)
+	}
+	transmitMessage(client1, false)
+
+	// client2 alternates between fetching from its home server and from
+	// the fallback server.
+	for i := 0; i < 2 && len(client2.inbox) == 0; i++ {
+		transmitMessage(client2, false)
+	}
+	if len(client2.inbox) != 1 {
+		t.Fatalf("Message wasn't fetched from the fallback server")
+	}
+	if msg := client2.inbox[0]; msg.message == nil || string(msg.message.Body) != "via the fallback" {
+		t.Errorf("Bad message fetched from the fallback server")
+	}
+
+	// Revoking a contact must update the group on every server.
+	clickOnContact(client2, "client1")
+	client2.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{name: "delete"}
+	client2.gui.WaitForSignal()
+	client2.gui.events <- Click{name: "delete"}
+	client2.AdvanceTo(uiStateRevocationComplete)
+	client2.queueMutex.Lock()
+	revocationServers := make(map[string]bool)
+	for _, msg := range client2.queue {
+		if msg.revocation {
+			revocationServers[msg.server] = true
+		}
+	}
+	client2.queueMutex.Unlock()
+	if len(revocationServers) != 2 || !revocationServers[server.URL()] || !revocationServers[fallbackServer.URL()] {
+		t.Errorf("Revocations weren't queued for both servers: %v", revocationServers)
+	}
+}
+
+func TestHandshakeExpiry(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToKeyExchange(t, client, server, "pending")
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	_, contact := contactByName(client, "pending")
+	if contact.kxCreated.IsZero() {
+		t.Fatalf("Handshake creation time wasn't saved")
+	}
+	if client.handshakeStale(contact) {
+		t.Fatalf("New handshake is stale")
+	}
+	oldKX := contact.kxsBytes
+
+	created := contact.kxCreated
+	client.nowFunc = func() time.Time {
+		return created.Add(defaultHandshakeExpiry + time.Hour)
+	}
+	if !client.handshakeStale(contact) {
+		t.Fatalf("Old handshake isn't stale")
+	}
+	if subline := client.contactSubline(contact); subline != "handshake expired" {
+		t.Errorf("Bad subline for stale handshake: %q", subline)
+	}
+
+	client.gui.events <- Click{name: client.contactsUI.entries[0].boxName}
+	client.AdvanceTo(uiStateNewContact2)
+	if len(client.gui.text["kxstale"]) == 0 {
+		t.Fatalf("No warning shown for stale handshake")
+	}
+
+	client.gui.events <- Click{name: "regeneratekx"}
+	client.AdvanceTo(uiStateNewContact)
+	client.AdvanceTo(uiStateNewContact2)
+	if bytes.Equal(contact.kxsBytes, oldKX) {
+		t.Errorf("Handshake wasn't regenerated")
+	}
+	if client.handshakeStale(contact) {
+		t.Errorf("Regenerated handshake is stale")
+	}
+}
+
+func TestRegenerateHandshake(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToKeyExchange(t, client1, server, "client2")
+	proceedToKeyExchange(t, client2, server, "client1")
+
+	oldHandshake := client1.gui.text["kxout"]
+	generation := client1.generation
+
+	client1.gui.events <- Click{name: "regeneratekx"}
+	client1.AdvanceTo(uiStateNewContact)
+	client1.AdvanceTo(uiStateNewContact2)
+
+	newHandshake := client1.gui.text["kxout"]
+	if newHandshake == oldHandshake {
+		t.Fatalf("Handshake wasn't regenerated")
+	}
+	if client1.generation != generation+1 {
+		t.Errorf("Old group member key wasn't revoked")
+	}
+	_, contact := contactByName(client1, "client2")
+	if contact.revoked {
+		t.Errorf("Contact is marked as revoked")
+	}
+
+	// The pairing completes with the new handshake.
+	client1.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": newHandshake},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+
+	// The revocation is sent first.
+	transmitMessage(client1, false)
+	sendMessage(client1, "client2", "after regeneration")
+	from, msg := fetchMessage(client2)
+	if from != "client1" || string(msg.message.Body) != "after regeneration" {
+		t.Errorf("Message wasn't received after regenerating the handshake")
+	}
+}
+
+func TestDuplicateContactIdentity(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// client2 gives client1 a second handshake, which client1 tries to
+	// add as a different person.
+	proceedToKeyExchange(t, client2, server, "client1 again")
+	proceedToKeyExchange(t, client1, server, "someone else")
+
+	process := Click{
+		name:      "process",
+		textViews: map[string]string{"kxin": client2.gui.text["kxout"]},
+	}
+	client1.gui.events <- process
+	if err := client1.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := client1.gui.text["error2"]; !strings.Contains(msg, "client2") {
+		t.Fatalf("No warning about the duplicate identity: %q", msg)
+	}
+	_, dup := contactByName(client1, "someone else")
+	if !dup.isPending {
+		t.Fatalf("Duplicate contact was added without confirmation")
+	}
+	if other := client1.duplicateContact(dup); other == nil || other.name != "client2" {
+		t.Errorf("duplicateContact didn't find the existing contact")
+	}
+
+	// Processing the handshake again adds the contact anyway.
+	client1.gui.events <- process
+	client1.AdvanceTo(uiStateShowContact)
+	if dup.isPending {
+		t.Errorf("Duplicate contact wasn't added after confirmation")
+	}
+}
+
+func TestAccountCreationCancel(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A server that accepts a connection but never answers. closed is
+	// closed once the client has closed the connection.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+	silentURL := fmt.Sprintf("pondserver://%s@%s", server.identity, listener.Addr())
+
+	client.AdvanceTo(uiStateCreatePassphrase)
+	client.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": ""},
+	}
+	client.AdvanceTo(uiStateErasureStorage)
+	client.gui.events <- Click{
+		name: "continue",
+	}
+	client.AdvanceTo(uiStateCreateAccount)
+
+	client.gui.events <- Click{
+		name:    "create",
+		entries: map[string]string{"server": silentURL},
+	}
+	for client.gui.text["status"] != "Connecting to server..." {
+		if err := client.gui.WaitForSignal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.gui.events <- Click{name: "cancelcreate"}
+	if err := client.gui.WaitForSignal(); err != nil {
+		t.Fatal(err)
+	}
+	if status := client.gui.text["status"]; status != errAccountCreationCancelled.Error() {
+		t.Fatalf("Unexpected status after cancelling: %q", status)
+	}
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Connection wasn't closed after cancelling")
+	}
+	if len(client.server) != 0 {
+		t.Errorf("Server was recorded after cancelling: %s", client.server)
+	}
+
+	client.gui.events <- Click{
+		name:    "create",
+		entries: map[string]string{"server": server.URL()},
+	}
+	client.AdvanceTo(uiStateMain)
+}
+
+func TestParseHandshake(t *testing.T) {
+	t.Parallel()
+
+	kxsBytes, err := proto.Marshal(&pond.SignedKeyExchange{
+		Signed:    []byte("signed"),
+		Signature: []byte("signature"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored := string(pem.EncodeToMemory(&pem.Block{Type: keyExchangePEM, Bytes: kxsBytes}))
+	lines := strings.Split(strings.TrimSpace(armored), "\n")
+	body := strings.Join(lines[1:len(lines)-1], "\n")
+
+	quoted := ""
+	for _, line := range lines {
+		quoted += "> " + line + "  \r\n"
+	}
+
+	accepted := []struct {
+		name, text string
+	}{
+		{"armored", armored},
+		{"padded", "\n\n   " + armored + "\n  \n"},
+		{"quoted", quoted},
+		{"raw base64", body},
+		{"raw base64 on one line", strings.Replace(body, "\n", "", -1)},
+		{"missing header", body + "\n" + lines[len(lines)-1]},
+	}
+	for _, test := range accepted {
+		result, err := parseHandshake(test.text)
+		if err != nil {
+			t.Errorf("%s: failed to parse handshake: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(result, kxsBytes) {
+			t.Errorf("%s: handshake parsed incorrectly", test.name)
+		}
+	}
+
+	rejected := []struct {
+		name, text, guidance string
+	}{
+		{"empty", "  \n ", "including the BEGIN and END lines"},
+		{"garbage", "hello there", "including the BEGIN and END lines"},
+		{"missing header", "damaged!\n" + lines[len(lines)-1], "BEGIN line is missing"},
+		{"missing footer", lines[0] + "\n" + body[:len(body)-3], "cut off"},
+		{"damaged", lines[0] + "\ndamaged!\n" + lines[len(lines)-1], "damaged"},
+		{"wrong type", string(pem.EncodeToMemory(&pem.Block{Type: "PGP MESSAGE", Bytes: kxsBytes})), "PGP MESSAGE"},
+		{"not a handshake", base64.StdEncoding.EncodeToString([]byte("not a handshake")), "including the BEGIN and END lines"},
+	}
+	for _, test := range rejected {
+		_, err := parseHandshake(test.text)
+		if err == nil {
+			t.Errorf("%s: handshake was accepted", test.name)
+			continue
+		}
+		if guidance := err.(*handshakeError).guidance; !strings.Contains(guidance, test.guidance) {
+			t.Errorf("%s: guidance %q doesn't contain %q", test.name, guidance, test.guidance)
+		}
+	}
+}
+
+func TestAttachmentSave(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	large := make([]byte, 3*attachmentSaveBlockSize+100)
+	io.ReadFull(rand.Reader, large)
+	largePath := filepath.Join(client2.stateDir, "large")
+	if err := saveAttachment(make(chan interface{}, 1), largePath, 1, large, make(chan bool, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := ioutil.ReadFile(largePath); err != nil || !bytes.Equal(saved, large) {
+		t.Errorf("Large attachment wasn't saved correctly: %v", err)
+	}
+
+	// A canceled save mustn't leave a partial file behind.
+	canceledPath := filepath.Join(client2.stateDir, "canceled")
+	killChan := make(chan bool, 1)
+	killChan <- true
+	if err := saveAttachment(make(chan interface{}, 1), canceledPath, 1, large, killChan); err != backgroundCanceledError {
+		t.Fatalf("Canceled save returned %v", err)
+	}
+	if _, err := os.Stat(canceledPath); !os.IsNotExist(err) {
+		t.Errorf("Canceled save left a file behind: %v", err)
+	}
+
+	contents := make([]byte, 1000)
+	io.ReadFull(rand.Reader, contents)
+	attachmentPath := filepath.Join(client1.stateDir, "attachment")
+	if err := ioutil.WriteFile(attachmentPath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	client1.gui.events <- Click{name: "attach"}
+	client1.gui.WaitForFileOpen()
+	client1.gui.events <- OpenResult{path: attachmentPath, ok: true}
+	client1.gui.WaitForSignal()
+	client1.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "attached"},
+	}
+	client1.AdvanceTo(uiStateOutbox)
+	transmitMessage(client1, false)
+
+	_, msg := fetchMessage(client2)
+	if len(msg.message.Files) != 1 {
+		t.Fatalf("Message received with %d attachments", len(msg.message.Files))
+	}
+	if !attachmentIntact(msg.message.Files[0]) || len(msg.message.Files[0].Sha256) == 0 {
+		t.Errorf("Received attachment doesn't carry a valid hash")
+	}
+	for _, e := range client2.inboxUI.entries {
+		if e.id == msg.id {
+			client2.gui.events <- Click{name: e.boxName}
+			break
+		}
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.gui.events <- Click{name: "attachment-0"}
+	fo := client2.gui.WaitForFileOpen()
+	savedPath := filepath.Join(client2.stateDir, "saved")
+	client2.gui.events <- OpenResult{ok: true, path: savedPath, arg: fo.arg}
+	client2.gui.WaitForSignal()
+	if len(msg.saves) != 1 {
+		t.Fatalf("Save didn't start")
+	}
+	for len(msg.saves) > 0 {
+		client2.gui.WaitForSignal()
+	}
+
+	saved, err := ioutil.ReadFile(savedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, contents) {
+		t.Errorf("Saved attachment differs from the original")
+	}
+}
+
+func TestLoadDiagnostics(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	// Reloading ensures that the state file has been written.
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+
+	diagnostics := client.loadDiagnostics("something failed")
+	for _, want := range []string{"something failed", client.stateFilename, "headered", "key check: true"} {
+		if !strings.Contains(diagnostics, want) {
+			t.Errorf("Diagnostics don't contain %q: %s", want, diagnostics)
+		}
+	}
+	if strings.Contains(diagnostics, fmt.Sprintf("%x", client.identityPublic[:])) {
+		t.Errorf("Diagnostics contain the public identity: %s", diagnostics)
+	}
+
+	client.stateFilename = filepath.Join(client.stateDir, "missing")
+	if diagnostics := client.loadDiagnostics("missing"); !strings.Contains(diagnostics, "unreadable") {
+		t.Errorf("Diagnostics for a missing state file don't say so: %s", diagnostics)
+	}
+}
+
+func TestStateFileKDF(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	dir, err := ioutil.TempDir("", "pond-kdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := &disk.StateFile{
+		Path: filepath.Join(dir, "state"),
+		Rand: rand.Reader,
+		Log:  t.Logf,
+		// A target that is quicker than the default cost leaves the
+		// parameters at the default.
+		KDFTime: time.Nanosecond,
+	}
+	if err := stateFile.Create("secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, 32)
+	state := &disk.State{
+		Identity:     key,
+		Public:       key,
+		Private:      key,
+		Server:       proto.String("pondserver://test"),
+		Group:        key,
+		GroupPrivate: key,
+	}
+	stateBytes, err := proto.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := make(chan disk.NewState)
+	done := make(chan struct{})
+	go stateFile.StartWriter(states, done)
+	states <- disk.NewState{State: stateBytes}
+	close(states)
+	<-done
+
+	if format := disk.DescribeFormat(stateFile.Path); !strings.Contains(format, "scrypt N=32768 r=16 p=1") {
+		t.Errorf("State file doesn't use the default scrypt parameters: %s", format)
+	}
+
+	if _, err := (&disk.StateFile{Path: stateFile.Path, Log: t.Logf}).Read("wrong"); err != disk.BadPasswordError {
+		t.Errorf("Reading with the wrong passphrase gave %v", err)
+	}
+	if _, err := (&disk.StateFile{Path: stateFile.Path, Log: t.Logf}).Read("secret"); err != nil {
+		t.Errorf("Failed to read state file: %s", err)
+	}
+}
+
+func TestFormatBodyMarkup(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"plain text", "plain text"},
+		{"*bold* and _italic_", "<b>bold</b> and <i>italic</i>"},
+		{"a * b * c", "a * b * c"},
+		{"snake_case_name", "snake_case_name"},
+		{"2*3*4", "2*3*4"},
+		{"**", "**"},
+		{"*not\nbold*", "*not\nbold*"},
+		{"<b>&'\"", "&lt;b&gt;&amp;&apos;&quot;"},
+		{"*<i>*", "<b>&lt;i&gt;</b>"},
+		{"see https://example.com/a_b_c.", `see <a href="https://example.com/a_b_c">https://example.com/a_b_c</a>.`},
+		{"https://x/?a=1&b=<2>", `<a href="https://x/?a=1&amp;b=">https://x/?a=1&amp;b=</a>&lt;2&gt;`},
+		{"ftp://example.com", "ftp://example.com"},
+		{"bad\x00\xff", "bad\ufffd\ufffd"},
+	}
+
+	for _, test := range tests {
+		if out := formatBodyMarkup(test.in); out != test.out {
+			t.Errorf("formatBodyMarkup(%q) = %q, but wanted %q", test.in, out, test.out)
+		}
+	}
+}
+
+func TestFormatBodies(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	const body = "*hello* <b>"
+	sendMessage(client1, "client2", body)
+	fetchMessage(client2)
+
+	// Bodies are shown exactly as they were sent by default.
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	if text := client2.gui.text["body"]; text != body {
+		t.Errorf("Body is %q, but wanted %q", text, body)
+	}
+	if _, ok := client2.gui.text["formattedbody"]; ok {
+		t.Errorf("Formatted body was shown by default")
+	}
+
+	client2.gui.events <- Click{
+		name: client2.clientUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.gui.events <- Click{
+		name:   "formatbodies",
+		checks: map[string]bool{"formatbodies": true},
+	}
+	client2.AdvanceTo(uiStateShowIdentity)
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	if markup, want := client2.gui.text["formattedbody"], formatBodyMarkup(body); markup != want {
+		t.Errorf("Formatted body is %q, but wanted %q", markup, want)
+	}
+
+	client2.gui.text["body"] = ""
+	client2.gui.events <- Click{
+		name:   "viewraw",
+		checks: map[string]bool{"viewraw": true},
+	}
+	client2.AdvanceTo(uiStateInbox)
+	if text := client2.gui.text["body"]; text != body {
+		t.Errorf("Raw body is %q, but wanted %q", text, body)
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if !client2.formatBodies {
+		t.Errorf("Formatting preference wasn't kept after reload")
+	}
+}
+
+func TestBrowserCommandArgs(t *testing.T) {
+	args, err := browserCommandArgs(" torsocks  firefox ", "https://example.com/a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"torsocks", "firefox", "https://example.com/a b"}; fmt.Sprint(args) != fmt.Sprint(want) {
+		t.Errorf("Got arguments %q, but wanted %q", args, want)
+	}
+
+	if _, err := browserCommandArgs("", "https://example.com"); err != errNoBrowserCommand {
+		t.Errorf("Unexpected error without a command: %v", err)
+	}
+	for _, u := range []string{"file:///etc/passwd", "javascript:alert(1)", "https://", "example.com"} {
+		if _, err := browserCommandArgs("firefox", u); err == nil {
+			t.Errorf("%q was accepted as a link", u)
+		}
+	}
+}
+
+func TestOpenLink(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	const link = "https://example.com/page"
+	sendMessage(client1, "client2", "see "+link)
+	fetchMessage(client2)
+	client2.formatBodies = true
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	// Without a browser command, the link can only be copied.
+	client2.gui.events <- LinkClicked{name: "formattedbody", uri: link}
+	client2.AdvanceTo(uiStateConfirm)
+	if body := client2.gui.text["confirmbody"]; !strings.HasPrefix(body, link) || !strings.Contains(body, "Copy") {
+		t.Errorf("Unexpected confirmation without a browser command: %q", body)
+	}
+	client2.gui.events <- Click{name: "confirmyes"}
+	client2.AdvanceTo(uiStateInbox)
+	if client2.gui.clipboard != link {
+		t.Errorf("Clipboard contains %q, but wanted the link", client2.gui.clipboard)
+	}
+
+	client2.gui.events <- Click{
+		name: client2.clientUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.gui.events <- Click{
+		name:    "setbrowsercommand",
+		entries: map[string]string{"browsercommand": " true "},
+	}
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	if client2.browserCommand != "true" {
+		t.Fatalf("Browser command is %q", client2.browserCommand)
+	}
+
+	client2.gui.events <- LinkClicked{name: "formattedbody", uri: link}
+	client2.AdvanceTo(uiStateConfirm)
+	if body := client2.gui.text["confirmbody"]; !strings.HasPrefix(body, link) || !strings.Contains(body, "IP address") {
+		t.Errorf("Confirmation doesn't warn about opening the link: %q", body)
+	}
+	client2.gui.events <- Click{name: "confirmno"}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if client2.browserCommand != "true" {
+		t.Errorf("Browser command wasn't kept after reload")
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	for i := 0; i < 3; i++ {
+		sendMessage(client1, "client2", fmt.Sprintf("message %d", i))
+		fetchMessage(client2)
+		client2.gui.events <- Click{
+			name: client2.inboxUI.entries[i].boxName,
+		}
+		client2.AdvanceTo(uiStateInbox)
+	}
+	var ids []uint64
+	for _, entry := range client2.inboxUI.entries {
+		ids = append(ids, entry.id)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("Inbox has %d entries, but wanted 3", len(ids))
+	}
+
+	clickEntry := func(i int, shift, control bool) {
+		client2.gui.events <- Click{
+			name:    client2.inboxUI.entries[i].boxName,
+			shift:   shift,
+			control: control,
+		}
+	}
+	checkCount := func(n int) {
+		if text := client2.gui.text["selectioncount"]; !strings.HasPrefix(text, fmt.Sprintf("%d messages", n)) {
+			t.Errorf("Selection count is %q, but wanted %d messages", text, n)
+		}
+	}
+
+	clickEntry(0, false, false)
+	client2.AdvanceTo(uiStateInbox)
+	clickEntry(2, false, true)
+	client2.AdvanceTo(uiStateInboxSelection)
+	checkCount(2)
+	clickEntry(0, true, false)
+	client2.AdvanceTo(uiStateInboxSelection)
+	checkCount(3)
+	clickEntry(1, false, true)
+	client2.AdvanceTo(uiStateInboxSelection)
+	checkCount(2)
+
+	client2.gui.events <- Click{name: "deleteselected"}
+	client2.AdvanceTo(uiStateConfirm)
+	client2.gui.events <- Click{name: "confirmno"}
+	client2.AdvanceTo(uiStateInboxSelection)
+	if len(client2.inbox) != 3 {
+		t.Fatalf("Messages were deleted without confirmation")
+	}
+
+	client2.gui.events <- Click{name: "deleteselected"}
+	client2.AdvanceTo(uiStateConfirm)
+	if body := client2.gui.text["confirmbody"]; !strings.Contains(body, "2 messages") {
+		t.Errorf("Confirmation doesn't mention the number of messages: %q", body)
+	}
+	client2.gui.events <- Click{name: "confirmyes"}
+	client2.AdvanceTo(uiStateMain)
+
+	if len(client2.inbox) != 1 || client2.inbox[0].id != ids[1] {
+		t.Fatalf("Wrong messages were deleted")
+	}
+	if ui := client2.inboxUI; len(ui.entries) != 1 || ui.selected != 0 || ui.multiSelected != nil {
+		t.Errorf("Inbox list wasn't updated: %d entries, selected %d, %d multiply selected", len(ui.entries), ui.selected, len(ui.multiSelected))
+	}
+
+	// A single message that is left selected with control is shown as
+	// usual.
+	clickEntry(0, false, true)
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if len(client2.inbox) != 1 {
+		t.Errorf("Inbox has %d messages after reload", len(client2.inbox))
+	}
+}
+
+func TestAttachmentIntact(t *testing.T) {
+	a := newAttachment("a.txt", []byte("contents"))
+	if !attachmentIntact(a) {
+		t.Errorf("New attachment isn't intact")
+	}
+	a.Contents[0] ^= 1
+	if attachmentIntact(a) {
+		t.Errorf("Damaged attachment is intact")
+	}
+
+	// Attachments from older clients don't have a hash.
+	old := &pond.Message_Attachment{Filename: proto.String("a.txt"), Contents: []byte("contents")}
+	if !attachmentIntact(old) {
+		t.Errorf("Attachment without a hash isn't intact")
+	}
+}
+
+func TestUnverifiedWarning(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	_, contact := contactByName(client1, "client2")
+
+	// clickAndWait sends a click to the compose UI and waits for it to
+	// update the warning. Other signals, such as for clock skew, may come
+	// first.
+	clickAndWait := func(click Click) {
+		delete(client1.gui.text, "unverifiedwarningtext")
+		client1.gui.events <- click
+		for _, ok := client1.gui.text["unverifiedwarningtext"]; !ok; _, ok = client1.gui.text["unverifiedwarningtext"] {
+			client1.gui.WaitForSignal()
+		}
+	}
+	// composeTo starts a message to client2 and returns whether the
+	// warning is shown.
+	composeTo := func() bool {
+		client1.gui.events <- Click{name: "compose"}
+		client1.AdvanceTo(uiStateCompose)
+		if !client1.gui.hidden["unverifiedwarning"] {
+			t.Errorf("Warning is shown before a recipient is chosen")
+		}
+		clickAndWait(Click{name: "to", combos: map[string]string{"to": "client2"}})
+		return !client1.gui.hidden["unverifiedwarning"]
+	}
+
+	if !composeTo() {
+		t.Fatalf("No warning for an unverified contact")
+	}
+	if s := client1.gui.text["unverifiedwarningtext"]; !strings.Contains(s, "client2") {
+		t.Errorf("Warning doesn't name the contact: %q", s)
+	}
+
+	client1.gui.events <- Click{name: "verifynow"}
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{name: "verify"}
+	client1.AdvanceTo(uiStateShowContact)
+	if !contact.verified {
+		t.Fatalf("Contact wasn't marked as verified")
+	}
+	if composeTo() {
+		t.Errorf("Warning is shown for a verified contact")
+	}
+
+	clickOnContact(client1, "client2")
+	client1.gui.events <- Click{name: "verify"}
+	client1.AdvanceTo(uiStateShowContact)
+	if !composeTo() {
+		t.Fatalf("No warning once the contact was marked as unverified")
+	}
+	clickAndWait(Click{name: "unverifiedok"})
+	if !client1.gui.hidden["unverifiedwarning"] {
+		t.Errorf("Warning is still shown after being dismissed")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	_, contact = contactByName(client1, "client2")
+	if contact.verified || !contact.noUnverifiedWarning {
+		t.Errorf("Verification state wasn't saved")
+	}
+	if composeTo() {
+		t.Errorf("Dismissed warning is shown again")
+	}
+}
+
+func TestDefaultRecipient(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
+	id2, _ := contactByName(client1, "client2")
+	id3, _ := contactByName(client1, "client3")
+
+	// compose returns the recipient of a new draft.
+	compose := func() uint64 {
+		existing := make(map[uint64]bool)
+		for id := range client1.drafts {
+			existing[id] = true
+		}
+		client1.gui.events <- Click{name: "compose"}
+		client1.AdvanceTo(uiStateCompose)
+		for id, draft := range client1.drafts {
+			if !existing[id] {
+				return draft.to
+			}
+		}
+		t.Fatalf("No draft was created")
+		return 0
+	}
+	setDefault := func(choice string) {
+		client1.gui.events <- Click{name: client1.clientUI.entries[0].boxName}
+		client1.AdvanceTo(uiStateShowIdentity)
+		client1.gui.events <- Click{name: "defaultrecipient", combos: map[string]string{"defaultrecipient": choice}}
+		client1.AdvanceTo(uiStateShowIdentity)
+	}
+
+	if to := compose(); to != 0 {
+		t.Errorf("New message is addressed to %d by default", to)
+	}
+
+	setDefault("client3")
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if client1.defaultRecipient != id3 || client1.defaultRecipientRecent {
+		t.Fatalf("Default recipient wasn't saved")
+	}
+	if to := compose(); to != id3 {
+		t.Errorf("New message is addressed to %d, not the pinned contact", to)
+	}
+
+	sendMessage(client1, "client2", "hello")
+	setDefault(defaultRecipientRecent)
+	if to := compose(); to != id2 {
+		t.Errorf("New message is addressed to %d, not the most recent recipient", to)
+	}
+
+	setDefault(defaultRecipientNone)
+	if client1.defaultRecipient != 0 || client1.defaultRecipientRecent {
+		t.Errorf("Default recipient wasn't cleared")
+	}
+}
+
+func TestMaskKeys(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	client1.gui.events <- Click{name: client1.clientUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowIdentity)
+	identity := fmt.Sprintf("%x", client1.identityPublic[:])
+	if s := client1.gui.text["identityvalue"]; s != identity {
+		t.Errorf("Identity is shown as %q by default", s)
+	}
+
+	client1.gui.events <- Click{name: "maskkeys", checks: map[string]bool{"maskkeys": true}}
+	client1.AdvanceTo(uiStateShowIdentity)
+	if !client1.maskKeys {
+		t.Fatalf("Masking keys wasn't enabled")
+	}
+	if s := client1.gui.text["identityvalue"]; s == identity || !strings.HasPrefix(identity, strings.TrimSuffix(s, "…")) {
+		t.Errorf("Masked identity is shown as %q", s)
+	}
+
+	// The full value can be copied while masked.
+	client1.gui.events <- Click{name: "copyidentity"}
+	client1.gui.WaitForSignal()
+	if client1.gui.clipboard != identity {
+		t.Errorf("Copied identity is %q, but wanted %q", client1.gui.clipboard, identity)
+	}
+
+	client1.gui.events <- Click{name: "showidentity"}
+	client1.gui.WaitForSignal()
+	if s := client1.gui.text["identityvalue"]; s != identity {
+		t.Errorf("Revealed identity is %q", s)
+	}
+	if !client1.gui.hidden["showidentity"] {
+		t.Errorf("Show button wasn't hidden once the identity was revealed")
+	}
+
+	_, contact := contactByName(client1, "client2")
+	currentDH := fmt.Sprintf("%x", contact.theirCurrentDHPublic[:])
+	clickOnContact(client1, "client2")
+	client1.AdvanceTo(uiStateShowContact)
+	if s := client1.gui.text["currentdhvalue"]; s == currentDH {
+		t.Errorf("Contact's DH value isn't masked")
+	}
+	client1.gui.events <- Click{name: "copycurrentdh"}
+	client1.gui.WaitForSignal()
+	if client1.gui.clipboard != currentDH {
+		t.Errorf("Copied DH value is %q, but wanted %q", client1.gui.clipboard, currentDH)
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	if !client1.maskKeys {
+		t.Errorf("Masking keys wasn't persisted")
+	}
+}
+
+func TestCopyIdentity(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+	client.gui.events <- Click{name: client.clientUI.entries[0].boxName}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.gui.events <- Click{name: "copyidentity"}
+	client.gui.WaitForSignal()
+	if expected := fmt.Sprintf("%x", client.identityPublic[:]); client.gui.clipboard != expected {
+		t.Errorf("Copied identity is %q, but wanted %q", client.gui.clipboard, expected)
+	}
+
+	client.gui.events <- Click{name: "copypublickey"}
+	client.gui.WaitForSignal()
+	if expected := fmt.Sprintf("%x", client.pub[:]); client.gui.clipboard != expected {
+		t.Errorf("Copied public key is %q, but wanted %q", client.gui.clipboard, expected)
+	}
+
+	client.gui.events <- Click{name: "copyidentityblock"}
+	client.gui.WaitForSignal()
+	serverURL, identityPublic, pub, err := parseIdentityBlock("> " + strings.Replace(client.gui.clipboard, "\n", "\n> ", -1))
+	if err != nil {
+		t.Fatalf("Failed to parse copied identity block: %s", err)
+	}
+	if serverURL != client.server || identityPublic != client.identityPublic || pub != client.pub {
+		t.Errorf("Identity block didn't round trip")
+	}
+
+	if _, _, _, err := parseIdentityBlock(strings.Replace(client.gui.clipboard, "Identity: ", "Identity: 00", 1)); err == nil {
+		t.Errorf("Identity block with a bad identity was accepted")
+	}
+}
+
+func TestPublishedKeyExchange(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	alice, err := NewTestClient(t, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+
+	bob, err := NewTestClient(t, "bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	carol, err := NewTestClient(t, "carol", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer carol.Close()
+
+	proceedToMainUI(t, alice, server)
+	alice.gui.events <- Click{name: alice.clientUI.entries[0].boxName}
+	alice.AdvanceTo(uiStateShowIdentity)
+	alice.gui.events <- Click{name: "createpublishedkx"}
+	for len(alice.gui.text["publishedkx"]) == 0 {
+		alice.gui.WaitForSignal()
+	}
+	published := alice.gui.text["publishedkx"]
+	if !strings.Contains(published, publishedKeyExchangePEM) {
+		t.Fatalf("Published handshake has the wrong type: %s", published)
+	}
+	alice.gui.events <- Click{name: "copypublishedkx"}
+	alice.gui.WaitForSignal()
+	if alice.gui.clipboard != published {
+		t.Errorf("Copied published handshake differs from the one displayed")
+	}
+	if block := alice.myKeyExchangeBlock(); block != published {
+		t.Errorf("Published handshake changed")
+	}
+
+	// Bob and Carol both complete the same published handshake and send
+	// their own handshakes back to Alice.
+	for _, reader := range []*TestClient{bob, carol} {
+		proceedToKeyExchange(t, reader, server, "alice")
+		reader.gui.events <- Click{
+			name:      "process",
+			textViews: map[string]string{"kxin": published},
+		}
+		reader.AdvanceTo(uiStateShowContact)
+
+		alice.gui.events <- Click{name: "newcontact"}
+		alice.AdvanceTo(uiStateNewContact)
+		alice.gui.events <- Click{
+			name:    "name",
+			entries: map[string]string{"name": reader.name},
+		}
+		alice.gui.events <- Click{name: "manual"}
+		alice.AdvanceTo(uiStateNewContact2)
+		alice.gui.events <- Click{
+			name:      "process",
+			textViews: map[string]string{"kxin": reader.gui.text["kxout"]},
+			checks:    map[string]bool{"kxpublished": true},
+		}
+		alice.AdvanceTo(uiStateShowContact)
+	}
+
+	_, bobContact := contactByName(alice, "bob")
+	_, carolContact := contactByName(alice, "carol")
+	if !bobContact.viaPublished || !carolContact.viaPublished {
+		t.Fatalf("Contacts weren't added from the published handshake")
+	}
+	if !bytes.Equal(bobContact.groupKey.Tag(), carolContact.groupKey.Tag()) {
+		t.Errorf("Contacts added from the published handshake have different member keys")
+	}
+
+	checkMessage := func(client *TestClient, expectedFrom, expectedBody string) {
+		from, msg := fetchMessage(client)
+		if from != expectedFrom {
+			t.Errorf("%s received message from %s, but expected %s", client.name, from, expectedFrom)
+		}
+		if body := string(msg.message.Body); body != expectedBody {
+			t.Errorf("%s received %q, but expected %q", client.name, body, expectedBody)
+		}
+	}
+
+	sendMessage(carol, "alice", "from carol")
+	checkMessage(alice, "carol", "from carol")
+	sendMessage(bob, "alice", "from bob")
+	checkMessage(alice, "bob", "from bob")
+
+	sendMessage(alice, "bob", "to bob")
+	checkMessage(bob, "alice", "to bob")
+	sendMessage(alice, "carol", "to carol")
+	checkMessage(carol, "alice", "to carol")
+
+	alice.Reload()
+	alice.AdvanceTo(uiStateMain)
+	if block := alice.myKeyExchangeBlock(); block != published {
+		t.Errorf("Published handshake changed after reloading")
+	}
+	if _, contact := contactByName(alice, "bob"); !contact.viaPublished {
+		t.Errorf("Contact lost its published status after reloading")
+	}
+
+	sendMessage(bob, "alice", "after reload")
+	checkMessage(alice, "bob", "after reload")
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{"Work", []string{"work"}},
+		{"work, Family ,  book   club", []string{"book club", "family", "work"}},
+		{"work, WORK, all, All", []string{"work"}},
+	}
+	for _, test := range tests {
+		got := parseTags(test.in)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("parseTags(%q) = %q, but wanted %q", test.in, got, test.want)
+		}
+	}
+	if s := formatTags([]string{"family", "work"}); s != "family, work" {
+		t.Errorf("Tags formatted as %q", s)
+	}
+}
+
+func TestContactTags(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	client1.gui.events <- Click{name: "newcontact"}
+	client1.AdvanceTo(uiStateNewContact)
+	client1.gui.events <- Click{
+		name:    "name",
+		entries: map[string]string{"name": "pending"},
+	}
+	client1.gui.events <- Click{name: "manual"}
+	client1.AdvanceTo(uiStateNewContact2)
+
+	client2ID, contact := contactByName(client1, "client2")
+	pendingID, _ := contactByName(client1, "pending")
+
+	for _, entry := range client1.contactsUI.entries {
+		if entry.id == client2ID {
+			client1.gui.events <- Click{name: entry.boxName}
+		}
+	}
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{
+		name:    "settags",
+		entries: map[string]string{"tags": "Work, family"},
+	}
+	client1.AdvanceTo(uiStateShowContact)
+	if fmt.Sprint(contact.tags) != fmt.Sprint([]string{"family", "work"}) {
+		t.Fatalf("Contact has tags %q", contact.tags)
+	}
+
+	hidden := func(id uint64) bool {
+		for _, entry := range client1.contactsUI.entries {
+			if entry.id == id {
+				return entry.hidden
+			}
+		}
+		t.Fatalf("Contact %d isn't in the list", id)
+		return false
+	}
+
+	client1.gui.events <- Update{name: "contactfilter", text: "Wo"}
+	client1.gui.events <- Click{name: "settags", entries: map[string]string{"tags": "Work, family"}}
+	client1.AdvanceTo(uiStateShowContact)
+	if hidden(client2ID) || !hidden(pendingID) {
+		t.Errorf("Filtering by tag gave the wrong contacts: %v %v", hidden(client2ID), hidden(pendingID))
+	}
+
+	client1.gui.events <- Update{name: "contactfilter", text: "all"}
+	client1.gui.events <- Click{name: "settags", entries: map[string]string{"tags": "Work, family"}}
+	client1.AdvanceTo(uiStateShowContact)
+	if hidden(client2ID) || hidden(pendingID) {
+		t.Errorf("Contacts are still hidden after filtering by all")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	_, contact = contactByName(client1, "client2")
+	if fmt.Sprint(contact.tags) != fmt.Sprint([]string{"family", "work"}) {
+		t.Errorf("Contact has tags %q after reload", contact.tags)
+	}
+}
+
+func TestDraftIndicator(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "test message")
+	fetchMessage(client2)
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	ackChan := make(chan bool)
+	client2.fetchNowChan <- ackChan
+WaitForAck:
+	for {
+		select {
+		case ack := <-client2.gui.signal:
+			ack <- true
+		case <-ackChan:
+			break WaitForAck
+		}
+	}
+	fetchMessage(client1)
+
+	contactID, _ := contactByName(client1, "client2")
+	var contactEntry listItem
+	for _, entry := range client1.contactsUI.entries {
+		if entry.id == contactID {
+			contactEntry = entry
+		}
+	}
+	outboxEntry := client1.outboxUI.entries[0]
+
+	check := func(contactWant, outboxWant Indicator) {
+		if got := client1.gui.images[contactEntry.imageName]; got != contactWant {
+			t.Errorf("Contact has indicator %d, but wanted %d", got, contactWant)
+		}
+		if got := client1.gui.images[outboxEntry.imageName]; got != outboxWant {
+			t.Errorf("Outbox message has indicator %d, but wanted %d", got, outboxWant)
+		}
+	}
+
+	client1.gui.events <- Click{name: contactEntry.boxName}
+	client1.AdvanceTo(uiStateShowContact)
+	check(indicatorNone, indicatorGreen)
+
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	client1.gui.events <- Click{
+		name:   "to",
+		combos: map[string]string{"to": "client2"},
+	}
+	client1.gui.events <- Click{name: contactEntry.boxName}
+	client1.AdvanceTo(uiStateShowContact)
+	check(indicatorDraft, indicatorDraft)
+	if !client1.hasDraft(contactID) {
+		t.Fatalf("No draft to the contact")
+	}
+
+	client1.gui.events <- Click{name: client1.draftsUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateCompose)
+	client1.gui.events <- Click{name: "discard"}
+	client1.AdvanceTo(uiStateMain)
+	check(indicatorNone, indicatorGreen)
+}
+
+func TestMissingMessageFields(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+
+	// Simulate a message from a contact that has since been deleted and
+	// which lacks a time.
+	inboxMsg := client2.inbox[0]
+	inboxMsg.from = client2.randId()
+	inboxMsg.message.Time = nil
+
+	if name := client2.ContactName(inboxMsg.from); name != unknownContactName {
+		t.Errorf("Unknown contact is named %q", name)
+	}
+	if sentTime, _, body := inboxMsg.Strings(); sentTime != unknownTimeText || body != "hello" {
+		t.Errorf("Message without a time has strings %q and %q", sentTime, body)
+	}
+
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	client2.gui.events <- Click{name: client2.inboxUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateInbox)
+
+	outboxMsg := client1.outbox[0]
+	outboxMsg.to = client1.randId()
+	outboxMsg.message.Time = nil
+
+	client1.gui.events <- Click{name: client1.outboxUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateOutbox)
+}
+
+func TestOrphanAckAndSelfMessage(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	logged := func(client *TestClient, substr string) bool {
+		client.log.Lock()
+		defer client.log.Unlock()
+		for _, entry := range client.log.entries {
+			if strings.Contains(entry.s, substr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// An acknowledgement of a message that isn't in the outbox is logged.
+	_, contact := contactByName(client1, "client2")
+	client1.processAcks(contact, &pond.Message{InReplyTo: proto.Uint64(0x1234)})
+	if !logged(client1, "message 1234, which isn't in the outbox") {
+		t.Errorf("Orphan acknowledgement wasn't logged")
+	}
+
+	// Make client2 believe that client1 has its own identity.
+	_, contact = contactByName(client2, "client1")
+	contact.theirIdentityPublic = client2.identityPublic
+
+	sendMessage(client1, "client2", "hello")
+	ackChan := make(chan bool)
+	client2.fetchNowChan <- ackChan
+WaitForFetch:
+	for {
+		select {
+		case ack := <-client2.gui.signal:
+			ack <- true
+		case <-ackChan:
+			break WaitForFetch
+		}
+	}
+
+	if len(client2.inbox) != 0 {
+		t.Errorf("Message from ourselves was accepted")
+	}
+	if !logged(client2, "claims to be from ourselves") {
+		t.Errorf("Message from ourselves wasn't logged")
+	}
+}
+
+func TestMuteContact(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	id, contact := contactByName(client2, "client1")
+	lineName := func() string {
+		for _, entry := range client2.contactsUI.entries {
+			if entry.id == id {
+				return entry.lineName
+			}
+		}
+		t.Fatalf("Contact isn't in the list")
+		return ""
+	}
+
+	client2.gui.events <- Click{name: "mute"}
+	client2.AdvanceTo(uiStateShowContact)
+	if !contact.muted {
+		t.Fatalf("Contact wasn't muted")
+	}
+	if line := client2.gui.text[lineName()]; line != "client1 "+mutedGlyph {
+		t.Errorf("Muted contact is shown as %q", line)
+	}
+
+	// Messages from a muted contact are still counted as unread.
+	sendMessage(client1, "client2", "hello")
+	fetchMessage(client2)
+	client2.gui.events <- Click{name: client2.clientUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowIdentity)
+	if title := client2.gui.title; !strings.HasSuffix(title, "(1)") {
+		t.Errorf("Unread message from muted contact not counted: %q", title)
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	_, contact = contactByName(client2, "client1")
+	if !contact.muted {
+		t.Fatalf("Contact isn't muted after reload")
+	}
+
+	client2.gui.events <- Click{name: client2.contactsUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowContact)
+	client2.gui.events <- Click{name: "mute"}
+	client2.AdvanceTo(uiStateShowContact)
+	if contact.muted {
+		t.Errorf("Contact wasn't unmuted")
+	}
+	if line := client2.gui.text[lineName()]; line != "client1" {
+		t.Errorf("Unmuted contact is shown as %q", line)
+	}
+}
+
+func TestParseHotkey(t *testing.T) {
+	valid := []struct {
+		in, want string
+	}{
+		{"Ctrl+Alt+W", "ctrl+alt+w"},
+		{"shift + control + F5", "ctrl+shift+f5"},
+		{"alt+shift+ctrl+delete", "ctrl+alt+shift+delete"},
+	}
+	for _, test := range valid {
+		h, err := parseHotkey(test.in)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", test.in, err)
+			continue
+		}
+		if s := h.String(); s != test.want {
+			t.Errorf("%q parsed as %q, but wanted %q", test.in, s, test.want)
+		}
+	}
+
+	if h, err := parseHotkey(" "); h != nil || err != nil {
+		t.Errorf("Empty hotkey wasn't disabled: %v %v", h, err)
+	}
+	for _, in := range []string{"w", "ctrl+w", "ctrl+ctrl+w", "hyper+alt+w", "ctrl+alt+!", "ctrl+alt+space", "ctrl+alt+"} {
+		if _, err := parseHotkey(in); err == nil {
+			t.Errorf("%q was accepted", in)
+		}
+	}
+
+	for keyval, want := range map[uint32]string{'W': "w", '7': "7", 0xffbe: "f1", 0xffc9: "f12", 0xffff: "delete", ' ': ""} {
+		if name := keyvalName(keyval); name != want {
+			t.Errorf("keyvalName(%#x) = %q, but wanted %q", keyval, name, want)
+		}
+	}
+}
+
+func TestPanicWipe(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	client.gui.events <- Click{name: client.clientUI.entries[0].boxName}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.gui.events <- Click{
+		name:    "setwipehotkey",
+		entries: map[string]string{"wipehotkey": "ctrl+w"},
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+	if client.wipeHotkey != nil || len(client.gui.text["wipehotkeyerror"]) == 0 {
+		t.Fatalf("Hotkey with one modifier was accepted")
+	}
+
+	client.gui.events <- Click{
+		name:    "setwipehotkey",
+		entries: map[string]string{"wipehotkey": "ctrl+alt+shift+w"},
+	}
+	client.AdvanceTo(uiStateShowIdentity)
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	if h := client.wipeHotkey; h == nil || h.String() != "ctrl+alt+shift+w" {
+		t.Fatalf("Hotkey wasn't restored: %v", h)
+	}
+
+	statePath := filepath.Join(client.stateDir, "state")
+	client.gui.events <- KeyPress{key: "w", control: true, alt: true}
+	client.gui.events <- KeyPress{key: "w", control: true, alt: true, shift: true}
+
+WaitForExit:
+	for {
+		select {
+		case _, ok := <-client.gui.actions:
+			if !ok {
+				break WaitForExit
+			}
+		case ack := <-client.gui.signal:
+			ack <- true
+		}
+	}
+
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("State file still exists: %v", err)
+	}
+	var zero [32]byte
+	if !bytes.Equal(client.priv[:32], zero[:]) {
+		t.Errorf("Signing key wasn't wiped")
+	}
+	if client.identity != zero {
+		t.Errorf("Identity key wasn't wiped")
+	}
+}
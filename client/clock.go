@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxClockSkew is the largest difference between the local clock and the home
+// server's that is tolerated before the user is warned. Some difference is
+// expected because of the latency of the network, especially via Tor.
+const maxClockSkew = 10 * time.Minute
+
+// clockSkewResult is sent on backgroundChan by transact after each fetch from
+// the home server that reported the server's time.
+type clockSkewResult struct {
+	// skew is the amount by which the local clock is ahead of the
+	// server's. It's negative if the local clock is behind.
+	skew time.Duration
+}
+
+// processClockSkew runs on the main client goroutine and records the result
+// of a measurement by transact. The local clock is never adjusted: the user is
+// only informed, in the activity log, when it becomes wrong and when it's
+// corrected.
+func (c *client) processClockSkew(result clockSkewResult) {
+	wasSkewed := c.clockSkewed()
+	c.clockSkew = result.skew
+	c.clockSkewKnown = true
+
+	switch {
+	case !wasSkewed && c.clockSkewed():
+		c.log.Errorf("The local clock is %s. Message times and erasure will be wrong until it's corrected.", describeClockSkew(c.clockSkew))
+	case wasSkewed && !c.clockSkewed():
+		c.log.Printf("The local clock now agrees with the home server's")
+	}
+}
+
+// clockSkewed returns true if the last measurement found that the local clock
+// differs from the home server's by more than maxClockSkew.
+func (c *client) clockSkewed() bool {
+	return c.clockSkewKnown && (c.clockSkew > maxClockSkew || c.clockSkew < -maxClockSkew)
+}
+
+// clockSkewSummary returns a description of the last measurement, for display.
+func (c *client) clockSkewSummary() string {
+	if !c.clockSkewKnown {
+		return "Not yet measured"
+	}
+	return describeClockSkew(c.clockSkew)
+}
+
+// describeClockSkew describes the difference between the local clock and the
+// home server's, given the amount by which the local clock is ahead.
+func describeClockSkew(skew time.Duration) string {
+	relation := "ahead of"
+	if skew < 0 {
+		skew = -skew
+		relation = "behind"
+	}
+	skew = skew / time.Second * time.Second
+	return fmt.Sprintf("%s %s the home server's", skew, relation)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes of an attachment that are examined in
+// order to determine its type. http.DetectContentType considers no more than
+// this.
+const sniffLen = 512
+
+// attachmentType describes the content of an attachment, as determined from
+// the content itself rather than from the filename that the sender chose.
+type attachmentType struct {
+	// mimeType is the detected MIME type, without any parameters.
+	mimeType string
+	// label is a human-readable description of the type.
+	label string
+	// icon is the name, from the freedesktop.org icon naming
+	// specification, of an icon that represents the type.
+	icon string
+	// isImage is true if the content is an image in a format that can be
+	// previewed.
+	isImage bool
+}
+
+// knownAttachmentTypes maps MIME types to descriptions of them.
+var knownAttachmentTypes = map[string]attachmentType{
+	"image/png":                    {label: "PNG image", icon: "image-x-generic", isImage: true},
+	"image/jpeg":                   {label: "JPEG image", icon: "image-x-generic", isImage: true},
+	"image/gif":                    {label: "GIF image", icon: "image-x-generic", isImage: true},
+	"image/bmp":                    {label: "BMP image", icon: "image-x-generic"},
+	"image/webp":                   {label: "WebP image", icon: "image-x-generic"},
+	"application/pdf":              {label: "PDF document", icon: "x-office-document"},
+	"application/postscript":       {label: "PostScript document", icon: "x-office-document"},
+	"application/zip":              {label: "ZIP archive", icon: "package-x-generic"},
+	"application/x-gzip":           {label: "gzip archive", icon: "package-x-generic"},
+	"application/x-rar-compressed": {label: "RAR archive", icon: "package-x-generic"},
+	"text/html":                    {label: "HTML document", icon: "text-html"},
+	"text/xml":                     {label: "XML document", icon: "text-x-generic"},
+	"text/plain":                   {label: "Text", icon: "text-x-generic"},
+}
+
+// detectAttachmentType sniffs the type of an attachment from the first
+// sniffLen bytes of its contents.
+func detectAttachmentType(contents []byte) attachmentType {
+	if len(contents) > sniffLen {
+		contents = contents[:sniffLen]
+	}
+	mimeType := http.DetectContentType(contents)
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+
+	t, ok := knownAttachmentTypes[mimeType]
+	if !ok {
+		switch {
+		case strings.HasPrefix(mimeType, "image/"):
+			t = attachmentType{label: "Image", icon: "image-x-generic"}
+		case strings.HasPrefix(mimeType, "audio/"):
+			t = attachmentType{label: "Audio", icon: "audio-x-generic"}
+		case strings.HasPrefix(mimeType, "video/"):
+			t = attachmentType{label: "Video", icon: "video-x-generic"}
+		case strings.HasPrefix(mimeType, "text/"):
+			t = attachmentType{label: "Text", icon: "text-x-generic"}
+		default:
+			t = attachmentType{label: "Binary data", icon: "unknown"}
+		}
+	}
+	t.mimeType = mimeType
+	return t
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"code.google.com/p/goprotobuf/proto"
+	pond "github.com/agl/pond/protos"
+)
+
+// A detachment that we upload is stored on our home server under a random id
+// and anyone with its URL can download it. Only the key keeps its contents
+// private, and the key travels with the URL, so if a message leaks then so
+// does the file. Revoking a detachment deletes the file from the server,
+// which invalidates every reference to it. Replacing a detachment re-encrypts
+// the file under a new key, uploads it under a new id and then revokes the
+// old one. Since a message can't be changed once it has been sent, the new
+// detachment is put in a new draft to the same contact.
+
+// msgReplacementBody is the initial body of the draft that carries a
+// replacement detachment.
+const msgReplacementBody = "This replaces the copy of %s that I sent earlier, which can no longer be downloaded."
+
+// detachmentReference is a detachment, in an outbox message, that refers to
+// a file that we uploaded.
+type detachmentReference struct {
+	// index is the position of the detachment in the message's
+	// DetachedFiles.
+	index int
+	// server is the server that holds the file.
+	server string
+	// id is the id of the file on server.
+	id uint64
+	// revoked is true if the file has been deleted.
+	revoked bool
+}
+
+// detachmentReferences returns the detachments in msg that refer to files
+// that we uploaded, and which can therefore be revoked.
+func (c *client) detachmentReferences(msg *queuedMessage) []detachmentReference {
+	if msg.message == nil {
+		return nil
+	}
+
+	var refs []detachmentReference
+	for i, detachment := range msg.message.DetachedFiles {
+		if len(detachment.GetUrl()) == 0 {
+			continue
+		}
+		server, from, id, err := parseDetachmentURL(detachment.GetUrl())
+		if err != nil || !bytes.Equal(from[:], c.identityPublic[:]) {
+			continue
+		}
+		ref := detachmentReference{index: i, server: server, id: id}
+		for _, revoked := range msg.revokedDetachments {
+			if revoked == id {
+				ref.revoked = true
+				break
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// markDetachmentRevoked records, in every outbox message that refers to it,
+// that the file with the given id has been deleted.
+func (c *client) markDetachmentRevoked(id uint64) {
+	for _, msg := range c.outbox {
+		for _, ref := range c.detachmentReferences(msg) {
+			if ref.id == id && !ref.revoked {
+				msg.revokedDetachments = append(msg.revokedDetachments, id)
+				break
+			}
+		}
+	}
+}
+
+// deleteDetachment asks server to delete the file, uploaded by us, with the
+// given id. A file that's already gone, for example because it expired, isn't
+// an error.
+func (c *client) deleteDetachment(server string, id uint64) error {
+	conn, err := c.dialServer(server, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := &pond.Request{
+		DeleteFile: &pond.DeleteFile{
+			Id: proto.Uint64(id),
+		},
+	}
+	if err := conn.WriteProto(request); err != nil {
+		return errors.New("failed to write request: " + err.Error())
+	}
+	reply := new(pond.Reply)
+	if err := conn.ReadProto(reply); err != nil {
+		return errors.New("failed to read reply: " + err.Error())
+	}
+	if reply.GetStatus() == pond.Reply_NO_SUCH_FILE {
+		c.log.Printf("Detachment %x was already missing from %s", id, server)
+		return nil
+	}
+	return replyToError(reply)
+}
+
+// startRevocation revokes the file that ref refers to in the background.
+// detachment is the detachment at ref.index. If newID is not zero then the
+// file is first replaced: it's re-encrypted under a new key and uploaded with
+// that id. The result is reported on backgroundChan with DetachmentComplete,
+// which carries the replacement detachment, if any, or DetachmentError.
+func (c *client) startRevocation(taskID uint64, ref detachmentReference, detachment *pond.Message_Detachment, newID uint64) (cancel func()) {
+	killChan := make(chan bool, 1)
+	go func() {
+		var replacement *pond.Message_Detachment
+		var err error
+		if newID != 0 {
+			replacement, err = c.replaceDetachment(taskID, detachment, newID, killChan)
+		}
+		if err == nil {
+			if err = c.deleteDetachment(ref.server, ref.id); err != nil && replacement != nil {
+				// The old file can still be downloaded so the
+				// replacement isn't needed.
+				c.deleteDetachment(c.homeServer(), newID)
+				replacement = nil
+			}
+		}
+		if err == nil {
+			c.log.Printf("Revoked detachment %x on %s", ref.id, ref.server)
+			c.backgroundChan <- DetachmentComplete{taskID, replacement}
+		} else {
+			c.backgroundChan <- DetachmentError{taskID, err}
+		}
+	}()
+	return func() {
+		killChan <- true
+	}
+}
+
+// replaceDetachment downloads the file that detachment refers to,
+// re-encrypts it under a new key and uploads it to our server with the given
+// id. It returns the detachment for the new file.
+func (c *client) replaceDetachment(taskID uint64, detachment *pond.Message_Detachment, newID uint64, killChan chan bool) (*pond.Message_Detachment, error) {
+	download, err := ioutil.TempFile("" /* default tmp dir */, "pond-download-")
+	if err != nil {
+		return nil, errors.New("failed to create temp file: " + err.Error())
+	}
+	os.Remove(download.Name())
+	defer download.Close()
+
+	if err := c.downloadDetachment(c.backgroundChan, download, taskID, detachment.GetUrl(), killChan); err != nil {
+		return nil, err
+	}
+	if _, err := download.Seek(0, 0 /* from start */); err != nil {
+		return nil, err
+	}
+
+	upload, err := ioutil.TempFile("" /* default tmp dir */, "pond-upload-")
+	if err != nil {
+		return nil, errors.New("failed to create temp file: " + err.Error())
+	}
+	os.Remove(upload.Name())
+	defer upload.Close()
+
+	replacement, err := reencryptDetachment(c.rand, c.backgroundChan, upload, taskID, download, detachment, killChan)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.uploadDetachment(c.backgroundChan, upload, newID, killChan); err != nil {
+		return nil, err
+	}
+	replacement.Url = proto.String(c.buildDetachmentURL(newID))
+	c.log.Printf("Finished upload of %s", *replacement.Url)
+	return replacement, nil
+}
+
+// reencryptDetachment reads the encrypted file for detachment from in and
+// writes it to out, encrypted under a new, random key. The plaintext is never
+// written to disk and, since the chunking and padding are unchanged, the new
+// file is the same size as the old one. It returns the detachment for the new
+// file, without a URL.
+func reencryptDetachment(rand io.Reader, c chan interface{}, out io.Writer, id uint64, in io.Reader, detachment *pond.Message_Detachment, killChan chan bool) (*pond.Message_Detachment, error) {
+	var oldKey, newKey [32]byte
+	var nonce [24]byte
+
+	blockSize := detachment.GetChunkSize() + secretbox.Overhead
+	if blockSize > 1<<20 {
+		return nil, errors.New("chunk size too large")
+	}
+	copy(oldKey[:], detachment.Key)
+	if _, err := io.ReadFull(rand, newKey[:]); err != nil {
+		panic(err)
+	}
+
+	var bytesIn uint64
+	buf := make([]byte, blockSize)
+	var decrypted, boxBuf []byte
+	var lastUpdate time.Time
+
+	for bytesIn < detachment.GetPaddedSize() {
+		if _, err := io.ReadFull(in, buf); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				return nil, errors.New("input truncated")
+			}
+			return nil, errors.New("failed to read from source: " + err.Error())
+		}
+		bytesIn += uint64(len(buf))
+
+		var ok bool
+		if decrypted, ok = secretbox.Open(decrypted[:0], buf, &nonce, &oldKey); !ok {
+			return nil, errors.New("input corrupt")
+		}
+		boxBuf = secretbox.Seal(boxBuf[:0], decrypted, &nonce, &newKey)
+		if _, err := out.Write(boxBuf); err != nil {
+			return nil, errors.New("failed to write to destination: " + err.Error())
+		}
+
+		incNonce(&nonce)
+
+		now := time.Now()
+		if lastUpdate.IsZero() || now.Sub(lastUpdate) > 500*time.Millisecond {
+			lastUpdate = now
+			select {
+			case c <- DetachmentProgress{
+				id:     id,
+				done:   bytesIn,
+				total:  detachment.GetPaddedSize(),
+				status: "re-encrypting",
+			}:
+				break
+			default:
+			}
+		}
+
+		select {
+		case <-killChan:
+			return nil, backgroundCanceledError
+		default:
+			break
+		}
+	}
+
+	if bytesIn != detachment.GetPaddedSize() {
+		return nil, errors.New("input has the wrong length")
+	}
+
+	return &pond.Message_Detachment{
+		Filename:   proto.String(detachment.GetFilename()),
+		Size:       proto.Uint64(detachment.GetSize()),
+		PaddedSize: proto.Uint64(detachment.GetPaddedSize()),
+		ChunkSize:  proto.Uint32(detachment.GetChunkSize()),
+		Key:        newKey[:],
+	}, nil
+}
+
+// finishRevocation records that the file that ref, in msg, refers to has
+// been revoked. If the detachment was replaced then it returns a new draft to
+// the same contact that carries replacement.
+func (c *client) finishRevocation(msg *queuedMessage, ref detachmentReference, replacement *pond.Message_Detachment) *Draft {
+	c.markDetachmentRevoked(ref.id)
+
+	var draft *Draft
+	if replacement != nil {
+		draft = &Draft{
+			id:          c.randId(),
+			created:     c.Now(),
+			to:          msg.to,
+			body:        fmt.Sprintf(msgReplacementBody, replacement.GetFilename()),
+			detachments: []*pond.Message_Detachment{replacement},
+		}
+		c.drafts[draft.id] = draft
+	}
+	c.save()
+	return draft
+}
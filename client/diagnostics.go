@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+
+	"github.com/agl/pond/client/disk"
+)
+
+// loadDiagnostics returns a report about a fatal error that occurred while
+// loading, suitable for pasting into a bug report. It contains the error, the
+// location and format of the state file and the platform, but nothing from
+// the contents of the state file and no keys.
+func (c *client) loadDiagnostics(errText string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Error: %s\n", errText)
+	fmt.Fprintf(&buf, "State file: %s\n", c.stateFilename)
+	fmt.Fprintf(&buf, "State file format: %s\n", disk.DescribeFormat(c.stateFilename))
+	fmt.Fprintf(&buf, "Protocol version: %d\n", protoVersion)
+	fmt.Fprintf(&buf, "Platform: %s/%s, %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version())
+	return buf.String()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.crypto/curve25519"
@@ -15,6 +17,54 @@ import (
 // storage value before rotating.
 const erasureRotationTime = 24 * time.Hour
 
+// stateWriteDelay is the longest that a saved state is held back in order to
+// combine it with any saves that follow it.
+const stateWriteDelay = 250 * time.Millisecond
+
+// stateVersion is the version of the State protobuf written by this code. It
+// must be incremented, and a migration added to stateMigrations, whenever the
+// meaning of existing fields changes or new fields need to be populated from
+// older state.
+const stateVersion = 1
+
+// stateMigrations contains, at index i, a function that upgrades a State of
+// version i to version i+1 in place. State files written before versioning
+// was introduced are version zero.
+var stateMigrations = []func(*disk.State) error{
+	// Version zero to one: versioning was introduced. The layout is
+	// otherwise unchanged.
+	func(*disk.State) error { return nil },
+}
+
+// newerStateError results from loading a state file that was written by a
+// newer version of Pond. Unlike corruption, it's not something that the user
+// should recover from by setting the state file aside.
+type newerStateError struct {
+	version uint32
+}
+
+func (e *newerStateError) Error() string {
+	return fmt.Sprintf("The state file was written by a newer version of Pond (state version %d, but only versions up to %d are supported). Please upgrade Pond in order to use it.", e.version, stateVersion)
+}
+
+// migrateState upgrades state to the current version. It returns true if any
+// migrations were performed, in which case the state should be rewritten.
+func migrateState(state *disk.State) (migrated bool, err error) {
+	version := state.GetVersion()
+	if version > stateVersion {
+		return false, &newerStateError{version}
+	}
+
+	for ; version < stateVersion; version++ {
+		if err := stateMigrations[version](state); err != nil {
+			return false, fmt.Errorf("client: failed to upgrade state from version %d: %s", version, err)
+		}
+		migrated = true
+	}
+	state.Version = proto.Uint32(stateVersion)
+	return migrated, nil
+}
+
 func (c *client) loadState(stateFile *disk.StateFile, pw string) error {
 	parsedState, err := stateFile.Read(pw)
 	if err != nil {
@@ -23,6 +73,11 @@ func (c *client) loadState(stateFile *disk.StateFile, pw string) error {
 	return c.unmarshal(parsedState)
 }
 
+// save serialises the state and passes it to the disk goroutine. It doesn't
+// wait for the state to be written, so the state may be lost if the process
+// dies soon after. Callers that need the state to be on disk before they
+// continue, for example because a key exchange is about to be shown to the
+// user, must call flush afterwards.
 func (c *client) save() {
 	c.log.Printf("Saving state")
 	now := c.Now()
@@ -32,11 +87,160 @@ func (c *client) save() {
 		c.lastErasureStorageTime = now
 	}
 	serialized := c.marshal()
-	c.writerChan <- disk.NewState{serialized, rotateErasureStorage, false /* don't destruct */}
+	atomic.AddUint32(&c.statesSaved, 1)
+	c.writerChan <- disk.NewState{State: serialized, RotateErasureStorage: rotateErasureStorage}
+}
+
+// flush blocks until every state that has been saved has been written to
+// disk.
+func (c *client) flush() {
+	if c.flushChan == nil {
+		return
+	}
+	reply := make(chan chan struct{})
+	c.flushChan <- reply
+	<-<-reply
+}
+
+// flushRequest is sent by flush to ask coalesceStates to write any pending
+// state immediately. The reply is a channel that is closed once the last
+// state has been written.
+type flushRequest chan chan struct{}
+
+// coalesceStates passes states from in to out, which is read by the disk
+// goroutine. Flows often save several times in quick succession and each
+// write involves encrypting and syncing the whole state so, rather than being
+// passed on immediately, a state is held for stateWriteDelay and replaced by
+// any that arrive in the meantime. Only the latest state is ever written so
+// ordering is preserved. Reading from in never waits for the disk, so saving
+// doesn't block the main goroutine, except that a request from flushes causes
+// any pending state to be written straight away. Any pending state is written
+// when in is closed and then out is closed in turn.
+func (c *client) coalesceStates(in <-chan disk.NewState, flushes <-chan flushRequest, out chan<- disk.NewState) {
+	var pending *disk.NewState
+	var timer <-chan time.Time
+	// ready is true once pending has been held for long enough.
+	var ready bool
+	// lastWritten is closed by the disk goroutine once the state that was
+	// most recently passed to it has been written.
+	lastWritten := make(chan struct{})
+	close(lastWritten)
+
+	write := func(state disk.NewState) {
+		atomic.AddUint32(&c.statesWritten, 1)
+		out <- state
+		lastWritten = state.Written
+		pending, timer, ready = nil, nil, false
+	}
+
+	for {
+		// Sending on a nil channel never proceeds so out is only
+		// offered a state that's ready to be written.
+		var readyOut chan<- disk.NewState
+		var next disk.NewState
+		if ready {
+			readyOut = out
+			next = *pending
+		}
+
+		select {
+		case state, ok := <-in:
+			if !ok {
+				if pending != nil {
+					write(*pending)
+				}
+				close(out)
+				return
+			}
+			if state.Destruct {
+				// Any pending state is moot and the disk
+				// goroutine exits after destructing.
+				write(state)
+				return
+			}
+			if pending != nil && pending.RotateErasureStorage {
+				// The rotation mustn't be lost just because
+				// the state that requested it was superseded.
+				state.RotateErasureStorage = true
+			}
+			state.Written = make(chan struct{})
+			pending = &state
+			if timer == nil && !ready {
+				timer = time.After(stateWriteDelay)
+			}
+		case <-timer:
+			timer = nil
+			ready = true
+		case readyOut <- next:
+			atomic.AddUint32(&c.statesWritten, 1)
+			lastWritten = next.Written
+			pending, ready = nil, false
+		case reply := <-flushes:
+			if pending != nil {
+				write(*pending)
+			}
+			reply <- lastWritten
+		}
+	}
+}
+
+// wipeKeys sets the private keys held in memory to zero so that they don't
+// linger after shutdown. It must only be called once the disk goroutine has
+// finished serialising the final state.
+func (c *client) wipeKeys() {
+	wipe := func(b []byte) {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+
+	wipe(c.priv[:])
+	wipe(c.identity[:])
+	if c.groupPriv != nil {
+		c.groupPriv.Wipe()
+	}
+	for _, prevGroupPriv := range c.prevGroupPrivs {
+		prevGroupPriv.priv.Wipe()
+	}
+
+	if c.published != nil {
+		c.published.wipe()
+	}
+
+	for _, contact := range c.contacts {
+		wipe(contact.lastDHPrivate[:])
+		wipe(contact.currentDHPrivate[:])
+		for i := range contact.retiredDHPrivates {
+			wipe(contact.retiredDHPrivates[i][:])
+		}
+		wipe(contact.pandaKeyExchange)
+		if contact.ratchet != nil {
+			contact.ratchet.Wipe()
+		}
+		if contact.groupKey != nil {
+			contact.groupKey.Wipe()
+		}
+		if contact.myGroupKey != nil {
+			contact.myGroupKey.Wipe()
+		}
+	}
 }
 
 func (c *client) unmarshal(state *disk.State) error {
+	migrated, err := migrateState(state)
+	if err != nil {
+		return err
+	}
+	c.stateMigrated = migrated
+
 	c.server = *state.Server
+	for _, server := range state.GetFallbackServers() {
+		if _, _, err := parseServer(server, c.dev); err != nil {
+			c.log.Errorf("Ignoring invalid fallback server, %q: %s", server, err)
+			continue
+		}
+		c.fallbackServers = append(c.fallbackServers, server)
+	}
 
 	if len(state.Identity) != len(c.identity) {
 		return errors.New("client: identity is wrong length in State")
@@ -66,6 +270,37 @@ func (c *client) unmarshal(state *disk.State) error {
 	if state.LastErasureStorageTime != nil {
 		c.lastErasureStorageTime = time.Unix(*state.LastErasureStorageTime, 0)
 	}
+	c.disableReplyQuoting = state.GetDisableReplyQuoting()
+	c.disableBodyCompression = state.GetDisableBodyCompression()
+	c.spellCheck = state.GetSpellCheck()
+	c.noQuitPrompt = state.GetNoQuitPrompt()
+	c.idleLockTimeout = time.Duration(state.GetIdleLockMinutes()) * time.Minute
+	c.ackOverdue = time.Duration(state.GetAckOverdueHours()) * time.Hour
+	c.handshakeExpiry = time.Duration(state.GetHandshakeExpiryDays()) * 24 * time.Hour
+	c.setTransactionSchedule(time.Duration(state.GetTransactionInterval())*time.Second, state.GetCoverTraffic())
+	c.selectedList = int(state.GetSelectedList())
+	c.selectedId = state.GetSelectedId()
+	c.panedPosition = int(state.GetPanedPosition())
+	c.bodyFont = state.GetBodyFont()
+	c.monoFont = state.GetMonoFont()
+	c.fontScale = int(state.GetFontScalePercent())
+	c.themeName = state.GetTheme()
+	c.shapedIndicators = state.GetShapedIndicators()
+	c.sentLifetime = time.Duration(state.GetSentLifetimeDays()) * 24 * time.Hour
+	c.keepSent = state.GetKeepSent()
+	c.messageDetails = state.GetMessageDetails()
+	c.formatBodies = state.GetFormatBodies()
+	c.maskKeys = state.GetMaskKeys()
+	c.defaultRecipient = state.GetDefaultRecipient()
+	c.defaultRecipientRecent = state.GetDefaultRecipientRecent()
+	if mode := operatingMode(state.GetOperatingMode()); mode <= modeSendOnly {
+		c.setOperatingMode(mode)
+	}
+	c.browserCommand = state.GetBrowserCommand()
+	if hotkey, err := parseHotkey(state.GetWipeHotkey()); err == nil {
+		c.wipeHotkey = hotkey
+	}
+	c.setProxyAddress(state.GetProxyAddress())
 
 	for _, prevGroupPriv := range state.PreviousGroupPrivateKeys {
 		group, ok := new(bbssig.Group).Unmarshal(prevGroupPriv.Group)
@@ -82,6 +317,19 @@ func (c *client) unmarshal(state *disk.State) error {
 		})
 	}
 
+	if published := state.PublishedKeyExchange; published != nil {
+		groupKey, ok := new(bbssig.MemberKey).Unmarshal(c.groupPriv.Group, published.GroupKey)
+		if !ok {
+			return errors.New("client: failed to unmarshal published group member key")
+		}
+		c.published = &publishedKeyExchange{
+			groupKey: groupKey,
+			ratchet:  published.Ratchet,
+			kxsBytes: published.KeyExchangeBytes,
+			created:  time.Unix(published.GetCreated(), 0),
+		}
+	}
+
 	for _, cont := range state.Contacts {
 		contact := &Contact{
 			id:               *cont.Id,
@@ -98,6 +346,35 @@ func (c *client) unmarshal(state *disk.State) error {
 		}
 		copy(contact.lastDHPrivate[:], cont.LastPrivate)
 		copy(contact.currentDHPrivate[:], cont.CurrentPrivate)
+		for _, retired := range cont.RetiredPrivate {
+			var private [32]byte
+			if len(retired) != len(private) {
+				return errors.New("client: retired DH value has the wrong length")
+			}
+			copy(private[:], retired)
+			contact.retiredDHPrivates = append(contact.retiredDHPrivates, private)
+		}
+		contact.dhRotationPending = cont.GetDhRotationPending()
+		contact.signatureRejectedIds = cont.GetSignatureRejectedIds()
+		if t := cont.GetFirstSignatureRejection(); t != 0 {
+			contact.firstSignatureRejection = time.Unix(t, 0)
+		}
+		if t := cont.GetTheirDhAdvanced(); t != 0 {
+			contact.theirDHAdvanced = time.Unix(t, 0)
+		}
+		if t := cont.GetOurDhAdvanced(); t != 0 {
+			contact.ourDHAdvanced = time.Unix(t, 0)
+		}
+		if t := cont.GetLastActivity(); t != 0 {
+			contact.lastActivity = time.Unix(t, 0)
+		}
+		contact.color = cont.GetColor()
+		contact.tags = cont.GetTags()
+		contact.blocked = cont.GetBlocked()
+		contact.muted = cont.GetMuted()
+		contact.verified = cont.GetVerified()
+		contact.noUnverifiedWarning = cont.GetNoUnverifiedWarning()
+		contact.viaPublished = cont.GetViaPublishedKeyExchange()
 
 		if cont.Ratchet != nil {
 			contact.ratchet = c.newRatchet(contact)
@@ -108,6 +385,13 @@ func (c *client) unmarshal(state *disk.State) error {
 
 		if cont.IsPending != nil && *cont.IsPending {
 			contact.isPending = true
+			if t := cont.GetKeyExchangeCreated(); t != 0 {
+				contact.kxCreated = time.Unix(t, 0)
+			} else if len(contact.kxsBytes) > 0 {
+				// Handshakes from before creation times were
+				// recorded are considered to be created now.
+				contact.kxCreated = c.Now()
+			}
 			continue
 		}
 
@@ -119,10 +403,20 @@ func (c *client) unmarshal(state *disk.State) error {
 			return errors.New("client: failed to unmarshal my group key")
 		}
 
-		if cont.TheirServer == nil {
-			return errors.New("client: contact missing server")
+		// A contact with a damaged server is loaded, rather than
+		// failing the whole load, so that the user can correct it.
+		contact.theirServer = cont.GetTheirServer()
+		if _, _, err := parseServer(contact.theirServer, c.dev); err != nil {
+			contact.invalidServer = err
+			c.log.Errorf("Contact %s has an invalid server, %q: %s", contact.name, contact.theirServer, err)
+		}
+		for _, server := range cont.GetTheirFallbackServers() {
+			if _, _, err := parseServer(server, c.dev); err != nil {
+				c.log.Errorf("Ignoring invalid fallback server, %q, of contact %s: %s", server, contact.name, err)
+				continue
+			}
+			contact.theirFallbackServers = append(contact.theirFallbackServers, server)
 		}
-		contact.theirServer = *cont.TheirServer
 
 		if len(cont.TheirPub) != len(contact.theirPub) {
 			return errors.New("client: contact missing public key")
@@ -184,14 +478,16 @@ func (c *client) unmarshal(state *disk.State) error {
 		}
 
 		c.inbox = append(c.inbox, msg)
+		c.threadInbox(msg)
 	}
 
 	for _, m := range state.Outbox {
 		msg := &queuedMessage{
-			id:      *m.Id,
-			to:      *m.To,
-			server:  *m.Server,
-			created: time.Unix(*m.Created, 0),
+			id:       *m.Id,
+			to:       *m.To,
+			server:   *m.Server,
+			created:  time.Unix(*m.Created, 0),
+			enqueued: time.Unix(*m.Created, 0),
 		}
 		c.registerId(msg.id)
 		if len(m.Message) > 0 {
@@ -200,6 +496,9 @@ func (c *client) unmarshal(state *disk.State) error {
 				return errors.New("client: corrupt message in outbox: " + err.Error())
 			}
 		}
+		if m.Enqueued != nil {
+			msg.enqueued = time.Unix(*m.Enqueued, 0)
+		}
 		if m.Sent != nil {
 			msg.sent = time.Unix(*m.Sent, 0)
 		}
@@ -213,17 +512,36 @@ func (c *client) unmarshal(state *disk.State) error {
 			}
 		}
 		msg.revocation = m.GetRevocation()
+		msg.retained = m.GetRetained()
+		msg.revokedDetachments = m.GetRevokedDetachments()
+		if c.outboxExpired(msg, time.Now()) {
+			// The retention period may have been shortened
+			// since the state was last saved.
+			continue
+		}
 		if msg.revocation && len(msg.server) == 0 {
 			// There was a bug in some versions where revoking a
 			// pending contact would result in a revocation message
 			// with an empty server.
 			msg.server = c.server
 		}
+		if to, ok := c.contacts[msg.to]; ok && !msg.revocation {
+			msg.servers = to.servers()
+		}
 
 		c.outbox = append(c.outbox, msg)
-
-		if msg.sent.IsZero() && (msg.to == 0 || !c.contacts[msg.to].revokedUs) {
-			// This message hasn't been sent yet.
+		c.threadOutbox(msg)
+
+		if c.isUnsent(msg) {
+			// This message hasn't been sent yet. Unless it's a
+			// revocation, its request is only created once it
+			// reaches the front of the queue. Messages to
+			// contacts that are waiting for a new key exchange,
+			// because our home server changed, are held until
+			// it completes.
+			if to, ok := c.contacts[msg.to]; ok && to.isPending && !msg.revocation {
+				msg.held = true
+			}
 			c.enqueue(msg)
 		}
 	}
@@ -272,6 +590,7 @@ func (c *client) marshal() []byte {
 			cont.MyGroupKey = contact.myGroupKey.Marshal()
 			cont.TheirGroup = contact.myGroupKey.Group.Marshal()
 			cont.TheirServer = proto.String(contact.theirServer)
+			cont.TheirFallbackServers = contact.theirFallbackServers
 			cont.TheirPub = contact.theirPub[:]
 			cont.Generation = proto.Uint32(contact.generation)
 
@@ -282,6 +601,47 @@ func (c *client) marshal() []byte {
 		if contact.ratchet != nil {
 			cont.Ratchet = contact.ratchet.Marshal(time.Now(), messageLifetime)
 		}
+		for i := range contact.retiredDHPrivates {
+			cont.RetiredPrivate = append(cont.RetiredPrivate, contact.retiredDHPrivates[i][:])
+		}
+		if contact.dhRotationPending {
+			cont.DhRotationPending = proto.Bool(true)
+		}
+		cont.SignatureRejectedIds = contact.signatureRejectedIds
+		if !contact.firstSignatureRejection.IsZero() {
+			cont.FirstSignatureRejection = proto.Int64(contact.firstSignatureRejection.Unix())
+		}
+		if !contact.theirDHAdvanced.IsZero() {
+			cont.TheirDhAdvanced = proto.Int64(contact.theirDHAdvanced.Unix())
+		}
+		if !contact.ourDHAdvanced.IsZero() {
+			cont.OurDhAdvanced = proto.Int64(contact.ourDHAdvanced.Unix())
+		}
+		if !contact.lastActivity.IsZero() {
+			cont.LastActivity = proto.Int64(contact.lastActivity.Unix())
+		}
+		if len(contact.color) > 0 {
+			cont.Color = proto.String(contact.color)
+		}
+		cont.Tags = contact.tags
+		if contact.blocked {
+			cont.Blocked = proto.Bool(true)
+		}
+		if contact.muted {
+			cont.Muted = proto.Bool(true)
+		}
+		if contact.verified {
+			cont.Verified = proto.Bool(true)
+		}
+		if contact.noUnverifiedWarning {
+			cont.NoUnverifiedWarning = proto.Bool(true)
+		}
+		if contact.viaPublished {
+			cont.ViaPublishedKeyExchange = proto.Bool(true)
+		}
+		if contact.isPending && !contact.kxCreated.IsZero() {
+			cont.KeyExchangeCreated = proto.Int64(contact.kxCreated.Unix())
+		}
 		for _, prevTag := range contact.previousTags {
 			if time.Since(prevTag.expired) > previousTagLifetime {
 				continue
@@ -328,7 +688,7 @@ func (c *client) marshal() []byte {
 
 	var outbox []*disk.Outbox
 	for _, msg := range c.outbox {
-		if time.Since(msg.created) > messageLifetime {
+		if c.outboxExpired(msg, time.Now()) {
 			continue
 		}
 		m := &disk.Outbox{
@@ -336,8 +696,13 @@ func (c *client) marshal() []byte {
 			To:         proto.Uint64(msg.to),
 			Server:     proto.String(msg.server),
 			Created:    proto.Int64(msg.created.Unix()),
+			Enqueued:   proto.Int64(msg.enqueued.Unix()),
 			Revocation: proto.Bool(msg.revocation),
 		}
+		if msg.retained {
+			m.Retained = proto.Bool(true)
+		}
+		m.RevokedDetachments = msg.revokedDetachments
 		if msg.message != nil {
 			if m.Message, err = proto.Marshal(msg.message); err != nil {
 				panic(err)
@@ -378,10 +743,12 @@ func (c *client) marshal() []byte {
 	}
 
 	state := &disk.State{
+		Version:                proto.Uint32(stateVersion),
 		Private:                c.priv[:],
 		Public:                 c.pub[:],
 		Identity:               c.identity[:],
 		Server:                 proto.String(c.server),
+		FallbackServers:        c.fallbackServers,
 		Group:                  c.groupPriv.Group.Marshal(),
 		GroupPrivate:           c.groupPriv.Marshal(),
 		Generation:             proto.Uint32(c.generation),
@@ -391,6 +758,96 @@ func (c *client) marshal() []byte {
 		Drafts:                 drafts,
 		LastErasureStorageTime: proto.Int64(c.lastErasureStorageTime.Unix()),
 	}
+	if c.disableReplyQuoting {
+		state.DisableReplyQuoting = proto.Bool(true)
+	}
+	if c.disableBodyCompression {
+		state.DisableBodyCompression = proto.Bool(true)
+	}
+	if c.spellCheck {
+		state.SpellCheck = proto.Bool(true)
+	}
+	if c.noQuitPrompt {
+		state.NoQuitPrompt = proto.Bool(true)
+	}
+	if c.idleLockTimeout > 0 {
+		state.IdleLockMinutes = proto.Uint32(uint32(c.idleLockTimeout / time.Minute))
+	}
+	if c.ackOverdue > 0 {
+		state.AckOverdueHours = proto.Uint32(uint32(c.ackOverdue / time.Hour))
+	}
+	if c.transactionInterval > 0 {
+		state.TransactionInterval = proto.Uint32(uint32(c.transactionInterval / time.Second))
+	}
+	if c.coverTraffic {
+		state.CoverTraffic = proto.Bool(true)
+	}
+	if c.handshakeExpiry > 0 {
+		state.HandshakeExpiryDays = proto.Uint32(uint32(c.handshakeExpiry / (24 * time.Hour)))
+	}
+	if c.published != nil {
+		state.PublishedKeyExchange = &disk.State_PublishedKeyExchange{
+			GroupKey:         c.published.groupKey.Marshal(),
+			Ratchet:          c.published.ratchet,
+			KeyExchangeBytes: c.published.kxsBytes,
+			Created:          proto.Int64(c.published.created.Unix()),
+		}
+	}
+	if c.selectedList != selectionNone {
+		state.SelectedList = proto.Int32(int32(c.selectedList))
+		state.SelectedId = proto.Uint64(c.selectedId)
+	}
+	if c.panedPosition > 0 {
+		state.PanedPosition = proto.Int32(int32(c.panedPosition))
+	}
+	if len(c.bodyFont) > 0 {
+		state.BodyFont = proto.String(c.bodyFont)
+	}
+	if len(c.monoFont) > 0 {
+		state.MonoFont = proto.String(c.monoFont)
+	}
+	if c.fontScale > 0 {
+		state.FontScalePercent = proto.Uint32(uint32(c.fontScale))
+	}
+	if len(c.themeName) > 0 {
+		state.Theme = proto.String(c.themeName)
+	}
+	if c.shapedIndicators {
+		state.ShapedIndicators = proto.Bool(true)
+	}
+	if c.sentLifetime > 0 {
+		state.SentLifetimeDays = proto.Uint32(uint32(c.sentLifetime / (24 * time.Hour)))
+	}
+	if c.keepSent {
+		state.KeepSent = proto.Bool(true)
+	}
+	if c.messageDetails {
+		state.MessageDetails = proto.Bool(true)
+	}
+	if c.formatBodies {
+		state.FormatBodies = proto.Bool(true)
+	}
+	if len(c.browserCommand) > 0 {
+		state.BrowserCommand = proto.String(c.browserCommand)
+	}
+	if c.wipeHotkey != nil {
+		state.WipeHotkey = proto.String(c.wipeHotkey.String())
+	}
+	if c.maskKeys {
+		state.MaskKeys = proto.Bool(true)
+	}
+	if c.defaultRecipient != 0 {
+		state.DefaultRecipient = proto.Uint64(c.defaultRecipient)
+	}
+	if c.defaultRecipientRecent {
+		state.DefaultRecipientRecent = proto.Bool(true)
+	}
+	if c.mode != modeNormal {
+		state.OperatingMode = proto.Int32(int32(c.mode))
+	}
+	if len(c.proxyAddress) > 0 {
+		state.ProxyAddress = proto.String(c.proxyAddress)
+	}
 	for _, prevGroupPriv := range c.prevGroupPrivs {
 		if time.Since(prevGroupPriv.expired) > previousTagLifetime {
 			continue
@@ -0,0 +1,99 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+)
+
+// archiveMagic starts every message archive and distinguishes it from state
+// files and backups.
+var archiveMagic = [8]byte{0x9d, 0x27, 0xe1, 0x4a, 0x66, 0xb0, 0x13, 0xc8}
+
+// archiveVersion is the version of the archive format written by this code.
+const archiveVersion = 1
+
+// archiveHeaderLen is the length of the header that precedes the sealed
+// contents of an archive: the magic, version, salt, key check and nonce.
+const archiveHeaderLen = len(archiveMagic) + 4 + kdfSaltLen + 16 + 24
+
+// NotArchiveError is returned when opening a file that isn't a message
+// archive.
+var NotArchiveError = errors.New("file is not a Pond message archive")
+
+// UnsupportedArchiveError is returned when opening a message archive that was
+// written by a newer version of Pond.
+var UnsupportedArchiveError = errors.New("message archive is from a newer version of Pond")
+
+// SealArchive encrypts contents with a key derived from the passphrase pw and
+// returns the resulting archive. Nothing but the contents themselves, and the
+// values needed to decrypt them, is included.
+func SealArchive(rand io.Reader, pw string, contents []byte) ([]byte, error) {
+	if len(pw) == 0 {
+		return nil, errors.New("a passphrase is required to export a message")
+	}
+
+	var salt [kdfSaltLen]byte
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand, salt[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	var key [kdfKeyLen]byte
+	if err := deriveKey(&key, pw, salt[:], nil); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, archiveHeaderLen+len(contents)+secretbox.Overhead)
+	out = append(out, archiveMagic[:]...)
+	var version [4]byte
+	binary.LittleEndian.PutUint32(version[:], archiveVersion)
+	out = append(out, version[:]...)
+	out = append(out, salt[:]...)
+	out = append(out, keyCheck(&key)...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, contents, &nonce, &key), nil
+}
+
+// OpenArchive decrypts an archive produced by SealArchive. It returns
+// BadPasswordError if pw isn't the passphrase that the archive was sealed
+// with.
+func OpenArchive(pw string, archive []byte) ([]byte, error) {
+	if len(archive) < len(archiveMagic)+4 || !bytes.Equal(archive[:len(archiveMagic)], archiveMagic[:]) {
+		return nil, NotArchiveError
+	}
+	if version := binary.LittleEndian.Uint32(archive[len(archiveMagic):]); version > archiveVersion {
+		return nil, UnsupportedArchiveError
+	}
+	if len(archive) < archiveHeaderLen+secretbox.Overhead {
+		return nil, errors.New("message archive is truncated")
+	}
+
+	b := archive[len(archiveMagic)+4:]
+	salt, b := b[:kdfSaltLen], b[kdfSaltLen:]
+	check, b := b[:16], b[16:]
+	var nonce [24]byte
+	copy(nonce[:], b)
+	b = b[len(nonce):]
+
+	var key [kdfKeyLen]byte
+	if err := deriveKey(&key, pw, salt, nil); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(check, keyCheck(&key)) != 1 {
+		return nil, BadPasswordError
+	}
+
+	contents, ok := secretbox.Open(nil, b, &nonce, &key)
+	if !ok {
+		return nil, errors.New("message archive is corrupt")
+	}
+	return contents, nil
+}
@@ -0,0 +1,110 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// backupMagic starts every backup file and distinguishes it from a state file.
+var backupMagic = [8]byte{0x3b, 0x91, 0x0c, 0x5e, 0x72, 0xd8, 0x4f, 0xa6}
+
+// backupVersion is the version of the backup format written by this code. It
+// must be incremented whenever the format of the contained state file changes
+// in a way that older code cannot read.
+const backupVersion = 1
+
+// ErasureStorageBackupError results from trying to back up a state file whose
+// key is masked by erasure storage. Such a backup would become unreadable as
+// soon as the erasure storage value is rotated.
+var ErasureStorageBackupError = errors.New("state files that use erasure storage (i.e. a TPM) cannot be backed up. Use entombing to move them instead")
+
+// WriteBackup writes a backup of the state file at statePath to w. The state
+// file is copied as-is and thus remains encrypted.
+func WriteBackup(w io.Writer, statePath string) error {
+	contents, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return err
+	}
+
+	if len(contents) < len(headerMagic)+4 {
+		return errors.New("state file is too small to be valid")
+	}
+
+	if bytes.Equal(contents[:len(headerMagic)], headerMagic[:]) {
+		headerLen := binary.LittleEndian.Uint32(contents[len(headerMagic):])
+		headerBytes := contents[len(headerMagic)+4:]
+		if headerLen > 1<<16 || len(headerBytes) < int(headerLen) {
+			return errors.New("state file corrupt")
+		}
+		var header Header
+		if err := proto.Unmarshal(headerBytes[:int(headerLen)], &header); err != nil {
+			return err
+		}
+		if !header.GetNoErasureStorage() {
+			return ErasureStorageBackupError
+		}
+	}
+
+	if _, err := w.Write(backupMagic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(backupVersion)); err != nil {
+		return err
+	}
+	_, err = w.Write(contents)
+	return err
+}
+
+// ReadBackup checks the header of a backup and returns the contained state
+// file. Backups from a newer version of Pond are rejected.
+func ReadBackup(b []byte) ([]byte, error) {
+	if len(b) < len(backupMagic)+4 || !bytes.Equal(b[:len(backupMagic)], backupMagic[:]) {
+		return nil, errors.New("file is not a Pond backup")
+	}
+	b = b[len(backupMagic):]
+	version := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if version > backupVersion {
+		return nil, fmt.Errorf("backup is from a newer version of Pond (format %d, but only %d is supported)", version, backupVersion)
+	}
+	if len(b) == 0 {
+		return nil, errors.New("backup is empty")
+	}
+	return b, nil
+}
+
+// Restore replaces the contents of the state file with the given, still
+// encrypted, state file from a backup. The header, key and any erasure
+// storage of sf are discarded so that the restored file must be read, and
+// thus the passphrase entered, afresh. The state file must already exist.
+func (sf *StateFile) Restore(contents []byte) error {
+	if sf.Erasure != nil {
+		if err := sf.Erasure.Destroy(&sf.key); err != nil {
+			sf.Log("disk: error while deleting NVRAM: %s", err)
+		}
+		sf.Erasure = nil
+	}
+	sf.header = Header{}
+	sf.wipeKey()
+
+	out, err := os.OpenFile(sf.Path, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(contents); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
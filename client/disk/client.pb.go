@@ -20,6 +20,7 @@ type Header struct {
 	Scrypt           *Header_SCrypt `protobuf:"bytes,3,opt,name=scrypt" json:"scrypt,omitempty"`
 	TpmNvram         *Header_TPM    `protobuf:"bytes,4,opt,name=tpm_nvram" json:"tpm_nvram,omitempty"`
 	NoErasureStorage *bool          `protobuf:"varint,5,opt,name=no_erasure_storage" json:"no_erasure_storage,omitempty"`
+	KeyCheck         []byte         `protobuf:"bytes,6,opt,name=key_check" json:"key_check,omitempty"`
 	XXX_unrecognized []byte         `json:"-"`
 }
 
@@ -64,6 +65,13 @@ func (this *Header) GetNoErasureStorage() bool {
 	return false
 }
 
+func (this *Header) GetKeyCheck() []byte {
+	if this != nil {
+		return this.KeyCheck
+	}
+	return nil
+}
+
 type Header_SCrypt struct {
 	N                *int32 `protobuf:"varint,2,opt,def=32768" json:"N,omitempty"`
 	R                *int32 `protobuf:"varint,3,opt,name=r,def=16" json:"r,omitempty"`
@@ -117,29 +125,45 @@ func (this *Header_TPM) GetIndex() uint32 {
 }
 
 type Contact struct {
-	Id                  *uint64                `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
-	Name                *string                `protobuf:"bytes,2,req,name=name" json:"name,omitempty"`
-	GroupKey            []byte                 `protobuf:"bytes,3,req,name=group_key" json:"group_key,omitempty"`
-	SupportedVersion    *int32                 `protobuf:"varint,16,opt,name=supported_version" json:"supported_version,omitempty"`
-	KeyExchangeBytes    []byte                 `protobuf:"bytes,4,opt,name=key_exchange_bytes" json:"key_exchange_bytes,omitempty"`
-	PandaKeyExchange    []byte                 `protobuf:"bytes,18,opt,name=panda_key_exchange" json:"panda_key_exchange,omitempty"`
-	PandaError          *string                `protobuf:"bytes,19,opt,name=panda_error" json:"panda_error,omitempty"`
-	TheirGroup          []byte                 `protobuf:"bytes,5,opt,name=their_group" json:"their_group,omitempty"`
-	MyGroupKey          []byte                 `protobuf:"bytes,6,opt,name=my_group_key" json:"my_group_key,omitempty"`
-	Generation          *uint32                `protobuf:"varint,7,opt,name=generation" json:"generation,omitempty"`
-	TheirServer         *string                `protobuf:"bytes,8,opt,name=their_server" json:"their_server,omitempty"`
-	TheirPub            []byte                 `protobuf:"bytes,9,opt,name=their_pub" json:"their_pub,omitempty"`
-	TheirIdentityPublic []byte                 `protobuf:"bytes,10,opt,name=their_identity_public" json:"their_identity_public,omitempty"`
-	RevokedUs           *bool                  `protobuf:"varint,21,opt,name=revoked_us" json:"revoked_us,omitempty"`
-	LastPrivate         []byte                 `protobuf:"bytes,11,opt,name=last_private" json:"last_private,omitempty"`
-	CurrentPrivate      []byte                 `protobuf:"bytes,12,opt,name=current_private" json:"current_private,omitempty"`
-	TheirLastPublic     []byte                 `protobuf:"bytes,13,opt,name=their_last_public" json:"their_last_public,omitempty"`
-	TheirCurrentPublic  []byte                 `protobuf:"bytes,14,opt,name=their_current_public" json:"their_current_public,omitempty"`
-	Ratchet             *RatchetState          `protobuf:"bytes,20,opt,name=ratchet" json:"ratchet,omitempty"`
-	PreviousTags        []*Contact_PreviousTag `protobuf:"bytes,17,rep,name=previous_tags" json:"previous_tags,omitempty"`
-	Events              []*Contact_Event       `protobuf:"bytes,22,rep,name=events" json:"events,omitempty"`
-	IsPending           *bool                  `protobuf:"varint,15,opt,name=is_pending,def=0" json:"is_pending,omitempty"`
-	XXX_unrecognized    []byte                 `json:"-"`
+	Id                      *uint64                `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	Name                    *string                `protobuf:"bytes,2,req,name=name" json:"name,omitempty"`
+	GroupKey                []byte                 `protobuf:"bytes,3,req,name=group_key" json:"group_key,omitempty"`
+	SupportedVersion        *int32                 `protobuf:"varint,16,opt,name=supported_version" json:"supported_version,omitempty"`
+	KeyExchangeBytes        []byte                 `protobuf:"bytes,4,opt,name=key_exchange_bytes" json:"key_exchange_bytes,omitempty"`
+	PandaKeyExchange        []byte                 `protobuf:"bytes,18,opt,name=panda_key_exchange" json:"panda_key_exchange,omitempty"`
+	PandaError              *string                `protobuf:"bytes,19,opt,name=panda_error" json:"panda_error,omitempty"`
+	TheirGroup              []byte                 `protobuf:"bytes,5,opt,name=their_group" json:"their_group,omitempty"`
+	MyGroupKey              []byte                 `protobuf:"bytes,6,opt,name=my_group_key" json:"my_group_key,omitempty"`
+	Generation              *uint32                `protobuf:"varint,7,opt,name=generation" json:"generation,omitempty"`
+	TheirServer             *string                `protobuf:"bytes,8,opt,name=their_server" json:"their_server,omitempty"`
+	TheirPub                []byte                 `protobuf:"bytes,9,opt,name=their_pub" json:"their_pub,omitempty"`
+	TheirIdentityPublic     []byte                 `protobuf:"bytes,10,opt,name=their_identity_public" json:"their_identity_public,omitempty"`
+	RevokedUs               *bool                  `protobuf:"varint,21,opt,name=revoked_us" json:"revoked_us,omitempty"`
+	LastPrivate             []byte                 `protobuf:"bytes,11,opt,name=last_private" json:"last_private,omitempty"`
+	CurrentPrivate          []byte                 `protobuf:"bytes,12,opt,name=current_private" json:"current_private,omitempty"`
+	TheirLastPublic         []byte                 `protobuf:"bytes,13,opt,name=their_last_public" json:"their_last_public,omitempty"`
+	TheirCurrentPublic      []byte                 `protobuf:"bytes,14,opt,name=their_current_public" json:"their_current_public,omitempty"`
+	Ratchet                 *RatchetState          `protobuf:"bytes,20,opt,name=ratchet" json:"ratchet,omitempty"`
+	TheirDhAdvanced         *int64                 `protobuf:"varint,23,opt,name=their_dh_advanced" json:"their_dh_advanced,omitempty"`
+	OurDhAdvanced           *int64                 `protobuf:"varint,24,opt,name=our_dh_advanced" json:"our_dh_advanced,omitempty"`
+	LastActivity            *int64                 `protobuf:"varint,25,opt,name=last_activity" json:"last_activity,omitempty"`
+	Color                   *string                `protobuf:"bytes,26,opt,name=color" json:"color,omitempty"`
+	Blocked                 *bool                  `protobuf:"varint,27,opt,name=blocked" json:"blocked,omitempty"`
+	TheirFallbackServers    []string               `protobuf:"bytes,28,rep,name=their_fallback_servers" json:"their_fallback_servers,omitempty"`
+	KeyExchangeCreated      *int64                 `protobuf:"varint,29,opt,name=key_exchange_created" json:"key_exchange_created,omitempty"`
+	ViaPublishedKeyExchange *bool                  `protobuf:"varint,30,opt,name=via_published_key_exchange" json:"via_published_key_exchange,omitempty"`
+	Tags                    []string               `protobuf:"bytes,31,rep,name=tags" json:"tags,omitempty"`
+	Muted                   *bool                  `protobuf:"varint,32,opt,name=muted" json:"muted,omitempty"`
+	Verified                *bool                  `protobuf:"varint,33,opt,name=verified" json:"verified,omitempty"`
+	NoUnverifiedWarning     *bool                  `protobuf:"varint,34,opt,name=no_unverified_warning" json:"no_unverified_warning,omitempty"`
+	RetiredPrivate          [][]byte               `protobuf:"bytes,35,rep,name=retired_private" json:"retired_private,omitempty"`
+	DhRotationPending       *bool                  `protobuf:"varint,36,opt,name=dh_rotation_pending" json:"dh_rotation_pending,omitempty"`
+	SignatureRejectedIds    []uint64               `protobuf:"fixed64,37,rep,name=signature_rejected_ids" json:"signature_rejected_ids,omitempty"`
+	FirstSignatureRejection *int64                 `protobuf:"varint,38,opt,name=first_signature_rejection" json:"first_signature_rejection,omitempty"`
+	PreviousTags            []*Contact_PreviousTag `protobuf:"bytes,17,rep,name=previous_tags" json:"previous_tags,omitempty"`
+	Events                  []*Contact_Event       `protobuf:"bytes,22,rep,name=events" json:"events,omitempty"`
+	IsPending               *bool                  `protobuf:"varint,15,opt,name=is_pending,def=0" json:"is_pending,omitempty"`
+	XXX_unrecognized        []byte                 `json:"-"`
 }
 
 func (this *Contact) Reset()         { *this = Contact{} }
@@ -281,6 +305,118 @@ func (this *Contact) GetRatchet() *RatchetState {
 	return nil
 }
 
+func (this *Contact) GetTheirDhAdvanced() int64 {
+	if this != nil && this.TheirDhAdvanced != nil {
+		return *this.TheirDhAdvanced
+	}
+	return 0
+}
+
+func (this *Contact) GetOurDhAdvanced() int64 {
+	if this != nil && this.OurDhAdvanced != nil {
+		return *this.OurDhAdvanced
+	}
+	return 0
+}
+
+func (this *Contact) GetLastActivity() int64 {
+	if this != nil && this.LastActivity != nil {
+		return *this.LastActivity
+	}
+	return 0
+}
+
+func (this *Contact) GetColor() string {
+	if this != nil && this.Color != nil {
+		return *this.Color
+	}
+	return ""
+}
+
+func (this *Contact) GetBlocked() bool {
+	if this != nil && this.Blocked != nil {
+		return *this.Blocked
+	}
+	return false
+}
+
+func (this *Contact) GetTheirFallbackServers() []string {
+	if this != nil {
+		return this.TheirFallbackServers
+	}
+	return nil
+}
+
+func (this *Contact) GetKeyExchangeCreated() int64 {
+	if this != nil && this.KeyExchangeCreated != nil {
+		return *this.KeyExchangeCreated
+	}
+	return 0
+}
+
+func (this *Contact) GetViaPublishedKeyExchange() bool {
+	if this != nil && this.ViaPublishedKeyExchange != nil {
+		return *this.ViaPublishedKeyExchange
+	}
+	return false
+}
+
+func (this *Contact) GetTags() []string {
+	if this != nil {
+		return this.Tags
+	}
+	return nil
+}
+
+func (this *Contact) GetMuted() bool {
+	if this != nil && this.Muted != nil {
+		return *this.Muted
+	}
+	return false
+}
+
+func (this *Contact) GetVerified() bool {
+	if this != nil && this.Verified != nil {
+		return *this.Verified
+	}
+	return false
+}
+
+func (this *Contact) GetNoUnverifiedWarning() bool {
+	if this != nil && this.NoUnverifiedWarning != nil {
+		return *this.NoUnverifiedWarning
+	}
+	return false
+}
+
+func (this *Contact) GetRetiredPrivate() [][]byte {
+	if this != nil {
+		return this.RetiredPrivate
+	}
+	return nil
+}
+
+func (this *Contact) GetDhRotationPending() bool {
+	if this != nil && this.DhRotationPending != nil {
+		return *this.DhRotationPending
+	}
+	return false
+}
+
+func (this *Contact) GetSignatureRejectedIds() []uint64 {
+	if this != nil {
+		return this.SignatureRejectedIds
+	}
+	return nil
+}
+
+func (this *Contact) GetFirstSignatureRejection() int64 {
+	if this != nil && this.FirstSignatureRejection != nil {
+		return *this.FirstSignatureRejection
+	}
+	return 0
+}
+
 func (this *Contact) GetPreviousTags() []*Contact_PreviousTag {
 	if this != nil {
 		return this.PreviousTags
@@ -625,16 +761,19 @@ func (this *Inbox) GetRetained() bool {
 }
 
 type Outbox struct {
-	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
-	To               *uint64 `protobuf:"fixed64,2,req,name=to" json:"to,omitempty"`
-	Server           *string `protobuf:"bytes,3,req,name=server" json:"server,omitempty"`
-	Created          *int64  `protobuf:"varint,4,req,name=created" json:"created,omitempty"`
-	Sent             *int64  `protobuf:"varint,5,opt,name=sent" json:"sent,omitempty"`
-	Message          []byte  `protobuf:"bytes,6,opt,name=message" json:"message,omitempty"`
-	Request          []byte  `protobuf:"bytes,7,opt,name=request" json:"request,omitempty"`
-	Acked            *int64  `protobuf:"varint,8,opt,name=acked" json:"acked,omitempty"`
-	Revocation       *bool   `protobuf:"varint,9,opt,name=revocation" json:"revocation,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Id                 *uint64  `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	To                 *uint64  `protobuf:"fixed64,2,req,name=to" json:"to,omitempty"`
+	Server             *string  `protobuf:"bytes,3,req,name=server" json:"server,omitempty"`
+	Created            *int64   `protobuf:"varint,4,req,name=created" json:"created,omitempty"`
+	Sent               *int64   `protobuf:"varint,5,opt,name=sent" json:"sent,omitempty"`
+	Message            []byte   `protobuf:"bytes,6,opt,name=message" json:"message,omitempty"`
+	Request            []byte   `protobuf:"bytes,7,opt,name=request" json:"request,omitempty"`
+	Acked              *int64   `protobuf:"varint,8,opt,name=acked" json:"acked,omitempty"`
+	Revocation         *bool    `protobuf:"varint,9,opt,name=revocation" json:"revocation,omitempty"`
+	Retained           *bool    `protobuf:"varint,10,opt,name=retained" json:"retained,omitempty"`
+	Enqueued           *int64   `protobuf:"varint,11,opt,name=enqueued" json:"enqueued,omitempty"`
+	RevokedDetachments []uint64 `protobuf:"fixed64,12,rep,name=revoked_detachments" json:"revoked_detachments,omitempty"`
+	XXX_unrecognized   []byte   `json:"-"`
 }
 
 func (this *Outbox) Reset()         { *this = Outbox{} }
@@ -704,6 +843,27 @@ func (this *Outbox) GetRevocation() bool {
 	return false
 }
 
+func (this *Outbox) GetRetained() bool {
+	if this != nil && this.Retained != nil {
+		return *this.Retained
+	}
+	return false
+}
+
+func (this *Outbox) GetEnqueued() int64 {
+	if this != nil && this.Enqueued != nil {
+		return *this.Enqueued
+	}
+	return 0
+}
+
+func (this *Outbox) GetRevokedDetachments() []uint64 {
+	if this != nil {
+		return this.RevokedDetachments
+	}
+	return nil
+}
+
 type Draft struct {
 	Id               *uint64                      `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
 	Created          *int64                       `protobuf:"varint,2,req,name=created" json:"created,omitempty"`
@@ -769,26 +929,64 @@ func (this *Draft) GetDetachments() []*protos.Message_Detachment {
 }
 
 type State struct {
-	Identity                 []byte                 `protobuf:"bytes,1,req,name=identity" json:"identity,omitempty"`
-	Public                   []byte                 `protobuf:"bytes,2,req,name=public" json:"public,omitempty"`
-	Private                  []byte                 `protobuf:"bytes,3,req,name=private" json:"private,omitempty"`
-	Server                   *string                `protobuf:"bytes,4,req,name=server" json:"server,omitempty"`
-	Group                    []byte                 `protobuf:"bytes,5,req,name=group" json:"group,omitempty"`
-	GroupPrivate             []byte                 `protobuf:"bytes,6,req,name=group_private" json:"group_private,omitempty"`
-	PreviousGroupPrivateKeys []*State_PreviousGroup `protobuf:"bytes,12,rep,name=previous_group_private_keys" json:"previous_group_private_keys,omitempty"`
-	Generation               *uint32                `protobuf:"varint,7,req,name=generation" json:"generation,omitempty"`
-	LastErasureStorageTime   *int64                 `protobuf:"varint,13,opt,name=last_erasure_storage_time" json:"last_erasure_storage_time,omitempty"`
-	Contacts                 []*Contact             `protobuf:"bytes,8,rep,name=contacts" json:"contacts,omitempty"`
-	Inbox                    []*Inbox               `protobuf:"bytes,9,rep,name=inbox" json:"inbox,omitempty"`
-	Outbox                   []*Outbox              `protobuf:"bytes,10,rep,name=outbox" json:"outbox,omitempty"`
-	Drafts                   []*Draft               `protobuf:"bytes,11,rep,name=drafts" json:"drafts,omitempty"`
-	XXX_unrecognized         []byte                 `json:"-"`
+	Version                  *uint32                     `protobuf:"varint,16,opt,name=version" json:"version,omitempty"`
+	Identity                 []byte                      `protobuf:"bytes,1,req,name=identity" json:"identity,omitempty"`
+	Public                   []byte                      `protobuf:"bytes,2,req,name=public" json:"public,omitempty"`
+	Private                  []byte                      `protobuf:"bytes,3,req,name=private" json:"private,omitempty"`
+	Server                   *string                     `protobuf:"bytes,4,req,name=server" json:"server,omitempty"`
+	Group                    []byte                      `protobuf:"bytes,5,req,name=group" json:"group,omitempty"`
+	GroupPrivate             []byte                      `protobuf:"bytes,6,req,name=group_private" json:"group_private,omitempty"`
+	PreviousGroupPrivateKeys []*State_PreviousGroup      `protobuf:"bytes,12,rep,name=previous_group_private_keys" json:"previous_group_private_keys,omitempty"`
+	Generation               *uint32                     `protobuf:"varint,7,req,name=generation" json:"generation,omitempty"`
+	LastErasureStorageTime   *int64                      `protobuf:"varint,13,opt,name=last_erasure_storage_time" json:"last_erasure_storage_time,omitempty"`
+	DisableReplyQuoting      *bool                       `protobuf:"varint,14,opt,name=disable_reply_quoting" json:"disable_reply_quoting,omitempty"`
+	ProxyAddress             *string                     `protobuf:"bytes,15,opt,name=proxy_address" json:"proxy_address,omitempty"`
+	DisableBodyCompression   *bool                       `protobuf:"varint,17,opt,name=disable_body_compression" json:"disable_body_compression,omitempty"`
+	IdleLockMinutes          *uint32                     `protobuf:"varint,18,opt,name=idle_lock_minutes" json:"idle_lock_minutes,omitempty"`
+	AckOverdueHours          *uint32                     `protobuf:"varint,19,opt,name=ack_overdue_hours" json:"ack_overdue_hours,omitempty"`
+	SelectedList             *int32                      `protobuf:"varint,20,opt,name=selected_list" json:"selected_list,omitempty"`
+	SelectedId               *uint64                     `protobuf:"fixed64,21,opt,name=selected_id" json:"selected_id,omitempty"`
+	PanedPosition            *int32                      `protobuf:"varint,22,opt,name=paned_position" json:"paned_position,omitempty"`
+	BodyFont                 *string                     `protobuf:"bytes,23,opt,name=body_font" json:"body_font,omitempty"`
+	MonoFont                 *string                     `protobuf:"bytes,24,opt,name=mono_font" json:"mono_font,omitempty"`
+	FontScalePercent         *uint32                     `protobuf:"varint,25,opt,name=font_scale_percent" json:"font_scale_percent,omitempty"`
+	Theme                    *string                     `protobuf:"bytes,26,opt,name=theme" json:"theme,omitempty"`
+	SpellCheck               *bool                       `protobuf:"varint,27,opt,name=spell_check" json:"spell_check,omitempty"`
+	NoQuitPrompt             *bool                       `protobuf:"varint,28,opt,name=no_quit_prompt" json:"no_quit_prompt,omitempty"`
+	TransactionInterval      *uint32                     `protobuf:"varint,29,opt,name=transaction_interval" json:"transaction_interval,omitempty"`
+	CoverTraffic             *bool                       `protobuf:"varint,30,opt,name=cover_traffic" json:"cover_traffic,omitempty"`
+	HandshakeExpiryDays      *uint32                     `protobuf:"varint,31,opt,name=handshake_expiry_days" json:"handshake_expiry_days,omitempty"`
+	PublishedKeyExchange     *State_PublishedKeyExchange `protobuf:"bytes,32,opt,name=published_key_exchange" json:"published_key_exchange,omitempty"`
+	ShapedIndicators         *bool                       `protobuf:"varint,33,opt,name=shaped_indicators" json:"shaped_indicators,omitempty"`
+	SentLifetimeDays         *uint32                     `protobuf:"varint,34,opt,name=sent_lifetime_days" json:"sent_lifetime_days,omitempty"`
+	KeepSent                 *bool                       `protobuf:"varint,35,opt,name=keep_sent" json:"keep_sent,omitempty"`
+	MessageDetails           *bool                       `protobuf:"varint,36,opt,name=message_details" json:"message_details,omitempty"`
+	FormatBodies             *bool                       `protobuf:"varint,37,opt,name=format_bodies" json:"format_bodies,omitempty"`
+	BrowserCommand           *string                     `protobuf:"bytes,38,opt,name=browser_command" json:"browser_command,omitempty"`
+	WipeHotkey               *string                     `protobuf:"bytes,39,opt,name=wipe_hotkey" json:"wipe_hotkey,omitempty"`
+	MaskKeys                 *bool                       `protobuf:"varint,40,opt,name=mask_keys" json:"mask_keys,omitempty"`
+	DefaultRecipient         *uint64                     `protobuf:"fixed64,41,opt,name=default_recipient" json:"default_recipient,omitempty"`
+	DefaultRecipientRecent   *bool                       `protobuf:"varint,42,opt,name=default_recipient_recent" json:"default_recipient_recent,omitempty"`
+	OperatingMode            *int32                      `protobuf:"varint,43,opt,name=operating_mode" json:"operating_mode,omitempty"`
+	FallbackServers          []string                    `protobuf:"bytes,44,rep,name=fallback_servers" json:"fallback_servers,omitempty"`
+	Contacts                 []*Contact                  `protobuf:"bytes,8,rep,name=contacts" json:"contacts,omitempty"`
+	Inbox                    []*Inbox                    `protobuf:"bytes,9,rep,name=inbox" json:"inbox,omitempty"`
+	Outbox                   []*Outbox                   `protobuf:"bytes,10,rep,name=outbox" json:"outbox,omitempty"`
+	Drafts                   []*Draft                    `protobuf:"bytes,11,rep,name=drafts" json:"drafts,omitempty"`
+	XXX_unrecognized         []byte                      `json:"-"`
 }
 
 func (this *State) Reset()         { *this = State{} }
 func (this *State) String() string { return proto.CompactTextString(this) }
 func (*State) ProtoMessage()       {}
 
+func (this *State) GetVersion() uint32 {
+	if this != nil && this.Version != nil {
+		return *this.Version
+	}
+	return 0
+}
+
 func (this *State) GetIdentity() []byte {
 	if this != nil {
 		return this.Identity
@@ -852,6 +1050,216 @@ func (this *State) GetLastErasureStorageTime() int64 {
 	return 0
 }
 
+func (this *State) GetDisableReplyQuoting() bool {
+	if this != nil && this.DisableReplyQuoting != nil {
+		return *this.DisableReplyQuoting
+	}
+	return false
+}
+
+func (this *State) GetProxyAddress() string {
+	if this != nil && this.ProxyAddress != nil {
+		return *this.ProxyAddress
+	}
+	return ""
+}
+
+func (this *State) GetDisableBodyCompression() bool {
+	if this != nil && this.DisableBodyCompression != nil {
+		return *this.DisableBodyCompression
+	}
+	return false
+}
+
+func (this *State) GetIdleLockMinutes() uint32 {
+	if this != nil && this.IdleLockMinutes != nil {
+		return *this.IdleLockMinutes
+	}
+	return 0
+}
+
+func (this *State) GetAckOverdueHours() uint32 {
+	if this != nil && this.AckOverdueHours != nil {
+		return *this.AckOverdueHours
+	}
+	return 0
+}
+
+func (this *State) GetSelectedList() int32 {
+	if this != nil && this.SelectedList != nil {
+		return *this.SelectedList
+	}
+	return 0
+}
+
+func (this *State) GetSelectedId() uint64 {
+	if this != nil && this.SelectedId != nil {
+		return *this.SelectedId
+	}
+	return 0
+}
+
+func (this *State) GetPanedPosition() int32 {
+	if this != nil && this.PanedPosition != nil {
+		return *this.PanedPosition
+	}
+	return 0
+}
+
+func (this *State) GetBodyFont() string {
+	if this != nil && this.BodyFont != nil {
+		return *this.BodyFont
+	}
+	return ""
+}
+
+func (this *State) GetMonoFont() string {
+	if this != nil && this.MonoFont != nil {
+		return *this.MonoFont
+	}
+	return ""
+}
+
+func (this *State) GetFontScalePercent() uint32 {
+	if this != nil && this.FontScalePercent != nil {
+		return *this.FontScalePercent
+	}
+	return 0
+}
+
+func (this *State) GetTheme() string {
+	if this != nil && this.Theme != nil {
+		return *this.Theme
+	}
+	return ""
+}
+
+func (this *State) GetSpellCheck() bool {
+	if this != nil && this.SpellCheck != nil {
+		return *this.SpellCheck
+	}
+	return false
+}
+
+func (this *State) GetNoQuitPrompt() bool {
+	if this != nil && this.NoQuitPrompt != nil {
+		return *this.NoQuitPrompt
+	}
+	return false
+}
+
+func (this *State) GetTransactionInterval() uint32 {
+	if this != nil && this.TransactionInterval != nil {
+		return *this.TransactionInterval
+	}
+	return 0
+}
+
+func (this *State) GetCoverTraffic() bool {
+	if this != nil && this.CoverTraffic != nil {
+		return *this.CoverTraffic
+	}
+	return false
+}
+
+func (this *State) GetHandshakeExpiryDays() uint32 {
+	if this != nil && this.HandshakeExpiryDays != nil {
+		return *this.HandshakeExpiryDays
+	}
+	return 0
+}
+
+func (this *State) GetPublishedKeyExchange() *State_PublishedKeyExchange {
+	if this != nil {
+		return this.PublishedKeyExchange
+	}
+	return nil
+}
+
+func (this *State) GetShapedIndicators() bool {
+	if this != nil && this.ShapedIndicators != nil {
+		return *this.ShapedIndicators
+	}
+	return false
+}
+
+func (this *State) GetSentLifetimeDays() uint32 {
+	if this != nil && this.SentLifetimeDays != nil {
+		return *this.SentLifetimeDays
+	}
+	return 0
+}
+
+func (this *State) GetKeepSent() bool {
+	if this != nil && this.KeepSent != nil {
+		return *this.KeepSent
+	}
+	return false
+}
+
+func (this *State) GetMessageDetails() bool {
+	if this != nil && this.MessageDetails != nil {
+		return *this.MessageDetails
+	}
+	return false
+}
+
+func (this *State) GetFormatBodies() bool {
+	if this != nil && this.FormatBodies != nil {
+		return *this.FormatBodies
+	}
+	return false
+}
+
+func (this *State) GetBrowserCommand() string {
+	if this != nil && this.BrowserCommand != nil {
+		return *this.BrowserCommand
+	}
+	return ""
+}
+
+func (this *State) GetWipeHotkey() string {
+	if this != nil && this.WipeHotkey != nil {
+		return *this.WipeHotkey
+	}
+	return ""
+}
+
+func (this *State) GetMaskKeys() bool {
+	if this != nil && this.MaskKeys != nil {
+		return *this.MaskKeys
+	}
+	return false
+}
+
+func (this *State) GetDefaultRecipient() uint64 {
+	if this != nil && this.DefaultRecipient != nil {
+		return *this.DefaultRecipient
+	}
+	return 0
+}
+
+func (this *State) GetDefaultRecipientRecent() bool {
+	if this != nil && this.DefaultRecipientRecent != nil {
+		return *this.DefaultRecipientRecent
+	}
+	return false
+}
+
+func (this *State) GetOperatingMode() int32 {
+	if this != nil && this.OperatingMode != nil {
+		return *this.OperatingMode
+	}
+	return 0
+}
+
+func (this *State) GetFallbackServers() []string {
+	if this != nil {
+		return this.FallbackServers
+	}
+	return nil
+}
+
 func (this *State) GetContacts() []*Contact {
 	if this != nil {
 		return this.Contacts
@@ -880,6 +1288,46 @@ func (this *State) GetDrafts() []*Draft {
 	return nil
 }
 
+type State_PublishedKeyExchange struct {
+	GroupKey         []byte        `protobuf:"bytes,1,req,name=group_key" json:"group_key,omitempty"`
+	Ratchet          *RatchetState `protobuf:"bytes,2,req,name=ratchet" json:"ratchet,omitempty"`
+	KeyExchangeBytes []byte        `protobuf:"bytes,3,req,name=key_exchange_bytes" json:"key_exchange_bytes,omitempty"`
+	Created          *int64        `protobuf:"varint,4,opt,name=created" json:"created,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (this *State_PublishedKeyExchange) Reset()         { *this = State_PublishedKeyExchange{} }
+func (this *State_PublishedKeyExchange) String() string { return proto.CompactTextString(this) }
+func (*State_PublishedKeyExchange) ProtoMessage()       {}
+
+func (this *State_PublishedKeyExchange) GetGroupKey() []byte {
+	if this != nil {
+		return this.GroupKey
+	}
+	return nil
+}
+
+func (this *State_PublishedKeyExchange) GetRatchet() *RatchetState {
+	if this != nil {
+		return this.Ratchet
+	}
+	return nil
+}
+
+func (this *State_PublishedKeyExchange) GetKeyExchangeBytes() []byte {
+	if this != nil {
+		return this.KeyExchangeBytes
+	}
+	return nil
+}
+
+func (this *State_PublishedKeyExchange) GetCreated() int64 {
+	if this != nil && this.Created != nil {
+		return *this.Created
+	}
+	return 0
+}
+
 type State_PreviousGroup struct {
 	Group            []byte `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
 	GroupPrivate     []byte `protobuf:"bytes,2,req,name=group_private" json:"group_private,omitempty"`
@@ -2,13 +2,17 @@ package disk
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"sync"
 	"syscall"
+	"time"
 
 	"code.google.com/p/go.crypto/nacl/secretbox"
 	"code.google.com/p/go.crypto/scrypt"
@@ -52,6 +56,10 @@ type StateFile struct {
 	// with the key. This is done because an ErasureStorage is believed to
 	// be able to erase old mask values.
 	Erasure ErasureStorage
+	// KDFTime, if non-zero, is roughly how long deriving the key from a
+	// passphrase should take on this machine. When a passphrase is set,
+	// the scrypt cost is increased from the default until it's reached.
+	KDFTime time.Duration
 
 	header Header
 	key    [kdfKeyLen]byte
@@ -63,6 +71,18 @@ type StateFile struct {
 	lockFdMutex sync.Mutex
 }
 
+// wipeKey sets the key and mask to zero. The state file must be read again
+// before it can be written.
+func (sf *StateFile) wipeKey() {
+	for i := range sf.key {
+		sf.key[i] = 0
+	}
+	for i := range sf.mask {
+		sf.mask[i] = 0
+	}
+	sf.valid = false
+}
+
 func NewStateFile(rand io.Reader, path string) *StateFile {
 	return &StateFile{
 		Rand: rand,
@@ -105,12 +125,110 @@ func (sf *StateFile) deriveKey(pw string) error {
 	if len(pw) == 0 && sf.header.Scrypt != nil {
 		return BadPasswordError
 	}
-	params := sf.header.Scrypt
-	key, err := scrypt.Key([]byte(pw), sf.header.KdfSalt, int(params.GetN()), int(params.GetR()), int(params.GetP()), kdfKeyLen)
+	return deriveKey(&sf.key, pw, sf.header.KdfSalt, sf.header.Scrypt)
+}
+
+// Forget discards the key that was derived by a successful Read, for when the
+// state that it returned won't be used. The state file must be read again
+// before it can be written.
+func (sf *StateFile) Forget() {
+	sf.wipeKey()
+}
+
+// deriveKey sets key to the scrypt hash of pw with the given salt and
+// parameters.
+func deriveKey(key *[kdfKeyLen]byte, pw string, salt []byte, params *Header_SCrypt) error {
+	derived, err := scrypt.Key([]byte(pw), salt, int(params.GetN()), int(params.GetR()), int(params.GetP()), kdfKeyLen)
 	if err != nil {
 		return err
 	}
-	copy(sf.key[:], key)
+	copy(key[:], derived)
+	return nil
+}
+
+const (
+	// scryptProbeN is the scrypt cost that is timed in order to estimate
+	// the speed of the machine.
+	scryptProbeN = 1 << 10
+	// scryptMaxN limits the cost that chooseSCrypt will select. With the
+	// default r, scrypt needs 128*r*N bytes of memory, so this is 256MB.
+	scryptMaxN = 1 << 17
+)
+
+// checkSCrypt returns an error if params, which were read from a file that
+// may have been tampered with, would make deriving a key unreasonably
+// expensive.
+func checkSCrypt(params *Header_SCrypt) error {
+	n := params.GetN()
+	if n < 2 || n > scryptMaxN || n&(n-1) != 0 {
+		return fmt.Errorf("invalid scrypt cost: %d", n)
+	}
+	if r := params.GetR(); r < 1 || r > Default_Header_SCrypt_R {
+		return fmt.Errorf("invalid scrypt block size: %d", r)
+	}
+	if p := params.GetP(); p < 1 || p > Default_Header_SCrypt_P {
+		return fmt.Errorf("invalid scrypt parallelism: %d", p)
+	}
+	return nil
+}
+
+// chooseSCrypt returns the scrypt parameters for a new passphrase such that
+// deriving a key takes about target on this machine. The cost is never less
+// than the default, and parameters that equal the default are left unset so
+// that the header is the same as before the cost could be changed.
+func chooseSCrypt(target time.Duration) *Header_SCrypt {
+	params := new(Header_SCrypt)
+	if target <= 0 {
+		return params
+	}
+
+	var salt [kdfSaltLen]byte
+	start := time.Now()
+	if _, err := scrypt.Key(nil, salt[:], scryptProbeN, int(params.GetR()), int(params.GetP()), kdfKeyLen); err != nil {
+		return params
+	}
+	probe := time.Since(start)
+
+	n := params.GetN()
+	for n < scryptMaxN && probe*time.Duration(2*n/scryptProbeN) <= target {
+		n *= 2
+	}
+	if n != params.GetN() {
+		params.N = proto.Int32(n)
+	}
+	return params
+}
+
+// keyCheck returns the value stored in the header that confirms that key was
+// derived from the correct passphrase. It's only used without erasure
+// storage: the check is derived from the passphrase alone so, with it, anyone
+// with the state file could test passphrases without the mask, which would
+// defeat erasure storage.
+func keyCheck(key *[kdfKeyLen]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("Pond state file key check\x00"))
+	h.Write(key[:])
+	return h.Sum(nil)[:16]
+}
+
+// SetAside renames the state file to path and releases any lock on it so that
+// a new state file can be created in its place. The header, key and erasure
+// storage of sf are discarded, but the erasure storage isn't destroyed in
+// case the old state file can be recovered.
+func (sf *StateFile) SetAside(path string) error {
+	sf.lockFdMutex.Lock()
+	defer sf.lockFdMutex.Unlock()
+
+	if err := os.Rename(sf.Path, path); err != nil {
+		return err
+	}
+	if sf.lockFd != nil {
+		(&Lock{sf.lockFd}).Close()
+		sf.lockFd = nil
+	}
+	sf.Erasure = nil
+	sf.header = Header{}
+	sf.wipeKey()
 	return nil
 }
 
@@ -122,10 +240,10 @@ func (sf *StateFile) Create(pw string) error {
 
 	if len(pw) > 0 {
 		sf.header.KdfSalt = salt[:]
+		sf.header.Scrypt = chooseSCrypt(sf.KDFTime)
 		if err := sf.deriveKey(pw); err != nil {
 			return err
 		}
-		sf.header.Scrypt = new(Header_SCrypt)
 	}
 
 	if sf.Erasure != nil {
@@ -140,6 +258,7 @@ func (sf *StateFile) Create(pw string) error {
 		}
 	} else {
 		sf.header.NoErasureStorage = proto.Bool(true)
+		sf.header.KeyCheck = keyCheck(&sf.key)
 	}
 
 	sf.valid = true
@@ -177,7 +296,7 @@ func (sf *StateFile) Read(pw string) (*State, error) {
 	headerLen := binary.LittleEndian.Uint32(b)
 	b = b[4:]
 	if headerLen > 1<<16 {
-		return nil, errors.New("state file corrupt")
+		return nil, CorruptStateError
 	}
 	if len(b) < int(headerLen) {
 		return nil, errors.New("state file truncated")
@@ -193,6 +312,17 @@ func (sf *StateFile) Read(pw string) (*State, error) {
 			return nil, err
 		}
 	}
+	check := sf.header.GetKeyCheck()
+	if !sf.header.GetNoErasureStorage() {
+		// A key check shouldn't be present with erasure storage but,
+		// if one is, it's ignored and not written again.
+		check = nil
+		sf.header.KeyCheck = nil
+	}
+	if len(check) > 0 && subtle.ConstantTimeCompare(check, keyCheck(&sf.key)) != 1 {
+		sf.wipeKey()
+		return nil, BadPasswordError
+	}
 
 	if !sf.header.GetNoErasureStorage() {
 		for _, erasureMethod := range erasureRegistry {
@@ -233,15 +363,20 @@ func (sf *StateFile) Read(pw string) (*State, error) {
 	}
 	plaintext, ok := secretbox.Open(nil, b, &nonce, &effectiveKey)
 	if !ok {
+		if len(check) > 0 {
+			// The passphrase is known to be correct so the
+			// ciphertext must have been damaged.
+			return nil, CorruptStateError
+		}
 		return nil, BadPasswordError
 	}
 	if len(plaintext) < 4 {
-		return nil, errors.New("state file corrupt")
+		return nil, CorruptStateError
 	}
 	length := binary.LittleEndian.Uint32(plaintext[:4])
 	plaintext = plaintext[4:]
 	if length > 1<<31 || length > uint32(len(plaintext)) {
-		return nil, errors.New("state file corrupt")
+		return nil, CorruptStateError
 	}
 	plaintext = plaintext[:int(length)]
 
@@ -250,9 +385,54 @@ func (sf *StateFile) Read(pw string) (*State, error) {
 		return nil, err
 	}
 
+	if len(check) == 0 && sf.header.GetNoErasureStorage() {
+		// State files written by older versions lack a key check
+		// so one is added when the file is next written.
+		sf.header.KeyCheck = keyCheck(&sf.key)
+	}
+
 	return &state, nil
 }
 
+// DescribeFormat returns a short description of the format of the state file
+// at path for use in bug reports. Only the unencrypted header is examined and
+// nothing secret, such as the salt or key check, is included.
+func DescribeFormat(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "unreadable: " + err.Error()
+	}
+	if len(b) < len(headerMagic)+4 {
+		return fmt.Sprintf("too small to be valid (%d bytes)", len(b))
+	}
+	if !bytes.Equal(b[:len(headerMagic)], headerMagic[:]) {
+		return fmt.Sprintf("old style without a header (%d bytes)", len(b))
+	}
+
+	b = b[len(headerMagic):]
+	headerLen := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	var header Header
+	if headerLen > 1<<16 || len(b) < int(headerLen) || proto.Unmarshal(b[:int(headerLen)], &header) != nil {
+		return "damaged header"
+	}
+
+	var erasure string
+	switch {
+	case header.TpmNvram != nil:
+		erasure = "TPM"
+	case header.GetNoErasureStorage():
+		erasure = "none"
+	default:
+		erasure = "unknown"
+	}
+	kdf := "none"
+	if params := header.Scrypt; params != nil {
+		kdf = fmt.Sprintf("scrypt N=%d r=%d p=%d", params.GetN(), params.GetR(), params.GetP())
+	}
+	return fmt.Sprintf("headered (%d bytes), erasure storage: %s, kdf: %s, key check: %t", len(b)+len(headerMagic)+4, erasure, kdf, len(header.KeyCheck) > 0)
+}
+
 func (sf *StateFile) readOldStyle(b []byte) (*State, error) {
 	return loadOldState(b, &sf.key)
 }
@@ -261,12 +441,17 @@ type NewState struct {
 	State                []byte
 	RotateErasureStorage bool
 	Destruct             bool
+	// Written, if not nil, is closed once State has been written.
+	Written chan struct{}
 }
 
 func (sf *StateFile) StartWriter(states chan NewState, done chan struct{}) {
 	for {
 		newState, ok := <-states
 		if !ok {
+			// All pending states have been written so the key is
+			// no longer needed.
+			sf.wipeKey()
 			close(done)
 			return
 		}
@@ -289,9 +474,15 @@ func (sf *StateFile) StartWriter(states chan NewState, done chan struct{}) {
 			if out != nil {
 				pos, _ := out.Seek(0, 2)
 				out.Seek(0, 0)
-				sf.Log("disk: writing %d zeros to statefile", pos)
-				zeros := make([]byte, pos)
-				if _, err := out.Write(zeros); err != nil {
+				// Unlike zeros, random bytes leave the blocks
+				// that held the state indistinguishable from
+				// ciphertext.
+				sf.Log("disk: writing %d random bytes to statefile", pos)
+				random := make([]byte, pos)
+				if _, err := io.ReadFull(sf.Rand, random); err != nil {
+					panic(err)
+				}
+				if _, err := out.Write(random); err != nil {
 					sf.Log("disk: error from Write: %s", err)
 				}
 				if err := out.Sync(); err != nil {
@@ -425,6 +616,10 @@ func (sf *StateFile) StartWriter(states chan NewState, done chan struct{}) {
 			syscall.Close(newFd)
 		}
 		sf.lockFdMutex.Unlock()
+
+		if newState.Written != nil {
+			close(newState.Written)
+		}
 	}
 }
 
@@ -443,6 +638,11 @@ func (l *Lock) Close() {
 
 var BadPasswordError = errors.New("bad password")
 
+// CorruptStateError is returned when a state file is damaged. In particular,
+// it's returned instead of BadPasswordError when the state file can't be
+// decrypted even though the passphrase is known to be correct.
+var CorruptStateError = errors.New("state file corrupt")
+
 func loadOldState(b []byte, key *[32]byte) (*State, error) {
 	const (
 		SCryptSaltLen = 32
@@ -466,12 +666,12 @@ func loadOldState(b []byte, key *[32]byte) (*State, error) {
 		return nil, BadPasswordError
 	}
 	if len(plaintext) < 4 {
-		return nil, errors.New("state file corrupt")
+		return nil, CorruptStateError
 	}
 	length := binary.LittleEndian.Uint32(plaintext[:4])
 	plaintext = plaintext[4:]
 	if length > 1<<31 || length > uint32(len(plaintext)) {
-		return nil, errors.New("state file corrupt")
+		return nil, CorruptStateError
 	}
 	plaintext = plaintext[:int(length)]
 
@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// An instance lock prevents two copies of Pond from running with the same
+// state file, which would corrupt it and break the ratchets with every
+// contact. It's a file, next to the state file, that is locked with flock for
+// as long as Pond runs and which records the process that holds it. The
+// record is erased when the lock is released so, if it's found when the lock
+// is free, the previous holder didn't exit cleanly. Usually it crashed, but
+// flock isn't reliable on all network filesystems so the user is asked before
+// taking over.
+
+// InstanceRunningError results from trying to lock a state file that's in use
+// by another running copy of Pond.
+var InstanceRunningError = errors.New("Pond is already running for this profile")
+
+// StaleInstanceLockError results from trying to lock a state file whose
+// previous user didn't release it.
+var StaleInstanceLockError = errors.New("Pond didn't exit cleanly the last time that this profile was used")
+
+// InstanceOwner describes the process that holds, or held, an instance lock.
+type InstanceOwner struct {
+	PID  int
+	Host string
+}
+
+func (o *InstanceOwner) String() string {
+	if o == nil {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("process %d on %s", o.PID, o.Host)
+}
+
+// InstanceLock is a held instance lock.
+type InstanceLock struct {
+	file *os.File
+}
+
+// LockInstance takes the instance lock at path. If the lock is held by
+// another process then it returns InstanceRunningError and, if the lock was
+// never released by its previous holder and takeover is false, it returns
+// StaleInstanceLockError. In both cases the owner is also returned, if known.
+func LockInstance(path string, takeover bool) (*InstanceLock, *InstanceOwner, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	locked := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	owner := parseInstanceOwner(string(contents))
+
+	if !locked {
+		file.Close()
+		return nil, owner, InstanceRunningError
+	}
+	if len(contents) > 0 && !takeover {
+		file.Close()
+		return nil, owner, StaleInstanceLockError
+	}
+
+	host, _ := os.Hostname()
+	record := fmt.Sprintf("%d\n%s\n", os.Getpid(), host)
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.WriteAt([]byte(record), 0); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return &InstanceLock{file}, nil, nil
+}
+
+// parseInstanceOwner returns the owner recorded in the contents of an
+// instance lock, or nil if it can't be parsed.
+func parseInstanceOwner(contents string) *InstanceOwner {
+	lines := strings.Split(contents, "\n")
+	if len(lines) < 2 {
+		return nil
+	}
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return nil
+	}
+	return &InstanceOwner{PID: pid, Host: lines[1]}
+}
+
+// Release erases the record of the holder and unlocks the instance lock. It
+// may be called on a nil InstanceLock.
+func (l *InstanceLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	l.file.Sync()
+	// Closing the file releases the flock.
+	l.file.Close()
+	l.file = nil
+}
@@ -0,0 +1,163 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// A transfer bundle moves a whole account to another computer. Unlike a
+// backup, it contains the serialised State rather than the state file, since
+// the state file's key may be masked by erasure storage that can't be moved.
+// The State is sealed with a key derived, in the same way as a state file's
+// key, from both a passphrase chosen by the user and a random transfer code,
+// so that someone who obtains the bundle also needs the code, which is only
+// ever displayed.
+//
+// The format is the magic value, a little-endian uint32 version, a
+// little-endian uint32 header length, a Header containing the KDF parameters
+// and key check, a 24-byte nonce and finally the sealed State.
+
+// transferMagic starts every transfer bundle.
+var transferMagic = [8]byte{0x5d, 0x0e, 0xa2, 0x77, 0x19, 0xc4, 0x63, 0xf0}
+
+// transferVersion is the version of the transfer bundle format written by
+// this code.
+const transferVersion = 1
+
+// transferCodeLen is the number of random bytes in a transfer code.
+const transferCodeLen = 10
+
+// BadTransferKeyError results from opening a transfer bundle with the wrong
+// passphrase or transfer code.
+var BadTransferKeyError = errors.New("the passphrase or transfer code is incorrect")
+
+// NewTransferCode returns a random transfer code, formatted for the user to
+// copy by hand.
+func NewTransferCode(rand io.Reader) (string, error) {
+	var code [transferCodeLen]byte
+	if _, err := io.ReadFull(rand, code[:]); err != nil {
+		return "", err
+	}
+	encoded := base32.StdEncoding.EncodeToString(code[:])
+	var groups []string
+	for len(encoded) > 0 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// NormalizeTransferCode removes the separators and spaces that the user may
+// have typed as part of a transfer code and corrects its case.
+func NormalizeTransferCode(code string) string {
+	var normalized []rune
+	for _, r := range strings.ToUpper(code) {
+		if (r >= 'A' && r <= 'Z') || (r >= '2' && r <= '7') {
+			normalized = append(normalized, r)
+		}
+	}
+	return string(normalized)
+}
+
+// transferKey derives the key for a transfer bundle.
+func transferKey(key *[kdfKeyLen]byte, passphrase, code string, header *Header) error {
+	return deriveKey(key, passphrase+"\x00"+NormalizeTransferCode(code), header.KdfSalt, header.Scrypt)
+}
+
+// WriteTransfer writes a transfer bundle containing state, a serialised
+// State, to w. Deriving the key takes roughly kdfTime, or the default scrypt
+// cost if that's zero.
+func WriteTransfer(w io.Writer, rand io.Reader, state []byte, passphrase, code string, kdfTime time.Duration) error {
+	header := Header{
+		KdfSalt: make([]byte, kdfSaltLen),
+		Scrypt:  chooseSCrypt(kdfTime),
+	}
+	if _, err := io.ReadFull(rand, header.KdfSalt); err != nil {
+		return err
+	}
+	var key [kdfKeyLen]byte
+	if err := transferKey(&key, passphrase, code, &header); err != nil {
+		return err
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+	header.KeyCheck = keyCheck(&key)
+
+	headerBytes, err := proto.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand, nonce[:]); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	out.Write(transferMagic[:])
+	binary.Write(&out, binary.LittleEndian, uint32(transferVersion))
+	binary.Write(&out, binary.LittleEndian, uint32(len(headerBytes)))
+	out.Write(headerBytes)
+	out.Write(nonce[:])
+	_, err = w.Write(secretbox.Seal(out.Bytes(), state, &nonce, &key))
+	return err
+}
+
+// ReadTransfer checks a transfer bundle and returns the serialised State that
+// it contains. Bundles from a newer version of Pond are rejected.
+func ReadTransfer(b []byte, passphrase, code string) ([]byte, error) {
+	if len(b) < len(transferMagic)+8 || !bytes.Equal(b[:len(transferMagic)], transferMagic[:]) {
+		return nil, errors.New("file is not a Pond transfer bundle")
+	}
+	b = b[len(transferMagic):]
+	version := binary.LittleEndian.Uint32(b)
+	if version > transferVersion {
+		return nil, fmt.Errorf("transfer bundle is from a newer version of Pond (format %d, but only %d is supported)", version, transferVersion)
+	}
+	headerLen := binary.LittleEndian.Uint32(b[4:])
+	b = b[8:]
+	if headerLen > 1<<16 || uint32(len(b)) < headerLen+24 {
+		return nil, errors.New("transfer bundle is truncated")
+	}
+	var header Header
+	if err := proto.Unmarshal(b[:headerLen], &header); err != nil {
+		return nil, err
+	}
+	b = b[headerLen:]
+	if err := checkSCrypt(header.Scrypt); err != nil {
+		return nil, errors.New("transfer bundle is corrupt: " + err.Error())
+	}
+
+	var key [kdfKeyLen]byte
+	if err := transferKey(&key, passphrase, code, &header); err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+	if subtle.ConstantTimeCompare(keyCheck(&key), header.KeyCheck) != 1 {
+		return nil, BadTransferKeyError
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], b)
+	state, ok := secretbox.Open(nil, b[len(nonce):], &nonce, &key)
+	if !ok {
+		return nil, errors.New("transfer bundle is corrupt")
+	}
+	return state, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Received message bodies can optionally be shown with some lightweight
+// formatting: *bold*, _italic_ and links for web addresses. The formatting is
+// done entirely locally and links are only followed if the user clicks on
+// them. Since the body is written by the sender, everything in it is escaped
+// so that it can't inject markup of its own.
+
+// bodyURLRegexp matches the web addresses in a body that are made into links.
+var bodyURLRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// markupEscaper escapes the characters that are special in Pango markup.
+var markupEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"'", "&apos;",
+	`"`, "&quot;",
+)
+
+// sanitizeBodyText replaces invalid UTF-8 and control characters, other than
+// newlines and tabs, with U+FFFD because GTK rejects markup that contains
+// them.
+func sanitizeBodyText(text string) string {
+	var out bytes.Buffer
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+		if r == '\n' || r == '\t' || (r != utf8.RuneError && !unicode.IsControl(r)) {
+			out.WriteRune(r)
+		} else {
+			out.WriteRune(utf8.RuneError)
+		}
+	}
+	return out.String()
+}
+
+// formatBodyMarkup returns the Pango markup for a received message body with
+// the lightweight formatting applied.
+func formatBodyMarkup(text string) string {
+	text = sanitizeBodyText(text)
+
+	var out bytes.Buffer
+	for {
+		loc := bodyURLRegexp.FindStringIndex(text)
+		if loc == nil {
+			break
+		}
+		// Punctuation at the end of an address is more likely to end
+		// the sentence than to be part of it.
+		url := strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)'")
+		emphasize(&out, text[:loc[0]])
+		escaped := markupEscaper.Replace(url)
+		out.WriteString(`<a href="` + escaped + `">` + escaped + `</a>`)
+		text = text[loc[0]+len(url):]
+	}
+	emphasize(&out, text)
+
+	return out.String()
+}
+
+// isWordRune returns true if r is part of a word, and so can't be next to the
+// opening or closing marker of emphasis.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// emphasize writes text to out as escaped markup with runs between matching
+// '*' or '_' markers made bold or italic. Markers only count at the edges of
+// words and the emphasis can't span lines or be nested.
+func emphasize(out *bytes.Buffer, text string) {
+	for len(text) > 0 {
+		i := strings.IndexAny(text, "*_")
+		if i < 0 {
+			break
+		}
+		marker := text[i]
+		prev, _ := utf8.DecodeLastRuneInString(text[:i])
+		rest := text[i+1:]
+		first, _ := utf8.DecodeRuneInString(rest)
+
+		end := -1
+		if (i == 0 || !isWordRune(prev)) && len(rest) > 0 && !unicode.IsSpace(first) && first != rune(marker) {
+			for j := 0; j < len(rest) && rest[j] != '\n'; j++ {
+				if rest[j] != marker {
+					continue
+				}
+				last, _ := utf8.DecodeLastRuneInString(rest[:j])
+				next, _ := utf8.DecodeRuneInString(rest[j+1:])
+				if !unicode.IsSpace(last) && (j+1 == len(rest) || !isWordRune(next)) {
+					end = j
+					break
+				}
+			}
+		}
+
+		if end < 0 {
+			out.WriteString(markupEscaper.Replace(text[:i+1]))
+			text = rest
+			continue
+		}
+
+		tag := "b"
+		if marker == '_' {
+			tag = "i"
+		}
+		out.WriteString(markupEscaper.Replace(text[:i]))
+		out.WriteString("<" + tag + ">" + markupEscaper.Replace(rest[:end]) + "</" + tag + ">")
+		text = rest[end+1:]
+	}
+	out.WriteString(markupEscaper.Replace(text))
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"unsafe"
 
 	"github.com/agl/go-gtk/gdk"
 	"github.com/agl/go-gtk/gdkpixbuf"
@@ -28,6 +29,12 @@ type GTKUI struct {
 	radioGroups map[string]int
 	calendars   map[string]*gtk.GtkCalendar
 	spinButtons map[string]*gtk.GtkSpinButton
+	// foreground and background are the default colors from the last
+	// Reset.
+	foreground, background uint32
+	// interceptClose is true if closing the window results in a
+	// CloseRequested event rather than closing it.
+	interceptClose bool
 }
 
 func NewGTKUI() *GTKUI {
@@ -42,6 +49,16 @@ func NewGTKUI() *GTKUI {
 		actions: make(chan interface{}, uiActionsQueueLen),
 		events:  make(chan interface{}, 8),
 	}
+	window.Connect("delete-event", func() bool {
+		if !ui.interceptClose {
+			return false
+		}
+		select {
+		case ui.events <- CloseRequested{}:
+		default:
+		}
+		return true
+	})
 	window.Connect("destroy", func(ctx *glib.CallbackContext) {
 		close(ui.events)
 		for {
@@ -51,6 +68,25 @@ func NewGTKUI() *GTKUI {
 		}
 		gtk.MainQuit()
 	})
+	window.Connect("key-press-event", func(ctx *glib.CallbackContext) bool {
+		arg := ctx.Args(0)
+		event := *(**gdk.EventKey)(unsafe.Pointer(&arg))
+		state := gdk.ModifierType(event.State)
+		press := KeyPress{
+			key:     keyvalName(uint32(event.Keyval)),
+			control: state&gdk.CONTROL_MASK != 0,
+			alt:     state&gdk.MOD1_MASK != 0,
+			shift:   state&gdk.SHIFT_MASK != 0,
+		}
+		// Only combinations that could be a hotkey are reported.
+		if len(press.key) > 0 && (press.control || press.alt) {
+			select {
+			case ui.events <- press:
+			default:
+			}
+		}
+		return false
+	})
 	if err := syscall.Pipe(ui.pipe[:]); err != nil {
 		panic(err)
 	}
@@ -117,6 +153,12 @@ func (ui *GTKUI) updatedEntry(name string) {
 }
 
 func (ui *GTKUI) clicked(name string) {
+	ui.clickedWithModifiers(name, false, false)
+}
+
+// clickedWithModifiers is like clicked, but also records whether shift or
+// control were held.
+func (ui *GTKUI) clickedWithModifiers(name string, shift, control bool) {
 	entries := make(map[string]string)
 	textViews := make(map[string]string)
 	var combos map[string]string
@@ -168,7 +210,7 @@ func (ui *GTKUI) clicked(name string) {
 		spins[spinName] = spin.GetInt()
 	}
 
-	ui.events <- Click{name, entries, textViews, combos, checks, radios, calendars, spins}
+	ui.events <- Click{name, entries, textViews, combos, checks, radios, calendars, spins, shift, control}
 }
 
 func (ui *GTKUI) newWidget(v Widget) gtk.WidgetLike {
@@ -274,8 +316,28 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		}
 		configureWidget(&box.GtkWidget, v.widgetBase)
 		if len(v.name) > 0 {
-			box.Connect("button-press-event", func(e interface{}) {
-				ui.clicked(v.name)
+			box.Connect("button-press-event", func(ctx *glib.CallbackContext) {
+				arg := ctx.Args(0)
+				event := *(**gdk.EventButton)(unsafe.Pointer(&arg))
+				state := gdk.ModifierType(event.State)
+				ui.clickedWithModifiers(v.name, state&gdk.SHIFT_MASK != 0, state&gdk.CONTROL_MASK != 0)
+			})
+		}
+		if v.dropFiles {
+			box.DragDestSet(gtk.GTK_DEST_DEFAULT_ALL, nil, gdk.GDK_ACTION_COPY)
+			box.DragDestAddUriTargets()
+			box.Connect("drag-data-received", func(ctx *glib.CallbackContext) {
+				data := gtk.SelectionDataFromNative(unsafe.Pointer(ctx.Args(3)))
+				if data == nil || data.GetLength() <= 0 {
+					return
+				}
+				list := string((*[1 << 30]byte)(data.GetData())[:data.GetLength()])
+				if paths := parseURIList(list); len(paths) > 0 {
+					select {
+					case ui.events <- FilesDropped{paths: paths}:
+					default:
+					}
+				}
 			})
 		}
 		return box
@@ -283,9 +345,20 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		label := gtk.Label(v.text)
 		if len(v.markup) > 0 {
 			label.SetMarkup(v.markup)
+			// GTK would otherwise open links itself, without
+			// the confirmation that the client requires.
+			name := v.name
+			label.Connect("activate-link", func(ctx *glib.CallbackContext) bool {
+				select {
+				case ui.events <- LinkClicked{name: name, uri: ctx.Args(0).ToString()}:
+				default:
+				}
+				return true
+			})
 		}
 		label.SetAlignment(v.xAlign, v.yAlign)
 		configureWidget(&label.GtkWidget, v.widgetBase)
+		ui.applyDefaultColors(&label.GtkWidget, v.widgetBase, false)
 		if v.wrap != 0 {
 			label.SetSizeRequest(v.wrap, -1)
 			label.SetLineWrap(true)
@@ -316,6 +389,7 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 			entry.SetVisibility(false)
 		}
 		configureWidget(&entry.GtkWidget, v.widgetBase)
+		ui.applyDefaultColors(&entry.GtkWidget, v.widgetBase, true)
 		return entry
 	case Button:
 		var button *gtk.GtkButton
@@ -348,6 +422,14 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		right := ui.newWidget(v.right)
 		paned.Add1(left)
 		paned.Add2(right)
+		if v.position > 0 {
+			paned.SetPosition(v.position)
+		}
+		if name := v.name; len(name) > 0 {
+			paned.Connect("notify::position", func() {
+				ui.events <- PanedMoved{name, paned.GetPosition()}
+			})
+		}
 		return paned
 	case Scrolled:
 		scrolled := gtk.ScrolledWindow(nil, nil)
@@ -392,6 +474,7 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 			})
 		}
 		configureWidget(&view.GtkWidget, v.widgetBase)
+		ui.applyDefaultColors(&view.GtkWidget, v.widgetBase, true)
 		return view
 	case Combo:
 		combo := gtk.ComboBoxText()
@@ -417,7 +500,18 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		configureWidget(&combo.GtkWidget, v.widgetBase)
 		return combo
 	case Image:
-		image := gtk.ImageFromPixbuf(v.image.Image())
+		var image *gtk.GtkImage
+		if len(v.icon) > 0 {
+			image = gtk.ImageFromIconName(v.icon, gtk.GTK_ICON_SIZE_MENU)
+		} else {
+			var pixbuf *gdkpixbuf.GdkPixbuf
+			if len(v.png) > 0 {
+				pixbuf = pixbufFromPNG(v.png)
+			} else {
+				pixbuf = v.image.Image()
+			}
+			image = gtk.ImageFromPixbuf(pixbuf)
+		}
 		image.SetAlignment(v.xAlign, v.yAlign)
 		configureWidget(&image.GtkWidget, v.widgetBase)
 		return image
@@ -542,6 +636,7 @@ func (ui *GTKUI) handle(action interface{}) {
 			ui.window.Remove(ui.topWidget)
 			ui.topWidget = nil
 		}
+		ui.foreground, ui.background = action.foreground, action.background
 		ui.topWidget = ui.newWidget(action.root)
 		ui.window.Add(ui.topWidget)
 		ui.window.ShowAll()
@@ -580,6 +675,14 @@ func (ui *GTKUI) handle(action interface{}) {
 	case Sensitive:
 		widget := gtk.GtkWidget{ui.getWidget(action.name).ToNative()}
 		widget.SetSensitive(action.sensitive)
+	case SetVisible:
+		widget := gtk.GtkWidget{ui.getWidget(action.name).ToNative()}
+		widget.SetNoShowAll(!action.visible)
+		if action.visible {
+			widget.ShowAll()
+		} else {
+			widget.Hide()
+		}
 	case StartSpinner:
 		widget := gtk.GtkSpinner{gtk.GtkWidget{ui.getWidget(action.name).ToNative()}}
 		widget.Start()
@@ -598,7 +701,27 @@ func (ui *GTKUI) handle(action interface{}) {
 	case SetTextView:
 		widget := gtk.GtkTextView{gtk.GtkContainer{gtk.GtkWidget{ui.getWidget(action.name).ToNative()}}}
 		buffer := gtk.TextBuffer(gtk.TextTagTable())
-		buffer.SetText(action.text)
+		if action.spans == nil {
+			buffer.SetText(action.text)
+		} else {
+			tags := make(map[uint32]*gtk.GtkTextTag)
+			var end gtk.GtkTextIter
+			for _, span := range action.spans {
+				buffer.GetEndIter(&end)
+				if span.foreground == 0 {
+					buffer.Insert(&end, span.text)
+					continue
+				}
+				tag, ok := tags[span.foreground]
+				if !ok {
+					tag = buffer.CreateTag(fmt.Sprintf("fg%06x", span.foreground), map[string]string{
+						"foreground": fmt.Sprintf("#%06x", span.foreground),
+					})
+					tags[span.foreground] = tag
+				}
+				buffer.InsertWithTag(&end, span.text, tag)
+			}
+		}
 		widget.SetBuffer(buffer)
 	case ScrollTextViewToEnd:
 		widget := gtk.GtkTextView{gtk.GtkContainer{gtk.GtkWidget{ui.getWidget(action.name).ToNative()}}}
@@ -606,7 +729,11 @@ func (ui *GTKUI) handle(action interface{}) {
 		widget.ScrollToMark(mark, 0.0, true, 0, 1)
 	case SetImage:
 		widget := gtk.GtkImage{gtk.GtkWidget{ui.getWidget(action.name).ToNative()}}
-		widget.SetFromPixbuf(action.image.Image())
+		if len(action.png) > 0 {
+			widget.SetFromPixbuf(pixbufFromPNG(action.png))
+		} else {
+			widget.SetFromPixbuf(action.image.Image())
+		}
 	case SetFocus:
 		widget := gtk.GtkWidget{ui.getWidget(action.name).ToNative()}
 		widget.GrabFocus()
@@ -649,6 +776,13 @@ func (ui *GTKUI) handle(action interface{}) {
 		widget.SetText(action.s)
 	case SetTitle:
 		ui.window.SetTitle(action.title)
+	case InterceptClose:
+		ui.interceptClose = true
+	case CloseWindow:
+		ui.window.Destroy()
+	case SetClipboard:
+		clipboard := gtk.ClipboardGetForDisplay(gdk.DisplayGetDefault(), gdk.GDK_SELECTION_CLIPBOARD)
+		clipboard.SetText(action.text)
 	case InsertRow:
 		grid := gtk.GtkGrid{gtk.GtkContainer{gtk.GtkWidget{ui.getWidget(action.name).ToNative()}}}
 		x := 0
@@ -677,6 +811,19 @@ func colComponent(component uint32) float64 {
 	return float64(component&0xff) / 255
 }
 
+// applyDefaultColors gives a widget, that doesn't set its own colors, the
+// default colors from the last Reset. Only widgets into which text is entered
+// take the default background since other widgets are drawn on top of their
+// parent.
+func (ui *GTKUI) applyDefaultColors(w *gtk.GtkWidget, b widgetBase, textEntry bool) {
+	if ui.foreground != 0 && b.Foreground() == 0 {
+		w.OverrideColor(gtk.GTK_STATE_FLAG_NORMAL, toColor(ui.foreground))
+	}
+	if textEntry && ui.background != 0 && b.Background() == 0 {
+		w.OverrideBackgroundColor(gtk.GTK_STATE_FLAG_NORMAL, toColor(ui.background))
+	}
+}
+
 func toColor(color uint32) *gdk.GdkRGBA {
 	return gdk.RGBA(colComponent(color>>16), colComponent(color>>8), colComponent(color), 1)
 }
@@ -685,14 +832,18 @@ var indicatorImages [indicatorCount]*gdkpixbuf.GdkPixbuf
 
 func (i Indicator) Image() *gdkpixbuf.GdkPixbuf {
 	if indicatorImages[i] == nil {
-		loader, err := gdkpixbuf.PixbufLoaderWithType("png")
-		if err != nil {
-			panic(err)
-		}
-		if ok, err := loader.Write(indicatorPNGBytes[i]); !ok {
-			panic(err)
-		}
-		indicatorImages[i] = loader.GetPixbuf()
+		indicatorImages[i] = pixbufFromPNG(indicatorPNGBytes[i])
 	}
 	return indicatorImages[i]
 }
+
+func pixbufFromPNG(pngBytes []byte) *gdkpixbuf.GdkPixbuf {
+	loader, err := gdkpixbuf.PixbufLoaderWithType("png")
+	if err != nil {
+		panic(err)
+	}
+	if ok, err := loader.Write(pngBytes); !ok {
+		panic(err)
+	}
+	return loader.GetPixbuf()
+}
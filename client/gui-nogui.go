@@ -22,6 +22,6 @@ func NewGTKUI() GUI {
 func (*noGUIClient) Start() {
 }
 
-func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFetch bool) *noGUIClient {
+func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFetch bool, servers *serverDefaults, appName string) *noGUIClient {
 	panic("no GUI built")
 }
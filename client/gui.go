@@ -9,7 +9,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -77,15 +79,265 @@ const (
 	uiStateTimerComplete
 	uiStateEntomb
 	uiStateEntombComplete
+	uiStateNetwork
+	uiStateBulkImport
+	uiStateConversation
+	uiStateThread
+	uiStateRecovery
+	uiStateImportMessage
+	uiStateImportedMessage
+	uiStateQuit
+	uiStateConfirm
+	uiStateInboxSelection
+	uiStateIntroduction
+	uiStateTransfer
+	uiStateTransferComplete
+	uiStateStaleLock
+	uiStateProfiles
 )
 
+// backupFileArg is the arg of a FileOpen that selects the path of a state
+// file backup.
+type backupFileArg struct{}
+
+// transferFileArg is the arg of a FileOpen that selects the path of a
+// transfer bundle, which moves the account to another computer.
+type transferFileArg struct{}
+
+// publishedKXFileArg is the arg of a FileOpen that selects the path to which
+// the published handshake is saved.
+type publishedKXFileArg struct{}
+
+// handshakeQRArg is the arg of a FileOpen that selects an image of a QR code
+// containing part of a handshake.
+type handshakeQRArg struct{}
+
 type guiClient struct {
 	client
 
-	gui                                               GUI
+	gui                                               *batchGUI
 	inboxUI, outboxUI, contactsUI, clientUI, draftsUI *listUI
+
+	// lastActivity is the time of the most recent event from the user. It
+	// is used to implement idleLockTimeout.
+	lastActivity time.Time
+
+	// quitAfterTransaction is one of the quit* values and records whether
+	// the user has asked to quit once the next network transaction has
+	// completed.
+	quitAfterTransaction int
+
+	// filterContact is the id of the contact whose messages are the only
+	// ones shown in the inbox and outbox, or zero if every message is
+	// shown.
+	filterContact uint64
+	// contactTagFilter, if not empty, limits the contacts list to those
+	// with a tag that starts with it. See contactMatchesTag.
+	contactTagFilter string
+	// revocations contains the detachments that are being, or failed to
+	// be, revoked, keyed by the id of the file. See startRevocation.
+	revocations map[uint64]*pendingRevocation
+}
+
+// Values for guiClient.quitAfterTransaction.
+const (
+	quitNotWaiting = iota
+	// quitWaitingForStart means that the window will be closed once a
+	// network transaction has started and then completed.
+	quitWaitingForStart
+	// quitWaitingForEnd means that a transaction has started and the
+	// window will be closed once it completes.
+	quitWaitingForEnd
+)
+
+// theme returns the colors with which the main UI is drawn.
+func (c *guiClient) theme() *theme {
+	return themeByName(c.themeName)
+}
+
+// idleLockChoices are the periods of inactivity, after which the GUI locks
+// itself, that the user can select from. Zero disables the feature.
+var idleLockChoices = []time.Duration{0, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour, 4 * time.Hour}
+
+// idleLockLabel returns a description of an idle lock timeout for display.
+func idleLockLabel(d time.Duration) string {
+	if d == 0 {
+		return "Never"
+	}
+	n, unit := int(d/time.Minute), "minute"
+	if d%time.Hour == 0 {
+		n, unit = int(d/time.Hour), "hour"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("After %d %s", n, unit)
+}
+
+// ackOverdueChoices are the periods, after which an unacknowledged message
+// is highlighted in the outbox, that the user can select from.
+var ackOverdueChoices = []time.Duration{6 * time.Hour, 12 * time.Hour, 24 * time.Hour, 2 * 24 * time.Hour, 7 * 24 * time.Hour}
+
+// ackOverdueLabel returns a description of an ack overdue threshold for
+// display.
+func ackOverdueLabel(d time.Duration) string {
+	n, unit := int(d/time.Hour), "hour"
+	if d%(24*time.Hour) == 0 {
+		n, unit = int(d/(24*time.Hour)), "day"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("After %d %s", n, unit)
+}
+
+// handshakeExpiryChoices are the periods, after which an unanswered
+// handshake is considered to be stale, that the user can select from.
+var handshakeExpiryChoices = []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, defaultHandshakeExpiry, 14 * 24 * time.Hour, 30 * 24 * time.Hour}
+
+// handshakeExpiryLabel returns a description of a handshake expiry period for
+// display.
+func handshakeExpiryLabel(d time.Duration) string {
+	n, unit := int(d/(24*time.Hour)), "day"
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("After %d %s", n, unit)
+}
+
+// sentLifetimeChoices are the periods, after which sent messages are erased
+// from the outbox, that the user can select from. Zero keeps them until the
+// user deletes them.
+var sentLifetimeChoices = []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, messageLifetime, 30 * 24 * time.Hour, 365 * 24 * time.Hour, 0}
+
+// sentLifetimeLabel returns a description of a sent message lifetime for
+// display.
+func sentLifetimeLabel(d time.Duration) string {
+	if d == 0 {
+		return "Never"
+	}
+	return handshakeExpiryLabel(d)
+}
+
+// transactionIntervalChoices are the mean times between network transactions
+// that the user can select from. They lie within minTransactionInterval and
+// maxTransactionInterval.
+var transactionIntervalChoices = []time.Duration{time.Minute, 2 * time.Minute, transactionRateSeconds * time.Second, 10 * time.Minute, 30 * time.Minute, time.Hour}
+
+// transactionIntervalLabel returns a description of a transaction interval
+// for display.
+func transactionIntervalLabel(d time.Duration) string {
+	n, unit := int(d/time.Minute), "minute"
+	if d%time.Hour == 0 {
+		n, unit = int(d/time.Hour), "hour"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	label := fmt.Sprintf("%d %s", n, unit)
+	if d == transactionRateSeconds*time.Second {
+		label += " (default)"
+	}
+	return label
+}
+
+// latencyLabel returns a description of a median delay, calculated from the
+// given number of messages, for display.
+func latencyLabel(d time.Duration, samples int) string {
+	if samples == 0 {
+		return "No data"
+	}
+	unit := "message"
+	if samples != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%s (from %d %s)", d-d%time.Second, samples, unit)
+}
+
+const (
+	defaultBodyFont     = "Arial"
+	defaultBodyFontSize = 12
+	defaultMonoFont     = "Liberation Mono"
+	defaultMonoFontSize = 10
+)
+
+// bodyFontChoices and monoFontChoices are the font families that the user
+// can select for message bodies and for fixed-width text.
+var (
+	bodyFontChoices = []string{"Arial", "DejaVu Sans", "DejaVu Serif", "Liberation Sans", "Liberation Serif"}
+	monoFontChoices = []string{"Liberation Mono", "DejaVu Sans Mono"}
+)
+
+// fontScaleChoices are the percentages, by which the size of message text is
+// scaled, that the user can select from.
+var fontScaleChoices = []int{75, 100, 125, 150, 200}
+
+// fontScaleLabel returns a description of a font scale for display.
+func fontScaleLabel(percent int) string {
+	return fmt.Sprintf("%d%%", percent)
+}
+
+// fontChoiceLabels returns the labels for a combo box that selects from
+// choices, including current if it's not one of them.
+func fontChoiceLabels(choices []string, current string) []string {
+	labels := append([]string(nil), choices...)
+	for _, choice := range choices {
+		if choice == current {
+			return labels
+		}
+	}
+	return append(labels, current)
+}
+
+// fontScalePercent returns the user's chosen font scale.
+func (c *guiClient) fontScalePercent() int {
+	if c.fontScale > 0 {
+		return c.fontScale
+	}
+	return 100
+}
+
+// scaledFont returns a font description for the given family at size points,
+// scaled by the user's chosen font scale.
+func (c *guiClient) scaledFont(family string, size int) string {
+	scaled := (size*c.fontScalePercent() + 50) / 100
+	if scaled < 1 {
+		scaled = 1
+	}
+	return fmt.Sprintf("%s %d", family, scaled)
+}
+
+// bodyFontFamily and monoFontFamily return the user's chosen font families.
+func (c *guiClient) bodyFontFamily() string {
+	if len(c.bodyFont) > 0 {
+		return c.bodyFont
+	}
+	return defaultBodyFont
+}
+
+func (c *guiClient) monoFontFamily() string {
+	if len(c.monoFont) > 0 {
+		return c.monoFont
+	}
+	return defaultMonoFont
+}
+
+// messageFont returns the font used for the bodies of messages.
+func (c *guiClient) messageFont() string {
+	return c.scaledFont(c.bodyFontFamily(), defaultBodyFontSize)
+}
+
+// messageMonoFont returns the font used for fixed-width text, such as handshakes.
+func (c *guiClient) messageMonoFont() string {
+	return c.scaledFont(c.monoFontFamily(), defaultMonoFontSize)
 }
 
+// outboxChanged is returned by nextEvent after processing something that may
+// have changed the state of a message in the outbox: the start or completion
+// of a transmission, the signing of a message for transmission or the receipt
+// of an acknowledgement.
+type outboxChanged struct{}
+
 // nextEvent polls a number of event sources and returns a GUI event and a bool
 // which indicates whether this is a global event or not. Global events are
 // events like clicks on the lists on the left-hand-side, which cause the
@@ -99,24 +351,63 @@ func (c *guiClient) nextEvent(currentMsgId uint64) (event interface{}, wanted bo
 	select {
 	case sigReq := <-c.signingRequestChan:
 		c.processSigningRequest(sigReq)
-		return
+		return outboxChanged{}, false
 	case event, ok = <-c.gui.Events():
 		if !ok {
 			c.ShutdownAndSuspend()
 		}
+		c.lastActivity = c.Now()
+		if moved, ok := event.(PanedMoved); ok {
+			// The position is saved with the rest of the state.
+			c.panedPosition = moved.position
+			return nil, false
+		}
+		if update, ok := event.(Update); ok && update.name == "contactfilter" {
+			c.filterContactsByTag(update.text)
+			return nil, false
+		}
+		if press, ok := event.(KeyPress); ok {
+			if c.wipeHotkey != nil && c.wipeHotkey.matches(press) {
+				c.panicWipe()
+			}
+			return nil, false
+		}
+		if _, ok := event.(CloseRequested); ok {
+			if c.noQuitPrompt || c.unsentMessageCount() == 0 {
+				c.closeWindow()
+				return nil, false
+			}
+			// The current interaction is abandoned so that
+			// mainUI can ask for confirmation.
+			return event, true
+		}
 	case newMessage := <-c.newMessageChan:
 		c.processNewMessage(newMessage)
-		return
+		return outboxChanged{}, false
 	case msr := <-c.messageSentChan:
 		if msr.id != 0 {
 			c.processMessageSent(msr)
 		}
-		return
+		c.checkQuitAfterTransaction(msr)
+		return outboxChanged{}, false
 	case update := <-c.pandaChan:
 		c.processPANDAUpdate(update)
 		return
 	case event = <-c.backgroundChan:
-		break
+		if result, ok := event.(serverProbeResult); ok {
+			c.processServerProbe(result)
+		}
+		if result, ok := event.(clockSkewResult); ok {
+			c.processClockSkew(result)
+			c.updateClockSkewBanner()
+		}
+		if step, ok := event.(unsealStep); ok {
+			c.processUnsealStep(step)
+		}
+		if c.processRevocationResult(event) {
+			return outboxChanged{}, false
+		}
+		c.processFinishedSave(event, currentMsgId)
 	case <-c.log.updateChan:
 		return
 	case <-c.timerChan:
@@ -140,13 +431,47 @@ func (c *guiClient) nextEvent(currentMsgId uint64) (event interface{}, wanted bo
 		wanted = true
 	}
 	if click, ok := event.(Click); ok {
-		wanted = wanted || click.name == "newcontact" || click.name == "compose"
+		wanted = wanted || click.name == "newcontact" || click.name == "compose" || click.name == "markallread"
 	}
 	return
 }
 
+// processFinishedSave forgets about attachments that finish saving while the
+// message that they're from isn't being displayed, since showInbox won't see
+// the result.
+func (c *guiClient) processFinishedSave(event interface{}, currentMsgId uint64) {
+	var id uint64
+	var err error
+	switch e := event.(type) {
+	case DetachmentComplete:
+		id = e.id
+	case DetachmentError:
+		id, err = e.id, e.err
+	default:
+		return
+	}
+
+	for _, msg := range c.inbox {
+		if msg.id == currentMsgId {
+			continue
+		}
+		if _, ok := msg.saves[id]; ok {
+			delete(msg.saves, id)
+			if err != nil && err != backgroundCanceledError {
+				c.log.Errorf("Failed to save attachment: %s", err)
+			}
+			return
+		}
+	}
+}
+
 func (c *guiClient) processTimer(currentMsgId uint64) {
 	now := c.Now()
+	if c.idleLockTimeout > 0 && now.Sub(c.lastActivity) >= c.idleLockTimeout {
+		c.log.Printf("Locking after %s without activity", c.idleLockTimeout)
+		c.ShutdownAndSuspend()
+	}
+
 	haveDeleted := false
 
 RestartInboxIteration:
@@ -171,7 +496,7 @@ RestartInboxIteration:
 RestartOutboxIteration:
 	for {
 		for _, msg := range c.outbox {
-			if msg.id != currentMsgId && now.Sub(msg.created) > messageLifetime {
+			if msg.id != currentMsgId && c.outboxExpired(msg, now) {
 				if msg.revocation || len(msg.message.Body) > 0 {
 					c.outboxUI.Remove(msg.id)
 				}
@@ -179,9 +504,21 @@ RestartOutboxIteration:
 				haveDeleted = true
 				continue RestartOutboxIteration
 			}
+			if !msg.sent.IsZero() && msg.acked.IsZero() {
+				// The message may have become overdue for an
+				// ack since it was last drawn.
+				c.outboxUI.SetIndicator(msg.id, c.outboxIndicator(msg))
+			}
 		}
 		break
 	}
+	c.logOverdueAcks()
+
+	for _, contact := range c.contacts {
+		if c.handshakeStale(contact) {
+			c.contactsUI.SetSubline(contact.id, c.contactSubline(contact))
+		}
+	}
 
 	if haveDeleted {
 		c.save()
@@ -238,6 +575,7 @@ func (c *guiClient) sleepUI(d time.Duration) error {
 	case _, ok := <-c.gui.Events():
 		if !ok {
 			// User asked to close the window.
+			c.releaseInstanceLock()
 			close(c.gui.Actions())
 			select {}
 		}
@@ -264,7 +602,7 @@ func (c *guiClient) initUI() {
 								padding:    10,
 								font:       fontLoadTitle,
 							},
-							text: "Pond",
+							text: c.appTitle(),
 						},
 					},
 				},
@@ -279,7 +617,8 @@ func (c *guiClient) initUI() {
 			},
 		},
 	}
-	c.gui.Actions() <- Reset{ui}
+	c.gui.Actions() <- SetTitle{c.appTitle()}
+	c.gui.Actions() <- Reset{root: ui}
 }
 
 func (c *guiClient) loadingUI() {
@@ -309,17 +648,84 @@ func (c *guiClient) DeselectAll() {
 	c.draftsUI.Deselect()
 }
 
-var rightPlaceholderUI = EventBox{
-	widgetBase: widgetBase{background: colorGray, name: "right"},
-	child: Label{
+// rightPlaceholderUI returns the contents of the right-hand side of the main
+// window when nothing is selected. Normally it shows the name of the
+// application but, while the inbox is empty, it explains how to get started
+// instead.
+func (c *guiClient) rightPlaceholderUI() Widget {
+	t := c.theme()
+	title := Label{
 		widgetBase: widgetBase{
-			foreground: colorTitleForeground,
+			foreground: t.title,
 			font:       fontLoadLarge,
 		},
-		text:   "Pond",
+		text:   c.appTitle(),
 		xAlign: 0.5,
 		yAlign: 0.5,
-	},
+	}
+	if !c.inboxEmpty() {
+		return EventBox{
+			widgetBase: widgetBase{background: t.pane, name: "right"},
+			child:      title,
+		}
+	}
+
+	guidance := "Your inbox is empty. Messages from your contacts will appear here. Click Compose to write to one of them."
+	var button Widget = Button{
+		widgetBase: widgetBase{name: "emptycompose"},
+		text:       "Compose",
+	}
+	if c.operatingMode() == modeFetchOnly {
+		guidance = "Your inbox is empty. Messages from your contacts will appear here."
+		button = HBox{}
+	}
+	if len(c.contacts) == 0 {
+		guidance = "You don't have any contacts yet. Before you can exchange messages with someone, you need to add them as a contact by sharing a secret with them or by swapping key exchange messages. Click Add Contact to start."
+		button = Button{
+			widgetBase: widgetBase{name: "emptynewcontact"},
+			text:       "Add Contact",
+		}
+	}
+	title.text = "Welcome to " + c.appTitle()
+
+	return EventBox{
+		widgetBase: widgetBase{background: t.pane, name: "right"},
+		child: VBox{
+			spacing: 12,
+			children: []Widget{
+				VBox{widgetBase: widgetBase{expand: true}},
+				title,
+				Label{
+					widgetBase: widgetBase{name: "emptyguidance", padding: 20},
+					text:       guidance,
+					wrap:       400,
+					xAlign:     0.5,
+				},
+				HBox{
+					children: []Widget{
+						HBox{widgetBase: widgetBase{expand: true}},
+						button,
+						HBox{widgetBase: widgetBase{expand: true}},
+					},
+				},
+				VBox{widgetBase: widgetBase{expand: true}},
+			},
+		},
+	}
+}
+
+// updateClockSkewBanner shows a warning at the top of the main window while the
+// local clock is wrong, and hides it otherwise.
+func (c *guiClient) updateClockSkewBanner() {
+	if c.inboxUI == nil {
+		// The main window hasn't been built yet.
+		return
+	}
+	if c.clockSkewed() {
+		c.gui.Actions() <- SetText{name: "clockskew", text: "Your clock is " + describeClockSkew(c.clockSkew) + ". Message times and erasure will be wrong until it's corrected."}
+	}
+	c.gui.Actions() <- SetVisible{name: "clockskewbanner", visible: c.clockSkewed()}
+	c.gui.Signal()
 }
 
 func (c *guiClient) updateWindowTitle() {
@@ -332,9 +738,9 @@ func (c *guiClient) updateWindowTitle() {
 	}
 
 	if unreadCount == 0 {
-		c.gui.Actions() <- SetTitle{"Pond"}
+		c.gui.Actions() <- SetTitle{c.appTitle()}
 	} else {
-		c.gui.Actions() <- SetTitle{fmt.Sprintf("Pond (%d)", unreadCount)}
+		c.gui.Actions() <- SetTitle{fmt.Sprintf("%s (%d)", c.appTitle(), unreadCount)}
 	}
 	c.gui.Signal()
 }
@@ -342,26 +748,33 @@ func (c *guiClient) updateWindowTitle() {
 func (c *guiClient) processFetch(inboxMsg *InboxMessage) {
 	from := c.contacts[inboxMsg.from]
 
-	if !from.isPending {
+	if inboxMsg.message != nil {
 		if len(inboxMsg.message.Body) > 0 {
-			subline := time.Unix(*inboxMsg.message.Time, 0).Format(shortTimeFormat)
+			subline := messageTimeText(inboxMsg.message, shortTimeFormat)
 			c.inboxUI.Add(inboxMsg.id, from.name, subline, indicatorBlue)
+			c.setContactAvatar(c.inboxUI, inboxMsg.id, from)
+			c.setMessageDetail(c.inboxUI, inboxMsg.id, inboxMsg.message)
 		}
+		c.contactsUI.SetSubline(from.id, c.contactSubline(from))
 	} else {
 		c.inboxUI.Add(inboxMsg.id, from.name, "pending", indicatorRed)
+		c.setContactAvatar(c.inboxUI, inboxMsg.id, from)
 	}
 
 	c.updateWindowTitle()
 }
 
 func (c *guiClient) processServerAnnounce(inboxMsg *InboxMessage) {
-	subline := time.Unix(*inboxMsg.message.Time, 0).Format(shortTimeFormat)
+	subline := messageTimeText(inboxMsg.message, shortTimeFormat)
 	c.inboxUI.Add(inboxMsg.id, c.ContactName(inboxMsg.from), subline, indicatorBlue)
 	c.updateWindowTitle()
 }
 
 func (c *guiClient) processAcknowledgement(ackedMsg *queuedMessage) {
-	c.outboxUI.SetIndicator(ackedMsg.id, indicatorGreen)
+	c.outboxUI.SetIndicator(ackedMsg.id, c.outboxIndicator(ackedMsg))
+	if to, ok := c.contacts[ackedMsg.to]; ok {
+		c.contactsUI.SetSubline(to.id, c.contactSubline(to))
+	}
 }
 
 func (c *guiClient) processRevocationOfUs(by *Contact) {
@@ -382,23 +795,59 @@ func (c *guiClient) processRevocation(by *Contact) {
 	c.gui.Signal()
 }
 
+// updateDraftIndicators redraws the indicators of the contact with the given
+// id, and of the outbox messages to them, after a draft to that contact has
+// been created, readdressed, sent or discarded.
+func (c *guiClient) updateDraftIndicators(contactID uint64) {
+	contact, ok := c.contacts[contactID]
+	if !ok {
+		return
+	}
+	c.contactsUI.SetIndicator(contactID, c.contactIndicator(contact))
+	for _, msg := range c.outbox {
+		if msg.to == contactID && !msg.revocation {
+			c.outboxUI.SetIndicator(msg.id, c.outboxIndicator(msg))
+		}
+	}
+}
+
 func (c *guiClient) processMessageDelivered(msg *queuedMessage) {
 	c.outboxUI.SetIndicator(msg.id, indicatorYellow)
 }
 
-func (c *guiClient) mainUI() {
+// The entries in clientUI.
+const (
+	clientUIIdentity = iota + 1
+	clientUIActivity
+	clientUINetwork
+	clientUIImport
+)
+
+// buildMainUI replaces the contents of the window with the main UI and fills
+// in the lists on the left-hand side. It's run again when the theme changes.
+func (c *guiClient) buildMainUI() {
+	t := c.theme()
 	ui := Paned{
+		widgetBase: widgetBase{name: "paned"},
+		position:   c.panedPosition,
 		left: Scrolled{
 			viewport: true,
 			child: EventBox{
-				widgetBase: widgetBase{background: colorGray},
+				widgetBase: widgetBase{background: t.pane},
 				child: VBox{
 					children: []Widget{
 						EventBox{
-							widgetBase: widgetBase{background: colorHeaderBackground},
+							widgetBase: widgetBase{name: "clockskewbanner", background: t.imminently},
+							child: Label{
+								widgetBase: widgetBase{name: "clockskew", padding: 10},
+								wrap:       200,
+							},
+						},
+						EventBox{
+							widgetBase: widgetBase{background: t.headerBackground},
 							child: Label{
 								widgetBase: widgetBase{
-									foreground: colorHeaderForegroundSmall,
+									foreground: t.headerForegroundSmall,
 									padding:    10,
 									font:       fontListHeading,
 								},
@@ -406,14 +855,35 @@ func (c *guiClient) mainUI() {
 								text:   "Inbox",
 							},
 						},
-						EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+						EventBox{widgetBase: widgetBase{height: 1, background: t.sep}},
+						HBox{
+							widgetBase: widgetBase{padding: 6},
+							children: []Widget{
+								HBox{widgetBase: widgetBase{expand: true}},
+								HBox{
+									widgetBase: widgetBase{padding: 8},
+									children: []Widget{
+										VBox{
+											widgetBase: widgetBase{padding: 8},
+											children: []Widget{
+												Button{
+													widgetBase: widgetBase{width: 100, name: "markallread"},
+													text:       "Mark all read",
+												},
+											},
+										},
+									},
+								},
+								HBox{widgetBase: widgetBase{expand: true}},
+							},
+						},
 						VBox{widgetBase: widgetBase{name: "inboxVbox"}},
 
 						EventBox{
-							widgetBase: widgetBase{background: colorHeaderBackground},
+							widgetBase: widgetBase{background: t.headerBackground},
 							child: Label{
 								widgetBase: widgetBase{
-									foreground: colorHeaderForegroundSmall,
+									foreground: t.headerForegroundSmall,
 									padding:    10,
 									font:       fontListHeading,
 								},
@@ -421,7 +891,7 @@ func (c *guiClient) mainUI() {
 								text:   "Outbox",
 							},
 						},
-						EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+						EventBox{widgetBase: widgetBase{height: 1, background: t.sep}},
 						HBox{
 							widgetBase: widgetBase{padding: 6},
 							children: []Widget{
@@ -446,10 +916,10 @@ func (c *guiClient) mainUI() {
 						VBox{widgetBase: widgetBase{name: "outboxVbox"}},
 
 						EventBox{
-							widgetBase: widgetBase{background: colorHeaderBackground},
+							widgetBase: widgetBase{background: t.headerBackground},
 							child: Label{
 								widgetBase: widgetBase{
-									foreground: colorHeaderForegroundSmall,
+									foreground: t.headerForegroundSmall,
 									padding:    10,
 									font:       fontListHeading,
 								},
@@ -457,14 +927,14 @@ func (c *guiClient) mainUI() {
 								text:   "Drafts",
 							},
 						},
-						EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+						EventBox{widgetBase: widgetBase{height: 1, background: t.sep}},
 						VBox{widgetBase: widgetBase{name: "draftsVbox"}},
 
 						EventBox{
-							widgetBase: widgetBase{background: colorHeaderBackground},
+							widgetBase: widgetBase{background: t.headerBackground},
 							child: Label{
 								widgetBase: widgetBase{
-									foreground: colorHeaderForegroundSmall,
+									foreground: t.headerForegroundSmall,
 									padding:    10,
 									font:       fontListHeading,
 								},
@@ -472,7 +942,7 @@ func (c *guiClient) mainUI() {
 								text:   "Contacts",
 							},
 						},
-						EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+						EventBox{widgetBase: widgetBase{height: 1, background: t.sep}},
 						HBox{
 							widgetBase: widgetBase{padding: 6},
 							children: []Widget{
@@ -494,13 +964,30 @@ func (c *guiClient) mainUI() {
 								HBox{widgetBase: widgetBase{expand: true}},
 							},
 						},
+						HBox{
+							widgetBase: widgetBase{padding: 4},
+							spacing:    6,
+							children: []Widget{
+								Label{
+									widgetBase: widgetBase{padding: 6},
+									text:       "Tag",
+									yAlign:     0.5,
+								},
+								Entry{
+									widgetBase:     widgetBase{name: "contactfilter"},
+									width:          15,
+									text:           c.contactTagFilter,
+									updateOnChange: true,
+								},
+							},
+						},
 						VBox{widgetBase: widgetBase{name: "contactsVbox"}},
 
 						EventBox{
-							widgetBase: widgetBase{background: colorHeaderBackground},
+							widgetBase: widgetBase{background: t.headerBackground},
 							child: Label{
 								widgetBase: widgetBase{
-									foreground: colorHeaderForegroundSmall,
+									foreground: t.headerForegroundSmall,
 									padding:    10,
 									font:       fontListHeading,
 								},
@@ -508,7 +995,7 @@ func (c *guiClient) mainUI() {
 								text:   "Client",
 							},
 						},
-						EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+						EventBox{widgetBase: widgetBase{height: 1, background: t.sep}},
 						VBox{
 							widgetBase: widgetBase{name: "clientVbox"},
 						},
@@ -519,98 +1006,154 @@ func (c *guiClient) mainUI() {
 		right: Scrolled{
 			horizontal: true,
 			viewport:   true,
-			child:      rightPlaceholderUI,
+			child:      c.rightPlaceholderUI(),
 		},
 	}
 
-	c.gui.Actions() <- Reset{ui}
+	c.gui.Actions() <- Reset{
+		root: EventBox{
+			widgetBase: widgetBase{background: t.background},
+			child:      ui,
+		},
+		foreground: t.foreground,
+		background: t.background,
+	}
 	c.gui.Signal()
 
-	c.contactsUI = &listUI{
-		gui:      c.gui,
-		vboxName: "contactsVbox",
-	}
+	// Adding an entry to a list signals the GUI, which would mean a redraw
+	// for every message in a large account, so the lists are built as a
+	// single batch.
+	c.gui.Batch(func() {
+		c.contactsUI = &listUI{
+			gui:              c.gui,
+			theme:            t,
+			vboxName:         "contactsVbox",
+			shapedIndicators: c.shapedIndicators,
+		}
 
-	for id, contact := range c.contacts {
-		c.contactsUI.Add(id, contact.name, contact.subline(), contact.indicator())
-	}
+		for _, contact := range c.sortedContacts() {
+			c.contactsUI.Add(contact.id, contactLine(contact), c.contactSubline(contact), c.contactIndicator(contact))
+			c.setContactAvatar(c.contactsUI, contact.id, contact)
+		}
 
-	c.inboxUI = &listUI{
-		gui:      c.gui,
-		vboxName: "inboxVbox",
-	}
+		c.inboxUI = &listUI{
+			gui:              c.gui,
+			theme:            t,
+			vboxName:         "inboxVbox",
+			shapedIndicators: c.shapedIndicators,
+		}
 
-	for _, msg := range c.inbox {
-		var subline string
-		i := indicatorNone
+		for _, msg := range c.inbox {
+			var subline string
+			i := indicatorNone
 
-		if msg.message == nil {
-			subline = "pending"
-		} else {
-			if len(msg.message.Body) == 0 {
-				continue
+			if msg.message == nil {
+				subline = "pending"
+			} else {
+				if len(msg.message.Body) == 0 {
+					continue
+				}
+				if !msg.read {
+					i = indicatorBlue
+				}
+				subline = messageTimeText(msg.message, shortTimeFormat)
 			}
-			if !msg.read {
-				i = indicatorBlue
+			if msg.from != 0 {
+				if i == indicatorNone && !msg.acked {
+					i = indicatorYellow
+				}
 			}
-			subline = time.Unix(*msg.message.Time, 0).Format(shortTimeFormat)
-		}
-		if msg.from != 0 {
-			if i == indicatorNone && !msg.acked {
-				i = indicatorYellow
+			c.inboxUI.Add(msg.id, c.ContactName(msg.from), subline, i)
+			if from, ok := c.contacts[msg.from]; ok {
+				c.setContactAvatar(c.inboxUI, msg.id, from)
 			}
+			c.setMessageDetail(c.inboxUI, msg.id, msg.message)
+			c.updateInboxBackgroundColor(msg)
 		}
-		c.inboxUI.Add(msg.id, c.ContactName(msg.from), subline, i)
-		c.updateInboxBackgroundColor(msg)
-	}
-	c.updateWindowTitle()
+		c.updateWindowTitle()
 
-	c.outboxUI = &listUI{
-		gui:      c.gui,
-		vboxName: "outboxVbox",
-	}
+		c.outboxUI = &listUI{
+			gui:              c.gui,
+			theme:            t,
+			vboxName:         "outboxVbox",
+			shapedIndicators: c.shapedIndicators,
+		}
 
-	for _, msg := range c.outbox {
-		if msg.revocation {
-			c.outboxUI.Add(msg.id, "Revocation", msg.created.Format(shortTimeFormat), msg.indicator(nil))
-			c.outboxUI.SetInsensitive(msg.id)
-			continue
+		for _, msg := range c.outbox {
+			if msg.revocation {
+				c.outboxUI.Add(msg.id, "Revocation", msg.created.Format(shortTimeFormat), c.outboxIndicator(msg))
+				c.outboxUI.SetInsensitive(msg.id)
+				continue
+			}
+			if len(msg.message.Body) > 0 {
+				subline := msg.created.Format(shortTimeFormat)
+				c.outboxUI.Add(msg.id, c.ContactName(msg.to), subline, c.outboxIndicator(msg))
+				c.setMessageDetail(c.outboxUI, msg.id, msg.message)
+			}
 		}
-		if len(msg.message.Body) > 0 {
-			subline := msg.created.Format(shortTimeFormat)
-			c.outboxUI.Add(msg.id, c.ContactName(msg.to), subline, msg.indicator(c.contacts[msg.to]))
+
+		c.draftsUI = &listUI{
+			gui:              c.gui,
+			theme:            t,
+			vboxName:         "draftsVbox",
+			shapedIndicators: c.shapedIndicators,
 		}
-	}
 
-	c.draftsUI = &listUI{
-		gui:      c.gui,
-		vboxName: "draftsVbox",
-	}
+		for _, draft := range c.drafts {
+			to := "Unknown"
+			if draft.to != 0 {
+				to = c.ContactName(draft.to)
+			}
+			subline := draft.created.Format(shortTimeFormat)
+			c.draftsUI.Add(draft.id, to, subline, indicatorNone)
+		}
 
-	for _, draft := range c.drafts {
-		to := "Unknown"
-		if draft.to != 0 {
-			to = c.ContactName(draft.to)
+		c.clientUI = &listUI{
+			gui:              c.gui,
+			theme:            t,
+			vboxName:         "clientVbox",
+			shapedIndicators: c.shapedIndicators,
 		}
-		subline := draft.created.Format(shortTimeFormat)
-		c.draftsUI.Add(draft.id, to, subline, indicatorNone)
-	}
+		c.clientUI.Add(clientUIIdentity, "Identity", "", indicatorNone)
+		c.clientUI.Add(clientUIActivity, "Activity Log", "", indicatorNone)
+		c.clientUI.Add(clientUINetwork, "Network", "", indicatorNone)
+		c.clientUI.Add(clientUIImport, "Import Message", "", indicatorNone)
+
+		if c.filterContact != 0 {
+			c.filterMessages(c.filterContact)
+		}
+		if len(c.contactTagFilter) > 0 {
+			c.filterContactsByTag(c.contactTagFilter)
+		}
+	})
+	// Composing is pointless when messages are never sent.
+	c.gui.Actions() <- SetVisible{name: "compose", visible: c.operatingMode() != modeFetchOnly}
+	c.updateClockSkewBanner()
+}
 
-	c.clientUI = &listUI{
-		gui:      c.gui,
-		vboxName: "clientVbox",
+func (c *guiClient) mainUI() {
+	c.buildMainUI()
+	// Finish any unsealing that was interrupted when the client was last
+	// running.
+	for _, contact := range c.contactsWithSealedMessages() {
+		c.startUnsealing(contact)
 	}
-	const (
-		clientUIIdentity = iota + 1
-		clientUIActivity
-	)
-	c.clientUI.Add(clientUIIdentity, "Identity", "", indicatorNone)
-	c.clientUI.Add(clientUIActivity, "Activity Log", "", indicatorNone)
+	// Closing the window is confirmed if there are unsent messages.
+	c.gui.Actions() <- InterceptClose{}
 
+	c.lastActivity = c.Now()
 	c.gui.Actions() <- UIState{uiStateMain}
 	c.gui.Signal()
 
+	// Show whatever was selected when Pond was last running, if it still
+	// exists.
 	var nextEvent interface{}
+	if ui := c.selectionListUI(); ui != nil {
+		if click, ok := ui.SelectEvent(c.selectedId); ok {
+			nextEvent = click
+		}
+	}
+
 	for {
 		event := nextEvent
 		nextEvent = nil
@@ -621,29 +1164,49 @@ func (c *guiClient) mainUI() {
 			continue
 		}
 
+		if id, ok := c.inboxUI.Event(event); ok {
+			if click := event.(Click); click.shift || click.control {
+				nextEvent = c.extendInboxSelection(id, click.shift)
+				continue
+			}
+		}
+
 		c.DeselectAll()
+		if _, ok := event.(CloseRequested); ok {
+			c.selectedList = selectionNone
+			nextEvent = c.quitUI()
+			continue
+		}
 		if id, ok := c.inboxUI.Event(event); ok {
 			c.inboxUI.Select(id)
+			c.selectedList, c.selectedId = selectionInbox, id
 			nextEvent = c.showInbox(id)
 			continue
 		}
 		if id, ok := c.outboxUI.Event(event); ok {
 			c.outboxUI.Select(id)
+			c.selectedList, c.selectedId = selectionOutbox, id
 			nextEvent = c.showOutbox(id)
 			continue
 		}
 		if id, ok := c.contactsUI.Event(event); ok {
 			c.contactsUI.Select(id)
+			c.selectedList, c.selectedId = selectionContact, id
 			nextEvent = c.showContact(id)
 			continue
 		}
 		if id, ok := c.clientUI.Event(event); ok {
 			c.clientUI.Select(id)
+			c.selectedList = selectionNone
 			switch id {
 			case clientUIIdentity:
 				nextEvent = c.identityUI()
 			case clientUIActivity:
 				nextEvent = c.logUI()
+			case clientUINetwork:
+				nextEvent = c.networkUI()
+			case clientUIImport:
+				nextEvent = c.importMessageUI()
 			default:
 				panic("bad clientUI event")
 			}
@@ -651,6 +1214,7 @@ func (c *guiClient) mainUI() {
 		}
 		if id, ok := c.draftsUI.Event(event); ok {
 			c.draftsUI.Select(id)
+			c.selectedList = selectionNone
 			nextEvent = c.composeUI(c.drafts[id], nil)
 		}
 
@@ -659,66 +1223,289 @@ func (c *guiClient) mainUI() {
 			continue
 		}
 		switch click.name {
-		case "newcontact":
+		case "newcontact", "emptynewcontact":
+			c.selectedList = selectionNone
 			nextEvent = c.newContactUI(nil)
-		case "compose":
+		case "compose", "emptycompose":
+			if c.operatingMode() == modeFetchOnly {
+				continue
+			}
+			c.selectedList = selectionNone
 			nextEvent = c.composeUI(nil, nil)
+		case "markallread":
+			c.markAllReadUI()
 		}
 	}
 }
 
-// updateInboxBackgroundColor updates the background color of an inbox message
-// in the listUI. For example, if a message is marked as "retain" then the
-// background color may go from a warning indication to a normal color.
-func (c *guiClient) updateInboxBackgroundColor(msg *InboxMessage) {
-	now := c.Now()
-
-	if !msg.retained {
-		if now.Sub(msg.receivedTime) > messageLifetime {
-			// The message will be deleted imminently.
-			c.inboxUI.SetBackground(msg.id, colorImminently)
-			return
-		}
-		if now.Sub(msg.receivedTime) > messagePreIndicationLifetime {
-			// The message will be deleted soon.
-			c.inboxUI.SetBackground(msg.id, colorDeleteSoon)
-			return
-		}
+// extendInboxSelection handles a click on the inbox entry with the given id
+// while shift or control was held. Rather than replacing the selection, the
+// click extends it so that several messages can be selected at once.
+func (c *guiClient) extendInboxSelection(id uint64, shift bool) interface{} {
+	c.outboxUI.Deselect()
+	c.contactsUI.Deselect()
+	c.clientUI.Deselect()
+	c.draftsUI.Deselect()
+	if shift {
+		c.inboxUI.SelectRange(id)
+	} else {
+		c.inboxUI.ToggleSelected(id)
 	}
 
-	c.inboxUI.SetBackground(msg.id, colorGray)
+	switch ids := c.inboxUI.SelectedIds(); len(ids) {
+	case 0:
+		c.selectedList = selectionNone
+		c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
+		c.gui.Actions() <- UIState{uiStateMain}
+		c.gui.Signal()
+		return nil
+	case 1:
+		c.selectedList, c.selectedId = selectionInbox, ids[0]
+		return c.showInbox(ids[0])
+	}
+	c.selectedList = selectionNone
+	return c.showInboxSelection()
 }
 
-func (c *guiClient) errorUI(errorText string, fatal bool) {
-	bgColor := uint32(colorDefault)
-	if fatal {
-		bgColor = colorError
-	}
+// showInboxSelection shows the number of inbox messages that are selected
+// and allows them to be deleted together.
+func (c *guiClient) showInboxSelection() interface{} {
+	for {
+		ids := c.inboxUI.SelectedIds()
+		left := Label{
+			widgetBase: widgetBase{name: "selectioncount", margin: 6},
+			text:       fmt.Sprintf("%d messages are selected. Hold control to add or remove a message, or shift to select a range.", len(ids)),
+			wrap:       400,
+		}
+		right := Grid{
+			widgetBase: widgetBase{margin: 6},
+			rows: [][]GridE{
+				{
+					{1, 1, Button{
+						widgetBase: widgetBase{name: "deleteselected"},
+						text:       "Delete Selected",
+					}},
+				},
+			},
+		}
+		c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "SELECTED MESSAGES", left, right, nil)}
+		c.gui.Actions() <- UIState{uiStateInboxSelection}
+		c.gui.Signal()
+
+		for {
+			event, wanted := c.nextEvent(0)
+			if wanted {
+				return event
+			}
+			if click, ok := event.(Click); ok && click.name == "deleteselected" {
+				break
+			}
+		}
+
+		// Messages may have been erased in the meantime.
+		ids = c.inboxUI.SelectedIds()
+		if len(ids) == 0 || !c.confirm("DELETE MESSAGES", fmt.Sprintf("Delete %d messages now? They can't be recovered.", len(ids))) {
+			continue
+		}
+
+		for _, id := range ids {
+			c.inboxUI.Remove(id)
+			c.deleteInboxMsg(id)
+		}
+		c.log.Printf("Deleted %d messages from the inbox", len(ids))
+		c.updateWindowTitle()
+		c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
+		c.gui.Actions() <- UIState{uiStateMain}
+		c.gui.Signal()
+		c.save()
+		return nil
+	}
+
+	panic("unreachable")
+}
+
+// markAllReadUI marks every message in the inbox as read and updates their
+// indicators.
+func (c *guiClient) markAllReadUI() {
+	for _, msg := range c.markAllRead() {
+		i := indicatorYellow
+		if msg.from == 0 || msg.acked {
+			i = indicatorNone
+		}
+		c.inboxUI.SetIndicator(msg.id, i)
+	}
+	c.updateWindowTitle()
+}
+
+// selectionListUI returns the list that contains the selected item, or nil if
+// nothing is selected.
+func (c *guiClient) selectionListUI() *listUI {
+	switch c.selectedList {
+	case selectionInbox:
+		return c.inboxUI
+	case selectionOutbox:
+		return c.outboxUI
+	case selectionContact:
+		return c.contactsUI
+	}
+	return nil
+}
+
+// updateInboxBackgroundColor updates the background color of an inbox message
+// in the listUI. For example, if a message is marked as "retain" then the
+// background color may go from a warning indication to a normal color.
+// setContactAvatar sets the avatar of the entry with the given id in ui to
+// that of contact.
+func (c *guiClient) setContactAvatar(ui *listUI, id uint64, contact *Contact) {
+	ui.SetAvatar(id, contactInitial(contact), contactAvatarColor(contact).color)
+}
+
+// messageDetail returns a short description of the size of msg, and of its
+// attachments if it has any, for the inbox and outbox lists.
+func messageDetail(msg *pond.Message) string {
+	serialized, err := proto.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	size := fmt.Sprintf("%d B", len(serialized))
+	if len(serialized) >= 1024 {
+		size = fmt.Sprintf("%.1f KB", float64(len(serialized))/1024)
+	}
+	if n := len(msg.Files); n > 0 {
+		return fmt.Sprintf("\U0001F4CE%d  %s", n, size)
+	}
+	return size
+}
+
+// setMessageDetail sets the detail of the entry with the given id in ui to
+// describe msg, if the user has asked for that.
+func (c *guiClient) setMessageDetail(ui *listUI, id uint64, msg *pond.Message) {
+	if !c.messageDetails || msg == nil {
+		return
+	}
+	ui.SetDetail(id, messageDetail(msg))
+}
+
+// updateContactAvatars updates the avatar of contact's entry in the contacts
+// list and those of the entries for their messages in the inbox.
+func (c *guiClient) updateContactAvatars(contact *Contact) {
+	c.setContactAvatar(c.contactsUI, contact.id, contact)
+	for _, msg := range c.inbox {
+		if msg.from == contact.id {
+			c.setContactAvatar(c.inboxUI, msg.id, contact)
+		}
+	}
+}
+
+func (c *guiClient) updateInboxBackgroundColor(msg *InboxMessage) {
+	now := c.Now()
+
+	if !msg.retained {
+		if now.Sub(msg.receivedTime) > messageLifetime {
+			// The message will be deleted imminently.
+			c.inboxUI.SetBackground(msg.id, c.theme().imminently)
+			return
+		}
+		if now.Sub(msg.receivedTime) > messagePreIndicationLifetime {
+			// The message will be deleted soon.
+			c.inboxUI.SetBackground(msg.id, c.theme().deleteSoon)
+			return
+		}
+	}
+
+	c.inboxUI.SetBackground(msg.id, c.theme().pane)
+}
+
+func (c *guiClient) errorUI(errorText string, fatal bool) {
+	bgColor := uint32(colorDefault)
+	if fatal {
+		bgColor = colorError
+	}
+
+	var child Widget = Label{
+		widgetBase: widgetBase{
+			foreground: colorBlack,
+			font:       "Ariel Bold 12",
+		},
+		text:   errorText,
+		xAlign: 0.5,
+		yAlign: 0.5,
+	}
+	if fatal {
+		// The error can be selected, or copied along with some
+		// details of the state file, so that it can be included in
+		// a bug report.
+		child = VBox{
+			widgetBase: widgetBase{padding: 40, expand: true, fill: true},
+			children: []Widget{
+				Label{
+					widgetBase: widgetBase{
+						name:       "errortext",
+						foreground: colorBlack,
+						font:       "Ariel Bold 12",
+						expand:     true,
+						fill:       true,
+					},
+					text:       errorText,
+					xAlign:     0.5,
+					yAlign:     0.5,
+					wrap:       600,
+					selectable: true,
+				},
+				HBox{
+					spacing: 5,
+					children: []Widget{
+						HBox{widgetBase: widgetBase{expand: true}},
+						Button{
+							widgetBase: widgetBase{name: "copydiagnostics"},
+							text:       "Copy Diagnostics",
+						},
+						Button{
+							widgetBase: widgetBase{name: "quit"},
+							text:       "Quit",
+						},
+						HBox{widgetBase: widgetBase{expand: true}},
+					},
+				},
+			},
+		}
+	}
 
 	ui := EventBox{
 		widgetBase: widgetBase{background: bgColor, expand: true, fill: true},
-		child: Label{
-			widgetBase: widgetBase{
-				foreground: colorBlack,
-				font:       "Ariel Bold 12",
-			},
-			text:   errorText,
-			xAlign: 0.5,
-			yAlign: 0.5,
-		},
+		child:      child,
 	}
 	c.log.Printf("Fatal error: %s", errorText)
 	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
 	c.gui.Actions() <- UIState{uiStateError}
 	c.gui.Signal()
-	if !c.testing {
-		select {
-		case _, ok := <-c.gui.Events():
-			if !ok {
-				// User asked to close the window.
-				close(c.gui.Actions())
-				select {}
-			}
+	if c.testing {
+		return
+	}
+
+	for {
+		event, ok := <-c.gui.Events()
+		if !ok {
+			// User asked to close the window.
+			c.releaseInstanceLock()
+			close(c.gui.Actions())
+			select {}
+		}
+		if !fatal {
+			return
+		}
+		// A fatal error is only dismissed with the Quit button, after
+		// which the caller shuts down.
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+		switch click.name {
+		case "copydiagnostics":
+			c.gui.Actions() <- SetClipboard{c.loadDiagnostics(errorText)}
+			c.gui.Signal()
+		case "quit":
+			return
 		}
 	}
 }
@@ -764,48 +1551,63 @@ func (c *guiClient) keyPromptUI(stateFile *disk.StateFile) error {
 			},
 			HBox{
 				widgetBase: widgetBase{padding: 5},
+				spacing:    10,
 				children: []Widget{
+					Spinner{
+						widgetBase: widgetBase{name: "spinner"},
+					},
 					Label{
 						widgetBase: widgetBase{name: "status"},
 					},
+					Button{
+						widgetBase: widgetBase{name: "cancelunlock", insensitive: true},
+						text:       "Cancel",
+					},
 				},
 			},
 		},
 	}
 
 	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
+	c.gui.Actions() <- StopSpinner{name: "spinner"}
 	c.gui.Actions() <- SetFocus{name: "pw"}
 	c.gui.Actions() <- UIState{uiStatePassphrase}
 	c.gui.Signal()
 
-	for {
-		event, ok := <-c.gui.Events()
-		if !ok {
-			c.ShutdownAndSuspend()
-		}
-
-		click, ok := event.(Click)
-		if !ok {
-			continue
-		}
-		if click.name != "next" && click.name != "pw" {
-			continue
-		}
+	// Deriving the key can take seconds with a high scrypt cost so the
+	// state file is read on another goroutine while the UI shows that it's
+	// working. Only one read of stateFile may run at a time: if the user
+	// cancels, the abandoned read must finish before another can start,
+	// and its result is discarded.
+	type readResult struct {
+		state *disk.State
+		err   error
+	}
+	var result chan readResult
+	var abandoned, queued bool
+	var queuedPW string
 
-		pw, ok := click.entries["pw"]
-		if !ok {
-			panic("missing pw")
-		}
+	startRead := func(pw string) {
+		result = make(chan readResult, 1)
+		go func(result chan<- readResult) {
+			state, err := stateFile.Read(pw)
+			result <- readResult{state, err}
+		}(result)
+	}
 
+	showUnlocking := func() {
 		c.gui.Actions() <- Sensitive{name: "next", sensitive: false}
 		c.gui.Actions() <- Sensitive{name: "pw", sensitive: false}
+		c.gui.Actions() <- StartSpinner{name: "spinner"}
+		c.gui.Actions() <- SetText{name: "status", text: "Unlocking..."}
+		c.gui.Actions() <- Sensitive{name: "cancelunlock", sensitive: true}
 		c.gui.Signal()
+	}
 
-		if err := c.loadState(stateFile, pw); err != disk.BadPasswordError {
-			return err
-		}
-
-		c.gui.Actions() <- SetText{name: "status", text: msgIncorrectPassword}
+	resetPrompt := func(status string) {
+		c.gui.Actions() <- StopSpinner{name: "spinner"}
+		c.gui.Actions() <- Sensitive{name: "cancelunlock", sensitive: false}
+		c.gui.Actions() <- SetText{name: "status", text: status}
 		c.gui.Actions() <- SetEntry{name: "pw", text: ""}
 		c.gui.Actions() <- Sensitive{name: "pw", sensitive: true}
 		c.gui.Actions() <- SetFocus{name: "pw"}
@@ -813,54 +1615,115 @@ func (c *guiClient) keyPromptUI(stateFile *disk.StateFile) error {
 		c.gui.Signal()
 	}
 
+	for {
+		select {
+		case r := <-result:
+			result = nil
+			if abandoned {
+				abandoned = false
+				if r.err == nil {
+					stateFile.Forget()
+				}
+				if queued {
+					queued = false
+					startRead(queuedPW)
+				}
+				continue
+			}
+			if r.err == nil {
+				return c.unmarshal(r.state)
+			}
+			if r.err != disk.BadPasswordError {
+				return r.err
+			}
+			resetPrompt(msgIncorrectPassword)
+		case event, ok := <-c.gui.Events():
+			if !ok {
+				c.ShutdownAndSuspend()
+			}
+
+			click, ok := event.(Click)
+			if !ok {
+				continue
+			}
+			if click.name == "cancelunlock" {
+				switch {
+				case queued:
+					queued = false
+				case result != nil && !abandoned:
+					abandoned = true
+				default:
+					continue
+				}
+				resetPrompt("Cancelled")
+				continue
+			}
+			if click.name != "next" && click.name != "pw" {
+				continue
+			}
+
+			pw, ok := click.entries["pw"]
+			if !ok {
+				panic("missing pw")
+			}
+
+			switch {
+			case result == nil:
+				startRead(pw)
+			case abandoned:
+				// The cancelled read is still running so this
+				// one has to wait for it.
+				queued, queuedPW = true, pw
+			default:
+				continue
+			}
+			showUnlocking()
+		}
+	}
+
 	return nil
 }
 
-func (c *guiClient) createPassphraseUI() (string, error) {
-	ui := Grid{
-		widgetBase: widgetBase{margin: 20},
-		rowSpacing: 5,
-		colSpacing: 5,
-		rows: [][]GridE{
-			{
-				{2, 1, Label{
-					widgetBase: widgetBase{font: "DejaVu Sans 30"},
-					text:       "Set Passphrase",
-				}},
+func (c *guiClient) stateRecoveryUI(loadErr error) (string, error) {
+	ui := VBox{
+		widgetBase: widgetBase{padding: 40, expand: true, fill: true, name: "vbox"},
+		children: []Widget{
+			Label{
+				widgetBase: widgetBase{font: "DejaVu Sans 30"},
+				text:       "Damaged State File",
 			},
-			{
-				{2, 1, Label{
-					widgetBase: widgetBase{
-						padding: 20,
-						font:    "DejaVu Sans 14",
-					},
-					text: msgCreatePassphrase,
-					wrap: 600,
-				}},
+			Label{
+				widgetBase: widgetBase{
+					padding: 20,
+					font:    "DejaVu Sans 14",
+				},
+				text: msgCorruptState,
+				wrap: 600,
 			},
-			{
-				{1, 1, Label{
-					text:   "Passphrase:",
-					yAlign: 0.5,
-				}},
-				{1, 1, Entry{
-					widgetBase: widgetBase{name: "pw", hAlign: AlignStart, hExpand: true},
-					width:      60,
-					password:   true,
-				}},
+			Label{
+				widgetBase: widgetBase{name: "loaderror", foreground: colorRed, padding: 10},
+				text:       "Error: " + loadErr.Error(),
+				wrap:       600,
 			},
-			{
-				{2, 1, Button{
-					widgetBase: widgetBase{name: "next", hAlign: AlignStart},
-					text:       "Next",
-				}},
+			HBox{
+				widgetBase: widgetBase{padding: 40},
+				spacing:    5,
+				children: []Widget{
+					Button{
+						widgetBase: widgetBase{name: "backupfile"},
+						text:       "Restore Backup",
+					},
+					Button{
+						widgetBase: widgetBase{name: "fresh"},
+						text:       "Start Afresh",
+					},
+				},
 			},
 		},
 	}
 
 	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
-	c.gui.Actions() <- SetFocus{name: "pw"}
-	c.gui.Actions() <- UIState{uiStateCreatePassphrase}
+	c.gui.Actions() <- UIState{uiStateRecovery}
 	c.gui.Signal()
 
 	for {
@@ -869,33 +1732,285 @@ func (c *guiClient) createPassphraseUI() (string, error) {
 			c.ShutdownAndSuspend()
 		}
 
-		click, ok := event.(Click)
-		if !ok {
-			continue
-		}
-		if click.name != "next" && click.name != "pw" {
+		if open, ok := event.(OpenResult); ok && open.ok {
+			if _, ok := open.arg.(backupFileArg); ok {
+				return open.path, nil
+			}
 			continue
 		}
 
-		pw, ok := click.entries["pw"]
+		click, ok := event.(Click)
 		if !ok {
-			panic("missing pw")
+			continue
 		}
 
-		return pw, nil
+		switch click.name {
+		case "backupfile":
+			c.gui.Actions() <- FileOpen{
+				save:  false,
+				title: "Select backup file",
+				arg:   backupFileArg{},
+			}
+			c.gui.Signal()
+		case "fresh":
+			return "", nil
+		}
 	}
 
 	panic("unreachable")
 }
 
-func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didImport bool, err error) {
-	defaultServer := msgDefaultServer
-	if c.dev {
-		defaultServer = msgDefaultDevServer
+func (c *guiClient) profileUI(profiles []string) (string, error) {
+	var preSelected string
+	if len(profiles) > 0 {
+		preSelected = profiles[0]
+	}
+	ui := Grid{
+		widgetBase: widgetBase{margin: 20},
+		rowSpacing: 5,
+		colSpacing: 5,
+		rows: [][]GridE{
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{font: "DejaVu Sans 30"},
+					text:       "Choose Profile",
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{
+						padding: 20,
+						font:    "DejaVu Sans 14",
+					},
+					text: "Each profile is a separate account, with its own contacts, messages and passphrase.",
+					wrap: 600,
+				}},
+			},
+			{
+				{1, 1, Combo{
+					widgetBase:  widgetBase{name: "profiles", insensitive: len(profiles) == 0},
+					labels:      profiles,
+					preSelected: preSelected,
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "openprofile", hAlign: AlignStart, insensitive: len(profiles) == 0},
+					text:       "Open",
+				}},
+			},
+			{
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "newprofile", hAlign: AlignStart, hExpand: true},
+					width:      30,
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "createprofile", hAlign: AlignStart},
+					text:       "Create New Profile",
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "profileerror", foreground: colorRed},
+					wrap:       600,
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
+	if len(profiles) > 0 {
+		c.gui.Actions() <- SetFocus{name: "openprofile"}
+	} else {
+		c.gui.Actions() <- SetFocus{name: "newprofile"}
+	}
+	c.gui.Actions() <- UIState{uiStateProfiles}
+	c.gui.Signal()
+
+	for {
+		event, ok := <-c.gui.Events()
+		if !ok {
+			c.ShutdownAndSuspend()
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		switch click.name {
+		case "openprofile":
+			if name := click.combos["profiles"]; len(name) > 0 {
+				return name, nil
+			}
+		case "newprofile", "createprofile":
+			name, err := newProfileName(click.entries["newprofile"], profiles)
+			if err == nil {
+				return name, nil
+			}
+			c.gui.Actions() <- SetText{name: "profileerror", text: err.Error()}
+			c.gui.Actions() <- UIState{uiStateProfiles}
+			c.gui.Signal()
+		}
+	}
+
+	panic("unreachable")
+}
+
+func (c *guiClient) staleLockUI(owner *disk.InstanceOwner) error {
+	ui := VBox{
+		widgetBase: widgetBase{padding: 40, expand: true, fill: true, name: "vbox"},
+		children: []Widget{
+			Label{
+				widgetBase: widgetBase{font: "DejaVu Sans 30"},
+				text:       "Already Running?",
+			},
+			Label{
+				widgetBase: widgetBase{
+					padding: 20,
+					font:    "DejaVu Sans 14",
+				},
+				text: msgStaleLock,
+				wrap: 600,
+			},
+			Label{
+				widgetBase: widgetBase{name: "lockowner", padding: 10},
+				text:       "It was last used by " + owner.String() + ".",
+				wrap:       600,
+			},
+			HBox{
+				widgetBase: widgetBase{padding: 40},
+				spacing:    5,
+				children: []Widget{
+					Button{
+						widgetBase: widgetBase{name: "takeover"},
+						text:       "Continue",
+					},
+					Button{
+						widgetBase: widgetBase{name: "quit"},
+						text:       "Quit",
+					},
+				},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
+	c.gui.Actions() <- UIState{uiStateStaleLock}
+	c.gui.Signal()
+
+	for {
+		event, ok := <-c.gui.Events()
+		if !ok {
+			c.ShutdownAndSuspend()
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		switch click.name {
+		case "takeover":
+			return nil
+		case "quit":
+			c.ShutdownAndSuspend()
+		}
+	}
+
+	panic("unreachable")
+}
+
+func (c *guiClient) createPassphraseUI() (string, error) {
+	ui := Grid{
+		widgetBase: widgetBase{margin: 20},
+		rowSpacing: 5,
+		colSpacing: 5,
+		rows: [][]GridE{
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{font: "DejaVu Sans 30"},
+					text:       "Set Passphrase",
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{
+						padding: 20,
+						font:    "DejaVu Sans 14",
+					},
+					text: msgCreatePassphrase,
+					wrap: 600,
+				}},
+			},
+			{
+				{1, 1, Label{
+					text:   "Passphrase:",
+					yAlign: 0.5,
+				}},
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "pw", hAlign: AlignStart, hExpand: true},
+					width:      60,
+					password:   true,
+				}},
+			},
+			{
+				{2, 1, Button{
+					widgetBase: widgetBase{name: "next", hAlign: AlignStart},
+					text:       "Next",
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
+	c.gui.Actions() <- SetFocus{name: "pw"}
+	c.gui.Actions() <- UIState{uiStateCreatePassphrase}
+	c.gui.Signal()
+
+	for {
+		event, ok := <-c.gui.Events()
+		if !ok {
+			c.ShutdownAndSuspend()
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+		if click.name != "next" && click.name != "pw" {
+			continue
+		}
+
+		pw, ok := click.entries["pw"]
+		if !ok {
+			panic("missing pw")
+		}
+
+		return pw, nil
+	}
+
+	panic("unreachable")
+}
+
+// validateServerEntry checks the server URL that has been entered when
+// creating an account and only allows the account to be created if it's
+// valid.
+func (c *guiClient) validateServerEntry(server string) {
+	var errText string
+	if len(server) > 0 {
+		if _, _, err := parseServer(server, c.dev); err != nil {
+			errText = "Invalid server address: " + err.Error()
+		}
 	}
+	c.gui.Actions() <- SetText{name: "servererror", text: errText}
+	c.gui.Actions() <- Sensitive{name: "create", sensitive: len(server) > 0 && len(errText) == 0}
+	c.gui.Signal()
+}
+
+func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didImport bool, err error) {
+	defaultServer := c.defaultServer()
 
 	serverLabels := []string{"Default"}
-	for _, server := range knownServers {
+	for _, server := range c.serverPresets() {
 		serverLabels = append(serverLabels, server.description)
 	}
 	serverLabels = append(serverLabels, "Custom")
@@ -928,9 +2043,16 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 					preSelected: "Default",
 				}},
 				{1, 1, Entry{
-					widgetBase: widgetBase{name: "server", hAlign: AlignStart, hExpand: true, margin: 10, insensitive: true},
-					width:      60,
-					text:       defaultServer,
+					widgetBase:     widgetBase{name: "server", hAlign: AlignStart, hExpand: true, margin: 10, insensitive: true},
+					width:          60,
+					text:           defaultServer,
+					updateOnChange: true,
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "servererror", foreground: colorRed},
+					wrap:       600,
 				}},
 			},
 			{
@@ -988,80 +2110,224 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 								wrap:       600,
 							}},
 						},
-					},
-				}},
-			},
-		},
-	}
-
-	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
-	c.gui.Actions() <- SetFocus{name: "create"}
-	c.gui.Actions() <- UIState{uiStateCreateAccount}
-	c.gui.Signal()
-
-	var spinnerCreated bool
-	var tombPath string
-	for {
-		event, ok := <-c.gui.Events()
-		if !ok {
-			c.ShutdownAndSuspend()
-		}
-
-		if open, ok := event.(OpenResult); ok && open.ok {
-			tombPath = open.path
-			c.gui.Actions() <- Sensitive{name: "import", sensitive: true}
-			c.gui.Signal()
-			continue
-		}
-
-		click, ok := event.(Click)
-		if !ok {
-			continue
-		}
-
-		switch click.name {
-		case "tombfile":
-			c.gui.Actions() <- FileOpen{
-				save:     false,
-				title:    "Select path of entombed file",
-				filename: "statefile.tomb",
-				arg:      nil,
-			}
-			c.gui.Signal()
-			continue
-		case "import":
-			if err := c.importTombFile(stateFile, click.entries["tombkey"], tombPath); err == nil {
-				err = c.loadState(stateFile, pw)
-			}
-			if err != nil {
-				c.gui.Actions() <- SetText{name: "tomberror", text: err.Error()}
-				c.gui.Actions() <- UIError{err}
-				c.gui.Signal()
-				continue
-			}
-
-			c.lastErasureStorageTime = time.Now()
-			return true, nil
-		case "servercombo":
-			selected := click.combos["servercombo"]
-			server := ""
-
-			switch selected {
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{font: "bold"},
+								text:       "Import from another computer",
+							}},
+						},
+						{
+							{2, 1, Label{
+								text: "An account that was moved with \"Move Account\" on another computer can be imported using the passphrase that protects it and the transfer code that was displayed there. The transfer file is deleted once it has been imported. " + msgTransferWarning,
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Label{
+								text:   "Passphrase:",
+								yAlign: 0.5,
+							}},
+							{1, 1, Entry{
+								widgetBase: widgetBase{name: "transferimportpassphrase", hAlign: AlignStart, hExpand: true},
+								width:      40,
+								password:   true,
+							}},
+						},
+						{
+							{1, 1, Label{
+								text:   "Transfer code:",
+								yAlign: 0.5,
+							}},
+							{1, 1, Entry{
+								widgetBase: widgetBase{name: "transfercode", hAlign: AlignStart, hExpand: true},
+								width:      30,
+							}},
+						},
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "transferimportfile", hAlign: AlignStart},
+								text:       "Select File",
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "importtransfer", hAlign: AlignStart, insensitive: true},
+								text:       "Import",
+							}},
+						},
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{name: "transferimporterror", foreground: colorRed},
+								wrap:       600,
+							}},
+						},
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{font: "bold"},
+								text:       "Restore backup",
+							}},
+						},
+						{
+							{2, 1, Label{
+								text: "A backup made with \"Export Backup\" can also be restored. You will be prompted for the passphrase that was in use when the backup was made.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "backupfile", hAlign: AlignStart},
+								text:       "Select File",
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "restore", hAlign: AlignStart, insensitive: true},
+								text:       "Restore",
+							}},
+						},
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{name: "backuperror", foreground: colorRed},
+								wrap:       600,
+							}},
+						},
+					},
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
+	c.gui.Actions() <- SetFocus{name: "create"}
+	c.gui.Actions() <- UIState{uiStateCreateAccount}
+	c.gui.Signal()
+
+	var spinnerCreated bool
+	var tombPath, backupPath, transferPath string
+	for {
+		event, ok := <-c.gui.Events()
+		if !ok {
+			c.ShutdownAndSuspend()
+		}
+
+		if update, ok := event.(Update); ok && update.name == "server" {
+			c.validateServerEntry(update.text)
+			continue
+		}
+
+		if open, ok := event.(OpenResult); ok && open.ok {
+			if _, ok := open.arg.(backupFileArg); ok {
+				backupPath = open.path
+				c.gui.Actions() <- Sensitive{name: "restore", sensitive: true}
+			} else if _, ok := open.arg.(transferFileArg); ok {
+				transferPath = open.path
+				c.gui.Actions() <- Sensitive{name: "importtransfer", sensitive: true}
+			} else {
+				tombPath = open.path
+				c.gui.Actions() <- Sensitive{name: "import", sensitive: true}
+			}
+			c.gui.Signal()
+			continue
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		switch click.name {
+		case "tombfile":
+			c.gui.Actions() <- FileOpen{
+				save:     false,
+				title:    "Select path of entombed file",
+				filename: "statefile.tomb",
+				arg:      nil,
+			}
+			c.gui.Signal()
+			continue
+		case "import":
+			if err := c.importTombFile(stateFile, click.entries["tombkey"], tombPath); err == nil {
+				err = c.loadState(stateFile, pw)
+			}
+			if err != nil {
+				c.gui.Actions() <- SetText{name: "tomberror", text: err.Error()}
+				c.gui.Actions() <- UIError{err}
+				c.gui.Signal()
+				continue
+			}
+
+			c.lastErasureStorageTime = time.Now()
+			return true, nil
+		case "transferimportfile":
+			c.gui.Actions() <- FileOpen{
+				save:     false,
+				title:    "Select transfer file",
+				filename: "pond.transfer",
+				arg:      transferFileArg{},
+			}
+			c.gui.Signal()
+			continue
+		case "importtransfer":
+			err := c.importTransfer(stateFile, transferPath, click.entries["transferimportpassphrase"], click.entries["transfercode"])
+			if err == nil {
+				err = c.loadState(stateFile, pw)
+			}
+			if err != nil {
+				c.gui.Actions() <- SetText{name: "transferimporterror", text: err.Error()}
+				c.gui.Actions() <- UIError{err}
+				c.gui.Signal()
+				continue
+			}
+
+			c.lastErasureStorageTime = time.Now()
+			return true, nil
+		case "backupfile":
+			c.gui.Actions() <- FileOpen{
+				save:  false,
+				title: "Select backup file",
+				arg:   backupFileArg{},
+			}
+			c.gui.Signal()
+			continue
+		case "restore":
+			if err := c.importBackup(stateFile, backupPath); err != nil {
+				c.gui.Actions() <- SetText{name: "backuperror", text: err.Error()}
+				c.gui.Actions() <- UIError{err}
+				c.gui.Signal()
+				continue
+			}
+
+			err := c.loadState(stateFile, "")
+			for err == disk.BadPasswordError {
+				err = c.keyPromptUI(stateFile)
+			}
+			if err != nil {
+				// The backup has already replaced the state
+				// file so there's no going back.
+				c.errorUI(err.Error(), true)
+				if err := c.ShutdownAndSuspend(); err != nil {
+					return false, err
+				}
+			}
+
+			c.lastErasureStorageTime = time.Now()
+			return true, nil
+		case "servercombo":
+			selected := click.combos["servercombo"]
+			server := ""
+
+			switch selected {
 			case "Default":
 				server = defaultServer
 			case "Custom":
 				server = ""
 			default:
-				for _, known := range knownServers {
+				for _, known := range c.serverPresets() {
 					if known.description == selected {
 						server = known.uri
 					}
 				}
 			}
 
-			c.gui.Actions() <- Sensitive{name: "server", sensitive: len(server) == 0}
+			c.gui.Actions() <- Sensitive{name: "server", sensitive: selected == "Custom"}
 			c.gui.Actions() <- SetEntry{name: "server", text: server}
-			c.gui.Signal()
+			c.validateServerEntry(server)
 			continue
 		case "create":
 			break
@@ -1069,7 +2335,7 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 			continue
 		}
 
-		c.server = click.entries["server"]
+		server := click.entries["server"]
 
 		c.gui.Actions() <- Sensitive{name: "server", sensitive: false}
 		c.gui.Actions() <- Sensitive{name: "create", sensitive: false}
@@ -1090,6 +2356,10 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 							widgetBase: widgetBase{name: "status"},
 							text:       initialMessage,
 						},
+						Button{
+							widgetBase: widgetBase{name: "cancelcreate"},
+							text:       "Cancel",
+						},
 					},
 				},
 			}
@@ -1097,30 +2367,97 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 		} else {
 			c.gui.Actions() <- StartSpinner{name: "spinner"}
 			c.gui.Actions() <- SetText{name: "status", text: initialMessage}
+			c.gui.Actions() <- Sensitive{name: "cancelcreate", sensitive: true}
 		}
 		c.gui.Signal()
 
-		updateMsg := func(msg string) {
-			c.gui.Actions() <- SetText{name: "status", text: msg}
-			c.gui.Signal()
-		}
-
-		if err := c.doCreateAccount(updateMsg); err != nil {
+		if err := c.createAccountWithProgress(server); err != nil {
 			c.gui.Actions() <- StopSpinner{name: "spinner"}
-			c.gui.Actions() <- UIError{err}
+			if err != errAccountCreationCancelled {
+				c.gui.Actions() <- UIError{err}
+			}
 			c.gui.Actions() <- SetText{name: "status", text: err.Error()}
+			c.gui.Actions() <- Sensitive{name: "cancelcreate", sensitive: false}
 			c.gui.Actions() <- Sensitive{name: "server", sensitive: true}
 			c.gui.Actions() <- Sensitive{name: "create", sensitive: true}
 			c.gui.Signal()
 			continue
 		}
 
+		c.gui.Actions() <- Sensitive{name: "cancelcreate", sensitive: false}
+		c.gui.Actions() <- SetText{name: "status", text: "Saving..."}
+		c.gui.Signal()
 		break
 	}
 
 	return false, nil
 }
 
+// errAccountCreationCancelled is returned by createAccountWithProgress when
+// the user cancels.
+var errAccountCreationCancelled = errors.New("Account creation was cancelled")
+
+// createAccountWithProgress creates an account on server. The network
+// operations run on a separate goroutine, which reports each step to the
+// status label via a channel, so that the user can cancel if, for example,
+// Tor is slow to connect. Cancelling closes any connection to the server.
+// The client's state is only updated if the account was created.
+func (c *guiClient) createAccountWithProgress(server string) error {
+	generation := uint32(c.randId())
+
+	progress := make(chan string)
+	result := make(chan error, 1)
+	cancel := make(chan struct{})
+	go func() {
+		result <- c.createAccount(server, generation, cancel, func(msg string) {
+			select {
+			case progress <- msg:
+			case <-cancel:
+			}
+		})
+	}()
+
+	for {
+		select {
+		case msg := <-progress:
+			c.gui.Actions() <- SetText{name: "status", text: msg}
+			c.gui.Signal()
+		case err := <-result:
+			if err != nil {
+				return err
+			}
+			c.server = server
+			c.generation = generation
+			return nil
+		case event, ok := <-c.gui.Events():
+			if !ok {
+				close(cancel)
+				c.ShutdownAndSuspend()
+			}
+			if click, ok := event.(Click); ok && click.name == "cancelcreate" {
+				close(cancel)
+				return errAccountCreationCancelled
+			}
+		}
+	}
+
+	panic("unreachable")
+}
+
+// matches returns true if the key press is exactly h.
+func (h *hotkey) matches(press KeyPress) bool {
+	return h.control == press.control && h.alt == press.alt && h.shift == press.shift && h.key == press.key
+}
+
+// panicWipe destroys the state and exits, without confirmation, when the
+// user presses the wipe hotkey.
+func (c *guiClient) panicWipe() {
+	c.wipeState()
+	c.releaseInstanceLock()
+	close(c.gui.Actions())
+	select {}
+}
+
 func (c *guiClient) ShutdownAndSuspend() error {
 	if c.writerChan != nil {
 		c.save()
@@ -1150,37 +2487,57 @@ func (c *guiClient) Shutdown() {
 			}
 		}
 	}
+	c.stopNetwork(false)
 	if c.writerChan != nil {
 		close(c.writerChan)
 		<-c.writerDone
 	}
-	if c.fetchNowChan != nil {
-		close(c.fetchNowChan)
-	}
 	if c.stateLock != nil {
 		c.stateLock.Close()
 	}
+	c.releaseInstanceLock()
+	c.wipeKeys()
 }
 
+// InboxDetachmentUI handles the background tasks of an inbox message: the
+// decryption and download of detachments and the saving of attachments.
 type InboxDetachmentUI struct {
 	msg *InboxMessage
 	gui GUI
 }
 
 func (i InboxDetachmentUI) IsValid(id uint64) bool {
+	if _, ok := i.msg.saves[id]; ok {
+		return true
+	}
 	_, ok := i.msg.decryptions[id]
 	return ok
 }
 
 func (i InboxDetachmentUI) ProgressName(id uint64) string {
+	if save, ok := i.msg.saves[id]; ok {
+		return fmt.Sprintf("attachment-progress-%d", save.index)
+	}
 	return fmt.Sprintf("detachment-progress-%d", i.msg.decryptions[id].index)
 }
 
 func (i InboxDetachmentUI) VBoxName(id uint64) string {
+	if save, ok := i.msg.saves[id]; ok {
+		return fmt.Sprintf("attachment-save-vbox-%d", save.index)
+	}
 	return fmt.Sprintf("detachment-vbox-%d", i.msg.decryptions[id].index)
 }
 
 func (i InboxDetachmentUI) OnFinal(id uint64) {
+	if save, ok := i.msg.saves[id]; ok {
+		i.gui.Actions() <- Destroy{name: fmt.Sprintf("attachment-cancel-%d", save.index)}
+		i.gui.Actions() <- Sensitive{
+			name:      fmt.Sprintf("attachment-%d", save.index),
+			sensitive: true,
+		}
+		delete(i.msg.saves, id)
+		return
+	}
 	i.gui.Actions() <- Sensitive{
 		name:      fmt.Sprintf("detachment-decrypt-%d", i.msg.decryptions[id].index),
 		sensitive: true,
@@ -1227,7 +2584,7 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 		rows: [][]GridE{
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "FROM",
 				}},
 				// We set hExpand true here so that the
@@ -1237,21 +2594,47 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "SENT",
 				}},
 				{1, 1, Label{text: sentTimeText}},
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "ERASE",
 				}},
 				{1, 1, Label{text: eraseTimeText}},
 			},
 		},
 	}
+	if isPending {
+		// Until the key exchange with the sender completes, the
+		// message is opaque and only its arrival and size are known.
+		left.rows = append(left.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				text:       "RECEIVED",
+			}},
+			{1, 1, Label{widgetBase: widgetBase{name: "receivedtime"}, text: formatTime(msg.receivedTime)}},
+		}, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				text:       "SIZE",
+			}},
+			{1, 1, Label{widgetBase: widgetBase{name: "sealedsize"}, text: prettyNumber(uint64(len(msg.sealed))) + " bytes (encrypted)"}},
+		})
+	}
 	lhsNextRow := len(left.rows)
+	// Attachments are inserted above the details, at lhsNextRow.
+	left.rows = append(left.rows, []GridE{
+		{2, 1, c.messageIdsFrame([]messageIdField{
+			{"messageid", "MESSAGE ID", msg.message.GetId()},
+			{"localid", "LOCAL ID", msg.id},
+			{"contactid", "FROM CONTACT", msg.from},
+			{"inreplytoid", "IN REPLY TO", msg.message.GetInReplyTo()},
+		})},
+	})
 
 	right := Grid{
 		widgetBase: widgetBase{margin: 6},
@@ -1262,11 +2645,29 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 				{1, 1, Button{
 					widgetBase: widgetBase{
 						name:        "reply",
-						insensitive: isServerAnnounce || isPending,
+						insensitive: isServerAnnounce || isPending || c.operatingMode() == modeFetchOnly,
 					},
 					text: "Reply",
 				}},
 			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "thread",
+						insensitive: isServerAnnounce || isPending || !c.hasThread(msg.message.GetId()),
+					},
+					text: "Show Thread",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "copybody",
+						insensitive: isPending,
+					},
+					text: "Copy Body",
+				}},
+			},
 			{
 				{1, 1, Button{
 					widgetBase: widgetBase{
@@ -1295,15 +2696,85 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 			},
 		},
 	}
+	if contact, ok := c.contacts[msg.from]; ok && isPending && contact.isPending {
+		right.rows = append(right.rows, []GridE{
+			{1, 1, Button{
+				widgetBase: widgetBase{name: "showcontact"},
+				text:       "Complete Key Exchange",
+			}},
+		})
+	}
+	// If formatting is enabled then the user can still switch to the
+	// body exactly as it was sent.
+	formatBody := c.formatBodies && !isPending
+	if formatBody {
+		right.rows = append(right.rows, []GridE{
+			{1, 1, CheckButton{
+				widgetBase: widgetBase{name: "viewraw"},
+				text:       "View Raw",
+			}},
+		})
+	}
+	right.rows = append(right.rows, exportMessageRows(isPending)...)
+	right.rows = append(right.rows, messageDetailsRow())
+	// A contact may introduce someone by sending their handshake.
+	const introductionPrefix = "introduction-"
+	var introductions []*pem.Block
+	if !isPending && !isServerAnnounce {
+		introductions = embeddedHandshakes(msgText)
+	}
+	for i := range introductions {
+		text := "Add as Contact"
+		if len(introductions) > 1 {
+			text = fmt.Sprintf("Add Contact %d", i+1)
+		}
+		right.rows = append(right.rows, []GridE{
+			{1, 1, Button{
+				widgetBase: widgetBase{name: fmt.Sprintf("%s%d", introductionPrefix, i)},
+				text:       text,
+			}},
+		})
+	}
+	if !isPending {
+		if _, err := decodeBody(msg.message); err != nil {
+			// Don't lose messages that can't be displayed.
+			right.rows = append(right.rows, []GridE{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "saverawbody"},
+					text:       "Save Raw Body",
+				}},
+			})
+		}
+	}
 
-	main := TextView{
-		widgetBase: widgetBase{hExpand: true, vExpand: true, name: "body"},
+	rawBody := TextView{
+		widgetBase: widgetBase{hExpand: true, vExpand: true, expand: true, fill: true, name: "body", font: c.messageFont()},
 		editable:   false,
 		text:       msgText,
 		wrap:       true,
 	}
+	formattedBody := Scrolled{
+		widgetBase: widgetBase{hExpand: true, vExpand: true, expand: true, fill: true},
+		viewport:   true,
+		child: Label{
+			widgetBase: widgetBase{name: "formattedbody", margin: 6, font: c.messageFont()},
+			markup:     formatBodyMarkup(msgText),
+			wrap:       600,
+			selectable: true,
+		},
+	}
+
+	var main Widget = rawBody
+	if formatBody {
+		main = VBox{
+			widgetBase: widgetBase{name: "bodybox", hExpand: true, vExpand: true},
+			children:   []Widget{formattedBody},
+		}
+	}
 
-	c.gui.Actions() <- SetChild{name: "right", child: rightPane("RECEIVED MESSAGE", left, right, main)}
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "RECEIVED MESSAGE", left, right, main)}
+	c.gui.Actions() <- SetVisible{name: "messageids", visible: false}
+	detailsShown := false
 
 	// The UI names widgets with strings so these prefixes are used to
 	// generate names for the dynamic parts of the UI.
@@ -1314,8 +2785,30 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 		detachmentDownloadPrefix = "detachment-download-"
 		detachmentSavePrefix     = "detachment-save-"
 		attachmentPrefix         = "attachment-"
+		attachmentCancelPrefix   = "attachment-cancel-"
+		attachmentSaveVBoxPrefix = "attachment-save-vbox-"
+		attachmentWarningPrefix  = "attachment-warning-"
 	)
 
+	// widgetsForAttachmentSave returns the progress bar and cancel
+	// button that are shown while an attachment is being saved.
+	widgetsForAttachmentSave := func(index int) []Widget {
+		return []Widget{
+			Progress{
+				widgetBase: widgetBase{
+					name: fmt.Sprintf("attachment-progress-%d", index),
+				},
+			},
+			Button{
+				widgetBase: widgetBase{
+					name:   fmt.Sprintf("%s%d", attachmentCancelPrefix, index),
+					hAlign: AlignStart,
+				},
+				text: "Cancel",
+			},
+		}
+	}
+
 	widgetForDetachmentProcess := func(index int) Widget {
 		return VBox{
 			widgetBase: widgetBase{name: fmt.Sprintf("detachment-vbox-%d", index)},
@@ -1333,22 +2826,66 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 		grid := Grid{widgetBase: widgetBase{marginLeft: 25}, rowSpacing: 3}
 
 		for i, attachment := range msg.message.Files {
-			filename := maybeTruncate(*attachment.Filename)
+			filename := maybeTruncate(attachment.GetFilename())
+			var saving bool
+			for _, save := range msg.saves {
+				if save.index == i {
+					saving = true
+					break
+				}
+			}
+			// The type is determined from the contents since the
+			// filename was chosen by the sender.
+			contentType := detectAttachmentType(attachment.Contents)
 			grid.rows = append(grid.rows, []GridE{
+				{1, 1, Image{
+					widgetBase: widgetBase{vAlign: AlignCenter},
+					icon:       contentType.icon,
+				}},
 				{1, 1, Label{
 					widgetBase: widgetBase{vAlign: AlignCenter, hAlign: AlignStart},
 					text:       filename,
 				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{
+						name:       fmt.Sprintf("attachment-type-%d", i),
+						foreground: c.theme().subline,
+						vAlign:     AlignCenter,
+						hAlign:     AlignStart,
+					},
+					text: contentType.label,
+				}},
 				{1, 1, Button{
-					widgetBase: widgetBase{name: fmt.Sprintf("%s%d", attachmentPrefix, i)},
-					text:       "Save",
+					widgetBase: widgetBase{
+						name:        fmt.Sprintf("%s%d", attachmentPrefix, i),
+						insensitive: saving,
+					},
+					text: "Save",
 				}},
 			})
+			saveVBox := VBox{
+				widgetBase: widgetBase{name: fmt.Sprintf("%s%d", attachmentSaveVBoxPrefix, i)},
+			}
+			if saving {
+				saveVBox.children = widgetsForAttachmentSave(i)
+			}
+			grid.rows = append(grid.rows, []GridE{{4, 1, saveVBox}})
+			if !contentType.isImage {
+				continue
+			}
+			if thumbnail := attachmentThumbnail(attachment.Contents); thumbnail != nil {
+				grid.rows = append(grid.rows, []GridE{
+					{4, 1, Image{
+						widgetBase: widgetBase{hAlign: AlignStart},
+						png:        thumbnail,
+					}},
+				})
+			}
 		}
 
 		c.gui.Actions() <- InsertRow{name: "lhs", pos: lhsNextRow, row: []GridE{
 			{1, 1, Label{
-				widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 				text:       "ATTACHMENTS",
 			}},
 		}}
@@ -1361,7 +2898,7 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 		grid := Grid{widgetBase: widgetBase{name: "detachment-grid", marginLeft: 25}, rowSpacing: 3}
 
 		for i, detachment := range msg.message.DetachedFiles {
-			filename := maybeTruncate(*detachment.Filename)
+			filename := maybeTruncate(detachment.GetFilename())
 			var pending *pendingDecryption
 			for _, candidate := range msg.decryptions {
 				if candidate.index == i {
@@ -1412,7 +2949,7 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 
 		c.gui.Actions() <- InsertRow{name: "lhs", pos: lhsNextRow, row: []GridE{
 			{1, 1, Label{
-				widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 				text:       "KEYS",
 			}},
 		}}
@@ -1430,6 +2967,9 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 	if msg.decryptions == nil {
 		msg.decryptions = make(map[uint64]*pendingDecryption)
 	}
+	if msg.saves == nil {
+		msg.saves = make(map[uint64]*pendingDecryption)
+	}
 
 NextEvent:
 	for {
@@ -1438,6 +2978,16 @@ NextEvent:
 			return event
 		}
 
+		if c.processMessageExport(event, msg.message) {
+			continue
+		}
+		if !isPending && c.processCopyBody(event, msgText) {
+			continue
+		}
+		if c.processMessageDetails(event, &detailsShown) {
+			continue
+		}
+
 		// These types are returned by the UI from a file dialog and
 		// serve to identify the actions that should be taken with the
 		// resulting filename.
@@ -1450,13 +3000,51 @@ NextEvent:
 				inPath string
 			}
 			detachmentDownloadIndex int
+			rawBodySave             struct{}
 		)
 
 		if open, ok := event.(OpenResult); ok && open.ok {
 			switch i := open.arg.(type) {
 			case attachmentSaveIndex:
-				// Save an attachment to disk.
-				ioutil.WriteFile(open.path, msg.message.Files[i].Contents, 0600)
+				// Save an attachment to disk in the background so
+				// that large attachments don't block the UI.
+				for _, save := range msg.saves {
+					if save.index == int(i) {
+						continue NextEvent
+					}
+				}
+				c.gui.Actions() <- Sensitive{
+					name:      fmt.Sprintf("%s%d", attachmentPrefix, i),
+					sensitive: false,
+				}
+				c.gui.Actions() <- Append{
+					name:     fmt.Sprintf("%s%d", attachmentSaveVBoxPrefix, i),
+					children: widgetsForAttachmentSave(int(i)),
+				}
+				if attachment := msg.message.Files[i]; !attachmentIntact(attachment) {
+					// The file is still saved since it may be
+					// mostly usable, but the user is warned.
+					c.log.Errorf("Attachment %q from message %x doesn't match its hash", attachment.GetFilename(), msg.id)
+					c.gui.Actions() <- Append{
+						name: fmt.Sprintf("%s%d", attachmentSaveVBoxPrefix, i),
+						children: []Widget{
+							Label{
+								widgetBase: widgetBase{name: fmt.Sprintf("%s%d", attachmentWarningPrefix, i), foreground: colorRed},
+								text:       "This attachment was damaged in transit: its contents don't match the hash that the sender included.",
+								wrap:       300,
+							},
+						},
+					}
+				}
+				id := c.randId()
+				msg.saves[id] = &pendingDecryption{
+					index:  int(i),
+					cancel: c.startAttachmentSave(id, open.path, msg.message.Files[i].Contents),
+				}
+				c.gui.Signal()
+			case rawBodySave:
+				// Save the undecoded body to disk.
+				ioutil.WriteFile(open.path, msg.message.Body, 0600)
 			case detachmentSaveIndex:
 				// Save a detachment key to disk.
 				bytes, err := proto.Marshal(msg.message.DetachedFiles[i])
@@ -1540,11 +3128,34 @@ NextEvent:
 			continue
 		}
 
+		if link, ok := event.(LinkClicked); ok && link.name == "formattedbody" {
+			c.openURL(link.uri)
+			return c.showInbox(msg.id)
+		}
+
 		click, ok := event.(Click)
 		if !ok {
 			continue
 		}
 		switch {
+		case strings.HasPrefix(click.name, introductionPrefix):
+			i, _ := strconv.Atoi(click.name[len(introductionPrefix):])
+			c.inboxUI.Deselect()
+			return c.introductionUI(c.ContactName(msg.from), introductions[i])
+		case strings.HasPrefix(click.name, attachmentCancelPrefix):
+			i, _ := strconv.Atoi(click.name[len(attachmentCancelPrefix):])
+			for _, save := range msg.saves {
+				if save.index == i && save.cancel != nil {
+					save.cancel()
+					// The task may take a moment to notice
+					// and the cancel function mustn't be
+					// called twice.
+					save.cancel = nil
+					c.gui.Actions() <- Sensitive{name: click.name, sensitive: false}
+					c.gui.Signal()
+				}
+			}
+			continue
 		case strings.HasPrefix(click.name, attachmentPrefix):
 			i, _ := strconv.Atoi(click.name[len(attachmentPrefix):])
 			c.gui.Actions() <- FileOpen{
@@ -1594,14 +3205,29 @@ NextEvent:
 		case click.name == "reply":
 			c.inboxUI.Deselect()
 			return c.composeUI(nil, msg)
+		case click.name == "thread":
+			return c.threadUI(msg.message.GetId(), c.ContactName(msg.from))
+		case click.name == "showcontact":
+			c.inboxUI.Deselect()
+			c.contactsUI.Select(msg.from)
+			c.selectedList, c.selectedId = selectionContact, msg.from
+			return c.showContact(msg.from)
 		case click.name == "delete":
 			c.inboxUI.Remove(msg.id)
 			c.deleteInboxMsg(msg.id)
-			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
 			c.gui.Actions() <- UIState{uiStateMain}
 			c.gui.Signal()
 			c.save()
 			return nil
+		case click.name == "saverawbody":
+			c.gui.Actions() <- FileOpen{
+				save:     true,
+				title:    "Save raw message body",
+				filename: fmt.Sprintf("message-%s.body", strings.ToLower(msg.message.GetBodyEncoding().String())),
+				arg:      rawBodySave{},
+			}
+			c.gui.Signal()
 		case click.name == "retain":
 			msg.retained = click.checks["retain"]
 			if !msg.retained {
@@ -1611,6 +3237,14 @@ NextEvent:
 			c.save()
 			c.gui.Actions() <- UIState{uiStateInbox}
 			c.gui.Signal()
+		case click.name == "viewraw" && formatBody:
+			var body Widget = formattedBody
+			if click.checks["viewraw"] {
+				body = rawBody
+			}
+			c.gui.Actions() <- SetBoxContents{name: "bodybox", child: body}
+			c.gui.Actions() <- UIState{uiStateInbox}
+			c.gui.Signal()
 		}
 	}
 
@@ -1629,16 +3263,21 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 		panic("failed to find message in outbox")
 	}
 
-	contact := c.contacts[msg.to]
+	// The contact may have been deleted since the message was sent.
+	contact, haveContact := c.contacts[msg.to]
+	revokedUs := func() bool {
+		return haveContact && contact.revokedUs
+	}
+	contactName := c.ContactName(msg.to)
 	var sentTime string
-	if contact.revokedUs {
+	if revokedUs() && msg.sent.IsZero() {
 		sentTime = "(never - contact has revoked us)"
 	} else {
-		sentTime = formatTime(msg.sent)
+		sentTime = formatStepTime(msg.sent, msg.enqueued)
 	}
-	eraseTime := formatTime(msg.created.Add(messageLifetime))
+	eraseTime := formatEraseTime(c.outboxEraseTime(msg))
 
-	canAbort := !contact.revokedUs && msg.sent.IsZero()
+	canAbort := !revokedUs() && msg.sent.IsZero()
 	if canAbort {
 		c.queueMutex.Lock()
 		if msg.sending {
@@ -1654,23 +3293,34 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 		rows: [][]GridE{
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "TO",
 				}},
-				{1, 1, Label{text: contact.name}},
+				{1, 1, Label{text: contactName}},
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "CREATED",
 				}},
 				{1, 1, Label{
-					text: time.Unix(*msg.message.Time, 0).Format(time.RFC1123),
+					widgetBase: widgetBase{name: "created"},
+					text:       formatTime(msg.created),
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					text:       "QUEUED",
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{name: "queued"},
+					text:       formatStepTime(msg.enqueued, msg.created),
 				}},
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "SENT",
 				}},
 				{1, 1, Label{
@@ -1680,21 +3330,22 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "ACKNOWLEDGED",
 				}},
 				{1, 1, Label{
 					widgetBase: widgetBase{name: "acked"},
-					text:       formatTime(msg.acked),
+					text:       formatStepTime(msg.acked, msg.sent),
 				}},
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "ERASE",
 				}},
 				{1, 1, Label{
-					text: eraseTime,
+					widgetBase: widgetBase{name: "erase"},
+					text:       eraseTime,
 				}},
 			},
 		},
@@ -1723,17 +3374,135 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 					text: "Delete",
 				}},
 			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "resend",
+						insensitive: !c.canResend(msg),
+					},
+					text: "Resend",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "thread",
+						insensitive: msg.message == nil || !c.hasThread(msg.message.GetId()),
+					},
+					text: "Show Thread",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "copybody",
+						insensitive: msg.message == nil,
+					},
+					text: "Copy Body",
+				}},
+			},
+			{
+				{1, 1, CheckButton{
+					widgetBase: widgetBase{
+						name: "retain",
+					},
+					checked: msg.retained,
+					text:    "Retain",
+				}},
+			},
 		},
 	}
+	right.rows = append(right.rows, exportMessageRows(msg.revocation || msg.message == nil)...)
+	right.rows = append(right.rows, messageDetailsRow())
+
+	const (
+		detachmentStatusPrefix  = "detachment-status-"
+		detachmentRevokePrefix  = "detachment-revoke-"
+		detachmentReplacePrefix = "detachment-replace-"
+	)
+
+	// Detachments that we uploaded can be revoked, or replaced, once the
+	// message has been sent.
+	refs := c.detachmentReferences(msg)
+	if len(refs) > 0 {
+		grid := Grid{widgetBase: widgetBase{marginLeft: 25}, rowSpacing: 3, colSpacing: 3}
+		for _, ref := range refs {
+			insensitive := !c.canRevoke(msg, ref)
+			grid.rows = append(grid.rows, []GridE{
+				{1, 1, Label{
+					widgetBase: widgetBase{vAlign: AlignCenter, hAlign: AlignStart},
+					text:       maybeTruncate(msg.message.DetachedFiles[ref.index].GetFilename()),
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        fmt.Sprintf("%s%d", detachmentRevokePrefix, ref.index),
+						padding:     3,
+						insensitive: insensitive,
+					},
+					text: "Revoke",
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        fmt.Sprintf("%s%d", detachmentReplacePrefix, ref.index),
+						padding:     3,
+						insensitive: insensitive,
+					},
+					text: "Replace",
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{
+						name:   fmt.Sprintf("%s%d", detachmentStatusPrefix, ref.index),
+						vAlign: AlignCenter,
+					},
+					text: c.revocationStatus(ref),
+					wrap: 200,
+				}},
+			})
+		}
+		left.rows = append(left.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				text:       "DETACHMENTS",
+			}},
+		}, []GridE{
+			{2, 1, grid},
+		})
+	}
+	// updateDetachments updates the status, and buttons, of each
+	// detachment as revocations start and finish.
+	updateDetachments := func() {
+		refs = c.detachmentReferences(msg)
+		for _, ref := range refs {
+			sensitive := c.canRevoke(msg, ref)
+			c.gui.Actions() <- SetText{name: fmt.Sprintf("%s%d", detachmentStatusPrefix, ref.index), text: c.revocationStatus(ref)}
+			c.gui.Actions() <- Sensitive{name: fmt.Sprintf("%s%d", detachmentRevokePrefix, ref.index), sensitive: sensitive}
+			c.gui.Actions() <- Sensitive{name: fmt.Sprintf("%s%d", detachmentReplacePrefix, ref.index), sensitive: sensitive}
+		}
+	}
+	// revokeArmed records which revoke and replace buttons have been
+	// clicked once and are waiting for confirmation.
+	revokeArmed := make(map[string]bool)
+
+	left.rows = append(left.rows, []GridE{
+		{2, 1, c.messageIdsFrame([]messageIdField{
+			{"messageid", "MESSAGE ID", msg.message.GetId()},
+			{"localid", "LOCAL ID", msg.id},
+			{"contactid", "TO CONTACT", msg.to},
+			{"inreplytoid", "IN REPLY TO", msg.message.GetInReplyTo()},
+		})},
+	})
 
+	body, _ := decodeBody(msg.message)
 	main := TextView{
-		widgetBase: widgetBase{vExpand: true, hExpand: true, name: "body"},
+		widgetBase: widgetBase{vExpand: true, hExpand: true, name: "body", font: c.messageFont()},
 		editable:   false,
-		text:       string(msg.message.Body),
+		text:       body,
 		wrap:       true,
 	}
 
-	c.gui.Actions() <- SetChild{name: "right", child: rightPane("SENT MESSAGE", left, right, main)}
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "SENT MESSAGE", left, right, main)}
+	c.gui.Actions() <- SetVisible{name: "messageids", visible: false}
+	detailsShown := false
 	c.gui.Actions() <- UIState{uiStateOutbox}
 	c.gui.Signal()
 
@@ -1746,6 +3515,52 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 			return event
 		}
 
+		if _, ok := event.(outboxChanged); ok {
+			// The labels and buttons are only updated when the
+			// message's state has actually changed.
+			changed := false
+			if !haveSentTime && !msg.sent.IsZero() {
+				haveSentTime = true
+				c.gui.Actions() <- SetText{name: "sent", text: formatStepTime(msg.sent, msg.enqueued)}
+				changed = true
+			}
+			if !haveAckTime && !msg.acked.IsZero() {
+				haveAckTime = true
+				c.gui.Actions() <- SetText{name: "acked", text: formatStepTime(msg.acked, msg.sent)}
+				changed = true
+			}
+
+			c.queueMutex.Lock()
+			nowCanAbort := !revokedUs() && msg.sent.IsZero() && !msg.sending
+			c.queueMutex.Unlock()
+			if nowCanAbort != canAbort {
+				canAbort = nowCanAbort
+				c.gui.Actions() <- Sensitive{name: "abort", sensitive: canAbort}
+				c.gui.Actions() <- Sensitive{name: "delete", sensitive: !canAbort}
+				changed = true
+			}
+
+			if len(refs) > 0 {
+				updateDetachments()
+				changed = true
+			}
+
+			if changed {
+				c.gui.Signal()
+			}
+			continue
+		}
+
+		if c.processMessageExport(event, msg.message) {
+			continue
+		}
+		if msg.message != nil && c.processCopyBody(event, body) {
+			continue
+		}
+		if c.processMessageDetails(event, &detailsShown) {
+			continue
+		}
+
 		if click, ok := event.(Click); ok && click.name == "abort" {
 			c.queueMutex.Lock()
 			indexOfMessage := c.indexOfQueuedMessage(msg)
@@ -1770,10 +3585,88 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 			c.draftsUI.Add(draft.id, c.ContactName(msg.to), draft.created.Format(shortTimeFormat), indicatorNone)
 			c.draftsUI.Select(draft.id)
 			c.drafts[draft.id] = draft
+			c.updateDraftIndicators(draft.to)
 			c.save()
 			return c.composeUI(draft, nil)
 		}
 
+		if click, ok := event.(Click); ok && click.name == "resend" {
+			if !c.canResend(msg) {
+				c.gui.Actions() <- Sensitive{name: "resend", sensitive: false}
+				c.gui.Signal()
+				continue
+			}
+			newMsg := c.resend(msg)
+			c.outboxUI.Remove(msg.id)
+			c.outboxUI.Add(newMsg.id, contactName, newMsg.created.Format(shortTimeFormat), c.outboxIndicator(newMsg))
+			c.setMessageDetail(c.outboxUI, newMsg.id, newMsg.message)
+			c.save()
+			c.outboxUI.Select(newMsg.id)
+			return c.showOutbox(newMsg.id)
+		}
+
+		if click, ok := event.(Click); ok && click.name == "thread" {
+			return c.threadUI(msg.message.GetId(), contactName)
+		}
+
+		if click, ok := event.(Click); ok && (strings.HasPrefix(click.name, detachmentRevokePrefix) || strings.HasPrefix(click.name, detachmentReplacePrefix)) {
+			replace := strings.HasPrefix(click.name, detachmentReplacePrefix)
+			var index int
+			if replace {
+				index, _ = strconv.Atoi(click.name[len(detachmentReplacePrefix):])
+			} else {
+				index, _ = strconv.Atoi(click.name[len(detachmentRevokePrefix):])
+			}
+			var ref *detachmentReference
+			for i := range refs {
+				if refs[i].index == index {
+					ref = &refs[i]
+					break
+				}
+			}
+			if ref == nil || !c.canRevoke(msg, *ref) {
+				continue
+			}
+			if !revokeArmed[click.name] {
+				revokeArmed[click.name] = true
+				c.gui.Actions() <- SetButtonText{name: click.name, text: "Confirm"}
+				c.gui.Signal()
+				continue
+			}
+			delete(revokeArmed, click.name)
+
+			pending := &pendingRevocation{
+				taskID:  c.randId(),
+				msg:     msg,
+				ref:     *ref,
+				replace: replace,
+			}
+			var newID uint64
+			if replace {
+				newID = c.randId()
+			}
+			if c.revocations == nil {
+				c.revocations = make(map[uint64]*pendingRevocation)
+			}
+			c.revocations[ref.id] = pending
+			c.startRevocation(pending.taskID, *ref, msg.message.DetachedFiles[index], newID)
+
+			c.gui.Actions() <- SetButtonText{name: fmt.Sprintf("%s%d", detachmentRevokePrefix, index), text: "Revoke"}
+			c.gui.Actions() <- SetButtonText{name: fmt.Sprintf("%s%d", detachmentReplacePrefix, index), text: "Replace"}
+			updateDetachments()
+			c.gui.Signal()
+			continue
+		}
+
+		if click, ok := event.(Click); ok && click.name == "retain" {
+			msg.retained = click.checks["retain"]
+			c.gui.Actions() <- SetText{name: "erase", text: formatEraseTime(c.outboxEraseTime(msg))}
+			c.gui.Actions() <- UIState{uiStateOutbox}
+			c.gui.Signal()
+			c.save()
+			continue
+		}
+
 		if click, ok := event.(Click); ok && click.name == "delete" {
 			c.deleteOutboxMsg(msg.id)
 			// Also find and delete any empty acks for this message.
@@ -1787,40 +3680,252 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 			if msg.revocation || len(msg.message.Body) > 0 {
 				c.outboxUI.Remove(msg.id)
 			}
-			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
 			c.gui.Actions() <- UIState{uiStateMain}
 			c.gui.Signal()
 			return nil
 		}
+	}
 
-		if !haveSentTime && !msg.sent.IsZero() {
-			c.gui.Actions() <- SetText{name: "sent", text: formatTime(msg.sent)}
-			c.gui.Signal()
+	return nil
+}
+
+// pendingRevocation is a detachment that is being, or failed to be, revoked
+// from the outbox UI.
+type pendingRevocation struct {
+	// taskID identifies the background task that's revoking the file, or
+	// is zero if it has finished.
+	taskID uint64
+	msg    *queuedMessage
+	ref    detachmentReference
+	// replace is true if the file is being replaced, rather than just
+	// revoked.
+	replace bool
+	// err is the reason that the revocation failed, if it has.
+	err error
+}
+
+// canRevoke returns true if the user can revoke, or replace, the file that
+// ref, in msg, refers to.
+func (c *guiClient) canRevoke(msg *queuedMessage, ref detachmentReference) bool {
+	if msg.sent.IsZero() || ref.revoked {
+		return false
+	}
+	pending, ok := c.revocations[ref.id]
+	return !ok || pending.taskID == 0
+}
+
+// revocationStatus describes the state of the file that ref refers to.
+func (c *guiClient) revocationStatus(ref detachmentReference) string {
+	if ref.revoked {
+		return "Revoked"
+	}
+	pending, ok := c.revocations[ref.id]
+	switch {
+	case !ok:
+		return ""
+	case pending.taskID == 0:
+		return "Failed: " + pending.err.Error()
+	case pending.replace:
+		return "Replacing..."
+	}
+	return "Revoking..."
+}
+
+// processRevocationResult handles the result of a background task started by
+// startRevocation. Since the user may have moved on from the message, the
+// result is processed here rather than in showOutbox. It returns true if
+// event was such a result.
+func (c *guiClient) processRevocationResult(event interface{}) bool {
+	var taskID uint64
+	var replacement *pond.Message_Detachment
+	var err error
+	switch event := event.(type) {
+	case DetachmentComplete:
+		taskID, replacement = event.id, event.detachment
+	case DetachmentError:
+		taskID, err = event.id, event.err
+	default:
+		return false
+	}
+
+	for id, pending := range c.revocations {
+		if pending.taskID != taskID {
+			continue
 		}
-		if !haveAckTime && !msg.acked.IsZero() {
-			c.gui.Actions() <- SetText{name: "acked", text: formatTime(msg.acked)}
-			c.gui.Signal()
+		pending.taskID = 0
+		if err != nil {
+			c.log.Errorf("Failed to revoke detachment %x: %s", id, err)
+			pending.err = err
+			return true
 		}
-
-		canAbortChanged := false
-		c.queueMutex.Lock()
-		if c := !contact.revokedUs && msg.sent.IsZero() && !msg.sending; c != canAbort {
-			canAbort = c
-			canAbortChanged = true
+		delete(c.revocations, id)
+		if draft := c.finishRevocation(pending.msg, pending.ref, replacement); draft != nil {
+			c.draftsUI.Add(draft.id, c.ContactName(draft.to), draft.created.Format(shortTimeFormat), indicatorNone)
+			c.updateDraftIndicators(draft.to)
 		}
-		c.queueMutex.Unlock()
+		return true
+	}
+	return false
+}
+
+// messageExportArg is passed to FileOpen when selecting the path to which a
+// message is exported.
+type messageExportArg struct {
+	passphrase string
+}
+
+// exportMessageRows returns the rows, for the right-hand side of a message
+// view, that allow the message to be exported.
+func exportMessageRows(insensitive bool) [][]GridE {
+	return [][]GridE{
+		{
+			{1, 1, Label{
+				widgetBase: widgetBase{marginTop: 10},
+				text:       "Export passphrase:",
+			}},
+		},
+		{
+			{1, 1, Entry{
+				widgetBase: widgetBase{name: "exportpassphrase", insensitive: insensitive},
+				width:      20,
+				password:   true,
+			}},
+		},
+		{
+			{1, 1, Button{
+				widgetBase: widgetBase{name: "export", insensitive: insensitive},
+				text:       "Export...",
+			}},
+		},
+		{
+			{1, 1, Label{
+				widgetBase: widgetBase{name: "exportstatus"},
+				wrap:       200,
+			}},
+		},
+	}
+}
 
-		if canAbortChanged {
-			c.gui.Actions() <- Sensitive{name: "abort", sensitive: canAbort}
-			c.gui.Actions() <- Sensitive{name: "delete", sensitive: !canAbort}
+// processMessageExport handles the events that export msg to an encrypted
+// file. It returns true if event was such an event.
+func (c *guiClient) processMessageExport(event interface{}, msg *pond.Message) bool {
+	switch event := event.(type) {
+	case Click:
+		if event.name != "export" {
+			return false
+		}
+		passphrase := event.entries["exportpassphrase"]
+		if len(passphrase) == 0 {
+			c.gui.Actions() <- SetText{name: "exportstatus", text: "A passphrase is needed to encrypt the exported message"}
 			c.gui.Signal()
+			return true
+		}
+		c.gui.Actions() <- FileOpen{
+			save:     true,
+			title:    "Export message",
+			filename: "message.pond",
+			arg:      messageExportArg{passphrase},
+		}
+		c.gui.Signal()
+		return true
+	case OpenResult:
+		arg, ok := event.arg.(messageExportArg)
+		if !ok {
+			return false
+		}
+		if !event.ok {
+			return true
+		}
+		status := "Exported to " + event.path
+		if err := c.exportMessage(event.path, arg.passphrase, msg); err != nil {
+			status = err.Error()
+			c.gui.Actions() <- UIError{err}
+		}
+		c.gui.Actions() <- SetText{name: "exportstatus", text: status}
+		c.gui.Signal()
+		return true
+	}
+	return false
+}
+
+// messageIdField is one of the ids shown by messageIdsFrame.
+type messageIdField struct {
+	// name names the label that shows the id.
+	name  string
+	title string
+	id    uint64
+}
+
+// messageIdsFrame returns a frame, for the left-hand side of a message view,
+// that shows the ids of the message. They aren't meaningful to most users but
+// help when debugging delivery problems, so the frame should be hidden until
+// the details button, from messageDetailsRow, is clicked.
+func (c *guiClient) messageIdsFrame(fields []messageIdField) Widget {
+	var entries []nvEntry
+	for _, field := range fields {
+		value := "(none)"
+		if field.id != 0 {
+			value = fmt.Sprintf("%016x", field.id)
 		}
+		entries = append(entries, nvEntry{field.title, value})
 	}
 
-	return nil
+	grid := nameValuesLHS(c.theme(), entries).(Grid)
+	grid.name = "messageidsgrid"
+	for i, field := range fields {
+		label := grid.rows[i][1].widget.(Label)
+		label.name = field.name
+		label.font = fontMainMono
+		grid.rows[i][1].widget = label
+	}
+	return Frame{
+		widgetBase: widgetBase{name: "messageids", padding: 2},
+		child:      grid,
+	}
+}
+
+// messageDetailsRow returns the row, for the right-hand side of a message view,
+// with the button that shows and hides the frame from messageIdsFrame.
+func messageDetailsRow() []GridE {
+	return []GridE{
+		{1, 1, Button{
+			widgetBase: widgetBase{name: "details"},
+			text:       "Show Details",
+		}},
+	}
+}
+
+// processMessageDetails handles a click on the button from messageDetailsRow.
+// shown records whether the details are currently shown. It returns true if
+// event was such a click.
+func (c *guiClient) processMessageDetails(event interface{}, shown *bool) bool {
+	if click, ok := event.(Click); !ok || click.name != "details" {
+		return false
+	}
+	*shown = !*shown
+	text := "Show Details"
+	if *shown {
+		text = "Hide Details"
+	}
+	c.gui.Actions() <- SetVisible{name: "messageids", visible: *shown}
+	c.gui.Actions() <- SetButtonText{name: "details", text: text}
+	c.gui.Signal()
+	return true
+}
+
+// processCopyBody handles a click on the "Copy Body" button of a message view
+// by putting body on the clipboard. It returns true if event was such a click.
+func (c *guiClient) processCopyBody(event interface{}, body string) bool {
+	if click, ok := event.(Click); !ok || click.name != "copybody" {
+		return false
+	}
+	c.gui.Actions() <- SetClipboard{body}
+	c.gui.Signal()
+	return true
 }
 
-func rightPane(title string, left, right, main Widget) Grid {
+func rightPane(t *theme, title string, left, right, main Widget) Grid {
 	var mid []GridE
 	if left != nil {
 		mid = append(mid, GridE{1, 1, left})
@@ -1834,15 +3939,15 @@ func rightPane(title string, left, right, main Widget) Grid {
 		rows: [][]GridE{
 			{
 				{3, 1, EventBox{
-					widgetBase: widgetBase{background: colorHeaderBackground, hExpand: true},
+					widgetBase: widgetBase{background: t.headerBackground, hExpand: true},
 					child: Label{
-						widgetBase: widgetBase{font: fontMainTitle, margin: 10, foreground: colorHeaderForeground, hExpand: true},
+						widgetBase: widgetBase{font: fontMainTitle, margin: 10, foreground: t.headerForeground, hExpand: true},
 						text:       title,
 					},
 				}},
 			},
 			{
-				{3, 1, EventBox{widgetBase: widgetBase{height: 1, background: colorSep}}},
+				{3, 1, EventBox{widgetBase: widgetBase{height: 1, background: t.sep}}},
 			},
 			mid,
 			{},
@@ -1860,16 +3965,84 @@ type nvEntry struct {
 	name, value string
 }
 
-func nameValuesLHS(entries []nvEntry) Widget {
-	grid := Grid{
-		widgetBase: widgetBase{margin: 6, name: "lhs"},
-		rowSpacing: 3,
-		colSpacing: 3,
+// ratchetAuditWidget returns a panel showing the history of the DH ratchet
+// with a contact. willAdvance is true if we'll advance the ratchet with the
+// next message that we send.
+func ratchetAuditWidget(t *theme, audit ratchetAudit, willAdvance bool) Widget {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "Not yet observed"
+		}
+		return t.Format(logTimeFormat)
 	}
-	for _, ent := range entries {
-		var font string
-		vAlign := AlignCenter
-		if strings.HasPrefix(ent.value, "-----") {
+
+	sent := fmt.Sprintf("%d", audit.sentSinceTheirAdvance)
+	if audit.sentSinceTheirAdvance > 0 {
+		sent += ", the first at " + audit.firstSentSinceTheirAdvance.Format(logTimeFormat)
+	}
+	nextSend := "No"
+	if willAdvance {
+		nextSend = "Yes"
+	}
+	status := "OK"
+	var statusColor uint32
+	if audit.stalled {
+		status = fmt.Sprintf("Stalled: %d messages have been sent without the contact advancing the ratchet. They may not be receiving messages.", audit.sentSinceTheirAdvance)
+		statusColor = colorError
+	}
+
+	rows := [][]GridE{}
+	for _, ent := range []nvEntry{
+		{"THEY ADVANCED", formatTime(audit.theirAdvanced)},
+		{"WE ADVANCED", formatTime(audit.ourAdvanced)},
+		{"SENT SINCE", sent},
+		{"ADVANCE ON SEND", nextSend},
+	} {
+		rows = append(rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: t.headerForegroundSmall, hAlign: AlignEnd, vAlign: AlignCenter},
+				text:       ent.name,
+			}},
+			{1, 1, Label{
+				widgetBase: widgetBase{hAlign: AlignStart},
+				text:       ent.value,
+				selectable: true,
+			}},
+		})
+	}
+	rows = append(rows, []GridE{
+		{1, 1, Label{
+			widgetBase: widgetBase{font: fontMainLabel, foreground: t.headerForegroundSmall, hAlign: AlignEnd, vAlign: AlignCenter},
+			text:       "STATUS",
+		}},
+		{1, 1, Label{
+			widgetBase: widgetBase{name: "ratchetstatus", foreground: statusColor, hAlign: AlignStart},
+			text:       status,
+			wrap:       400,
+		}},
+	})
+
+	return Frame{
+		widgetBase: widgetBase{name: "ratchetaudit", padding: 2},
+		child: Grid{
+			widgetBase: widgetBase{margin: 6},
+			rowSpacing: 3,
+			colSpacing: 3,
+			rows:       rows,
+		},
+	}
+}
+
+func nameValuesLHS(t *theme, entries []nvEntry) Widget {
+	grid := Grid{
+		widgetBase: widgetBase{margin: 6, name: "lhs"},
+		rowSpacing: 3,
+		colSpacing: 3,
+	}
+	for _, ent := range entries {
+		var font string
+		vAlign := AlignCenter
+		if strings.HasPrefix(ent.value, "-----") {
 			// PEM block
 			font = fontMainMono
 			vAlign = AlignStart
@@ -1877,7 +4050,7 @@ func nameValuesLHS(entries []nvEntry) Widget {
 
 		grid.rows = append(grid.rows, []GridE{
 			GridE{1, 1, Label{
-				widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: vAlign},
+				widgetBase: widgetBase{font: fontMainLabel, foreground: t.headerForeground, hAlign: AlignEnd, vAlign: vAlign},
 				text:       ent.name,
 			}},
 			GridE{1, 1, Label{
@@ -1891,22 +4064,1192 @@ func nameValuesLHS(entries []nvEntry) Widget {
 	return grid
 }
 
-func (c *guiClient) identityUI() interface{} {
-	entries := nameValuesLHS([]nvEntry{
-		{"SERVER", c.server},
-		{"PUBLIC IDENTITY", fmt.Sprintf("%x", c.identityPublic[:])},
-		{"PUBLIC KEY", fmt.Sprintf("%x", c.pub[:])},
-		{"STATE FILE", c.stateFilename},
-		{"GROUP GENERATION", fmt.Sprintf("%d", c.generation)},
-	})
+// maskedKeyDigits is the number of hex digits of a key that are shown while
+// keys are masked. It's enough to compare keys at a glance but not to be
+// useful to someone looking over the user's shoulder.
+const maskedKeyDigits = 16
+
+// keyField is a public key that's displayed in a grid built by
+// nameValuesLHS.
+type keyField struct {
+	// row is the row of the grid that contains the key.
+	row int
+	// name is used to name the widgets for the key: the label is
+	// name+"value" and the buttons are "show"+name and "copy"+name.
+	name string
+	// value is the key in hex.
+	value string
+}
+
+// addKeyFieldButtons adds Copy buttons for fields to grid, which was built by
+// nameValuesLHS. If keys are masked then only the start of each key is shown
+// and a Show button is added to reveal the rest. The Copy buttons always copy
+// the whole key.
+func (c *guiClient) addKeyFieldButtons(grid *Grid, fields []keyField) {
+	for _, field := range fields {
+		row := grid.rows[field.row]
+		label := row[1].widget.(Label)
+		label.name = field.name + "value"
+		if c.maskKeys && len(field.value) > maskedKeyDigits {
+			label.text = field.value[:maskedKeyDigits] + "…"
+			row = append(row, GridE{1, 1, Button{
+				widgetBase: widgetBase{name: "show" + field.name, vAlign: AlignCenter},
+				text:       "Show",
+			}})
+		}
+		row[1].widget = label
+		grid.rows[field.row] = append(row, GridE{1, 1, Button{
+			widgetBase: widgetBase{name: "copy" + field.name, vAlign: AlignCenter},
+			text:       "Copy",
+		}})
+	}
+}
+
+// keyFieldClick handles a click on one of the buttons added by
+// addKeyFieldButtons and returns true if click was for one of them.
+func (c *guiClient) keyFieldClick(click Click, fields []keyField) bool {
+	for _, field := range fields {
+		switch click.name {
+		case "show" + field.name:
+			c.gui.Actions() <- SetText{name: field.name + "value", text: field.value}
+			c.gui.Actions() <- SetVisible{name: "show" + field.name, visible: false}
+		case "copy" + field.name:
+			c.gui.Actions() <- SetClipboard{field.value}
+		default:
+			continue
+		}
+		c.gui.Signal()
+		return true
+	}
+	return false
+}
+
+// networkUI shows the SOCKS5 proxy settings and allows them to be changed.
+func (c *guiClient) networkUI() interface{} {
+	var host, port string
+	if len(c.proxyAddress) > 0 {
+		host, port, _ = net.SplitHostPort(c.proxyAddress)
+	}
 
 	left := Grid{
 		widgetBase: widgetBase{margin: 6},
-		rowSpacing: 10,
+		rowSpacing: 3,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{2, 1, Label{
+					text: "All connections are made via a SOCKS5 proxy, which is normally a local Tor instance. By default, Pond looks for Tor on ports 9050 and 9150 of the local host. Enter a host and port below to use a different proxy, or leave them empty to use the default.",
+					wrap: 600,
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "currentproxy"},
+					text:       "Currently using " + c.proxyAddr(),
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground},
+					text:       "PROXY HOST",
+				}},
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "proxyhost", hAlign: AlignStart, hExpand: true},
+					width:      40,
+					text:       host,
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground},
+					text:       "PROXY PORT",
+				}},
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "proxyport", hAlign: AlignStart},
+					width:      6,
+					text:       port,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "saveproxy"},
+					text:       "Save",
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{
+						name:       "proxyerror",
+						foreground: colorRed,
+					},
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "NETWORK", left, nil, nil)}
+	c.gui.Actions() <- UIState{uiStateNetwork}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		click, ok := event.(Click)
+		if !ok || click.name != "saveproxy" {
+			continue
+		}
+
+		host := click.entries["proxyhost"]
+		port := click.entries["proxyport"]
+		var addr string
+		if len(strings.TrimSpace(host)) > 0 || len(strings.TrimSpace(port)) > 0 {
+			var err error
+			if addr, err = parseProxyAddress(host, port); err != nil {
+				c.gui.Actions() <- SetText{name: "proxyerror", text: err.Error()}
+				c.gui.Actions() <- UIError{err}
+				c.gui.Signal()
+				continue
+			}
+		}
+
+		c.setProxyAddress(addr)
+		c.save()
+		c.log.Printf("SOCKS5 proxy set to %s", c.proxyAddr())
+		c.gui.Actions() <- SetText{name: "proxyerror", text: ""}
+		c.gui.Actions() <- SetText{name: "currentproxy", text: "Currently using " + c.proxyAddr()}
+		c.gui.Actions() <- UIState{uiStateNetwork}
+		c.gui.Signal()
+	}
+
+	panic("unreachable")
+}
+
+// importMessageArg is the arg of a FileOpen that selects a message archive to
+// import.
+type importMessageArg struct{}
+
+// importErrorText returns a description of an error from importMessage.
+func importErrorText(err error) string {
+	switch err {
+	case disk.BadPasswordError:
+		return "Incorrect passphrase for this message archive"
+	case disk.UnsupportedArchiveError:
+		return "This message was exported by a newer version of Pond and cannot be read"
+	case disk.NotArchiveError:
+		return "This file is not an exported message"
+	}
+	return err.Error()
+}
+
+// importMessageUI reads a message that was exported with exportMessage. The
+// message is shown without being added to the inbox.
+func (c *guiClient) importMessageUI() interface{} {
+	left := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{3, 1, Label{
+					text: "A message that was previously exported can be read here. It won't be added to the inbox unless you choose to do so after reading it.",
+					wrap: 600,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "importfile"},
+					text:       "Select file",
+				}},
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "importpath", hExpand: true},
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground},
+					text:       "PASSPHRASE",
+				}},
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "importpassphrase", hAlign: AlignStart},
+					width:      30,
+					password:   true,
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "import", insensitive: true},
+					text:       "Open",
+				}},
+			},
+			{
+				{3, 1, Label{
+					widgetBase: widgetBase{
+						name:       "importerror",
+						foreground: colorRed,
+					},
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "IMPORT MESSAGE", left, nil, nil)}
+	c.gui.Actions() <- UIState{uiStateImportMessage}
+	c.gui.Signal()
+
+	var path string
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		if open, ok := event.(OpenResult); ok {
+			if _, ok := open.arg.(importMessageArg); ok && open.ok {
+				path = open.path
+				c.gui.Actions() <- SetText{name: "importpath", text: path}
+				c.gui.Actions() <- Sensitive{name: "import", sensitive: true}
+				c.gui.Signal()
+			}
+			continue
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		switch click.name {
+		case "importfile":
+			c.gui.Actions() <- FileOpen{
+				title: "Select exported message",
+				arg:   importMessageArg{},
+			}
+			c.gui.Signal()
+		case "import", "importpassphrase":
+			if len(path) == 0 {
+				continue
+			}
+			msg, err := importMessage(path, click.entries["importpassphrase"])
+			if err != nil {
+				c.gui.Actions() <- SetText{name: "importerror", text: importErrorText(err)}
+				c.gui.Signal()
+				continue
+			}
+			return c.importedMessageUI(msg)
+		}
+	}
+
+	panic("unreachable")
+}
+
+// importedMessageUI shows a message that was read from an archive. The
+// message is read-only but can be added to the inbox as if it had been
+// received from a chosen contact.
+func (c *guiClient) importedMessageUI(msg *pond.Message) interface{} {
+	var contactNames []string
+	for _, contact := range c.sortedContacts() {
+		if !contact.isPending {
+			contactNames = append(contactNames, contact.name)
+		}
+	}
+
+	left := Grid{
+		widgetBase: widgetBase{margin: 6, name: "lhs"},
+		rowSpacing: 3,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					text:       "SENT",
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{hExpand: true},
+					text:       time.Unix(msg.GetTime(), 0).Format(time.RFC1123),
+				}},
+			},
+		},
+	}
+
+	const attachmentPrefix = "attachment-"
+	if len(msg.Files) > 0 {
+		grid := Grid{widgetBase: widgetBase{marginLeft: 25}, rowSpacing: 3}
+		for i, attachment := range msg.Files {
+			grid.rows = append(grid.rows, []GridE{
+				{1, 1, Label{
+					widgetBase: widgetBase{vAlign: AlignCenter, hAlign: AlignStart},
+					text:       maybeTruncate(attachment.GetFilename()),
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: fmt.Sprintf("%s%d", attachmentPrefix, i)},
+					text:       "Save",
+				}},
+			})
+		}
+		left.rows = append(left.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				text:       "ATTACHMENTS",
+			}},
+		}, []GridE{{2, 1, grid}})
+	}
+
+	right := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
 		colSpacing: 3,
 		rows: [][]GridE{
 			{
-				{1, 1, entries},
+				{1, 1, Label{text: "Received from:"}},
+			},
+			{
+				{1, 1, Combo{
+					widgetBase: widgetBase{name: "importfrom", insensitive: len(contactNames) == 0},
+					labels:     contactNames,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "addtoinbox", insensitive: len(contactNames) == 0},
+					text:       "Add to Inbox",
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{name: "addtoinboxerror", foreground: colorRed},
+					wrap:       200,
+				}},
+			},
+		},
+	}
+
+	body, err := decodeBody(msg)
+	if err != nil {
+		body = "(cannot display message: " + err.Error() + ")"
+	}
+	main := TextView{
+		widgetBase: widgetBase{hExpand: true, vExpand: true, name: "body", font: c.messageFont()},
+		editable:   false,
+		text:       body,
+		wrap:       true,
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "IMPORTED MESSAGE", left, right, main)}
+	c.gui.Actions() <- UIState{uiStateImportedMessage}
+	c.gui.Signal()
+
+	type attachmentSaveIndex int
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		if open, ok := event.(OpenResult); ok {
+			if i, ok := open.arg.(attachmentSaveIndex); ok && open.ok {
+				ioutil.WriteFile(open.path, msg.Files[i].Contents, 0600)
+			}
+			continue
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(click.name, attachmentPrefix):
+			i, _ := strconv.Atoi(click.name[len(attachmentPrefix):])
+			c.gui.Actions() <- FileOpen{
+				save:     true,
+				title:    "Save Attachment",
+				filename: msg.Files[i].GetFilename(),
+				arg:      attachmentSaveIndex(i),
+			}
+			c.gui.Signal()
+		case click.name == "addtoinbox":
+			var from *Contact
+			for _, contact := range c.contacts {
+				if contact.name == click.combos["importfrom"] && !contact.isPending {
+					from = contact
+					break
+				}
+			}
+			if from == nil {
+				c.gui.Actions() <- SetText{name: "addtoinboxerror", text: "Select the contact that sent this message"}
+				c.gui.Signal()
+				continue
+			}
+			inboxMsg, err := c.addImportedMessage(msg, from)
+			if err != nil {
+				c.gui.Actions() <- SetText{name: "addtoinboxerror", text: err.Error()}
+				c.gui.Signal()
+				continue
+			}
+			subline := time.Unix(msg.GetTime(), 0).Format(shortTimeFormat)
+			c.inboxUI.Add(inboxMsg.id, from.name, subline, indicatorNone)
+			c.setContactAvatar(c.inboxUI, inboxMsg.id, from)
+			c.setMessageDetail(c.inboxUI, inboxMsg.id, inboxMsg.message)
+			c.updateInboxBackgroundColor(inboxMsg)
+			click, _ := c.inboxUI.SelectEvent(inboxMsg.id)
+			return click
+		}
+	}
+
+	panic("unreachable")
+}
+
+// defaultRecipientNone and defaultRecipientRecent are the choices, other than
+// the contacts themselves, for the recipient of new messages.
+const (
+	defaultRecipientNone   = "Nobody (choose each time)"
+	defaultRecipientRecent = "The most recent recipient"
+)
+
+func (c *guiClient) identityUI() interface{} {
+	var idleLockLabels []string
+	current := false
+	for _, d := range idleLockChoices {
+		idleLockLabels = append(idleLockLabels, idleLockLabel(d))
+		current = current || d == c.idleLockTimeout
+	}
+	if !current {
+		idleLockLabels = append(idleLockLabels, idleLockLabel(c.idleLockTimeout))
+	}
+
+	var ackOverdueLabels []string
+	current = false
+	for _, d := range ackOverdueChoices {
+		ackOverdueLabels = append(ackOverdueLabels, ackOverdueLabel(d))
+		current = current || d == c.ackOverdueThreshold()
+	}
+	if !current {
+		ackOverdueLabels = append(ackOverdueLabels, ackOverdueLabel(c.ackOverdueThreshold()))
+	}
+
+	currentSentLifetime := c.sentMessageLifetime()
+	if c.keepSent {
+		currentSentLifetime = 0
+	}
+	var sentLifetimeLabels []string
+	current = false
+	for _, d := range sentLifetimeChoices {
+		sentLifetimeLabels = append(sentLifetimeLabels, sentLifetimeLabel(d))
+		current = current || d == currentSentLifetime
+	}
+	if !current {
+		sentLifetimeLabels = append(sentLifetimeLabels, sentLifetimeLabel(currentSentLifetime))
+	}
+
+	var wipeHotkeyText string
+	if c.wipeHotkey != nil {
+		wipeHotkeyText = c.wipeHotkey.String()
+	}
+
+	var handshakeExpiryLabels []string
+	current = false
+	for _, d := range handshakeExpiryChoices {
+		handshakeExpiryLabels = append(handshakeExpiryLabels, handshakeExpiryLabel(d))
+		current = current || d == c.handshakeExpiryPeriod()
+	}
+	if !current {
+		handshakeExpiryLabels = append(handshakeExpiryLabels, handshakeExpiryLabel(c.handshakeExpiryPeriod()))
+	}
+
+	interval, coverTraffic := c.transactionSchedule()
+	var transactionIntervalLabels []string
+	current = false
+	for _, d := range transactionIntervalChoices {
+		transactionIntervalLabels = append(transactionIntervalLabels, transactionIntervalLabel(d))
+		current = current || d == interval
+	}
+	if !current {
+		transactionIntervalLabels = append(transactionIntervalLabels, transactionIntervalLabel(interval))
+	}
+
+	var fontScaleLabels []string
+	current = false
+	for _, percent := range fontScaleChoices {
+		fontScaleLabels = append(fontScaleLabels, fontScaleLabel(percent))
+		current = current || percent == c.fontScalePercent()
+	}
+	if !current {
+		fontScaleLabels = append(fontScaleLabels, fontScaleLabel(c.fontScalePercent()))
+	}
+
+	var themeLabels []string
+	for _, t := range themes {
+		themeLabels = append(themeLabels, t.name)
+	}
+
+	recipientLabels := []string{defaultRecipientNone, defaultRecipientRecent}
+	recipientSelected := defaultRecipientNone
+	if c.defaultRecipientRecent {
+		recipientSelected = defaultRecipientRecent
+	}
+	for _, contact := range c.sortedContacts() {
+		if contact.isPending || contact.revokedUs {
+			continue
+		}
+		recipientLabels = append(recipientLabels, contact.name)
+		if !c.defaultRecipientRecent && contact.id == c.defaultRecipient {
+			recipientSelected = contact.name
+		}
+	}
+
+	stats := c.messageStats()
+
+	nvEntries := []nvEntry{
+		{"SERVER", c.server},
+		{"PUBLIC IDENTITY", fmt.Sprintf("%x", c.identityPublic[:])},
+		{"PUBLIC KEY", fmt.Sprintf("%x", c.pub[:])},
+		{"STATE FILE", c.stateFilename},
+		{"GROUP GENERATION", fmt.Sprintf("%d", c.generation)},
+		{"CLOCK", c.clockSkewSummary()},
+	}
+	if len(c.fallbackServers) > 0 {
+		nvEntries = append(nvEntries, nvEntry{"FALLBACK SERVERS", strings.Join(c.fallbackServers, ", ")})
+	}
+	entries := nameValuesLHS(c.theme(), nvEntries)
+	// Copying long hex strings by selecting them is error-prone so the
+	// public identity and key have buttons that copy the exact values.
+	keyFields := []keyField{
+		{1, "identity", fmt.Sprintf("%x", c.identityPublic[:])},
+		{2, "publickey", fmt.Sprintf("%x", c.pub[:])},
+	}
+	entriesGrid := entries.(Grid)
+	c.addKeyFieldButtons(&entriesGrid, keyFields)
+	entriesGrid.rows = append(entriesGrid.rows, []GridE{
+		{1, 1, Label{}},
+		{1, 1, Button{
+			widgetBase: widgetBase{name: "copyidentityblock", hAlign: AlignStart},
+			text:       "Copy All as Shareable Block",
+		}},
+	})
+	entries = entriesGrid
+
+	published := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{3, 1, Label{
+					widgetBase: widgetBase{
+						font: "bold",
+					},
+					text: "Published Handshake",
+				}},
+			},
+			{
+				{3, 1, Label{
+					text: "A published handshake can be posted publicly, for example on a web page, so that anyone can start a key exchange with you. They reply with a handshake of their own, which you enter for a new contact as a reply to your published handshake. Unlike a handshake for a single person, a published one proves to anyone who sees it that you use this identity and home server, anyone who has it can deliver messages to your home server, and contacts added from it can't be revoked individually.",
+					wrap: 600,
+				}},
+			},
+		},
+	}
+	if c.published == nil {
+		published.rows = append(published.rows, []GridE{
+			{1, 1, Button{
+				widgetBase: widgetBase{name: "createpublishedkx"},
+				text:       "Create Published Handshake",
+			}},
+			{2, 1, Label{
+				widgetBase: widgetBase{hExpand: true},
+			}},
+		})
+	} else {
+		published.rows = append(published.rows, [][]GridE{
+			{
+				{3, 1, TextView{
+					widgetBase: widgetBase{
+						height: 150,
+						name:   "publishedkx",
+						font:   c.messageMonoFont(),
+					},
+					editable: false,
+					text:     c.myKeyExchangeBlock(),
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "copypublishedkx"},
+					text:       "Copy",
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "savepublishedkx"},
+					text:       "Save",
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{hExpand: true},
+				}},
+			},
+			{
+				{3, 1, Label{
+					widgetBase: widgetBase{name: "publishedkxstatus"},
+				}},
+			},
+		}...)
+	}
+
+	left := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 10,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{1, 1, entries},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{1, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Messages",
+							}},
+						},
+						{
+							{1, 1, CheckButton{
+								widgetBase: widgetBase{
+									name: "quotereplies",
+								},
+								checked: !c.disableReplyQuoting,
+								text:    "Include a quoted copy of the original message when replying",
+							}},
+						},
+						{
+							{1, 1, CheckButton{
+								widgetBase: widgetBase{
+									name: "compressbodies",
+								},
+								checked: !c.disableBodyCompression,
+								text:    "Compress message bodies, when the recipient supports it, so that longer messages fit",
+							}},
+						},
+						{
+							{1, 1, CheckButton{
+								widgetBase: widgetBase{
+									name: "spellcheck",
+								},
+								checked: c.spellCheck,
+								text:    "Check spelling while composing messages. Only dictionaries installed on this computer are used and nothing is sent over the network",
+							}},
+						},
+						{
+							{1, 1, CheckButton{
+								widgetBase: widgetBase{
+									name: "quitprompt",
+								},
+								checked: !c.noQuitPrompt,
+								text:    "Ask before quitting while messages are waiting to be sent",
+							}},
+						},
+						{
+							{1, 1, Grid{
+								colSpacing: 6,
+								rows: [][]GridE{
+									{
+										{1, 1, Label{text: "Highlight unacknowledged messages in the outbox"}},
+										{1, 1, Combo{
+											widgetBase:  widgetBase{name: "ackoverdue"},
+											labels:      ackOverdueLabels,
+											preSelected: ackOverdueLabel(c.ackOverdueThreshold()),
+										}},
+										{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+									},
+								},
+							}},
+						},
+						{
+							{1, 1, Grid{
+								colSpacing: 6,
+								rows: [][]GridE{
+									{
+										{1, 1, Label{text: "Erase sent messages from the outbox"}},
+										{1, 1, Combo{
+											widgetBase:  widgetBase{name: "sentlifetime"},
+											labels:      sentLifetimeLabels,
+											preSelected: sentLifetimeLabel(currentSentLifetime),
+										}},
+										{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+									},
+								},
+							}},
+						},
+						{
+							{1, 1, Grid{
+								colSpacing: 6,
+								rows: [][]GridE{
+									{
+										{1, 1, Label{text: "Warn about handshakes that haven't been completed"}},
+										{1, 1, Combo{
+											widgetBase:  widgetBase{name: "handshakeexpiry"},
+											labels:      handshakeExpiryLabels,
+											preSelected: handshakeExpiryLabel(c.handshakeExpiryPeriod()),
+										}},
+										{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+									},
+								},
+							}},
+						},
+						{
+							{1, 1, Grid{
+								colSpacing: 6,
+								rows: [][]GridE{
+									{
+										{1, 1, Label{text: "Average time between network transactions"}},
+										{1, 1, Combo{
+											widgetBase:  widgetBase{name: "transactioninterval"},
+											labels:      transactionIntervalLabels,
+											preSelected: transactionIntervalLabel(interval),
+										}},
+										{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+									},
+								},
+							}},
+						},
+						{
+							{1, 1, CheckButton{
+								widgetBase: widgetBase{
+									name: "covertraffic",
+								},
+								checked: coverTraffic,
+								text:    "Make anonymous connections when there's nothing to send so that sending can't be distinguished from idling. Messages are fetched less often as a result",
+							}},
+						},
+						{
+							{1, 1, Grid{
+								colSpacing: 6,
+								rows: [][]GridE{
+									{
+										{1, 1, Label{text: "Network transactions"}},
+										{1, 1, Combo{
+											widgetBase:  widgetBase{name: "operatingmode"},
+											labels:      operatingModeLabels,
+											preSelected: operatingModeLabels[c.operatingMode()],
+										}},
+										{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+									},
+								},
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 6,
+					rows: [][]GridE{
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Theme",
+							}},
+						},
+						{
+							{1, 1, Combo{
+								widgetBase:  widgetBase{name: "theme"},
+								labels:      themeLabels,
+								preSelected: c.theme().name,
+							}},
+							{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						},
+						{
+							{2, 1, CheckButton{
+								widgetBase: widgetBase{name: "shapedindicators"},
+								checked:    c.shapedIndicators,
+								text:       "Distinguish the status indicators by shape as well as by color",
+							}},
+						},
+						{
+							{2, 1, CheckButton{
+								widgetBase: widgetBase{name: "messagedetails"},
+								checked:    c.messageDetails,
+								text:       "Show the size of messages, and how many attachments they have, in the inbox and outbox",
+							}},
+						},
+						{
+							{2, 1, CheckButton{
+								widgetBase: widgetBase{name: "formatbodies"},
+								checked:    c.formatBodies,
+								text:       "Format received messages: *bold*, _italic_ and links",
+							}},
+						},
+						{
+							{2, 1, CheckButton{
+								widgetBase: widgetBase{name: "maskkeys"},
+								checked:    c.maskKeys,
+								text:       "Hide public keys until Show is clicked, for when the screen is shared",
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 6,
+					rows: [][]GridE{
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Compose",
+							}},
+						},
+						{
+							{1, 1, Label{text: "New messages are addressed to"}},
+							{1, 1, Combo{
+								widgetBase:  widgetBase{name: "defaultrecipient"},
+								labels:      recipientLabels,
+								preSelected: recipientSelected,
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 6,
+					rows: [][]GridE{
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Links",
+							}},
+						},
+						{
+							{3, 1, Label{
+								text: "Links in messages are only opened after you confirm, with this command. It should start a browser that uses Tor, such as Tor Browser, because otherwise the site will learn your IP address. The link is added as the last argument.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Label{text: "Command"}},
+							{1, 1, Entry{
+								widgetBase: widgetBase{name: "browsercommand"},
+								width:      40,
+								text:       c.browserCommand,
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "setbrowsercommand"},
+								text:       "Set",
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 6,
+					rows: [][]GridE{
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Panic Wipe",
+							}},
+						},
+						{
+							{3, 1, Label{
+								text: "If set, pressing this key combination, such as ctrl+alt+shift+w, immediately destroys the state file and exits. There's no confirmation and all contacts and messages are lost permanently, even to you. The combination needs at least two of ctrl, alt and shift. Leave it empty to disable the wipe.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Label{text: "Keys"}},
+							{1, 1, Entry{
+								widgetBase: widgetBase{name: "wipehotkey"},
+								width:      20,
+								text:       wipeHotkeyText,
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "setwipehotkey"},
+								text:       "Set",
+							}},
+						},
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{name: "wipehotkeyerror", foreground: colorRed},
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 6,
+					rows: [][]GridE{
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Message Text",
+							}},
+						},
+						{
+							{3, 1, Label{
+								text: "The font and size of the text of messages. Changes take effect when a message is next shown.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Label{text: "Font"}},
+							{1, 1, Combo{
+								widgetBase:  widgetBase{name: "bodyfont"},
+								labels:      fontChoiceLabels(bodyFontChoices, c.bodyFontFamily()),
+								preSelected: c.bodyFontFamily(),
+							}},
+							{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						},
+						{
+							{1, 1, Label{text: "Fixed-width font"}},
+							{1, 1, Combo{
+								widgetBase:  widgetBase{name: "monofont"},
+								labels:      fontChoiceLabels(monoFontChoices, c.monoFontFamily()),
+								preSelected: c.monoFontFamily(),
+							}},
+						},
+						{
+							{1, 1, Label{text: "Size"}},
+							{1, 1, Combo{
+								widgetBase:  widgetBase{name: "fontscale"},
+								labels:      fontScaleLabels,
+								preSelected: fontScaleLabel(c.fontScalePercent()),
+							}},
+						},
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "resetfonts"},
+								text:       "Reset to Defaults",
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Diagnostics",
+							}},
+						},
+						{
+							{2, 1, Label{
+								text: "These figures are calculated from the messages currently in the inbox and outbox. Consistently long delays suggest that the home server, or the network path to it, is slow.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Label{text: "Messages in inbox"}},
+							{1, 1, Label{widgetBase: widgetBase{name: "statsinbox"}, text: fmt.Sprintf("%d", stats.inbox)}},
+						},
+						{
+							{1, 1, Label{text: "Messages in outbox"}},
+							{1, 1, Label{widgetBase: widgetBase{name: "statsoutbox"}, text: fmt.Sprintf("%d", stats.outbox)}},
+						},
+						{
+							{1, 1, Label{text: "Waiting to be sent"}},
+							{1, 1, Label{widgetBase: widgetBase{name: "statspending"}, text: fmt.Sprintf("%d", stats.pending)}},
+						},
+						{
+							{1, 1, Label{text: "Median time to send"}},
+							{1, 1, Label{widgetBase: widgetBase{name: "statssend"}, text: latencyLabel(stats.medianSend, stats.sendSamples)}},
+						},
+						{
+							{1, 1, Label{text: "Median time to acknowledgment"}},
+							{1, 1, Label{widgetBase: widgetBase{name: "statsack"}, text: latencyLabel(stats.medianAck, stats.ackSamples)}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Idle Lock",
+							}},
+						},
+						{
+							{2, 1, Label{
+								text: "Pond can save its state and close itself when it hasn't been used for a while so that an unattended session can't be read. Pond must then be restarted and the passphrase entered again.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Combo{
+								widgetBase:  widgetBase{name: "idlelock"},
+								labels:      idleLockLabels,
+								preSelected: idleLockLabel(c.idleLockTimeout),
+							}},
+							{1, 1, Label{
+								widgetBase: widgetBase{hExpand: true},
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Backup",
+							}},
+						},
+						{
+							{2, 1, Label{
+								text: "A backup is a copy of your encrypted state file. It can be restored when setting up Pond and requires your current passphrase to open. Since messages are erased after a week, restoring an old backup may bring back messages that would otherwise have been erased.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "exportbackup"},
+								text:       "Export Backup",
+							}},
+							{1, 1, Label{
+								widgetBase: widgetBase{hExpand: true},
+							}},
+						},
+						{
+							{2, 1, Label{
+								widgetBase: widgetBase{
+									name: "backupstatus",
+								},
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, published},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Change Home Server",
+							}},
+						},
+						{
+							{3, 1, Label{
+								text: msgChangeServerWarning,
+								wrap: 600,
+							}},
+						},
+						{
+							{2, 1, Entry{
+								widgetBase: widgetBase{name: "newserver", hAlign: AlignStart, hExpand: true},
+								width:      60,
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "changeserver"},
+								text:       "Change",
+							}},
+						},
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									name: "changeserverstatus",
+								},
+							}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Fallback Servers",
+							}},
+						},
+						{
+							{3, 1, Label{
+								text: msgFallbackServersInfo,
+								wrap: 600,
+							}},
+						},
+						{
+							{2, 1, Entry{
+								widgetBase: widgetBase{name: "fallbackserver", hAlign: AlignStart, hExpand: true},
+								width:      60,
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "addfallback"},
+								text:       "Add",
+							}},
+						},
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									name: "fallbackstatus",
+								},
+							}},
+						},
+					},
+				}},
 			},
 			{
 				{1, 1, Grid{
@@ -1955,34 +5298,365 @@ func (c *guiClient) identityUI() interface{} {
 					},
 				}},
 			},
+			{
+				{1, 1, Grid{
+					widgetBase: widgetBase{margin: 6},
+					rowSpacing: 3,
+					colSpacing: 3,
+					rows: [][]GridE{
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									font: "bold",
+								},
+								text: "Move to Another Computer",
+							}},
+						},
+						{
+							{3, 1, Label{
+								text: "Moving your account writes everything (keys, contacts, messages and the queue of unsent messages) to a file that is protected by the passphrase below and by a transfer code that will be displayed. Import the file on the new computer, using the 'Import from another computer' option when creating an account there, and then erase this copy. " + msgTransferWarning + " Pond stops sending and receiving once the file has been written.",
+								wrap: 600,
+							}},
+						},
+						{
+							{1, 1, Label{
+								text:   "Passphrase:",
+								yAlign: 0.5,
+							}},
+							{2, 1, Entry{
+								widgetBase: widgetBase{name: "transferpassphrase", hAlign: AlignStart, hExpand: true},
+								width:      40,
+								password:   true,
+							}},
+						},
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "transferfile"},
+								text:       "Select file",
+							}},
+							{1, 1, Button{
+								widgetBase: widgetBase{
+									name:        "transfer",
+									insensitive: true,
+								},
+								text: "Move Account",
+							}},
+							{1, 1, Label{
+								widgetBase: widgetBase{hExpand: true},
+							}},
+						},
+						{
+							{3, 1, Label{
+								widgetBase: widgetBase{
+									name:       "transfererror",
+									foreground: colorRed,
+								},
+								wrap: 600,
+							}},
+						},
+					},
+				}},
+			},
 		},
 	}
 
-	c.gui.Actions() <- SetChild{name: "right", child: rightPane("IDENTITY", left, nil, nil)}
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "IDENTITY", left, nil, nil)}
 	c.gui.Actions() <- UIState{uiStateShowIdentity}
 	c.gui.Signal()
 
-	var tombPath string
+	var tombPath, transferPath string
+	changeServerArmed := false
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		if open, ok := event.(OpenResult); ok && open.ok {
+			if _, ok := open.arg.(publishedKXFileArg); ok {
+				status := "Published handshake written to " + open.path
+				if err := ioutil.WriteFile(open.path, []byte(c.myKeyExchangeBlock()), 0600); err != nil {
+					status = err.Error()
+					c.gui.Actions() <- UIError{err}
+				}
+				c.gui.Actions() <- SetText{name: "publishedkxstatus", text: status}
+				c.gui.Signal()
+				continue
+			}
+			if _, ok := open.arg.(backupFileArg); ok {
+				status := "Backup written to " + open.path
+				if err := c.exportBackup(open.path); err != nil {
+					status = err.Error()
+					c.gui.Actions() <- UIError{err}
+				}
+				c.gui.Actions() <- SetText{name: "backupstatus", text: status}
+				c.gui.Signal()
+				continue
+			}
+			if _, ok := open.arg.(transferFileArg); ok {
+				transferPath = open.path
+				c.gui.Actions() <- Sensitive{name: "transfer", sensitive: true}
+				c.gui.Signal()
+				continue
+			}
+			tombPath = open.path
+			c.gui.Actions() <- Sensitive{name: "entomb", sensitive: true}
+			c.gui.Signal()
+			continue
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		if c.keyFieldClick(click, keyFields) {
+			continue
+		}
+
+		switch click.name {
+		case "copyidentityblock":
+			c.gui.Actions() <- SetClipboard{c.identityBlock()}
+			c.gui.Signal()
+		case "quotereplies":
+			c.disableReplyQuoting = !click.checks["quotereplies"]
+			c.save()
+		case "compressbodies":
+			c.disableBodyCompression = !click.checks["compressbodies"]
+			c.save()
+		case "spellcheck":
+			c.spellCheck = click.checks["spellcheck"]
+			c.save()
+		case "quitprompt":
+			c.noQuitPrompt = !click.checks["quitprompt"]
+			c.save()
+		case "idlelock":
+			selected := click.combos["idlelock"]
+			for _, d := range idleLockChoices {
+				if idleLockLabel(d) == selected {
+					c.idleLockTimeout = d
+					break
+				}
+			}
+			c.save()
+		case "ackoverdue":
+			selected := click.combos["ackoverdue"]
+			for _, d := range ackOverdueChoices {
+				if ackOverdueLabel(d) == selected {
+					c.ackOverdue = d
+					break
+				}
+			}
+			c.save()
+		case "sentlifetime":
+			selected := click.combos["sentlifetime"]
+			for _, d := range sentLifetimeChoices {
+				if sentLifetimeLabel(d) == selected {
+					c.sentLifetime, c.keepSent = d, d == 0
+					break
+				}
+			}
+			c.save()
+		case "bodyfont":
+			c.bodyFont = click.combos["bodyfont"]
+			if c.bodyFont == defaultBodyFont {
+				c.bodyFont = ""
+			}
+			c.save()
+		case "monofont":
+			c.monoFont = click.combos["monofont"]
+			if c.monoFont == defaultMonoFont {
+				c.monoFont = ""
+			}
+			c.save()
+		case "handshakeexpiry":
+			selected := click.combos["handshakeexpiry"]
+			for _, d := range handshakeExpiryChoices {
+				if handshakeExpiryLabel(d) == selected {
+					c.handshakeExpiry = d
+					break
+				}
+			}
+			if c.handshakeExpiry == defaultHandshakeExpiry {
+				c.handshakeExpiry = 0
+			}
+			c.save()
+		case "transactioninterval", "covertraffic":
+			interval, _ := c.transactionSchedule()
+			selected := click.combos["transactioninterval"]
+			for _, d := range transactionIntervalChoices {
+				if transactionIntervalLabel(d) == selected {
+					interval = d
+					break
+				}
+			}
+			if interval == transactionRateSeconds*time.Second {
+				interval = 0
+			}
+			c.setTransactionSchedule(interval, click.checks["covertraffic"])
+			c.save()
+		case "operatingmode":
+			selected := click.combos["operatingmode"]
+			for mode, label := range operatingModeLabels {
+				if label == selected {
+					c.setOperatingMode(operatingMode(mode))
+					break
+				}
+			}
+			c.save()
+			// Composing is only offered when messages can be sent.
+			c.buildMainUI()
+			c.clientUI.Select(clientUIIdentity)
+			return c.identityUI()
+		case "fontscale":
+			selected := click.combos["fontscale"]
+			for _, percent := range fontScaleChoices {
+				if fontScaleLabel(percent) == selected {
+					c.fontScale = percent
+					break
+				}
+			}
+			if c.fontScale == 100 {
+				c.fontScale = 0
+			}
+			c.save()
+		case "theme":
+			c.themeName = themeByName(click.combos["theme"]).name
+			if c.themeName == themes[0].name {
+				c.themeName = ""
+			}
+			c.save()
+			// The whole window is rebuilt so that the new colors
+			// take effect immediately.
+			c.buildMainUI()
+			c.clientUI.Select(clientUIIdentity)
+			return c.identityUI()
+		case "shapedindicators":
+			c.shapedIndicators = click.checks["shapedindicators"]
+			c.save()
+			c.buildMainUI()
+			c.clientUI.Select(clientUIIdentity)
+			return c.identityUI()
+		case "messagedetails":
+			c.messageDetails = click.checks["messagedetails"]
+			c.save()
+			c.buildMainUI()
+			c.clientUI.Select(clientUIIdentity)
+			return c.identityUI()
+		case "formatbodies":
+			c.formatBodies = click.checks["formatbodies"]
+			c.save()
+			return c.identityUI()
+		case "maskkeys":
+			c.maskKeys = click.checks["maskkeys"]
+			c.save()
+			return c.identityUI()
+		case "defaultrecipient":
+			selected := click.combos["defaultrecipient"]
+			c.defaultRecipient = 0
+			c.defaultRecipientRecent = selected == defaultRecipientRecent
+			for _, contact := range c.contacts {
+				if contact.name == selected {
+					c.defaultRecipient = contact.id
+				}
+			}
+			c.save()
+			return c.identityUI()
+		case "browsercommand", "setbrowsercommand":
+			c.browserCommand = strings.TrimSpace(click.entries["browsercommand"])
+			c.save()
+		case "wipehotkey", "setwipehotkey":
+			hotkey, err := parseHotkey(click.entries["wipehotkey"])
+			if err != nil {
+				c.gui.Actions() <- SetText{name: "wipehotkeyerror", text: err.Error()}
+				c.gui.Actions() <- UIState{uiStateShowIdentity}
+				c.gui.Signal()
+				continue
+			}
+			c.wipeHotkey = hotkey
+			c.save()
+			return c.identityUI()
+		case "resetfonts":
+			c.bodyFont, c.monoFont, c.fontScale = "", "", 0
+			c.save()
+			return c.identityUI()
+		case "createpublishedkx":
+			c.myKeyExchangeBlock()
+			return c.identityUI()
+		case "copypublishedkx":
+			c.gui.Actions() <- SetClipboard{c.myKeyExchangeBlock()}
+			c.gui.Signal()
+		case "savepublishedkx":
+			c.gui.Actions() <- FileOpen{
+				save:     true,
+				title:    "Save published handshake",
+				filename: "pond-handshake.txt",
+				arg:      publishedKXFileArg{},
+			}
+			c.gui.Signal()
+		case "exportbackup":
+			c.gui.Actions() <- FileOpen{
+				save:     true,
+				title:    "Select path for backup",
+				filename: "pond.backup",
+				arg:      backupFileArg{},
+			}
+			c.gui.Signal()
+		case "changeserver":
+			if !changeServerArmed {
+				changeServerArmed = true
+				c.gui.Actions() <- SetButtonText{name: "changeserver", text: "Confirm"}
+				c.gui.Signal()
+				continue
+			}
+			changeServerArmed = false
+			c.gui.Actions() <- Sensitive{name: "changeserver", sensitive: false}
+			c.gui.Actions() <- Sensitive{name: "newserver", sensitive: false}
+			c.gui.Signal()
+
+			updateMsg := func(msg string) {
+				c.gui.Actions() <- SetText{name: "changeserverstatus", text: msg}
+				c.gui.Signal()
+			}
 
-	for {
-		event, wanted := c.nextEvent(0)
-		if wanted {
-			return event
-		}
+			revocations, err := c.changeHomeServer(strings.TrimSpace(click.entries["newserver"]), updateMsg)
+			if err != nil {
+				c.gui.Actions() <- UIError{err}
+				c.gui.Actions() <- SetText{name: "changeserverstatus", text: err.Error()}
+				c.gui.Actions() <- SetButtonText{name: "changeserver", text: "Change"}
+				c.gui.Actions() <- Sensitive{name: "changeserver", sensitive: true}
+				c.gui.Actions() <- Sensitive{name: "newserver", sensitive: true}
+				c.gui.Signal()
+				continue
+			}
 
-		if open, ok := event.(OpenResult); ok && open.ok {
-			tombPath = open.path
-			c.gui.Actions() <- Sensitive{name: "entomb", sensitive: true}
+			for _, revocation := range revocations {
+				c.addRevocationMessageUI(revocation)
+			}
+			for _, contact := range c.contacts {
+				c.contactsUI.SetSubline(contact.id, c.contactSubline(contact))
+				c.contactsUI.SetIndicator(contact.id, c.contactIndicator(contact))
+			}
+			return c.identityUI()
+		case "addfallback":
+			c.gui.Actions() <- Sensitive{name: "addfallback", sensitive: false}
+			c.gui.Actions() <- Sensitive{name: "fallbackserver", sensitive: false}
 			c.gui.Signal()
-			continue
-		}
 
-		click, ok := event.(Click)
-		if !ok {
-			continue
-		}
+			updateMsg := func(msg string) {
+				c.gui.Actions() <- SetText{name: "fallbackstatus", text: msg}
+				c.gui.Signal()
+			}
 
-		switch click.name {
+			if err := c.addFallbackServer(strings.TrimSpace(click.entries["fallbackserver"]), updateMsg); err != nil {
+				c.gui.Actions() <- SetText{name: "fallbackstatus", text: err.Error()}
+				c.gui.Actions() <- Sensitive{name: "addfallback", sensitive: true}
+				c.gui.Actions() <- Sensitive{name: "fallbackserver", sensitive: true}
+				c.gui.Signal()
+				continue
+			}
+			return c.identityUI()
 		case "tombfile":
 			c.gui.Actions() <- FileOpen{
 				save:     true,
@@ -2003,7 +5677,7 @@ func (c *guiClient) identityUI() interface{} {
 				continue
 			}
 
-			c.gui.Actions() <- Reset{TextView{
+			c.gui.Actions() <- Reset{root: TextView{
 				widgetBase: widgetBase{name: "log"},
 				editable:   false,
 				wrap:       true,
@@ -2031,18 +5705,159 @@ func (c *guiClient) identityUI() interface{} {
 
 			c.gui.Actions() <- UIState{uiStateEntombComplete}
 			c.gui.Signal()
-
-			for {
-				if _, ok := <-c.gui.Events(); !ok {
-					break
-				}
+			c.haltUntilClosed()
+		case "transferfile":
+			c.gui.Actions() <- FileOpen{
+				save:     true,
+				title:    "Select path for transfer file",
+				filename: "pond.transfer",
+				arg:      transferFileArg{},
+			}
+			c.gui.Signal()
+		case "transfer":
+			passphrase := click.entries["transferpassphrase"]
+			if len(passphrase) == 0 {
+				c.gui.Actions() <- SetText{name: "transfererror", text: "A passphrase is needed to protect the transfer file."}
+				c.gui.Actions() <- UIState{uiStateShowIdentity}
+				c.gui.Signal()
+				continue
 			}
+			c.transferUI(transferPath, passphrase)
+		}
+	}
+
+	panic("unreachable")
+}
+
+// haltUntilClosed waits for the user to close the window and then stops the
+// GUI, without saving. It's used once the state has been moved elsewhere.
+func (c *guiClient) haltUntilClosed() {
+	for {
+		if _, ok := <-c.gui.Events(); !ok {
+			break
+		}
+	}
+	c.releaseInstanceLock()
+	close(c.gui.Actions())
+	select {}
+}
+
+// transferUI writes the account to a transfer bundle at path and shows the
+// transfer code. Since the account mustn't be used again once it has been
+// exported, it never returns: the user either erases this copy or cancels,
+// which deletes the bundle, and then closes the window.
+func (c *guiClient) transferUI(path, passphrase string) {
+	c.gui.Actions() <- Reset{root: Grid{
+		widgetBase: widgetBase{margin: 20},
+		rowSpacing: 10,
+		colSpacing: 5,
+		rows: [][]GridE{
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{font: "DejaVu Sans 20"},
+					text:       "Move to Another Computer",
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "transferstatus"},
+					text:       "Writing transfer file...",
+					wrap:       600,
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "transfercode", font: c.scaledFont(c.monoFontFamily(), 16)},
+					selectable: true,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "transferdone", insensitive: true},
+					text:       "Erase This Copy",
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "transfercancel", insensitive: true},
+					text:       "Cancel",
+				}},
+			},
+		},
+	}}
+	c.gui.Actions() <- UIState{uiStateTransfer}
+	c.gui.Signal()
+
+	code, err := c.exportTransfer(path, passphrase)
+	if err != nil {
+		c.gui.Actions() <- SetText{name: "transferstatus", text: "Writing the transfer file failed: " + err.Error() + "\n\nYour account is still intact, but sending and receiving have stopped. Please close this window and restart when ready."}
+		c.gui.Actions() <- UIError{err}
+		c.gui.Actions() <- UIState{uiStateTransferComplete}
+		c.gui.Signal()
+		c.haltUntilClosed()
+	}
+
+	c.gui.Actions() <- SetText{name: "transferstatus", text: "Your account has been written to " + path + ". Copy that file to the new computer and import it using the transfer code below, which isn't stored anywhere and must be written down now.\n\nOnce the import has succeeded, erase this copy. " + msgTransferWarning}
+	c.gui.Actions() <- SetText{name: "transfercode", text: code}
+	c.gui.Actions() <- Sensitive{name: "transferdone", sensitive: true}
+	c.gui.Actions() <- Sensitive{name: "transfercancel", sensitive: true}
+	c.gui.Actions() <- UIState{uiStateTransfer}
+	c.gui.Signal()
+
+	eraseArmed := false
+	for {
+		event, ok := <-c.gui.Events()
+		if !ok {
+			// The window was closed without a decision, so the
+			// bundle and this copy both remain. Since the network
+			// is stopped, nothing is lost by not saving.
+			c.releaseInstanceLock()
 			close(c.gui.Actions())
 			select {}
 		}
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		var status string
+		switch click.name {
+		case "transferdone":
+			if !eraseArmed {
+				eraseArmed = true
+				c.gui.Actions() <- SetButtonText{name: "transferdone", text: "Confirm"}
+				c.gui.Signal()
+				continue
+			}
+			c.wipeState()
+			status = "This copy of your account has been erased. You can close this window."
+		case "transfercancel":
+			status = "The transfer has been cancelled and the transfer file deleted. Please close this window and restart Pond to continue using this copy."
+			if err := c.cancelTransfer(path); err != nil {
+				c.gui.Actions() <- UIError{err}
+				status = "Deleting the transfer file failed: " + err.Error() + ". Delete it yourself before restarting Pond, in order to continue using this copy."
+			}
+		default:
+			continue
+		}
+
+		c.gui.Actions() <- SetText{name: "transferstatus", text: status}
+		c.gui.Actions() <- SetText{name: "transfercode", text: ""}
+		c.gui.Actions() <- Sensitive{name: "transferdone", sensitive: false}
+		c.gui.Actions() <- Sensitive{name: "transfercancel", sensitive: false}
+		c.gui.Actions() <- UIState{uiStateTransferComplete}
+		c.gui.Signal()
+		c.haltUntilClosed()
 	}
+}
 
-	panic("unreachable")
+// mutedGlyph follows the names of muted contacts in the contacts list.
+const mutedGlyph = "\U0001F507"
+
+// contactLine returns the text that names contact in the contacts list.
+func contactLine(contact *Contact) string {
+	if contact.muted {
+		return contact.name + " " + mutedGlyph
+	}
+	return contact.name
 }
 
 func (c *guiClient) showContact(id uint64) interface{} {
@@ -2050,7 +5865,40 @@ func (c *guiClient) showContact(id uint64) interface{} {
 	if contact.isPending && len(contact.pandaKeyExchange) == 0 && len(contact.pandaResult) == 0 {
 		return c.newContactUI(contact)
 	}
-	c.contactsUI.SetIndicator(id, indicatorNone)
+	// Viewing a contact clears any indication of activity, but not the
+	// indication that they are blocked, that their server is invalid or
+	// that there's an unsent draft to them.
+	switch {
+	case contact.blocked || contact.invalidServer != nil:
+		c.contactsUI.SetIndicator(id, contact.indicator())
+	case c.hasDraft(id):
+		c.contactsUI.SetIndicator(id, indicatorDraft)
+	default:
+		c.contactsUI.SetIndicator(id, indicatorNone)
+	}
+
+	blockText := "Block"
+	if contact.blocked {
+		blockText = "Unblock"
+	}
+	muteText := "Mute"
+	if contact.muted {
+		muteText = "Unmute"
+	}
+
+	verifiedText := "No. Compare their public identity, below, with them in person or over a channel that you trust."
+	verifyText := "Mark as Verified"
+	if contact.verified {
+		verifiedText = "Yes"
+		verifyText = "Mark as Unverified"
+	}
+
+	// The same button clears the filter, while it's showing only this
+	// contact's messages.
+	filterText := "Show Only Their Messages"
+	if c.filterContact == id {
+		filterText = "Show All Messages"
+	}
 
 	entries := []nvEntry{
 		{"NAME", contact.name},
@@ -2061,6 +5909,14 @@ func (c *guiClient) showContact(id uint64) interface{} {
 		{"CURRENT DH", fmt.Sprintf("%x", contact.theirCurrentDHPublic[:])},
 		{"GROUP GENERATION", fmt.Sprintf("%d", contact.generation)},
 		{"CLIENT VERSION", fmt.Sprintf("%d", contact.supportedVersion)},
+		{"LAST HEARD FROM", contact.lastHeardFrom(c.Now())},
+		{"VERIFIED", verifiedText},
+	}
+	if len(contact.theirFallbackServers) > 0 {
+		entries = append(entries, nvEntry{"FALLBACK SERVERS", strings.Join(contact.theirFallbackServers, ", ")})
+	}
+	if len(contact.serverStatus) > 0 {
+		entries = append(entries, nvEntry{"SERVER STATUS", contact.serverStatus})
 	}
 
 	var pandaMessage string
@@ -2092,6 +5948,16 @@ func (c *guiClient) showContact(id uint64) interface{} {
 		entries = append(entries, nvEntry{"EVENTS", eventsText})
 	}
 
+	const automaticColor = "Automatic"
+	colorLabels := []string{automaticColor}
+	for _, ac := range avatarColors {
+		colorLabels = append(colorLabels, ac.name)
+	}
+	colorSelected := contact.color
+	if len(colorSelected) == 0 {
+		colorSelected = automaticColor
+	}
+
 	right := Grid{
 		widgetBase: widgetBase{margin: 6},
 		rowSpacing: 3,
@@ -2105,15 +5971,191 @@ func (c *guiClient) showContact(id uint64) interface{} {
 					text: "Delete",
 				}},
 			},
-		},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "ratchet",
+						insensitive: contact.isPending,
+					},
+					text: "Show Ratchet",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "rotatedh",
+						insensitive: !canRotateDH(contact),
+					},
+					text: "Rotate Keys",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "conversation",
+						insensitive: contact.isPending,
+					},
+					text: "View Conversation",
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "filter",
+						insensitive: contact.isPending,
+					},
+					text: filterText,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name: "block",
+					},
+					text: blockText,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name: "mute",
+					},
+					text: muteText,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "verify",
+						insensitive: contact.isPending,
+					},
+					text: verifyText,
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{marginTop: 12},
+					text:       "Color",
+				}},
+			},
+			{
+				{1, 1, Combo{
+					widgetBase:  widgetBase{name: "color"},
+					labels:      colorLabels,
+					preSelected: colorSelected,
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{marginTop: 12},
+					text:       "Tags, separated by commas",
+				}},
+			},
+			{
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "tags"},
+					width:      20,
+					text:       formatTags(contact.tags),
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "settags"},
+					text:       "Set Tags",
+				}},
+			},
+		},
+	}
+	if tags := c.allTags(); len(tags) > 0 {
+		right.rows = append(right.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{foreground: c.theme().subline},
+				text:       "In use: " + formatTags(tags),
+				wrap:       200,
+			}},
+		})
+	}
+
+	// A contact whose server couldn't be parsed when the state was loaded
+	// can't be sent to until the server is corrected or the key exchange
+	// is repeated.
+	var main Widget
+	if contact.invalidServer != nil {
+		main = Grid{
+			widgetBase: widgetBase{margin: 6},
+			rowSpacing: 6,
+			colSpacing: 6,
+			rows: [][]GridE{
+				{
+					{3, 1, Label{
+						widgetBase: widgetBase{foreground: colorRed},
+						text:       fmt.Sprintf("The address of this contact's server is invalid (%s), so messages can't be sent to them. Enter the correct address, if you know it, or start a new key exchange with them.", contact.invalidServer),
+						wrap:       500,
+					}},
+				},
+				{
+					{1, 1, Entry{
+						widgetBase: widgetBase{name: "fixserver", hExpand: true},
+						text:       contact.theirServer,
+					}},
+					{1, 1, Button{
+						widgetBase: widgetBase{name: "fixserverset"},
+						text:       "Set Server",
+					}},
+					{1, 1, Button{
+						widgetBase: widgetBase{name: "fixserverrekey"},
+						text:       "New Key Exchange",
+					}},
+				},
+				{
+					{3, 1, Label{
+						widgetBase: widgetBase{name: "fixservererror", foreground: colorRed},
+					}},
+				},
+			},
+		}
+	} else if contact.revokedUs {
+		main = Grid{
+			widgetBase: widgetBase{margin: 6},
+			rowSpacing: 6,
+			colSpacing: 6,
+			rows: [][]GridE{
+				{
+					{3, 1, Label{
+						widgetBase: widgetBase{name: "revokedus", foreground: colorRed},
+						text:       "This contact appears to have removed you, so messages can no longer be sent to them. You can archive the contact, which keeps their messages, or delete it.",
+						wrap:       500,
+					}},
+				},
+				{
+					{1, 1, Button{
+						widgetBase: widgetBase{name: "archive", insensitive: contactHasTag(contact, archivedTag)},
+						text:       "Archive",
+					}},
+					{1, 1, Button{
+						widgetBase: widgetBase{name: "revokeddelete"},
+						text:       "Delete",
+					}},
+					{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+				},
+			},
+		}
 	}
 
-	left := nameValuesLHS(entries)
-	c.gui.Actions() <- SetChild{name: "right", child: rightPane("CONTACT", left, right, nil)}
+	keyFields := []keyField{
+		{2, "identity", fmt.Sprintf("%x", contact.theirIdentityPublic[:])},
+		{3, "publickey", fmt.Sprintf("%x", contact.theirPub[:])},
+		{4, "lastdh", fmt.Sprintf("%x", contact.theirLastDHPublic[:])},
+		{5, "currentdh", fmt.Sprintf("%x", contact.theirCurrentDHPublic[:])},
+	}
+	left := nameValuesLHS(c.theme(), entries).(Grid)
+	c.addKeyFieldButtons(&left, keyFields)
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "CONTACT", left, right, main)}
 	c.gui.Actions() <- UIState{uiStateShowContact}
 	c.gui.Signal()
 
 	deleteArmed := false
+	ratchetShown := false
 
 	for {
 		event, wanted := c.nextEvent(0)
@@ -2121,24 +6163,146 @@ func (c *guiClient) showContact(id uint64) interface{} {
 			return event
 		}
 
+		if result, ok := event.(serverProbeResult); ok && result.id == id {
+			return c.showContact(id)
+		}
+
 		click, ok := event.(Click)
 		if !ok {
 			continue
 		}
 
-		if click.name == "delete" {
+		if c.keyFieldClick(click, keyFields) {
+			continue
+		}
+
+		if click.name == "conversation" {
+			return c.conversationUI(contact)
+		}
+
+		if click.name == "fixserverset" {
+			server := strings.TrimSpace(click.entries["fixserver"])
+			if _, _, err := parseServer(server, c.dev); err != nil {
+				c.gui.Actions() <- SetText{name: "fixservererror", text: err.Error()}
+				c.gui.Actions() <- UIState{uiStateShowContact}
+				c.gui.Signal()
+				continue
+			}
+			c.setContactServer(contact, server)
+			c.contactsUI.SetIndicator(id, c.contactIndicator(contact))
+			c.contactsUI.SetSubline(id, c.contactSubline(contact))
+			c.save()
+			return c.showContact(id)
+		}
+
+		if click.name == "fixserverrekey" {
+			c.newKeyExchange(contact)
+			contact.isPending = true
+			contact.invalidServer = nil
+			contact.events = append(contact.events, Event{
+				t:   c.Now(),
+				msg: "The contact's server was invalid. A new key exchange with this contact is required.",
+			})
+			c.contactsUI.SetIndicator(id, c.contactIndicator(contact))
+			c.contactsUI.SetSubline(id, c.contactSubline(contact))
+			c.save()
+			return c.showContact(id)
+		}
+
+		if click.name == "filter" {
+			if c.filterContact == id {
+				c.filterMessages(0)
+			} else {
+				c.filterMessages(id)
+			}
+			return c.showContact(id)
+		}
+
+		if click.name == "block" {
+			contact.blocked = !contact.blocked
+			c.save()
+			c.contactsUI.SetSubline(contact.id, c.contactSubline(contact))
+			return c.showContact(id)
+		}
+
+		if click.name == "mute" {
+			contact.muted = !contact.muted
+			c.save()
+			c.contactsUI.SetLine(contact.id, contactLine(contact))
+			return c.showContact(id)
+		}
+
+		if click.name == "verify" {
+			contact.verified = !contact.verified
+			msg := "Marked as verified."
+			if !contact.verified {
+				msg = "Marked as unverified."
+			}
+			contact.events = append(contact.events, Event{t: c.Now(), msg: msg})
+			c.save()
+			return c.showContact(id)
+		}
+
+		if click.name == "archive" {
+			contact.tags = parseTags(formatTags(append(contact.tags, archivedTag)))
+			c.save()
+			c.contactsUI.SetLine(contact.id, contactLine(contact))
+			c.filterContactsByTag(c.contactTagFilter)
+			return c.showContact(id)
+		}
+
+		if click.name == "tags" || click.name == "settags" {
+			contact.tags = parseTags(click.entries["tags"])
+			c.save()
+			c.filterContactsByTag(c.contactTagFilter)
+			return c.showContact(id)
+		}
+
+		if click.name == "color" {
+			contact.color = ""
+			if selected := click.combos["color"]; selected != automaticColor {
+				contact.color = selected
+			}
+			c.updateContactAvatars(contact)
+			c.save()
+			continue
+		}
+
+		if click.name == "rotatedh" && canRotateDH(contact) {
+			c.rotateDH(contact)
+			contact.events = append(contact.events, Event{t: c.Now(), msg: "Rotated keys. The new key will be sent with the next message."})
+			c.save()
+			return c.showContact(id)
+		}
+
+		if click.name == "ratchet" {
+			if ratchetShown {
+				c.gui.Actions() <- Destroy{name: "ratchetaudit"}
+				c.gui.Actions() <- SetButtonText{name: "ratchet", text: "Show Ratchet"}
+			} else {
+				c.gui.Actions() <- InsertRow{name: "lhs", pos: len(entries), row: []GridE{
+					{2, 1, ratchetAuditWidget(c.theme(), c.auditRatchet(contact), contact.dhRotationPending || contact.ratchet != nil && contact.ratchet.WillAdvance())},
+				}}
+				c.gui.Actions() <- SetButtonText{name: "ratchet", text: "Hide Ratchet"}
+			}
+			ratchetShown = !ratchetShown
+			c.gui.Signal()
+			continue
+		}
+
+		if click.name == "delete" || click.name == "revokeddelete" {
 			if deleteArmed {
-				c.gui.Actions() <- Sensitive{name: "delete", sensitive: false}
+				c.gui.Actions() <- Sensitive{name: click.name, sensitive: false}
 				c.gui.Signal()
 				c.deleteContact(contact)
-				c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+				c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
 				c.gui.Actions() <- UIState{uiStateRevocationComplete}
 				c.gui.Signal()
 				c.save()
 				return nil
 			} else {
 				deleteArmed = true
-				c.gui.Actions() <- SetButtonText{name: "delete", text: "Confirm"}
+				c.gui.Actions() <- SetButtonText{name: click.name, text: "Confirm"}
 				c.gui.Signal()
 			}
 		}
@@ -2147,6 +6311,121 @@ func (c *guiClient) showContact(id uint64) interface{} {
 	panic("unreachable")
 }
 
+// conversationUI shows all the messages exchanged with contact, in both
+// directions, as a single thread.
+func (c *guiClient) conversationUI(contact *Contact) interface{} {
+	entries := c.conversation(contact)
+
+	grid := conversationGrid(c.theme(), contact.name, entries)
+	if len(entries) == 0 {
+		grid.rows = append(grid.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{foreground: c.theme().subline},
+				text:       "No messages have been exchanged with " + contact.name + ".",
+			}},
+		})
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "CONVERSATION WITH "+strings.ToUpper(contact.name), nil, nil, grid)}
+	c.gui.Actions() <- UIState{uiStateConversation}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+	}
+
+	panic("unreachable")
+}
+
+// threadUI shows the chain of replies that ends with the message that has the
+// given pond.Message id. The messages in the chain are with the contact
+// called name.
+func (c *guiClient) threadUI(id uint64, name string) interface{} {
+	grid := conversationGrid(c.theme(), name, c.threadOf(id))
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "THREAD", nil, nil, grid)}
+	c.gui.Actions() <- UIState{uiStateThread}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+	}
+
+	panic("unreachable")
+}
+
+// conversationGrid returns a widget that displays entries, which are messages
+// exchanged with the contact called name, one after another. Sent and
+// received messages are distinguished by their alignment and background.
+func conversationGrid(t *theme, name string, entries []conversationEntry) Grid {
+	grid := Grid{
+		widgetBase: widgetBase{name: "conversation", margin: 6, hExpand: true},
+		rowSpacing: 6,
+	}
+
+	for _, entry := range entries {
+		if entry.missing {
+			grid.rows = append(grid.rows, []GridE{
+				{1, 1, Label{
+					widgetBase: widgetBase{name: fmt.Sprintf("conversation-missing-%d", entry.id), foreground: t.subline, margin: 6},
+					text:       "(an earlier message is no longer available)",
+					xAlign:     0.5,
+				}},
+			})
+			continue
+		}
+
+		var header string
+		var background uint32
+		var xAlign float32
+		if entry.sent {
+			header = "Sent " + entry.time.Format(time.RFC1123)
+			if entry.acked.IsZero() {
+				header += " (not yet acknowledged)"
+			} else {
+				header += " (acknowledged " + formatTime(entry.acked) + ")"
+			}
+			background = t.highlight
+			xAlign = 1
+		} else {
+			header = "Received from " + name + " " + entry.time.Format(time.RFC1123)
+			background = t.received
+		}
+
+		grid.rows = append(grid.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: t.headerForegroundSmall, hExpand: true},
+				text:       header,
+				xAlign:     xAlign,
+			}},
+		}, []GridE{
+			{1, 1, EventBox{
+				widgetBase: widgetBase{background: background, hExpand: true},
+				child: Label{
+					widgetBase: widgetBase{
+						name:    fmt.Sprintf("conversation-%d", entry.id),
+						font:    fontMainBody,
+						padding: 6,
+						margin:  6,
+					},
+					text:       entry.body,
+					wrap:       400,
+					selectable: true,
+					xAlign:     xAlign,
+				},
+			}},
+		})
+	}
+
+	return grid
+}
+
 func (c *guiClient) newContactUI(contact *Contact) interface{} {
 	var name string
 	existing := contact != nil
@@ -2223,9 +6502,32 @@ Manual keying (not generally recommended) involves exchanging key material with
 		},
 	}
 
+	if !existing {
+		grid.rows = append(grid.rows, [][]GridE{
+			{
+				{1, 1, nil},
+				{1, 1, Label{text: "Alternatively, several contacts can be created at once from a bundle of their handshake messages.", wrap: 400}},
+			},
+			{
+				{1, 1, nil},
+				{1, 1, Grid{
+					rows: [][]GridE{
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "bulkimport"},
+								text:       "Import Bundle",
+							}},
+							{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						},
+					},
+				}},
+			},
+		}...)
+	}
+
 	nextRow := len(grid.rows)
 
-	c.gui.Actions() <- SetChild{name: "right", child: rightPane("CREATE CONTACT", nil, nil, grid)}
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "CREATE CONTACT", nil, nil, grid)}
 	c.gui.Actions() <- UIState{uiStateNewContact}
 	c.gui.Signal()
 
@@ -2248,6 +6550,8 @@ Manual keying (not generally recommended) involves exchanging key material with
 
 		keyAgreementClick = nil
 		switch click.name {
+		case "bulkimport":
+			return c.bulkImportUI()
 		case "name":
 		case "manual", "shared":
 			// If the user clicked one of the key-agreement type
@@ -2264,21 +6568,14 @@ Manual keying (not generally recommended) involves exchanging key material with
 			continue
 		}
 
-		nameIsUnique := true
-		for _, contact := range c.contacts {
-			if contact.name == name {
-				const errText = "A contact by that name already exists!"
-				c.gui.Actions() <- SetText{name: "error1", text: errText}
-				c.gui.Actions() <- UIError{errors.New(errText)}
-				c.gui.Signal()
-				nameIsUnique = false
-				break
-			}
-		}
-
-		if nameIsUnique {
+		if !c.contactNameInUse(name) {
 			break
 		}
+
+		const errText = "A contact by that name already exists!"
+		c.gui.Actions() <- SetText{name: "error1", text: errText}
+		c.gui.Actions() <- UIError{errors.New(errText)}
+		c.gui.Signal()
 	}
 
 	contact = &Contact{
@@ -2311,6 +6608,8 @@ Manual keying (not generally recommended) involves exchanging key material with
 		var nextFunc func(*Contact, bool, int) interface{}
 
 		switch click.name {
+		case "bulkimport":
+			return c.bulkImportUI()
 		case "manual":
 			nextFunc = func(contact *Contact, existing bool, nextRow int) interface{} {
 				return c.newContactManual(contact, existing, nextRow)
@@ -2323,21 +6622,222 @@ Manual keying (not generally recommended) involves exchanging key material with
 			continue
 		}
 
-		c.gui.Actions() <- Sensitive{name: "manual", sensitive: false}
-		c.gui.Actions() <- Sensitive{name: "shared", sensitive: false}
-		return nextFunc(contact, existing, nextRow)
-	}
+		c.gui.Actions() <- Sensitive{name: "manual", sensitive: false}
+		c.gui.Actions() <- Sensitive{name: "shared", sensitive: false}
+		return nextFunc(contact, existing, nextRow)
+	}
+
+	panic("unreachable")
+}
+
+// bulkImportUI allows several contacts to be created at once from a bundle of
+// their key exchange messages.
+// introductionUI asks the user to confirm that they want to add the contact
+// whose handshake, block, was sent to them in a message by the contact called
+// introducer.
+func (c *guiClient) introductionUI(introducer string, block *pem.Block) interface{} {
+	grid := Grid{
+		widgetBase: widgetBase{margin: 5},
+		rowSpacing: 8,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "introducer"},
+					text:       fmt.Sprintf("%s sent you a handshake for someone else. Only add them if you trust %s to have introduced the right person, because you'll have no other assurance of who they are.", introducer, introducer),
+					wrap:       400,
+				}},
+			},
+			{
+				{2, 1, Label{
+					text: "Once they're added you can message them, but they can't reply until they have your handshake, which will be shown on their contact page.",
+					wrap: 400,
+				}},
+			},
+			{
+				{1, 1, Label{text: "Name"}},
+				{1, 1, Entry{
+					widgetBase: widgetBase{name: "name", hExpand: true},
+					text:       strings.TrimSpace(block.Headers["Name"]),
+				}},
+			},
+			{
+				{2, 1, Grid{
+					rows: [][]GridE{
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "add"},
+								text:       "Add Contact",
+							}},
+							{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						},
+					},
+				}},
+			},
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "error", foreground: colorRed},
+					wrap:       400,
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "INTRODUCTION", nil, nil, grid)}
+	c.gui.Actions() <- UIState{uiStateIntroduction}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		click, ok := event.(Click)
+		if !ok || (click.name != "add" && click.name != "name") {
+			continue
+		}
+
+		contact, err := c.addIntroducedContact(click.entries["name"], block.Bytes, introducer)
+		if err != nil {
+			c.gui.Actions() <- SetText{name: "error", text: err.Error()}
+			c.gui.Actions() <- UIState{uiStateIntroduction}
+			c.gui.Signal()
+			continue
+		}
+
+		c.contactsUI.Add(contact.id, contact.name, "", indicatorNone)
+		c.setContactAvatar(c.contactsUI, contact.id, contact)
+		c.probeServer(contact)
+		c.contactsUI.Select(contact.id)
+		c.selectedList, c.selectedId = selectionContact, contact.id
+		return c.showContact(contact.id)
+	}
+
+	panic("unreachable")
+}
+
+func (c *guiClient) bulkImportUI() interface{} {
+	grid := Grid{
+		widgetBase: widgetBase{name: "grid", margin: 5},
+		rowSpacing: 8,
+		colSpacing: 3,
+		rows: [][]GridE{
+			{
+				{1, 1, Label{text: "Paste the handshake messages of several contacts below. If a message has a \"Name\" header then that is used as the name of the contact. Otherwise a name is generated, which can be changed later.", wrap: 400}},
+			},
+			{
+				{1, 1, TextView{
+					widgetBase: widgetBase{
+						height: 300,
+						name:   "bundle",
+						font:   c.messageMonoFont(),
+					},
+					editable: true,
+				}},
+			},
+			{
+				{1, 1, Grid{
+					rows: [][]GridE{
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "import"},
+								text:       "Import",
+							}},
+							{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						},
+					},
+				}},
+			},
+			{
+				{1, 1, Label{
+					widgetBase: widgetBase{name: "importresults"},
+					wrap:       400,
+				}},
+			},
+		},
+	}
+	nextRow := len(grid.rows)
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "IMPORT CONTACTS", nil, nil, grid)}
+	c.gui.Actions() <- UIState{uiStateBulkImport}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		click, ok := event.(Click)
+		if !ok || click.name != "import" {
+			continue
+		}
+
+		results := c.importKeyExchangeBundle([]byte(click.textViews["bundle"]))
+		if len(results) == 0 {
+			const errText = "No key exchange messages found!"
+			c.gui.Actions() <- SetText{name: "importresults", text: errText}
+			c.gui.Actions() <- UIError{errors.New(errText)}
+			c.gui.Signal()
+			continue
+		}
 
-	panic("unreachable")
+		var summary, handshakes bytes.Buffer
+		for i, result := range results {
+			if result.err != nil {
+				fmt.Fprintf(&summary, "%d. Failed: %s\n", i+1, result.err)
+				continue
+			}
+			contact := result.contact
+			fmt.Fprintf(&summary, "%d. Created %s\n", i+1, contact.name)
+			c.contactsUI.Add(contact.id, contact.name, "", indicatorNone)
+			c.setContactAvatar(c.contactsUI, contact.id, contact)
+			c.unsealPendingMessages(contact)
+			c.probeServer(contact)
+			pem.Encode(&handshakes, &pem.Block{
+				Type:    keyExchangePEM,
+				Headers: map[string]string{"For": contact.name},
+				Bytes:   contact.kxsBytes,
+			})
+		}
+
+		// Importing the same bundle again would create duplicate
+		// contacts.
+		c.gui.Actions() <- Sensitive{name: "import", sensitive: false}
+		c.gui.Actions() <- SetText{name: "importresults", text: strings.TrimSpace(summary.String())}
+		if handshakes.Len() > 0 {
+			c.gui.Actions() <- InsertRow{name: "grid", pos: nextRow, row: []GridE{
+				{1, 1, Label{text: "Each new contact must now be given the handshake message below that is marked for them. They won't be able to message you until they process it.", wrap: 400}},
+			}}
+			c.gui.Actions() <- InsertRow{name: "grid", pos: nextRow + 1, row: []GridE{
+				{1, 1, TextView{
+					widgetBase: widgetBase{
+						height: 300,
+						name:   "bundleout",
+						font:   c.messageMonoFont(),
+					},
+					editable: false,
+					text:     handshakes.String(),
+				}},
+			}}
+		}
+		c.gui.Actions() <- UIState{uiStateBulkImport}
+		c.gui.Signal()
+	}
 }
 
 func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow int) interface{} {
 	if !existing {
 		c.newKeyExchange(contact)
 		c.contacts[contact.id] = contact
+		// The handshake mustn't be given out before the keys that
+		// it corresponds to are on disk.
 		c.save()
+		c.flush()
 
 		c.contactsUI.Add(contact.id, contact.name, "pending", indicatorNone)
+		c.setContactAvatar(c.contactsUI, contact.id, contact)
 		c.contactsUI.Select(contact.id)
 	}
 
@@ -2345,7 +6845,41 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 	pem.Encode(&out, &pem.Block{Bytes: contact.kxsBytes, Type: keyExchangePEM})
 	handshake := string(out.Bytes())
 
-	rows := [][]GridE{
+	var rows [][]GridE
+	if existing && c.handshakeStale(contact) {
+		rows = append(rows, []GridE{
+			{1, 1, nil},
+			{1, 1, Label{
+				widgetBase: widgetBase{name: "kxstale", foreground: colorRed},
+				text:       fmt.Sprintf("This handshake was created %s and hasn't been completed. It contains key material that anyone who obtains it could use, so it's best to replace it with a new one, and give that to them instead, unless they have already received it.", formatAgo(c.Now().Sub(contact.kxCreated))),
+				wrap:       400,
+			}},
+		})
+	}
+	if existing {
+		rows = append(rows, [][]GridE{
+			{
+				{1, 1, nil},
+				{1, 1, Label{text: "If the handshake below was lost, or may have been seen by someone else, then a new one can be created. The old handshake will stop working and a revocation will be sent to your home server.", wrap: 400}},
+			},
+			{
+				{1, 1, nil},
+				{1, 1, Grid{
+					rows: [][]GridE{
+						{
+							{1, 1, Button{
+								widgetBase: widgetBase{name: "regeneratekx"},
+								text:       "Regenerate Handshake",
+							}},
+							{1, 1, Label{widgetBase: widgetBase{hExpand: true}}},
+						},
+					},
+				}},
+			},
+		}...)
+	}
+
+	rows = append(rows, [][]GridE{
 		{
 			{1, 1, Label{text: "3."}},
 			{1, 1, Label{text: "Give them a handshake message."}},
@@ -2360,13 +6894,37 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 				widgetBase: widgetBase{
 					height: 150,
 					name:   "kxout",
-					font:   fontMainMono,
+					font:   c.messageMonoFont(),
 				},
 				editable: false,
 				text:     handshake,
 			},
 			},
 		},
+	}...)
+
+	if pngs, err := handshakeQRCodes(contact.kxsBytes); err == nil {
+		qrGrid := Grid{colSpacing: 5, rowSpacing: 5}
+		for i, png := range pngs {
+			if i%2 == 0 {
+				qrGrid.rows = append(qrGrid.rows, nil)
+			}
+			row := &qrGrid.rows[len(qrGrid.rows)-1]
+			*row = append(*row, GridE{1, 1, Image{png: png}})
+		}
+		rows = append(rows, [][]GridE{
+			{
+				{1, 1, nil},
+				{1, 1, Label{text: fmt.Sprintf("Alternatively, they can read the handshake from these %d QR codes.", len(pngs)), wrap: 400}},
+			},
+			{
+				{1, 1, nil},
+				{1, 1, qrGrid},
+			},
+		}...)
+	}
+
+	rows = append(rows, [][]GridE{
 		{
 			{1, 1, Label{text: "4."}},
 			{1, 1, Label{text: "Enter the handshake message from them."}},
@@ -2381,12 +6939,42 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 				widgetBase: widgetBase{
 					height: 150,
 					name:   "kxin",
-					font:   fontMainMono,
+					font:   c.messageMonoFont(),
 				},
 				editable: true,
 			},
 			},
 		},
+		{
+			{1, 1, nil},
+			{1, 1, Grid{
+				colSpacing: 5,
+				rows: [][]GridE{
+					{
+						{1, 1, Button{
+							widgetBase: widgetBase{name: "loadqr"},
+							text:       "Read QR Code",
+						}},
+						{1, 1, Label{
+							widgetBase: widgetBase{name: "qrstatus", hExpand: true},
+						}},
+					},
+				},
+			}},
+		},
+	}...)
+
+	if c.published != nil {
+		rows = append(rows, []GridE{
+			{1, 1, nil},
+			{1, 1, CheckButton{
+				widgetBase: widgetBase{name: "kxpublished"},
+				text:       "This is a reply to my published handshake. The handshake above won't be used.",
+			}},
+		})
+	}
+
+	rows = append(rows, [][]GridE{
 		{
 			{1, 1, nil},
 			{1, 1, Grid{
@@ -2413,7 +7001,14 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 				widgetBase: widgetBase{name: "error2", foreground: colorRed},
 			}},
 		},
-	}
+		{
+			{1, 1, nil},
+			{1, 1, Label{
+				widgetBase: widgetBase{name: "error2guidance"},
+				wrap:       400,
+			}},
+		},
+	}...)
 
 	for _, row := range rows {
 		c.gui.Actions() <- InsertRow{name: "grid", pos: nextRow, row: row}
@@ -2422,22 +7017,71 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 	c.gui.Actions() <- UIState{uiStateNewContact2}
 	c.gui.Signal()
 
+	var qrParts handshakeQRParts
+	// confirmedDuplicate is the existing contact, with the same identity
+	// as the processed handshake, that the user has been warned about. A
+	// further click on the button adds the contact anyway.
+	var confirmedDuplicate *Contact
+
 	for {
 		event, wanted := c.nextEvent(0)
 		if wanted {
 			return event
 		}
 
+		if open, ok := event.(OpenResult); ok && open.ok {
+			if _, ok := open.arg.(handshakeQRArg); !ok {
+				continue
+			}
+			payload, err := readQRFile(open.path)
+			var status string
+			if err == nil {
+				status, err = qrParts.add(payload)
+			}
+			if err != nil {
+				c.gui.Actions() <- SetText{name: "qrstatus", text: err.Error()}
+				c.gui.Actions() <- UIError{err}
+				c.gui.Signal()
+				continue
+			}
+			if kxsBytes, ok := qrParts.result(); ok {
+				var out bytes.Buffer
+				pem.Encode(&out, &pem.Block{Bytes: kxsBytes, Type: keyExchangePEM})
+				c.gui.Actions() <- SetTextView{name: "kxin", text: out.String()}
+				status = "Handshake read from QR codes"
+			}
+			c.gui.Actions() <- SetText{name: "qrstatus", text: status}
+			c.gui.Signal()
+			continue
+		}
+
 		click, ok := event.(Click)
 		if !ok {
 			continue
 		}
 
+		if click.name == "loadqr" {
+			c.gui.Actions() <- FileOpen{
+				title: "Select QR code image",
+				arg:   handshakeQRArg{},
+			}
+			c.gui.Signal()
+			continue
+		}
+
+		if click.name == "regeneratekx" {
+			revocation := c.regenerateKeyExchange(contact)
+			c.addRevocationMessageUI(revocation)
+			c.save()
+			c.contactsUI.SetSubline(contact.id, c.contactSubline(contact))
+			return c.newContactUI(contact)
+		}
+
 		if click.name == "abort" {
 			c.gui.Actions() <- Sensitive{name: "abort", sensitive: false}
 			c.gui.Signal()
 			c.deleteContact(contact)
-			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
 			c.gui.Actions() <- UIState{uiStateRevocationComplete}
 			c.gui.Signal()
 			c.save()
@@ -2447,30 +7091,60 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 		if click.name != "process" {
 			continue
 		}
+		if confirmedDuplicate != nil {
+			// The handshake has already been processed and the
+			// user has chosen to add the contact despite the
+			// warning.
+			break
+		}
 
-		block, _ := pem.Decode([]byte(click.textViews["kxin"]))
-		if block == nil || block.Type != keyExchangePEM {
-			const errText = "No key exchange message found!"
-			c.gui.Actions() <- SetText{name: "error2", text: errText}
-			c.gui.Actions() <- UIError{errors.New(errText)}
+		kxsBytes, err := parseHandshake(click.textViews["kxin"])
+		if err != nil {
+			c.gui.Actions() <- SetText{name: "error2", text: err.Error()}
+			c.gui.Actions() <- SetText{name: "error2guidance", text: err.(*handshakeError).guidance}
+			c.gui.Actions() <- UIError{err}
 			c.gui.Signal()
 			continue
 		}
-		if err := contact.processKeyExchange(block.Bytes, c.dev, c.simulateOldClient, c.disableV2Ratchet); err != nil {
+		var dup *Contact
+		if click.checks["kxpublished"] {
+			if err = c.usePublishedKeyExchange(contact, kxsBytes); err == nil {
+				dup = c.duplicateContact(contact)
+			}
+		} else {
+			dup, err = c.acceptKeyExchange(contact, kxsBytes)
+		}
+		if err != nil {
+			var guidance string
+			if kxErr, ok := err.(*kxError); ok {
+				guidance = kxErr.guidance()
+			}
 			c.gui.Actions() <- SetText{name: "error2", text: err.Error()}
+			c.gui.Actions() <- SetText{name: "error2guidance", text: guidance}
 			c.gui.Actions() <- UIError{err}
 			c.gui.Signal()
 			continue
-		} else {
-			break
 		}
+		if dup != nil {
+			confirmedDuplicate = dup
+			c.gui.Actions() <- Sensitive{name: "kxin", sensitive: false}
+			c.gui.Actions() <- Sensitive{name: "loadqr", sensitive: false}
+			c.gui.Actions() <- SetText{name: "error2", text: fmt.Sprintf("This handshake has the same identity as your contact %s.", dup.name)}
+			c.gui.Actions() <- SetText{name: "error2guidance", text: "Both contacts would be the same person. This may be a mistake, or someone may be pretending to be two different people. Abort unless you're sure that this is intended."}
+			c.gui.Actions() <- SetButtonText{name: "process", text: "Add Anyway"}
+			c.gui.Signal()
+			continue
+		}
+		break
 	}
 
 	// Unseal all pending messages from this new contact.
 	contact.isPending = false
 	c.unsealPendingMessages(contact)
-	c.contactsUI.SetSubline(contact.id, "")
+	c.releaseHeldMessages(contact)
+	c.probeServer(contact)
 	c.save()
+	c.flush()
 	return c.showContact(contact.id)
 }
 
@@ -2484,7 +7158,7 @@ func (c *guiClient) newContactPanda(contact *Contact, existing bool, nextRow int
 		rows: [][]GridE{
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "Shared secret",
 				}},
 				{2, 1, Grid{
@@ -2499,7 +7173,7 @@ func (c *guiClient) newContactPanda(contact *Contact, existing bool, nextRow int
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "Cards",
 				}},
 				{1, 1, Entry{widgetBase: widgetBase{name: "cardentry"}, updateOnChange: true}},
@@ -2515,7 +7189,7 @@ func (c *guiClient) newContactPanda(contact *Contact, existing bool, nextRow int
 			},
 			{
 				{1, 1, Label{
-					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+					widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "When",
 				}},
 				{2, 1, Grid{
@@ -2701,6 +7375,7 @@ SharedSecretEvent:
 
 				c.contacts[contact.id] = contact
 				c.contactsUI.Add(contact.id, contact.name, "pending", indicatorNone)
+				c.setContactAvatar(c.contactsUI, contact.id, contact)
 				c.contactsUI.Select(contact.id)
 
 				kx, err := panda.NewKeyExchange(c.rand, mp, &secret, contact.kxsBytes)
@@ -2719,6 +7394,7 @@ SharedSecretEvent:
 	}
 
 	c.save()
+	c.flush()
 	c.pandaWaitGroup.Add(1)
 	contact.pandaShutdownChan = make(chan struct{})
 	go c.runPANDA(contact.pandaKeyExchange, contact.id, contact.name, contact.pandaShutdownChan)
@@ -2769,6 +7445,50 @@ func widgetForAttachment(id uint64, label string, isError bool, extraWidgets []W
 	}
 }
 
+// widgetForInlineAttachment returns the widget for an attachment that is
+// included in the message itself. In addition to the usual attachment widget,
+// it allows the filename that will be sent to be edited and the attachment to
+// be moved up or down the list.
+func widgetForInlineAttachment(id uint64, attachment *pond.Message_Attachment) Widget {
+	return widgetForAttachment(id, inlineAttachmentLabel(attachment, false), false, []Widget{
+		HBox{
+			children: []Widget{
+				Label{
+					widgetBase: widgetBase{padding: 2},
+					text:       "Send as",
+					yAlign:     0.5,
+				},
+				Entry{
+					widgetBase:     widgetBase{name: fmt.Sprintf("attachment-name-%x", id), padding: 2},
+					text:           attachment.GetFilename(),
+					updateOnChange: true,
+				},
+				VBox{
+					widgetBase: widgetBase{expand: true, fill: true},
+				},
+				Button{
+					widgetBase: widgetBase{name: fmt.Sprintf("attachment-up-%x", id)},
+					text:       "Up",
+				},
+				Button{
+					widgetBase: widgetBase{name: fmt.Sprintf("attachment-down-%x", id)},
+					text:       "Down",
+				},
+			},
+		},
+	})
+}
+
+// inlineAttachmentLabel returns the text that describes an attachment that is
+// included in the message. If oversize is true then the attachment doesn't fit.
+func inlineAttachmentLabel(attachment *pond.Message_Attachment, oversize bool) string {
+	label := fmt.Sprintf("%s (%d bytes)", attachment.GetFilename(), len(attachment.Contents))
+	if oversize {
+		label += " (exceeds size limit)"
+	}
+	return label
+}
+
 type DetachmentUI interface {
 	IsValid(id uint64) bool
 	ProgressName(id uint64) string
@@ -2869,26 +7589,96 @@ func (c *guiClient) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI
 }
 
 func (c *guiClient) updateUsage(validContactSelected bool, draft *Draft) bool {
-	usageMessage, over := draft.usageString()
-	c.gui.Actions() <- SetText{name: "usage", text: usageMessage}
-	color := uint32(colorBlack)
+	usage := c.draftUsage(draft)
+	over := usage.over()
+	c.gui.Actions() <- SetText{name: "usage", text: usage.String()}
+	c.gui.Actions() <- SetText{name: "usagebreakdown", text: usage.breakdown()}
 	if over {
-		color = colorRed
 		c.gui.Actions() <- Sensitive{name: "send", sensitive: false}
 	} else if validContactSelected {
 		c.gui.Actions() <- Sensitive{name: "send", sensitive: true}
 	}
-	c.gui.Actions() <- SetForeground{name: "usage", foreground: color}
+	c.gui.Actions() <- SetForeground{name: "usage", foreground: usageColor(usage)}
 	return over
 }
 
+// markOversizeAttachments highlights the inline attachments that don't fit in
+// the message so that the user can see which to remove. ids identifies the
+// attachment widgets, in the same order as draft.attachments, and marked
+// records which of them are currently highlighted. It returns the filenames of
+// the attachments that don't fit.
+func (c *guiClient) markOversizeAttachments(draft *Draft, ids []uint64, marked map[uint64]bool) (filenames []string) {
+	oversize := make(map[uint64]bool)
+	for _, i := range c.oversizeAttachments(draft) {
+		oversize[ids[i]] = true
+		filenames = append(filenames, draft.attachments[i].GetFilename())
+	}
+
+	for i, id := range ids {
+		if oversize[id] == marked[id] {
+			continue
+		}
+		foreground := c.theme().foreground
+		if oversize[id] {
+			foreground = colorRed
+		}
+		labelName := fmt.Sprintf("attachment-label-%x", id)
+		c.gui.Actions() <- SetText{name: labelName, text: inlineAttachmentLabel(draft.attachments[i], oversize[id])}
+		c.gui.Actions() <- SetForeground{name: labelName, foreground: foreground}
+	}
+
+	for id := range marked {
+		delete(marked, id)
+	}
+	for id := range oversize {
+		marked[id] = true
+	}
+	return
+}
+
+// usageColor returns a color that shades from green, through orange, to red as
+// the size of a message approaches the maximum.
+func usageColor(usage draftUsage) uint32 {
+	const (
+		green  = 0x00a000
+		orange = 0xff8c00
+		red    = colorRed
+	)
+
+	if usage.over() {
+		return red
+	}
+
+	fraction := float64(usage.total) / pond.MaxSerializedMessage
+	switch {
+	case fraction < 0.5:
+		return green
+	case fraction < 0.8:
+		return blendColors(green, orange, (fraction-0.5)/0.3)
+	default:
+		return blendColors(orange, red, (fraction-0.8)/0.2)
+	}
+}
+
+// blendColors linearly interpolates between two colors, returning a when t is
+// zero and b when t is one.
+func blendColors(a, b uint32, t float64) uint32 {
+	var result uint32
+	for shift := uint(0); shift < 24; shift += 8 {
+		ca := float64((a >> shift) & 0xff)
+		cb := float64((b >> shift) & 0xff)
+		result |= uint32(ca+(cb-ca)*t+0.5) << shift
+	}
+	return result
+}
+
 func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
 	if draft != nil && inReplyTo != nil {
 		panic("draft and inReplyTo both set")
 	}
 
 	var contactNames []string
-	for _, contact := range c.contacts {
+	for _, contact := range c.sortedContacts() {
 		if !contact.isPending && !contact.revokedUs {
 			contactNames = append(contactNames, contact.name)
 		}
@@ -2901,15 +7691,17 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 		}
 	}
 
-	attachments := make(map[uint64]int)
+	// attachmentIds contains the UI id of each element of
+	// draft.attachments, in the same order.
+	var attachmentIds []uint64
 	detachments := make(map[uint64]int)
 
 	if draft != nil {
 		if to, ok := c.contacts[draft.to]; ok {
 			preSelected = to.name
 		}
-		for i := range draft.attachments {
-			attachments[c.randId()] = i
+		for _ = range draft.attachments {
+			attachmentIds = append(attachmentIds, c.randId())
 		}
 		for i := range draft.detachments {
 			detachments[c.randId()] = i
@@ -2925,6 +7717,13 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 		}
 	}
 
+	var defaultTo *Contact
+	if draft == nil && inReplyTo == nil {
+		if defaultTo = c.composeRecipient(); defaultTo != nil {
+			preSelected = defaultTo.name
+		}
+	}
+
 	if draft == nil {
 		from := preSelected
 		if len(preSelected) == 0 {
@@ -2938,15 +7737,18 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 		if inReplyTo != nil {
 			draft.inReplyTo = inReplyTo.id
 			draft.to = inReplyTo.from
-			draft.body = indentForReply(inReplyTo.message.GetBody())
+			draft.body = c.replyBody(inReplyTo)
+		} else if defaultTo != nil {
+			draft.to = defaultTo.id
 		}
 
 		c.draftsUI.Add(draft.id, from, draft.created.Format(shortTimeFormat), indicatorNone)
 		c.draftsUI.Select(draft.id)
 		c.drafts[draft.id] = draft
+		c.updateDraftIndicators(draft.to)
 	}
 
-	initialUsageMessage, overSize := draft.usageString()
+	initialUsage := c.draftUsage(draft)
 	validContactSelected := len(preSelected) > 0
 
 	lhs := VBox{
@@ -2955,7 +7757,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				widgetBase: widgetBase{padding: 2},
 				children: []Widget{
 					Label{
-						widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, padding: 10},
+						widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, padding: 10},
 						text:       "TO",
 						yAlign:     0.5,
 					},
@@ -2973,13 +7775,21 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				widgetBase: widgetBase{padding: 2},
 				children: []Widget{
 					Label{
-						widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, padding: 10},
+						widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, padding: 10},
 						text:       "SIZE",
 						yAlign:     0.5,
 					},
-					Label{
-						widgetBase: widgetBase{name: "usage"},
-						text:       initialUsageMessage,
+					VBox{
+						children: []Widget{
+							Label{
+								widgetBase: widgetBase{name: "usage", foreground: usageColor(initialUsage)},
+								text:       initialUsage.String(),
+							},
+							Label{
+								widgetBase: widgetBase{name: "usagebreakdown", foreground: c.theme().subline},
+								text:       initialUsage.breakdown(),
+							},
+						},
 					},
 				},
 			},
@@ -2987,7 +7797,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				widgetBase: widgetBase{padding: 0},
 				children: []Widget{
 					Label{
-						widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, padding: 10},
+						widgetBase: widgetBase{font: fontMainLabel, foreground: c.theme().headerForeground, padding: 10},
 						text:       "ATTACHMENTS",
 						yAlign:     0.5,
 					},
@@ -3002,6 +7812,11 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				children: []Widget{
 					VBox{
 						widgetBase: widgetBase{name: "filesvbox", padding: 25},
+						children: []Widget{
+							VBox{
+								widgetBase: widgetBase{name: "attachmentsvbox"},
+							},
+						},
 					},
 				},
 			},
@@ -3020,17 +7835,44 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			},
 		},
 	}
+	// If the message being replied to is about to be erased then the
+	// user is offered the chance to retain it so that the context of the
+	// reply isn't lost.
+	var erasureWarning Widget
+	if inReplyTo != nil && inReplyTo.erasesSoon(c.Now()) {
+		erasureWarning = EventBox{
+			widgetBase: widgetBase{name: "erasurewarning", background: c.theme().imminently},
+			child: HBox{
+				widgetBase: widgetBase{padding: 5},
+				children: []Widget{
+					Label{
+						widgetBase: widgetBase{name: "erasurewarningtext", padding: 10},
+						text:       "The message that you are replying to will be erased at " + inReplyTo.eraseTime().Format(time.RFC1123) + ".",
+						yAlign:     0.5,
+					},
+					Label{
+						widgetBase: widgetBase{expand: true, fill: true},
+					},
+					Button{
+						widgetBase: widgetBase{name: "retainoriginal", padding: 2},
+						text:       "Retain Original",
+					},
+				},
+			},
+		}
+	}
+
 	ui := VBox{
 		children: []Widget{
 			EventBox{
-				widgetBase: widgetBase{background: colorHeaderBackground},
+				widgetBase: widgetBase{background: c.theme().headerBackground},
 				child: VBox{
 					children: []Widget{
 						HBox{
 							widgetBase: widgetBase{padding: 10},
 							children: []Widget{
 								Label{
-									widgetBase: widgetBase{font: fontMainTitle, padding: 10, foreground: colorHeaderForeground},
+									widgetBase: widgetBase{font: fontMainTitle, padding: 10, foreground: c.theme().headerForeground},
 									text:       "COMPOSE",
 								},
 							},
@@ -3038,7 +7880,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					},
 				},
 			},
-			EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+			EventBox{widgetBase: widgetBase{height: 1, background: c.theme().sep}},
 			HBox{
 				children: []Widget{
 					lhs,
@@ -3052,28 +7894,97 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				widgetBase: widgetBase{expand: true, fill: true},
 				horizontal: true,
 				child: TextView{
-					widgetBase:     widgetBase{expand: true, fill: true, name: "body"},
+					widgetBase:     widgetBase{expand: true, fill: true, name: "body", font: c.messageFont()},
 					editable:       true,
 					wrap:           true,
 					updateOnChange: true,
-					spellCheck:     true,
+					spellCheck:     c.spellCheck,
 					text:           draft.body,
 				},
 			},
 		},
 	}
 
-	c.gui.Actions() <- SetChild{name: "right", child: ui}
+	if erasureWarning != nil {
+		// The warning goes just below the title.
+		ui.children = append(ui.children[:2], append([]Widget{erasureWarning}, ui.children[2:]...)...)
+	}
+
+	// The warning about an unverified recipient is shown, or hidden, as
+	// the recipient changes. It never prevents the message from being
+	// sent.
+	unverifiedWarning := EventBox{
+		widgetBase: widgetBase{name: "unverifiedwarning", background: c.theme().deleteSoon},
+		child: HBox{
+			widgetBase: widgetBase{padding: 5},
+			children: []Widget{
+				Label{
+					widgetBase: widgetBase{name: "unverifiedwarningtext", padding: 10},
+					yAlign:     0.5,
+				},
+				Label{
+					widgetBase: widgetBase{expand: true, fill: true},
+				},
+				Button{
+					widgetBase: widgetBase{name: "verifynow", padding: 2},
+					text:       "Verify Now",
+				},
+				Button{
+					widgetBase: widgetBase{name: "unverifiedok", padding: 2},
+					text:       "Don't Warn Again",
+				},
+			},
+		},
+	}
+	ui.children = append(ui.children[:2], append([]Widget{unverifiedWarning}, ui.children[2:]...)...)
+
+	// Files can be attached by dragging them anywhere onto the compose
+	// pane as well as with the attach button.
+	c.gui.Actions() <- SetChild{name: "right", child: EventBox{
+		widgetBase: widgetBase{expand: true, fill: true},
+		child:      ui,
+		dropFiles:  true,
+	}}
+
+	updateUnverifiedWarning := func() {
+		to, ok := c.contacts[draft.to]
+		show := ok && !to.verified && !to.noUnverifiedWarning
+		var text string
+		if show {
+			text = "You haven't verified " + to.name + "'s key."
+		}
+		c.gui.Actions() <- SetText{name: "unverifiedwarningtext", text: text}
+		c.gui.Actions() <- SetVisible{name: "unverifiedwarning", visible: show}
+	}
+	updateUnverifiedWarning()
 
 	if draft.pendingDetachments == nil {
 		draft.pendingDetachments = make(map[uint64]*pendingDetachment)
 	}
 
-	var initialAttachmentChildren []Widget
-	for id, index := range attachments {
-		attachment := draft.attachments[index]
-		initialAttachmentChildren = append(initialAttachmentChildren, widgetForAttachment(id, fmt.Sprintf("%s (%d bytes)", *attachment.Filename, len(attachment.Contents)), false, nil))
+	attachmentWidgets := func() (widgets []Widget) {
+		for i, id := range attachmentIds {
+			widgets = append(widgets, widgetForInlineAttachment(id, draft.attachments[i]))
+		}
+		return
+	}
+	attachmentIndex := func(id uint64) int {
+		for i, candidate := range attachmentIds {
+			if candidate == id {
+				return i
+			}
+		}
+		return -1
 	}
+
+	if len(attachmentIds) > 0 {
+		c.gui.Actions() <- Append{
+			name:     "attachmentsvbox",
+			children: attachmentWidgets(),
+		}
+	}
+
+	var initialAttachmentChildren []Widget
 	for id, index := range detachments {
 		detachment := draft.detachments[index]
 		initialAttachmentChildren = append(initialAttachmentChildren, widgetForAttachment(id, fmt.Sprintf("%s (%d bytes, external)", *detachment.Filename, *detachment.Size), false, nil))
@@ -3084,20 +7995,105 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				widgetBase: widgetBase{
 					name: fmt.Sprintf("attachment-progress-%x", id),
 				},
-			},
-		}))
-	}
+			},
+		}))
+	}
+
+	if len(initialAttachmentChildren) > 0 {
+		c.gui.Actions() <- Append{
+			name:     "filesvbox",
+			children: initialAttachmentChildren,
+		}
+	}
+
+	// oversizeIds contains the ids of the attachments that are marked as
+	// not fitting in the message.
+	oversizeIds := make(map[uint64]bool)
+	updateUsage := func() {
+		c.updateUsage(validContactSelected, draft)
+		if filenames := c.markOversizeAttachments(draft, attachmentIds, oversizeIds); len(filenames) > 0 {
+			c.gui.Actions() <- SetText{
+				name: "usagebreakdown",
+				text: c.draftUsage(draft).breakdown() + "\nRemove " + strings.Join(filenames, ", ") + " to send this message.",
+			}
+		}
+	}
+	updateUsage()
+
+	detachmentUI := ComposeDetachmentUI{draft, detachments, c.gui, updateUsage}
+
+	// addAttachment reads the file at path and adds it to the draft,
+	// either inline or, if it's too large, as a pending detachment.
+	addAttachment := func(path string) {
+		contents, size, err := openAttachment(path)
+		base := filepath.Base(path)
+		id := c.randId()
+
+		var label string
+		var extraWidgets []Widget
+		if err != nil {
+			label = base + ": " + err.Error()
+		} else if size > 0 {
+			// Oversize attachment.
+			label = fmt.Sprintf("%s (%d bytes, external)", base, size)
+			extraWidgets = []Widget{VBox{
+				widgetBase: widgetBase{
+					name: fmt.Sprintf("attachment-addi-%x", id),
+				},
+				children: []Widget{
+					Label{
+						widgetBase: widgetBase{
+							padding: 4,
+						},
+						text: "This file is too large to send via Pond directly. Instead, this Pond message can contain the encryption key for the file and the encrypted file can be transported via a non-Pond mechanism.",
+						wrap: 300,
+					},
+					HBox{
+						children: []Widget{
+							Button{
+								widgetBase: widgetBase{
+									name: fmt.Sprintf("attachment-convert-%x", id),
+								},
+								text: "Save Encrypted",
+							},
+							Button{
+								widgetBase: widgetBase{
+									name: fmt.Sprintf("attachment-upload-%x", id),
+								},
+								text: "Upload",
+							},
+						},
+					},
+				},
+			}}
 
-	if len(initialAttachmentChildren) > 0 {
-		c.gui.Actions() <- Append{
-			name:     "filesvbox",
-			children: initialAttachmentChildren,
+			draft.pendingDetachments[id] = &pendingDetachment{
+				path: path,
+				size: size,
+			}
+		} else {
+			a := newAttachment(base, contents)
+			label = inlineAttachmentLabel(a, false)
+			attachmentIds = append(attachmentIds, id)
+			draft.attachments = append(draft.attachments, a)
 		}
-	}
 
-	detachmentUI := ComposeDetachmentUI{draft, detachments, c.gui, func() {
-		overSize = c.updateUsage(validContactSelected, draft)
-	}}
+		if err == nil && size == 0 {
+			c.gui.Actions() <- Append{
+				name: "attachmentsvbox",
+				children: []Widget{
+					widgetForInlineAttachment(id, draft.attachments[len(draft.attachments)-1]),
+				},
+			}
+		} else {
+			c.gui.Actions() <- Append{
+				name: "filesvbox",
+				children: []Widget{
+					widgetForAttachment(id, label, err != nil, extraWidgets),
+				},
+			}
+		}
+	}
 
 	c.gui.Actions() <- UIState{uiStateCompose}
 	c.gui.Signal()
@@ -3108,78 +8104,48 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			return event
 		}
 
+		const attachmentNamePrefix = "attachment-name-"
+		if update, ok := event.(Update); ok && strings.HasPrefix(update.name, attachmentNamePrefix) {
+			// One of the attachment filenames was edited.
+			idStr := update.name[len(attachmentNamePrefix):]
+			id, err := strconv.ParseUint(idStr, 16, 64)
+			if err != nil {
+				panic(update.name)
+			}
+			i := attachmentIndex(id)
+			name := filepath.Base(strings.TrimSpace(update.text))
+			if i < 0 || len(name) == 0 || name == "." || name == string(filepath.Separator) {
+				continue
+			}
+			attachment := draft.attachments[i]
+			attachment.Filename = proto.String(name)
+			c.gui.Actions() <- SetText{name: "attachment-label-" + idStr, text: inlineAttachmentLabel(attachment, oversizeIds[id])}
+			updateUsage()
+			c.gui.Signal()
+			continue
+		}
+
 		if update, ok := event.(Update); ok {
-			overSize = c.updateUsage(validContactSelected, draft)
 			draft.body = update.text
+			updateUsage()
 			c.gui.Signal()
 			continue
 		}
 
 		if open, ok := event.(OpenResult); ok && open.ok && open.arg == nil {
 			// Opening a file for an attachment.
-			contents, size, err := openAttachment(open.path)
-			base := filepath.Base(open.path)
-			id := c.randId()
-
-			var label string
-			var extraWidgets []Widget
-			if err != nil {
-				label = base + ": " + err.Error()
-			} else if size > 0 {
-				// Oversize attachment.
-				label = fmt.Sprintf("%s (%d bytes, external)", base, size)
-				extraWidgets = []Widget{VBox{
-					widgetBase: widgetBase{
-						name: fmt.Sprintf("attachment-addi-%x", id),
-					},
-					children: []Widget{
-						Label{
-							widgetBase: widgetBase{
-								padding: 4,
-							},
-							text: "This file is too large to send via Pond directly. Instead, this Pond message can contain the encryption key for the file and the encrypted file can be transported via a non-Pond mechanism.",
-							wrap: 300,
-						},
-						HBox{
-							children: []Widget{
-								Button{
-									widgetBase: widgetBase{
-										name: fmt.Sprintf("attachment-convert-%x", id),
-									},
-									text: "Save Encrypted",
-								},
-								Button{
-									widgetBase: widgetBase{
-										name: fmt.Sprintf("attachment-upload-%x", id),
-									},
-									text: "Upload",
-								},
-							},
-						},
-					},
-				}}
-
-				draft.pendingDetachments[id] = &pendingDetachment{
-					path: open.path,
-					size: size,
-				}
-			} else {
-				label = fmt.Sprintf("%s (%d bytes)", base, len(contents))
-				a := &pond.Message_Attachment{
-					Filename: proto.String(base),
-					Contents: contents,
-				}
-				attachments[id] = len(draft.attachments)
-				draft.attachments = append(draft.attachments, a)
-			}
-
-			c.gui.Actions() <- Append{
-				name: "filesvbox",
-				children: []Widget{
-					widgetForAttachment(id, label, err != nil, extraWidgets),
-				},
+			addAttachment(open.path)
+			updateUsage()
+			c.gui.Signal()
+		}
+		if dropped, ok := event.(FilesDropped); ok {
+			// Each file is added separately so that one that
+			// can't be read doesn't prevent the others from being
+			// attached.
+			for _, path := range dropped.paths {
+				addAttachment(path)
 			}
-			overSize = c.updateUsage(validContactSelected, draft)
+			updateUsage()
 			c.gui.Signal()
 		}
 		if open, ok := event.(OpenResult); ok && open.ok && open.arg != nil {
@@ -3220,23 +8186,56 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			if len(selected) > 0 {
 				validContactSelected = true
 			}
+			previousTo := draft.to
 			for _, contact := range c.contacts {
 				if contact.name == selected {
 					draft.to = contact.id
 				}
 			}
+			if draft.to != previousTo {
+				c.updateDraftIndicators(previousTo)
+				c.updateDraftIndicators(draft.to)
+			}
 			c.draftsUI.SetLine(draft.id, selected)
-			if validContactSelected && !overSize {
-				c.gui.Actions() <- Sensitive{name: "send", sensitive: true}
-				c.gui.Signal()
+			// The recipient determines whether the body can be
+			// compressed and thus how much space it takes.
+			updateUsage()
+			updateUnverifiedWarning()
+			c.gui.Signal()
+			continue
+		}
+		if _, ok := c.contacts[draft.to]; ok && click.name == "verifynow" {
+			// The draft is kept and can be returned to once the
+			// contact has been verified.
+			c.draftsUI.Deselect()
+			c.contactsUI.Select(draft.to)
+			c.selectedList, c.selectedId = selectionContact, draft.to
+			return c.showContact(draft.to)
+		}
+		if click.name == "unverifiedok" {
+			if to, ok := c.contacts[draft.to]; ok {
+				to.noUnverifiedWarning = true
+				c.save()
 			}
+			updateUnverifiedWarning()
+			c.gui.Signal()
+			continue
+		}
+		if click.name == "retainoriginal" && inReplyTo != nil {
+			inReplyTo.retained = true
+			c.updateInboxBackgroundColor(inReplyTo)
+			c.save()
+			c.gui.Actions() <- Destroy{name: "erasurewarning"}
+			c.gui.Actions() <- UIState{uiStateCompose}
+			c.gui.Signal()
 			continue
 		}
 		if click.name == "discard" {
 			c.draftsUI.Remove(draft.id)
 			delete(c.drafts, draft.id)
+			c.updateDraftIndicators(draft.to)
 			c.save()
-			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
+			c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
 			c.gui.Actions() <- UIState{uiStateMain}
 			c.gui.Signal()
 			return nil
@@ -3248,9 +8247,9 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				panic(click.name)
 			}
 			c.gui.Actions() <- Destroy{name: "attachment-frame-" + click.name[7:]}
-			if index, ok := attachments[id]; ok {
+			if index := attachmentIndex(id); index >= 0 {
 				draft.attachments = append(draft.attachments[:index], draft.attachments[index+1:]...)
-				delete(attachments, id)
+				attachmentIds = append(attachmentIds[:index], attachmentIds[index+1:]...)
 			}
 			if detachment, ok := draft.pendingDetachments[id]; ok {
 				if detachment.cancel != nil {
@@ -3262,7 +8261,45 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 				draft.detachments = append(draft.detachments[:index], draft.detachments[index+1:]...)
 				delete(detachments, id)
 			}
-			overSize = c.updateUsage(validContactSelected, draft)
+			updateUsage()
+			c.gui.Signal()
+			continue
+		}
+		const upPrefix = "attachment-up-"
+		const downPrefix = "attachment-down-"
+		if strings.HasPrefix(click.name, upPrefix) || strings.HasPrefix(click.name, downPrefix) {
+			// One of the buttons that moves an attachment within the
+			// list. The order of the list is the order in which the
+			// attachments are sent.
+			var idStr string
+			delta := -1
+			if strings.HasPrefix(click.name, upPrefix) {
+				idStr = click.name[len(upPrefix):]
+			} else {
+				idStr = click.name[len(downPrefix):]
+				delta = 1
+			}
+			id, err := strconv.ParseUint(idStr, 16, 64)
+			if err != nil {
+				panic(click.name)
+			}
+			i := attachmentIndex(id)
+			j := i + delta
+			if i < 0 || j < 0 || j >= len(attachmentIds) {
+				continue
+			}
+			attachmentIds[i], attachmentIds[j] = attachmentIds[j], attachmentIds[i]
+			draft.attachments[i], draft.attachments[j] = draft.attachments[j], draft.attachments[i]
+			c.gui.Actions() <- SetBoxContents{
+				name:  "attachmentsvbox",
+				child: VBox{children: attachmentWidgets()},
+			}
+			// The new widgets aren't marked and the order
+			// determines which attachments fit.
+			for id := range oversizeIds {
+				delete(oversizeIds, id)
+			}
+			updateUsage()
 			c.gui.Signal()
 			continue
 		}
@@ -3319,12 +8356,14 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			}
 		}
 
+		var inReplyToId *uint64
 		if inReplyTo != nil {
 			draft.inReplyTo = inReplyTo.message.GetId()
+			inReplyToId = &draft.inReplyTo
 		}
 		draft.body = click.textViews["body"]
 
-		id, created, err := c.sendDraft(draft)
+		id, err := c.SendMessage(draft.to, draft.body, draft.attachments, draft.detachments, inReplyToId)
 		if err != nil {
 			// TODO: handle this case better.
 			println(err.Error())
@@ -3332,7 +8371,13 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			continue
 		}
 		to := c.contacts[draft.to]
-		c.outboxUI.Add(id, to.name, created.Format(shortTimeFormat), indicatorRed)
+		c.outboxUI.Add(id, to.name, c.Now().Format(shortTimeFormat), indicatorRed)
+		for _, msg := range c.outbox {
+			if msg.id == id {
+				c.setMessageDetail(c.outboxUI, id, msg.message)
+				break
+			}
+		}
 		if inReplyTo != nil {
 			inReplyTo.acked = true
 			c.inboxUI.SetIndicator(inReplyTo.id, indicatorNone)
@@ -3340,6 +8385,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 
 		c.draftsUI.Remove(draft.id)
 		delete(c.drafts, draft.id)
+		c.updateDraftIndicators(draft.to)
 
 		c.save()
 
@@ -3351,27 +8397,63 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 }
 
 // unsealPendingMessages is run once a key exchange with a contact has
-// completed and unseals any previously unreadable messages from that contact.
+// completed and starts unsealing any previously unreadable messages from that
+// contact. Since there may be many of them, they are unsealed in the
+// background by processUnsealStep.
 func (c *guiClient) unsealPendingMessages(contact *Contact) {
-	var needToFilter = true
+	if !c.hasSealedMessages(contact) {
+		c.finishUnsealing(contact)
+		return
+	}
+	c.startUnsealing(contact)
+}
 
-	for _, msg := range c.inbox {
-		if msg.message == nil && msg.from == contact.id {
-			if !c.unsealMessage(msg, contact) || len(msg.message.Body) == 0 {
-				c.inboxUI.Remove(msg.id)
-				needToFilter = true
-				continue
-			}
-			subline := time.Unix(*msg.message.Time, 0).Format(shortTimeFormat)
-			c.inboxUI.SetSubline(msg.id, subline)
-			c.inboxUI.SetIndicator(msg.id, indicatorBlue)
-		}
+// processUnsealStep unseals the next sealed message from a contact, or finishes
+// if there are none left.
+func (c *guiClient) processUnsealStep(step unsealStep) {
+	contact, ok := c.contacts[step.id]
+	if !ok {
+		// The contact was deleted, along with their messages.
+		step.more <- false
+		return
+	}
+
+	if len(contact.unsealQueue) == 0 {
+		contact.unsealing = false
+		c.finishUnsealing(contact)
+		c.save()
+		step.more <- false
+		return
 	}
 
-	if needToFilter {
-		c.dropSealedAndAckMessagesFrom(contact)
+	msg := contact.unsealQueue[0]
+	remaining := len(contact.unsealQueue)
+	contact.unsealQueue[0] = nil
+	contact.unsealQueue = contact.unsealQueue[1:]
+
+	c.contactsUI.SetSubline(contact.id, fmt.Sprintf("decrypting, %d left", remaining))
+	if !c.unsealMessage(msg, contact) {
+		c.inboxUI.Remove(msg.id)
+		c.deleteInboxMsg(msg.id)
+	} else if len(msg.message.Body) == 0 {
+		c.inboxUI.Remove(msg.id)
+	} else {
+		subline := messageTimeText(msg.message, shortTimeFormat)
+		c.inboxUI.SetSubline(msg.id, subline)
+		c.inboxUI.SetIndicator(msg.id, indicatorBlue)
+		c.setMessageDetail(c.inboxUI, msg.id, msg.message)
 	}
+	step.more <- true
+}
 
+// finishUnsealing updates the UI once all the messages from contact that were
+// received while the key exchange was pending have been unsealed.
+func (c *guiClient) finishUnsealing(contact *Contact) {
+	c.dropSealedAndAckMessagesFrom(contact)
+	c.contactsUI.SetSubline(contact.id, c.contactSubline(contact))
+	// The contact's default color is derived from their identity, which
+	// is now known.
+	c.updateContactAvatars(contact)
 	c.updateWindowTitle()
 }
 
@@ -3409,24 +8491,284 @@ func (c *guiClient) addRevocationMessageUI(msg *queuedMessage) {
 
 func (c *guiClient) removeContactUI(contact *Contact) {
 	c.contactsUI.Remove(contact.id)
+	if c.filterContact == contact.id {
+		c.filterMessages(0)
+	}
+}
+
+// filterMessages restricts the inbox and outbox to messages from and to the
+// contact with the given id. If id is zero then every message is shown again.
+func (c *guiClient) filterMessages(id uint64) {
+	c.filterContact = id
+	if id == 0 {
+		c.inboxUI.Filter(nil)
+		c.outboxUI.Filter(nil)
+		return
+	}
+
+	c.inboxUI.Filter(func(msgId uint64) bool {
+		for _, msg := range c.inbox {
+			if msg.id == msgId {
+				return msg.from == id
+			}
+		}
+		return false
+	})
+	c.outboxUI.Filter(func(msgId uint64) bool {
+		for _, msg := range c.outbox {
+			if msg.id == msgId {
+				return msg.to == id
+			}
+		}
+		return false
+	})
+}
+
+// filterContactsByTag limits the contacts list to those with a tag that
+// starts with query. An empty query, or "all", shows every contact again.
+func (c *guiClient) filterContactsByTag(query string) {
+	c.contactTagFilter = strings.TrimSpace(query)
+	if matchesAllTags(c.contactTagFilter) {
+		c.contactsUI.Filter(nil)
+		return
+	}
+	c.contactsUI.Filter(func(id uint64) bool {
+		contact, ok := c.contacts[id]
+		return ok && contactMatchesTag(contact, c.contactTagFilter)
+	})
 }
 
 func (c *guiClient) logEventUI(contact *Contact, event Event) {
 	c.contactsUI.SetIndicator(contact.id, indicatorBlue)
 }
 
+// closeWindow closes the window, which causes the state to be saved and the
+// client to exit.
+func (c *guiClient) closeWindow() {
+	c.quitAfterTransaction = quitNotWaiting
+	c.gui.Actions() <- CloseWindow{}
+	c.gui.Signal()
+}
+
+// checkQuitAfterTransaction is called with each notification from the network
+// goroutine and closes the window if the user asked to quit after the next
+// transaction and that transaction has completed.
+func (c *guiClient) checkQuitAfterTransaction(msr messageSendResult) {
+	switch c.quitAfterTransaction {
+	case quitNotWaiting:
+		return
+	case quitWaitingForStart:
+		// A zero id is sent when a transaction starts.
+		if msr.id == 0 {
+			c.quitAfterTransaction = quitWaitingForEnd
+		}
+	case quitWaitingForEnd:
+		// Either a message was successfully sent or another
+		// transaction has started, in which case the previous one
+		// has completed.
+		c.closeWindow()
+		return
+	}
+
+	if c.unsentMessageCount() == 0 {
+		c.closeWindow()
+	}
+}
+
+// quitUI is shown when the user closes the window while messages are waiting
+// to be sent. Closing then would delay their delivery until Pond is next run.
+func (c *guiClient) quitUI() interface{} {
+	n := c.unsentMessageCount()
+	noun := "messages haven't"
+	if n == 1 {
+		noun = "message hasn't"
+	}
+
+	grid := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 6,
+		colSpacing: 6,
+		rows: [][]GridE{
+			{
+				{3, 1, Label{
+					widgetBase: widgetBase{name: "quitmessage"},
+					text:       fmt.Sprintf("%d %s been sent yet. If Pond is closed now then they will be sent when it's next run, which may delay their delivery.", n, noun),
+					wrap:       500,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "quitwait"},
+					text:       "Try Sending, Then Quit",
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "quitnow"},
+					text:       "Quit Now",
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "quitcancel"},
+					text:       "Cancel",
+				}},
+			},
+			{
+				{3, 1, CheckButton{
+					widgetBase: widgetBase{name: "quitdontask"},
+					text:       "Don't ask again",
+				}},
+			},
+			{
+				{3, 1, Label{
+					widgetBase: widgetBase{name: "quitstatus"},
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), "QUIT", grid, nil, nil)}
+	c.gui.Actions() <- UIState{uiStateQuit}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+
+		click, ok := event.(Click)
+		if !ok {
+			continue
+		}
+
+		switch click.name {
+		case "quitwait", "quitnow":
+			if click.checks["quitdontask"] {
+				c.noQuitPrompt = true
+				c.save()
+			}
+			if click.name == "quitnow" {
+				c.closeWindow()
+				continue
+			}
+			c.quitAfterTransaction = quitWaitingForStart
+			c.gui.Actions() <- Sensitive{name: "quitwait", sensitive: false}
+			c.gui.Actions() <- SetText{name: "quitstatus", text: "Pond will close once the next attempt to send has completed."}
+			c.gui.Signal()
+		case "quitcancel":
+			c.quitAfterTransaction = quitNotWaiting
+			c.gui.Actions() <- SetChild{name: "right", child: c.rightPlaceholderUI()}
+			c.gui.Actions() <- UIState{uiStateMain}
+			c.gui.Signal()
+			return nil
+		}
+	}
+
+	panic("unreachable")
+}
+
+// confirm asks the user to confirm an action, such as a deletion, by showing
+// title and body in the right pane with Yes and No buttons. It returns true if
+// the user clicks Yes. Until they answer, the rest of the main window is
+// ignored, although background events are still processed. The right pane is
+// left showing the question so the caller must replace it.
+func (c *guiClient) confirm(title, body string) bool {
+	grid := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 6,
+		colSpacing: 6,
+		rows: [][]GridE{
+			{
+				{2, 1, Label{
+					widgetBase: widgetBase{name: "confirmbody"},
+					text:       body,
+					wrap:       500,
+				}},
+			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "confirmyes"},
+					text:       "Yes",
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: "confirmno"},
+					text:       "No",
+				}},
+			},
+		},
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane(c.theme(), title, grid, nil, nil)}
+	c.gui.Actions() <- SetFocus{name: "confirmno"}
+	c.gui.Actions() <- UIState{uiStateConfirm}
+	c.gui.Signal()
+
+	for {
+		event, _ := c.nextEvent(0)
+		if click, ok := event.(Click); ok {
+			switch click.name {
+			case "confirmyes":
+				return true
+			case "confirmno":
+				return false
+			}
+		}
+	}
+
+	panic("unreachable")
+}
+
+// openURL asks the user to confirm that u, a link from a message, should be
+// opened and, if so, runs the browser command from the preferences with it.
+// The full URL is shown because opening it with a browser that doesn't use
+// Tor reveals the user's IP address to the site. If no command has been set
+// then the user is offered a copy of the link instead. Like confirm, it leaves
+// the right pane for the caller to replace.
+func (c *guiClient) openURL(u string) {
+	args, err := browserCommandArgs(c.browserCommand, u)
+	switch {
+	case err == errNoBrowserCommand:
+		if c.confirm("OPEN LINK", u+"\n\nNo command for opening links has been set in the preferences. Copy this link to the clipboard instead?") {
+			c.gui.Actions() <- SetClipboard{u}
+			c.gui.Signal()
+		}
+		return
+	case err != nil:
+		c.log.Errorf("Not opening link %q: %s", u, err)
+		return
+	}
+
+	if !c.confirm("OPEN LINK", fmt.Sprintf("%s\n\nOpen this link with %q? Unless that browser uses Tor, the site and anyone watching your connection will learn your IP address and that you were sent this link.", u, c.browserCommand)) {
+		return
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		c.log.Errorf("Failed to open link with %q: %s", c.browserCommand, err)
+		return
+	}
+	c.log.Printf("Opened link with %q", c.browserCommand)
+	go cmd.Wait()
+}
+
+// logAllContacts is the entry in the activity log's contact filter that shows
+// the entries for every contact.
+const logAllContacts = "All contacts"
+
 func (c *guiClient) logUI() interface{} {
+	contactNames := []string{logAllContacts}
+	for _, contact := range c.sortedContacts() {
+		contactNames = append(contactNames, contact.name)
+	}
+
 	ui := VBox{
 		children: []Widget{
 			EventBox{
-				widgetBase: widgetBase{background: colorHeaderBackground},
+				widgetBase: widgetBase{background: c.theme().headerBackground},
 				child: VBox{
 					children: []Widget{
 						HBox{
 							widgetBase: widgetBase{padding: 10},
 							children: []Widget{
 								Label{
-									widgetBase: widgetBase{font: "Arial 16", padding: 10, foreground: colorHeaderForeground},
+									widgetBase: widgetBase{font: "Arial 16", padding: 10, foreground: c.theme().headerForeground},
 									text:       "ACTIVITY LOG",
 								},
 							},
@@ -3434,7 +8776,7 @@ func (c *guiClient) logUI() interface{} {
 					},
 				},
 			},
-			EventBox{widgetBase: widgetBase{height: 1, background: colorSep}},
+			EventBox{widgetBase: widgetBase{height: 1, background: c.theme().sep}},
 			HBox{
 				widgetBase: widgetBase{
 					padding: 5,
@@ -3451,6 +8793,14 @@ func (c *guiClient) logUI() interface{} {
 							padding: 10,
 						},
 						children: []Widget{
+							Combo{
+								widgetBase: widgetBase{
+									name:    "logcontact",
+									padding: 2,
+								},
+								labels:      contactNames,
+								preSelected: logAllContacts,
+							},
 							Button{
 								widgetBase: widgetBase{
 									name:    "clear-log",
@@ -3480,19 +8830,35 @@ func (c *guiClient) logUI() interface{} {
 		},
 	}
 
-	log := ""
+	// filter is the id of the contact whose entries are shown, or zero to
+	// show every entry.
+	var filter uint64
+	var log []TextSpan
 	lastProcessedIndex := -1
 
+	// appendEntry adds entry to log unless it's filtered out. Entries that
+	// concern a contact are tagged with their name, in their color.
+	appendEntry := func(entry logEntry) {
+		if filter != 0 && entry.contact != filter {
+			return
+		}
+		log = append(log, TextSpan{text: entry.Format(logTimeFormat) + ": "})
+		if contact, ok := c.contacts[entry.contact]; ok {
+			log = append(log, TextSpan{text: "[" + contact.name + "] ", foreground: contactAvatarColor(contact).color})
+		}
+		log = append(log, TextSpan{text: entry.s + "\n"})
+	}
+
 	c.log.Lock()
 	logEpoch := c.log.epoch
 	for _, entry := range c.log.entries {
-		log += fmt.Sprintf("%s: %s\n", entry.Format(logTimeFormat), entry.s)
+		appendEntry(entry)
 		lastProcessedIndex++
 	}
 	c.log.Unlock()
 
 	c.gui.Actions() <- SetChild{name: "right", child: ui}
-	c.gui.Actions() <- SetTextView{name: "log", text: log}
+	c.gui.Actions() <- SetTextView{name: "log", spans: log}
 	c.gui.Actions() <- UIState{uiStateLog}
 	c.gui.Actions() <- ScrollTextViewToEnd{name: "log"}
 	c.gui.Signal()
@@ -3515,25 +8881,36 @@ func (c *guiClient) logUI() interface{} {
 			c.log.clear()
 			logEpoch = c.log.epoch
 			lastProcessedIndex = -1
-			log = ""
-			c.gui.Actions() <- SetTextView{name: "log", text: log}
+			log = nil
+			c.gui.Actions() <- SetTextView{name: "log"}
 			c.gui.Signal()
 			continue
 		}
 
+		refilter := false
+		if click, ok := event.(Click); ok && click.name == "logcontact" {
+			filter = 0
+			for _, contact := range c.contacts {
+				if contact.name == click.combos["logcontact"] {
+					filter = contact.id
+				}
+			}
+			refilter = true
+		}
+
 		c.log.Lock()
-		if logEpoch != c.log.epoch {
+		if logEpoch != c.log.epoch || refilter {
 			logEpoch = c.log.epoch
 			lastProcessedIndex = -1
-			log = ""
+			log = nil
 		}
 		for _, entry := range c.log.entries[lastProcessedIndex+1:] {
-			log += fmt.Sprintf("%s: %s\n", entry.Format(logTimeFormat), entry.s)
+			appendEntry(entry)
 			lastProcessedIndex++
 		}
 		c.log.Unlock()
 
-		c.gui.Actions() <- SetTextView{name: "log", text: log}
+		c.gui.Actions() <- SetTextView{name: "log", spans: log}
 		c.gui.Actions() <- ScrollTextViewToEnd{name: "log"}
 		c.gui.Signal()
 	}
@@ -3541,7 +8918,10 @@ func (c *guiClient) logUI() interface{} {
 	return nil
 }
 
-func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFetch bool) *guiClient {
+// NewGUIClient returns a client that uses gui. If servers is not nil then it
+// overrides the default choice of servers when creating an account. If appName
+// is not empty then it replaces "Pond" in the window title and the main window.
+func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFetch bool, servers *serverDefaults, appName string) *guiClient {
 	c := &guiClient{
 		client: client{
 			testing:            testing,
@@ -3558,10 +8938,14 @@ func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFe
 			pandaChan:          make(chan pandaUpdate, 1),
 			signingRequestChan: make(chan signingRequest),
 			usedIds:            make(map[uint64]bool),
+			appName:            appName,
 		},
-		gui: gui,
+		gui: &batchGUI{GUI: gui},
 	}
 	c.ui = c
+	if servers != nil {
+		c.servers = *servers
+	}
 
 	if !testing {
 		c.timerChan = time.Tick(60 * time.Second)
@@ -3569,7 +8953,7 @@ func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFe
 
 	c.newMeetingPlace = func() panda.MeetingPlace {
 		return &panda.HTTPMeetingPlace{
-			TorAddress: c.torAddress,
+			TorAddress: c.proxyAddr(),
 			URL:        "https://panda-key-exchange.appspot.com/exchange",
 		}
 	}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"code.google.com/p/goprotobuf/proto"
+	pond "github.com/agl/pond/protos"
+)
+
+// handshakeError is returned by parseHandshake. In addition to the error, it
+// carries guidance for the user about what may have gone wrong.
+type handshakeError struct {
+	msg      string
+	guidance string
+}
+
+func (e *handshakeError) Error() string {
+	return e.msg
+}
+
+const (
+	handshakeBegin = "-----BEGIN " + keyExchangePEM + "-----"
+	handshakeEnd   = "-----END " + keyExchangePEM + "-----"
+)
+
+// normalizeHandshakeText removes the damage that handshakes commonly suffer
+// when they are passed through email or chat: whitespace around each line and
+// quoting with leading "> " markers.
+func normalizeHandshakeText(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		for strings.HasPrefix(line, ">") {
+			line = strings.TrimSpace(line[1:])
+		}
+		lines[i] = line
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// parseHandshake extracts a serialised key exchange message from text that
+// the user pasted. It's lenient about the formatting: quoting is removed and
+// base64 without the BEGIN and END lines is accepted as long as it decodes to
+// something that looks like a key exchange. The result must still be
+// validated by processKeyExchange. On failure, the error is a
+// *handshakeError.
+func parseHandshake(text string) ([]byte, error) {
+	text = normalizeHandshakeText(text)
+	if len(text) == 0 {
+		return nil, &handshakeError{"No key exchange message found!", "Paste their whole handshake message, including the BEGIN and END lines."}
+	}
+
+	if block, _ := pem.Decode([]byte(text)); block != nil {
+		if block.Type != keyExchangePEM && block.Type != publishedKeyExchangePEM {
+			return nil, &handshakeError{"No key exchange message found!", fmt.Sprintf("This is a %q block rather than a Pond handshake.", block.Type)}
+		}
+		return block.Bytes, nil
+	}
+
+	hasBegin := strings.Contains(text, handshakeBegin)
+	hasEnd := strings.Contains(text, handshakeEnd)
+
+	// Try to interpret whatever is between the BEGIN and END lines, if
+	// any, as the base64 contents of the handshake.
+	var encoded []string
+	for _, line := range strings.Split(text, "\n") {
+		if line == handshakeBegin || line == handshakeEnd {
+			continue
+		}
+		encoded = append(encoded, line)
+	}
+	if kxsBytes, err := base64.StdEncoding.DecodeString(strings.Join(encoded, "")); err == nil && looksLikeHandshake(kxsBytes) {
+		return kxsBytes, nil
+	}
+
+	var guidance string
+	switch {
+	case hasBegin && !hasEnd:
+		guidance = "The END line is missing. The handshake may have been cut off when it was copied."
+	case !hasBegin && hasEnd:
+		guidance = "The BEGIN line is missing. Make sure that the whole handshake was copied."
+	case hasBegin && hasEnd:
+		guidance = "The text between the BEGIN and END lines is damaged. Ask them to send the handshake again, perhaps as an attachment."
+	default:
+		guidance = "Paste their whole handshake message, including the BEGIN and END lines."
+	}
+	return nil, &handshakeError{"No key exchange message found!", guidance}
+}
+
+// embeddedHandshakes returns the key exchange PEM blocks in the body of a
+// received message. A contact can introduce someone else to the user by
+// sending them that person's handshake.
+func embeddedHandshakes(body string) []*pem.Block {
+	var blocks []*pem.Block
+	for rest := []byte(normalizeHandshakeText(body)); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return blocks
+		}
+		if block.Type == keyExchangePEM && looksLikeHandshake(block.Bytes) {
+			blocks = append(blocks, block)
+		}
+	}
+}
+
+// looksLikeHandshake returns true if b parses as a signed key exchange. It
+// doesn't check the signature or the contents.
+func looksLikeHandshake(b []byte) bool {
+	var kxs pond.SignedKeyExchange
+	if err := proto.Unmarshal(b, &kxs); err != nil {
+		return false
+	}
+	return len(kxs.Signed) > 0 && len(kxs.Signature) > 0
+}
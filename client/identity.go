@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+// identityPEM is the PEM type of the block that contains the details that a
+// user shares so that others can recognise them: their home server, public
+// identity and public key.
+const identityPEM = "POND IDENTITY"
+
+// identityBlock returns the user's home server, public identity and public key
+// in a block that can be pasted into an email or chat and later parsed with
+// parseIdentityBlock.
+func (c *client) identityBlock() string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type: identityPEM,
+		Headers: map[string]string{
+			"Server":     c.server,
+			"Identity":   hex.EncodeToString(c.identityPublic[:]),
+			"Public-Key": hex.EncodeToString(c.pub[:]),
+		},
+	}))
+}
+
+// parseIdentityBlock parses a block produced by identityBlock. Quoting and
+// surrounding whitespace are tolerated, as for handshakes.
+func parseIdentityBlock(text string) (server string, identityPublic, pub [32]byte, err error) {
+	block, _ := pem.Decode([]byte(normalizeHandshakeText(text)))
+	if block == nil || block.Type != identityPEM {
+		err = errors.New("no identity block found")
+		return
+	}
+
+	server = block.Headers["Server"]
+	if !strings.HasPrefix(server, "pondserver://") {
+		err = errors.New("identity block doesn't contain a valid server")
+		return
+	}
+	if err = decodeHexKey(identityPublic[:], block.Headers["Identity"]); err != nil {
+		err = errors.New("identity block contains an invalid identity: " + err.Error())
+		return
+	}
+	if err = decodeHexKey(pub[:], block.Headers["Public-Key"]); err != nil {
+		err = errors.New("identity block contains an invalid public key: " + err.Error())
+	}
+	return
+}
+
+// decodeHexKey decodes s, which must be exactly len(out) bytes of hex, into
+// out.
+func decodeHexKey(out []byte, s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(out) {
+		return errors.New("wrong length")
+	}
+	copy(out, b)
+	return nil
+}
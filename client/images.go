@@ -15,6 +15,10 @@ const (
 	indicatorBlack
 	indicatorRemove
 	indicatorAdd
+	indicatorOrange
+	// indicatorDraft marks contacts, and the outbox messages to them, for
+	// which there's an unsent draft.
+	indicatorDraft
 	indicatorCount
 )
 
@@ -35,6 +39,10 @@ func (i Indicator) Star() string {
 		return starWithColor(57)
 	case indicatorBlack:
 		return starWithColor(201)
+	case indicatorOrange:
+		return starWithColor(208)
+	case indicatorDraft:
+		return starWithColor(129)
 	}
 
 	return " "
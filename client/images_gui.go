@@ -2,10 +2,130 @@
 
 package main
 
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+)
+
 func (i Indicator) pngBytes() []byte {
 	return indicatorPNGBytes[i]
 }
 
+// indicatorShape is an alternative image for an indicator: a shape, drawn in
+// the indicator's usual color, that distinguishes it without relying on color
+// alone.
+type indicatorShape struct {
+	color color.NRGBA
+	// rows is the mask of the shape, with '#' marking the pixels that
+	// are drawn.
+	rows [8]string
+}
+
+// indicatorShapes contains the shapes of the colored indicators. The meaning of
+// each is unchanged: red for messages that haven't been sent and for blocked
+// contacts, yellow and orange for messages that are awaiting an
+// acknowledgement, green for those that have been acknowledged, blue for
+// unread messages, black for contacts that have revoked us and purple for
+// contacts with an unsent draft.
+var indicatorShapes = map[Indicator]indicatorShape{
+	indicatorRed: {color.NRGBA{0xff, 0x00, 0x00, 0xc0}, [8]string{
+		"........",
+		".######.",
+		".######.",
+		".######.",
+		".######.",
+		".######.",
+		".######.",
+		"........",
+	}},
+	indicatorYellow: {color.NRGBA{0xff, 0xf2, 0x00, 0xb9}, [8]string{
+		"...##...",
+		"...##...",
+		"..####..",
+		"..####..",
+		".######.",
+		".######.",
+		"########",
+		"########",
+	}},
+	indicatorOrange: {color.NRGBA{0xff, 0x84, 0x00, 0xb9}, [8]string{
+		"########",
+		"########",
+		".######.",
+		".######.",
+		"..####..",
+		"..####..",
+		"...##...",
+		"...##...",
+	}},
+	indicatorGreen: {color.NRGBA{0x00, 0xff, 0x00, 0xb9}, [8]string{
+		"...##...",
+		"..####..",
+		".######.",
+		"########",
+		"########",
+		".######.",
+		"..####..",
+		"...##...",
+	}},
+	indicatorBlue: {color.NRGBA{0x07, 0x01, 0xff, 0xc0}, [8]string{
+		"...##...",
+		".######.",
+		".######.",
+		"########",
+		"########",
+		".######.",
+		".######.",
+		"...##...",
+	}},
+	indicatorDraft: {color.NRGBA{0x9c, 0x27, 0xb0, 0xc0}, [8]string{
+		"......##",
+		".....###",
+		"....###.",
+		"...###..",
+		"..###...",
+		".###....",
+		"###.....",
+		"##......",
+	}},
+	indicatorBlack: {color.NRGBA{0x00, 0x00, 0x00, 0xc0}, [8]string{
+		"..####..",
+		".##..##.",
+		"##....##",
+		"#......#",
+		"#......#",
+		"##....##",
+		".##..##.",
+		"..####..",
+	}},
+}
+
+// shapedPNGBytes returns the indicator's image, as a PNG, with its shape from
+// indicatorShapes. Indicators without a shape are unchanged.
+func (i Indicator) shapedPNGBytes() []byte {
+	shape, ok := indicatorShapes[i]
+	if !ok {
+		return i.pngBytes()
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, len(shape.rows[0]), len(shape.rows)))
+	for y, row := range shape.rows {
+		for x, pixel := range row {
+			if pixel == '#' {
+				img.SetNRGBA(x, y, shape.color)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
 var indicatorPNGBytes = [][]byte{
 	{
 		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
@@ -116,4 +236,27 @@ var indicatorPNGBytes = [][]byte{
 		0x2f, 0x83, 0xdc, 0x8d, 0xae, 0x10, 0x00, 0xb6, 0xdd, 0xbf, 0x8e, 0x33, 0x76, 0x4d, 0x53, 0x00,
 		0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
 	},
+	{
+		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+		0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x08, 0x08, 0x06, 0x00, 0x00, 0x00, 0xc4, 0x0f, 0xbe,
+		0x8b, 0x00, 0x00, 0x00, 0x74, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x74, 0x8f, 0xb1, 0x0d, 0xc3,
+		0x20, 0x10, 0x45, 0x5f, 0x4e, 0x29, 0x90, 0xd2, 0xa7, 0x66, 0x02, 0x96, 0xa2, 0x61, 0x90, 0x94,
+		0x19, 0x20, 0x0d, 0xbb, 0x30, 0x03, 0x13, 0xa4, 0xa6, 0x70, 0x67, 0xc9, 0x1d, 0xd6, 0xc9, 0x67,
+		0xc9, 0xc2, 0xf6, 0x3b, 0xd1, 0xfc, 0x0f, 0xe8, 0xdd, 0xb3, 0x7f, 0x3d, 0x2c, 0xff, 0x37, 0x10,
+		0x81, 0xc0, 0x46, 0x05, 0x32, 0xce, 0xb7, 0x47, 0xff, 0xa0, 0xe5, 0x0f, 0x78, 0x59, 0xb9, 0xcf,
+		0x0c, 0x24, 0xb1, 0x97, 0x63, 0x89, 0x65, 0x51, 0x0e, 0xdf, 0x5e, 0x11, 0x64, 0x08, 0x4e, 0x88,
+		0x09, 0xdd, 0x51, 0xf5, 0x42, 0x36, 0xa1, 0x71, 0x54, 0x32, 0x8b, 0xae, 0xa2, 0xb6, 0x40, 0x01,
+		0x26, 0x3b, 0x05, 0x48, 0x38, 0xdf, 0xd6, 0x01, 0x00, 0xe8, 0xc7, 0x16, 0xa6, 0x99, 0x93, 0xcb,
+		0x3d, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+	},
+	{
+		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
+		0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x08, 0x08, 0x06, 0x00, 0x00, 0x00, 0xc4, 0x0f, 0xbe,
+		0x8b, 0x00, 0x00, 0x00, 0x3c, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x62, 0x61, 0x80, 0x82, 0x39,
+		0xea, 0x1b, 0x0e, 0xc0, 0xd8, 0x20, 0x98, 0x72, 0x33, 0xc0, 0x01, 0x44, 0x33, 0x61, 0x93, 0x44,
+		0x16, 0x63, 0xc4, 0x26, 0x89, 0x0c, 0x98, 0xd0, 0xf8, 0xb4, 0x50, 0x00, 0x73, 0x2d, 0x36, 0x00,
+		0x92, 0x63, 0x42, 0xf6, 0x12, 0x32, 0x4c, 0xb9, 0x19, 0xe0, 0xc0, 0xc0, 0xc0, 0xc0, 0x00, 0x18,
+		0x00, 0x30, 0xf8, 0x11, 0xdf, 0xea, 0x2a, 0xa2, 0x71, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4e,
+		0x44, 0xae, 0x42, 0x60, 0x82,
+	},
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// errNoBrowserCommand is returned by browserCommandArgs when the user hasn't
+// configured a command for opening links.
+var errNoBrowserCommand = errors.New("no command for opening links has been set")
+
+// checkLinkURL returns an error unless u is an absolute http or https URL.
+// Links with other schemes, such as file, are never opened.
+func checkLinkURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("only http and https links can be opened")
+	}
+	if len(parsed.Host) == 0 {
+		return errors.New("link has no host")
+	}
+	return nil
+}
+
+// browserCommandArgs returns the arguments for running command in order to
+// open u. The command is split on whitespace, without any interpretation by
+// a shell, and u is added as the final argument.
+func browserCommandArgs(command, u string) ([]string, error) {
+	if err := checkLinkURL(u); err != nil {
+		return nil, err
+	}
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errNoBrowserCommand
+	}
+	return append(args, u), nil
+}
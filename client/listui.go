@@ -7,22 +7,46 @@ import (
 )
 
 // listUI manages the sections in the left-hand side list. It contains a number
-// of items, which may have subheadlines and indicators (coloured dots).
+// of items, which may have subheadlines, indicators (coloured dots) and
+// avatars.
 type listUI struct {
-	gui        GUI
-	vboxName   string
-	entries    []listItem
-	selected   uint64
+	gui      GUI
+	theme    *theme
+	vboxName string
+	entries  []listItem
+	// selected is the entry whose details are shown in the right pane, or
+	// zero if there isn't one.
+	selected uint64
+	// multiSelected contains the ids of the entries that the user has
+	// selected together, using shift or control, when there are more than
+	// one. selected is zero in that case.
+	multiSelected map[uint64]bool
+	// anchor is the entry from which a shift-click selects a range.
+	anchor     uint64
 	nextId     int
 	hasSubline bool
+	// filter, if not nil, returns true for the ids of the entries that
+	// should be visible.
+	filter func(id uint64) bool
+	// shapedIndicators is true if indicators should be drawn with
+	// distinct shapes, rather than distinguished only by color.
+	shapedIndicators bool
 }
 
 type listItem struct {
 	id                                                                           uint64
 	name, sepName, boxName, imageName, lineName, sublineTextName, sublineBoxName string
+	lineBoxName, avatarName, avatarTextName, detailName                          string
 	insensitive                                                                  bool
 	hasSubline                                                                   bool
+	hasAvatar                                                                    bool
+	hasDetail                                                                    bool
 	background                                                                   uint32
+	// hasSep is true if the entry is preceded by a separator bar.
+	hasSep bool
+	// hidden and sepHidden record whether the entry and its separator
+	// have been hidden by a filter.
+	hidden, sepHidden bool
 }
 
 func (cs *listUI) Event(event interface{}) (uint64, bool) {
@@ -40,11 +64,11 @@ func (cs *listUI) Event(event interface{}) (uint64, bool) {
 	return 0, false
 }
 
-func sublineLabel(name, text string) Label {
+func sublineLabel(t *theme, name, text string) Label {
 	return Label{
 		widgetBase: widgetBase{
 			padding:    5,
-			foreground: colorSubline,
+			foreground: t.subline,
 			font:       fontListSubline,
 			name:       name,
 		},
@@ -62,24 +86,29 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 		lineName:        cs.newIdent(),
 		sublineTextName: cs.newIdent(),
 		sublineBoxName:  cs.newIdent(),
-		background:      colorGray,
+		lineBoxName:     cs.newIdent(),
+		avatarName:      cs.newIdent(),
+		avatarTextName:  cs.newIdent(),
+		detailName:      cs.newIdent(),
+		background:      cs.theme.pane,
 		hasSubline:      len(subline) > 0,
 	}
+	index := len(cs.entries)
+	c.hasSep = index > 0
 	cs.entries = append(cs.entries, c)
-	index := len(cs.entries) - 1
 
 	if index > 0 {
 		// Add the separator bar.
 		cs.gui.Actions() <- AddToBox{
 			box:   cs.vboxName,
 			pos:   index*2 - 1,
-			child: EventBox{widgetBase: widgetBase{height: 1, background: 0xe5e6e6, name: c.sepName}},
+			child: EventBox{widgetBase: widgetBase{height: 1, background: cs.theme.listSep, name: c.sepName}},
 		}
 	}
 
 	children := []Widget{
 		HBox{
-			widgetBase: widgetBase{padding: 1},
+			widgetBase: widgetBase{padding: 1, name: c.lineBoxName},
 			children: []Widget{
 				Label{
 					widgetBase: widgetBase{
@@ -96,7 +125,7 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 	var sublineChildren []Widget
 
 	if len(subline) > 0 {
-		sublineChildren = append(sublineChildren, sublineLabel(c.sublineTextName, subline))
+		sublineChildren = append(sublineChildren, sublineLabel(cs.theme, c.sublineTextName, subline))
 	}
 
 	sublineChildren = append(sublineChildren, Image{
@@ -107,6 +136,7 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 			name:    c.imageName,
 		},
 		image:  indicator,
+		png:    cs.indicatorPNG(indicator),
 		xAlign: 1,
 		yAlign: 0.5,
 	})
@@ -125,6 +155,10 @@ func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
 		},
 	}
 	cs.gui.Signal()
+
+	if cs.filter != nil {
+		cs.applyFilter()
+	}
 }
 
 func (cs *listUI) SetInsensitive(id uint64) {
@@ -137,9 +171,9 @@ func (cs *listUI) SetInsensitive(id uint64) {
 
 func (cs *listUI) Remove(id uint64) {
 	newEntries := make([]listItem, 0, len(cs.entries))
-	for i, entry := range cs.entries {
+	for _, entry := range cs.entries {
 		if entry.id == id {
-			if i > 0 {
+			if entry.hasSep {
 				cs.gui.Actions() <- Destroy{name: entry.sepName}
 			}
 			cs.gui.Actions() <- Destroy{name: entry.boxName}
@@ -147,6 +181,10 @@ func (cs *listUI) Remove(id uint64) {
 			if cs.selected == id {
 				cs.selected = 0
 			}
+			delete(cs.multiSelected, id)
+			if cs.anchor == id {
+				cs.anchor = 0
+			}
 			continue
 		}
 		newEntries = append(newEntries, entry)
@@ -156,9 +194,65 @@ func (cs *listUI) Remove(id uint64) {
 		panic("unknown id passed to Remove")
 	}
 	cs.entries = newEntries
+
+	// A multiple selection that is reduced to a single entry is just a
+	// selection.
+	if cs.multiSelected != nil && len(cs.multiSelected) < 2 {
+		for id := range cs.multiSelected {
+			cs.selected = id
+		}
+		cs.multiSelected = nil
+	}
+
+	if cs.filter != nil {
+		cs.applyFilter()
+	}
+}
+
+// Filter hides the entries for which predicate returns false, including any
+// that are added later. A nil predicate shows every entry again. The selection
+// is unchanged so that, if the selected entry is hidden, it's still selected
+// once the filter is cleared.
+func (cs *listUI) Filter(predicate func(id uint64) bool) {
+	cs.filter = predicate
+	cs.applyFilter()
+}
+
+// applyFilter shows and hides the entries, and the separators between them,
+// to match the current filter.
+func (cs *listUI) applyFilter() {
+	anyVisible := false
+	for i := range cs.entries {
+		entry := &cs.entries[i]
+		hidden := cs.filter != nil && !cs.filter(entry.id)
+		// A separator is only needed between two visible entries.
+		sepHidden := hidden || !anyVisible
+		if !hidden {
+			anyVisible = true
+		}
+
+		changed := false
+		if entry.hasSep && entry.sepHidden != sepHidden {
+			cs.gui.Actions() <- SetVisible{name: entry.sepName, visible: !sepHidden}
+			entry.sepHidden = sepHidden
+			changed = true
+		}
+		if entry.hidden != hidden {
+			cs.gui.Actions() <- SetVisible{name: entry.boxName, visible: !hidden}
+			entry.hidden = hidden
+			changed = true
+		}
+		if changed {
+			cs.gui.Signal()
+		}
+	}
 }
 
 func (cs *listUI) Deselect() {
+	if cs.multiSelected != nil {
+		cs.setSelection(nil)
+		return
+	}
 	if cs.selected == 0 {
 		return
 	}
@@ -178,6 +272,11 @@ func (cs *listUI) Deselect() {
 }
 
 func (cs *listUI) Select(id uint64) {
+	cs.anchor = id
+	if cs.multiSelected != nil {
+		cs.setSelection(map[uint64]bool{id: true})
+		return
+	}
 	if id == cs.selected {
 		return
 	}
@@ -203,15 +302,119 @@ func (cs *listUI) Select(id uint64) {
 	if currentlySelected != nil {
 		cs.gui.Actions() <- SetBackground{name: currentlySelected.boxName, color: currentlySelected.background}
 	}
-	cs.gui.Actions() <- SetBackground{name: newSelected.boxName, color: colorHighlight}
+	cs.gui.Actions() <- SetBackground{name: newSelected.boxName, color: cs.theme.highlight}
 	cs.selected = id
 	cs.gui.Signal()
 }
 
+// ToggleSelected adds id to the selection, or removes it if it's already
+// selected, as for a control-click.
+func (cs *listUI) ToggleSelected(id uint64) {
+	selection := make(map[uint64]bool)
+	for _, selectedId := range cs.SelectedIds() {
+		selection[selectedId] = true
+	}
+	if selection[id] {
+		delete(selection, id)
+	} else {
+		selection[id] = true
+	}
+	cs.anchor = id
+	cs.setSelection(selection)
+}
+
+// SelectRange selects the visible entries from the anchor, which is the last
+// entry that was clicked without shift, to id inclusive, as for a
+// shift-click. Without an anchor, only id is selected.
+func (cs *listUI) SelectRange(id uint64) {
+	selection := map[uint64]bool{id: true}
+	if cs.anchor != 0 && cs.anchor != id {
+		inRange := false
+		for _, entry := range cs.entries {
+			isEnd := entry.id == cs.anchor || entry.id == id
+			if (inRange || isEnd) && !entry.hidden && !entry.insensitive {
+				selection[entry.id] = true
+			}
+			if isEnd {
+				if inRange {
+					break
+				}
+				inRange = true
+			}
+		}
+	}
+	cs.setSelection(selection)
+}
+
+// SelectedIds returns the ids of the selected entries in the order in which
+// they appear in the list.
+func (cs *listUI) SelectedIds() []uint64 {
+	var ids []uint64
+	for _, entry := range cs.entries {
+		if entry.id == cs.selected || cs.multiSelected[entry.id] {
+			ids = append(ids, entry.id)
+		}
+	}
+	return ids
+}
+
+// isSelected returns true if the entry with the given id is highlighted,
+// either alone or as part of a multiple selection.
+func (cs *listUI) isSelected(id uint64) bool {
+	return (cs.selected != 0 && cs.selected == id) || cs.multiSelected[id]
+}
+
+// setSelection highlights exactly the entries in selection. A single entry
+// becomes the selected entry, as if it had been clicked on.
+func (cs *listUI) setSelection(selection map[uint64]bool) {
+	wasSelected := make(map[uint64]bool)
+	for _, id := range cs.SelectedIds() {
+		wasSelected[id] = true
+	}
+
+	cs.selected, cs.multiSelected = 0, nil
+	switch len(selection) {
+	case 0:
+	case 1:
+		for id := range selection {
+			cs.selected = id
+		}
+	default:
+		cs.multiSelected = selection
+	}
+
+	changed := false
+	for _, entry := range cs.entries {
+		if selection[entry.id] == wasSelected[entry.id] {
+			continue
+		}
+		color := entry.background
+		if selection[entry.id] {
+			color = cs.theme.highlight
+		}
+		cs.gui.Actions() <- SetBackground{name: entry.boxName, color: color}
+		changed = true
+	}
+	if changed {
+		cs.gui.Signal()
+	}
+}
+
+// SelectEvent returns an event that is equivalent to the user clicking on the
+// entry with the given id. It returns false if there's no such entry.
+func (cs *listUI) SelectEvent(id uint64) (Click, bool) {
+	for _, entry := range cs.entries {
+		if entry.id == id && !entry.insensitive {
+			return Click{name: entry.boxName}, true
+		}
+	}
+	return Click{}, false
+}
+
 func (cs *listUI) SetIndicator(id uint64, indicator Indicator) {
 	for _, entry := range cs.entries {
 		if entry.id == id {
-			cs.gui.Actions() <- SetImage{name: entry.imageName, image: indicator}
+			cs.gui.Actions() <- SetImage{name: entry.imageName, image: indicator, png: cs.indicatorPNG(indicator)}
 			cs.gui.Signal()
 			break
 		}
@@ -243,7 +446,7 @@ func (cs *listUI) SetSubline(id uint64, subline string) {
 				cs.gui.Actions() <- AddToBox{
 					box:   entry.sublineBoxName,
 					pos:   0,
-					child: sublineLabel(entry.sublineTextName, subline),
+					child: sublineLabel(cs.theme, entry.sublineTextName, subline),
 				}
 				cs.entries[i].hasSubline = true
 			}
@@ -253,11 +456,76 @@ func (cs *listUI) SetSubline(id uint64, subline string) {
 	}
 }
 
+// SetDetail sets a second, optional, piece of text that follows the subline
+// of an entry, such as the size of a message. An empty detail removes it.
+func (cs *listUI) SetDetail(id uint64, detail string) {
+	for i, entry := range cs.entries {
+		if entry.id == id {
+			if entry.hasDetail {
+				if len(detail) > 0 {
+					cs.gui.Actions() <- SetText{name: entry.detailName, text: detail}
+				} else {
+					cs.gui.Actions() <- Destroy{name: entry.detailName}
+					cs.entries[i].hasDetail = false
+				}
+			} else if len(detail) > 0 {
+				// The detail goes after the subline, if any, and
+				// before the indicator.
+				pos := 0
+				if entry.hasSubline {
+					pos = 1
+				}
+				cs.gui.Actions() <- AddToBox{
+					box:   entry.sublineBoxName,
+					pos:   pos,
+					child: sublineLabel(cs.theme, entry.detailName, detail),
+				}
+				cs.entries[i].hasDetail = true
+			}
+			cs.gui.Signal()
+			break
+		}
+	}
+}
+
+// SetAvatar sets the avatar of an entry: a short piece of text, typically an
+// initial, on a background of the given color that precedes the entry's name.
+func (cs *listUI) SetAvatar(id uint64, text string, color uint32) {
+	for i, entry := range cs.entries {
+		if entry.id == id {
+			if entry.hasAvatar {
+				cs.gui.Actions() <- SetText{name: entry.avatarTextName, text: text}
+				cs.gui.Actions() <- SetBackground{name: entry.avatarName, color: color}
+			} else {
+				cs.gui.Actions() <- AddToBox{
+					box: entry.lineBoxName,
+					pos: 0,
+					child: EventBox{
+						widgetBase: widgetBase{name: entry.avatarName, padding: 5, width: 22, background: color},
+						child: Label{
+							widgetBase: widgetBase{
+								name:       entry.avatarTextName,
+								foreground: colorWhite,
+								font:       fontListEntry,
+							},
+							text:   text,
+							xAlign: 0.5,
+						},
+					},
+				}
+				cs.entries[i].hasAvatar = true
+			}
+			cs.gui.Signal()
+			break
+		}
+	}
+}
+
 func (cs *listUI) SetBackground(id uint64, color uint32) {
 	for i, entry := range cs.entries {
 		if entry.id == id {
 			cs.entries[i].background = color
-			if cs.selected != id {
+			if !cs.isSelected(id) {
 				cs.gui.Actions() <- SetBackground{name: entry.boxName, color: color}
 				cs.gui.Signal()
 			}
@@ -266,6 +534,15 @@ func (cs *listUI) SetBackground(id uint64, color uint32) {
 	}
 }
 
+// indicatorPNG returns the image that should be shown for indicator, or nil if
+// the standard image should be used.
+func (cs *listUI) indicatorPNG(indicator Indicator) []byte {
+	if !cs.shapedIndicators {
+		return nil
+	}
+	return indicator.shapedPNGBytes()
+}
+
 func (cs *listUI) newIdent() string {
 	id := cs.vboxName + "-" + strconv.Itoa(cs.nextId)
 	cs.nextId++
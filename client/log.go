@@ -11,6 +11,9 @@ type logEntry struct {
 	time.Time
 	isError bool
 	s       string
+	// contact is the id of the contact whose conversation the entry
+	// concerns, or zero if it doesn't concern a single contact.
+	contact uint64
 }
 
 type Log struct {
@@ -31,11 +34,23 @@ func NewLog() *Log {
 }
 
 func (l *Log) Printf(format string, args ...interface{}) {
-	l.add(false, format, args...)
+	l.add(false, 0, format, args...)
 }
 
 func (l *Log) Errorf(format string, args ...interface{}) {
-	l.add(true, format, args...)
+	l.add(true, 0, format, args...)
+}
+
+// ContactPrintf is like Printf for an entry that concerns the conversation
+// with the given contact, so that the log can be filtered to show only that
+// conversation. A contact id of zero is the same as calling Printf.
+func (l *Log) ContactPrintf(contact uint64, format string, args ...interface{}) {
+	l.add(false, contact, format, args...)
+}
+
+// ContactErrorf is the Errorf equivalent of ContactPrintf.
+func (l *Log) ContactErrorf(contact uint64, format string, args ...interface{}) {
+	l.add(true, contact, format, args...)
 }
 
 const (
@@ -46,14 +61,15 @@ const (
 	logSlack = 250
 )
 
-func (l *Log) add(isError bool, format string, args ...interface{}) {
+func (l *Log) add(isError bool, contact uint64, format string, args ...interface{}) {
 	l.Lock()
 	defer l.Unlock()
 
 	entry := logEntry{
-		time.Now(),
-		isError,
-		fmt.Sprintf(format, args...),
+		Time:    time.Now(),
+		isError: isError,
+		s:       fmt.Sprintf(format, args...),
+		contact: contact,
 	}
 	if len(l.entries) > logLimit+logSlack {
 		newEntries := make([]logEntry, logLimit)
@@ -14,7 +14,9 @@ import (
 func main() {
 	devFlag := flag.Bool("dev", false, "Is this a development environment?")
 	stateFile := flag.String("state-file", "", "File in which to save persistent state")
+	profilesDir := flag.String("profiles", "", "Directory containing a state file for each profile. If set, a profile is chosen at startup and --state-file is ignored")
 	cliFlag := flag.Bool("cli", false, "If true, the CLI will be used, even if the GUI is available")
+	scriptFlag := flag.Bool("script", false, "If true, JSON commands are read from stdin and the results written to stdout")
 	flag.Parse()
 
 	runtime.LockOSThread()
@@ -37,16 +39,24 @@ func main() {
 
 	defer system.Shutdown()
 
-	if !haveGUI || *cliFlag {
-		client := NewCLIClient(*stateFile, rand.Reader, false /* testing */, true /* autoFetch */)
+	if *scriptFlag {
+		client := NewScriptClient(*stateFile, os.Stdin, os.Stdout, rand.Reader, false /* testing */, true /* autoFetch */, nil /* default servers */)
 		client.disableV2Ratchet = true
 		client.dev = dev
+		client.profilesDir = *profilesDir
+		client.Start()
+	} else if !haveGUI || *cliFlag {
+		client := NewCLIClient(*stateFile, rand.Reader, false /* testing */, true /* autoFetch */, nil /* default servers */)
+		client.disableV2Ratchet = true
+		client.dev = dev
+		client.profilesDir = *profilesDir
 		client.Start()
 	} else {
 		ui := NewGTKUI()
-		client := NewGUIClient(*stateFile, ui, rand.Reader, false /* testing */, true /* autoFetch */)
+		client := NewGUIClient(*stateFile, ui, rand.Reader, false /* testing */, true /* autoFetch */, nil /* default servers */, "" /* default name */)
 		client.disableV2Ratchet = true
 		client.dev = dev
+		client.profilesDir = *profilesDir
 		client.Start()
 		ui.Run()
 	}
@@ -14,8 +14,10 @@ import (
 
 func main() {
 	stateFile := flag.String("state-file", "", "File in which to save persistent state")
+	profilesDir := flag.String("profiles", "", "Directory containing a state file for each profile. If set, a profile is chosen at startup and --state-file is ignored")
 	pandaScrypt := flag.Bool("panda-scrypt", false, "Run in subprocess mode to process passphrase")
 	cliFlag := flag.Bool("cli", false, "If true, the CLI will be used, even if the GUI is available")
+	scriptFlag := flag.Bool("script", false, "If true, JSON commands are read from stdin and the results written to stdout")
 	devFlag := flag.Bool("dev", false, "Is this a development environment?")
 	flag.Parse()
 
@@ -63,16 +65,24 @@ func main() {
 		}
 	}
 
-	if !haveGUI || *cliFlag || len(os.Getenv("PONDCLI")) > 0 {
-		client := NewCLIClient(*stateFile, rand.Reader, false /* testing */, true /* autoFetch */)
+	if *scriptFlag {
+		client := NewScriptClient(*stateFile, os.Stdin, os.Stdout, rand.Reader, false /* testing */, true /* autoFetch */, nil /* default servers */)
 		client.disableV2Ratchet = true
 		client.dev = dev
+		client.profilesDir = *profilesDir
+		client.Start()
+	} else if !haveGUI || *cliFlag || len(os.Getenv("PONDCLI")) > 0 {
+		client := NewCLIClient(*stateFile, rand.Reader, false /* testing */, true /* autoFetch */, nil /* default servers */)
+		client.disableV2Ratchet = true
+		client.dev = dev
+		client.profilesDir = *profilesDir
 		client.Start()
 	} else {
 		ui := NewGTKUI()
-		client := NewGUIClient(*stateFile, ui, rand.Reader, false /* testing */, true /* autoFetch */)
+		client := NewGUIClient(*stateFile, ui, rand.Reader, false /* testing */, true /* autoFetch */, nil /* default servers */, "" /* default name */)
 		client.disableV2Ratchet = true
 		client.dev = dev
+		client.profilesDir = *profilesDir
 		client.Start()
 		ui.Run()
 	}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
 	"encoding/binary"
@@ -49,7 +48,7 @@ func (c *client) sendAck(msg *InboxMessage) {
 			proto.AlsoAck = append(proto.AlsoAck, msg.message.GetId())
 			if !tooLarge(queuedMsg) {
 				c.queueMutex.Unlock()
-				c.log.Printf("ACK merged with queued message.")
+				c.log.ContactPrintf(msg.from, "ACK merged with queued message.")
 				// All done.
 				return
 			}
@@ -65,9 +64,7 @@ func (c *client) sendAck(msg *InboxMessage) {
 	to := c.contacts[msg.from]
 	var myNextDH []byte
 	if to.ratchet == nil {
-		var nextDHPub [32]byte
-		curve25519.ScalarBaseMult(&nextDHPub, &to.currentDHPrivate)
-		myNextDH = nextDHPub[:]
+		myNextDH = c.nextDHPublic(to)
 	}
 
 	id := c.randId()
@@ -81,7 +78,7 @@ func (c *client) sendAck(msg *InboxMessage) {
 		SupportedVersion: proto.Int32(protoVersion),
 	})
 	if err != nil {
-		c.log.Errorf("Error sending message: %s", err)
+		c.log.ContactErrorf(msg.from, "Error sending message: %s", err)
 	}
 }
 
@@ -97,50 +94,116 @@ func (c *client) send(to *Contact, message *pond.Message) error {
 	}
 
 	out := &queuedMessage{
-		id:      *message.Id,
-		to:      to.id,
-		server:  to.theirServer,
-		message: message,
-		created: time.Unix(*message.Time, 0),
+		id:       *message.Id,
+		to:       to.id,
+		server:   to.theirServer,
+		servers:  to.servers(),
+		message:  message,
+		created:  time.Unix(*message.Time, 0),
+		enqueued: time.Now(),
 	}
 	c.enqueue(out)
 	c.outbox = append(c.outbox, out)
+	c.threadOutbox(out)
 
 	return nil
 }
 
-func (c *client) sendDraft(draft *Draft) (uint64, time.Time, error) {
-	to := c.contacts[draft.to]
+// resendAfter is the amount of time after which a message that has been
+// sent, but not acknowledged, may be resent.
+const resendAfter = 48 * time.Hour
+
+// canResend returns true if msg, from the outbox, may be sent again. That's
+// the case if it was sent but hasn't been acknowledged for some time.
+// Messages that the server rejects remain queued and are retried
+// automatically, while messages to contacts that have revoked us can never be
+// delivered, so neither can be resent.
+func (c *client) canResend(msg *queuedMessage) bool {
+	if msg.revocation || msg.message == nil || len(msg.message.Body) == 0 || !msg.acked.IsZero() || msg.sent.IsZero() {
+		return false
+	}
+	if to, ok := c.contacts[msg.to]; !ok || to.revokedUs {
+		return false
+	}
+	return c.Now().Sub(msg.sent) > resendAfter
+}
+
+// resend replaces msg in the outbox with a new transmission of the same
+// message. The message keeps its id and creation time so that the recipient
+// discards it if the original was received after all, and so that an
+// acknowledgement of either copy is recognised.
+func (c *client) resend(msg *queuedMessage) *queuedMessage {
+	to := c.contacts[msg.to]
+	if to.ratchet == nil {
+		// Our DH value may have changed since the message was
+		// originally sent.
+		msg.message.MyNextDh = c.nextDHPublic(to)
+	}
+
+	out := &queuedMessage{
+		id:       c.randId(),
+		to:       msg.to,
+		server:   to.theirServer,
+		servers:  to.servers(),
+		message:  msg.message,
+		created:  msg.created,
+		enqueued: time.Now(),
+
+		revokedDetachments: msg.revokedDetachments,
+	}
+	c.deleteOutboxMsg(msg.id)
+	c.enqueue(out)
+	c.outbox = append(c.outbox, out)
+	c.threadOutbox(out)
+
+	return out
+}
+
+// SendMessage creates a message to the given contact and enqueues it for
+// transmission. If inReplyTo is not nil then the message is marked as a reply
+// to the message with that id. It returns the id of the new outbox message.
+func (c *client) SendMessage(toContactID uint64, body string, files []*pond.Message_Attachment, detachments []*pond.Message_Detachment, inReplyTo *uint64) (uint64, error) {
+	to, ok := c.contacts[toContactID]
+	switch {
+	case !ok:
+		return 0, errors.New("no such contact")
+	case to.isPending:
+		return 0, errors.New("key exchange with contact hasn't completed")
+	case to.revokedUs:
+		return 0, errors.New("contact has revoked us")
+	case to.invalidServer != nil:
+		return 0, errors.New("contact's server is invalid: " + to.invalidServer.Error())
+	}
 
 	// Zero length bodies are ACKs.
-	if len(draft.body) == 0 {
-		draft.body = " "
+	if len(body) == 0 {
+		body = " "
 	}
 
 	id := c.randId()
-	created := c.Now()
+	encoded, encoding := c.encodeBody([]byte(body), to)
 	message := &pond.Message{
 		Id:               proto.Uint64(id),
-		Time:             proto.Int64(created.Unix()),
-		Body:             []byte(draft.body),
-		BodyEncoding:     pond.Message_RAW.Enum(),
-		Files:            draft.attachments,
-		DetachedFiles:    draft.detachments,
+		Time:             proto.Int64(c.Now().Unix()),
+		Body:             encoded,
+		BodyEncoding:     encoding.Enum(),
+		Files:            files,
+		DetachedFiles:    detachments,
 		SupportedVersion: proto.Int32(protoVersion),
 	}
 
-	if r := draft.inReplyTo; r != 0 {
-		message.InReplyTo = proto.Uint64(r)
+	if inReplyTo != nil {
+		message.InReplyTo = proto.Uint64(*inReplyTo)
 	}
 
 	if to.ratchet == nil {
-		var nextDHPub [32]byte
-		curve25519.ScalarBaseMult(&nextDHPub, &to.currentDHPrivate)
-		message.MyNextDh = nextDHPub[:]
+		message.MyNextDh = c.nextDHPublic(to)
 	}
 
-	err := c.send(to, message)
-	return id, created, err
+	if err := c.send(to, message); err != nil {
+		return 0, err
+	}
+	return id, nil
 }
 
 // tooLarge returns true if the given message is too large to serialise.
@@ -160,14 +223,25 @@ func (c *client) processSigningRequest(sigReq signingRequest) {
 	defer close(sigReq.resultChan)
 	to := c.contacts[sigReq.msg.to]
 
+	if to.isPending {
+		// Our home server changed after the network goroutine
+		// selected this message and the contact's keys have been
+		// replaced.
+		c.log.ContactPrintf(sigReq.msg.to, "Holding outgoing message until the new key exchange completes")
+		c.queueMutex.Lock()
+		sigReq.msg.held = true
+		c.queueMutex.Unlock()
+		return
+	}
+
 	messageBytes, err := proto.Marshal(sigReq.msg.message)
 	if err != nil {
-		c.log.Printf("Failed to sign outgoing message: %s", err)
+		c.log.ContactPrintf(sigReq.msg.to, "Failed to sign outgoing message: %s", err)
 		return
 	}
 
 	if len(messageBytes) > pond.MaxSerializedMessage {
-		c.log.Printf("Failed to sign outgoing message because it's too large")
+		c.log.ContactPrintf(sigReq.msg.to, "Failed to sign outgoing message because it's too large")
 		return
 	}
 
@@ -179,6 +253,9 @@ func (c *client) processSigningRequest(sigReq signingRequest) {
 
 	var sealed []byte
 	if to.ratchet != nil {
+		if to.ratchet.WillAdvance() {
+			to.ourDHAdvanced = c.Now()
+		}
 		sealed = to.ratchet.Encrypt(sealed, plaintext)
 	} else {
 		// The message is encrypted to an ephemeral key so that the sending
@@ -199,7 +276,7 @@ func (c *client) processSigningRequest(sigReq signingRequest) {
 
 		public, private, err := box.GenerateKey(c.rand)
 		if err != nil {
-			c.log.Printf("Failed to generate key for outgoing message: %s", err)
+			c.log.ContactPrintf(sigReq.msg.to, "Failed to generate key for outgoing message: %s", err)
 			return
 		}
 		box.Seal(x[:0], public[:], &outerNonce, &to.theirCurrentDHPublic, &to.lastDHPrivate)
@@ -218,7 +295,7 @@ func (c *client) processSigningRequest(sigReq signingRequest) {
 	sha.Reset()
 	groupSig, err := to.myGroupKey.Sign(c.rand, digest, sha)
 	if err != nil {
-		c.log.Printf("Failed to sign outgoing message: %s", err)
+		c.log.ContactPrintf(sigReq.msg.to, "Failed to sign outgoing message: %s", err)
 		return
 	}
 
@@ -260,6 +337,11 @@ func (c *client) revoke(to *Contact) *queuedMessage {
 		})
 		contact.groupKey.Update(revocation)
 	}
+	if c.published != nil {
+		// Contacts added from the published handshake in future
+		// are given copies of this key so it must stay current.
+		c.published.groupKey.Update(revocation)
+	}
 
 	rev := &pond.SignedRevocation_Revocation{
 		Revocation: revocation.Marshal(),
@@ -296,8 +378,26 @@ func (c *client) revoke(to *Contact) *queuedMessage {
 		server:     c.server, // revocations always go to the home server.
 		created:    time.Now(),
 	}
+	out.enqueued = out.created
 	c.enqueue(out)
 	c.outbox = append(c.outbox, out)
+
+	// Each fallback server has its own copy of our group and so needs
+	// the revocation too. The caller only knows of the revocation for the
+	// home server so the copies are added to the UI here.
+	for _, server := range c.fallbackServers {
+		fallbackOut := &queuedMessage{
+			revocation: true,
+			request:    request,
+			id:         c.randId(),
+			server:     server,
+			created:    out.created,
+		}
+		fallbackOut.enqueued = fallbackOut.created
+		c.enqueue(fallbackOut)
+		c.outbox = append(c.outbox, fallbackOut)
+		c.ui.addRevocationMessageUI(fallbackOut)
+	}
 	return out
 }
 
@@ -336,6 +436,12 @@ func decryptMessage(sealed []byte, from *Contact) ([]byte, error) {
 		return plaintext, nil
 	}
 
+	for i := range from.retiredDHPrivates {
+		if plaintext, ok := box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.retiredDHPrivates[i]); ok {
+			return plaintext, nil
+		}
+	}
+
 	plaintext, ok := box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.currentDHPrivate)
 	if !ok {
 		return nil, errors.New("failed to decrypt with either DH values (old ratchet)")
@@ -343,10 +449,7 @@ func decryptMessage(sealed []byte, from *Contact) ([]byte, error) {
 
 	// They have clearly received our current DH value. Time to
 	// rotate.
-	copy(from.lastDHPrivate[:], from.currentDHPrivate[:])
-	if _, err := io.ReadFull(rand.Reader, from.currentDHPrivate[:]); err != nil {
-		panic(err)
-	}
+	from.advanceDH()
 	return plaintext, nil
 }
 
@@ -359,6 +462,17 @@ func decryptMessageInner(sealed []byte, nonce *[24]byte, from *Contact) ([]byte,
 		return plaintext, true
 	}
 
+	// Messages that were sealed before a rotation of our DH value may
+	// still be in flight.
+	for i := range from.retiredDHPrivates {
+		if plaintext, ok := box.Open(nil, sealed, nonce, &from.theirLastDHPublic, &from.retiredDHPrivates[i]); ok {
+			return plaintext, true
+		}
+		if plaintext, ok := box.Open(nil, sealed, nonce, &from.theirCurrentDHPublic, &from.retiredDHPrivates[i]); ok {
+			return plaintext, true
+		}
+	}
+
 	plaintext, ok := box.Open(nil, sealed, nonce, &from.theirLastDHPublic, &from.currentDHPrivate)
 	if !ok {
 		plaintext, ok = box.Open(nil, sealed, nonce, &from.theirCurrentDHPublic, &from.currentDHPrivate)
@@ -369,10 +483,7 @@ func decryptMessageInner(sealed []byte, nonce *[24]byte, from *Contact) ([]byte,
 
 	// They have clearly received our current DH value. Time to
 	// rotate.
-	copy(from.lastDHPrivate[:], from.currentDHPrivate[:])
-	if _, err := io.ReadFull(rand.Reader, from.currentDHPrivate[:]); err != nil {
-		panic(err)
-	}
+	from.advanceDH()
 	return plaintext, true
 }
 
@@ -416,21 +527,31 @@ func (c *client) processFetch(m NewMessage) {
 		return
 	}
 
-	var from *Contact
+	var candidates []*Contact
 NextCandidate:
 	for _, candidate := range c.contacts {
 		if bytes.Equal(tag, candidate.groupKey.Tag()) {
-			from = candidate
-			break
+			candidates = append(candidates, candidate)
+			continue
 		}
 		for _, prevTag := range candidate.previousTags {
 			if bytes.Equal(tag, prevTag.tag) {
-				from = candidate
-				break NextCandidate
+				candidates = append(candidates, candidate)
+				continue NextCandidate
 			}
 		}
 	}
 
+	var from *Contact
+	switch {
+	case len(candidates) == 1:
+		from = candidates[0]
+	case len(candidates) > 1:
+		// Only contacts that were added from the published
+		// handshake share a member key.
+		from = c.publishedSender(candidates, f.Message)
+	}
+
 	if from == nil {
 		c.log.Errorf("Message from unknown contact. Dropping. Tag: %x", tag)
 		return
@@ -439,7 +560,17 @@ NextCandidate:
 	if from.revoked {
 		// It's possible that there were pending messages from the
 		// contact when we revoked them.
-		c.log.Errorf("Message from revoked contact %s. Dropping", from.name)
+		c.log.ContactErrorf(from.id, "Message from revoked contact %s. Dropping", from.name)
+		return
+	}
+
+	if from.blocked {
+		c.log.ContactPrintf(from.id, "Message from blocked contact %s. Dropping", from.name)
+		return
+	}
+
+	if c.isSelf(from) {
+		c.logEvent(from, "Dropping message that claims to be from ourselves")
 		return
 	}
 
@@ -448,6 +579,17 @@ NextCandidate:
 		return
 	}
 
+	if from.isPending {
+		// Messages from pending contacts can't be decrypted yet so
+		// redelivered copies can only be spotted by their contents.
+		for _, candidate := range c.inbox {
+			if candidate.from == from.id && candidate.message == nil && bytes.Equal(candidate.sealed, f.Message) {
+				c.log.ContactPrintf(from.id, "Dropping duplicate message from %s", from.name)
+				return
+			}
+		}
+	}
+
 	inboxMsg := &InboxMessage{
 		id:           c.randId(),
 		receivedTime: time.Now(),
@@ -455,7 +597,12 @@ NextCandidate:
 		sealed:       f.Message,
 	}
 
-	if !from.isPending {
+	switch {
+	case from.unsealing:
+		// Messages from before this one are still being unsealed so
+		// it has to wait its turn.
+		from.unsealQueue = append(from.unsealQueue, inboxMsg)
+	case !from.isPending:
 		if !c.unsealMessage(inboxMsg, from) || len(inboxMsg.message.Body) == 0 {
 			return
 		}
@@ -485,9 +632,29 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 		panic("was asked to unseal message from pending contact")
 	}
 
+	if from.blocked {
+		// Messages that were received while the key exchange was
+		// pending are dropped once it completes.
+		c.log.ContactPrintf(from.id, "Dropping message from blocked contact %s", from.name)
+		return false
+	}
+
 	sealed := inboxMsg.sealed
+	var theirRatchetPublic [32]byte
+	if from.ratchet != nil {
+		theirRatchetPublic = from.ratchet.TheirRatchetPublic()
+	}
+	currentDHPrivate := from.currentDHPrivate
 	plaintext, err := decryptMessage(sealed, from)
 
+	if from.ratchet != nil {
+		if from.ratchet.TheirRatchetPublic() != theirRatchetPublic {
+			from.theirDHAdvanced = c.Now()
+		}
+	} else if from.currentDHPrivate != currentDHPrivate {
+		from.ourDHAdvanced = c.Now()
+	}
+
 	if err != nil {
 		c.logEvent(from, "Failed to decrypt message: "+err.Error())
 		return false
@@ -511,14 +678,22 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 		c.logEvent(from, "Failed to parse message: "+err.Error())
 		return false
 	}
+	// The rest of the client assumes that these fields are present.
+	// Unknown fields, from newer clients, are ignored.
+	if msg.Id == nil || msg.Time == nil {
+		c.logEvent(from, "Message is missing its id or time")
+		return false
+	}
 
-	// Check for duplicate message.
+	// Check for duplicate message. The server may redeliver a message if
+	// it didn't see our confirmation of the original delivery.
 	for _, candidate := range c.inbox {
 		if candidate.from == from.id &&
 			candidate.id != inboxMsg.id &&
 			candidate.message != nil &&
 			*candidate.message.Id == *msg.Id {
-			c.log.Printf("Dropping duplicate message from %s", from.name)
+			c.log.ContactPrintf(from.id, "Dropping duplicate message from %s", from.name)
+			c.processAcks(from, msg)
 			return false
 		}
 	}
@@ -533,28 +708,17 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 			// We have a new DH value from them.
 			copy(from.theirLastDHPublic[:], from.theirCurrentDHPublic[:])
 			copy(from.theirCurrentDHPublic[:], msg.MyNextDh)
+			from.theirDHAdvanced = c.Now()
 		}
 	}
 
-	var ackedIds []uint64
-	ackedIds = append(ackedIds, msg.AlsoAck...)
-	if msg.InReplyTo != nil {
-		ackedIds = append(ackedIds, *msg.InReplyTo)
-	}
+	c.processAcks(from, msg)
 
-	var now time.Time
-	if len(ackedIds) > 0 {
-		now = time.Now()
-	}
-
-	for _, ackedId := range ackedIds {
-		for _, candidate := range c.outbox {
-			if candidate.id == ackedId {
-				candidate.acked = now
-				c.ui.processAcknowledgement(candidate)
-				break
-			}
-		}
+	// Messages from pending contacts are only unsealed once the key
+	// exchange completes so the time of receipt is used, rather than the
+	// current time.
+	if inboxMsg.receivedTime.After(from.lastActivity) {
+		from.lastActivity = inboxMsg.receivedTime
 	}
 
 	if msg.SupportedVersion != nil {
@@ -565,10 +729,41 @@ func (c *client) unsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
 	inboxMsg.message = msg
 	inboxMsg.sealed = nil
 	inboxMsg.read = false
+	c.threadInbox(inboxMsg)
 
 	return true
 }
 
+// processAcks records the acknowledgements of outbox messages that are
+// carried by msg. Acknowledgements may be received more than once, as
+// messages may be redelivered, so a message that is already acknowledged
+// keeps its original acknowledgement time and the UI isn't notified again.
+// Acknowledgements of messages that aren't in the outbox, perhaps because
+// they have been deleted, are logged and otherwise ignored.
+func (c *client) processAcks(from *Contact, msg *pond.Message) {
+	var ackedIds []uint64
+	ackedIds = append(ackedIds, msg.AlsoAck...)
+	if msg.InReplyTo != nil {
+		ackedIds = append(ackedIds, *msg.InReplyTo)
+	}
+
+NextAck:
+	for _, ackedId := range ackedIds {
+		for _, candidate := range c.outbox {
+			// Resent messages have a different id to the message
+			// that they carry.
+			if candidate.id == ackedId || candidate.message.GetId() == ackedId {
+				if candidate.acked.IsZero() {
+					candidate.acked = time.Now()
+					c.ui.processAcknowledgement(candidate)
+				}
+				continue NextAck
+			}
+		}
+		c.log.ContactPrintf(from.id, "Ignoring acknowledgement from %s of message %x, which isn't in the outbox", from.name, ackedId)
+	}
+}
+
 func (c *client) processMessageSent(msr messageSendResult) {
 	var msg *queuedMessage
 	for _, m := range c.outbox {
@@ -580,6 +775,7 @@ func (c *client) processMessageSent(msr messageSendResult) {
 
 	if msg == nil {
 		// Message might have been deleted while sending.
+		c.log.Printf("Ignoring the result of sending message %x, which is no longer in the outbox", msr.id)
 		return
 	}
 
@@ -600,21 +796,25 @@ func (c *client) processMessageSent(msr messageSendResult) {
 				}
 			}
 
+			if rev.Revocation == nil || rev.Revocation.Generation == nil {
+				c.log.ContactPrintf(to.id, "Revocation from %s is missing its generation", to.name)
+				return
+			}
 			if gen := *rev.Revocation.Generation; gen != to.generation {
-				c.log.Printf("Message to '%s' resulted in revocation for generation %d, but current generation is %d", to.name, gen, to.generation)
+				c.log.ContactPrintf(to.id, "Message to '%s' resulted in revocation for generation %d, but current generation is %d", to.name, gen, to.generation)
 				return
 			}
 
 			// Check the signature on the revocation.
 			revBytes, err := proto.Marshal(rev.Revocation)
 			if err != nil {
-				c.log.Printf("Failed to marshal revocation message: %s", err)
+				c.log.ContactPrintf(to.id, "Failed to marshal revocation message: %s", err)
 				return
 			}
 
 			var sig [ed25519.SignatureSize]byte
 			if revSig := rev.Signature; copy(sig[:], revSig) != len(sig) {
-				c.log.Printf("Bad signature length on revocation (%d bytes) from %s", len(revSig), to.name)
+				c.log.ContactPrintf(to.id, "Bad signature length on revocation (%d bytes) from %s", len(revSig), to.name)
 				return
 			}
 
@@ -622,34 +822,21 @@ func (c *client) processMessageSent(msr messageSendResult) {
 			signed = append(signed, revocationSignaturePrefix...)
 			signed = append(signed, revBytes...)
 			if !ed25519.Verify(&to.theirPub, signed, &sig) {
-				c.log.Printf("Bad signature on revocation from %s", to.name)
+				c.log.ContactPrintf(to.id, "Bad signature on revocation from %s", to.name)
 				return
 			}
 			bbsRev, ok := new(bbssig.Revocation).Unmarshal(rev.Revocation.Revocation)
 			if !ok {
-				c.log.Printf("Failed to parse revocation from %s", to.name)
+				c.log.ContactPrintf(to.id, "Failed to parse revocation from %s", to.name)
 				return
 			}
 			to.generation++
 			if !to.myGroupKey.Update(bbsRev) {
-				// We were revoked.
-				to.revokedUs = true
-				// Further revocations will not be applied
-				// because the loop conditional is false now.
-				c.log.Printf("Revoked by %s", to.name)
-				c.ui.processRevocationOfUs(to)
-
-				// Mark all pending messages to this contact as
-				// undeliverable.
-				newQueue := make([]*queuedMessage, 0, len(c.queue))
-				c.queueMutex.Lock()
-				for _, m := range c.queue {
-					if m.to != msg.to {
-						newQueue = append(newQueue, m)
-					}
-				}
-				c.queue = newQueue
-				c.queueMutex.Unlock()
+				// We were revoked. Further revocations will
+				// not be applied because the loop conditional
+				// is false now.
+				c.log.ContactPrintf(to.id, "Revoked by %s", to.name)
+				c.revokedBy(to)
 			} else {
 				to.myGroupKey.Group.Update(bbsRev)
 				// Outgoing messages will be resigned when the network
@@ -662,16 +849,88 @@ func (c *client) processMessageSent(msr messageSendResult) {
 		return
 	}
 
+	if msr.rejected {
+		// Without a revocation to check, the rejection can't be
+		// verified. But, if it keeps happening, retrying is futile
+		// and so the contact is treated as having revoked us.
+		to, ok := c.contacts[msg.to]
+		if !ok || to.revokedUs {
+			return
+		}
+		now := c.Now()
+		if len(to.signatureRejectedIds) == 0 {
+			to.firstSignatureRejection = now
+		}
+		counted := false
+		for _, id := range to.signatureRejectedIds {
+			if id == msg.id {
+				counted = true
+				break
+			}
+		}
+		if !counted {
+			to.signatureRejectedIds = append(to.signatureRejectedIds, msg.id)
+		}
+		if len(to.signatureRejectedIds) < maxSignatureRejections || now.Sub(to.firstSignatureRejection) < minSignatureRejectionPeriod {
+			c.log.ContactPrintf(to.id, "Message to %s was rejected by their server (%d messages rejected since %s)", to.name, len(to.signatureRejectedIds), to.firstSignatureRejection.Format(logTimeFormat))
+			c.save()
+			return
+		}
+		c.log.ContactPrintf(to.id, "Message to %s was rejected by their server: they appear to have removed us", to.name)
+		to.events = append(to.events, Event{
+			t:   c.Now(),
+			msg: "Their server repeatedly rejected messages from you, which suggests that they have removed you as a contact. No more messages will be sent to them.",
+		})
+		c.revokedBy(to)
+		c.save()
+		return
+	}
+
+	if to, ok := c.contacts[msg.to]; ok {
+		to.signatureRejectedIds = nil
+		to.firstSignatureRejection = time.Time{}
+	}
 	msg.sent = time.Now()
 	if msg.revocation {
 		c.deleteOutboxMsg(msg.id)
 		c.ui.removeOutboxMessageUI(msg)
 	} else {
+		if to, ok := c.contacts[msg.to]; ok && to.ratchet == nil && msg.message != nil {
+			c.completeDHRotation(to, msg.message.MyNextDh)
+		}
 		c.ui.processMessageDelivered(msg)
 	}
 	c.save()
 }
 
+// maxSignatureRejections is the number of distinct messages to a contact that
+// their server must reject, because of our group signature and without any
+// message being delivered in between, before the contact is treated as having
+// revoked us. Rejections can't be verified so retries of the same message
+// don't count and the rejections must also span minSignatureRejectionPeriod.
+const maxSignatureRejections = 3
+
+// minSignatureRejectionPeriod is the minimum time between the first and last
+// of the rejections counted by maxSignatureRejections.
+const minSignatureRejectionPeriod = 24 * time.Hour
+
+// revokedBy marks contact as having revoked us and drops the queued messages
+// to them, which can no longer be delivered.
+func (c *client) revokedBy(contact *Contact) {
+	contact.revokedUs = true
+	c.ui.processRevocationOfUs(contact)
+
+	c.queueMutex.Lock()
+	newQueue := make([]*queuedMessage, 0, len(c.queue))
+	for _, m := range c.queue {
+		if m.to != contact.id {
+			newQueue = append(newQueue, m)
+		}
+	}
+	c.queue = newQueue
+	c.queueMutex.Unlock()
+}
+
 func decodeBase32(s string) ([]byte, error) {
 	for len(s)%8 != 0 {
 		s += "="
@@ -738,7 +997,7 @@ func (c *client) torDialer() proxy.Dialer {
 		User:     base32.StdEncoding.EncodeToString(userBytes[:]),
 		Password: "password",
 	}
-	dialer, err := proxy.SOCKS5("tcp", c.torAddress, &auth, proxy.Direct)
+	dialer, err := proxy.SOCKS5("tcp", c.proxyAddr(), &auth, proxy.Direct)
 	if err != nil {
 		panic(err)
 	}
@@ -746,6 +1005,14 @@ func (c *client) torDialer() proxy.Dialer {
 }
 
 func (c *client) dialServer(server string, useRandomIdentity bool) (*transport.Conn, error) {
+	return c.dialServerWithCancel(server, useRandomIdentity, nil, nil)
+}
+
+// dialServerWithCancel is like dialServer except that, if cancel is closed
+// before done, the underlying connection is closed so that any operation on
+// it, including the handshake, fails immediately rather than waiting for the
+// deadline.
+func (c *client) dialServerWithCancel(server string, useRandomIdentity bool, cancel, done <-chan struct{}) (*transport.Conn, error) {
 	identity := &c.identity
 	identityPublic := &c.identityPublic
 	if useRandomIdentity {
@@ -776,6 +1043,15 @@ func (c *client) dialServer(server string, useRandomIdentity bool) (*transport.C
 	// Sometimes Tor holds the connection open but we never receive
 	// anything so we add a 60 second deadline.
 	rawConn.SetDeadline(time.Now().Add(60 * time.Second))
+	if cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				rawConn.Close()
+			case <-done:
+			}
+		}()
+	}
 	conn := transport.NewClient(rawConn, identity, identityPublic, serverIdentity)
 	if err := conn.Handshake(); err != nil {
 		return nil, err
@@ -783,48 +1059,91 @@ func (c *client) dialServer(server string, useRandomIdentity bool) (*transport.C
 	return conn, nil
 }
 
-func (c *client) doCreateAccount(displayMsg func(string)) error {
-	_, _, err := parseServer(c.server, c.dev)
+// checkProxy returns an error if the SOCKS5 proxy cannot be reached. In
+// development mode, where no proxy is used, it always succeeds.
+func (c *client) checkProxy() error {
+	if c.dev {
+		return nil
+	}
+	testConn, err := net.Dial("tcp", c.proxyAddr())
 	if err != nil {
 		return err
 	}
+	testConn.Close()
+	return nil
+}
 
-	if !c.dev {
-		// Check that Tor is running.
-		testConn, err := net.Dial("tcp", c.torAddress)
-		if err != nil {
-			return errors.New("Failed to connect to local Tor: " + err.Error())
-		}
-		testConn.Close()
+// accountError records the step at which creating an account failed so that
+// problems with Tor, or with reaching the server, can be told apart from the
+// server rejecting the request.
+type accountError struct {
+	stage string
+	err   error
+}
+
+func (e *accountError) Error() string {
+	return fmt.Sprintf("Failed while %s: %s", e.stage, e.err)
+}
+
+func (c *client) doCreateAccount(displayMsg func(string)) error {
+	generation := uint32(c.randId())
+	if err := c.createAccount(c.server, generation, nil, displayMsg); err != nil {
+		return err
 	}
+	c.generation = generation
+	return nil
+}
 
-	displayMsg("Connecting...")
+// createAccount creates an account on server with the given generation. It
+// doesn't change the client's state and so can be run on a goroutine while
+// the UI continues to handle events. Each step is reported via displayMsg
+// before it starts. If cancel is closed then the connection to the server,
+// if any, is closed and an error is returned.
+func (c *client) createAccount(server string, generation uint32, cancel <-chan struct{}, displayMsg func(string)) error {
+	displayMsg("Checking server address...")
+	if _, _, err := parseServer(server, c.dev); err != nil {
+		return &accountError{"checking the server address", err}
+	}
 
-	conn, err := c.dialServer(c.server, false)
+	displayMsg("Checking Tor...")
+	if err := c.checkProxy(); err != nil {
+		return errors.New("Failed to connect to local Tor: " + err.Error())
+	}
+
+	return c.requestNewAccount(server, generation, cancel, displayMsg)
+}
+
+// requestNewAccount creates an account for our identity on the given server
+// using the current group and the given generation. See createAccount for the
+// meaning of cancel, which may be nil.
+func (c *client) requestNewAccount(server string, generation uint32, cancel <-chan struct{}, displayMsg func(string)) error {
+	displayMsg("Connecting to server...")
+
+	done := make(chan struct{})
+	defer close(done)
+	conn, err := c.dialServerWithCancel(server, false, cancel, done)
 	if err != nil {
-		return err
+		return &accountError{"connecting to the server", err}
 	}
 	defer conn.Close()
 
 	displayMsg("Requesting new account...")
 
-	c.generation = uint32(c.randId())
-
 	request := new(pond.Request)
 	request.NewAccount = &pond.NewAccount{
-		Generation: proto.Uint32(c.generation),
+		Generation: proto.Uint32(generation),
 		Group:      c.groupPriv.Group.Marshal(),
 	}
 	if err := conn.WriteProto(request); err != nil {
-		return err
+		return &accountError{"sending the request", err}
 	}
 
 	reply := new(pond.Reply)
 	if err := conn.ReadProto(reply); err != nil {
-		return err
+		return &accountError{"reading the reply", err}
 	}
 	if err := replyToError(reply); err != nil {
-		return err
+		return &accountError{"registering the account", err}
 	}
 
 	displayMsg("Done")
@@ -832,23 +1151,314 @@ func (c *client) doCreateAccount(displayMsg func(string)) error {
 	return nil
 }
 
+// changeHomeServer moves our account to newServer. An account is created on
+// the new server with our existing group. Since contacts only learn of our
+// home server via a key exchange, every contact that isn't in the middle of a
+// PANDA exchange has its group member key revoked, gets a fresh handshake and
+// is marked as pending until the key exchange has been repeated. The
+// revocations, which have been queued for the new server, are returned.
+//
+// Messages are encrypted and signed with a contact's keys when they're
+// transmitted, so queued messages to those contacts are held until the new
+// key exchange completes and are then sent to the contact's current servers.
+// Revocations that are queued for the old server are left alone since the
+// new account's group already reflects them.
+func (c *client) changeHomeServer(newServer string, displayMsg func(string)) ([]*queuedMessage, error) {
+	if newServer == c.server {
+		return nil, errors.New("that is already your home server")
+	}
+	if c.isFallbackServer(newServer) {
+		return nil, errors.New("that is one of your fallback servers")
+	}
+	if _, _, err := parseServer(newServer, c.dev); err != nil {
+		return nil, err
+	}
+	if err := c.checkProxy(); err != nil {
+		return nil, errors.New("Failed to connect to local Tor: " + err.Error())
+	}
+
+	if err := c.requestNewAccount(newServer, c.generation, nil, displayMsg); err != nil {
+		return nil, err
+	}
+
+	oldServer := c.server
+	// The network goroutine reads server with queueMutex held.
+	c.queueMutex.Lock()
+	c.server = newServer
+	c.queueMutex.Unlock()
+	c.log.Printf("Changed home server from %s to %s", oldServer, newServer)
+
+	var revocations []*queuedMessage
+	for _, contact := range c.contacts {
+		if contact.revokedUs || len(contact.pandaKeyExchange) > 0 {
+			continue
+		}
+		revocations = append(revocations, c.regenerateKeyExchange(contact))
+		contact.isPending = true
+		contact.events = append(contact.events, Event{
+			t:   c.Now(),
+			msg: "Home server changed. A new key exchange with this contact is required.",
+		})
+	}
+
+	// A message that's already being sent is left to the network
+	// goroutine: processSigningRequest holds it if it hasn't been signed
+	// yet.
+	c.queueMutex.Lock()
+	for _, msg := range c.queue {
+		if to, ok := c.contacts[msg.to]; ok && to.isPending && !msg.revocation && !msg.sending {
+			msg.held = true
+		}
+	}
+	c.queueMutex.Unlock()
+
+	c.save()
+	c.flush()
+	return revocations, nil
+}
+
+// isFallbackServer returns true if server is one of our fallback servers.
+func (c *client) isFallbackServer(server string) bool {
+	for _, fallback := range c.fallbackServers {
+		if fallback == server {
+			return true
+		}
+	}
+	return false
+}
+
+// addFallbackServer creates an account on server, with our existing group,
+// and adds it to the fallback servers that are listed in our key exchanges.
+// Contacts only learn of it from key exchanges that are created afterwards.
+func (c *client) addFallbackServer(server string, displayMsg func(string)) error {
+	if server == c.server {
+		return errors.New("that is your home server")
+	}
+	if c.isFallbackServer(server) {
+		return errors.New("that is already one of your fallback servers")
+	}
+	if _, _, err := parseServer(server, c.dev); err != nil {
+		return err
+	}
+	if err := c.checkProxy(); err != nil {
+		return errors.New("Failed to connect to local Tor: " + err.Error())
+	}
+
+	if err := c.requestNewAccount(server, c.generation, nil, displayMsg); err != nil {
+		return err
+	}
+
+	// The network goroutine reads fallbackServers with queueMutex held.
+	c.queueMutex.Lock()
+	c.fallbackServers = append(c.fallbackServers, server)
+	c.queueMutex.Unlock()
+	c.log.Printf("Added fallback server %s", server)
+
+	c.save()
+	return nil
+}
+
+// homeServer returns our home server. It's for goroutines other than the
+// main one, which is the only one that changes it.
+func (c *client) homeServer() string {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	return c.server
+}
+
 // transactionRateSeconds is the mean of the exponential distribution that
 // we'll sample in order to distribute the time between our network
 // connections.
+//
+// The delays are drawn from an exponential distribution because it's
+// memoryless: the time until the next transaction is independent of when the
+// last one happened and, in particular, of when the user composed a message.
+// Messages are queued and only sent in the next scheduled transaction so an
+// observer of the network learns nothing about when they were written.
 const transactionRateSeconds = 300 // five minutes
 
+// minTransactionInterval and maxTransactionInterval bound the mean time
+// between transactions that the user can configure. Shorter intervals would
+// put too much load on the servers and longer ones would make the delay
+// before messages are sent and received unreasonable.
+const (
+	minTransactionInterval = time.Minute
+	maxTransactionInterval = time.Hour
+)
+
+// transactionSchedule returns the mean time between network transactions and
+// whether cover transactions should be made. It's called from the network
+// goroutine.
+func (c *client) transactionSchedule() (mean time.Duration, cover bool) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	mean = c.transactionInterval
+	switch {
+	case mean == 0:
+		mean = transactionRateSeconds * time.Second
+	case mean < minTransactionInterval:
+		mean = minTransactionInterval
+	case mean > maxTransactionInterval:
+		mean = maxTransactionInterval
+	}
+	return mean, c.coverTraffic
+}
+
+// setTransactionSchedule sets the values returned by transactionSchedule. A
+// zero interval selects the default.
+func (c *client) setTransactionSchedule(interval time.Duration, cover bool) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	c.transactionInterval = interval
+	c.coverTraffic = cover
+}
+
+// operatingMode restricts the network transactions that the client makes.
+type operatingMode int
+
+const (
+	// modeNormal both sends and fetches.
+	modeNormal operatingMode = iota
+	// modeFetchOnly fetches from the home server but never sends, which
+	// is useful for an endpoint that only archives received messages.
+	// Messages, including acknowledgements, are still queued.
+	modeFetchOnly
+	// modeSendOnly transmits queued messages but never fetches. When
+	// there's nothing to send, cover transactions are made instead.
+	modeSendOnly
+)
+
+// operatingModeLabels are shown to the user for each operatingMode.
+var operatingModeLabels = []string{
+	modeNormal:    "Send and receive",
+	modeFetchOnly: "Receive only",
+	modeSendOnly:  "Send only",
+}
+
+// operatingMode returns the current mode. It may be called from any
+// goroutine.
+func (c *client) operatingMode() operatingMode {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	return c.mode
+}
+
+// setOperatingMode sets the value returned by operatingMode.
+func (c *client) setOperatingMode(mode operatingMode) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+
+	c.mode = mode
+}
+
+// coverTransaction makes an anonymous connection to the home server that
+// carries no message. When cover traffic is enabled, one is made whenever a
+// message could have been sent but the queue was empty so that, whether or
+// not the user has anything to send, the pattern of transactions is the
+// same.
+func (c *client) coverTransaction() {
+	c.log.Printf("Starting cover transaction")
+	server := c.homeServer()
+	conn, err := c.dialServer(server, true /* anonymous */)
+	if err != nil {
+		c.log.Printf("Failed to connect to %s: %s", server, err)
+		return
+	}
+	defer conn.Close()
+
+	// A fetch from an anonymous identity is rejected by the server, but
+	// has the same shape on the wire as a delivery.
+	if err := conn.WriteProto(&pond.Request{Fetch: &pond.Fetch{}}); err != nil {
+		c.log.Printf("Failed to send to %s: %s", server, err)
+		return
+	}
+	reply := new(pond.Reply)
+	if err := conn.ReadProto(reply); err != nil {
+		c.log.Printf("Failed to read from %s: %s", server, err)
+	}
+}
+
+// stopNetwork closes fetchNowChan, if the network goroutine is running, and
+// waits for it to exit so that nothing is using the keys afterwards. Any
+// transaction that was in progress is completed. Its results are processed,
+// so that they're included in the state, unless discard is true.
+func (c *client) stopNetwork(discard bool) {
+	if c.fetchNowChan == nil {
+		return
+	}
+	select {
+	case <-c.networkDone:
+		return
+	default:
+	}
+	close(c.fetchNowChan)
+
+	for {
+		select {
+		case <-c.networkDone:
+			// The result of the final transaction may still
+			// be buffered.
+			select {
+			case msr := <-c.messageSentChan:
+				if msr.id != 0 && !discard {
+					c.processMessageSent(msr)
+				}
+			default:
+			}
+			return
+		case sigReq := <-c.signingRequestChan:
+			if discard {
+				close(sigReq.resultChan)
+			} else {
+				c.processSigningRequest(sigReq)
+			}
+		case newMessage := <-c.newMessageChan:
+			if discard {
+				newMessage.ack <- true
+			} else {
+				c.processNewMessage(newMessage)
+			}
+		case msr := <-c.messageSentChan:
+			if msr.id != 0 && !discard {
+				c.processMessageSent(msr)
+			}
+		case <-c.backgroundChan:
+			// The network goroutine reports clock skew here.
+			// Nothing else that's sent matters once the client
+			// is stopping.
+		}
+	}
+}
+
 func (c *client) transact() {
+	defer close(c.networkDone)
+
 	startup := true
 
 	var ackChan chan bool
 	var head *queuedMessage
 	lastWasSend := false
+	// fromTimer is true if the current transaction was started by the
+	// timer, rather than by a fetchNow signal.
+	fromTimer := false
+	// fetches counts the fetches so far, so that they can rotate between
+	// the home server and any fallback servers.
+	fetches := 0
 
 	for {
 		if head != nil {
-			// We failed to send a message.
+			// We failed to send a message. If the contact has
+			// other servers then the next attempt will use the
+			// next of them.
 			c.queueMutex.Lock()
 			head.sending = false
+			if head.nextServer() {
+				c.log.ContactPrintf(head.to, "Will try %s for the next attempt to send", head.server)
+			}
 			c.queueMutex.Unlock()
 			head = nil
 		}
@@ -861,11 +1471,12 @@ func (c *client) transact() {
 
 			var timerChan <-chan time.Time
 			if c.autoFetch {
+				mean, _ := c.transactionSchedule()
 				var seedBytes [8]byte
 				c.randBytes(seedBytes[:])
 				seed := int64(binary.LittleEndian.Uint64(seedBytes[:]))
 				r := mrand.New(mrand.NewSource(seed))
-				delaySeconds := r.ExpFloat64() * transactionRateSeconds
+				delaySeconds := r.ExpFloat64() * mean.Seconds()
 				if c.dev {
 					delaySeconds = 5
 				}
@@ -881,31 +1492,76 @@ func (c *client) transact() {
 					return
 				}
 				c.log.Printf("Starting fetch because of fetchNow signal")
+				fromTimer = false
 			case <-timerChan:
 				c.log.Printf("Starting fetch because of timer")
+				fromTimer = true
 			}
 		}
 		startup = false
 
+		// Cover transactions disguise sends, so they only replace
+		// scheduled transactions, since an explicitly requested one
+		// always does something useful, and are never made when only
+		// fetching.
+		if _, cover := c.transactionSchedule(); cover && fromTimer && !lastWasSend && c.operatingMode() != modeFetchOnly {
+			c.queueMutex.Lock()
+			queueEmpty := c.nextQueuedMessage() == nil
+			c.queueMutex.Unlock()
+			if queueEmpty {
+				c.coverTransaction()
+				lastWasSend = true
+				continue
+			}
+		}
+
 		var req *pond.Request
 		var server string
+		// to is the contact that a message is being sent to, or zero
+		// for a fetch, so that log entries can be attributed.
+		var to uint64
 
 		useAnonymousIdentity := true
 		isFetch := false
 		c.queueMutex.Lock()
-		if (!c.testing && lastWasSend) || len(c.queue) == 0 {
+		next := c.nextQueuedMessage()
+		fetch := (!c.testing && lastWasSend) || next == nil
+		switch c.mode {
+		case modeFetchOnly:
+			fetch = true
+		case modeSendOnly:
+			if next == nil {
+				c.queueMutex.Unlock()
+				// Skipping the transaction would reveal
+				// when there's nothing to send, so a cover
+				// transaction is made instead.
+				c.log.Printf("Nothing to send and fetching is disabled")
+				c.coverTransaction()
+				lastWasSend = true
+				continue
+			}
+			fetch = false
+		}
+		if fetch {
 			useAnonymousIdentity = false
 			isFetch = true
 			req = &pond.Request{Fetch: &pond.Fetch{}}
-			server = c.server
-			c.log.Printf("Starting fetch from home server")
+			if n := fetches % (1 + len(c.fallbackServers)); n == 0 {
+				server = c.server
+				c.log.Printf("Starting fetch from home server")
+			} else {
+				server = c.fallbackServers[n-1]
+				c.log.Printf("Starting fetch from fallback server %s", server)
+			}
+			fetches++
 			lastWasSend = false
 		} else {
-			head = c.queue[0]
+			head = next
 			head.sending = true
 			req = head.request
 			server = head.server
-			c.log.Printf("Starting message transmission to %s", server)
+			to = head.to
+			c.log.ContactPrintf(to, "Starting message transmission to %s", server)
 
 			if head.revocation {
 				useAnonymousIdentity = false
@@ -920,7 +1576,10 @@ func (c *client) transact() {
 
 		conn, err := c.dialServer(server, useAnonymousIdentity)
 		if err != nil {
-			c.log.Printf("Failed to connect to %s: %s", server, err)
+			c.log.ContactPrintf(to, "Failed to connect to %s: %s", server, err)
+			if err := c.checkProxy(); err != nil {
+				c.log.Errorf("SOCKS5 proxy at %s is unreachable: %s", c.proxyAddr(), err)
+			}
 			continue
 		}
 		if lastWasSend && req == nil {
@@ -933,18 +1592,23 @@ func (c *client) transact() {
 			}
 		}
 		if err := conn.WriteProto(req); err != nil {
-			c.log.Printf("Failed to send to %s: %s", server, err)
+			c.log.ContactPrintf(to, "Failed to send to %s: %s", server, err)
 			continue
 		}
 
 		reply := new(pond.Reply)
 		if err := conn.ReadProto(reply); err != nil {
-			c.log.Printf("Failed to read from %s: %s", server, err)
+			c.log.ContactPrintf(to, "Failed to read from %s: %s", server, err)
 			continue
 		}
 
 		conn.Close()
 
+		if isFetch && reply.Time != nil {
+			skew := c.Now().Sub(time.Unix(*reply.Time, 0))
+			c.backgroundChan <- clockSkewResult{skew}
+		}
+
 		if !isFetch {
 			c.queueMutex.Lock()
 			// Find the index of the message that we just sent (if any) in
@@ -973,10 +1637,23 @@ func (c *client) transact() {
 				// messages to the same contact are moved to
 				// the end of the queue.
 				c.moveContactsMessagesToEndOfQueue(head.to)
+				if *reply.Status == pond.Reply_DELIVERY_SIGNATURE_INVALID && !head.revocation {
+					// Rejections are only counted once for
+					// each message, so the contact's other
+					// messages are tried before this one
+					// again. Our signature is the same for
+					// all of them so, if the rejection is
+					// genuine, they won't be delivered out
+					// of order.
+					c.moveQueuedMessageToEnd(head)
+				}
 				c.queueMutex.Unlock()
 
-				if *reply.Status == pond.Reply_GENERATION_REVOKED && reply.Revocation != nil {
+				switch {
+				case *reply.Status == pond.Reply_GENERATION_REVOKED && reply.Revocation != nil:
 					c.messageSentChan <- messageSendResult{id: head.id, revocation: reply.Revocation, extraRevocations: reply.ExtraRevocations}
+				case *reply.Status == pond.Reply_DELIVERY_SIGNATURE_INVALID && !head.revocation:
+					c.messageSentChan <- messageSendResult{id: head.id, rejected: true}
 				}
 			}
 
@@ -988,7 +1665,7 @@ func (c *client) transact() {
 		}
 
 		if err := replyToError(reply); err != nil {
-			c.log.Errorf("Error from server %s: %s", server, err)
+			c.log.ContactErrorf(to, "Error from server %s: %s", server, err)
 			continue
 		}
 	}
@@ -1063,7 +1740,7 @@ func (c *client) uploadDetachment(out chan interface{}, in *os.File, id uint64,
 	}
 	transfer.total = fi.Size()
 
-	return c.transferDetachment(out, c.server, transfer, id, killChan)
+	return c.transferDetachment(out, c.homeServer(), transfer, id, killChan)
 }
 
 type downloadTransfer struct {
@@ -1118,43 +1795,53 @@ func (dt *downloadTransfer) Complete(conn *transport.Conn) bool {
 
 func (c *client) downloadDetachment(out chan interface{}, file *os.File, id uint64, downloadURL string, killChan chan bool) error {
 	c.log.Printf("Starting download of %s", downloadURL)
+	server, from, fileID, err := parseDetachmentURL(downloadURL)
+	if err != nil {
+		return err
+	}
+
+	transfer := &downloadTransfer{file: file, fileID: fileID, from: from}
+
+	return c.transferDetachment(out, server, transfer, id, killChan)
+}
+
+// parseDetachmentURL splits the URL of an uploaded detachment, as built by
+// buildDetachmentURL, into the server that holds the file, the public
+// identity of the account that uploaded it and the file's id.
+func parseDetachmentURL(downloadURL string) (server string, from *[32]byte, fileID uint64, err error) {
 	u, err := url.Parse(downloadURL)
 	if err != nil {
-		return errors.New("failed to parse download URL: " + err.Error())
+		return "", nil, 0, errors.New("failed to parse download URL: " + err.Error())
 	}
 	if u.Scheme != "pondserver" {
-		return errors.New("download URL is a not a Pond URL")
+		return "", nil, 0, errors.New("download URL is a not a Pond URL")
 	}
 	path := u.Path
 	if len(path) == 0 {
-		return errors.New("download URL is missing a path")
+		return "", nil, 0, errors.New("download URL is missing a path")
 	}
 	path = path[1:]
 	parts := strings.Split(path, "/")
 	if len(parts) != 2 {
-		return errors.New("download URL has incorrect number of path elements")
+		return "", nil, 0, errors.New("download URL has incorrect number of path elements")
 	}
 	fromSlice, err := hex.DecodeString(parts[0])
 	if err != nil {
-		return errors.New("failed to parse public identity from download URL: " + err.Error())
+		return "", nil, 0, errors.New("failed to parse public identity from download URL: " + err.Error())
 	}
 	if len(fromSlice) != 32 {
-		return errors.New("public identity in download URL is wrong length")
+		return "", nil, 0, errors.New("public identity in download URL is wrong length")
 	}
-	var from [32]byte
+	from = new([32]byte)
 	copy(from[:], fromSlice)
 
-	fileID, err := strconv.ParseUint(parts[1], 16, 64)
+	fileID, err = strconv.ParseUint(parts[1], 16, 64)
 	if err != nil {
-		return errors.New("failed to parse download ID from URL: " + err.Error())
+		return "", nil, 0, errors.New("failed to parse download ID from URL: " + err.Error())
 	}
 
 	u.Path = ""
-	server := u.String()
-
-	transfer := &downloadTransfer{file: file, fileID: fileID, from: &from}
-
-	return c.transferDetachment(out, server, transfer, id, killChan)
+	return u.String(), from, fileID, nil
 }
 
 // transferDetachmentConn transfers as much of a detachment as possible on a
@@ -1187,6 +1874,9 @@ func (c *client) transferDetachmentConn(sendStatus func(s string, done, total in
 		if reply.GetStatus() == pond.Reply_OVER_QUOTA {
 			return fmt.Errorf("server reports that the upload would exceed allowed quota"), true
 		}
+		if reply.GetStatus() == pond.Reply_NO_SUCH_FILE {
+			return fmt.Errorf("the file is no longer on the server: it may have expired or been revoked by the sender"), true
+		}
 		return fmt.Errorf("request failed: %s", err), false
 	}
 
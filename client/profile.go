@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A profile is a separate account, with its own state file and passphrase,
+// which allows a user to keep separate identities. When profilesDir is set,
+// each state file in it is a profile and the user picks one, or creates a new
+// one, before anything is loaded. The rest of the client then only sees the
+// chosen state file, so the instance lock, backups etc all apply to it alone.
+
+// profileSuffix ends the name of each profile's state file. It distinguishes
+// state files from the other files, such as locks, that are kept next to
+// them.
+const profileSuffix = ".pond"
+
+// maxProfileNameLen is the maximum length of the name of a profile.
+const maxProfileNameLen = 64
+
+// listProfiles returns the sorted names of the profiles in dir.
+func listProfiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(name, profileSuffix) || len(name) == len(profileSuffix) {
+			continue
+		}
+		names = append(names, name[:len(name)-len(profileSuffix)])
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// validateProfileName returns an error if name can't be used as the name of
+// a new profile.
+func validateProfileName(name string) error {
+	switch {
+	case len(name) == 0:
+		return errors.New("a profile needs a name")
+	case len(name) > maxProfileNameLen:
+		return errors.New("the name of a profile is too long")
+	case strings.HasPrefix(name, "."):
+		return errors.New("the name of a profile can't start with a dot")
+	case strings.ContainsAny(name, "/\\:\x00"):
+		return errors.New("the name of a profile can't contain slashes or colons")
+	}
+	return nil
+}
+
+// chooseProfile asks the user to pick a profile, if profiles are in use, and
+// sets stateFilename to its state file.
+func (c *client) chooseProfile() error {
+	if len(c.profilesDir) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(c.profilesDir, 0700); err != nil {
+		return err
+	}
+	names, err := listProfiles(c.profilesDir)
+	if err != nil {
+		return err
+	}
+	name, err := c.ui.profileUI(names)
+	if err != nil {
+		return err
+	}
+	c.profileName = name
+	c.stateFilename = filepath.Join(c.profilesDir, name+profileSuffix)
+	c.log.Printf("Using profile %s", name)
+	return nil
+}
+
+// newProfileName checks the name of a new profile given the names of the
+// existing ones. Names are compared case-insensitively because profiles that
+// differ only in case would share a state file on some filesystems.
+func newProfileName(name string, existing []string) (string, error) {
+	name = strings.TrimSpace(name)
+	if err := validateProfileName(name); err != nil {
+		return "", err
+	}
+	for _, other := range existing {
+		if strings.EqualFold(other, name) {
+			return "", errors.New("a profile with that name already exists")
+		}
+	}
+	return name, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/agl/ed25519"
+	"github.com/agl/pond/bbssig"
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/client/ratchet"
+	pond "github.com/agl/pond/protos"
+)
+
+// A published handshake allows anyone to start a key exchange with the user.
+// It's a handshake like those from newKeyExchange, but it isn't generated for
+// any particular contact and so the user can post it publicly, for example on
+// a web page.
+//
+// Someone who reads it creates a contact in the usual way and enters the
+// published handshake as the one from the user. That generates a group member
+// key for the user, and a handshake containing it, as for any other contact.
+// They send their handshake back to the user, who enters it for a new contact
+// with usePublishedKeyExchange. Rather than a new group member key and new
+// ratchet values, that contact is given copies of those in the published
+// handshake, which completes the key exchange without any further reply.
+//
+// This is weaker than a handshake that's given to a single person:
+//
+// Deniability is reduced. The handshake is signed with the user's long-term
+// key so, once published, it proves to anyone that the user controls that
+// identity and uses the home server that it names.
+//
+// Everyone who has the handshake shares its group member key and so can
+// deliver messages to the user's home server. Since the key is shared, a
+// single contact who was added from it can't be revoked: deleting them only
+// stops their messages from being decrypted.
+//
+// Contacts added from the same published handshake share its initial ratchet
+// values. Anyone who obtains the private values can read the start of each of
+// those conversations, until the ratchet first advances.
+//
+// The sender of a message that's signed with the shared member key can't be
+// identified from the signature so it has to be found by trial decryption.
+
+// publishedKeyExchangePEM is the PEM type of a published handshake. It's
+// distinct from keyExchangePEM so that readers aren't misled into treating it
+// as private.
+const publishedKeyExchangePEM = "POND PUBLISHED KEY EXCHANGE"
+
+// publishedKeyExchange contains the secrets behind the user's published
+// handshake.
+type publishedKeyExchange struct {
+	// groupKey is the group member key that the published handshake
+	// contains. It's updated with every revocation so that contacts added
+	// from the handshake can be given a current copy.
+	groupKey *bbssig.MemberKey
+	// ratchet contains the private values of the ratchet whose public
+	// values are in the handshake. It's never completed itself, but
+	// copied for each contact.
+	ratchet *disk.RatchetState
+	// kxsBytes is the serialised, signed handshake.
+	kxsBytes []byte
+	created  time.Time
+}
+
+// signedKeyExchange returns a serialised handshake containing our identity
+// and the given group member key and ratchet values.
+func (c *client) signedKeyExchange(groupKey *bbssig.MemberKey, r *ratchet.Ratchet) []byte {
+	kx := &pond.KeyExchange{
+		PublicKey:       c.pub[:],
+		IdentityPublic:  c.identityPublic[:],
+		Server:          proto.String(c.server),
+		FallbackServers: c.fallbackServers,
+		Group:           groupKey.Group.Marshal(),
+		GroupKey:        groupKey.Marshal(),
+		Generation:      proto.Uint32(c.generation),
+	}
+	r.FillKeyExchange(kx)
+	if c.simulateOldClient {
+		kx.Dh1 = nil
+	}
+
+	kxBytes, err := proto.Marshal(kx)
+	if err != nil {
+		panic(err)
+	}
+
+	sig := ed25519.Sign(&c.priv, kxBytes)
+
+	kxs := &pond.SignedKeyExchange{
+		Signed:    kxBytes,
+		Signature: sig[:],
+	}
+
+	kxsBytes, err := proto.Marshal(kxs)
+	if err != nil {
+		panic(err)
+	}
+	return kxsBytes
+}
+
+// myKeyExchangeBlock returns the user's published handshake, PEM encoded. The
+// handshake is created the first time that it's needed and then kept so that
+// copies that have already been published remain valid.
+func (c *client) myKeyExchangeBlock() string {
+	if c.published == nil {
+		groupKey, err := c.groupPriv.NewMember(c.rand)
+		if err != nil {
+			panic(err)
+		}
+		// The ratchet isn't used for a contact, so it has no
+		// identities.
+		r := ratchet.New(c.rand)
+		c.published = &publishedKeyExchange{
+			groupKey: groupKey,
+			kxsBytes: c.signedKeyExchange(groupKey, r),
+			ratchet:  r.Marshal(c.Now(), messageLifetime),
+			created:  c.Now(),
+		}
+		r.Wipe()
+		c.save()
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: publishedKeyExchangePEM, Bytes: c.published.kxsBytes}))
+}
+
+// usePublishedKeyExchange processes kxsBytes, a handshake that was sent in
+// reply to the published handshake, for contact. The group member key and
+// ratchet values that were generated for contact are replaced by copies of
+// those in the published handshake. If processing fails then contact keeps its
+// own handshake.
+func (c *client) usePublishedKeyExchange(contact *Contact, kxsBytes []byte) error {
+	if c.published == nil {
+		return errors.New("no handshake has been published")
+	}
+
+	groupKey, ok := new(bbssig.MemberKey).Unmarshal(c.groupPriv.Group, c.published.groupKey.Marshal())
+	if !ok {
+		panic("failed to copy published group member key")
+	}
+	r := c.newRatchet(contact)
+	if err := r.Unmarshal(c.published.ratchet); err != nil {
+		return err
+	}
+
+	oldGroupKey, oldRatchet, oldKXSBytes := contact.groupKey, contact.ratchet, contact.kxsBytes
+	contact.groupKey, contact.ratchet, contact.kxsBytes = groupKey, r, c.published.kxsBytes
+	if err := contact.processKeyExchange(kxsBytes, c.dev, c.simulateOldClient, c.disableV2Ratchet); err != nil {
+		groupKey.Wipe()
+		r.Wipe()
+		contact.groupKey, contact.ratchet, contact.kxsBytes = oldGroupKey, oldRatchet, oldKXSBytes
+		return err
+	}
+	if contact.ratchet == nil {
+		// They don't support the ratchet, and the old protocol
+		// needs values that are specific to each contact.
+		groupKey.Wipe()
+		r.Wipe()
+		contact.lastDHPrivate = [32]byte{}
+		contact.groupKey, contact.ratchet, contact.kxsBytes = oldGroupKey, oldRatchet, oldKXSBytes
+		return errors.New("their client is too old to reply to a published handshake")
+	}
+
+	// The handshake that was generated for the contact is no longer
+	// needed.
+	if oldGroupKey != nil {
+		oldGroupKey.Wipe()
+	}
+	if oldRatchet != nil {
+		oldRatchet.Wipe()
+	}
+	contact.viaPublished = true
+	return nil
+}
+
+// publishedSender returns the contact, from candidates, that sent sealed.
+// The candidates share a group member key, because they were added from the
+// published handshake, so the message is trial decrypted with each of their
+// ratchets. It returns nil if none of them can decrypt it.
+func (c *client) publishedSender(candidates []*Contact, sealed []byte) *Contact {
+	for _, candidate := range candidates {
+		if candidate.isPending || candidate.ratchet == nil {
+			continue
+		}
+		// Decryption advances the ratchet on success, but the
+		// message is decrypted again by unsealMessage so a copy is
+		// used.
+		trial := c.newRatchet(candidate)
+		if err := trial.Unmarshal(candidate.ratchet.Marshal(c.Now(), messageLifetime)); err != nil {
+			continue
+		}
+		_, err := trial.Decrypt(sealed)
+		trial.Wipe()
+		if err == nil {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// wipe zeros the secrets of the published handshake.
+func (p *publishedKeyExchange) wipe() {
+	p.groupKey.Wipe()
+	for _, b := range [][]byte{p.ratchet.Private0, p.ratchet.Private1} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
@@ -0,0 +1,855 @@
+package main
+
+// This file implements just enough of QR codes (ISO/IEC 18004) to display a
+// handshake as a series of codes and to read back clean, upright images of
+// them, such as screenshots or the PNG files that Pond itself produces. Only
+// byte mode, error correction level M and versions 1 to 10 are supported.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+)
+
+// qrVersionInfo describes the error correction structure of a QR code version
+// at level M.
+type qrVersionInfo struct {
+	// totalCodewords is the number of codewords in the symbol, including
+	// error correction.
+	totalCodewords int
+	// eccPerBlock is the number of error correction codewords in each
+	// block and numBlocks is the number of blocks.
+	eccPerBlock, numBlocks int
+}
+
+// qrVersions is indexed by version number.
+var qrVersions = [...]qrVersionInfo{
+	{},
+	{26, 10, 1},
+	{44, 16, 1},
+	{70, 26, 1},
+	{100, 18, 2},
+	{134, 24, 2},
+	{172, 16, 4},
+	{196, 18, 4},
+	{242, 22, 4},
+	{292, 22, 5},
+	{346, 26, 5},
+}
+
+// qrAlignmentPositions contains the row and column coordinates of the
+// alignment patterns for each version.
+var qrAlignmentPositions = [...][]int{
+	nil,
+	nil,
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+}
+
+const (
+	qrMaxVersion = len(qrVersions) - 1
+	// qrQuietZone is the number of light modules that surround a code.
+	qrQuietZone = 4
+	// qrModulePixels is the width and height of a module in rendered
+	// codes.
+	qrModulePixels = 4
+	// qrByteMode is the mode indicator for 8-bit data.
+	qrByteMode = 4
+	// qrEccLevelM is the two bit value that indicates error correction
+	// level M in the format information.
+	qrEccLevelM = 0
+)
+
+func qrDataCodewords(version int) int {
+	v := qrVersions[version]
+	return v.totalCodewords - v.eccPerBlock*v.numBlocks
+}
+
+// qrCountBits returns the length of the character count field in byte mode.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// qrCapacity returns the number of bytes that a code of the given version can
+// hold.
+func qrCapacity(version int) int {
+	return (qrDataCodewords(version)*8 - 4 - qrCountBits(version)) / 8
+}
+
+// qrCode is a QR code symbol. Coordinates are (x, y) with the origin at the
+// top-left.
+type qrCode struct {
+	version, size int
+	// modules is true for dark modules.
+	modules [][]bool
+	// function is true for modules that are part of a function pattern
+	// and thus don't carry data.
+	function [][]bool
+}
+
+// newQRCode returns an otherwise empty code of the given version with the
+// function patterns drawn.
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{
+		version:  version,
+		size:     size,
+		modules:  make([][]bool, size),
+		function: make([][]bool, size),
+	}
+	for y := range q.modules {
+		q.modules[y] = make([]bool, size)
+		q.function[y] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	q.drawFinder(3, 3)
+	q.drawFinder(size-4, 3)
+	q.drawFinder(3, size-4)
+
+	positions := qrAlignmentPositions[version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Alignment patterns that would overlap the finder
+			// patterns are omitted.
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			q.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format areas. They are filled in once the mask is known.
+	q.drawFormat(0)
+	q.drawVersion()
+
+	return q
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.size || y < 0 || y >= q.size {
+				continue
+			}
+			dist := maxInt(absInt(dx), absInt(dy))
+			q.setFunction(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *qrCode) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(cx+dx, cy+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+		}
+	}
+}
+
+// qrFormatBits returns the 15 bits of format information for level M and the
+// given mask.
+func qrFormatBits(mask int) int {
+	data := qrEccLevelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// formatPositions returns the coordinates of the two copies of the format
+// information, indexed by bit number.
+func (q *qrCode) formatPositions() (first, second [15][2]int) {
+	for i := 0; i < 15; i++ {
+		switch {
+		case i < 6:
+			first[i] = [2]int{8, i}
+		case i < 8:
+			first[i] = [2]int{8, i + 1}
+		case i == 8:
+			first[i] = [2]int{7, 8}
+		default:
+			first[i] = [2]int{14 - i, 8}
+		}
+
+		if i < 8 {
+			second[i] = [2]int{q.size - 1 - i, 8}
+		} else {
+			second[i] = [2]int{8, q.size - 15 + i}
+		}
+	}
+	return
+}
+
+func (q *qrCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	first, second := q.formatPositions()
+	for i := 0; i < 15; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		q.setFunction(first[i][0], first[i][1], dark)
+		q.setFunction(second[i][0], second[i][1], dark)
+	}
+	// This module is always dark.
+	q.setFunction(8, q.size-8, true)
+}
+
+// readFormat returns the mask indicated by the format information, tolerating
+// a few errors in either copy.
+func (q *qrCode) readFormat() (mask int, err error) {
+	first, second := q.formatPositions()
+	for _, positions := range [][15][2]int{first, second} {
+		bits := 0
+		for i, pos := range positions {
+			if q.modules[pos[1]][pos[0]] {
+				bits |= 1 << uint(i)
+			}
+		}
+		for candidate := 0; candidate < 8; candidate++ {
+			if bitCount(bits^qrFormatBits(candidate)) <= 3 {
+				return candidate, nil
+			}
+		}
+	}
+	return 0, errors.New("QR code format not supported")
+}
+
+// qrVersionBits returns the 18 bits of version information for the given
+// version, which is only included in codes of version seven and above.
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	return version<<12 | rem
+}
+
+func (q *qrCode) drawVersion() {
+	if q.version < 7 {
+		return
+	}
+	bits := qrVersionBits(q.version)
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := q.size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// dataPositions calls f with the coordinates of each data module in the order
+// in which they are filled.
+func (q *qrCode) dataPositions(f func(x, y int)) {
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern.
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if x := right - j; !q.function[y][x] {
+					f(x, y)
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	q.dataPositions(func(x, y int) {
+		if i < len(codewords)*8 {
+			q.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 != 0
+		}
+		i++
+	})
+}
+
+func (q *qrCode) readCodewords() []byte {
+	codewords := make([]byte, qrVersions[q.version].totalCodewords)
+	i := 0
+	q.dataPositions(func(x, y int) {
+		if i < len(codewords)*8 && q.modules[y][x] {
+			codewords[i/8] |= 1 << uint(7-i%8)
+		}
+		i++
+	})
+	return codewords
+}
+
+// applyMask inverts the data modules selected by the given mask. Since it's an
+// XOR, applying a mask twice removes it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the code according to the rules that are used to select a
+// mask. Lower is better.
+func (q *qrCode) penalty() int {
+	var result, dark int
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	for _, transpose := range []bool{false, true} {
+		at := func(i, j int) bool {
+			if transpose {
+				return q.modules[j][i]
+			}
+			return q.modules[i][j]
+		}
+		for i := 0; i < q.size; i++ {
+			run := 0
+			for j := 0; j < q.size; j++ {
+				if j > 0 && at(i, j) == at(i, j-1) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					result += 3
+				} else if run > 5 {
+					result++
+				}
+			}
+
+			for j := 0; j+11 <= q.size; j++ {
+			Patterns:
+				for _, pattern := range finderLike {
+					for k, want := range pattern {
+						if at(i, j+k) != want {
+							continue Patterns
+						}
+					}
+					result += 40
+				}
+			}
+		}
+	}
+
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+
+	total := q.size * q.size
+	result += ((absInt(dark*20-total*10)+total-1)/total - 1) * 10
+	return result
+}
+
+// image renders the code, including the quiet zone.
+func (q *qrCode) image() image.Image {
+	width := (q.size + 2*qrQuietZone) * qrModulePixels
+	img := image.NewGray(image.Rect(0, 0, width, width))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < qrModulePixels; dy++ {
+				for dx := 0; dx < qrModulePixels; dx++ {
+					img.SetGray((x+qrQuietZone)*qrModulePixels+dx, (y+qrQuietZone)*qrModulePixels+dy, color.Gray{0})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// encodeQR returns the smallest code that contains data.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; version <= qrMaxVersion; version++ {
+		if len(data) <= qrCapacity(version) {
+			break
+		}
+	}
+	if version > qrMaxVersion {
+		return nil, fmt.Errorf("%d bytes is too large for a QR code", len(data))
+	}
+
+	var bits qrBitWriter
+	bits.write(qrByteMode, 4)
+	bits.write(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.write(int(b), 8)
+	}
+	capacityBits := qrDataCodewords(version) * 8
+	bits.write(0, minInt(4, capacityBits-bits.n))
+	bits.write(0, (8-bits.n%8)%8)
+	for pad := 0xec; bits.n < capacityBits; pad ^= 0xec ^ 0x11 {
+		bits.write(pad, 8)
+	}
+
+	q := newQRCode(version)
+	q.drawCodewords(qrInterleave(version, bits.bytes))
+
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(bestMask)
+	q.drawFormat(bestMask)
+
+	return q, nil
+}
+
+// decodeQRImage reads a QR code from img. The image must contain only a single,
+// upright and undistorted code.
+func decodeQRImage(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	isDark := func(x, y int) bool {
+		gray := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+		return gray.Y < 0x80
+	}
+
+	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X-1, bounds.Min.Y-1
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if isDark(x, y) {
+				minX, maxX = minInt(minX, x), maxInt(maxX, x)
+				minY, maxY = minInt(minY, y), maxInt(maxY, y)
+			}
+		}
+	}
+	if maxX < minX {
+		return nil, errors.New("no QR code found in image")
+	}
+
+	// The top edge of the top-left finder pattern is seven dark modules
+	// wide.
+	run := 0
+	for x := minX; x <= maxX && isDark(x, minY); x++ {
+		run++
+	}
+	moduleSize := float64(run) / 7
+	size := int(float64(maxX-minX+1)/moduleSize + 0.5)
+	height := int(float64(maxY-minY+1)/moduleSize + 0.5)
+	version := (size - 17) / 4
+	if size != height || (size-17)%4 != 0 || version < 1 || version > qrMaxVersion {
+		return nil, errors.New("QR code size not supported")
+	}
+
+	q := newQRCode(version)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			q.modules[y][x] = isDark(minX+int((float64(x)+0.5)*moduleSize), minY+int((float64(y)+0.5)*moduleSize))
+		}
+	}
+
+	mask, err := q.readFormat()
+	if err != nil {
+		return nil, err
+	}
+	q.applyMask(mask)
+
+	data, ok := qrDeinterleave(version, q.readCodewords())
+	if !ok {
+		return nil, errors.New("QR code is damaged")
+	}
+
+	bits := qrBitReader{bytes: data}
+	if bits.read(4) != qrByteMode {
+		return nil, errors.New("QR code contents not supported")
+	}
+	n := bits.read(qrCountBits(version))
+	if n > qrCapacity(version) {
+		return nil, errors.New("QR code is damaged")
+	}
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(bits.read(8))
+	}
+	return out, nil
+}
+
+// qrBlockLengths returns the number of data codewords in each error correction
+// block of a code.
+func qrBlockLengths(version int) []int {
+	v := qrVersions[version]
+	dataCodewords := qrDataCodewords(version)
+	numLong := dataCodewords % v.numBlocks
+	lengths := make([]int, v.numBlocks)
+	for i := range lengths {
+		lengths[i] = dataCodewords / v.numBlocks
+		if i >= v.numBlocks-numLong {
+			lengths[i]++
+		}
+	}
+	return lengths
+}
+
+// qrInterleave splits data into blocks, calculates the error correction
+// codewords for each and returns the interleaved result.
+func qrInterleave(version int, data []byte) []byte {
+	v := qrVersions[version]
+	divisor := qrReedSolomonDivisor(v.eccPerBlock)
+	var blocks, eccs [][]byte
+	for _, n := range qrBlockLengths(version) {
+		block := data[:n]
+		data = data[n:]
+		blocks = append(blocks, block)
+		eccs = append(eccs, qrReedSolomonRemainder(block, divisor))
+	}
+
+	out := make([]byte, 0, v.totalCodewords)
+	for i := 0; i < len(blocks[len(blocks)-1]); i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.eccPerBlock; i++ {
+		for _, ecc := range eccs {
+			out = append(out, ecc[i])
+		}
+	}
+	return out
+}
+
+// qrDeinterleave reverses qrInterleave and returns the data codewords and
+// whether the error correction codewords matched them. Errors are detected but
+// not corrected.
+func qrDeinterleave(version int, codewords []byte) ([]byte, bool) {
+	v := qrVersions[version]
+	lengths := qrBlockLengths(version)
+	blocks := make([][]byte, len(lengths))
+	for i := 0; i < lengths[len(lengths)-1]; i++ {
+		for j, n := range lengths {
+			if i < n {
+				blocks[j] = append(blocks[j], codewords[0])
+				codewords = codewords[1:]
+			}
+		}
+	}
+	eccs := make([][]byte, len(lengths))
+	for i := 0; i < v.eccPerBlock; i++ {
+		for j := range eccs {
+			eccs[j] = append(eccs[j], codewords[0])
+			codewords = codewords[1:]
+		}
+	}
+
+	divisor := qrReedSolomonDivisor(v.eccPerBlock)
+	var data []byte
+	for i, block := range blocks {
+		if !bytes.Equal(qrReedSolomonRemainder(block, divisor), eccs[i]) {
+			return nil, false
+		}
+		data = append(data, block...)
+	}
+	return data, true
+}
+
+// qrGFMultiply multiplies two elements of GF(2^8), as used by QR codes.
+func qrGFMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrReedSolomonDivisor returns the generator polynomial of the given degree,
+// highest coefficient first and omitting the leading one.
+func qrReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrGFMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrGFMultiply(root, 2)
+	}
+	return result
+}
+
+func qrReedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= qrGFMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+type qrBitWriter struct {
+	bytes []byte
+	// n is the number of bits written.
+	n int
+}
+
+func (w *qrBitWriter) write(value, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		if (value>>uint(i))&1 != 0 {
+			w.bytes[w.n/8] |= 1 << uint(7-w.n%8)
+		}
+		w.n++
+	}
+}
+
+type qrBitReader struct {
+	bytes []byte
+	n     int
+}
+
+// read returns the next bits from the input. Reading past the end returns
+// zeros.
+func (r *qrBitReader) read(bits int) int {
+	value := 0
+	for i := 0; i < bits; i++ {
+		value <<= 1
+		if r.n/8 < len(r.bytes) && (r.bytes[r.n/8]>>uint(7-r.n%8))&1 != 0 {
+			value |= 1
+		}
+		r.n++
+	}
+	return value
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func bitCount(x int) int {
+	n := 0
+	for ; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+// maxQRImagePixels is the largest number of pixels that an image may claim to
+// have for it to be searched for a QR code.
+const maxQRImagePixels = 2048 * 2048
+
+// readQRFile returns the contents of the QR code in the image file at path.
+func readQRFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxQRImagePixels {
+		return nil, errors.New("image is too large")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return decodeQRImage(img)
+}
+
+// handshakeQRMagic starts each QR code that carries part of a handshake. It's
+// followed by the index of the part, the total number of parts and
+// handshakeQRDigestLen bytes of the hash of the whole handshake, which
+// prevents parts of different handshakes from being mixed.
+var handshakeQRMagic = []byte("PKX")
+
+const (
+	handshakeQRDigestLen = 4
+	handshakeQRHeaderLen = 3 + 2 + handshakeQRDigestLen
+)
+
+// handshakeQRCodes splits a serialised key exchange across as few QR codes as
+// possible and returns them as PNG images.
+func handshakeQRCodes(kxsBytes []byte) ([][]byte, error) {
+	perCode := qrCapacity(qrMaxVersion) - handshakeQRHeaderLen
+	n := (len(kxsBytes) + perCode - 1) / perCode
+	if n == 0 || n > 255 {
+		return nil, errors.New("handshake is unsuitable for QR codes")
+	}
+	// Share the data evenly so that the codes are similar in size.
+	perCode = (len(kxsBytes) + n - 1) / n
+	digest := sha256.Sum256(kxsBytes)
+
+	var pngs [][]byte
+	for i := 0; i < n; i++ {
+		part := kxsBytes[i*perCode:]
+		if len(part) > perCode {
+			part = part[:perCode]
+		}
+		payload := append([]byte{}, handshakeQRMagic...)
+		payload = append(payload, byte(i), byte(n))
+		payload = append(payload, digest[:handshakeQRDigestLen]...)
+		payload = append(payload, part...)
+
+		code, err := encodeQR(payload)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		if err := png.Encode(&out, code.image()); err != nil {
+			return nil, err
+		}
+		pngs = append(pngs, out.Bytes())
+	}
+	return pngs, nil
+}
+
+// handshakeQRParts collects the parts of a handshake as they are read from QR
+// codes.
+type handshakeQRParts struct {
+	digest []byte
+	parts  [][]byte
+}
+
+// add records the contents of a QR code and returns a description of the
+// progress so far.
+func (h *handshakeQRParts) add(payload []byte) (string, error) {
+	if len(payload) < handshakeQRHeaderLen || !bytes.Equal(payload[:len(handshakeQRMagic)], handshakeQRMagic) {
+		return "", errors.New("QR code doesn't contain a Pond handshake")
+	}
+	header := payload[len(handshakeQRMagic):handshakeQRHeaderLen]
+	i, n, digest := int(header[0]), int(header[1]), header[2:]
+	if n == 0 || i >= n {
+		return "", errors.New("QR code is invalid")
+	}
+
+	if h.parts == nil || len(h.parts) != n || !bytes.Equal(h.digest, digest) {
+		// This code is from a different handshake than any previous
+		// ones. Start again.
+		h.digest = append([]byte{}, digest...)
+		h.parts = make([][]byte, n)
+	}
+	h.parts[i] = append([]byte{}, payload[handshakeQRHeaderLen:]...)
+
+	have := 0
+	for _, part := range h.parts {
+		if part != nil {
+			have++
+		}
+	}
+	return fmt.Sprintf("Read %d of %d QR codes", have, n), nil
+}
+
+// result returns the handshake if all parts have been read and are
+// consistent.
+func (h *handshakeQRParts) result() ([]byte, bool) {
+	if h.parts == nil {
+		return nil, false
+	}
+	var kxsBytes []byte
+	for _, part := range h.parts {
+		if part == nil {
+			return nil, false
+		}
+		kxsBytes = append(kxsBytes, part...)
+	}
+	digest := sha256.Sum256(kxsBytes)
+	if !bytes.Equal(digest[:handshakeQRDigestLen], h.digest) {
+		return nil, false
+	}
+	return kxsBytes, true
+}
@@ -283,6 +283,19 @@ func (r *Ratchet) Encrypt(out, msg []byte) []byte {
 	return secretbox.Seal(out, msg, &messageNonce, &messageKey)
 }
 
+// WillAdvance returns true if the next call to Encrypt will advance the DH
+// ratchet. That happens after a new ratchet value has been received from the
+// other party.
+func (r *Ratchet) WillAdvance() bool {
+	return r.ratchet
+}
+
+// TheirRatchetPublic returns the most recent DH ratchet value received from
+// the other party. It changes each time that they advance the ratchet.
+func (r *Ratchet) TheirRatchetPublic() [32]byte {
+	return r.recvRatchetPublic
+}
+
 // trySavedKeys tries to decrypt ciphertext using keys saved for missing messages.
 func (r *Ratchet) trySavedKeys(ciphertext []byte) ([]byte, error) {
 	if len(ciphertext) < sealedHeaderSize {
@@ -511,6 +524,34 @@ func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
 	return msg, nil
 }
 
+// Wipe sets all the key material in r to zero. r cannot be used afterwards.
+func (r *Ratchet) Wipe() {
+	keys := []*[32]byte{
+		&r.rootKey,
+		&r.sendHeaderKey, &r.recvHeaderKey,
+		&r.nextSendHeaderKey, &r.nextRecvHeaderKey,
+		&r.sendChainKey, &r.recvChainKey,
+		&r.sendRatchetPrivate,
+		r.kxPrivate0, r.kxPrivate1,
+	}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		for i := range key {
+			key[i] = 0
+		}
+	}
+
+	for headerKey, messageKeys := range r.saved {
+		for messageNum := range messageKeys {
+			messageKeys[messageNum] = savedKey{}
+			delete(messageKeys, messageNum)
+		}
+		delete(r.saved, headerKey)
+	}
+}
+
 func dup(key *[32]byte) []byte {
 	if key == nil {
 		return nil
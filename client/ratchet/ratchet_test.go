@@ -214,3 +214,28 @@ func TestDrop(t *testing.T) {
 		{sendB, deliver, -1},
 	})
 }
+
+func TestWipe(t *testing.T) {
+	a, b := pairedRatchet()
+
+	// Drop a message so that b has a saved key.
+	a.Encrypt(nil, []byte("dropped"))
+	if _, err := b.Decrypt(a.Encrypt(nil, []byte("delivered"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.saved) == 0 {
+		t.Fatalf("No saved keys")
+	}
+
+	b.Wipe()
+
+	var zero [32]byte
+	for _, key := range []*[32]byte{&b.rootKey, &b.sendHeaderKey, &b.recvHeaderKey, &b.nextSendHeaderKey, &b.nextRecvHeaderKey, &b.sendChainKey, &b.recvChainKey, &b.sendRatchetPrivate} {
+		if *key != zero {
+			t.Errorf("Key wasn't wiped: %x", key[:])
+		}
+	}
+	if len(b.saved) != 0 {
+		t.Errorf("Saved keys weren't wiped")
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/panda"
+)
+
+// scriptClient is a UI that reads commands, as a stream of JSON objects, and
+// writes replies and notifications as JSON objects, one per line. It allows
+// Pond to be driven by another program, for example in automated testing or
+// to relay messages, without a GUI or a terminal.
+type scriptClient struct {
+	client
+
+	in  io.Reader
+	out *json.Encoder
+	// commands receives the commands read from in. It's closed when in
+	// reaches EOF or contains invalid JSON.
+	commands chan scriptCommand
+	// pending is a command that has been read while creating an account
+	// but that is still to be processed.
+	pending *scriptCommand
+	// fetchAck, if not nil, is the channel on which the network goroutine
+	// will signal the completion of a transaction requested by a fetch
+	// command.
+	fetchAck chan bool
+}
+
+// scriptCommand is a command read by a scriptClient. Only the fields that are
+// relevant to the command need to be set.
+type scriptCommand struct {
+	// Command is one of "profile", "create-account", "unlock",
+	// "recover", "takeover", "new-contact", "send", "fetch" or "quit".
+	Command    string `json:"command"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Server     string `json:"server,omitempty"`
+	// Name is the name of a contact for "new-contact", or of a profile
+	// for "profile", and To is the name of the recipient for "send".
+	Name string `json:"name,omitempty"`
+	To   string `json:"to,omitempty"`
+	Body string `json:"body,omitempty"`
+	// Handshake contains the contact's key exchange message for
+	// "new-contact". Alternatively, Filename can name a file that contains
+	// it. For "recover", Filename names a backup to restore.
+	Handshake string `json:"handshake,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+}
+
+// scriptOutput is written by a scriptClient. Replies to commands have Command
+// set and notifications of events, such as a new message, have Event set.
+type scriptOutput struct {
+	Command string `json:"command,omitempty"`
+	Event   string `json:"event,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Contact string `json:"contact,omitempty"`
+	Id      uint64 `json:"id,omitempty"`
+	Body    string `json:"body,omitempty"`
+	// Handshake contains our key exchange message for a new contact,
+	// which must be given to them.
+	Handshake string `json:"handshake,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// NewScriptClient returns a client that reads commands from in and writes the
+// results to out. If servers is not nil then it overrides the default server
+// when creating an account.
+func NewScriptClient(stateFilename string, in io.Reader, out io.Writer, rand io.Reader, testing, autoFetch bool, servers *serverDefaults) *scriptClient {
+	c := &scriptClient{
+		client: client{
+			testing:            testing,
+			dev:                testing,
+			autoFetch:          autoFetch,
+			stateFilename:      stateFilename,
+			log:                NewLog(),
+			rand:               rand,
+			contacts:           make(map[uint64]*Contact),
+			drafts:             make(map[uint64]*Draft),
+			newMessageChan:     make(chan NewMessage),
+			messageSentChan:    make(chan messageSendResult, 1),
+			backgroundChan:     make(chan interface{}, 8),
+			pandaChan:          make(chan pandaUpdate, 1),
+			usedIds:            make(map[uint64]bool),
+			signingRequestChan: make(chan signingRequest),
+		},
+		in:       in,
+		out:      json.NewEncoder(out),
+		commands: make(chan scriptCommand),
+	}
+	c.ui = c
+	if servers != nil {
+		c.servers = *servers
+	}
+
+	c.newMeetingPlace = func() panda.MeetingPlace {
+		return &panda.HTTPMeetingPlace{
+			TorAddress: c.proxyAddr(),
+			URL:        "https://panda-key-exchange.appspot.com/exchange",
+		}
+	}
+	c.log.toStderr = false
+	return c
+}
+
+func (c *scriptClient) Start() {
+	go c.readCommands()
+
+	c.loadUI()
+
+	if c.writerChan != nil {
+		c.save()
+	}
+	c.stopNetwork(false)
+	if c.writerChan != nil {
+		close(c.writerChan)
+		<-c.writerDone
+	}
+	if c.stateLock != nil {
+		c.stateLock.Close()
+	}
+	c.releaseInstanceLock()
+	c.wipeKeys()
+}
+
+// readCommands runs on its own goroutine and decodes commands from c.in.
+func (c *scriptClient) readCommands() {
+	defer close(c.commands)
+
+	decoder := json.NewDecoder(c.in)
+	for {
+		var cmd scriptCommand
+		if err := decoder.Decode(&cmd); err != nil {
+			if err != io.EOF {
+				c.log.Errorf("Failed to parse command: %s", err)
+			}
+			return
+		}
+		c.commands <- cmd
+	}
+}
+
+// nextCommand returns the next command to process.
+func (c *scriptClient) nextCommand() (scriptCommand, bool) {
+	if cmd := c.pending; cmd != nil {
+		c.pending = nil
+		return *cmd, true
+	}
+	cmd, ok := <-c.commands
+	return cmd, ok
+}
+
+func (c *scriptClient) write(out scriptOutput) {
+	c.out.Encode(out)
+}
+
+// reply writes the result of cmd, which failed if err is not nil.
+func (c *scriptClient) reply(cmd scriptCommand, err error, out scriptOutput) {
+	out.Command = cmd.Command
+	if err != nil {
+		out.Error = err.Error()
+	}
+	c.write(out)
+}
+
+func (c *scriptClient) initUI() {
+}
+
+func (c *scriptClient) loadingUI() {
+}
+
+func (c *scriptClient) torPromptUI() error {
+	c.errorUI("Please start a Tor SOCKS listener on port 9050 or 9150...", false)
+	for !c.detectTor() {
+		time.Sleep(1 * time.Second)
+	}
+	return nil
+}
+
+func (c *scriptClient) sleepUI(d time.Duration) error {
+	time.Sleep(d)
+	return nil
+}
+
+func (c *scriptClient) errorUI(msg string, fatal bool) {
+	event := "warning"
+	if fatal {
+		event = "error"
+	}
+	c.write(scriptOutput{Event: event, Message: msg})
+}
+
+func (c *scriptClient) ShutdownAndSuspend() error {
+	return errInterrupted
+}
+
+// createPassphraseUI waits for a create-account command and returns its
+// passphrase. The command is then completed by createAccountUI.
+func (c *scriptClient) createPassphraseUI() (string, error) {
+	for {
+		cmd, ok := c.nextCommand()
+		if !ok {
+			return "", errInterrupted
+		}
+		if cmd.Command != "create-account" {
+			c.reply(cmd, errors.New("no account exists: use create-account first"), scriptOutput{})
+			continue
+		}
+		c.pending = &cmd
+		return cmd.Passphrase, nil
+	}
+}
+
+// createErasureStorage creates the state file without trying to use a TPM
+// since there's nobody to configure it.
+func (c *scriptClient) createErasureStorage(pw string, stateFile *disk.StateFile) error {
+	return stateFile.Create(pw)
+}
+
+func (c *scriptClient) createAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
+	for {
+		cmd, ok := c.nextCommand()
+		if !ok {
+			return false, errInterrupted
+		}
+		if cmd.Command != "create-account" {
+			c.reply(cmd, errors.New("no account exists: use create-account first"), scriptOutput{})
+			continue
+		}
+
+		// Since the state file has already been created, the
+		// passphrase of any later attempt is ignored.
+		c.server = cmd.Server
+		if len(c.server) == 0 {
+			c.server = c.defaultServer()
+		}
+
+		updateMsg := func(msg string) {
+			c.write(scriptOutput{Event: "status", Message: msg})
+		}
+
+		err := c.doCreateAccount(updateMsg)
+		c.reply(cmd, err, scriptOutput{})
+		if err == nil {
+			return false, nil
+		}
+	}
+}
+
+func (c *scriptClient) keyPromptUI(stateFile *disk.StateFile) error {
+	for {
+		cmd, ok := c.nextCommand()
+		if !ok {
+			return errInterrupted
+		}
+		if cmd.Command != "unlock" {
+			c.reply(cmd, errors.New("the state file is locked: use unlock first"), scriptOutput{})
+			continue
+		}
+
+		err := c.loadState(stateFile, cmd.Passphrase)
+		if err == disk.BadPasswordError {
+			c.reply(cmd, errors.New(msgIncorrectPassword), scriptOutput{})
+			continue
+		}
+		c.reply(cmd, err, scriptOutput{})
+		return err
+	}
+}
+
+// profileUI waits for a profile command, which names either an existing
+// profile or a new one.
+func (c *scriptClient) profileUI(profiles []string) (string, error) {
+	for {
+		cmd, ok := c.nextCommand()
+		if !ok {
+			return "", errInterrupted
+		}
+		if cmd.Command != "profile" {
+			c.reply(cmd, errors.New("no profile has been chosen: use profile first"), scriptOutput{})
+			continue
+		}
+		name := cmd.Name
+		for _, existing := range profiles {
+			if existing == name {
+				c.reply(cmd, nil, scriptOutput{})
+				return name, nil
+			}
+		}
+		name, err := newProfileName(name, profiles)
+		c.reply(cmd, err, scriptOutput{})
+		if err == nil {
+			return name, nil
+		}
+	}
+}
+
+// staleLockUI reports that the state file wasn't released by its previous
+// user and waits for a takeover command.
+func (c *scriptClient) staleLockUI(owner *disk.InstanceOwner) error {
+	c.write(scriptOutput{Event: "error", Message: msgStaleLock + " It was last used by " + owner.String() + "."})
+
+	for {
+		cmd, ok := c.nextCommand()
+		if !ok {
+			return errInterrupted
+		}
+		if cmd.Command != "takeover" {
+			c.reply(cmd, errors.New("the state file may be in use by another copy of Pond: use takeover first"), scriptOutput{})
+			continue
+		}
+		c.reply(cmd, nil, scriptOutput{})
+		return nil
+	}
+}
+
+// stateRecoveryUI reports loadErr and waits for a recover command. The
+// command's filename, if any, names a backup to restore. Otherwise a new
+// account is started.
+func (c *scriptClient) stateRecoveryUI(loadErr error) (string, error) {
+	c.write(scriptOutput{Event: "error", Message: loadErr.Error()})
+
+	for {
+		cmd, ok := c.nextCommand()
+		if !ok {
+			return "", errInterrupted
+		}
+		if cmd.Command != "recover" {
+			c.reply(cmd, errors.New("the state file cannot be loaded: use recover first"), scriptOutput{})
+			continue
+		}
+		c.reply(cmd, nil, scriptOutput{})
+		return cmd.Filename, nil
+	}
+}
+
+// writeMessage writes a notification of a message from a contact.
+func (c *scriptClient) writeMessage(msg *InboxMessage) {
+	out := scriptOutput{
+		Event:   "message",
+		Contact: c.ContactName(msg.from),
+		Id:      msg.message.GetId(),
+	}
+	body, err := decodeBody(msg.message)
+	if err != nil {
+		out.Error = err.Error()
+	}
+	out.Body = body
+	c.write(out)
+}
+
+func (c *scriptClient) processFetch(msg *InboxMessage) {
+	// Sealed messages are reported once they have been unsealed and acks
+	// are never reported.
+	if msg.message == nil || len(msg.message.Body) == 0 {
+		return
+	}
+	c.writeMessage(msg)
+}
+
+func (c *scriptClient) processServerAnnounce(announce *InboxMessage) {
+	body, _ := decodeBody(announce.message)
+	c.write(scriptOutput{Event: "announcement", Body: body})
+}
+
+func (c *scriptClient) processAcknowledgement(ackedMsg *queuedMessage) {
+	c.write(scriptOutput{Event: "ack", Contact: c.ContactName(ackedMsg.to), Id: ackedMsg.id})
+}
+
+func (c *scriptClient) processRevocationOfUs(by *Contact) {
+	c.write(scriptOutput{Event: "revoked", Contact: by.name})
+}
+
+func (c *scriptClient) processRevocation(by *Contact) {
+}
+
+// unsealPendingMessages is run once a key exchange with a contact has
+// completed and unseals any previously unreadable messages from that contact.
+func (c *scriptClient) unsealPendingMessages(contact *Contact) {
+	var needToFilter bool
+
+	for _, msg := range c.inbox {
+		if msg.message == nil && msg.from == contact.id {
+			if !c.unsealMessage(msg, contact) {
+				needToFilter = true
+				continue
+			}
+			if len(msg.message.Body) == 0 {
+				needToFilter = true
+				continue
+			}
+			c.writeMessage(msg)
+		}
+	}
+
+	if needToFilter {
+		c.dropSealedAndAckMessagesFrom(contact)
+	}
+}
+
+func (c *scriptClient) processPANDAUpdateUI(update pandaUpdate) {
+	contact := c.contacts[update.id]
+
+	switch {
+	case update.err != nil:
+		c.write(scriptOutput{Event: "key-exchange", Contact: contact.name, Error: update.err.Error()})
+	case update.result != nil:
+		c.write(scriptOutput{Event: "key-exchange", Contact: contact.name})
+		c.unsealPendingMessages(contact)
+	}
+}
+
+func (c *scriptClient) processMessageDelivered(msg *queuedMessage) {
+	if !msg.revocation && len(msg.message.Body) > 0 {
+		c.write(scriptOutput{Event: "delivered", Contact: c.ContactName(msg.to), Id: msg.id})
+	}
+}
+
+func (c *scriptClient) removeInboxMessageUI(msg *InboxMessage) {
+}
+
+func (c *scriptClient) removeOutboxMessageUI(msg *queuedMessage) {
+}
+
+func (c *scriptClient) addRevocationMessageUI(msg *queuedMessage) {
+}
+
+func (c *scriptClient) removeContactUI(contact *Contact) {
+}
+
+func (c *scriptClient) logEventUI(contact *Contact, event Event) {
+	c.write(scriptOutput{Event: "warning", Contact: contact.name, Message: event.msg})
+}
+
+func (c *scriptClient) mainUI() {
+	c.write(scriptOutput{Event: "ready"})
+
+	for {
+		select {
+		case sigReq := <-c.signingRequestChan:
+			c.processSigningRequest(sigReq)
+		case cmd, ok := <-c.commands:
+			if !ok || cmd.Command == "quit" {
+				return
+			}
+			c.processCommand(cmd)
+		case <-c.fetchAck:
+			c.fetchAck = nil
+			c.write(scriptOutput{Command: "fetch"})
+		case newMessage := <-c.newMessageChan:
+			c.processNewMessage(newMessage)
+		case msr := <-c.messageSentChan:
+			if msr.id != 0 {
+				c.processMessageSent(msr)
+			}
+		case update := <-c.pandaChan:
+			c.processPANDAUpdate(update)
+		case event := <-c.backgroundChan:
+			if result, ok := event.(serverProbeResult); ok {
+				c.processServerProbe(result)
+				if contact, ok := c.contacts[result.id]; ok {
+					c.write(scriptOutput{Event: "server-status", Contact: contact.name, Message: contact.serverStatus})
+				}
+			}
+			if result, ok := event.(clockSkewResult); ok {
+				c.processClockSkew(result)
+			}
+		case <-c.log.updateChan:
+		}
+	}
+}
+
+func (c *scriptClient) contactByName(name string) *Contact {
+	for _, contact := range c.contacts {
+		if contact.name == name {
+			return contact
+		}
+	}
+	return nil
+}
+
+func (c *scriptClient) processCommand(cmd scriptCommand) {
+	switch cmd.Command {
+	case "new-contact":
+		contact, err := c.newContact(cmd)
+		var out scriptOutput
+		if err == nil {
+			out.Contact = contact.name
+			out.Handshake = string(pem.EncodeToMemory(&pem.Block{Bytes: contact.kxsBytes, Type: keyExchangePEM}))
+		}
+		c.reply(cmd, err, out)
+
+	case "send":
+		if c.operatingMode() == modeFetchOnly {
+			c.reply(cmd, errors.New("messages can't be sent in fetch-only mode"), scriptOutput{})
+			return
+		}
+		id, err := c.sendMessage(cmd.To, cmd.Body)
+		c.reply(cmd, err, scriptOutput{Contact: cmd.To, Id: id})
+
+	case "fetch":
+		if c.fetchAck != nil {
+			c.reply(cmd, errors.New("a fetch is already in progress"), scriptOutput{})
+			return
+		}
+		c.fetchAck = make(chan bool, 1)
+		c.fetchNowChan <- c.fetchAck
+
+	case "create-account", "unlock":
+		c.reply(cmd, errors.New("the account is already open"), scriptOutput{})
+
+	default:
+		c.reply(cmd, errors.New("unknown command"), scriptOutput{})
+	}
+}
+
+// newContact processes a new-contact command. Without a handshake, a pending
+// contact is created. Otherwise the handshake either completes the key
+// exchange with a pending contact of the same name or creates a new contact.
+func (c *scriptClient) newContact(cmd scriptCommand) (*Contact, error) {
+	if len(cmd.Name) == 0 {
+		return nil, errors.New("no contact name given")
+	}
+	existing := c.contactByName(cmd.Name)
+
+	handshake := []byte(cmd.Handshake)
+	if len(cmd.Filename) > 0 {
+		var err error
+		if handshake, err = ioutil.ReadFile(cmd.Filename); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(handshake) == 0 {
+		if existing != nil {
+			return nil, errors.New("a contact by that name already exists")
+		}
+		contact := &Contact{
+			name:      cmd.Name,
+			isPending: true,
+			id:        c.randId(),
+		}
+		c.newKeyExchange(contact)
+		c.contacts[contact.id] = contact
+		c.save()
+		c.flush()
+		return contact, nil
+	}
+
+	block, _ := pem.Decode(handshake)
+	if block == nil || block.Type != keyExchangePEM {
+		return nil, errors.New("no key exchange message found")
+	}
+
+	var contact *Contact
+	switch {
+	case existing == nil:
+		var err error
+		if contact, err = c.newContactFromKeyExchange(cmd.Name, block.Bytes); err != nil {
+			return nil, err
+		}
+		c.contacts[contact.id] = contact
+	case existing.isPending && len(existing.pandaKeyExchange) == 0:
+		dup, err := c.acceptKeyExchange(existing, block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if dup != nil {
+			return nil, errors.New("this handshake has the same identity as the existing contact " + dup.name)
+		}
+		contact = existing
+	default:
+		return nil, errors.New("a contact by that name already exists")
+	}
+
+	contact.isPending = false
+	c.unsealPendingMessages(contact)
+	c.releaseHeldMessages(contact)
+	c.probeServer(contact)
+	c.save()
+	c.flush()
+	return contact, nil
+}
+
+// sendMessage processes a send command and returns the id of the new outbox
+// message.
+func (c *scriptClient) sendMessage(to, body string) (uint64, error) {
+	contact := c.contactByName(to)
+	if contact == nil {
+		return 0, errors.New("no such contact")
+	}
+
+	id, err := c.SendMessage(contact.id, body, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	c.save()
+	return id, nil
+}
@@ -8,4 +8,9 @@ const (
 	msgDefaultDevServer  = "pondserver://ZGL2WALCGXCKYBIHTWL5Q3TPCOEHSQB2XON5JHA2KHM5PJ3C7AFA@127.0.0.1:16333"
 	msgKeyPrompt         = "Please enter the passphrase used to encrypt Pond's state file. If you set a passphrase and forgot it, it cannot be recovered. You will have to start afresh."
 	msgIncorrectPassword = "Incorrect passphrase or corrupt state file"
+	msgCorruptState      = "Pond's state file could not be loaded. It may have been damaged. You can either restore a backup or start afresh with a new account. In both cases the damaged state file will be kept, renamed, in case it can be recovered."
+	msgStaleLock         = "The last copy of Pond to use this account didn't exit cleanly. Usually that means that it crashed, but if it's still running, perhaps on another computer that shares this directory, then a second copy would corrupt the account and break the keys shared with your contacts. Only continue if you're sure that no other copy is running."
+
+	msgChangeServerWarning = "Moving to a new home server creates an account on that server and stops fetching from the current one. Any messages that are in flight to the old server may be lost. Contacts only learn of your home server during a key exchange so the keys that every contact has for you are revoked and each contact will be marked as pending, must be given a new handshake (shown on their contact page) and must complete a new key exchange with you. Messages that are waiting to be sent to a contact are held until then."
+	msgFallbackServersInfo = "A fallback server is another server on which you have an account. Contacts send to it if your home server can't be reached, and Pond fetches from it as well as from your home server. Contacts only learn of fallback servers from handshakes that are created after the server has been added."
 )
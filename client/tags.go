@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// allTagsFilter is the pseudo-tag that clears the tag filter of the contacts
+// list. It can't be assigned to a contact.
+const allTagsFilter = "all"
+
+// archivedTag is the tag given to contacts that have been archived, so that
+// they can be found with the contacts list's tag filter.
+const archivedTag = "archived"
+
+// parseTags splits text, a comma separated list of tags as the user entered
+// it, into tags. Tags are compared without regard to case so they're stored in
+// lower case, sorted and without duplicates.
+func parseTags(text string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, tag := range strings.Split(text, ",") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if len(tag) == 0 || tag == allTagsFilter || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// formatTags returns tags in the form that parseTags accepts.
+func formatTags(tags []string) string {
+	return strings.Join(tags, ", ")
+}
+
+// contactMatchesTag returns true if the contact has a tag that starts with
+// query, so that the contacts list can be searched as the user types. An
+// empty query, or the "all" pseudo-tag, matches every contact.
+func contactMatchesTag(contact *Contact, query string) bool {
+	if matchesAllTags(query) {
+		return true
+	}
+	query = strings.ToLower(strings.TrimSpace(query))
+	for _, tag := range contact.tags {
+		if strings.HasPrefix(tag, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// contactHasTag returns true if the contact has exactly the given tag.
+func contactHasTag(contact *Contact, tag string) bool {
+	for _, candidate := range contact.tags {
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAllTags returns true if query doesn't filter the contacts at all.
+func matchesAllTags(query string) bool {
+	query = strings.ToLower(strings.TrimSpace(query))
+	return len(query) == 0 || query == allTagsFilter
+}
+
+// allTags returns the tags that are assigned to any contact, sorted.
+func (c *client) allTags() []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, contact := range c.contacts {
+		for _, tag := range contact.tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
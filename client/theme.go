@@ -0,0 +1,146 @@
+// +build !nogui
+
+package main
+
+import (
+	"crypto/sha256"
+	"unicode"
+	"unicode/utf8"
+)
+
+// theme contains the colors with which the main GUI is drawn. Colors that
+// carry a meaning, such as colorRed for errors, are the same in every theme
+// and aren't included.
+type theme struct {
+	// name identifies the theme in the preferences and in the state file.
+	name string
+	// foreground and background, if non-zero, are the default colors of
+	// text and of the window. Zero leaves them to the GTK theme.
+	foreground, background uint32
+	// pane is the background of the panes that contain the lists and the
+	// selected item.
+	pane uint32
+	// listSep separates the entries in a list.
+	listSep uint32
+	// highlight marks the selected entry in a list and messages that we
+	// sent in a conversation.
+	highlight uint32
+	// received is the background of messages that we received in a
+	// conversation.
+	received              uint32
+	subline               uint32
+	headerBackground      uint32
+	headerForeground      uint32
+	headerForegroundSmall uint32
+	sep                   uint32
+	// title is the color of the large "Pond" shown when nothing is
+	// selected.
+	title uint32
+	// imminently and deleteSoon are the backgrounds of inbox entries that
+	// are about to be erased.
+	imminently uint32
+	deleteSoon uint32
+}
+
+var lightTheme = &theme{
+	name:                  "Light",
+	pane:                  colorGray,
+	listSep:               0xe5e6e6,
+	highlight:             colorHighlight,
+	received:              colorWhite,
+	subline:               colorSubline,
+	headerBackground:      colorHeaderBackground,
+	headerForeground:      colorHeaderForeground,
+	headerForegroundSmall: colorHeaderForegroundSmall,
+	sep:                   colorSep,
+	title:                 colorTitleForeground,
+	imminently:            colorImminently,
+	deleteSoon:            colorDeleteSoon,
+}
+
+var darkTheme = &theme{
+	name:                  "Dark",
+	foreground:            0xdcdcdc,
+	background:            0x2b2b2b,
+	pane:                  0x303030,
+	listSep:               0x3a3a3a,
+	highlight:             0x5c4a2e,
+	received:              0x3c3c3c,
+	subline:               0x9a9a9a,
+	headerBackground:      0x242424,
+	headerForeground:      0xa8a8a8,
+	headerForegroundSmall: 0xa0a4a8,
+	sep:                   0x474747,
+	title:                 0x444444,
+	imminently:            0x5e2b2b,
+	deleteSoon:            0x454545,
+}
+
+// themes lists the themes that the user can select from. The first is the
+// default.
+var themes = []*theme{lightTheme, darkTheme}
+
+// themeByName returns the theme with the given name, or the default theme if
+// there's no such theme.
+func themeByName(name string) *theme {
+	for _, t := range themes {
+		if t.name == name {
+			return t
+		}
+	}
+	return themes[0]
+}
+
+// avatarColor is a color that can be assigned to a contact. Entries for the
+// contact in the lists are marked with the initial of their name on that
+// color.
+type avatarColor struct {
+	name  string
+	color uint32
+}
+
+// avatarColors lists the colors that a contact can be given. They are dark
+// enough to carry white text and are the same in every theme.
+var avatarColors = []avatarColor{
+	{"Red", 0xc0392b},
+	{"Orange", 0xd35400},
+	{"Olive", 0x8a8a1e},
+	{"Green", 0x27ae60},
+	{"Teal", 0x16a085},
+	{"Blue", 0x2e86c1},
+	{"Indigo", 0x5b5ea6},
+	{"Purple", 0x8e44ad},
+	{"Pink", 0xc2185b},
+	{"Brown", 0x8d6e63},
+}
+
+// contactAvatarColor returns the color of a contact. Unless the user has
+// chosen one, it's derived from the contact's identity so that it's stable
+// without any configuration. Pending contacts don't have an identity yet so
+// their name is used until the key exchange completes.
+func contactAvatarColor(contact *Contact) avatarColor {
+	for _, ac := range avatarColors {
+		if ac.name == contact.color {
+			return ac
+		}
+	}
+
+	var zero [32]byte
+	var h [sha256.Size]byte
+	if contact.theirIdentityPublic != zero {
+		h = sha256.Sum256(contact.theirIdentityPublic[:])
+	} else {
+		h = sha256.Sum256([]byte(contact.name))
+	}
+	return avatarColors[int(h[0])%len(avatarColors)]
+}
+
+// contactInitial returns the character that represents a contact in their
+// avatar.
+func contactInitial(contact *Contact) string {
+	r, _ := utf8.DecodeRuneInString(contact.name)
+	if r == utf8.RuneError {
+		return "?"
+	}
+	return string(unicode.ToUpper(r))
+}
@@ -0,0 +1,114 @@
+package main
+
+// This file maintains an index of messages so that chains of replies, linked
+// by the InReplyTo field of each message, can be followed without scanning
+// the inbox and outbox.
+//
+// Messages are indexed by the id in their pond.Message. For outbox messages
+// this is our id for the message, but for inbox messages it's the id that the
+// sender chose. Since InReplyTo always references the id chosen by the sender
+// of the original message, this is the id that needs to be looked up.
+
+// maxThreadLength bounds the number of messages returned by threadOf so
+// that a cycle of InReplyTo values, which a malicious contact could create,
+// can't cause an infinite loop.
+const maxThreadLength = 1000
+
+// thread is an entry in the thread index. It records a single message and
+// the message that it's in reply to, if any.
+type thread struct {
+	// parent is the id of the message that this message is in reply to,
+	// or zero if it isn't a reply.
+	parent uint64
+	// Exactly one of inbox and outbox is non-nil.
+	inbox  *InboxMessage
+	outbox *queuedMessage
+}
+
+// threadInbox adds msg to the thread index. Messages that can't be displayed,
+// because the sender is pending, and pure acks are ignored.
+func (c *client) threadInbox(msg *InboxMessage) {
+	if msg.message == nil || len(msg.message.Body) == 0 || msg.from == 0 {
+		return
+	}
+	if c.threads == nil {
+		c.threads = make(map[uint64]*thread)
+	}
+	c.threads[msg.message.GetId()] = &thread{
+		parent: msg.message.GetInReplyTo(),
+		inbox:  msg,
+	}
+}
+
+// threadOutbox adds msg to the thread index. Revocations and pure acks are
+// ignored.
+func (c *client) threadOutbox(msg *queuedMessage) {
+	if msg.revocation || msg.message == nil || len(msg.message.Body) == 0 {
+		return
+	}
+	if c.threads == nil {
+		c.threads = make(map[uint64]*thread)
+	}
+	c.threads[msg.message.GetId()] = &thread{
+		parent: msg.message.GetInReplyTo(),
+		outbox: msg,
+	}
+}
+
+// unthreadInbox removes msg from the thread index. Replies to msg will
+// subsequently show it as missing.
+func (c *client) unthreadInbox(msg *InboxMessage) {
+	if msg.message == nil {
+		return
+	}
+	if t, ok := c.threads[msg.message.GetId()]; ok && t.inbox == msg {
+		delete(c.threads, msg.message.GetId())
+	}
+}
+
+// unthreadOutbox removes msg from the thread index.
+func (c *client) unthreadOutbox(msg *queuedMessage) {
+	if msg.message == nil {
+		return
+	}
+	if t, ok := c.threads[msg.message.GetId()]; ok && t.outbox == msg {
+		delete(c.threads, msg.message.GetId())
+	}
+}
+
+// hasThread returns true if the message with the given pond.Message id is a
+// reply to another message and thus there's a thread to show for it.
+func (c *client) hasThread(id uint64) bool {
+	t, ok := c.threads[id]
+	return ok && t.parent != 0
+}
+
+// threadOf returns the chain of messages that ends with the message with the
+// given pond.Message id, starting with the earliest. If a message in the
+// chain is no longer available, because it has been erased, then a missing
+// entry is included in its place and the chain stops there.
+func (c *client) threadOf(id uint64) []conversationEntry {
+	var chain []conversationEntry
+	seen := make(map[uint64]bool)
+
+	for id != 0 && !seen[id] && len(chain) < maxThreadLength {
+		seen[id] = true
+
+		t, ok := c.threads[id]
+		if !ok {
+			chain = append(chain, conversationEntry{id: id, missing: true})
+			break
+		}
+		if t.inbox != nil {
+			chain = append(chain, inboxConversationEntry(t.inbox))
+		} else {
+			chain = append(chain, outboxConversationEntry(t.outbox))
+		}
+		id = t.parent
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
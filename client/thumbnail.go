@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	// These packages register decoders for the image formats that
+	// attachments are previewed in.
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+const (
+	// maxThumbnailSourcePixels is the largest number of pixels that an
+	// attachment may claim to have for a preview to be generated. Since a
+	// small, compressed image can expand to an enormous one, this bounds
+	// the amount of memory that decoding an attachment can use.
+	maxThumbnailSourcePixels = 2048 * 2048
+	// maxThumbnailDimension is the maximum width and height of a preview.
+	maxThumbnailDimension = 256
+)
+
+// attachmentThumbnail returns a PNG encoded preview of contents if contents
+// is an image in a supported format and of reasonable dimensions. Otherwise
+// it returns nil. The image is decoded and encoded purely in memory.
+func attachmentThumbnail(contents []byte) []byte {
+	config, _, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil || config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil
+	}
+	if bounds := img.Bounds(); bounds.Dx() != config.Width || bounds.Dy() != config.Height {
+		return nil
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, scaleImage(img, maxThumbnailDimension)); err != nil {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// scaleImage returns src, reduced if needed so that neither dimension exceeds
+// max, while preserving the aspect ratio.
+func scaleImage(src image.Image, max int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= max && h <= max {
+		return src
+	}
+
+	var dw, dh int
+	if w > h {
+		dw, dh = max, h*max/w
+	} else {
+		dw, dh = w*max/h, max
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	// Nearest-neighbour sampling is crude but sufficient for a preview.
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy := bounds.Min.Y + y*h/dh
+		for x := 0; x < dw; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*w/dw, sy))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/agl/pond/client/disk"
+)
+
+// Moving an account to another computer is done with a transfer bundle, which
+// contains the whole state, sealed with a passphrase and a transfer code. See
+// disk.WriteTransfer. Two running copies of the same account would each
+// advance the ratchets with its contacts and thus break them, so the old copy
+// stops sending and receiving as soon as it exports the bundle, the bundle is
+// deleted once it has been imported and the old copy is then erased.
+
+// msgTransferWarning explains to the user why the old copy of an account
+// must not be used once it has been moved.
+const msgTransferWarning = "Never run two copies of the same account: the keys shared with each contact change with every message and two copies would break them, leaving your contacts unable to read your messages."
+
+// exportTransfer writes the whole account to a transfer bundle at path, sealed
+// with passphrase and a newly generated transfer code, which it returns. The
+// client stops sending and receiving first, so that the account doesn't
+// change after it's captured, and doesn't resume. Once the bundle has been
+// imported, the caller should erase this copy with wipeState.
+func (c *client) exportTransfer(path, passphrase string) (code string, err error) {
+	if len(passphrase) == 0 {
+		return "", errors.New("a passphrase is needed to protect the transfer bundle")
+	}
+
+	c.stopNetwork(false)
+	for _, contact := range c.contacts {
+		if contact.pandaShutdownChan != nil {
+			close(contact.pandaShutdownChan)
+		}
+	}
+
+	if code, err = disk.NewTransferCode(c.rand); err != nil {
+		return "", err
+	}
+	stateBytes := c.marshal()
+	kdfTime := passphraseKDFTime
+	if c.testing {
+		kdfTime = 0
+	}
+	var bundle bytes.Buffer
+	if err := disk.WriteTransfer(&bundle, c.rand, stateBytes, passphrase, code, kdfTime); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, bundle.Bytes(), 0600); err != nil {
+		return "", err
+	}
+
+	// Check that the bundle can be opened before the user relies on it.
+	readBack, err := ioutil.ReadFile(path)
+	if err == nil {
+		var state []byte
+		if state, err = disk.ReadTransfer(readBack, passphrase, code); err == nil && !bytes.Equal(state, stateBytes) {
+			err = errors.New("the transfer bundle was not written correctly")
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	c.log.Printf("Wrote transfer bundle to %s", path)
+	return code, nil
+}
+
+// cancelTransfer deletes the transfer bundle at path, so that this copy of
+// the account can safely be used again after a restart.
+func (c *client) cancelTransfer(path string) error {
+	return os.Remove(path)
+}
+
+// importTransfer opens the transfer bundle at path and replaces the newly
+// created stateFile with the account that it contains. The caller must then
+// load the state. The bundle is deleted so that it can't be imported a second
+// time.
+func (c *client) importTransfer(stateFile *disk.StateFile, path, passphrase, code string) error {
+	bundle, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	state, err := disk.ReadTransfer(bundle, passphrase, code)
+	if err != nil {
+		return err
+	}
+	if err := c.writeImportedState(stateFile, state); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		c.log.Errorf("Failed to delete the transfer bundle at %s: %s", path, err)
+	}
+	return nil
+}
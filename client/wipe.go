@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/agl/pond/client/disk"
+)
+
+// The panic wipe is for when the user is about to lose control of their
+// computer, perhaps to someone who will demand their passphrase. Pressing the
+// configured key combination immediately destroys the state file and the keys
+// in memory and exits. There's no confirmation, since there may be no time for
+// one, so the wipe is disabled until the user chooses a combination and that
+// combination must include at least two modifiers. Once wiped, the contacts
+// and messages can't be recovered, even by the user.
+
+// hotkey is a key combination, such as ctrl+alt+shift+w.
+type hotkey struct {
+	control, alt, shift bool
+	// key is a lower-case letter, a digit, F1 to F12, "delete" or
+	// "escape".
+	key string
+}
+
+// hotkeyKeys contains the keys, other than letters and digits, that a hotkey
+// may use.
+var hotkeyKeys = map[string]bool{
+	"delete": true,
+	"escape": true,
+}
+
+func init() {
+	for i := 1; i <= 12; i++ {
+		hotkeyKeys["f"+strconv.Itoa(i)] = true
+	}
+}
+
+// parseHotkey parses a key combination written as modifiers and a key joined
+// with "+", for example "ctrl+alt+shift+w". An empty string disables the
+// hotkey and results in nil. Combinations with fewer than two modifiers are
+// rejected because they're too easy to press by accident.
+func parseHotkey(text string) (*hotkey, error) {
+	text = strings.ToLower(strings.Join(strings.Fields(text), ""))
+	if len(text) == 0 {
+		return nil, nil
+	}
+
+	parts := strings.Split(text, "+")
+	h := new(hotkey)
+	modifiers := 0
+	for _, modifier := range parts[:len(parts)-1] {
+		var flag *bool
+		switch modifier {
+		case "ctrl", "control":
+			flag = &h.control
+		case "alt":
+			flag = &h.alt
+		case "shift":
+			flag = &h.shift
+		default:
+			return nil, errors.New("unknown modifier: " + modifier)
+		}
+		if *flag {
+			return nil, errors.New("repeated modifier: " + modifier)
+		}
+		*flag = true
+		modifiers++
+	}
+
+	h.key = parts[len(parts)-1]
+	if len(h.key) == 1 {
+		if c := h.key[0]; (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return nil, errors.New("unsupported key: " + h.key)
+		}
+	} else if !hotkeyKeys[h.key] {
+		return nil, errors.New("unsupported key: " + h.key)
+	}
+
+	if modifiers < 2 {
+		return nil, errors.New("the combination must include at least two of ctrl, alt and shift")
+	}
+	return h, nil
+}
+
+// String returns h in the form that parseHotkey accepts.
+func (h *hotkey) String() string {
+	var parts []string
+	if h.control {
+		parts = append(parts, "ctrl")
+	}
+	if h.alt {
+		parts = append(parts, "alt")
+	}
+	if h.shift {
+		parts = append(parts, "shift")
+	}
+	return strings.Join(append(parts, h.key), "+")
+}
+
+// keyvalName returns the name, as used in a hotkey, of the key with the given
+// X11 keysym, or "" if it can't be part of a hotkey.
+func keyvalName(keyval uint32) string {
+	switch {
+	case keyval >= 'a' && keyval <= 'z', keyval >= '0' && keyval <= '9':
+		return string(rune(keyval))
+	case keyval >= 'A' && keyval <= 'Z':
+		return string(rune(keyval - 'A' + 'a'))
+	case keyval >= 0xffbe && keyval <= 0xffc9:
+		return "f" + strconv.Itoa(int(keyval-0xffbe)+1)
+	case keyval == 0xffff:
+		return "delete"
+	case keyval == 0xff1b:
+		return "escape"
+	}
+	return ""
+}
+
+// wipeState destroys the state file, by overwriting it with random bytes and
+// then deleting it, and zeros the keys and messages in memory. The client
+// can't continue afterwards.
+func (c *client) wipeState() {
+	if c.writerChan != nil {
+		c.writerChan <- disk.NewState{Destruct: true}
+		<-c.writerDone
+		c.writerChan = nil
+		c.flushChan = nil
+	}
+	if c.stateLock != nil {
+		c.stateLock.Close()
+		c.stateLock = nil
+	}
+	// The network goroutine may be using the keys, so they can only be
+	// wiped once it has stopped. There's nowhere to save its results.
+	c.stopNetwork(true)
+
+	wipe := func(b []byte) {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	for _, msg := range c.inbox {
+		wipe(msg.sealed)
+		if msg.message != nil {
+			wipe(msg.message.Body)
+			for _, file := range msg.message.Files {
+				wipe(file.Contents)
+			}
+		}
+	}
+	for _, msg := range c.outbox {
+		if msg.message != nil {
+			wipe(msg.message.Body)
+			for _, file := range msg.message.Files {
+				wipe(file.Contents)
+			}
+		}
+	}
+	c.wipeKeys()
+}
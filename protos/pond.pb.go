@@ -160,6 +160,7 @@ type Request struct {
 	Revocation       *SignedRevocation `protobuf:"bytes,6,opt,name=revocation" json:"revocation,omitempty"`
 	HmacSetup        *HMACSetup        `protobuf:"bytes,7,opt,name=hmac_setup" json:"hmac_setup,omitempty"`
 	HmacStrike       *HMACStrike       `protobuf:"bytes,8,opt,name=hmac_strike" json:"hmac_strike,omitempty"`
+	DeleteFile       *DeleteFile       `protobuf:"bytes,9,opt,name=delete_file" json:"delete_file,omitempty"`
 	XXX_unrecognized []byte            `json:"-"`
 }
 
@@ -223,6 +224,13 @@ func (this *Request) GetHmacStrike() *HMACStrike {
 	return nil
 }
 
+func (this *Request) GetDeleteFile() *DeleteFile {
+	if this != nil {
+		return this.DeleteFile
+	}
+	return nil
+}
+
 type Reply struct {
 	Status           *Reply_Status       `protobuf:"varint,1,opt,name=status,enum=protos.Reply_Status,def=0" json:"status,omitempty"`
 	AccountCreated   *AccountCreated     `protobuf:"bytes,2,opt,name=account_created" json:"account_created,omitempty"`
@@ -232,6 +240,7 @@ type Reply struct {
 	Download         *DownloadReply      `protobuf:"bytes,6,opt,name=download" json:"download,omitempty"`
 	Revocation       *SignedRevocation   `protobuf:"bytes,7,opt,name=revocation" json:"revocation,omitempty"`
 	ExtraRevocations []*SignedRevocation `protobuf:"bytes,8,rep,name=extra_revocations" json:"extra_revocations,omitempty"`
+	Time             *int64              `protobuf:"varint,9,opt,name=time" json:"time,omitempty"`
 	XXX_unrecognized []byte              `json:"-"`
 }
 
@@ -297,6 +306,13 @@ func (this *Reply) GetExtraRevocations() []*SignedRevocation {
 	return nil
 }
 
+func (this *Reply) GetTime() int64 {
+	if this != nil && this.Time != nil {
+		return *this.Time
+	}
+	return 0
+}
+
 type NewAccount struct {
 	Generation       *uint32 `protobuf:"fixed32,1,req,name=generation" json:"generation,omitempty"`
 	Group            []byte  `protobuf:"bytes,2,req,name=group" json:"group,omitempty"`
@@ -585,6 +601,22 @@ func (this *DownloadReply) GetSize() int64 {
 	return 0
 }
 
+type DeleteFile struct {
+	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *DeleteFile) Reset()         { *this = DeleteFile{} }
+func (this *DeleteFile) String() string { return proto.CompactTextString(this) }
+func (*DeleteFile) ProtoMessage()       {}
+
+func (this *DeleteFile) GetId() uint64 {
+	if this != nil && this.Id != nil {
+		return *this.Id
+	}
+	return 0
+}
+
 type SignedRevocation struct {
 	Revocation       *SignedRevocation_Revocation `protobuf:"bytes,1,req,name=revocation" json:"revocation,omitempty"`
 	Signature        []byte                       `protobuf:"bytes,2,req,name=signature" json:"signature,omitempty"`
@@ -666,15 +698,16 @@ func (this *HMACStrike) GetHmacs() []uint64 {
 }
 
 type KeyExchange struct {
-	PublicKey        []byte  `protobuf:"bytes,1,req,name=public_key" json:"public_key,omitempty"`
-	IdentityPublic   []byte  `protobuf:"bytes,2,req,name=identity_public" json:"identity_public,omitempty"`
-	Server           *string `protobuf:"bytes,3,req,name=server" json:"server,omitempty"`
-	Dh               []byte  `protobuf:"bytes,4,req,name=dh" json:"dh,omitempty"`
-	Dh1              []byte  `protobuf:"bytes,8,opt,name=dh1" json:"dh1,omitempty"`
-	Group            []byte  `protobuf:"bytes,5,req,name=group" json:"group,omitempty"`
-	GroupKey         []byte  `protobuf:"bytes,6,req,name=group_key" json:"group_key,omitempty"`
-	Generation       *uint32 `protobuf:"varint,7,req,name=generation" json:"generation,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	PublicKey        []byte   `protobuf:"bytes,1,req,name=public_key" json:"public_key,omitempty"`
+	IdentityPublic   []byte   `protobuf:"bytes,2,req,name=identity_public" json:"identity_public,omitempty"`
+	Server           *string  `protobuf:"bytes,3,req,name=server" json:"server,omitempty"`
+	Dh               []byte   `protobuf:"bytes,4,req,name=dh" json:"dh,omitempty"`
+	Dh1              []byte   `protobuf:"bytes,8,opt,name=dh1" json:"dh1,omitempty"`
+	Group            []byte   `protobuf:"bytes,5,req,name=group" json:"group,omitempty"`
+	GroupKey         []byte   `protobuf:"bytes,6,req,name=group_key" json:"group_key,omitempty"`
+	Generation       *uint32  `protobuf:"varint,7,req,name=generation" json:"generation,omitempty"`
+	FallbackServers  []string `protobuf:"bytes,9,rep,name=fallback_servers" json:"fallback_servers,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (this *KeyExchange) Reset()         { *this = KeyExchange{} }
@@ -737,6 +770,13 @@ func (this *KeyExchange) GetGeneration() uint32 {
 	return 0
 }
 
+func (this *KeyExchange) GetFallbackServers() []string {
+	if this != nil {
+		return this.FallbackServers
+	}
+	return nil
+}
+
 type SignedKeyExchange struct {
 	Signed           []byte `protobuf:"bytes,1,req,name=signed" json:"signed,omitempty"`
 	Signature        []byte `protobuf:"bytes,2,req,name=signature" json:"signature,omitempty"`
@@ -852,6 +892,7 @@ func (this *Message) GetSupportedVersion() int32 {
 type Message_Attachment struct {
 	Filename         *string `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
 	Contents         []byte  `protobuf:"bytes,2,req,name=contents" json:"contents,omitempty"`
+	Sha256           []byte  `protobuf:"bytes,3,opt,name=sha256" json:"sha256,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -873,6 +914,13 @@ func (this *Message_Attachment) GetContents() []byte {
 	return nil
 }
 
+func (this *Message_Attachment) GetSha256() []byte {
+	if this != nil {
+		return this.Sha256
+	}
+	return nil
+}
+
 type Message_Detachment struct {
 	Filename         *string `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
 	Size             *uint64 `protobuf:"varint,2,req,name=size" json:"size,omitempty"`
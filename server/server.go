@@ -65,6 +65,17 @@ type Account struct {
 	filesSize    int64
 	hmacKey      [32]byte
 	hmacKeyValid bool
+	// uploads contains the uploads that are in progress, by file id, so
+	// that a file that's deleted during its upload is accounted for
+	// correctly.
+	uploads map[uint64]uploadReservation
+}
+
+// uploadReservation records the quota taken by a file that's being uploaded:
+// offset bytes were already present when the upload started and size bytes
+// are reserved for the rest.
+type uploadReservation struct {
+	offset, size int64
 }
 
 func NewAccount(s *Server, id *[32]byte) *Account {
@@ -390,6 +401,10 @@ func (a *Account) ReserveFile(newFile bool, size int64) bool {
 	a.Lock()
 	defer a.Unlock()
 
+	return a.reserveFile(newFile, size)
+}
+
+func (a *Account) reserveFile(newFile bool, size int64) bool {
 	if !a.loadFileInfo() {
 		return false
 	}
@@ -430,6 +445,10 @@ func (a *Account) ReleaseFile(removedFile bool, size int64) {
 	a.Lock()
 	defer a.Unlock()
 
+	a.releaseFile(removedFile, size)
+}
+
+func (a *Account) releaseFile(removedFile bool, size int64) {
 	if !a.loadFileInfo() {
 		return
 	}
@@ -442,6 +461,103 @@ func (a *Account) ReleaseFile(removedFile bool, size int64) {
 	}
 }
 
+// StartUpload opens the file with the given id for an upload that will make
+// it totalSize bytes long and reserves quota for the remainder. If the upload
+// can't proceed then a reply is returned instead. The account is locked
+// throughout so that DeleteFile sees either no file or one whose upload is
+// recorded.
+func (a *Account) StartUpload(id uint64, totalSize int64) (file *os.File, offset int64, reply *pond.Reply) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.loadFileInfo() {
+		return nil, 0, &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	path := filepath.Join(a.FilePath(), strconv.FormatUint(id, 16))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Failed to create file %s: %s", path, err)
+		return nil, 0, &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	offset, err = file.Seek(0, 2 /* from end */)
+
+	switch {
+	case offset == totalSize:
+		file.Close()
+		return nil, 0, &pond.Reply{Status: pond.Reply_FILE_COMPLETE.Enum()}
+	case offset > totalSize:
+		file.Close()
+		return nil, 0, &pond.Reply{Status: pond.Reply_FILE_LARGER_THAN_SIZE.Enum()}
+	}
+
+	size := totalSize - offset
+	if !a.reserveFile(offset > 0, size) {
+		file.Close()
+		return nil, 0, &pond.Reply{Status: pond.Reply_OVER_QUOTA.Enum()}
+	}
+
+	if a.uploads == nil {
+		a.uploads = make(map[uint64]uploadReservation)
+	}
+	a.uploads[id] = uploadReservation{offset, size}
+	return file, offset, nil
+}
+
+// FinishUpload records that written bytes of the upload of the file with the
+// given id were received and releases the rest of its reservation. A file
+// that received nothing is removed. If the file was deleted during the upload
+// then DeleteFile has already released everything.
+func (a *Account) FinishUpload(id uint64, written int64) {
+	a.Lock()
+	defer a.Unlock()
+
+	reservation, ok := a.uploads[id]
+	if !ok {
+		return
+	}
+	delete(a.uploads, id)
+
+	switch {
+	case written == 0:
+		os.Remove(filepath.Join(a.FilePath(), strconv.FormatUint(id, 16)))
+		a.releaseFile(true, reservation.size)
+	case written < reservation.size:
+		a.releaseFile(false, reservation.size-written)
+	}
+}
+
+// DeleteFile removes the file with the given id and releases its quota,
+// including that reserved by an upload that's still in progress. If the file
+// can't be removed then a reply is returned.
+func (a *Account) DeleteFile(id uint64) *pond.Reply {
+	a.Lock()
+	defer a.Unlock()
+
+	if !a.loadFileInfo() {
+		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	path := filepath.Join(a.FilePath(), strconv.FormatUint(id, 16))
+	fi, err := os.Stat(path)
+	if err != nil {
+		return &pond.Reply{Status: pond.Reply_NO_SUCH_FILE.Enum()}
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to delete file %s: %s", path, err)
+		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	}
+
+	size := fi.Size()
+	if reservation, ok := a.uploads[id]; ok {
+		size = reservation.offset + reservation.size
+		delete(a.uploads, id)
+	}
+	a.releaseFile(true, size)
+	return nil
+}
+
 type Server struct {
 	sync.Mutex
 
@@ -499,6 +615,8 @@ func (s *Server) Process(conn *transport.Conn) {
 		reply = s.hmacSetup(from, req.HmacSetup)
 	case req.HmacStrike != nil:
 		reply = s.hmacStrike(from, req.HmacStrike)
+	case req.DeleteFile != nil:
+		reply = s.deleteFile(from, req.DeleteFile)
 	default:
 		reply = &pond.Reply{Status: pond.Reply_NO_REQUEST.Enum()}
 	}
@@ -506,6 +624,7 @@ func (s *Server) Process(conn *transport.Conn) {
 	if reply == nil {
 		reply = &pond.Reply{}
 	}
+	reply.Time = proto.Int64(time.Now().Unix())
 
 	if err := conn.WriteProto(reply); err != nil {
 		log.Printf("Error from Write: %s", err)
@@ -1012,61 +1131,37 @@ func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Uploa
 		return &pond.Reply{Status: pond.Reply_PARSE_ERROR.Enum()}
 	}
 
-	path := filepath.Join(account.FilePath(), strconv.FormatUint(*upload.Id, 16))
-
-	if !account.LoadFileInfo() {
-		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
-	}
-
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		log.Printf("Failed to create file %s: %s", path, err)
-		return &pond.Reply{Status: pond.Reply_INTERNAL_ERROR.Enum()}
+	file, offset, reply := account.StartUpload(*upload.Id, *upload.Size)
+	if reply != nil {
+		return reply
 	}
 	defer file.Close()
 
-	offset, err := file.Seek(0, 2 /* from end */)
-
-	switch {
-	case offset == *upload.Size:
-		return &pond.Reply{Status: pond.Reply_FILE_COMPLETE.Enum()}
-	case offset > *upload.Size:
-		return &pond.Reply{Status: pond.Reply_FILE_LARGER_THAN_SIZE.Enum()}
-	}
-
 	size := *upload.Size - offset
-	if !account.ReserveFile(offset > 0, size) {
-		return &pond.Reply{Status: pond.Reply_OVER_QUOTA.Enum()}
-	}
 
 	var resume *int64
 	if offset > 0 {
 		resume = proto.Int64(offset)
 	}
 
-	reply := &pond.Reply{
+	reply = &pond.Reply{
 		Upload: &pond.UploadReply{
 			Resume: resume,
 		},
 	}
 	if err := conn.WriteProto(reply); err != nil {
+		account.FinishUpload(*upload.Id, 0)
 		return nil
 	}
 
 	n, err := io.Copy(file, io.LimitReader(conn, size))
-	switch {
-	case n == 0:
-		os.Remove(path)
-		account.ReleaseFile(true, size)
-	case n < size:
-		account.ReleaseFile(false, size-n)
-	case n == size:
-		if err == nil {
-			conn.Write([]byte{0})
-		}
-	case n > size:
+	if n > size {
 		panic("impossible")
 	}
+	account.FinishUpload(*upload.Id, n)
+	if n == size && err == nil {
+		conn.Write([]byte{0})
+	}
 
 	return nil
 }
@@ -1125,6 +1220,15 @@ func (s *Server) download(conn *transport.Conn, download *pond.Download) *pond.R
 	return nil
 }
 
+func (s *Server) deleteFile(from *[32]byte, deleteFile *pond.DeleteFile) *pond.Reply {
+	account, ok := s.getAccount(from)
+	if !ok {
+		return &pond.Reply{Status: pond.Reply_NO_ACCOUNT.Enum()}
+	}
+
+	return account.DeleteFile(*deleteFile.Id)
+}
+
 func (s *Server) revocation(from *[32]byte, signedRevocation *pond.SignedRevocation) *pond.Reply {
 	account, ok := s.getAccount(from)
 	if !ok {
@@ -776,6 +776,120 @@ func TestResumeDownload(t *testing.T) {
 	})
 }
 
+func TestDeleteFile(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("hello world")
+
+	runScript(t, script{
+		numPlayers:             2,
+		numPlayersWithAccounts: 2,
+		actions: []action{
+			{
+				player: 0,
+				request: &pond.Request{
+					Upload: &pond.Upload{
+						Id:   proto.Uint64(1),
+						Size: proto.Int64(int64(len(payload))),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to upload: %s", reply)
+					}
+				},
+				payload: payload,
+			},
+			{
+				// Only the account that uploaded a file can delete it.
+				player: 1,
+				request: &pond.Request{
+					DeleteFile: &pond.DeleteFile{
+						Id: proto.Uint64(1),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.GetStatus() != pond.Reply_NO_SUCH_FILE {
+						t.Fatalf("Bad reply to deleting another account's file: %s", reply)
+					}
+				},
+			},
+			{
+				player: 0,
+				request: &pond.Request{
+					DeleteFile: &pond.DeleteFile{
+						Id: proto.Uint64(1),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.Status != nil {
+						t.Fatalf("Bad reply to delete: %s", reply)
+					}
+				},
+			},
+			{
+				player: 1,
+				buildRequest: func(s *scriptState) *pond.Request {
+					return &pond.Request{
+						Download: &pond.Download{
+							From: s.publicIdentities[0][:],
+							Id:   proto.Uint64(1),
+						},
+					}
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.GetStatus() != pond.Reply_NO_SUCH_FILE {
+						t.Fatalf("Bad reply to downloading a deleted file: %s", reply)
+					}
+				},
+			},
+			{
+				player: 0,
+				request: &pond.Request{
+					DeleteFile: &pond.DeleteFile{
+						Id: proto.Uint64(1),
+					},
+				},
+				validate: func(t *testing.T, reply *pond.Reply) {
+					if reply.GetStatus() != pond.Reply_NO_SUCH_FILE {
+						t.Fatalf("Bad reply to deleting a deleted file: %s", reply)
+					}
+				},
+			},
+		},
+	})
+}
+
+func TestDeleteFileDuringUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var id [32]byte
+	account := NewAccount(&Server{baseDirectory: dir}, &id)
+	if err := os.MkdirAll(account.Path(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	file, _, reply := account.StartUpload(1, 100)
+	if reply != nil {
+		t.Fatalf("Bad reply to starting upload: %s", reply)
+	}
+	file.Write(make([]byte, 10))
+	file.Close()
+
+	if reply := account.DeleteFile(1); reply != nil {
+		t.Fatalf("Bad reply to deleting file during upload: %s", reply)
+	}
+	account.FinishUpload(1, 10)
+
+	if account.filesCount != 0 || account.filesSize != 0 {
+		t.Errorf("Account has %d files, totaling %d bytes, after deleting its only file", account.filesCount, account.filesSize)
+	}
+}
+
 func TestAnnounce(t *testing.T) {
 	t.Parallel()
 